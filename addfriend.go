@@ -6,6 +6,7 @@ package alpenhorn
 
 import (
 	"crypto/ed25519"
+	"crypto/mlkem"
 	"crypto/rand"
 	"crypto/subtle"
 	"encoding"
@@ -20,6 +21,9 @@ import (
 	"vuvuzela.io/alpenhorn/config"
 	"vuvuzela.io/alpenhorn/coordinator"
 	"vuvuzela.io/alpenhorn/errors"
+	"vuvuzela.io/alpenhorn/internal/keysafe"
+	"vuvuzela.io/alpenhorn/internal/tracing"
+	"vuvuzela.io/alpenhorn/internal/version"
 	"vuvuzela.io/alpenhorn/log"
 	"vuvuzela.io/alpenhorn/pkg"
 	"vuvuzela.io/alpenhorn/typesocket"
@@ -56,13 +60,18 @@ func (c *Client) addFriendMux() typesocket.Mux {
 }
 
 func (c *Client) addFriendRoundError(conn typesocket.Conn, v coordinator.RoundError) {
-	log.WithFields(log.Fields{"round": v.Round}).Errorf("error from addfriend coordinator: %s", v.Err)
+	c.logger().WithFields(log.Fields{"round": v.Round}).Errorf("error from addfriend coordinator: %s", v.Err)
 }
 
 func (c *Client) newAddFriendRound(conn typesocket.Conn, v coordinator.NewRound) {
 	c.mu.Lock()
 	defer c.mu.Unlock()
 
+	if err := version.Coordinator.Check("coordinator", v.ProtocolVersion, v.MinProtocolVersion); err != nil {
+		c.Handler.Error(errors.Wrap(err, "round %d", v.Round))
+		return
+	}
+
 	st, ok := c.addFriendRounds[v.Round]
 	if ok {
 		if st.ConfigParent.Hash() != v.ConfigHash {
@@ -112,20 +121,31 @@ func (c *Client) loadAddFriendConfig(newConfig *config.SignedConfig) *config.Add
 
 	pkgClient := &pkg.Client{
 		Username:        c.Username,
-		LoginKey:        c.PKGLoginKey,
+		LoginKey:        c.pkgLoginKey(),
 		UserLongTermKey: c.LongTermPublicKey,
 		HTTPClient:      c.edhttpClient,
+		Clock:           c.Clock,
+	}
+
+	var pqKey []byte
+	if innerConfig.IntroVersion == addfriend.IntroVersionHybrid {
+		pqKey = c.pqDecapsulationKeyLocked().EncapsulationKey().Bytes()
 	}
 
 	for _, pkgServer := range innerConfig.PKGServers {
 		err := pkgClient.CheckStatus(pkgServer)
 		if err == nil {
+			if pqKey != nil {
+				if err := pkgClient.SetPQKey(pkgServer, pqKey); err != nil {
+					c.Handler.Error(errors.Wrap(err, "failed to publish PQ key to PKG %s", pkgServer.Address))
+				}
+			}
 			continue
 		}
 
 		pkgErr, ok := err.(pkg.Error)
 		if ok && pkgErr.Code == pkg.ErrNotRegistered {
-			log.Infof("Username %q not registered with PKG %s", c.Username, pkgServer.Address)
+			c.logger().Infof("Username %q not registered with PKG %s", c.Username, pkgServer.Address)
 		} else {
 			c.Handler.Error(errors.Wrap(err, "failed to check account status with PKG %s", pkgServer.Address))
 		}
@@ -173,9 +193,10 @@ func (c *Client) extractPKGKeys(conn typesocket.Conn, v coordinator.PKGRound) {
 
 	pkgClient := &pkg.Client{
 		Username:        c.Username,
-		LoginKey:        c.PKGLoginKey,
+		LoginKey:        c.pkgLoginKey(),
 		UserLongTermKey: c.LongTermPublicKey,
 		HTTPClient:      c.edhttpClient,
+		Clock:           c.Clock,
 	}
 
 	extractFn := func(i int, pkgServer pkg.PublicServerConfig) error {
@@ -184,6 +205,11 @@ func (c *Client) extractPKGKeys(conn typesocket.Conn, v coordinator.PKGRound) {
 		st.ServerBLSKeys[i] = v.PKGSettings[hexkey].BLSPublicKey
 
 		extractResult, err := pkgClient.Extract(pkgServer, v.Round)
+		if pkgErr, ok := err.(pkg.Error); ok && pkgErr.Code == pkg.ErrExtractQuota {
+			// We extract each round's key once, so someone else
+			// may be extracting with our login key.
+			return errors.Wrap(err, "round %d: %s refused to extract our key; our PKG login key may be compromised", v.Round, pkgServer.Address)
+		}
 		if err != nil {
 			return errors.Wrap(err, "round %d: error extracting private key from %s", v.Round, pkgServer.Address)
 		}
@@ -259,6 +285,28 @@ func (c *Client) sendAddFriendOnion(conn typesocket.Conn, v coordinator.MixRound
 	}
 
 	outgoingReq := c.nextOutgoingFriendRequest()
+
+	hybrid := st.Config.IntroVersion == addfriend.IntroVersionHybrid
+	var pqKey []byte
+	if hybrid {
+		lookup := outgoingReq.Username
+		if lookup == "" {
+			lookup = c.Username
+		}
+		var err error
+		pqKey, err = c.lookupPQKey(st.Config.PKGServers, lookup)
+		if err != nil {
+			c.Handler.Error(errors.Wrap(err, "round %d", round))
+			if outgoingReq.Username != "" {
+				c.requeueFriendRequest(outgoingReq)
+				outgoingReq = &OutgoingFriendRequest{}
+			}
+			c.mu.Lock()
+			pqKey = c.pqDecapsulationKeyLocked().EncapsulationKey().Bytes()
+			c.mu.Unlock()
+		}
+	}
+
 	intro, sentReq := c.genIntro(st, outgoingReq)
 
 	var isReal int // 1 if real, 0 if cover
@@ -271,20 +319,40 @@ func (c *Client) sendAddFriendOnion(conn typesocket.Conn, v coordinator.MixRound
 	masterKey := new(ibe.MasterPublicKey).Aggregate(st.ServerMasterKeys...)
 	// Unsafe because "" is not a valid username, but this reduces timing leak:
 	id := pkg.ValidUsernameToIdentity(sentReq.Username)
-	encIntro := ibe.Encrypt(rand.Reader, masterKey, id[:], mustMarshal(intro))
+	payloadVersion := addfriend.NegotiatePayloadVersion(st.Config.PayloadVersion)
+	plaintext := mustMarshal(intro)
+	if payloadVersion != addfriend.PayloadVersionLegacy {
+		plaintext = addfriend.PadIntro(payloadVersion, plaintext)
+	}
+	encIntro := ibe.Encrypt(rand.Reader, masterKey, id[:], plaintext)
 	encIntroBytes := mustMarshal(encIntro)
 
-	mixMessage := new(addfriend.MixMessage)
-	mixMessage.Mailbox = usernameToMailbox(sentReq.Username, serviceData.NumMailboxes)
-	subtle.ConstantTimeCopy(isReal, mixMessage.EncryptedIntro[:], encIntroBytes)
+	var msg []byte
+	mailbox := usernameToMailbox(sentReq.Username, serviceData.NumMailboxes)
+	innerIntro := make([]byte, addfriend.EncryptedIntroSize(addfriend.IntroVersionIBE, payloadVersion))
+	subtle.ConstantTimeCopy(isReal, innerIntro, encIntroBytes)
+	if hybrid {
+		hybridIntro, err := addfriend.SealHybrid(pqKey, innerIntro)
+		if err != nil {
+			c.Handler.Error(errors.Wrap(err, "round %d: sealing hybrid intro", round))
+			return
+		}
+		msg = addfriend.MarshalMixMessage(mailbox, hybridIntro)
+	} else {
+		msg = addfriend.MarshalMixMessage(mailbox, innerIntro)
+	}
 
-	onion, _ := onionbox.Seal(mustMarshal(mixMessage), mixnet.ForwardNonce(round), v.MixSettings.OnionKeys)
+	onion, _ := onionbox.Seal(msg, mixnet.ForwardNonce(round), v.MixSettings.OnionKeys)
 
 	omsg := coordinator.OnionMsg{
 		Round: round,
 		Onion: onion,
 	}
-	conn.Send("onion", omsg)
+	_, span := tracing.StartRound(serviceData.TraceParent, "client.SubmitOnion", "AddFriend", round)
+	tracing.End(span, conn.Send("onion", omsg))
+	if isReal == 0 {
+		c.usage.cover.Add(len(onion), 0)
+	}
 
 	if sentReq.Username != "" {
 		c.Handler.SentFriendRequest(outgoingReq)
@@ -379,7 +447,8 @@ func (c *Client) scanMailbox(conn typesocket.Conn, v coordinator.MailboxURL) {
 		c.Handler.Error(errors.Wrap(err, "fetching mailbox"))
 		return
 	}
-	if len(mailbox) == 0 || len(mailbox)%addfriend.SizeEncryptedIntro != 0 {
+	introSize := addfriend.EncryptedIntroSize(st.Config.IntroVersion, st.Config.PayloadVersion)
+	if len(mailbox) == 0 || len(mailbox)%introSize != 0 {
 		c.Handler.Error(errors.New("round %d: malformed addfriend mailbox: id=%d len=%d", v.Round, mailboxID, len(mailbox)))
 		return
 	}
@@ -393,15 +462,29 @@ func (c *Client) scanMailbox(conn typesocket.Conn, v coordinator.MailboxURL) {
 	privKey := new(ibe.IdentityPrivateKey).Aggregate(st.PrivateKeys...)
 	st.mu.Unlock()
 
-	intros := concurrency.Spans(len(mailbox), addfriend.SizeEncryptedIntro)
+	var pqKey *mlkem.DecapsulationKey768
+	if st.Config.IntroVersion == addfriend.IntroVersionHybrid {
+		c.mu.Lock()
+		pqKey = c.pqDecapsulationKeyLocked()
+		c.mu.Unlock()
+	}
+
+	intros := concurrency.Spans(len(mailbox), introSize)
 	//log.WithFields(log.Fields{"round": v.Round, "intros": len(intros), "mailbox": mailboxID}).Info("Scanning mailbox")
 	concurrency.ParallelFor(len(intros), func(p *concurrency.P) {
 		for i, ok := p.Next(); ok; i, ok = p.Next() {
 			span := intros[i]
 			var ctxt ibe.Ciphertext
 			ctxtBytes := mailbox[span.Start : span.Start+span.Count]
+			if pqKey != nil {
+				var ok bool
+				ctxtBytes, ok = addfriend.OpenHybrid(pqKey, ctxtBytes)
+				if !ok {
+					continue
+				}
+			}
 			if err := ctxt.UnmarshalBinary(ctxtBytes); err != nil {
-				log.Warnf("Unmarshal failure: %s", err)
+				c.logger().Warnf("Unmarshal failure: %s", err)
 				continue
 			}
 
@@ -421,13 +504,19 @@ func (c *Client) scanMailbox(conn typesocket.Conn, v coordinator.MailboxURL) {
 }
 
 func (c *Client) decodeAddFriendMessage(msg []byte, verifiers []pkg.PublicServerConfig, multisigKeys []*bls.PublicKey) {
+	if len(msg) == addfriend.SizePaddedIntro {
+		var ok bool
+		if _, msg, ok = addfriend.UnpadIntro(msg); !ok {
+			return
+		}
+	}
 	intro := new(introduction)
 	if err := intro.UnmarshalBinary(msg); err != nil {
 		return
 	}
 
 	if !intro.Verify(multisigKeys) {
-		log.Warnf("failed to verify intro: %s", intro.Username)
+		c.logger().Warnf("failed to verify intro: %s", intro.Username)
 		return
 	}
 
@@ -480,6 +569,8 @@ func (c *Client) newFriend(in *IncomingFriendRequest, sent *sentFriendRequest) {
 	sharedKey := new([32]byte)
 	box.Precompute(sharedKey, in.DHPublicKey, sent.DHPrivateKey)
 	c.wheel.Put(in.Username, in.DialRound, sharedKey)
+	// The sent request is deleted below, so its DH key is no longer needed.
+	keysafe.Zero32(sent.DHPrivateKey)
 
 	friend := &Friend{
 		Username:    in.Username,
@@ -7,6 +7,7 @@ package addfriend
 
 import (
 	"bytes"
+	"context"
 	"crypto/ed25519"
 	"encoding/binary"
 	"encoding/gob"
@@ -20,6 +21,9 @@ import (
 
 	"vuvuzela.io/alpenhorn/edhttp"
 	"vuvuzela.io/alpenhorn/errors"
+	"vuvuzela.io/alpenhorn/internal/rng"
+	"vuvuzela.io/alpenhorn/internal/tracing"
+	"vuvuzela.io/alpenhorn/internal/version"
 	"vuvuzela.io/concurrency"
 	"vuvuzela.io/crypto/bn256"
 	"vuvuzela.io/crypto/ibe"
@@ -51,6 +55,15 @@ type Mixer struct {
 
 	Laplace rand.Laplace
 
+	// IntroVersion is the introduction format the mixer expects,
+	// matching the AddFriend config. Zero means IntroVersionIBE.
+	IntroVersion int
+
+	// PayloadVersion is the payload format version in the AddFriend
+	// config. Versions above zero share a size, so the mixer only
+	// needs to know whether payloads are padded.
+	PayloadVersion int
+
 	once      sync.Once
 	cdnClient *edhttp.Client
 }
@@ -60,7 +73,7 @@ func (srv *Mixer) Bidirectional() bool {
 }
 
 func (srv *Mixer) SizeIncomingMessage() int {
-	return sizeMixMessage
+	return sizeMixMessageVersion(srv.IntroVersion, srv.PayloadVersion)
 }
 
 func (srv *Mixer) SizeReplyMessage() int {
@@ -71,21 +84,66 @@ type ServiceData struct {
 	CDNKey       ed25519.PublicKey
 	CDNAddress   string
 	NumMailboxes uint32
+
+	// IntroVersion is the introduction format for the round.
+	IntroVersion int `json:",omitempty"`
+
+	// PayloadVersion is the payload format version for the round.
+	PayloadVersion int `json:",omitempty"`
+
+	// MixnetProtocol and MinMixnetProtocol are the coordinator's
+	// mixnet protocol versions. Zero means version 1.
+	MixnetProtocol    int `json:",omitempty"`
+	MinMixnetProtocol int `json:",omitempty"`
+
+	// TraceParent is the trace context of the coordinator's round
+	// span, so mixers and clients can add spans to the round.
+	TraceParent string `json:",omitempty"`
 }
 
 const AddFriendServiceDataVersion = 0
 
 func (srv *Mixer) ParseServiceData(data []byte) (interface{}, error) {
 	d := new(ServiceData)
-	err := d.Unmarshal(data)
-	return d, err
+	if err := d.Unmarshal(data); err != nil {
+		return d, err
+	}
+	if err := version.Mixnet.Check("coordinator", d.MixnetProtocol, d.MinMixnetProtocol); err != nil {
+		return d, err
+	}
+	// Messages of the wrong size are dropped, so refuse the round
+	// instead of silently discarding every request.
+	if introVersion(d.IntroVersion) != introVersion(srv.IntroVersion) {
+		return d, errors.New("round uses intro version %d, but mixer is configured for %d", d.IntroVersion, srv.IntroVersion)
+	}
+	if IntroSize(d.PayloadVersion) != IntroSize(srv.PayloadVersion) {
+		return d, errors.New("round uses payload version %d, but mixer is configured for %d", d.PayloadVersion, srv.PayloadVersion)
+	}
+	return d, nil
+}
+
+func introVersion(v int) int {
+	if v == 0 {
+		return IntroVersionIBE
+	}
+	return v
 }
 
 func (srv *Mixer) GenerateNoise(settings mixnet.RoundSettings, myPos int) [][]byte {
+	traceParent := settings.ServiceData.(*ServiceData).TraceParent
+	_, span := tracing.StartRound(traceParent, "mixer.GenerateNoise", settings.Service, settings.Round, tracing.Hop(myPos))
+	defer span.End()
+
+	// Noise sampled from a bad random source could be subtracted
+	// from the mailbox counts, so fail closed.
+	if err := rng.Err(); err != nil {
+		panic("refusing to generate noise: " + err.Error())
+	}
+
 	noiseTotal := uint32(0)
 	noiseCounts := make([]uint32, settings.ServiceData.(*ServiceData).NumMailboxes+1)
 	for b := range noiseCounts {
-		bmu := srv.Laplace.Uint32()
+		bmu := rng.Laplace(srv.Laplace.Mu, srv.Laplace.B)
 		noiseCounts[b] = bmu
 		noiseTotal += bmu
 	}
@@ -101,19 +159,26 @@ func (srv *Mixer) GenerateNoise(settings mixnet.RoundSettings, myPos int) [][]by
 	}
 
 	nextServerKeys := settings.OnionKeys[myPos+1:]
+	hybrid := srv.IntroVersion == IntroVersionHybrid
+	size := sizeMixMessageVersion(srv.IntroVersion, srv.PayloadVersion)
 
 	concurrency.ParallelFor(len(noise), func(p *concurrency.P) {
 		for i, ok := p.Next(); ok; i, ok = p.Next() {
-			var msg [sizeMixMessage]byte
+			msg := make([]byte, size)
 			binary.BigEndian.PutUint32(msg[0:4], mailbox[i])
 			if mailbox[i] != 0 {
 				// generate a valid-looking ciphertext
 				encintro := msg[4:]
-				rand.Read(encintro)
-				g1 := new(bn256.G1).HashToPoint(encintro[:32])
-				copy(encintro, g1.Marshal())
+				if _, err := rng.Read(encintro); err != nil {
+					panic(err)
+				}
+				// The hybrid outer layer has no curve point to fake.
+				if !hybrid {
+					g1 := new(bn256.G1).HashToPoint(encintro[:32])
+					copy(encintro, g1.Marshal())
+				}
 			}
-			onion, _ := onionbox.Seal(msg[:], mixnet.ForwardNonce(settings.Round), nextServerKeys)
+			onion, _ := onionbox.Seal(msg, mixnet.ForwardNonce(settings.Round), nextServerKeys)
 			noise[i] = onion
 		}
 	})
@@ -122,33 +187,44 @@ func (srv *Mixer) GenerateNoise(settings mixnet.RoundSettings, myPos int) [][]by
 }
 
 func (srv *Mixer) HandleMessages(settings mixnet.RoundSettings, messages [][]byte) (interface{}, error) {
+	traceParent := settings.ServiceData.(*ServiceData).TraceParent
+	ctx, span := tracing.StartRound(traceParent, "mixer.HandleMessages", settings.Service, settings.Round)
+	url, err := srv.handleMessages(ctx, settings, messages)
+	tracing.End(span, err)
+	return url, err
+}
+
+func (srv *Mixer) handleMessages(ctx context.Context, settings mixnet.RoundSettings, messages [][]byte) (interface{}, error) {
 	srv.once.Do(func() {
 		srv.cdnClient = &edhttp.Client{
 			Key: srv.SigningKey,
 		}
 	})
 
+	if err := rng.Err(); err != nil {
+		return nil, errors.Wrap(err, "refusing to shuffle")
+	}
+
 	serviceData := settings.ServiceData.(*ServiceData)
 
 	// The last server doesn't shuffle by default, so shuffle here.
-	shuffler := shuffle.New(rand.Reader, len(messages))
+	shuffler := shuffle.New(rng.Reader, len(messages))
 	shuffler.Shuffle(messages)
 
 	mailboxes := make(map[string][]byte)
 
-	mx := new(MixMessage)
+	// All formats are a big-endian mailbox followed by the intro.
+	size := sizeMixMessageVersion(srv.IntroVersion, srv.PayloadVersion)
 	for _, m := range messages {
-		if len(m) != sizeMixMessage {
+		if len(m) != size {
 			continue
 		}
-		if err := mx.UnmarshalBinary(m); err != nil {
-			continue
-		}
-		if mx.Mailbox == 0 {
+		mailbox := binary.BigEndian.Uint32(m[0:4])
+		if mailbox == 0 {
 			continue // dummy dead drop
 		}
-		mstr := strconv.FormatUint(uint64(mx.Mailbox), 10)
-		mailboxes[mstr] = append(mailboxes[mstr], mx.EncryptedIntro[:]...)
+		mstr := strconv.FormatUint(uint64(mailbox), 10)
+		mailboxes[mstr] = append(mailboxes[mstr], m[4:]...)
 	}
 
 	buf := new(bytes.Buffer)
@@ -158,11 +234,20 @@ func (srv *Mixer) HandleMessages(settings mixnet.RoundSettings, messages [][]byt
 	}
 
 	putURL := fmt.Sprintf("https://%s/put?bucket=%s/%d", serviceData.CDNAddress, settings.Service, settings.Round)
-	resp, err := srv.cdnClient.Post(serviceData.CDNKey, putURL, "application/octet-stream", buf)
+	req, err := version.CDN.NewRequest("POST", putURL, buf)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/octet-stream")
+	tracing.Inject(ctx, req.Header)
+	resp, err := srv.cdnClient.Do(serviceData.CDNKey, req)
 	if err != nil {
 		return "", err
 	}
 	defer resp.Body.Close()
+	if err := version.CDN.CheckHeader("cdn server", resp.Header); err != nil {
+		return "", err
+	}
 	if resp.StatusCode != http.StatusOK {
 		msg, _ := ioutil.ReadAll(resp.Body)
 		err = errors.New("bad CDN response: %s: %q", resp.Status, msg)
@@ -0,0 +1,88 @@
+// Copyright 2018 David Lazar. All rights reserved.
+// Use of this source code is governed by the GNU AGPL
+// license that can be found in the LICENSE file.
+
+package addfriend
+
+import (
+	"encoding/binary"
+
+	"vuvuzela.io/crypto/ibe"
+)
+
+// Payload format versions of the plaintext introduction, selected by
+// the PayloadVersion field of the AddFriend config. Version 0 is the
+// original unpadded introduction. Every later version has the same
+// padded size and starts with its version byte, so new fields can be
+// added to the reserved padding without changing the message size,
+// and clients that do not know about them still read the fields they
+// do know.
+const (
+	PayloadVersionLegacy = 0
+	PayloadVersion1      = 1
+
+	// MaxPayloadVersion is the highest version this package writes.
+	MaxPayloadVersion = PayloadVersion1
+
+	// SizePaddedIntro is the size of a padded introduction.
+	SizePaddedIntro = 512
+)
+
+// NegotiatePayloadVersion returns the payload version to write when
+// the config selects configured: the highest version supported by
+// both the config and this client.
+func NegotiatePayloadVersion(configured int) int {
+	if configured > MaxPayloadVersion {
+		return MaxPayloadVersion
+	}
+	return configured
+}
+
+// IntroSize returns the size of a plaintext introduction in the given
+// payload version.
+func IntroSize(payloadVersion int) int {
+	if payloadVersion == PayloadVersionLegacy {
+		return SizeIntro
+	}
+	return SizePaddedIntro
+}
+
+// PadIntro prefixes an introduction with its payload version and pads
+// it to SizePaddedIntro bytes. The padding is reserved for fields of
+// later versions and must be zero in version 1.
+func PadIntro(payloadVersion int, intro []byte) []byte {
+	if payloadVersion <= PayloadVersionLegacy || payloadVersion > 255 {
+		panic("invalid payload version")
+	}
+	if 1+len(intro) > SizePaddedIntro {
+		panic("introduction too large to pad")
+	}
+	padded := make([]byte, SizePaddedIntro)
+	padded[0] = byte(payloadVersion)
+	copy(padded[1:], intro)
+	return padded
+}
+
+// UnpadIntro reverses PadIntro, returning the version and the version 1
+// introduction fields. Introductions from later versions are accepted:
+// their version 1 fields are in the same place.
+func UnpadIntro(data []byte) (payloadVersion int, intro []byte, ok bool) {
+	if len(data) != SizePaddedIntro || data[0] == PayloadVersionLegacy {
+		return 0, nil, false
+	}
+	return int(data[0]), data[1 : 1+SizeIntro], true
+}
+
+// sizeEncryptedIntroPayload is the size of an IBE-encrypted intro.
+func sizeEncryptedIntroPayload(payloadVersion int) int {
+	return IntroSize(payloadVersion) + ibe.Overhead
+}
+
+// MarshalMixMessage encodes a mix message for an encrypted intro of any
+// format: a big-endian mailbox followed by the intro.
+func MarshalMixMessage(mailbox uint32, encryptedIntro []byte) []byte {
+	msg := make([]byte, 4+len(encryptedIntro))
+	binary.BigEndian.PutUint32(msg[0:4], mailbox)
+	copy(msg[4:], encryptedIntro)
+	return msg
+}
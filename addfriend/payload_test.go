@@ -0,0 +1,47 @@
+// Copyright 2018 David Lazar. All rights reserved.
+// Use of this source code is governed by the GNU AGPL
+// license that can be found in the LICENSE file.
+
+package addfriend
+
+import (
+	"bytes"
+	"crypto/rand"
+	"testing"
+)
+
+func TestPadIntro(t *testing.T) {
+	if sizeMixMessageVersion(IntroVersionIBE, PayloadVersionLegacy) != sizeMixMessage {
+		t.Fatalf("legacy mix message size changed: %d != %d", sizeMixMessageVersion(IntroVersionIBE, PayloadVersionLegacy), sizeMixMessage)
+	}
+
+	intro := make([]byte, SizeIntro)
+	rand.Read(intro)
+
+	padded := PadIntro(PayloadVersion1, intro)
+	if len(padded) != IntroSize(PayloadVersion1) {
+		t.Fatalf("padded intro is %d bytes, want %d", len(padded), IntroSize(PayloadVersion1))
+	}
+	v, got, ok := UnpadIntro(padded)
+	if !ok || v != PayloadVersion1 || !bytes.Equal(got, intro) {
+		t.Fatalf("intro did not round-trip: version=%d ok=%v", v, ok)
+	}
+
+	// A later version with extra fields in the padding still
+	// yields the version 1 fields.
+	future := PadIntro(MaxPayloadVersion+1, intro)
+	future[len(future)-1] = 0xFF
+	v, got, ok = UnpadIntro(future)
+	if !ok || v != MaxPayloadVersion+1 || !bytes.Equal(got, intro) {
+		t.Fatalf("failed to read future intro: version=%d ok=%v", v, ok)
+	}
+
+	padded[0] = PayloadVersionLegacy
+	if _, _, ok := UnpadIntro(padded); ok {
+		t.Fatal("accepted padded intro with version 0")
+	}
+
+	if NegotiatePayloadVersion(MaxPayloadVersion+1) != MaxPayloadVersion {
+		t.Fatal("negotiated a version above MaxPayloadVersion")
+	}
+}
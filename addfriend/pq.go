@@ -0,0 +1,108 @@
+// Copyright 2018 David Lazar. All rights reserved.
+// Use of this source code is governed by the GNU AGPL
+// license that can be found in the LICENSE file.
+
+package addfriend
+
+import (
+	"bytes"
+	"crypto/mlkem"
+	"encoding/binary"
+	"unsafe"
+
+	"golang.org/x/crypto/nacl/secretbox"
+
+	"vuvuzela.io/alpenhorn/errors"
+)
+
+// Introduction format versions, selected by the AddFriend config.
+const (
+	// IntroVersionIBE encrypts introductions with IBE only.
+	IntroVersionIBE = 1
+
+	// IntroVersionHybrid wraps the IBE ciphertext in a second layer
+	// keyed by an ML-KEM-768 encapsulation to the recipient's PQ key,
+	// so recorded requests stay confidential even if the pairing is
+	// broken later.
+	IntroVersionHybrid = 2
+)
+
+const (
+	// PQPublicKeySize is the size of a user's ML-KEM-768 public key.
+	PQPublicKeySize = mlkem.EncapsulationKeySize768
+
+	// PQSeedSize is the size of the seed a PQ private key is derived from.
+	PQSeedSize = mlkem.SeedSize
+
+	// HybridOverhead is the number of bytes SealHybrid adds.
+	HybridOverhead = mlkem.CiphertextSize768 + secretbox.Overhead
+
+	// SizeHybridEncryptedIntro is the size of an encrypted introduction
+	// in the hybrid format.
+	SizeHybridEncryptedIntro = SizeEncryptedIntro + HybridOverhead
+
+	sizeHybridMixMessage = int(unsafe.Sizeof(HybridMixMessage{}))
+)
+
+type HybridMixMessage struct {
+	Mailbox        uint32
+	EncryptedIntro [SizeHybridEncryptedIntro]byte
+}
+
+// EncryptedIntroSize returns the size of an encrypted introduction
+// in the given intro and payload format versions.
+func EncryptedIntroSize(version int, payloadVersion int) int {
+	size := sizeEncryptedIntroPayload(payloadVersion)
+	if version == IntroVersionHybrid {
+		size += HybridOverhead
+	}
+	return size
+}
+
+func sizeMixMessageVersion(version int, payloadVersion int) int {
+	return 4 + EncryptedIntroSize(version, payloadVersion)
+}
+
+// The shared key is fresh for every message, so a fixed nonce is safe.
+var zeroNonce = new([24]byte)
+
+// SealHybrid encrypts an IBE-encrypted introduction to the ML-KEM
+// public key pqKey. The result is HybridOverhead bytes longer than ctxt.
+func SealHybrid(pqKey []byte, ctxt []byte) ([]byte, error) {
+	ek, err := mlkem.NewEncapsulationKey768(pqKey)
+	if err != nil {
+		return nil, errors.Wrap(err, "parsing PQ key")
+	}
+	sharedKey, kemCtxt := ek.Encapsulate()
+	key := new([32]byte)
+	copy(key[:], sharedKey)
+	return secretbox.Seal(kemCtxt, ctxt, zeroNonce, key), nil
+}
+
+// OpenHybrid reverses SealHybrid using the recipient's ML-KEM private
+// key, returning the inner IBE ciphertext.
+func OpenHybrid(dk *mlkem.DecapsulationKey768, ctxt []byte) ([]byte, bool) {
+	if len(ctxt) < HybridOverhead {
+		return nil, false
+	}
+	sharedKey, err := dk.Decapsulate(ctxt[:mlkem.CiphertextSize768])
+	if err != nil {
+		return nil, false
+	}
+	key := new([32]byte)
+	copy(key[:], sharedKey)
+	return secretbox.Open(nil, ctxt[mlkem.CiphertextSize768:], zeroNonce, key)
+}
+
+func (m *HybridMixMessage) MarshalBinary() ([]byte, error) {
+	buf := new(bytes.Buffer)
+	if err := binary.Write(buf, binary.BigEndian, m); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (m *HybridMixMessage) UnmarshalBinary(data []byte) error {
+	buf := bytes.NewReader(data)
+	return binary.Read(buf, binary.BigEndian, m)
+}
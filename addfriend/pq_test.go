@@ -0,0 +1,42 @@
+// Copyright 2018 David Lazar. All rights reserved.
+// Use of this source code is governed by the GNU AGPL
+// license that can be found in the LICENSE file.
+
+package addfriend
+
+import (
+	"bytes"
+	"crypto/mlkem"
+	"crypto/rand"
+	"testing"
+)
+
+func TestHybrid(t *testing.T) {
+	dk, _ := mlkem.GenerateKey768()
+	ibeCtxt := make([]byte, SizeEncryptedIntro)
+	rand.Read(ibeCtxt)
+
+	ctxt, err := SealHybrid(dk.EncapsulationKey().Bytes(), ibeCtxt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ctxt) != SizeHybridEncryptedIntro {
+		t.Fatalf("got %d bytes, want %d", len(ctxt), SizeHybridEncryptedIntro)
+	}
+	if sizeHybridMixMessage != 4+SizeHybridEncryptedIntro {
+		t.Fatalf("hybrid mix message has padding: %d", sizeHybridMixMessage)
+	}
+
+	msg, ok := OpenHybrid(dk, ctxt)
+	if !ok {
+		t.Fatal("failed to open hybrid ciphertext")
+	}
+	if !bytes.Equal(msg, ibeCtxt) {
+		t.Fatal("opened ciphertext does not match")
+	}
+
+	other, _ := mlkem.GenerateKey768()
+	if _, ok := OpenHybrid(other, ctxt); ok {
+		t.Fatal("opened hybrid ciphertext with the wrong key")
+	}
+}
@@ -0,0 +1,17 @@
+// Copyright 2018 David Lazar. All rights reserved.
+// Use of this source code is governed by the GNU AGPL
+// license that can be found in the LICENSE file.
+
+// Package browser helps run the Alpenhorn client in a web browser.
+// The client library builds with GOOS=js GOARCH=wasm, and in the
+// browser it talks to servers with the Fetch and WebSocket APIs.
+// IndexedDB stores the client's state in place of files:
+//
+//	db, err := browser.OpenIndexedDB("alpenhorn")
+//	...
+//	client, err := alpenhorn.LoadClientFrom(db, "client", "keywheel")
+//
+// The browser does its own TLS, so servers are authenticated by web
+// PKI certificates rather than their Alpenhorn keys. Browser clients
+// are meant for experiments and demos.
+package browser
@@ -0,0 +1,118 @@
+// Copyright 2018 David Lazar. All rights reserved.
+// Use of this source code is governed by the GNU AGPL
+// license that can be found in the LICENSE file.
+
+//go:build js
+// +build js
+
+package browser
+
+import (
+	"os"
+	"syscall/js"
+
+	"vuvuzela.io/alpenhorn/errors"
+)
+
+// objectStore is the name of the object store that holds the state.
+const objectStore = "state"
+
+// IndexedDB is an alpenhorn.Storage that keeps the client's state in
+// an IndexedDB database. Its methods wait for the browser, so they
+// must not be called from a JavaScript callback.
+type IndexedDB struct {
+	db js.Value
+}
+
+// OpenIndexedDB opens the named database, creating it if needed.
+func OpenIndexedDB(name string) (*IndexedDB, error) {
+	indexedDB := js.Global().Get("indexedDB")
+	if !indexedDB.Truthy() {
+		return nil, errors.New("IndexedDB is not available")
+	}
+	req := indexedDB.Call("open", name, 1)
+
+	upgrade := js.FuncOf(func(this js.Value, args []js.Value) interface{} {
+		req.Get("result").Call("createObjectStore", objectStore)
+		return nil
+	})
+	defer upgrade.Release()
+	req.Call("addEventListener", "upgradeneeded", upgrade)
+
+	if err := wait(req, "success", "error"); err != nil {
+		return nil, errors.Wrap(err, "opening IndexedDB %q", name)
+	}
+	return &IndexedDB{db: req.Get("result")}, nil
+}
+
+func (d *IndexedDB) Close() {
+	d.db.Call("close")
+}
+
+// ReadFile returns the named state. If there is none, the error
+// satisfies os.IsNotExist.
+func (d *IndexedDB) ReadFile(name string) ([]byte, error) {
+	tx := d.db.Call("transaction", objectStore, "readonly")
+	req := tx.Call("objectStore", objectStore).Call("get", name)
+	if err := wait(req, "success", "error"); err != nil {
+		return nil, errors.Wrap(err, "reading %q", name)
+	}
+	v := req.Get("result")
+	if v.IsUndefined() {
+		return nil, &os.PathError{Op: "read", Path: name, Err: os.ErrNotExist}
+	}
+	data := make([]byte, v.Length())
+	js.CopyBytesToGo(data, v)
+	return data, nil
+}
+
+// WriteFile stores data under name. It returns once the transaction
+// has committed, and a failed write leaves the old state in place.
+func (d *IndexedDB) WriteFile(name string, data []byte) error {
+	buf := js.Global().Get("Uint8Array").New(len(data))
+	js.CopyBytesToJS(buf, data)
+
+	tx := d.db.Call("transaction", objectStore, "readwrite")
+	tx.Call("objectStore", objectStore).Call("put", buf, name)
+	if err := wait(tx, "complete", "error", "abort"); err != nil {
+		return errors.Wrap(err, "writing %q", name)
+	}
+	return nil
+}
+
+// wait waits for target to fire the success event or one of the
+// failure events, and returns target's error in the latter case.
+func wait(target js.Value, success string, failures ...string) error {
+	done := make(chan error, 1)
+	send := func(err error) {
+		select {
+		case done <- err:
+		default:
+		}
+	}
+
+	onSuccess := js.FuncOf(func(this js.Value, args []js.Value) interface{} {
+		send(nil)
+		return nil
+	})
+	defer onSuccess.Release()
+	target.Call("addEventListener", success, onSuccess)
+
+	onFailure := js.FuncOf(func(this js.Value, args []js.Value) interface{} {
+		send(jsError(target.Get("error"), args[0].Get("type").String()))
+		return nil
+	})
+	defer onFailure.Release()
+	for _, event := range failures {
+		target.Call("addEventListener", event, onFailure)
+	}
+
+	return <-done
+}
+
+func jsError(v js.Value, event string) error {
+	if v.Truthy() {
+		return errors.New("%s: %s", v.Get("name").String(), v.Get("message").String())
+	}
+	return errors.New("IndexedDB %s", event)
+}
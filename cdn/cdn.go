@@ -2,6 +2,9 @@
 // Use of this source code is governed by the GNU AGPL
 // license that can be found in the LICENSE file.
 
+//go:build !js
+// +build !js
+
 // Package cdn simulates a basic CDN server.
 package cdn
 
@@ -9,6 +12,7 @@ import (
 	"bytes"
 	"crypto/ed25519"
 	"encoding/gob"
+	"encoding/json"
 	"fmt"
 	"log"
 	"net/http"
@@ -19,6 +23,10 @@ import (
 
 	"github.com/boltdb/bolt"
 	"github.com/davidlazar/go-crypto/encoding/base32"
+
+	"vuvuzela.io/alpenhorn/internal/fault"
+	"vuvuzela.io/alpenhorn/internal/keysafe"
+	"vuvuzela.io/alpenhorn/internal/version"
 )
 
 type Server struct {
@@ -63,17 +71,68 @@ func (srv *Server) Close() error {
 }
 
 func (srv *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	version.CDN.SetHeader(w.Header())
+	if r.URL.Path != "/version" {
+		if err := version.CDN.CheckHeader("client", r.Header); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
 	if strings.HasPrefix(r.URL.Path, "/get") {
 		srv.get(w, r)
 	} else if strings.HasPrefix(r.URL.Path, "/put") {
 		srv.put(w, r)
+	} else if r.URL.Path == "/pir" {
+		srv.pir(w, r)
 	} else if strings.HasPrefix(r.URL.Path, "/newbucket") {
 		srv.newBucket(w, r)
+	} else if r.URL.Path == "/stats" {
+		srv.statsHandler(w, r)
+	} else if r.URL.Path == "/version" {
+		version.ServeHTTP(w, r)
 	} else {
 		http.Error(w, "not found", http.StatusNotFound)
 	}
 }
 
+// Stats returns the number of buckets and keys stored in the CDN.
+func (srv *Server) Stats() (Stats, error) {
+	var stats Stats
+	err := srv.db.View(func(tx *bolt.Tx) error {
+		stats.SizeBytes = tx.Size()
+		return tx.ForEach(func(name []byte, b *bolt.Bucket) error {
+			if string(name) == "Expires" {
+				return nil
+			}
+			stats.Buckets++
+			stats.Keys += b.Stats().KeyN
+			return nil
+		})
+	})
+	return stats, err
+}
+
+func (srv *Server) statsHandler(w http.ResponseWriter, req *http.Request) {
+	if len(req.TLS.PeerCertificates) == 0 {
+		http.Error(w, "expecting peer tls certificate", http.StatusBadRequest)
+		return
+	}
+	peerKey, ok := req.TLS.PeerCertificates[0].PublicKey.(ed25519.PublicKey)
+	if !ok || !keysafe.Equal(peerKey, srv.coordinatorKey) {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	stats, err := srv.Stats()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(stats)
+}
+
 func parseURL(u *url.URL) (cdnBucket, boltBucket, prefix string, err error) {
 	b := u.Query().Get("bucket")
 	parts := strings.Split(b, "/")
@@ -115,7 +174,7 @@ func (srv *Server) newBucket(w http.ResponseWriter, req *http.Request) {
 		http.Error(w, "expecting ed25519 certificate", http.StatusUnauthorized)
 		return
 	}
-	if !bytes.Equal(peerKey, srv.coordinatorKey) {
+	if !keysafe.Equal(peerKey, srv.coordinatorKey) {
 		http.Error(w, "unauthorized", http.StatusUnauthorized)
 		return
 	}
@@ -171,7 +230,7 @@ func (srv *Server) put(w http.ResponseWriter, req *http.Request) {
 		http.Error(w, fmt.Sprintf("bucket not found: %s", cdnBucket), http.StatusBadRequest)
 		return
 	}
-	if !bytes.Equal(peerKey, expectedKey) {
+	if !keysafe.Equal(peerKey, expectedKey) {
 		http.Error(w, "unauthorized", http.StatusUnauthorized)
 		return
 	}
@@ -183,6 +242,10 @@ func (srv *Server) put(w http.ResponseWriter, req *http.Request) {
 		return
 	}
 
+	if err := fault.Inject(fault.CDNDB); err != nil {
+		http.Error(w, fmt.Sprintf("internal DB error: %s", err), http.StatusInternalServerError)
+		return
+	}
 	err = srv.db.Update(func(tx *bolt.Tx) error {
 		eb := tx.Bucket([]byte("Expires"))
 
@@ -225,6 +288,11 @@ func (srv *Server) get(w http.ResponseWriter, req *http.Request) {
 		return
 	}
 
+	if err := fault.Inject(fault.CDNDB); err != nil {
+		http.Error(w, fmt.Sprintf("internal DB error: %s", err), http.StatusInternalServerError)
+		return
+	}
+
 	var val []byte
 	srv.db.View(func(tx *bolt.Tx) error {
 		b := tx.Bucket([]byte(boltBucket))
@@ -240,6 +308,7 @@ func (srv *Server) get(w http.ResponseWriter, req *http.Request) {
 		return nil
 	})
 
+	val = fault.Corrupt(fault.CDNDB, val)
 	if val == nil {
 		http.Error(w, fmt.Sprintf("key not found: %s/%s", cdnBucket, key), http.StatusNotFound)
 		return
@@ -86,6 +86,14 @@ func TestCDN(t *testing.T) {
 		if resp.StatusCode != http.StatusOK {
 			t.Fatalf("bad response status: %s; body = %q", resp.Status, body)
 		}
+
+		stats, err := cdn.Stats()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if stats.Buckets != 1 || stats.Keys != 2 {
+			t.Fatalf("unexpected stats: %+v", stats)
+		}
 	}
 
 	{
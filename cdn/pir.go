@@ -0,0 +1,85 @@
+// Copyright 2018 David Lazar. All rights reserved.
+// Use of this source code is governed by the GNU AGPL
+// license that can be found in the LICENSE file.
+
+package cdn
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+)
+
+// Experimental multi-server private information retrieval (the XOR
+// scheme of Chor et al.). A client that wants mailbox i of n sends each
+// of k mirrors a random subset of the mailboxes, chosen so the subsets
+// XOR to {i}, and XORs the answers. Each mirror sees a uniformly random
+// subset, so the client's mailbox stays hidden unless all k mirrors
+// collude. The mirrors must serve identical buckets.
+//
+// Mailboxes are numbered from 1, and bit j of a query selects mailbox
+// j+1. Each mailbox is encoded as a record: its 4-byte length, the
+// mailbox, and zero padding up to the longest mailbox in the bucket.
+
+// MaxPIRMailboxes bounds the number of mailboxes a PIR query may cover.
+const MaxPIRMailboxes = 1 << 20
+
+// NewPIRQueries returns one query per mirror for the given mailbox.
+func NewPIRQueries(numMirrors int, numMailboxes uint32, mailbox uint32) ([][]byte, error) {
+	if numMirrors < 2 {
+		return nil, fmt.Errorf("PIR needs at least 2 mirrors, got %d", numMirrors)
+	}
+	if mailbox == 0 || mailbox > numMailboxes {
+		return nil, fmt.Errorf("mailbox %d out of range", mailbox)
+	}
+	size := pirQuerySize(numMailboxes)
+	queries := make([][]byte, numMirrors)
+	last := make([]byte, size)
+	for i := 0; i < numMirrors-1; i++ {
+		queries[i] = make([]byte, size)
+		if _, err := rand.Read(queries[i]); err != nil {
+			return nil, err
+		}
+		// Keep unused bits clear so queries look the same.
+		if r := numMailboxes % 8; r != 0 {
+			queries[i][size-1] &= byte(1<<r) - 1
+		}
+		xorInto(last, queries[i])
+	}
+	i := mailbox - 1
+	last[i/8] ^= 1 << (i % 8)
+	queries[numMirrors-1] = last
+	return queries, nil
+}
+
+// CombinePIRAnswers XORs the mirrors' answers and decodes the mailbox.
+func CombinePIRAnswers(answers [][]byte) ([]byte, error) {
+	if len(answers) == 0 {
+		return nil, fmt.Errorf("no answers")
+	}
+	record := make([]byte, len(answers[0]))
+	for i, a := range answers {
+		if len(a) != len(record) {
+			return nil, fmt.Errorf("answer %d has length %d, want %d; mirrors differ", i, len(a), len(record))
+		}
+		xorInto(record, a)
+	}
+	if len(record) < 4 {
+		return nil, fmt.Errorf("short answer: %d bytes", len(record))
+	}
+	n := binary.BigEndian.Uint32(record)
+	if int(n) > len(record)-4 {
+		return nil, fmt.Errorf("bad record length: %d", n)
+	}
+	return record[4 : 4+n], nil
+}
+
+func pirQuerySize(numMailboxes uint32) int {
+	return int((numMailboxes + 7) / 8)
+}
+
+func xorInto(dst, src []byte) {
+	for i := range src {
+		dst[i] ^= src[i]
+	}
+}
@@ -0,0 +1,81 @@
+// Copyright 2018 David Lazar. All rights reserved.
+// Use of this source code is governed by the GNU AGPL
+// license that can be found in the LICENSE file.
+
+package cdn
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+
+	"github.com/boltdb/bolt"
+)
+
+func TestPIR(t *testing.T) {
+	dir, err := ioutil.TempDir("", "TestPIR")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	srv, err := New(filepath.Join(dir, "cdn.db"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+
+	const numMailboxes = 11
+	mailboxes := make([][]byte, numMailboxes+1)
+	err = srv.db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucketIfNotExists([]byte("dialing"))
+		if err != nil {
+			return err
+		}
+		for i := 1; i <= numMailboxes; i++ {
+			if i == 4 {
+				// Leave mailbox 4 empty.
+				continue
+			}
+			mailboxes[i] = bytes.Repeat([]byte{byte(i)}, 10*i)
+			if err := b.Put([]byte("42/"+strconv.Itoa(i)), mailboxes[i]); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for mailbox := uint32(1); mailbox <= numMailboxes; mailbox++ {
+		queries, err := NewPIRQueries(3, numMailboxes, mailbox)
+		if err != nil {
+			t.Fatal(err)
+		}
+		answers := make([][]byte, len(queries))
+		for i, q := range queries {
+			answers[i], err = srv.pirAnswer("dialing", "42", numMailboxes, q)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		got, err := CombinePIRAnswers(answers)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, mailboxes[mailbox]) {
+			t.Fatalf("mailbox %d: got %x, want %x", mailbox, got, mailboxes[mailbox])
+		}
+	}
+
+	if _, err := srv.pirAnswer("dialing", "42", numMailboxes, make([]byte, 1)); err == nil {
+		t.Fatal("expected error for short query")
+	}
+	if _, err := NewPIRQueries(1, numMailboxes, 1); err == nil {
+		t.Fatal("expected error for a single mirror")
+	}
+}
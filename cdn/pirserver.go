@@ -0,0 +1,93 @@
+// Copyright 2018 David Lazar. All rights reserved.
+// Use of this source code is governed by the GNU AGPL
+// license that can be found in the LICENSE file.
+
+//go:build !js
+// +build !js
+
+package cdn
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+
+	"github.com/boltdb/bolt"
+
+	"vuvuzela.io/alpenhorn/internal/fault"
+)
+
+// pirAnswer XORs the records of the mailboxes selected by query.
+func (srv *Server) pirAnswer(boltBucket, prefix string, numMailboxes uint32, query []byte) ([]byte, error) {
+	if len(query) != pirQuerySize(numMailboxes) {
+		return nil, fmt.Errorf("bad query size: got %d bytes, want %d", len(query), pirQuerySize(numMailboxes))
+	}
+
+	var answer []byte
+	err := srv.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(boltBucket))
+		if b == nil {
+			return fmt.Errorf("bucket not found: %s/%s", boltBucket, prefix)
+		}
+		get := func(i uint32) []byte {
+			return b.Get([]byte(prefix + "/" + strconv.FormatUint(uint64(i+1), 10)))
+		}
+
+		maxLen := 0
+		for i := uint32(0); i < numMailboxes; i++ {
+			if l := len(get(i)); l > maxLen {
+				maxLen = l
+			}
+		}
+
+		answer = make([]byte, 4+maxLen)
+		record := make([]byte, 4+maxLen)
+		for i := uint32(0); i < numMailboxes; i++ {
+			if query[i/8]&(1<<(i%8)) == 0 {
+				continue
+			}
+			v := get(i)
+			binary.BigEndian.PutUint32(record, uint32(len(v)))
+			n := copy(record[4:], v)
+			for j := 4 + n; j < len(record); j++ {
+				record[j] = 0
+			}
+			xorInto(answer, record)
+		}
+		return nil
+	})
+	return answer, err
+}
+
+func (srv *Server) pir(w http.ResponseWriter, req *http.Request) {
+	_, boltBucket, prefix, err := parseURL(req.URL)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	n, err := strconv.ParseUint(req.URL.Query().Get("n"), 10, 32)
+	if err != nil || n == 0 || n > MaxPIRMailboxes {
+		http.Error(w, "invalid number of mailboxes", http.StatusBadRequest)
+		return
+	}
+
+	body := http.MaxBytesReader(w, req.Body, int64(pirQuerySize(uint32(n))))
+	query, err := ioutil.ReadAll(body)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("reading query: %s", err), http.StatusBadRequest)
+		return
+	}
+
+	if err := fault.Inject(fault.CDNDB); err != nil {
+		http.Error(w, fmt.Sprintf("internal DB error: %s", err), http.StatusInternalServerError)
+		return
+	}
+	answer, err := srv.pirAnswer(boltBucket, prefix, uint32(n), query)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	w.Write(answer)
+}
@@ -0,0 +1,12 @@
+// Copyright 2016 David Lazar. All rights reserved.
+// Use of this source code is governed by the GNU AGPL
+// license that can be found in the LICENSE file.
+
+package cdn
+
+// Stats describes the CDN's storage.
+type Stats struct {
+	Buckets   int
+	Keys      int
+	SizeBytes int64
+}
@@ -6,14 +6,17 @@
 package alpenhorn
 
 import (
+	"crypto"
 	"crypto/ed25519"
 	"fmt"
 	"sync"
 
+	"vuvuzela.io/alpenhorn/clock"
 	"vuvuzela.io/alpenhorn/config"
 	"vuvuzela.io/alpenhorn/edhttp"
 	"vuvuzela.io/alpenhorn/errors"
 	"vuvuzela.io/alpenhorn/keywheel"
+	"vuvuzela.io/alpenhorn/log"
 	"vuvuzela.io/alpenhorn/pkg"
 	"vuvuzela.io/alpenhorn/typesocket"
 )
@@ -64,10 +67,27 @@ type Client struct {
 	LongTermPrivateKey ed25519.PrivateKey
 	PKGLoginKey        ed25519.PrivateKey
 
+	// PKGLoginSigner, if not nil, is used instead of PKGLoginKey to
+	// authenticate to the PKG servers, so the login key can live in
+	// hardware such as a FIDO2 authenticator or the platform keystore
+	// (see pkg.DerivedLoginKey). It is not persisted: applications
+	// must set it again after loading the client.
+	PKGLoginSigner crypto.Signer
+
 	ConfigClient *config.Client
 
 	Handler EventHandler
 
+	// Logger is the logger used for the client's log messages. The
+	// standard logger is used if Logger is nil. Applications can set
+	// its EntryHandler, for example to log.Slog, to route the client's
+	// logs into their own logging system.
+	Logger *log.Logger
+
+	// Clock timestamps calls and data usage, and is passed on to the
+	// PKG client. The real clock is used if Clock is nil.
+	Clock clock.Clock
+
 	// ClientPersistPath is where the client writes its state when it changes.
 	// If empty, the client does not persist state.
 	ClientPersistPath string
@@ -83,11 +103,24 @@ type Client struct {
 	// from the client state).
 	KeywheelPersistPath string
 
+	// Storage is where the client persists its state, under the names
+	// ClientPersistPath and KeywheelPersistPath. If Storage is nil,
+	// they are paths of files.
+	Storage Storage
+
+	// DialingPIR fetches dialing mailboxes by private information
+	// retrieval when the dialing config lists PIR mirrors. This uses
+	// less bandwidth than downloading the mailbox, but relies on the
+	// CDN and its mirrors not all colluding. It is experimental.
+	DialingPIR bool
+
 	// wheel is the Alpenhorn keywheel. It is persisted to the KeywheelPersistPath.
 	wheel keywheel.Wheel
 
 	initOnce     sync.Once
-	edhttpClient *edhttp.Client
+	edhttpClient *edhttp.Client // for the PKGs
+	cdnClient    *edhttp.Client
+	usage        usageCounters
 
 	lastDialingRound uint32 // updated atomically
 
@@ -98,6 +131,10 @@ type Client struct {
 	addFriendConfigHash string
 	addFriendConfig     *config.SignedConfig
 
+	// pqSeed derives the ML-KEM key for hybrid add-friend intros.
+	// It is generated when the config first enables them.
+	pqSeed []byte
+
 	dialingRounds     map[uint32]*dialingRoundState
 	dialingConfigHash string
 	dialingConfig     *config.SignedConfig
@@ -112,9 +149,26 @@ type Client struct {
 	dialingConn   typesocket.Conn
 }
 
+func (c *Client) logger() *log.Logger {
+	if c.Logger == nil {
+		return log.StdLogger
+	}
+	return c.Logger
+}
+
+func (c *Client) clock() clock.Clock {
+	return clock.Or(c.Clock)
+}
+
 func (c *Client) init() {
 	c.initOnce.Do(func() {
-		c.edhttpClient = new(edhttp.Client)
+		c.usage.since = c.clock().Now()
+		c.edhttpClient = &edhttp.Client{
+			CountTraffic: c.usage.pkg.Add,
+		}
+		c.cdnClient = &edhttp.Client{
+			CountTraffic: c.usage.cdn.Add,
+		}
 
 		if c.friends == nil {
 			c.friends = make(map[string]*Friend)
@@ -127,15 +181,22 @@ func (c *Client) init() {
 
 // Register registers the username with the given PKG.
 func (c *Client) Register(server pkg.PublicServerConfig, token string) error {
+	return c.RegisterWithCaptcha(server, token, "")
+}
+
+// RegisterWithCaptcha is like Register but includes a solved CAPTCHA
+// for PKGs that require one.
+func (c *Client) RegisterWithCaptcha(server pkg.PublicServerConfig, token string, captchaToken string) error {
 	c.init()
 
 	pkgc := &pkg.Client{
 		Username:        c.Username,
-		LoginKey:        c.PKGLoginKey,
+		LoginKey:        c.pkgLoginKey(),
 		UserLongTermKey: c.LongTermPublicKey,
 		HTTPClient:      c.edhttpClient,
+		Clock:           c.Clock,
 	}
-	err := pkgc.Register(server, token)
+	err := pkgc.RegisterWithCaptcha(server, token, captchaToken)
 	if err != nil {
 		return err
 	}
@@ -143,9 +204,45 @@ func (c *Client) Register(server pkg.PublicServerConfig, token string) error {
 	return err
 }
 
+// Unregister deletes the client's account on the PKG server. The
+// server erases the username, login key, and verification records.
+func (c *Client) Unregister(server pkg.PublicServerConfig) error {
+	c.init()
+
+	pkgc := &pkg.Client{
+		Username:   c.Username,
+		LoginKey:   c.pkgLoginKey(),
+		HTTPClient: c.edhttpClient,
+		Clock:      c.Clock,
+	}
+	return pkgc.Unregister(server)
+}
+
+// Rename changes the client's username with the given PKG to
+// newUsername, using token to prove ownership of the new username.
+// Once the username is changed with every PKG, the application sends
+// the attestations to the client's friends, who pass them to
+// Friend.Rename, and restarts the client with the new Username.
+func (c *Client) Rename(server pkg.PublicServerConfig, newUsername string, token string) (*pkg.RenameAttestation, error) {
+	c.init()
+
+	pkgc := &pkg.Client{
+		Username:   c.Username,
+		LoginKey:   c.pkgLoginKey(),
+		HTTPClient: c.edhttpClient,
+		Clock:      c.Clock,
+	}
+	return pkgc.Rename(server, newUsername, token)
+}
+
 type PKGStatus struct {
 	Server pkg.PublicServerConfig
 	Error  error
+
+	// Status is the client's account status on the server, or nil
+	// if Error is set. See pkg.Status for how to use it to detect
+	// extractions the client did not make.
+	Status *pkg.Status
 }
 
 func (c *Client) PKGStatus() []PKGStatus {
@@ -153,23 +250,29 @@ func (c *Client) PKGStatus() []PKGStatus {
 
 	pkgc := &pkg.Client{
 		Username:        c.Username,
-		LoginKey:        c.PKGLoginKey,
+		LoginKey:        c.pkgLoginKey(),
 		UserLongTermKey: c.LongTermPublicKey,
 		HTTPClient:      c.edhttpClient,
+		Clock:           c.Clock,
 	}
-	c.mu.Lock()
-	conf := c.addFriendConfig
-	c.mu.Unlock()
-	addFriendConfig := conf.Inner.(*config.AddFriendConfig)
-
-	statuses := make([]PKGStatus, len(addFriendConfig.PKGServers))
-	for i, pkgServer := range addFriendConfig.PKGServers {
+	pkgServers := c.PKGServers()
+	statuses := make([]PKGStatus, len(pkgServers))
+	for i, pkgServer := range pkgServers {
 		statuses[i].Server = pkgServer
-		statuses[i].Error = pkgc.CheckStatus(pkgServer)
+		statuses[i].Status, statuses[i].Error = pkgc.Status(pkgServer)
 	}
 	return statuses
 }
 
+// PKGServers returns the PKG servers in the client's current
+// add-friend config.
+func (c *Client) PKGServers() []pkg.PublicServerConfig {
+	c.mu.Lock()
+	conf := c.addFriendConfig
+	c.mu.Unlock()
+	return conf.Inner.(*config.AddFriendConfig).PKGServers
+}
+
 func (c *Client) ConnectAddFriend() (chan error, error) {
 	c.init()
 
@@ -192,11 +295,14 @@ func (c *Client) ConnectAddFriend() (chan error, error) {
 	addFriendInner := addFriendConfig.Inner.(*config.AddFriendConfig)
 
 	afwsAddr := fmt.Sprintf("wss://%s/addfriend/ws", addFriendInner.Coordinator.Address)
-	addFriendConn, err := typesocket.Dial(afwsAddr, addFriendInner.Coordinator.Key)
+	dialer := &typesocket.Dialer{CountTraffic: c.usage.coordinator.Add}
+	addFriendConn, err := dialer.Dial(afwsAddr, addFriendInner.Coordinator.Key)
 	if err != nil {
 		return nil, err
 	}
 
+	addFriendConn.Logger = c.Logger
+
 	c.mu.Lock()
 	c.addFriendConn = addFriendConn
 	c.mu.Unlock()
@@ -230,11 +336,14 @@ func (c *Client) ConnectDialing() (chan error, error) {
 	dialingInner := dialingConfig.Inner.(*config.DialingConfig)
 
 	dwsAddr := fmt.Sprintf("wss://%s/dialing/ws", dialingInner.Coordinator.Address)
-	dialingConn, err := typesocket.Dial(dwsAddr, dialingInner.Coordinator.Key)
+	dialer := &typesocket.Dialer{CountTraffic: c.usage.coordinator.Add}
+	dialingConn, err := dialer.Dial(dwsAddr, dialingInner.Coordinator.Key)
 	if err != nil {
 		return nil, err
 	}
 
+	dialingConn.Logger = c.Logger
+
 	c.mu.Lock()
 	c.dialingConn = dialingConn
 	c.mu.Unlock()
@@ -213,6 +213,13 @@ func easyjsonDecodePersistedStateC2eed687(in *jlexer.Lexer, out *persistedState)
 			} else {
 				out.PKGLoginKey = in.BytesReadable()
 			}
+		case "PQSeed":
+			if in.IsNull() {
+				in.Skip()
+				out.PQSeed = nil
+			} else {
+				out.PQSeed = in.BytesReadable()
+			}
 		case "AddFriendConfig":
 			if in.IsNull() {
 				in.Skip()
@@ -330,6 +337,37 @@ func easyjsonDecodePersistedStateC2eed687(in *jlexer.Lexer, out *persistedState)
 				}
 				in.Delim(']')
 			}
+		case "OutgoingCalls":
+			if in.IsNull() {
+				in.Skip()
+				out.OutgoingCalls = nil
+			} else {
+				in.Delim('[')
+				if out.OutgoingCalls == nil {
+					if !in.IsDelim(']') {
+						out.OutgoingCalls = make([]*persistedCall, 0, 8)
+					} else {
+						out.OutgoingCalls = []*persistedCall{}
+					}
+				} else {
+					out.OutgoingCalls = (out.OutgoingCalls)[:0]
+				}
+				for !in.IsDelim(']') {
+					var v15 *persistedCall
+					if in.IsNull() {
+						in.Skip()
+						v15 = nil
+					} else {
+						if v15 == nil {
+							v15 = new(persistedCall)
+						}
+						(*v15).UnmarshalEasyJSON(in)
+					}
+					out.OutgoingCalls = append(out.OutgoingCalls, v15)
+					in.WantComma()
+				}
+				in.Delim(']')
+			}
 		case "Friends":
 			if in.IsNull() {
 				in.Skip()
@@ -400,6 +438,12 @@ func easyjsonEncodePersistedStateC2eed687(out *jwriter.Writer, in persistedState
 		out.RawByte(',')
 	}
 	first = false
+	out.RawString("\"PQSeed\":")
+	out.Base32Bytes(in.PQSeed)
+	if !first {
+		out.RawByte(',')
+	}
+	first = false
 	out.RawString("\"AddFriendConfig\":")
 	if in.AddFriendConfig == nil {
 		out.RawString("null")
@@ -483,6 +527,27 @@ func easyjsonEncodePersistedStateC2eed687(out *jwriter.Writer, in persistedState
 		out.RawByte(',')
 	}
 	first = false
+	out.RawString("\"OutgoingCalls\":")
+	if in.OutgoingCalls == nil && (out.Flags&jwriter.NilSliceAsEmpty) == 0 {
+		out.RawString("null")
+	} else {
+		out.RawByte('[')
+		for v28, v29 := range in.OutgoingCalls {
+			if v28 > 0 {
+				out.RawByte(',')
+			}
+			if v29 == nil {
+				out.RawString("null")
+			} else {
+				(*v29).MarshalEasyJSON(out)
+			}
+		}
+		out.RawByte(']')
+	}
+	if !first {
+		out.RawByte(',')
+	}
+	first = false
 	out.RawString("\"Friends\":")
 	if in.Friends == nil && (out.Flags&jwriter.NilMapAsEmpty) == 0 {
 		out.RawString(`null`)
@@ -623,6 +688,91 @@ func (v *persistedFriend) UnmarshalJSON(data []byte) error {
 func (v *persistedFriend) UnmarshalEasyJSON(l *jlexer.Lexer) {
 	easyjsonDecodePersistedFriendC2eed687(l, v)
 }
+func easyjsonDecodePersistedCallC2eed687(in *jlexer.Lexer, out *persistedCall) {
+	isTopLevel := in.IsStart()
+	if in.IsNull() {
+		if isTopLevel {
+			in.Consumed()
+		}
+		in.Skip()
+		return
+	}
+	in.Delim('{')
+	for !in.IsDelim('}') {
+		key := in.UnsafeString()
+		in.WantColon()
+		if in.IsNull() {
+			in.Skip()
+			in.WantComma()
+			continue
+		}
+		switch key {
+		case "Username":
+			out.Username = string(in.String())
+		case "Intent":
+			out.Intent = int(in.Int())
+		case "Created":
+			if data := in.Raw(); in.Ok() {
+				in.AddError((out.Created).UnmarshalJSON(data))
+			}
+		default:
+			in.SkipRecursive()
+		}
+		in.WantComma()
+	}
+	in.Delim('}')
+	if isTopLevel {
+		in.Consumed()
+	}
+}
+func easyjsonEncodePersistedCallC2eed687(out *jwriter.Writer, in persistedCall) {
+	out.RawByte('{')
+	first := true
+	_ = first
+	if !first {
+		out.RawByte(',')
+	}
+	first = false
+	out.RawString("\"Username\":")
+	out.String(string(in.Username))
+	if !first {
+		out.RawByte(',')
+	}
+	first = false
+	out.RawString("\"Intent\":")
+	out.Int(int(in.Intent))
+	if !first {
+		out.RawByte(',')
+	}
+	first = false
+	out.RawString("\"Created\":")
+	out.Raw((in.Created).MarshalJSON())
+	out.RawByte('}')
+}
+
+// MarshalJSON supports json.Marshaler interface
+func (v persistedCall) MarshalJSON() ([]byte, error) {
+	w := jwriter.Writer{}
+	easyjsonEncodePersistedCallC2eed687(&w, v)
+	return w.Buffer.BuildBytes(), w.Error
+}
+
+// MarshalEasyJSON supports easyjson.Marshaler interface
+func (v persistedCall) MarshalEasyJSON(w *jwriter.Writer) {
+	easyjsonEncodePersistedCallC2eed687(w, v)
+}
+
+// UnmarshalJSON supports json.Unmarshaler interface
+func (v *persistedCall) UnmarshalJSON(data []byte) error {
+	r := jlexer.Lexer{Data: data}
+	easyjsonDecodePersistedCallC2eed687(&r, v)
+	return r.Error()
+}
+
+// UnmarshalEasyJSON supports easyjson.Unmarshaler interface
+func (v *persistedCall) UnmarshalEasyJSON(l *jlexer.Lexer) {
+	easyjsonDecodePersistedCallC2eed687(l, v)
+}
 func easyjsonDecodeOutgoingFriendRequestC2eed687(in *jlexer.Lexer, out *OutgoingFriendRequest) {
 	isTopLevel := in.IsStart()
 	if in.IsNull() {
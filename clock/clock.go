@@ -0,0 +1,171 @@
+// Copyright 2018 David Lazar. All rights reserved.
+// Use of this source code is governed by the GNU AGPL
+// license that can be found in the LICENSE file.
+
+// Package clock abstracts the passage of time so that round timers,
+// expiry checks, and timeouts can be driven by a Mock in tests.
+package clock
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// A Clock tells the time and makes timers.
+type Clock interface {
+	Now() time.Time
+
+	// NewTimer returns a timer that fires once after d.
+	NewTimer(d time.Duration) Timer
+}
+
+// A Timer delivers the time on C once it fires, like time.Timer.
+type Timer interface {
+	C() <-chan time.Time
+
+	// Stop prevents the timer from firing. It reports whether the
+	// timer was stopped before it fired.
+	Stop() bool
+}
+
+// Real is the Clock backed by package time.
+var Real Clock = realClock{}
+
+type realClock struct{}
+
+func (realClock) Now() time.Time { return time.Now() }
+
+func (realClock) NewTimer(d time.Duration) Timer {
+	return realTimer{time.NewTimer(d)}
+}
+
+type realTimer struct {
+	t *time.Timer
+}
+
+func (t realTimer) C() <-chan time.Time { return t.t.C }
+func (t realTimer) Stop() bool          { return t.t.Stop() }
+
+// Or returns c, or Real if c is nil. It lets structs treat a nil
+// Clock field as the real clock.
+func Or(c Clock) Clock {
+	if c == nil {
+		return Real
+	}
+	return c
+}
+
+// Sleep blocks until d has passed on c.
+func Sleep(c Clock, d time.Duration) {
+	<-c.NewTimer(d).C()
+}
+
+// Mock is a Clock whose time only moves when Add or Set is called.
+// Timers fire in deadline order as the mock's time passes them.
+// A Mock is safe for concurrent use.
+type Mock struct {
+	mu     sync.Mutex
+	cond   *sync.Cond
+	now    time.Time
+	timers []*mockTimer
+}
+
+// NewMock returns a Mock whose time starts at now.
+func NewMock(now time.Time) *Mock {
+	m := &Mock{now: now}
+	m.cond = sync.NewCond(&m.mu)
+	return m
+}
+
+func (m *Mock) Now() time.Time {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.now
+}
+
+func (m *Mock) NewTimer(d time.Duration) Timer {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	t := &mockTimer{
+		mock:     m,
+		c:        make(chan time.Time, 1),
+		deadline: m.now.Add(d),
+	}
+	if d <= 0 {
+		t.c <- m.now
+		return t
+	}
+	m.timers = append(m.timers, t)
+	m.cond.Broadcast()
+	return t
+}
+
+// Add advances the mock's time by d, firing the timers it passes.
+func (m *Mock) Add(d time.Duration) {
+	m.Set(m.Now().Add(d))
+}
+
+// Set moves the mock's time to t, firing the timers whose deadline
+// is not after t. Time never moves backwards: if t is before the
+// current time, only the timers that are already due fire.
+func (m *Mock) Set(t time.Time) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	sort.SliceStable(m.timers, func(i, j int) bool {
+		return m.timers[i].deadline.Before(m.timers[j].deadline)
+	})
+	for len(m.timers) > 0 && !m.timers[0].deadline.After(t) {
+		timer := m.timers[0]
+		m.timers = m.timers[1:]
+		if timer.deadline.After(m.now) {
+			m.now = timer.deadline
+		}
+		timer.c <- m.now
+	}
+	if t.After(m.now) {
+		m.now = t
+	}
+	m.cond.Broadcast()
+}
+
+// Timers returns the number of timers waiting to fire.
+func (m *Mock) Timers() int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return len(m.timers)
+}
+
+// BlockUntil waits until at least n timers are waiting to fire. Tests
+// use it to wait for a goroutine to start sleeping before they move
+// the mock's time forward.
+func (m *Mock) BlockUntil(n int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for len(m.timers) < n {
+		m.cond.Wait()
+	}
+}
+
+type mockTimer struct {
+	mock     *Mock
+	c        chan time.Time
+	deadline time.Time
+}
+
+func (t *mockTimer) C() <-chan time.Time { return t.c }
+
+func (t *mockTimer) Stop() bool {
+	m := t.mock
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for i, other := range m.timers {
+		if other == t {
+			m.timers = append(m.timers[:i], m.timers[i+1:]...)
+			m.cond.Broadcast()
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,81 @@
+// Copyright 2018 David Lazar. All rights reserved.
+// Use of this source code is governed by the GNU AGPL
+// license that can be found in the LICENSE file.
+
+package clock
+
+import (
+	"testing"
+	"time"
+)
+
+var epoch = time.Date(2017, time.January, 1, 0, 0, 0, 0, time.UTC)
+
+func TestMockTimers(t *testing.T) {
+	m := NewMock(epoch)
+	late := m.NewTimer(2 * time.Minute)
+	early := m.NewTimer(time.Minute)
+	stopped := m.NewTimer(time.Minute)
+	if !stopped.Stop() {
+		t.Fatal("Stop returned false for a pending timer")
+	}
+	if m.Timers() != 2 {
+		t.Fatalf("expected 2 pending timers, got %d", m.Timers())
+	}
+
+	m.Add(90 * time.Second)
+	select {
+	case now := <-early.C():
+		if !now.Equal(epoch.Add(time.Minute)) {
+			t.Fatalf("timer fired at %s, want its deadline", now)
+		}
+	default:
+		t.Fatal("timer did not fire")
+	}
+	select {
+	case <-late.C():
+		t.Fatal("timer fired early")
+	case <-stopped.C():
+		t.Fatal("stopped timer fired")
+	default:
+	}
+	if got := m.Now(); !got.Equal(epoch.Add(90 * time.Second)) {
+		t.Fatalf("Now() = %s after Add", got)
+	}
+	if early.Stop() {
+		t.Fatal("Stop returned true for a fired timer")
+	}
+
+	m.Set(epoch)
+	if got := m.Now(); !got.Equal(epoch.Add(90 * time.Second)) {
+		t.Fatalf("Set moved time backwards to %s", got)
+	}
+
+	m.Add(time.Hour)
+	<-late.C()
+}
+
+func TestMockBlockUntil(t *testing.T) {
+	m := NewMock(epoch)
+	done := make(chan time.Time)
+	go func() {
+		Sleep(m, time.Second)
+		done <- m.Now()
+	}()
+
+	m.BlockUntil(1)
+	m.Add(time.Second)
+	if now := <-done; !now.Equal(epoch.Add(time.Second)) {
+		t.Fatalf("Sleep returned at %s", now)
+	}
+}
+
+func TestOr(t *testing.T) {
+	if Or(nil) != Real {
+		t.Fatal("Or(nil) is not the real clock")
+	}
+	m := NewMock(epoch)
+	if Or(m) != Clock(m) {
+		t.Fatal("Or did not return its argument")
+	}
+}
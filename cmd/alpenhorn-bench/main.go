@@ -0,0 +1,97 @@
+// Copyright 2018 David Lazar. All rights reserved.
+// Use of this source code is governed by the GNU AGPL
+// license that can be found in the LICENSE file.
+
+// Command alpenhorn-bench measures Alpenhorn's cryptographic operations
+// on the local machine and projects how large a round it can handle.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"regexp"
+	"runtime"
+	"testing"
+	"text/tabwriter"
+	"time"
+
+	"vuvuzela.io/alpenhorn/internal/cryptobench"
+	"vuvuzela.io/alpenhorn/internal/version"
+)
+
+var (
+	runPattern   = flag.String("run", ".", "only run benchmarks matching this regexp")
+	cpus         = flag.Int("cpus", runtime.NumCPU(), "number of cores available to each server")
+	pkgWait      = flag.Duration("pkgWait", 5*time.Second, "time clients have to extract keys from the PKG (coordinator pkgWait)")
+	mixTime      = flag.Duration("mixTime", 30*time.Second, "time each mixer may spend processing a round")
+	clientBudget = flag.Duration("clientBudget", 10*time.Second, "time a client may spend scanning its add-friend mailbox")
+	numMailboxes = flag.Int("numMailboxes", 1, "number of add-friend mailboxes per round")
+	printVersion = flag.Bool("version", false, "print version information and exit")
+)
+
+func main() {
+	flag.Parse()
+	if *printVersion {
+		fmt.Println(version.String())
+		return
+	}
+
+	re, err := regexp.Compile(*runPattern)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "invalid -run pattern: %s\n", err)
+		os.Exit(2)
+	}
+
+	results := make(map[string]time.Duration)
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintf(tw, "benchmark\titerations\ttime/op\n")
+	for _, bm := range cryptobench.All {
+		if !re.MatchString(bm.Name) {
+			continue
+		}
+		r := testing.Benchmark(bm.F)
+		perOp := time.Duration(r.NsPerOp())
+		results[bm.Name] = perOp
+		fmt.Fprintf(tw, "%s\t%d\t%s\n", bm.Name, r.N, perOp)
+	}
+	tw.Flush()
+	fmt.Println()
+
+	fmt.Printf("Projected capacity with %d cores per server:\n", *cpus)
+	tw = tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	if d, ok := sum(results, "IBEExtract", "BLSSign"); ok {
+		fmt.Fprintf(tw, "  PKG extractions per round (pkgWait=%s)\t%d\n", *pkgWait, capacity(*pkgWait, d))
+	}
+	if d, ok := sum(results, "OnionOpenLayer"); ok {
+		fmt.Fprintf(tw, "  onions per round per mixer (mixTime=%s)\t%d\n", *mixTime, capacity(*mixTime, d))
+	}
+	if d, ok := results["IBEDecrypt"]; ok {
+		perMailbox := int64(*clientBudget / d)
+		fmt.Fprintf(tw, "  add-friend requests per round (clientBudget=%s, mailboxes=%d)\t%d\n",
+			*clientBudget, *numMailboxes, perMailbox*int64(*numMailboxes))
+	}
+	if d, ok := results["EdTLSHandshake"]; ok {
+		fmt.Fprintf(tw, "  edtls handshakes per second\t%d\n", capacity(time.Second, d))
+	}
+	tw.Flush()
+}
+
+func sum(results map[string]time.Duration, names ...string) (time.Duration, bool) {
+	var total time.Duration
+	for _, name := range names {
+		d, ok := results[name]
+		if !ok {
+			return 0, false
+		}
+		total += d
+	}
+	return total, total > 0
+}
+
+func capacity(window, perOp time.Duration) int64 {
+	if perOp <= 0 {
+		return 0
+	}
+	return int64(window/perOp) * int64(*cpus)
+}
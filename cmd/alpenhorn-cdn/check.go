@@ -0,0 +1,66 @@
+// Copyright 2018 David Lazar. All rights reserved.
+// Use of this source code is governed by the GNU AGPL
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"crypto/ed25519"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/boltdb/bolt"
+
+	"vuvuzela.io/alpenhorn/cmd/cmdutil"
+	"vuvuzela.io/alpenhorn/config"
+	"vuvuzela.io/alpenhorn/encoding/toml"
+	"vuvuzela.io/alpenhorn/errors"
+)
+
+// runCheck validates the local and global config and opens the
+// database read-only, then exits without starting the server.
+func runCheck(confPath string) {
+	c := new(cmdutil.Checker)
+
+	conf := new(Config)
+	data, err := ioutil.ReadFile(confPath)
+	if err == nil {
+		err = toml.Unmarshal(data, conf)
+	}
+	if c.Check("load "+confPath, err) {
+		c.Check("keys", cmdutil.CheckKeyPair(conf.PublicKey, conf.PrivateKey))
+		c.Check("listen address", cmdutil.CheckListenAddr(conf.ListenAddr))
+	}
+
+	signedConfig, err := config.StdClient.CurrentConfig("AddFriend")
+	if c.Check("fetch current AddFriend config", err) {
+		addFriendConfig := signedConfig.Inner.(*config.AddFriendConfig)
+		err = nil
+		if len(addFriendConfig.Coordinator.Key) != ed25519.PublicKeySize {
+			err = errors.New("invalid coordinator key")
+		}
+		c.Check("AddFriend coordinator key", err)
+	}
+
+	dbPath := filepath.Join(*persistPath, "bolt_db")
+	if _, err := os.Stat(dbPath); os.IsNotExist(err) {
+		c.Check("database (not created yet)", nil)
+	} else {
+		db, err := bolt.Open(dbPath, 0600, &bolt.Options{
+			ReadOnly: true,
+			Timeout:  1 * time.Second,
+		})
+		if err == nil {
+			db.Close()
+			c.Check("open database read-only", nil)
+		} else if err == bolt.ErrTimeout {
+			c.Check("database (in use by a running server)", nil)
+		} else {
+			c.Check("open database read-only", err)
+		}
+	}
+
+	c.Exit()
+}
@@ -21,13 +21,21 @@ import (
 	"vuvuzela.io/alpenhorn/edtls"
 	"vuvuzela.io/alpenhorn/encoding/toml"
 	"vuvuzela.io/alpenhorn/internal/alplog"
+	"vuvuzela.io/alpenhorn/internal/keysafe"
+	"vuvuzela.io/alpenhorn/internal/sandbox"
+	"vuvuzela.io/alpenhorn/internal/version"
 	"vuvuzela.io/alpenhorn/log"
 	"vuvuzela.io/crypto/rand"
 )
 
 var (
-	doinit      = flag.Bool("init", false, "create config file")
-	persistPath = flag.String("persist", "persist_cdn", "persistent data directory")
+	doinit       = flag.Bool("init", false, "create config file")
+	persistPath  = flag.String("persist", "persist_cdn", "persistent data directory")
+	printVersion = flag.Bool("version", false, "print version information and exit")
+	mlockKeys    = flag.Bool("mlock", false, "lock private keys in memory so they are not swapped to disk")
+	doCheck      = flag.Bool("check", false, "check config and database, then exit")
+	logFlags     = alplog.RegisterFlags(flag.CommandLine)
+	sandboxFlags = sandbox.RegisterFlags(flag.CommandLine)
 )
 
 type Config struct {
@@ -80,6 +88,13 @@ func writeNewConfig(path string) {
 
 func main() {
 	flag.Parse()
+	if *printVersion {
+		fmt.Println(version.String())
+		return
+	}
+	if *doCheck {
+		runCheck(filepath.Join(*persistPath, "cdn.conf"))
+	}
 
 	if err := os.MkdirAll(*persistPath, 0700); err != nil {
 		log.Fatal(err)
@@ -103,12 +118,17 @@ func main() {
 		log.Fatalf("error parsing config %q: %s", confPath, err)
 	}
 
+	keySecret := cmdutil.ProtectKey(&conf.PrivateKey, *mlockKeys)
+	defer keySecret.Destroy()
+	// The config file holds a copy of the private key.
+	keysafe.Zero(data)
+
 	if conf.ListenAddr == "" {
 		log.Fatal("empty listen address in config")
 	}
 
 	logsDir := filepath.Join(*persistPath, "logs")
-	logHandler, err := alplog.NewProductionOutput(logsDir)
+	logger, logHandler, err := logFlags.NewLogger(logsDir)
 	if err != nil {
 		log.Fatal(err)
 	}
@@ -130,8 +150,12 @@ func main() {
 		log.Fatalf("edtls listen: %s", err)
 	}
 
+	if err := sandboxFlags.Apply(*persistPath, logFlags.Dir()); err != nil {
+		log.Fatalf("dropping privileges: %s", err)
+	}
+
 	log.Infof("Listening on %q; logging to %s", conf.ListenAddr, logHandler.Name())
-	log.StdLogger.EntryHandler = logHandler
+	log.StdLogger = logger
 	log.Infof("Listening on %q", conf.ListenAddr)
 
 	err = http.Serve(listener, server)
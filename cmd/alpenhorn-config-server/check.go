@@ -0,0 +1,37 @@
+// Copyright 2018 David Lazar. All rights reserved.
+// Use of this source code is governed by the GNU AGPL
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"vuvuzela.io/alpenhorn/cmd/cmdutil"
+	"vuvuzela.io/alpenhorn/config"
+	"vuvuzela.io/alpenhorn/errors"
+)
+
+// runCheck loads the server state and validates the current configs,
+// then exits without starting the server.
+func runCheck(serverPath string) {
+	c := new(cmdutil.Checker)
+
+	if *hostname == "" {
+		c.Check("hostname", errors.New("-hostname is not set"))
+	}
+
+	server, err := config.LoadServer(serverPath)
+	if !c.Check("load "+serverPath, err) {
+		c.Exit()
+	}
+
+	for _, service := range []string{"AddFriend", "Dialing"} {
+		conf, hash := server.CurrentConfig(service)
+		if conf == nil {
+			c.Check("current "+service+" config", errors.New("not set"))
+			continue
+		}
+		c.Check("current "+service+" config "+hash, conf.Validate())
+	}
+
+	c.Exit()
+}
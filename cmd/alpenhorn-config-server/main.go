@@ -11,6 +11,7 @@ import (
 	"fmt"
 	"io/ioutil"
 	"log"
+	"net"
 	"net/http"
 	"os"
 	"path/filepath"
@@ -19,6 +20,8 @@ import (
 	"golang.org/x/crypto/acme/autocert"
 
 	"vuvuzela.io/alpenhorn/config"
+	"vuvuzela.io/alpenhorn/internal/sandbox"
+	"vuvuzela.io/alpenhorn/internal/version"
 	// Register the convo inner config.
 	_ "vuvuzela.io/vuvuzela/convo"
 )
@@ -27,10 +30,20 @@ var (
 	hostname      = flag.String("hostname", "", "hostname of config server")
 	setConfigPath = flag.String("setConfig", "", "path to signed config to make current")
 	persistPath   = flag.String("persist", "persist_config_server", "persistent data directory")
+	printVersion  = flag.Bool("version", false, "print version information and exit")
+	doCheck       = flag.Bool("check", false, "check server state, then exit")
+	sandboxFlags  = sandbox.RegisterFlags(flag.CommandLine)
 )
 
 func main() {
 	flag.Parse()
+	if *printVersion {
+		fmt.Println(version.String())
+		return
+	}
+	if *doCheck {
+		runCheck(filepath.Join(*persistPath, "config-server-state"))
+	}
 
 	if err := os.MkdirAll(*persistPath, 0700); err != nil {
 		log.Fatal(err)
@@ -61,10 +74,21 @@ func main() {
 		HostPolicy: autocert.HostWhitelist(*hostname),
 	}
 	// Listen on :80 for http-01 ACME challenge.
-	go http.ListenAndServe(":http", certManager.HTTPHandler(nil))
+	acmeListener, err := net.Listen("tcp", ":http")
+	if err != nil {
+		log.Fatal(err)
+	}
+	go http.Serve(acmeListener, certManager.HTTPHandler(nil))
+
+	listener, err := net.Listen("tcp", ":https")
+	if err != nil {
+		log.Fatal(err)
+	}
+	if err := sandboxFlags.Apply(*persistPath); err != nil {
+		log.Fatalf("dropping privileges: %s", err)
+	}
 
 	httpServer := &http.Server{
-		Addr:      ":https",
 		Handler:   server,
 		TLSConfig: &tls.Config{GetCertificate: certManager.GetCertificate},
 
@@ -72,7 +96,7 @@ func main() {
 		WriteTimeout: 10 * time.Second,
 	}
 	log.Printf("Listening on https://%s", *hostname)
-	log.Fatal(httpServer.ListenAndServeTLS("", ""))
+	log.Fatal(httpServer.ServeTLS(listener, "", ""))
 }
 
 func setConfig(serverPath string) {
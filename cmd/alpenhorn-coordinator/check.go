@@ -0,0 +1,80 @@
+// Copyright 2018 David Lazar. All rights reserved.
+// Use of this source code is governed by the GNU AGPL
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+
+	"vuvuzela.io/alpenhorn/cmd/cmdutil"
+	"vuvuzela.io/alpenhorn/config"
+	"vuvuzela.io/alpenhorn/coordinator"
+	"vuvuzela.io/alpenhorn/encoding/toml"
+	"vuvuzela.io/alpenhorn/errors"
+	"vuvuzela.io/alpenhorn/internal/keysafe"
+	"vuvuzela.io/alpenhorn/internal/rng"
+)
+
+// runCheck validates the local and global config and loads the
+// persisted round state, then exits without starting the server.
+func runCheck(confPath string) {
+	c := new(cmdutil.Checker)
+
+	conf := new(Config)
+	data, err := ioutil.ReadFile(confPath)
+	if err == nil {
+		err = toml.Unmarshal(data, conf)
+	}
+	if !c.Check("load "+confPath, err) {
+		c.Exit()
+	}
+	c.Check("keys", cmdutil.CheckKeyPair(conf.PublicKey, conf.PrivateKey))
+	c.Check("listen address", cmdutil.CheckListenAddr(conf.ListenAddr))
+	c.Check("randomness self-test", rng.SelfTest())
+	_, err = coordinator.ParseSLOs(conf.AddFriendSLOs)
+	c.Check("addFriendSLOs", err)
+	_, err = coordinator.ParseSLOs(conf.DialingSLOs)
+	c.Check("dialingSLOs", err)
+
+	services := []struct {
+		name      string
+		mailboxes uint32
+	}{
+		{"AddFriend", conf.AddFriendMailboxes},
+		{"Dialing", conf.DialingMailboxes},
+	}
+	for _, s := range services {
+		if s.mailboxes == 0 {
+			c.Check(s.name+" service (disabled)", nil)
+			continue
+		}
+
+		signedConfig, err := config.StdClient.CurrentConfig(s.name)
+		if c.Check("fetch current "+s.name+" config", err) {
+			var coordinatorConf config.CoordinatorConfig
+			switch inner := signedConfig.Inner.(type) {
+			case *config.AddFriendConfig:
+				coordinatorConf = inner.Coordinator
+			case *config.DialingConfig:
+				coordinatorConf = inner.Coordinator
+			}
+			err = nil
+			if !keysafe.Equal(coordinatorConf.Key, conf.PublicKey) {
+				err = errors.New("coordinator key in %s config does not match local public key", s.name)
+			}
+			c.Check(s.name+" coordinator key", err)
+		}
+
+		statePath := filepath.Join(*persistPath, strings.ToLower(s.name)+"-coordinator-state")
+		srv := &coordinator.Server{
+			Service:     s.name,
+			PersistPath: statePath,
+		}
+		c.Check("load "+statePath, srv.LoadPersistedState())
+	}
+
+	c.Exit()
+}
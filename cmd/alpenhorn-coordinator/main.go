@@ -11,6 +11,7 @@ import (
 	"flag"
 	"fmt"
 	"io/ioutil"
+	"net"
 	"net/http"
 	"os"
 	"path/filepath"
@@ -21,15 +22,26 @@ import (
 	"vuvuzela.io/alpenhorn/cmd/cmdutil"
 	"vuvuzela.io/alpenhorn/config"
 	"vuvuzela.io/alpenhorn/coordinator"
+	"vuvuzela.io/alpenhorn/dialing"
 	"vuvuzela.io/alpenhorn/edtls"
 	"vuvuzela.io/alpenhorn/encoding/toml"
 	"vuvuzela.io/alpenhorn/internal/alplog"
+	"vuvuzela.io/alpenhorn/internal/keysafe"
+	"vuvuzela.io/alpenhorn/internal/rng"
+	"vuvuzela.io/alpenhorn/internal/sandbox"
+	"vuvuzela.io/alpenhorn/internal/version"
 	"vuvuzela.io/alpenhorn/log"
 )
 
 var (
-	doInit      = flag.Bool("init", false, "initialize the coordinator for the first time")
-	persistPath = flag.String("persist", "persist", "persistent data directory")
+	doInit       = flag.Bool("init", false, "initialize the coordinator for the first time")
+	persistPath  = flag.String("persist", "persist", "persistent data directory")
+	printVersion = flag.Bool("version", false, "print version information and exit")
+	mlockKeys    = flag.Bool("mlock", false, "lock private keys in memory so they are not swapped to disk")
+	doCheck      = flag.Bool("check", false, "check config and round state, then exit")
+	logFlags     = alplog.RegisterFlags(flag.CommandLine)
+	sandboxFlags = sandbox.RegisterFlags(flag.CommandLine)
+	traceOnions  = flag.Bool("traceOnions", false, "inject a marked test onion each round (debug)")
 )
 
 type Config struct {
@@ -45,10 +57,28 @@ type Config struct {
 
 	AddFriendMailboxes uint32
 	DialingMailboxes   uint32
+
+	DialingBloomFalsePositiveRate float64
+	DialingBloomCapacity          int
+	DialingMailboxChunkSize       int
+
+	DashboardAddr     string
+	DashboardPassword string
+
+	AddFriendSLOs []string
+	DialingSLOs   []string
+	SLOWebhook    string
 }
 
 var funcMap = template.FuncMap{
 	"base32": toml.EncodeBytes,
+	"strings": func(strs []string) string {
+		quoted := make([]string, len(strs))
+		for i, s := range strs {
+			quoted[i] = fmt.Sprintf("%q", s)
+		}
+		return "[" + strings.Join(quoted, ", ") + "]"
+	},
 }
 
 const confTemplate = `# Alpenhorn coordinator (entry) server config
@@ -71,6 +101,29 @@ pkgWait = {{.PKGWait | printf "%q"}}
 
 addFriendMailboxes = {{.AddFriendMailboxes}}
 dialingMailboxes   = {{.DialingMailboxes}}
+
+# The dialing mailboxes' Bloom filter false positive rate and minimum
+# capacity. They must be within the bounds in the dialing config.
+dialingBloomFalsePositiveRate = {{.DialingBloomFalsePositiveRate | printf "%f"}}
+dialingBloomCapacity          = {{.DialingBloomCapacity}}
+
+# Dialing mailboxes larger than this many bytes are split into
+# continuation objects on the CDN.
+dialingMailboxChunkSize = {{.DialingMailboxChunkSize}}
+
+# The operator dashboard is served over plain HTTP at dashboardAddr
+# and requires dashboardPassword (HTTP basic auth, any username).
+# Leave either empty to disable the dashboard.
+dashboardAddr     = {{.DashboardAddr | printf "%q"}}
+dashboardPassword = {{.DashboardPassword | printf "%q"}}
+
+# Round latency SLOs, measured from when a round starts until its
+# mailbox is published, over the last 100 rounds. Each is written as
+# "p<percentile>=<target>". When an SLO is breached or recovers, the
+# coordinator logs a warning and posts a JSON alert to sloWebhook.
+addFriendSLOs = {{.AddFriendSLOs | strings}}
+dialingSLOs   = {{.DialingSLOs | strings}}
+sloWebhook    = {{.SLOWebhook | printf "%q"}}
 `
 
 func initService(service string) {
@@ -127,6 +180,14 @@ func writeNewConfig(path string) {
 
 		AddFriendMailboxes: 1,
 		DialingMailboxes:   1,
+
+		DialingBloomFalsePositiveRate: dialing.DefaultBloomFalsePositiveRate,
+		DialingMailboxChunkSize:       dialing.DefaultMailboxChunkSize,
+
+		DashboardAddr: "127.0.0.1:8001",
+
+		AddFriendSLOs: []string{"p99=2m"},
+		DialingSLOs:   []string{"p99=1m"},
 	}
 
 	tmpl := template.Must(template.New("config").Funcs(funcMap).Parse(confTemplate))
@@ -146,6 +207,13 @@ func writeNewConfig(path string) {
 
 func main() {
 	flag.Parse()
+	if *printVersion {
+		fmt.Println(version.String())
+		return
+	}
+	if *doCheck {
+		runCheck(filepath.Join(*persistPath, "coordinator.conf"))
+	}
 
 	if err := os.MkdirAll(*persistPath, 0700); err != nil {
 		log.Fatal(err)
@@ -167,14 +235,28 @@ func main() {
 		log.Fatalf("error parsing config %s: %s", confPath, err)
 	}
 
+	keySecret := cmdutil.ProtectKey(&conf.PrivateKey, *mlockKeys)
+	defer keySecret.Destroy()
+	// The config file holds a copy of the private key.
+	keysafe.Zero(data)
+
+	if err := rng.SelfTest(); err != nil {
+		log.Fatalf("refusing to start: %s", err)
+	}
+
 	logsDir := filepath.Join(*persistPath, "logs")
-	logHandler, err := alplog.NewProductionOutput(logsDir)
+	logger, logHandler, err := logFlags.NewLogger(logsDir)
 	if err != nil {
 		log.Fatal(err)
 	}
-	logger := &log.Logger{
-		Level:        log.InfoLevel,
-		EntryHandler: logHandler,
+
+	addFriendSLOs, err := coordinator.ParseSLOs(conf.AddFriendSLOs)
+	if err != nil {
+		log.Fatalf("addFriendSLOs: %s", err)
+	}
+	dialingSLOs, err := coordinator.ParseSLOs(conf.DialingSLOs)
+	if err != nil {
+		log.Fatalf("dialingSLOs: %s", err)
 	}
 
 	var addFriendServer *coordinator.Server
@@ -193,6 +275,10 @@ func main() {
 			NumMailboxes: conf.AddFriendMailboxes,
 
 			PersistPath: filepath.Join(*persistPath, "addfriend-coordinator-state"),
+			TraceOnions: *traceOnions,
+
+			SLOs:       addFriendSLOs,
+			SLOWebhook: conf.SLOWebhook,
 		}
 
 		err = addFriendServer.LoadPersistedState()
@@ -216,7 +302,15 @@ func main() {
 
 			NumMailboxes: conf.DialingMailboxes,
 
+			BloomFalsePositiveRate: conf.DialingBloomFalsePositiveRate,
+			BloomCapacity:          conf.DialingBloomCapacity,
+			MailboxChunkSize:       conf.DialingMailboxChunkSize,
+
 			PersistPath: filepath.Join(*persistPath, "dialing-coordinator-state"),
+			TraceOnions: *traceOnions,
+
+			SLOs:       dialingSLOs,
+			SLOWebhook: conf.SLOWebhook,
 		}
 
 		err = dialingServer.LoadPersistedState()
@@ -240,11 +334,40 @@ func main() {
 		}
 	}
 
+	http.HandleFunc("/version", version.ServeHTTP)
+
+	if conf.DashboardAddr != "" && conf.DashboardPassword != "" {
+		dashboard := &coordinator.Dashboard{
+			ConfigClient: config.StdClient,
+			Password:     conf.DashboardPassword,
+			PrivateKey:   conf.PrivateKey,
+		}
+		if addFriendServer != nil {
+			dashboard.Servers = append(dashboard.Servers, addFriendServer)
+		}
+		if dialingServer != nil {
+			dashboard.Servers = append(dashboard.Servers, dialingServer)
+		}
+		dashboardListener, err := net.Listen("tcp", conf.DashboardAddr)
+		if err != nil {
+			log.Fatalf("dashboard listen: %s", err)
+		}
+		go func() {
+			err := http.Serve(dashboardListener, dashboard)
+			log.Errorf("dashboard: %s", err)
+		}()
+		log.Infof("Serving dashboard on http://%s/", conf.DashboardAddr)
+	}
+
 	listener, err := edtls.Listen("tcp", conf.ListenAddr, conf.PrivateKey)
 	if err != nil {
 		log.Fatalf("edtls listen: %s", err)
 	}
 
+	if err := sandboxFlags.Apply(*persistPath, logFlags.Dir()); err != nil {
+		log.Fatalf("dropping privileges: %s", err)
+	}
+
 	log.Infof("Listening on %q; logging to %s", conf.ListenAddr, logHandler.Name())
 	logger.Infof("Listening on %q", conf.ListenAddr)
 
@@ -0,0 +1,242 @@
+// Copyright 2018 David Lazar. All rights reserved.
+// Use of this source code is governed by the GNU AGPL
+// license that can be found in the LICENSE file.
+
+// Command alpenhorn-gen-systemd writes hardened systemd units for the
+// Alpenhorn servers, along with environment files and a tmpfiles.d
+// snippet that creates each server's persist directory.
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"text/template"
+
+	"vuvuzela.io/alpenhorn/encoding/toml"
+	"vuvuzela.io/alpenhorn/internal/version"
+)
+
+var (
+	servers      = flag.String("servers", "", "comma-separated servers to generate units for (pkg, coordinator, mixer, cdn, config-server) or \"all\"")
+	persistRoot  = flag.String("persistRoot", "/var/lib/alpenhorn", "directory containing each server's persist directory")
+	binDir       = flag.String("bin", "/usr/local/bin", "directory containing the server binaries")
+	envDir       = flag.String("envDir", "/etc/alpenhorn", "directory for the environment files referenced by the units")
+	user         = flag.String("user", "alpenhorn", "user and group the servers run as")
+	outDir       = flag.String("out", ".", "directory to write the generated files to")
+	printVersion = flag.Bool("version", false, "print version information and exit")
+)
+
+type serverType struct {
+	Name     string // as passed to -servers
+	Binary   string
+	ConfFile string // config file in the persist directory, if any
+
+	// ExtraFlags are written to the environment file as a starting point.
+	ExtraFlags string
+	// Privileged is true if the server always binds to ports below 1024.
+	Privileged bool
+}
+
+var serverTypes = []serverType{
+	{Name: "pkg", Binary: "alpenhorn-pkg", ConfFile: "pkg.conf"},
+	{Name: "coordinator", Binary: "alpenhorn-coordinator", ConfFile: "coordinator.conf"},
+	{Name: "mixer", Binary: "alpenhorn-mixer", ConfFile: "mixer.conf"},
+	{Name: "cdn", Binary: "alpenhorn-cdn", ConfFile: "cdn.conf"},
+	{Name: "config-server", Binary: "alpenhorn-config-server", ExtraFlags: "-hostname configs.example.org", Privileged: true},
+}
+
+type unitData struct {
+	serverType
+	Version     string
+	BinDir      string
+	PersistPath string
+	EnvPath     string
+	User        string
+	BindLow     bool
+}
+
+const unitTemplate = `# Generated by alpenhorn-gen-systemd ({{.Version}}).
+[Unit]
+Description=Alpenhorn {{.Name}} server
+After=network-online.target
+Wants=network-online.target
+
+[Service]
+Type=simple
+User={{.User}}
+Group={{.User}}
+EnvironmentFile=-{{.EnvPath}}
+ExecStart={{.BinDir}}/{{.Binary}} -persist {{.PersistPath}} $ALPENHORN_FLAGS
+Restart=on-failure
+RestartSec=5s
+TimeoutStopSec=30s
+LimitNOFILE=65536
+UMask=0077
+
+# Sandboxing.
+NoNewPrivileges=yes
+ProtectSystem=strict
+ProtectHome=yes
+ReadWritePaths={{.PersistPath}}
+PrivateTmp=yes
+PrivateDevices=yes
+ProtectKernelTunables=yes
+ProtectKernelModules=yes
+ProtectKernelLogs=yes
+ProtectControlGroups=yes
+ProtectClock=yes
+ProtectHostname=yes
+RestrictAddressFamilies=AF_INET AF_INET6 AF_UNIX
+RestrictNamespaces=yes
+RestrictRealtime=yes
+RestrictSUIDSGID=yes
+LockPersonality=yes
+MemoryDenyWriteExecute=yes
+SystemCallArchitectures=native
+SystemCallFilter=@system-service
+SystemCallFilter=~@privileged
+{{- if .BindLow}}
+CapabilityBoundingSet=CAP_NET_BIND_SERVICE
+AmbientCapabilities=CAP_NET_BIND_SERVICE
+{{- else}}
+CapabilityBoundingSet=
+{{- end}}
+
+[Install]
+WantedBy=multi-user.target
+`
+
+const envTemplate = `# Extra command-line flags for {{.Binary}}.
+# See {{.Binary}} -help for the full list.
+ALPENHORN_FLAGS="{{.ExtraFlags}}"
+`
+
+func main() {
+	flag.Parse()
+	if *printVersion {
+		fmt.Println(version.String())
+		return
+	}
+
+	selected, err := selectServers(*servers)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s\n", err)
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	if err := os.MkdirAll(*outDir, 0755); err != nil {
+		log.Fatal(err)
+	}
+
+	unitTmpl := template.Must(template.New("unit").Parse(unitTemplate))
+	envTmpl := template.Must(template.New("env").Parse(envTemplate))
+
+	tmpfiles := new(bytes.Buffer)
+	fmt.Fprintf(tmpfiles, "# Persist directories for the Alpenhorn servers.\n")
+	fmt.Fprintf(tmpfiles, "# Install as /etc/tmpfiles.d/alpenhorn.conf and run systemd-tmpfiles --create.\n")
+	fmt.Fprintf(tmpfiles, "d %s 0750 %s %s -\n", *persistRoot, *user, *user)
+
+	for _, st := range selected {
+		persistPath := filepath.Join(*persistRoot, st.Name)
+		data := &unitData{
+			serverType:  st,
+			Version:     version.Get().Version,
+			BinDir:      *binDir,
+			PersistPath: persistPath,
+			EnvPath:     filepath.Join(*envDir, st.Binary+".env"),
+			User:        *user,
+			BindLow:     st.Privileged,
+		}
+		if st.ConfFile != "" {
+			low, err := bindsLowPort(filepath.Join(persistPath, st.ConfFile))
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "warning: %s; assuming %s binds to a privileged port\n", err, st.Name)
+				low = true
+			}
+			data.BindLow = low
+		}
+
+		writeTemplate(unitTmpl, data, filepath.Join(*outDir, st.Binary+".service"))
+		writeTemplate(envTmpl, data, filepath.Join(*outDir, st.Binary+".env"))
+
+		fmt.Fprintf(tmpfiles, "d %s 0700 %s %s -\n", persistPath, *user, *user)
+		if st.Name != "config-server" {
+			fmt.Fprintf(tmpfiles, "d %s 0700 %s %s -\n", filepath.Join(persistPath, "logs"), *user, *user)
+		}
+	}
+
+	tmpfilesPath := filepath.Join(*outDir, "alpenhorn-tmpfiles.conf")
+	if err := ioutil.WriteFile(tmpfilesPath, tmpfiles.Bytes(), 0644); err != nil {
+		log.Fatal(err)
+	}
+	fmt.Printf("wrote %s\n", tmpfilesPath)
+}
+
+func selectServers(list string) ([]serverType, error) {
+	if list == "" {
+		return nil, fmt.Errorf("no servers specified")
+	}
+	if list == "all" {
+		return serverTypes, nil
+	}
+	var selected []serverType
+	for _, name := range strings.Split(list, ",") {
+		name = strings.TrimSpace(name)
+		found := false
+		for _, st := range serverTypes {
+			if st.Name == name {
+				selected = append(selected, st)
+				found = true
+				break
+			}
+		}
+		if !found {
+			return nil, fmt.Errorf("unknown server type: %q", name)
+		}
+	}
+	return selected, nil
+}
+
+// bindsLowPort reports whether the server config at path listens on a
+// port that requires CAP_NET_BIND_SERVICE.
+func bindsLowPort(path string) (bool, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return false, err
+	}
+	var conf struct {
+		ListenAddr string
+	}
+	if err := toml.Unmarshal(data, &conf); err != nil {
+		return false, fmt.Errorf("error parsing %s: %s", path, err)
+	}
+	_, portStr, err := net.SplitHostPort(conf.ListenAddr)
+	if err != nil {
+		return false, fmt.Errorf("invalid listenAddr in %s: %s", path, err)
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil {
+		return false, fmt.Errorf("invalid port in %s: %q", path, portStr)
+	}
+	return port < 1024, nil
+}
+
+func writeTemplate(tmpl *template.Template, data interface{}, path string) {
+	buf := new(bytes.Buffer)
+	if err := tmpl.Execute(buf, data); err != nil {
+		log.Fatalf("template error: %s", err)
+	}
+	if err := ioutil.WriteFile(path, buf.Bytes(), 0644); err != nil {
+		log.Fatal(err)
+	}
+	fmt.Printf("wrote %s\n", path)
+}
@@ -0,0 +1,72 @@
+// Copyright 2018 David Lazar. All rights reserved.
+// Use of this source code is governed by the GNU AGPL
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"io/ioutil"
+
+	"vuvuzela.io/alpenhorn/cmd/cmdutil"
+	"vuvuzela.io/alpenhorn/config"
+	"vuvuzela.io/alpenhorn/encoding/toml"
+	"vuvuzela.io/alpenhorn/errors"
+	"vuvuzela.io/alpenhorn/internal/keysafe"
+	"vuvuzela.io/alpenhorn/internal/rng"
+	"vuvuzela.io/crypto/rand"
+	"vuvuzela.io/vuvuzela/mixnet"
+)
+
+// runCheck validates the local and global config, then exits
+// without starting the server.
+func runCheck(confPath string) {
+	c := new(cmdutil.Checker)
+
+	conf := new(Config)
+	data, err := ioutil.ReadFile(confPath)
+	if err == nil {
+		err = toml.Unmarshal(data, conf)
+	}
+	if !c.Check("load "+confPath, err) {
+		c.Exit()
+	}
+	c.Check("keys", cmdutil.CheckKeyPair(conf.PublicKey, conf.PrivateKey))
+	c.Check("listen address", cmdutil.CheckListenAddr(conf.ListenAddr))
+	c.Check("addFriendNoise", checkNoise(conf.AddFriendNoise))
+	c.Check("dialingNoise", checkNoise(conf.DialingNoise))
+	c.Check("randomness self-test", rng.SelfTest())
+
+	for _, service := range []string{"AddFriend", "Dialing"} {
+		signedConfig, err := config.StdClient.CurrentConfig(service)
+		if !c.Check("fetch current "+service+" config", err) {
+			continue
+		}
+		var mixers []mixnet.PublicServerConfig
+		switch inner := signedConfig.Inner.(type) {
+		case *config.AddFriendConfig:
+			mixers = inner.MixServers
+		case *config.DialingConfig:
+			mixers = inner.MixServers
+		}
+		listed := false
+		for _, mix := range mixers {
+			if keysafe.Equal(mix.Key, conf.PublicKey) {
+				listed = true
+			}
+		}
+		if listed {
+			c.Check(service+" mix chain includes this mixer", nil)
+		} else {
+			c.Check(service+" mix chain does not include this mixer (yet)", nil)
+		}
+	}
+
+	c.Exit()
+}
+
+func checkNoise(l rand.Laplace) error {
+	if l.Mu < 0 || l.B < 0 {
+		return errors.New("negative noise parameters: mu=%v b=%v", l.Mu, l.B)
+	}
+	return nil
+}
@@ -13,6 +13,7 @@ import (
 	"net"
 	"os"
 	"path/filepath"
+	"strings"
 	"text/template"
 
 	"google.golang.org/grpc"
@@ -24,6 +25,11 @@ import (
 	"vuvuzela.io/alpenhorn/dialing"
 	"vuvuzela.io/alpenhorn/edtls"
 	"vuvuzela.io/alpenhorn/encoding/toml"
+	"vuvuzela.io/alpenhorn/internal/alplog"
+	"vuvuzela.io/alpenhorn/internal/keysafe"
+	"vuvuzela.io/alpenhorn/internal/rng"
+	"vuvuzela.io/alpenhorn/internal/sandbox"
+	"vuvuzela.io/alpenhorn/internal/version"
 	"vuvuzela.io/alpenhorn/log"
 	"vuvuzela.io/crypto/rand"
 	"vuvuzela.io/vuvuzela/mixnet"
@@ -31,8 +37,17 @@ import (
 )
 
 var (
-	doinit      = flag.Bool("init", false, "create config file")
-	persistPath = flag.String("persist", "persist_alpmix", "persistent data directory")
+	doinit       = flag.Bool("init", false, "create config file")
+	persistPath  = flag.String("persist", "persist_alpmix", "persistent data directory")
+	printVersion = flag.Bool("version", false, "print version information and exit")
+	mlockKeys    = flag.Bool("mlock", false, "lock private keys in memory so they are not swapped to disk")
+	doCheck      = flag.Bool("check", false, "check config, then exit")
+	logFlags     = alplog.RegisterFlags(flag.CommandLine)
+	sandboxFlags = sandbox.RegisterFlags(flag.CommandLine)
+
+	joinRequest  = flag.Bool("joinRequest", false, "print a signed request to join the mix chain and exit")
+	joinAddress  = flag.String("joinAddress", "", "public address to advertise in the join request (default: listenAddr)")
+	joinServices = flag.String("joinServices", "AddFriend,Dialing", "comma-separated services to join")
 )
 
 type Config struct {
@@ -105,6 +120,13 @@ func writeNewConfig(path string) {
 
 func main() {
 	flag.Parse()
+	if *printVersion {
+		fmt.Println(version.String())
+		return
+	}
+	if *doCheck {
+		runCheck(filepath.Join(*persistPath, "mixer.conf"))
+	}
 
 	if err := os.MkdirAll(*persistPath, 0700); err != nil {
 		log.Fatal(err)
@@ -128,12 +150,44 @@ func main() {
 		log.Fatalf("error parsing config %q: %s", confPath, err)
 	}
 
+	keySecret := cmdutil.ProtectKey(&conf.PrivateKey, *mlockKeys)
+	defer keySecret.Destroy()
+	// The config file holds a copy of the private key.
+	keysafe.Zero(data)
+
+	if *joinRequest {
+		addr := *joinAddress
+		if addr == "" {
+			addr = conf.ListenAddr
+		}
+		services := strings.Split(*joinServices, ",")
+		req := config.NewMixerJoinRequest(conf.PrivateKey, addr, services)
+		fmt.Println(req.Encode())
+		return
+	}
+
+	if err := rng.SelfTest(); err != nil {
+		log.Fatalf("refusing to start: %s", err)
+	}
+
+	logsDir := filepath.Join(*persistPath, "logs")
+	logger, logHandler, err := logFlags.NewLogger(logsDir)
+	if err != nil {
+		log.Fatal(err)
+	}
+
 	signedConfig, err := config.StdClient.CurrentConfig("AddFriend")
 	if err != nil {
 		log.Fatal(err)
 	}
 	addFriendConfig := signedConfig.Inner.(*config.AddFriendConfig)
 
+	signedConfig, err = config.StdClient.CurrentConfig("Dialing")
+	if err != nil {
+		log.Fatal(err)
+	}
+	dialingConfig := signedConfig.Inner.(*config.DialingConfig)
+
 	mixServer := &mixnet.Server{
 		SigningKey: conf.PrivateKey,
 		// Assumes that AddFriend and Dialing use the same coordinator.
@@ -143,11 +197,16 @@ func main() {
 			"AddFriend": &addfriend.Mixer{
 				SigningKey: conf.PrivateKey,
 				Laplace:    conf.AddFriendNoise,
+				// Changing the intro or payload version requires a
+				// restart; until then the mixer refuses the new rounds.
+				IntroVersion:   addFriendConfig.IntroVersion,
+				PayloadVersion: addFriendConfig.PayloadVersion,
 			},
 
 			"Dialing": &dialing.Mixer{
-				SigningKey: conf.PrivateKey,
-				Laplace:    conf.DialingNoise,
+				SigningKey:     conf.PrivateKey,
+				Laplace:        conf.DialingNoise,
+				PayloadVersion: dialingConfig.PayloadVersion,
 			},
 		},
 	}
@@ -157,13 +216,19 @@ func main() {
 
 	pb.RegisterMixnetServer(grpcServer, mixServer)
 
-	log.Infof("Listening on %q", conf.ListenAddr)
-
 	listener, err := net.Listen("tcp", conf.ListenAddr)
 	if err != nil {
 		log.Fatalf("net.Listen: %s", err)
 	}
 
+	if err := sandboxFlags.Apply(*persistPath, logFlags.Dir()); err != nil {
+		log.Fatalf("dropping privileges: %s", err)
+	}
+
+	log.Infof("Listening on %q; logging to %s", conf.ListenAddr, logHandler.Name())
+	log.StdLogger = logger
+	log.Infof("Listening on %q", conf.ListenAddr)
+
 	err = grpcServer.Serve(listener)
 	log.Fatalf("Shutdown: %s", err)
 }
@@ -0,0 +1,27 @@
+// Copyright 2018 David Lazar. All rights reserved.
+// Use of this source code is governed by the GNU AGPL
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// openAuditLog opens the audit log named in the config: nothing if
+// name is empty, the system log if it is "syslog", and otherwise the
+// file name, relative to the persist directory, opened for appending.
+func openAuditLog(name string, persistPath string) (io.WriteCloser, error) {
+	switch name {
+	case "":
+		return nil, nil
+	case "syslog":
+		return openSyslog()
+	}
+	if !filepath.IsAbs(name) {
+		name = filepath.Join(persistPath, name)
+	}
+	return os.OpenFile(name, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+}
@@ -0,0 +1,82 @@
+// Copyright 2018 David Lazar. All rights reserved.
+// Use of this source code is governed by the GNU AGPL
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"crypto/ed25519"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"vuvuzela.io/alpenhorn/cmd/cmdutil"
+	"vuvuzela.io/alpenhorn/config"
+	"vuvuzela.io/alpenhorn/encoding/toml"
+	"vuvuzela.io/alpenhorn/errors"
+	"vuvuzela.io/alpenhorn/pkg"
+	"vuvuzela.io/alpenhorn/pkg/kv"
+)
+
+// runCheck validates the local and global config and opens the
+// database read-only, then exits without starting the server.
+func runCheck(confPath string) {
+	c := new(cmdutil.Checker)
+
+	conf := new(Config)
+	data, err := ioutil.ReadFile(confPath)
+	if err == nil {
+		err = toml.Unmarshal(data, conf)
+	}
+	if c.Check("load "+confPath, err) {
+		c.Check("keys, listen address, and storage backend", checkConfig(conf))
+	}
+
+	signedConfig, err := config.StdClient.CurrentConfig("AddFriend")
+	if c.Check("fetch current AddFriend config", err) {
+		addFriendConfig := signedConfig.Inner.(*config.AddFriendConfig)
+		err = nil
+		if len(addFriendConfig.Coordinator.Key) != ed25519.PublicKeySize {
+			err = errors.New("invalid coordinator key")
+		}
+		c.Check("AddFriend config settings", err)
+		switch pkg.RegistrationMode(conf.RegistrationMode) {
+		case "", pkg.RegistrationEmail:
+			_, err = newVerifier(conf, addFriendConfig)
+			c.Check("verifier settings", err)
+		}
+	}
+
+	dbPath := dbLocation(conf, *persistPath)
+	if _, err := os.Stat(dbPath); conf.DBBackend != kv.MySQL && os.IsNotExist(err) {
+		c.Check("database (not created yet)", nil)
+	} else {
+		keys, _ := parseDataKeys(conf.DataKeys)
+		db, err := openDB(conf.DBBackend, dbPath, keys, true)
+		if err == nil {
+			c.Check("open database read-only", nil)
+			c.Check("database schema version", checkSchemaVersion(db, conf.ManualMigrations))
+			db.Close()
+		} else if err == kv.ErrLocked || strings.Contains(err.Error(), "directory lock") {
+			c.Check("database (in use by a running server)", nil)
+		} else {
+			c.Check("open database read-only", err)
+		}
+	}
+
+	c.Exit()
+}
+
+func checkSchemaVersion(db kv.DB, manual bool) error {
+	version, err := pkg.DBSchemaVersion(db)
+	if err != nil {
+		return err
+	}
+	if version > pkg.SchemaVersion() {
+		return errors.New("database version %d is newer than the server's version %d", version, pkg.SchemaVersion())
+	}
+	if manual && version < pkg.SchemaVersion() {
+		return errors.New("database version %d is out of date: run alpenhorn-pkg -migrate", version)
+	}
+	return nil
+}
@@ -0,0 +1,242 @@
+// Copyright 2018 David Lazar. All rights reserved.
+// Use of this source code is governed by the GNU AGPL
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"database/sql"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"vuvuzela.io/alpenhorn/encoding/toml"
+	"vuvuzela.io/alpenhorn/errors"
+	"vuvuzela.io/alpenhorn/internal/keysafe"
+	"vuvuzela.io/alpenhorn/log"
+	"vuvuzela.io/alpenhorn/pkg"
+	"vuvuzela.io/alpenhorn/pkg/kv"
+)
+
+type dbCommand struct {
+	readOnly bool
+	run      func(db kv.DB, args []string) error
+	args     string
+	help     string
+}
+
+var dbCommands = map[string]dbCommand{
+	"db-stats": {
+		readOnly: true,
+		run:      dbStats,
+		help:     "report record counts and storage sizes",
+	},
+	"db-verify": {
+		readOnly: true,
+		run:      dbVerify,
+		help:     "check the database for invariant violations",
+	},
+	"db-vacuum": {
+		readOnly: false,
+		run:      dbVacuum,
+		help:     "compact the database (the server must be stopped)",
+	},
+	"db-reseal": {
+		readOnly: false,
+		run:      dbReseal,
+		help:     "encrypt user records with the first of the dataKeys",
+	},
+	"totp-enroll": {
+		readOnly: false,
+		run:      totpEnroll,
+		args:     "USERNAME",
+		help:     "enroll a user for TOTP verification (the server must be stopped)",
+	},
+}
+
+func runDBCommand(name string, cmd dbCommand, args []string) {
+	fs := flag.NewFlagSet(name, flag.ExitOnError)
+	persist := fs.String("persist", "persist_pkg", "persistent data directory")
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: alpenhorn-pkg %s [-persist DIR] %s\n\n%s\n", name, cmd.args, cmd.help)
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if want := len(strings.Fields(cmd.args)); fs.NArg() != want {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	backend, location, keys := dbConfig(*persist)
+	db, err := openDB(backend, location, keys, cmd.readOnly)
+	if err != nil {
+		log.Fatalf("error opening database: %s", err)
+	}
+	err = cmd.run(db, fs.Args())
+	if closeErr := db.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		log.Fatalf("%s: %s", name, err)
+	}
+}
+
+func dbStats(db kv.DB, _ []string) error {
+	stats, err := pkg.CollectDBStats(db)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("registrations:    %d\n", stats.Registrations)
+	fmt.Printf("last extractions: %d\n", stats.LastExtractions)
+	fmt.Printf("user logs:        %d\n", stats.UserLogs)
+	fmt.Printf("pq keys:          %d\n", stats.PQKeys)
+	fmt.Printf("rename holds:     %d\n", stats.RenameHolds)
+	fmt.Printf("recovery keys:    %d\n", stats.RecoveryKeys)
+	fmt.Printf("replay entries:   %d\n", stats.ReplayEntries)
+	fmt.Printf("domain counters:  %d\n", stats.DomainQuotaCounters)
+	fmt.Printf("spent tokens:     %d\n", stats.SpentTokens)
+	fmt.Printf("reserved tokens:  %d\n", stats.ReservedOverrides)
+	fmt.Printf("verifier records: %d\n", stats.VerifierRecords)
+	fmt.Printf("log entries:      %d\n", stats.LogEntries)
+	fmt.Printf("reg log entries:  %d\n", stats.RegistrationLogEntries)
+	fmt.Printf("audit events:     %d\n", stats.AuditEvents)
+	fmt.Printf("abuse reports:    %d\n", stats.AbuseReports)
+	fmt.Printf("blocklist:        %d\n", stats.BlocklistEntries)
+	fmt.Printf("coordinators:     %d\n", stats.CoordinatorRecords)
+	fmt.Printf("other keys:       %d\n", stats.OtherKeys)
+	fmt.Printf("key bytes:        %d\n", stats.KeyBytes)
+	fmt.Printf("value bytes:      %d\n", stats.ValueBytes)
+	fmt.Printf("disk size:        %d\n", stats.DiskSize)
+	fmt.Printf("schema version:   %d (server %d)\n", stats.SchemaVersion, pkg.SchemaVersion())
+	return nil
+}
+
+// runMigrate applies the database migrations for alpenhorn-pkg -migrate.
+func runMigrate(backend, dbPath string, keys []kv.SealKey) {
+	db, err := openDB(backend, dbPath, keys, false)
+	if err != nil {
+		log.Fatalf("error opening database: %s", err)
+	}
+	applied, err := pkg.Migrate(db, nil)
+	for _, m := range applied {
+		fmt.Printf("applied migration %d: %s\n", m.Version, m.Name)
+	}
+	if closeErr := db.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		log.Fatalf("migrate: %s", err)
+	}
+	fmt.Printf("database schema is at version %d\n", pkg.SchemaVersion())
+}
+
+func dbVerify(db kv.DB, _ []string) error {
+	problems, err := pkg.VerifyDB(db)
+	if err != nil {
+		return err
+	}
+	for _, p := range problems {
+		fmt.Println(p)
+	}
+	if len(problems) > 0 {
+		return errors.New("found %d problem(s)", len(problems))
+	}
+	fmt.Println("OK")
+	return nil
+}
+
+func dbVacuum(db kv.DB, _ []string) error {
+	before := db.Size()
+	if err := pkg.VacuumDB(db); err != nil {
+		return err
+	}
+	after := db.Size()
+	fmt.Printf("disk size: %d -> %d bytes\n", before, after)
+	return nil
+}
+
+func dbReseal(db kv.DB, _ []string) error {
+	sealed, ok := db.(*kv.SealedDB)
+	if !ok {
+		return errors.New("dataKeys is not set")
+	}
+	resealed, stale, err := pkg.ResealDB(sealed)
+	if err != nil {
+		return errors.Wrap(err, "resealed %d records", resealed)
+	}
+	fmt.Printf("resealed records: %d\n", resealed)
+	fmt.Printf("stale records:    %d\n", stale)
+	if stale > 0 {
+		fmt.Println("Stale records expire on their own; keep the old dataKeys until they do.")
+	}
+	return nil
+}
+
+func totpEnroll(db kv.DB, args []string) error {
+	username := args[0]
+	secret, err := pkg.EnrollTOTP(db, username)
+	if err != nil {
+		return err
+	}
+	fmt.Println("Add this account to the user's authenticator app:")
+	fmt.Println(pkg.TOTPURI("Alpenhorn", username, secret))
+	return nil
+}
+
+// dbConfig returns the storage backend named in the server's config
+// file, the database's location, and the data keys, falling back to
+// the defaults if the config cannot be read.
+func dbConfig(persistPath string) (backend, location string, keys []kv.SealKey) {
+	conf := new(Config)
+	data, err := ioutil.ReadFile(filepath.Join(persistPath, "pkg.conf"))
+	if err == nil {
+		if err := toml.Unmarshal(data, conf); err != nil {
+			conf = new(Config)
+		}
+		keysafe.Zero(data)
+	}
+	keys, err = parseDataKeys(conf.DataKeys)
+	if err != nil {
+		log.Fatal(err)
+	}
+	return conf.DBBackend, dbLocation(conf, persistPath), keys
+}
+
+// openDB opens the server's database. If keys is not empty, user
+// records are encrypted and decrypted with them as the server does.
+func openDB(backend, location string, keys []kv.SealKey, readOnly bool) (kv.DB, error) {
+	db, err := pkg.OpenDB(backend, location, readOnly)
+	if err != nil || len(keys) == 0 {
+		return db, err
+	}
+	sealed, err := pkg.SealDB(db, keys)
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return sealed, nil
+}
+
+// dbLocation returns where the server's database is: the data source
+// name for MySQL, and a directory under the persist directory for the
+// other backends.
+func dbLocation(conf *Config, persistPath string) string {
+	if conf.DBBackend == kv.MySQL {
+		return conf.DBSource
+	}
+	return filepath.Join(persistPath, "db")
+}
+
+// mysqlLinked reports whether the server was built with a MySQL driver;
+// see mysql.go.
+func mysqlLinked() bool {
+	for _, name := range sql.Drivers() {
+		if name == kv.MySQL {
+			return true
+		}
+	}
+	return false
+}
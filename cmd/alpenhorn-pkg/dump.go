@@ -0,0 +1,101 @@
+// Copyright 2018 David Lazar. All rights reserved.
+// Use of this source code is governed by the GNU AGPL
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"fmt"
+	"os"
+
+	"golang.org/x/crypto/ssh/terminal"
+
+	"vuvuzela.io/alpenhorn/internal/keysafe"
+	"vuvuzela.io/alpenhorn/log"
+	"vuvuzela.io/alpenhorn/pkg"
+	"vuvuzela.io/alpenhorn/pkg/kv"
+)
+
+// runDump writes an archive of the database for alpenhorn-pkg -dump.
+// Records are decrypted with keys, so the archive is protected by the
+// passphrase alone.
+func runDump(backend, dbPath string, keys []kv.SealKey, path string, signer crypto.Signer) {
+	pw := readPassphrase(true)
+	defer keysafe.Zero(pw)
+
+	db, err := openDB(backend, dbPath, keys, true)
+	if err != nil {
+		log.Fatalf("error opening database: %s", err)
+	}
+	defer db.Close()
+
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		log.Fatal(err)
+	}
+	n, err := pkg.DumpDB(db, f, pw, signer)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(path)
+		log.Fatalf("dump: %s", err)
+	}
+	fmt.Printf("wrote %d records to %s\n", n, path)
+}
+
+// runRestore loads an archive into the database for alpenhorn-pkg
+// -restore, encrypting the records with keys.
+func runRestore(backend, dbPath string, keys []kv.SealKey, path string, serverKey ed25519.PublicKey) {
+	f, err := os.Open(path)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer f.Close()
+
+	pw := readPassphrase(false)
+	defer keysafe.Zero(pw)
+
+	db, err := openDB(backend, dbPath, keys, false)
+	if err != nil {
+		log.Fatalf("error opening database: %s", err)
+	}
+	n, err := pkg.RestoreDB(db, f, pw, serverKey)
+	if closeErr := db.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		log.Fatalf("restore: %s (restored %d records)", err, n)
+	}
+	fmt.Printf("restored %d records from %s\n", n, path)
+}
+
+func readPassphrase(confirm bool) []byte {
+	for {
+		fmt.Fprintf(os.Stderr, "Enter dump passphrase: ")
+		pw, err := terminal.ReadPassword(0)
+		fmt.Fprintln(os.Stderr)
+		if err != nil {
+			log.Fatalf("terminal.ReadPassword: %s", err)
+		}
+		if len(pw) == 0 {
+			continue
+		}
+		if !confirm {
+			return pw
+		}
+
+		fmt.Fprintf(os.Stderr, "Enter same passphrase again: ")
+		again, err := terminal.ReadPassword(0)
+		fmt.Fprintln(os.Stderr)
+		if err != nil {
+			log.Fatalf("terminal.ReadPassword: %s", err)
+		}
+		if keysafe.Equal(pw, again) {
+			return pw
+		}
+		fmt.Fprintf(os.Stderr, "Passphrases do not match. Try again.\n")
+	}
+}
@@ -7,40 +7,158 @@ package main
 import (
 	"bytes"
 	"context"
+	"crypto"
 	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
 	"flag"
 	"fmt"
 	"io/ioutil"
 	golog "log"
+	"net"
 	"net/http"
 	"os"
 	"os/signal"
 	"path/filepath"
+	"strconv"
+	"strings"
 	"syscall"
 	"text/template"
 	"time"
 
+	"golang.org/x/net/netutil"
+
 	"vuvuzela.io/alpenhorn/cmd/cmdutil"
 	"vuvuzela.io/alpenhorn/config"
 	"vuvuzela.io/alpenhorn/edtls"
 	"vuvuzela.io/alpenhorn/encoding/toml"
 	"vuvuzela.io/alpenhorn/errors"
 	"vuvuzela.io/alpenhorn/internal/alplog"
+	"vuvuzela.io/alpenhorn/internal/keysafe"
+	"vuvuzela.io/alpenhorn/internal/sandbox"
+	"vuvuzela.io/alpenhorn/internal/version"
 	"vuvuzela.io/alpenhorn/log"
 	"vuvuzela.io/alpenhorn/pkg"
+	"vuvuzela.io/alpenhorn/pkg/kv"
 	"vuvuzela.io/crypto/rand"
 )
 
 var (
-	doinit      = flag.Bool("init", false, "create config file")
-	persistPath = flag.String("persist", "persist_pkg", "persistent data directory")
+	doinit       = flag.Bool("init", false, "create config file")
+	persistPath  = flag.String("persist", "persist_pkg", "persistent data directory")
+	printVersion = flag.Bool("version", false, "print version information and exit")
+	mlockKeys    = flag.Bool("mlock", false, "lock private keys in memory so they are not swapped to disk")
+	doCheck      = flag.Bool("check", false, "check config and database, then exit")
+	doMigrate    = flag.Bool("migrate", false, "migrate the database to the current schema, then exit")
+	dumpPath     = flag.String("dump", "", "write an encrypted archive of the database to `file`, then exit")
+	restorePath  = flag.String("restore", "", "load the database from an archive `file` written by -dump, then exit")
+	logFlags     = alplog.RegisterFlags(flag.CommandLine)
+	sandboxFlags = sandbox.RegisterFlags(flag.CommandLine)
 )
 
 type Config struct {
 	PublicKey  ed25519.PublicKey
 	PrivateKey ed25519.PrivateKey
 
-	ListenAddr string
+	SigningKeyURI string
+
+	PreviousPrivateKey ed25519.PrivateKey
+	PreviousKeyExpires time.Time
+
+	ListenAddr    string
+	MetricsAddr   string
+	DashboardAddr string
+
+	AdminAddr string
+	AdminKey  ed25519.PublicKey
+
+	CoordinatorKeys     string
+	CoordinatorNetworks string
+
+	AuditLog       string
+	AuditRetention time.Duration
+
+	AbuseReportRetention time.Duration
+
+	DBBackend        string
+	DBSource         string
+	DBReplicaSource  string
+	ManualMigrations bool
+	DataKeys         string
+
+	MySQLMaxOpenConns    int
+	MySQLMaxIdleConns    int
+	MySQLConnMaxLifetime time.Duration
+
+	ClusterNodeID   string
+	ClusterAddress  string
+	ClusterKey      []byte
+	ClusterLeaseTTL time.Duration
+
+	RoundKEK []byte
+
+	LookupLimit    int
+	LookupWindow   time.Duration
+	LookupWorkBits int
+
+	RegisterWorkBits int
+
+	UsernameMaxLength    int
+	UsernameAllowUnicode bool
+
+	ExtractsPerRound int
+	ExtractsPerEpoch int
+
+	LoginKeyGrace time.Duration
+	MaxLoginKeys  int
+	UnverifiedTTL time.Duration
+
+	RetainRounds   int
+	RetainRoundAge time.Duration
+
+	MaxConns              int
+	MaxConcurrentRequests int
+	MaxRequestBytes       int64
+
+	EndpointLimits       string
+	EndpointQueueTimeout time.Duration
+
+	IPRate        float64
+	IPBurst       int
+	UsernameRate  float64
+	UsernameBurst int
+
+	LogLevel string
+
+	RequestLogRate      float64
+	RequestLogRoutes    string
+	RequestLogUsernames bool
+
+	RegistrationMode     string
+	RegistrationTokenKey []byte
+	DomainQuotas         string
+	ReservedNamesFile    string
+	ReadOnly             bool
+	Captcha              string
+	CaptchaSecret        string
+	Verifier             string
+
+	SMTPAddr      string
+	SMTPUsername  string
+	SMTPPassword  string
+	EmailFrom     string
+	EmailSubject  string
+	EmailTemplate string
+
+	SMSGatewayURL string
+	SMSNumbers    string
+
+	WebhookURL string
+
+	EventWebhooks      string
+	EventWebhookSecret string
+	EventWebhookEvents string
 }
 
 var funcMap = template.FuncMap{
@@ -52,7 +170,293 @@ const confTemplate = `# Alpenhorn PKG server config
 publicKey  = {{.PublicKey | base32 | printf "%q"}}
 privateKey = {{.PrivateKey | base32 | printf "%q"}}
 
+# To keep the private key out of this file, remove privateKey and set
+# signingKeyURI to the key's location, such as a "file:" path or a
+# PKCS#11 URI when the server is built with a PKCS#11 driver:
+#
+#   signingKeyURI = "pkcs11:token=alpenhorn;object=pkg-signing-key"
+
+# To rotate the server's key, put a new key pair above and the old
+# private key in previousPrivateKey, and publish a config that lists
+# the new key with the old one as the server's PreviousKey. Until
+# previousKeyExpires, the server signs replies with both keys and
+# presents its old key to TLS clients, which lets clients that have
+# not seen the new config keep working:
+#
+#   previousPrivateKey = "..."
+#   previousKeyExpires = "2018-06-01T00:00:00Z"
+
 listenAddr = {{.ListenAddr | printf "%q"}}
+
+# The server rereads this file on SIGHUP and applies logLevel,
+# registrationMode, readOnly, the verifier settings, the rate limits,
+# coordinatorKeys, coordinatorNetworks, and reservedNamesFile (which it
+# also rereads), along with the coordinator key from the current
+# AddFriend config. Other settings take effect when the server
+# restarts.
+#
+# If logLevel is empty, the -logLevel flag sets it.
+logLevel = {{.LogLevel | printf "%q"}}
+
+# requestLogRate is the fraction of requests the server logs at the info
+# level, with their route, status, error codes, duration, and a salted
+# hash of the username, to debug load. requestLogRoutes overrides it
+# for some routes, as space-separated route=rate pairs such as
+# "/extract=0.01 /register=1"; a rate of 0 turns logging off for the
+# route. With requestLogUsernames, usernames are logged in the clear.
+requestLogRate      = {{.RequestLogRate}}
+requestLogRoutes    = {{.RequestLogRoutes | printf "%q"}}
+requestLogUsernames = {{.RequestLogUsernames}}
+
+# If metricsAddr is set, the server serves Prometheus metrics over
+# plain HTTP at /metrics on this address. Keep it off the public
+# internet: the metrics reveal how many users register and extract.
+metricsAddr = {{.MetricsAddr | printf "%q"}}
+
+# If dashboardAddr is set, the server serves a read-only status page for
+# operators over plain HTTP on this address, as HTML at / and as JSON
+# at /status.json. Like the metrics, keep it off the public internet.
+dashboardAddr = {{.DashboardAddr | printf "%q"}}
+
+# If adminAddr is set, the server serves the admin API on this address
+# to clients that authenticate with adminKey, including CPU and heap
+# profiles, goroutine dumps, and GC stats under /admin/debug/.
+adminAddr = {{.AdminAddr | printf "%q"}}
+adminKey  = {{.AdminKey | base32 | printf "%q"}}
+
+# The server accepts round setups from the coordinator in the current
+# AddFriend config and from the coordinators whose base32 keys are
+# listed in coordinatorKeys, separated by spaces.
+coordinatorKeys = {{.CoordinatorKeys | printf "%q"}}
+
+# If coordinatorNetworks lists networks in CIDR notation, separated by
+# spaces, round setups are only accepted from addresses in them, such
+# as "10.0.0.0/8 192.0.2.7/32".
+coordinatorNetworks = {{.CoordinatorNetworks | printf "%q"}}
+
+# The server records registrations, verifications, extractions, and key
+# changes in an audit log. The admin API can query the events in the
+# database for auditRetention. auditLog also writes them to a file, or
+# to the system log if it is "syslog" (not on Windows).
+auditLog       = {{.AuditLog | printf "%q"}}
+auditRetention = {{.AuditRetention | printf "%q"}}
+
+# Users can report other usernames for abuse. The admin API lists the
+# reports for review until abuseReportRetention passes.
+abuseReportRetention = {{.AbuseReportRetention | printf "%q"}}
+
+# Where the server keeps its state: under the persist directory with
+# "badger" (the default) or "bolt", a single file that suits small
+# deployments, or with "mysql", in the MySQL or MariaDB database named
+# by the data source name in dbSource, such as
+# "alpenhorn:password@tcp(db.example.org:3306)/pkg". The mysql backend
+# needs a server built with the mysql build tag.
+dbBackend = {{.DBBackend | printf "%q"}}
+dbSource  = {{.DBSource | printf "%q"}}
+
+# A mysql server can read status requests' last extractions and run
+# its full scans on a read replica, named by the data source name in
+# dbReplicaSource, to take load off the primary. Leave it empty to
+# read everything from dbSource.
+dbReplicaSource = {{.DBReplicaSource | printf "%q"}}
+
+# The mysql backend keeps a pool of connections to the database, and
+# another to its replica if dbReplicaSource is set: at most
+# mysqlMaxOpenConns open (0 for no limit), mysqlMaxIdleConns of them
+# idle, each reused for at most mysqlConnMaxLifetime (0 for no limit).
+# Servers that share a database must fit under its
+# max_connections between them, and mysqlConnMaxLifetime should be
+# shorter than its wait_timeout.
+mysqlMaxOpenConns    = {{.MySQLMaxOpenConns}}
+mysqlMaxIdleConns    = {{.MySQLMaxIdleConns}}
+mysqlConnMaxLifetime = {{.MySQLConnMaxLifetime | printf "%q"}}
+
+# The server migrates its database to the current schema when it
+# starts. If manualMigrations is true, it refuses to start on an out of
+# date database instead, and the operator runs alpenhorn-pkg -migrate
+# (with the server stopped and the database backed up).
+manualMigrations = {{.ManualMigrations}}
+
+# The server encrypts users' login keys and contact details in the
+# database with dataKeys, and replaces the usernames in its keys with
+# keyed hashes, so a copy of the database does not reveal them. The
+# registration and attestation logs it publishes are not hidden.
+# dataKeys is a list of ID:KEY pairs, where ID is a number from 1 to
+# 255 and KEY is a base32 32-byte key. The first key encrypts new
+# records. To rotate it, put a new key with a new ID first, restart the
+# server, and run alpenhorn-pkg db-reseal, which also moves records
+# written before dataKeys was set to their hashed usernames;
+# remove the old key once db-reseal reports no stale records. Keep
+# dataKeys with the database's backups: the database cannot be read
+# without them. Dumps (-dump) are decrypted with dataKeys and restored
+# with the keys in the restoring server's config. An empty dataKeys
+# leaves the database unencrypted.
+dataKeys = {{.DataKeys | printf "%q"}}
+
+# Several servers can serve one PKG from a shared "mysql" database if
+# they have the same keys and clusterKey and each has its own
+# clusterNodeID. The servers elect a leader, which sets up rounds and
+# sends their keys to the others, so clusterAddress is the host:port at
+# which the other servers reach this one's listenAddr. The leader holds
+# its lease for clusterLeaseTTL; the servers' clocks must agree to well
+# within it. Only the leader answers round setups, and only it answers
+# /leaderz with 200 OK, so point the coordinator at a load balancer
+# that checks /leaderz.
+clusterNodeID   = {{.ClusterNodeID | printf "%q"}}
+clusterAddress  = {{.ClusterAddress | printf "%q"}}
+clusterKey      = {{.ClusterKey | base32 | printf "%q"}}
+clusterLeaseTTL = {{.ClusterLeaseTTL | printf "%q"}}
+
+# The server keeps round master secrets sealed in memory with a key
+# derived from privateKey. A server whose key is behind signingKeyURI
+# needs a base32 32-byte roundKEK instead if it is in a cluster, the
+# same on every server in the cluster. Leave it empty otherwise.
+roundKEK = {{.RoundKEK | base32 | printf "%q"}}
+
+# To make harvesting the user base expensive, a client address may look
+# up at most lookupLimit distinct usernames per lookupWindow (0 disables
+# the limit), and anonymous PQ key lookups must carry a proof of work
+# with lookupWorkBits leading zero bits (0 disables the proof of work).
+# Users' signed requests for their own usernames do not count, but the
+# users behind a NAT share its address, so leave room for them.
+lookupLimit    = {{.LookupLimit}}
+lookupWindow   = {{.LookupWindow | printf "%q"}}
+lookupWorkBits = {{.LookupWorkBits}}
+
+# To make registering many accounts expensive, registrations must carry
+# a proof of work with registerWorkBits leading zero bits (0 disables
+# the proof of work).
+registerWorkBits = {{.RegisterWorkBits}}
+
+# Usernames are lowercase email addresses of at most usernameMaxLength
+# characters (0 means 64, the most allowed). If usernameAllowUnicode is true, they may
+# contain non-ASCII letters, but each part must be written in a single
+# script so that lookalike usernames are refused.
+usernameMaxLength    = {{.UsernameMaxLength}}
+usernameAllowUnicode = {{.UsernameAllowUnicode}}
+
+# To slow down anyone extracting keys with a stolen login key, a user
+# may extract their key for a round at most extractsPerRound times, and
+# at most extractsPerEpoch keys per day (0 disables the limits).
+extractsPerRound = {{.ExtractsPerRound}}
+extractsPerEpoch = {{.ExtractsPerEpoch}}
+
+# After a user rotates their login key in place, the old key keeps
+# working for loginKeyGrace so their other devices can catch up.
+loginKeyGrace = {{.LoginKeyGrace | printf "%q"}}
+
+# A user can enroll login keys for their other devices, up to
+# maxLoginKeys keys in all.
+maxLoginKeys = {{.MaxLoginKeys}}
+
+# A user who revokes their login key must verify their username again;
+# the registration is deleted if they have not after unverifiedTTL
+# ("0s" keeps it forever). Verification codes and TOTP secrets of
+# usernames that are still not registered after unverifiedTTL are
+# deleted too.
+unverifiedTTL = {{.UnverifiedTTL | printf "%q"}}
+
+# The server erases the keys of rounds other than the last retainRounds,
+# and of rounds committed more than retainRoundAge ago, along with users'
+# last extraction records from before the rounds it keeps (0 and "0s"
+# disable the limits).
+retainRounds   = {{.RetainRounds}}
+retainRoundAge = {{.RetainRoundAge | printf "%q"}}
+
+# The server accepts at most maxConns connections at once (0 means no
+# limit), handles at most maxConcurrentRequests client requests at once
+# (0 means no limit), and refuses request bodies larger than
+# maxRequestBytes (0 means the default of 1 MiB).
+maxConns              = {{.MaxConns}}
+maxConcurrentRequests = {{.MaxConcurrentRequests}}
+maxRequestBytes       = {{.MaxRequestBytes}}
+
+# endpointLimits caps the client requests the server handles at once on
+# some paths, as space-separated path=count pairs such as
+# "/extract=512 /register=32", so a burst on one path cannot starve the
+# others. Requests over a path's limit wait up to endpointQueueTimeout
+# for their turn before they are refused.
+endpointLimits       = {{.EndpointLimits | printf "%q"}}
+endpointQueueTimeout = {{.EndpointQueueTimeout | printf "%q"}}
+
+# Each source IP address may make ipBurst user requests at once and
+# then ipRate per second; requests about each username are limited by
+# usernameBurst and usernameRate. A rate of 0 disables the limit.
+ipRate        = {{.IPRate}}
+ipBurst       = {{.IPBurst}}
+usernameRate  = {{.UsernameRate}}
+usernameBurst = {{.UsernameBurst}}
+
+# Who may register usernames:
+#   "email"   users who show the verifier below that they own their
+#             usernames (the default)
+#   "fcfs"    whoever registers a username first, without verification
+#   "token"   whoever registers a username first with a registration
+#             token from alpenhorn-token-issuer, without verification
+#   "closed"  nobody; registered users can still extract their keys
+registrationMode = {{.RegistrationMode | printf "%q"}}
+
+# In "token" mode, registrationTokenKey is the token issuer's public key,
+# as printed by alpenhorn-token-issuer -keygen.
+registrationTokenKey = {{.RegistrationTokenKey | base32 | printf "%q"}}
+
+# To slow down mass registrations at free mail providers, domainQuotas
+# caps the registrations accepted per UTC day for each email domain. It
+# is a list of space-separated domain=count pairs, where the domain "*"
+# stands for every domain not listed, such as "gmail.com=500 *=2000".
+domainQuotas = {{.DomainQuotas | printf "%q"}}
+
+# If reservedNamesFile is set, it names a file of reserved names, one per
+# line, with "#" starting a comment. A name without an "@", such as
+# "admin", reserves that name at every domain. Reserved usernames can
+# only be registered with an override token from the admin API.
+reservedNamesFile = {{.ReservedNamesFile | printf "%q"}}
+
+# If readOnly is true, the server refuses registrations and changes to
+# users' keys, but keeps answering extractions, such as while migrating
+# the database or fending off a wave of abusive registrations.
+readOnly = {{.ReadOnly}}
+
+# If captcha is set, registrations must carry a CAPTCHA solved at
+# "hcaptcha" or "recaptcha", or at another service with a compatible
+# siteverify URL, which the server checks with captchaSecret.
+captcha       = {{.Captcha | printf "%q"}}
+captchaSecret = {{.CaptchaSecret | printf "%q"}}
+
+# How the server checks that users own their usernames in "email" mode:
+#   "registrar"  asks the registrar in the AddFriend config (the default)
+#   "email"      emails a token through the mail server at smtpAddr;
+#                emailTemplate optionally names a Go text/template file
+#                for the body of the emails
+#   "sms"        texts a code through the gateway at smsGatewayURL to
+#                the numbers in smsNumbers, a file of "username number"
+#                lines
+#   "totp"       checks authenticator app codes; enroll users with
+#                alpenhorn-pkg totp-enroll
+#   "webhook"    asks the service at webhookURL
+verifier = {{.Verifier | printf "%q"}}
+
+smtpAddr      = {{.SMTPAddr | printf "%q"}}
+smtpUsername  = {{.SMTPUsername | printf "%q"}}
+smtpPassword  = {{.SMTPPassword | printf "%q"}}
+emailFrom     = {{.EmailFrom | printf "%q"}}
+emailSubject  = {{.EmailSubject | printf "%q"}}
+emailTemplate = {{.EmailTemplate | printf "%q"}}
+
+smsGatewayURL = {{.SMSGatewayURL | printf "%q"}}
+smsNumbers    = {{.SMSNumbers | printf "%q"}}
+
+webhookURL = {{.WebhookURL | printf "%q"}}
+
+# The server posts events as JSON to the URLs in eventWebhooks,
+# separated by spaces. Each payload is signed with eventWebhookSecret:
+# the X-Alpenhorn-Signature header is "sha256=" followed by the hex
+# HMAC-SHA256 of the body. eventWebhookEvents lists the events to post,
+# from "register", "verify", "delete", and "roundfailure"; all of them
+# are posted if it is empty.
+eventWebhooks      = {{.EventWebhooks | printf "%q"}}
+eventWebhookSecret = {{.EventWebhookSecret | printf "%q"}}
+eventWebhookEvents = {{.EventWebhookEvents | printf "%q"}}
 `
 
 func writeNewConfig(path string) {
@@ -60,12 +464,66 @@ func writeNewConfig(path string) {
 	if err != nil {
 		panic(err)
 	}
+	clusterKey := make([]byte, 32)
+	if _, err := rand.Read(clusterKey); err != nil {
+		panic(err)
+	}
+	dataKey := make([]byte, 32)
+	if _, err := rand.Read(dataKey); err != nil {
+		panic(err)
+	}
 
 	conf := &Config{
 		PublicKey:  publicKey,
 		PrivateKey: privateKey,
 
-		ListenAddr: "0.0.0.0:80",
+		ListenAddr:  "0.0.0.0:80",
+		MetricsAddr: "127.0.0.1:9102",
+
+		AuditLog:       "audit.log",
+		AuditRetention: pkg.DefaultAuditRetention,
+
+		AbuseReportRetention: pkg.DefaultAbuseReportRetention,
+
+		DBBackend: kv.Badger,
+		DataKeys:  "1:" + toml.EncodeBytes(dataKey),
+
+		MySQLMaxOpenConns:    64,
+		MySQLMaxIdleConns:    16,
+		MySQLConnMaxLifetime: 5 * time.Minute,
+
+		ClusterKey:      clusterKey,
+		ClusterLeaseTTL: pkg.DefaultClusterLeaseTTL,
+
+		LookupLimit:    1000,
+		LookupWindow:   pkg.DefaultLookupWindow,
+		LookupWorkBits: 16,
+
+		RegisterWorkBits: 20,
+
+		UsernameMaxLength: 64,
+
+		ExtractsPerRound: 10,
+
+		LoginKeyGrace: pkg.DefaultLoginKeyGrace,
+		MaxLoginKeys:  pkg.DefaultMaxLoginKeys,
+		UnverifiedTTL: 30 * 24 * time.Hour,
+
+		RetainRoundAge: 24 * time.Hour,
+
+		MaxConns:              4096,
+		MaxConcurrentRequests: 512,
+
+		EndpointQueueTimeout: pkg.DefaultEndpointQueueTimeout,
+
+		IPRate:        5,
+		IPBurst:       20,
+		UsernameRate:  0.2,
+		UsernameBurst: 10,
+
+		RegistrationMode: string(pkg.RegistrationEmail),
+		Verifier:         "registrar",
+		EmailSubject:     "Your Alpenhorn verification token",
 	}
 
 	tmpl := template.Must(template.New("config").Funcs(funcMap).Parse(confTemplate))
@@ -85,7 +543,20 @@ func writeNewConfig(path string) {
 }
 
 func main() {
+	if len(os.Args) > 1 {
+		if cmd, ok := dbCommands[os.Args[1]]; ok {
+			runDBCommand(os.Args[1], cmd, os.Args[2:])
+			return
+		}
+	}
 	flag.Parse()
+	if *printVersion {
+		fmt.Println(version.String())
+		return
+	}
+	if *doCheck {
+		runCheck(filepath.Join(*persistPath, "pkg.conf"))
+	}
 
 	if err := os.MkdirAll(*persistPath, 0700); err != nil {
 		log.Fatal(err)
@@ -113,51 +584,199 @@ func main() {
 	if err != nil {
 		log.Fatalf("invalid config: %s", err)
 	}
+	dataKeys, err := parseDataKeys(conf.DataKeys)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if *doMigrate {
+		runMigrate(conf.DBBackend, dbLocation(conf, *persistPath), dataKeys)
+		return
+	}
+
+	var signer crypto.Signer
+	if conf.SigningKeyURI != "" {
+		signer, err = pkg.OpenSigner(conf.SigningKeyURI)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if !conf.PublicKey.Equal(signer.Public()) {
+			log.Fatalf("signingKeyURI: key does not match publicKey")
+		}
+	} else {
+		keySecret := cmdutil.ProtectKey(&conf.PrivateKey, *mlockKeys)
+		defer keySecret.Destroy()
+		signer = conf.PrivateKey
+	}
+	if len(conf.PreviousPrivateKey) != 0 {
+		prevSecret := cmdutil.ProtectKey(&conf.PreviousPrivateKey, *mlockKeys)
+		defer prevSecret.Destroy()
+	}
+	// The config file holds a copy of the private key.
+	keysafe.Zero(data)
+
+	if *dumpPath != "" {
+		runDump(conf.DBBackend, dbLocation(conf, *persistPath), dataKeys, *dumpPath, signer)
+		return
+	}
+	if *restorePath != "" {
+		runRestore(conf.DBBackend, dbLocation(conf, *persistPath), dataKeys, *restorePath, conf.PublicKey)
+		return
+	}
 
 	logsDir := filepath.Join(*persistPath, "logs")
-	logHandler, err := alplog.NewProductionOutput(logsDir)
+	logger, logHandler, err := logFlags.NewLogger(logsDir)
 	if err != nil {
 		log.Fatal(err)
 	}
+	level, err := logLevel(conf)
+	if err != nil {
+		log.Fatal(err)
+	}
+	// The level can change when the config is reloaded.
+	levels := alplog.NewLevelFilter(level, logger.EntryHandler)
+	logger.EntryHandler = levels
+	logger.Level = log.DebugLevel
 
 	signedConfig, err := config.StdClient.CurrentConfig("AddFriend")
 	if err != nil {
 		log.Fatal(err)
 	}
 	addFriendConfig := signedConfig.Inner.(*config.AddFriendConfig)
-	if addFriendConfig.Registrar.Address == "" {
-		log.Fatal("no Registrar Address defined in current addfriend config!")
+	settings, err := pkgSettings(conf, addFriendConfig)
+	if err != nil {
+		log.Fatal(err)
 	}
 
-	dbPath := filepath.Join(*persistPath, "db")
-	if err := os.MkdirAll(dbPath, 0700); err != nil {
+	dbPath := dbLocation(conf, *persistPath)
+	if conf.DBBackend != kv.MySQL {
+		if err := os.MkdirAll(dbPath, 0700); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	auditLog, err := openAuditLog(conf.AuditLog, *persistPath)
+	if err != nil {
+		log.Fatalf("opening audit log: %s", err)
+	}
+	if auditLog != nil {
+		defer auditLog.Close()
+	}
+
+	requestLogRoutes, err := parseRequestLogRoutes(conf.RequestLogRoutes)
+	if err != nil {
+		log.Fatal(err)
+	}
+	endpointLimits, err := parseEndpointLimits(conf.EndpointLimits)
+	if err != nil {
 		log.Fatal(err)
 	}
+	domainQuotas, err := parseDomainQuotas(conf.DomainQuotas)
+	if err != nil {
+		log.Fatal(err)
+	}
+	webhooks, err := eventWebhooks(conf)
+	if err != nil {
+		log.Fatal(err)
+	}
+	var captcha pkg.CaptchaVerifier
+	if c := newCaptcha(conf); c != nil {
+		captcha = c
+	}
 
 	pkgConfig := &pkg.Config{
-		DBPath:     dbPath,
-		SigningKey: conf.PrivateKey,
+		DBPath:           dbPath,
+		DBBackend:        conf.DBBackend,
+		ReplicaSource:    conf.DBReplicaSource,
+		MaxOpenConns:     conf.MySQLMaxOpenConns,
+		MaxIdleConns:     conf.MySQLMaxIdleConns,
+		ConnMaxLifetime:  conf.MySQLConnMaxLifetime,
+		ManualMigrations: conf.ManualMigrations,
+		DataKeys:         dataKeys,
+		Signer:           signer,
+
+		PreviousSigningKey: conf.PreviousPrivateKey,
+		PreviousKeyExpires: conf.PreviousKeyExpires,
+
+		CoordinatorKey:      settings.CoordinatorKey,
+		CoordinatorKeys:     settings.CoordinatorKeys,
+		CoordinatorNetworks: settings.CoordinatorNetworks,
+		RegistrarKey:        addFriendConfig.Registrar.Key,
+		AdminKey:            conf.AdminKey,
+
+		Logger: logger,
+
+		RegistrationMode:     settings.RegistrationMode,
+		RegistrationTokenKey: settings.RegistrationTokenKey,
+		ReservedNames:        settings.ReservedNames,
+		Verifier:             settings.Verifier,
+		DomainQuotas:         domainQuotas,
+		Captcha:              captcha,
+		Webhooks:             webhooks,
+
+		AuditRetention:       conf.AuditRetention,
+		AbuseReportRetention: conf.AbuseReportRetention,
+
+		MaxRequestBytes:       conf.MaxRequestBytes,
+		MaxConcurrentRequests: conf.MaxConcurrentRequests,
 
-		CoordinatorKey: addFriendConfig.Coordinator.Key,
-		RegistrarKey:   addFriendConfig.Registrar.Key,
+		EndpointLimits:       endpointLimits,
+		EndpointQueueTimeout: conf.EndpointQueueTimeout,
 
-		Logger: &log.Logger{
-			Level:        log.InfoLevel,
-			EntryHandler: logHandler,
+		LookupLimit:    conf.LookupLimit,
+		LookupWindow:   conf.LookupWindow,
+		LookupWorkBits: conf.LookupWorkBits,
+
+		RegisterWorkBits: conf.RegisterWorkBits,
+
+		UsernamePolicy: pkg.EmailPolicy{
+			MaxLength:    conf.UsernameMaxLength,
+			AllowUnicode: conf.UsernameAllowUnicode,
+		},
+
+		RequestLog: pkg.RequestLog{
+			SampleRate:     conf.RequestLogRate,
+			PathRates:      requestLogRoutes,
+			ClearUsernames: conf.RequestLogUsernames,
+		},
+
+		ExtractQuota: pkg.ExtractQuota{
+			PerRound: conf.ExtractsPerRound,
+			PerEpoch: conf.ExtractsPerEpoch,
 		},
 
-		RegTokenHandler: pkg.ExternalVerifier(fmt.Sprintf("https://%s/verify", addFriendConfig.Registrar.Address)),
+		LoginKeyGrace: conf.LoginKeyGrace,
+		MaxLoginKeys:  conf.MaxLoginKeys,
+		UnverifiedTTL: conf.UnverifiedTTL,
+
+		RoundRetention: pkg.RoundRetention{
+			Rounds: uint32(conf.RetainRounds),
+			Age:    conf.RetainRoundAge,
+		},
+
+		IPRateLimit:       settings.IPRateLimit,
+		UsernameRateLimit: settings.UsernameRateLimit,
+	}
+	if len(conf.RoundKEK) != 0 {
+		pkgConfig.RoundKEK = new([32]byte)
+		copy(pkgConfig.RoundKEK[:], conf.RoundKEK)
+	}
+	if conf.ClusterNodeID != "" {
+		clusterKey := new([32]byte)
+		copy(clusterKey[:], conf.ClusterKey)
+		pkgConfig.Cluster = &pkg.ClusterConfig{
+			NodeID:   conf.ClusterNodeID,
+			Address:  conf.ClusterAddress,
+			Key:      clusterKey,
+			LeaseTTL: conf.ClusterLeaseTTL,
+		}
+	}
+	if auditLog != nil {
+		pkgConfig.AuditLog = auditLog
 	}
 	pkgServer, err := pkg.NewServer(pkgConfig)
 	if err != nil {
 		log.Fatalf("pkg.NewServer: %s", err)
 	}
-	defer func() {
-		err := pkgServer.Close()
-		if err != nil {
-			log.Infof("PKG closed with error: %s", err)
-		}
-	}()
 
 	errorLogPath := filepath.Join(*persistPath, "http_errors.log")
 	errorFile, err := os.OpenFile(errorLogPath, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0660)
@@ -171,11 +790,62 @@ func main() {
 		Handler:  pkgServer,
 		ErrorLog: errorLog,
 
-		ReadTimeout:  10 * time.Second,
-		WriteTimeout: 30 * time.Second,
-		IdleTimeout:  60 * time.Second,
+		ReadTimeout:    10 * time.Second,
+		WriteTimeout:   30 * time.Second,
+		IdleTimeout:    60 * time.Second,
+		MaxHeaderBytes: maxHeaderBytes,
+	}
+
+	var metricsServer *http.Server
+	if conf.MetricsAddr != "" {
+		mux := http.NewServeMux()
+		mux.Handle("/metrics", pkgServer.Metrics())
+		metricsServer = &http.Server{
+			Addr:     conf.MetricsAddr,
+			Handler:  mux,
+			ErrorLog: errorLog,
+
+			ReadTimeout:    10 * time.Second,
+			WriteTimeout:   30 * time.Second,
+			MaxHeaderBytes: maxHeaderBytes,
+		}
+	}
+
+	var dashboardServer *http.Server
+	if conf.DashboardAddr != "" {
+		dashboardServer = &http.Server{
+			Handler:  pkgServer.DashboardHandler(),
+			ErrorLog: errorLog,
+
+			ReadTimeout:    10 * time.Second,
+			WriteTimeout:   30 * time.Second,
+			MaxHeaderBytes: maxHeaderBytes,
+		}
+	}
+
+	var adminServer *http.Server
+	if conf.AdminAddr != "" {
+		adminServer = &http.Server{
+			Handler:  pkgServer.AdminHandler(),
+			ErrorLog: errorLog,
+
+			ReadTimeout: 10 * time.Second,
+			// Long enough for the admin API's CPU profiles and
+			// traces, which run for up to a minute.
+			WriteTimeout:   90 * time.Second,
+			MaxHeaderBytes: maxHeaderBytes,
+		}
 	}
 
+	reloader := &reloader{
+		confPath:        confPath,
+		server:          pkgServer,
+		levels:          levels,
+		logger:          logger,
+		addFriendConfig: addFriendConfig,
+	}
+	reloader.handleSIGHUP()
+
 	sigChan := make(chan os.Signal, 1)
 	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
 	shutdownDone := make(chan struct{})
@@ -189,19 +859,98 @@ func main() {
 		if err != nil {
 			log.Infof("HTTP server shutdown with error: %s", err)
 		}
+		if metricsServer != nil {
+			metricsServer.Shutdown(ctx)
+		}
+		if dashboardServer != nil {
+			dashboardServer.Shutdown(ctx)
+		}
+		if adminServer != nil {
+			adminServer.Shutdown(ctx)
+		}
+
+		// Wait for requests in progress, such as a round's commit,
+		// before closing the database.
+		err = pkgServer.Shutdown(ctx)
+		if err != nil {
+			log.Infof("PKG shutdown with error: %s", err)
+			err = pkgServer.Close()
+		}
+		if err != nil {
+			log.Infof("PKG closed with error: %s", err)
+		}
 		close(shutdownDone)
 	}()
 
-	listener, err := edtls.Listen("tcp", conf.ListenAddr, conf.PrivateKey)
+	listener, err := listen(conf, signer)
 	if err != nil {
 		log.Fatalf("edtls.Listen: %s", err)
 	}
+	if conf.MaxConns > 0 {
+		listener = netutil.LimitListener(listener, conf.MaxConns)
+	}
+
+	var metricsListener net.Listener
+	if metricsServer != nil {
+		metricsListener, err = net.Listen("tcp", conf.MetricsAddr)
+		if err != nil {
+			log.Fatalf("listening for metrics: %s", err)
+		}
+	}
+
+	var dashboardListener net.Listener
+	if dashboardServer != nil {
+		dashboardListener, err = net.Listen("tcp", conf.DashboardAddr)
+		if err != nil {
+			log.Fatalf("listening for dashboard: %s", err)
+		}
+	}
+
+	var adminListener net.Listener
+	if adminServer != nil {
+		adminListener, err = edtls.Listen("tcp", conf.AdminAddr, signer)
+		if err != nil {
+			log.Fatalf("listening for admin API: %s", err)
+		}
+	}
+
+	if err := sandboxFlags.Apply(*persistPath, logFlags.Dir()); err != nil {
+		log.Fatalf("dropping privileges: %s", err)
+	}
 
 	// Let the user know what's happening before switching the logger.
 	log.Infof("Listening on %q; logging to %s", conf.ListenAddr, logHandler.Name())
 	// Record the start time in the logs directory.
 	pkgConfig.Logger.Infof("Listening on %q", conf.ListenAddr)
 
+	if metricsServer != nil {
+		log.Infof("Serving metrics on %q", conf.MetricsAddr)
+		go func() {
+			err := metricsServer.Serve(metricsListener)
+			if err != http.ErrServerClosed {
+				log.Errorf("metrics listen: %s", err)
+			}
+		}()
+	}
+	if dashboardServer != nil {
+		log.Infof("Serving dashboard on %q", conf.DashboardAddr)
+		go func() {
+			err := dashboardServer.Serve(dashboardListener)
+			if err != http.ErrServerClosed {
+				log.Errorf("dashboard listen: %s", err)
+			}
+		}()
+	}
+	if adminServer != nil {
+		log.Infof("Serving admin API on %q", conf.AdminAddr)
+		go func() {
+			err := adminServer.Serve(adminListener)
+			if err != http.ErrServerClosed {
+				log.Errorf("admin listen: %s", err)
+			}
+		}()
+	}
+
 	err = httpServer.Serve(listener)
 	if err != http.ErrServerClosed {
 		log.Errorf("http listen: %s", err)
@@ -211,15 +960,384 @@ func main() {
 }
 
 func checkConfig(conf *Config) error {
-	if conf.ListenAddr == "" {
-		return errors.New("no listen address specified")
+	if err := cmdutil.CheckListenAddr(conf.ListenAddr); err != nil {
+		return err
+	}
+	if conf.MetricsAddr != "" {
+		if err := cmdutil.CheckListenAddr(conf.MetricsAddr); err != nil {
+			return errors.Wrap(err, "metricsAddr")
+		}
+		if conf.MetricsAddr == conf.ListenAddr {
+			return errors.New("metricsAddr must differ from listenAddr")
+		}
+	}
+	if conf.DashboardAddr != "" {
+		if err := cmdutil.CheckListenAddr(conf.DashboardAddr); err != nil {
+			return errors.Wrap(err, "dashboardAddr")
+		}
+		if conf.DashboardAddr == conf.ListenAddr || conf.DashboardAddr == conf.MetricsAddr {
+			return errors.New("dashboardAddr must differ from listenAddr and metricsAddr")
+		}
+	}
+	if conf.AdminAddr != "" {
+		if err := cmdutil.CheckListenAddr(conf.AdminAddr); err != nil {
+			return errors.Wrap(err, "adminAddr")
+		}
+		if conf.AdminAddr == conf.ListenAddr || conf.AdminAddr == conf.MetricsAddr || conf.AdminAddr == conf.DashboardAddr {
+			return errors.New("adminAddr must differ from listenAddr, metricsAddr, and dashboardAddr")
+		}
+		if len(conf.AdminKey) != ed25519.PublicKeySize {
+			return errors.New("adminAddr is set but adminKey is not a valid key")
+		}
+	}
+	if conf.MaxConns < 0 || conf.MaxConcurrentRequests < 0 || conf.MaxRequestBytes < 0 {
+		return errors.New("maxConns, maxConcurrentRequests, and maxRequestBytes must not be negative")
+	}
+	if conf.UsernameMaxLength < 0 || conf.UsernameMaxLength > 64 {
+		return errors.New("usernameMaxLength must be between 0 and 64")
+	}
+	if conf.RetainRounds < 0 || conf.RetainRoundAge < 0 {
+		return errors.New("retainRounds and retainRoundAge must not be negative")
+	}
+	if conf.LogLevel != "" {
+		if _, err := log.ParseLevel(conf.LogLevel); err != nil {
+			return errors.Wrap(err, "logLevel")
+		}
+	}
+	switch conf.DBBackend {
+	case "", kv.Badger, kv.Bolt:
+	case kv.MySQL:
+		if conf.DBSource == "" {
+			return errors.New("dbBackend is %q without a dbSource", conf.DBBackend)
+		}
+		if !mysqlLinked() {
+			return errors.New("dbBackend is %q, but alpenhorn-pkg was built without the mysql build tag", conf.DBBackend)
+		}
+	default:
+		return errors.New("unknown dbBackend %q", conf.DBBackend)
+	}
+	if conf.DBReplicaSource != "" && conf.DBBackend != kv.MySQL {
+		return errors.New("dbReplicaSource is set, but dbBackend is %q", conf.DBBackend)
+	}
+	if conf.ClusterNodeID != "" {
+		if conf.DBBackend != kv.MySQL {
+			return errors.New("clusterNodeID is set, but dbBackend %q cannot be shared", conf.DBBackend)
+		}
+		if conf.ClusterAddress == "" {
+			return errors.New("clusterNodeID is set without a clusterAddress")
+		}
+		if len(conf.ClusterKey) != 32 {
+			return errors.New("clusterKey has %d bytes, want 32", len(conf.ClusterKey))
+		}
+		if conf.SigningKeyURI != "" && len(conf.RoundKEK) == 0 {
+			return errors.New("clusterNodeID and signingKeyURI are set without a roundKEK")
+		}
+	}
+	if len(conf.RoundKEK) != 0 && len(conf.RoundKEK) != 32 {
+		return errors.New("roundKEK has %d bytes, want 32", len(conf.RoundKEK))
+	}
+	if conf.MySQLMaxOpenConns < 0 || conf.MySQLMaxIdleConns < 0 || conf.MySQLConnMaxLifetime < 0 {
+		return errors.New("negative mysql connection pool setting")
+	}
+	if conf.MySQLMaxOpenConns > 0 && conf.MySQLMaxIdleConns > conf.MySQLMaxOpenConns {
+		return errors.New("mysqlMaxIdleConns %d exceeds mysqlMaxOpenConns %d", conf.MySQLMaxIdleConns, conf.MySQLMaxOpenConns)
+	}
+	if conf.ClusterLeaseTTL < 0 {
+		return errors.New("negative clusterLeaseTTL")
+	}
+	if conf.AbuseReportRetention < 0 {
+		return errors.New("negative abuseReportRetention")
+	}
+	switch pkg.RegistrationMode(conf.RegistrationMode) {
+	case "", pkg.RegistrationEmail, pkg.RegistrationFCFS, pkg.RegistrationClosed:
+	case pkg.RegistrationToken:
+		if len(conf.RegistrationTokenKey) == 0 {
+			return errors.New("registrationMode is %q without a registrationTokenKey", conf.RegistrationMode)
+		}
+	default:
+		return errors.New("unknown registrationMode %q", conf.RegistrationMode)
+	}
+	if _, err := parseRegistrationTokenKey(conf.RegistrationTokenKey); err != nil {
+		return err
+	}
+	if conf.RequestLogRate < 0 || conf.RequestLogRate > 1 {
+		return errors.New("requestLogRate must be between 0 and 1")
+	}
+	if _, err := parseRequestLogRoutes(conf.RequestLogRoutes); err != nil {
+		return err
+	}
+	if _, err := parseEndpointLimits(conf.EndpointLimits); err != nil {
+		return err
+	}
+	if conf.EndpointQueueTimeout < 0 {
+		return errors.New("negative endpointQueueTimeout")
+	}
+	if _, err := parseDomainQuotas(conf.DomainQuotas); err != nil {
+		return err
+	}
+	if _, err := parseCoordinatorKeys(conf.CoordinatorKeys); err != nil {
+		return err
 	}
-	if len(conf.PrivateKey) != ed25519.PrivateKeySize {
-		return errors.New("invalid private key")
+	if _, err := parseDataKeys(conf.DataKeys); err != nil {
+		return err
 	}
-	expectedPub := conf.PrivateKey.Public().(ed25519.PublicKey)
-	if !bytes.Equal(expectedPub, conf.PublicKey) {
-		return errors.New("public key does not correspond to private key")
+	if _, err := parseCoordinatorNetworks(conf.CoordinatorNetworks); err != nil {
+		return err
+	}
+	if _, err := readReservedNames(conf.ReservedNamesFile); err != nil {
+		return err
+	}
+	if _, err := eventWebhooks(conf); err != nil {
+		return err
+	}
+	if c := newCaptcha(conf); c != nil {
+		if err := c.Check(); err != nil {
+			return err
+		}
+	}
+	switch conf.Verifier {
+	case "", "registrar", "email", "sms", "totp", "webhook":
+	default:
+		return errors.New("unknown verifier %q", conf.Verifier)
+	}
+	if len(conf.PreviousPrivateKey) != 0 {
+		if len(conf.PreviousPrivateKey) != ed25519.PrivateKeySize {
+			return errors.New("invalid previousPrivateKey")
+		}
+		if conf.PreviousKeyExpires.IsZero() {
+			return errors.New("previousPrivateKey is set without previousKeyExpires")
+		}
+	}
+	if conf.SigningKeyURI != "" {
+		if len(conf.PrivateKey) != 0 {
+			return errors.New("privateKey and signingKeyURI are mutually exclusive")
+		}
+		if len(conf.PublicKey) != ed25519.PublicKeySize {
+			return errors.New("invalid publicKey")
+		}
+		return nil
+	}
+	return cmdutil.CheckKeyPair(conf.PublicKey, conf.PrivateKey)
+}
+
+// parseDomainQuotas parses the domainQuotas config setting.
+func parseDomainQuotas(s string) (map[string]int, error) {
+	fields := strings.Fields(s)
+	if len(fields) == 0 {
+		return nil, nil
+	}
+	quotas := make(map[string]int, len(fields))
+	for _, f := range fields {
+		ix := strings.LastIndex(f, "=")
+		if ix == -1 {
+			return nil, errors.New("domainQuotas: expected domain=count, got %q", f)
+		}
+		domain := strings.ToLower(f[:ix])
+		quota, err := strconv.Atoi(f[ix+1:])
+		if err != nil || quota < 0 {
+			return nil, errors.New("domainQuotas: invalid count for %q", domain)
+		}
+		if domain == "" {
+			return nil, errors.New("domainQuotas: empty domain in %q", f)
+		}
+		if _, ok := quotas[domain]; ok {
+			return nil, errors.New("domainQuotas: %q is listed twice", domain)
+		}
+		quotas[domain] = quota
+	}
+	return quotas, nil
+}
+
+// parseRequestLogRoutes parses the requestLogRoutes config setting.
+func parseRequestLogRoutes(s string) (map[string]float64, error) {
+	fields := strings.Fields(s)
+	if len(fields) == 0 {
+		return nil, nil
+	}
+	rates := make(map[string]float64, len(fields))
+	for _, f := range fields {
+		ix := strings.LastIndex(f, "=")
+		if ix == -1 {
+			return nil, errors.New("requestLogRoutes: expected route=rate, got %q", f)
+		}
+		route := f[:ix]
+		rate, err := strconv.ParseFloat(f[ix+1:], 64)
+		if err != nil || rate < 0 || rate > 1 {
+			return nil, errors.New("requestLogRoutes: invalid rate for %q", route)
+		}
+		if _, ok := rates[route]; ok {
+			return nil, errors.New("requestLogRoutes: %q is listed twice", route)
+		}
+		rates[route] = rate
+	}
+	return rates, nil
+}
+
+// parseEndpointLimits parses the endpointLimits config setting.
+func parseEndpointLimits(s string) (map[string]int, error) {
+	fields := strings.Fields(s)
+	if len(fields) == 0 {
+		return nil, nil
+	}
+	limits := make(map[string]int, len(fields))
+	for _, f := range fields {
+		ix := strings.LastIndex(f, "=")
+		if ix == -1 {
+			return nil, errors.New("endpointLimits: expected path=count, got %q", f)
+		}
+		path := f[:ix]
+		limit, err := strconv.Atoi(f[ix+1:])
+		if err != nil || limit <= 0 {
+			return nil, errors.New("endpointLimits: invalid count for %q", path)
+		}
+		if _, ok := limits[path]; ok {
+			return nil, errors.New("endpointLimits: %q is listed twice", path)
+		}
+		limits[path] = limit
+	}
+	return limits, nil
+}
+
+// parseCoordinatorKeys parses the coordinatorKeys config setting.
+func parseCoordinatorKeys(s string) ([]ed25519.PublicKey, error) {
+	var keys []ed25519.PublicKey
+	for _, f := range strings.Fields(s) {
+		key, err := toml.DecodeBytes(f)
+		if err != nil || len(key) != ed25519.PublicKeySize {
+			return nil, errors.New("coordinatorKeys: invalid key %q", f)
+		}
+		keys = append(keys, key)
+	}
+	return keys, nil
+}
+
+// parseDataKeys parses the dataKeys config setting.
+func parseDataKeys(s string) ([]kv.SealKey, error) {
+	var keys []kv.SealKey
+	seen := make(map[byte]bool)
+	for _, f := range strings.Fields(s) {
+		i := strings.IndexByte(f, ':')
+		if i < 0 {
+			return nil, errors.New("dataKeys: %q is not ID:KEY", f)
+		}
+		id, err := strconv.ParseUint(f[:i], 10, 8)
+		if err != nil || id == 0 {
+			return nil, errors.New("dataKeys: invalid key ID %q", f[:i])
+		}
+		if seen[byte(id)] {
+			return nil, errors.New("dataKeys: duplicate key ID %d", id)
+		}
+		seen[byte(id)] = true
+		key, err := toml.DecodeBytes(f[i+1:])
+		if err != nil || len(key) != 32 {
+			return nil, errors.New("dataKeys: invalid key for ID %d", id)
+		}
+		keys = append(keys, kv.SealKey{ID: byte(id), Key: key})
+	}
+	return keys, nil
+}
+
+// parseCoordinatorNetworks parses the coordinatorNetworks config
+// setting.
+func parseCoordinatorNetworks(s string) ([]*net.IPNet, error) {
+	var networks []*net.IPNet
+	for _, f := range strings.Fields(s) {
+		_, n, err := net.ParseCIDR(f)
+		if err != nil {
+			return nil, errors.New("coordinatorNetworks: invalid network %q", f)
+		}
+		networks = append(networks, n)
+	}
+	return networks, nil
+}
+
+// parseRegistrationTokenKey parses the registrationTokenKey config
+// setting, which is nil if it is not set.
+func parseRegistrationTokenKey(der []byte) (*rsa.PublicKey, error) {
+	if len(der) == 0 {
+		return nil, nil
+	}
+	key, err := x509.ParsePKIXPublicKey(der)
+	if err != nil {
+		return nil, errors.Wrap(err, "registrationTokenKey")
+	}
+	rsaKey, ok := key.(*rsa.PublicKey)
+	if !ok {
+		return nil, errors.New("registrationTokenKey: not an RSA key")
+	}
+	return rsaKey, nil
+}
+
+// readReservedNames reads the names in the reservedNamesFile, which
+// are nil if it is not set.
+func readReservedNames(path string) ([]string, error) {
+	if path == "" {
+		return nil, nil
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, errors.Wrap(err, "reservedNamesFile")
+	}
+	var names []string
+	for _, line := range strings.Split(string(data), "\n") {
+		if ix := strings.Index(line, "#"); ix >= 0 {
+			line = line[:ix]
+		}
+		name := strings.ToLower(strings.TrimSpace(line))
+		if name == "" {
+			continue
+		}
+		if strings.ContainsAny(name, " \t") {
+			return nil, errors.New("reservedNamesFile: invalid name %q", name)
+		}
+		names = append(names, name)
+	}
+	return names, nil
+}
+
+// eventWebhooks returns the webhooks in the eventWebhook settings.
+func eventWebhooks(conf *Config) ([]*pkg.Webhook, error) {
+	urls := strings.Fields(conf.EventWebhooks)
+	if len(urls) == 0 {
+		return nil, nil
+	}
+	var events []pkg.WebhookEventType
+	for _, e := range strings.Fields(conf.EventWebhookEvents) {
+		events = append(events, pkg.WebhookEventType(e))
+	}
+	hooks := make([]*pkg.Webhook, len(urls))
+	for i, u := range urls {
+		hooks[i] = &pkg.Webhook{
+			URL:    u,
+			Secret: []byte(conf.EventWebhookSecret),
+			Events: events,
+		}
+		if err := hooks[i].Check(); err != nil {
+			return nil, errors.Wrap(err, "eventWebhooks")
+		}
+	}
+	return hooks, nil
+}
+
+// maxHeaderBytes caps the size of request headers. PKG clients send
+// small headers, so this is far below net/http's default of 1 MiB.
+const maxHeaderBytes = 16 << 10
+
+// listen listens for PKG requests. While the server is rotating its
+// key, it presents its previous key, which clients with either the old
+// or the new config accept, and then switches to the new key.
+func listen(conf *Config, signer crypto.Signer) (net.Listener, error) {
+	if len(conf.PreviousPrivateKey) == 0 {
+		return edtls.Listen("tcp", conf.ListenAddr, signer)
+	}
+	newConfig := edtls.NewTLSServerConfig(signer)
+	oldConfig := edtls.NewTLSServerConfig(conf.PreviousPrivateKey)
+	tlsConfig := newConfig.Clone()
+	tlsConfig.GetCertificate = func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+		if time.Now().Before(conf.PreviousKeyExpires) {
+			return oldConfig.GetCertificate(hello)
+		}
+		return newConfig.GetCertificate(hello)
 	}
-	return nil
+	return tls.Listen("tcp", conf.ListenAddr, tlsConfig)
 }
@@ -0,0 +1,12 @@
+// Copyright 2018 David Lazar. All rights reserved.
+// Use of this source code is governed by the GNU AGPL
+// license that can be found in the LICENSE file.
+
+//go:build mysql
+// +build mysql
+
+package main
+
+// The mysql dbBackend needs a MySQL driver, which is only linked into
+// servers built with the mysql build tag.
+import _ "github.com/go-sql-driver/mysql"
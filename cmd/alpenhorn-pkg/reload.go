@@ -0,0 +1,138 @@
+// Copyright 2018 David Lazar. All rights reserved.
+// Use of this source code is governed by the GNU AGPL
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"vuvuzela.io/alpenhorn/config"
+	"vuvuzela.io/alpenhorn/encoding/toml"
+	"vuvuzela.io/alpenhorn/errors"
+	"vuvuzela.io/alpenhorn/internal/alplog"
+	"vuvuzela.io/alpenhorn/internal/keysafe"
+	"vuvuzela.io/alpenhorn/log"
+	"vuvuzela.io/alpenhorn/pkg"
+)
+
+// pkgSettings returns the server settings that can be reloaded.
+func pkgSettings(conf *Config, addFriendConfig *config.AddFriendConfig) (*pkg.Settings, error) {
+	coordinatorKeys, err := parseCoordinatorKeys(conf.CoordinatorKeys)
+	if err != nil {
+		return nil, err
+	}
+	coordinatorNetworks, err := parseCoordinatorNetworks(conf.CoordinatorNetworks)
+	if err != nil {
+		return nil, err
+	}
+	tokenKey, err := parseRegistrationTokenKey(conf.RegistrationTokenKey)
+	if err != nil {
+		return nil, err
+	}
+	reservedNames, err := readReservedNames(conf.ReservedNamesFile)
+	if err != nil {
+		return nil, err
+	}
+	var verifier pkg.Verifier
+	switch pkg.RegistrationMode(conf.RegistrationMode) {
+	case "", pkg.RegistrationEmail:
+		verifier, err = newVerifier(conf, addFriendConfig)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return &pkg.Settings{
+		CoordinatorKey:      addFriendConfig.Coordinator.Key,
+		CoordinatorKeys:     coordinatorKeys,
+		CoordinatorNetworks: coordinatorNetworks,
+
+		RegistrationMode:     pkg.RegistrationMode(conf.RegistrationMode),
+		Verifier:             verifier,
+		RegistrationTokenKey: tokenKey,
+		ReservedNames:        reservedNames,
+		ReadOnly:             conf.ReadOnly,
+
+		IPRateLimit:       pkg.RateLimit{Rate: conf.IPRate, Burst: conf.IPBurst},
+		UsernameRateLimit: pkg.RateLimit{Rate: conf.UsernameRate, Burst: conf.UsernameBurst},
+	}, nil
+}
+
+// logLevel returns the log level set in the config, or by the
+// -logLevel flag if the config does not set one.
+func logLevel(conf *Config) (log.Level, error) {
+	if conf.LogLevel != "" {
+		return log.ParseLevel(conf.LogLevel)
+	}
+	return log.ParseLevel(logFlags.Level)
+}
+
+// A reloader rereads the config file when the server gets SIGHUP and
+// applies the settings that can change while the server runs: the
+// registration mode and verifier, read-only mode, rate limits, log
+// level, coordinator networks, reserved names, and the coordinator keys,
+// including the one in the current AddFriend config.
+// The other settings take effect when the server restarts.
+type reloader struct {
+	confPath string
+	server   *pkg.Server
+	levels   *alplog.LevelFilter
+	logger   *log.Logger
+
+	addFriendConfig *config.AddFriendConfig
+}
+
+func (r *reloader) handleSIGHUP() {
+	sigChan := make(chan os.Signal, 1)
+	signal.Notify(sigChan, syscall.SIGHUP)
+	go func() {
+		for range sigChan {
+			if err := r.reload(); err != nil {
+				r.logger.Errorf("Reloading %s: %s", r.confPath, err)
+			} else {
+				r.logger.Infof("Reloaded %s", r.confPath)
+			}
+		}
+	}()
+}
+
+func (r *reloader) reload() error {
+	data, err := ioutil.ReadFile(r.confPath)
+	if err != nil {
+		return err
+	}
+	defer keysafe.Zero(data)
+	conf := new(Config)
+	if err := toml.Unmarshal(data, conf); err != nil {
+		return errors.Wrap(err, "parsing config")
+	}
+	// Only the running server's copy of the keys is used.
+	defer keysafe.Zero(conf.PrivateKey)
+	defer keysafe.Zero(conf.PreviousPrivateKey)
+	if err := checkConfig(conf); err != nil {
+		return errors.Wrap(err, "invalid config")
+	}
+	level, err := logLevel(conf)
+	if err != nil {
+		return err
+	}
+
+	signedConfig, err := config.StdClient.CurrentConfig("AddFriend")
+	if err != nil {
+		r.logger.Warnf("Keeping the previous AddFriend config: %s", err)
+	} else {
+		r.addFriendConfig = signedConfig.Inner.(*config.AddFriendConfig)
+	}
+	settings, err := pkgSettings(conf, r.addFriendConfig)
+	if err != nil {
+		return err
+	}
+	if err := r.server.Reload(settings); err != nil {
+		return err
+	}
+	r.levels.SetLevel(level)
+	return nil
+}
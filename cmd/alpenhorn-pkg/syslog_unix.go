@@ -0,0 +1,18 @@
+// Copyright 2018 David Lazar. All rights reserved.
+// Use of this source code is governed by the GNU AGPL
+// license that can be found in the LICENSE file.
+
+//go:build !windows && !plan9
+// +build !windows,!plan9
+
+package main
+
+import (
+	"io"
+	"log/syslog"
+)
+
+// openSyslog opens the system log for audit events.
+func openSyslog() (io.WriteCloser, error) {
+	return syslog.New(syslog.LOG_AUTH|syslog.LOG_NOTICE, "alpenhorn-pkg")
+}
@@ -0,0 +1,114 @@
+// Copyright 2018 David Lazar. All rights reserved.
+// Use of this source code is governed by the GNU AGPL
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strings"
+	"text/template"
+
+	"vuvuzela.io/alpenhorn/config"
+	"vuvuzela.io/alpenhorn/errors"
+	"vuvuzela.io/alpenhorn/pkg"
+)
+
+// newVerifier returns the verifier named in the config.
+func newVerifier(conf *Config, addFriendConfig *config.AddFriendConfig) (pkg.Verifier, error) {
+	switch conf.Verifier {
+	case "", "registrar":
+		if addFriendConfig.Registrar.Address == "" {
+			return nil, errors.New("no Registrar Address defined in current addfriend config!")
+		}
+		return pkg.ExternalVerifier(fmt.Sprintf("https://%s/verify", addFriendConfig.Registrar.Address)), nil
+
+	case "email":
+		v := &pkg.EmailVerifier{
+			SMTPAddr:     conf.SMTPAddr,
+			SMTPUsername: conf.SMTPUsername,
+			SMTPPassword: conf.SMTPPassword,
+			From:         conf.EmailFrom,
+			Subject:      conf.EmailSubject,
+		}
+		if conf.EmailTemplate != "" {
+			tmpl, err := template.ParseFiles(conf.EmailTemplate)
+			if err != nil {
+				return nil, errors.Wrap(err, "loading email template")
+			}
+			v.Template = tmpl
+		}
+		return v, v.Check()
+
+	case "sms":
+		numbers, err := loadPhoneNumbers(conf.SMSNumbers)
+		if err != nil {
+			return nil, err
+		}
+		v := &pkg.SMSVerifier{
+			GatewayURL: conf.SMSGatewayURL,
+			PhoneNumber: func(username string) (string, error) {
+				number, ok := numbers[username]
+				if !ok {
+					return "", errors.New("no phone number for %q", username)
+				}
+				return number, nil
+			},
+		}
+		return v, v.Check()
+
+	case "totp":
+		return new(pkg.TOTPVerifier), nil
+
+	case "webhook":
+		v := &pkg.WebhookVerifier{URL: conf.WebhookURL}
+		return v, v.Check()
+
+	default:
+		return nil, errors.New("unknown verifier %q", conf.Verifier)
+	}
+}
+
+// loadPhoneNumbers reads a file of "username number" lines. Blank
+// lines and lines starting with # are ignored.
+func loadPhoneNumbers(path string) (map[string]string, error) {
+	if path == "" {
+		return nil, errors.New("no smsNumbers file")
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	numbers := make(map[string]string)
+	scanner := bufio.NewScanner(f)
+	for lineNum := 1; scanner.Scan(); lineNum++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			return nil, errors.New("%s:%d: want \"username number\"", path, lineNum)
+		}
+		numbers[fields[0]] = fields[1]
+	}
+	return numbers, scanner.Err()
+}
+
+// newCaptcha returns the CAPTCHA verifier named in the config, or nil.
+func newCaptcha(conf *Config) *pkg.SiteverifyCaptcha {
+	switch conf.Captcha {
+	case "":
+		return nil
+	case "hcaptcha":
+		return &pkg.SiteverifyCaptcha{URL: pkg.HCaptchaURL, Secret: conf.CaptchaSecret}
+	case "recaptcha":
+		return &pkg.SiteverifyCaptcha{URL: pkg.ReCaptchaURL, Secret: conf.CaptchaSecret}
+	default:
+		return &pkg.SiteverifyCaptcha{URL: conf.Captcha, Secret: conf.CaptchaSecret}
+	}
+}
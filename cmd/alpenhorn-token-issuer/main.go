@@ -0,0 +1,124 @@
+// Copyright 2018 David Lazar. All rights reserved.
+// Use of this source code is governed by the GNU AGPL
+// license that can be found in the LICENSE file.
+
+// Command alpenhorn-token-issuer issues registration tokens for PKG
+// servers in "token" registration mode.
+//
+// The operator generates an issuer key once with -keygen and sets the
+// printed public key as registrationTokenKey in the PKG config. To
+// issue a token, the operator signs the blinded serial a user sends
+// (from pkg.NewTokenRequest) with -sign, and sends the printed blind
+// signature back to the user, who finishes the token with
+// pkg.TokenRequest.Finish. The operator never sees the token itself.
+package main
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"github.com/davidlazar/go-crypto/encoding/base32"
+
+	"vuvuzela.io/alpenhorn/errors"
+	"vuvuzela.io/alpenhorn/internal/version"
+	"vuvuzela.io/alpenhorn/pkg"
+)
+
+var (
+	keyPath      = flag.String("key", "token-issuer.pem", "path to the issuer's private key")
+	doKeygen     = flag.Bool("keygen", false, "generate an issuer key")
+	blinded      = flag.String("sign", "", "sign this base32 blinded serial")
+	printVersion = flag.Bool("version", false, "print version information and exit")
+)
+
+func main() {
+	flag.Parse()
+	if *printVersion {
+		fmt.Println(version.String())
+		return
+	}
+
+	var err error
+	switch {
+	case *doKeygen:
+		err = keygen(*keyPath)
+	case *blinded != "":
+		err = sign(*keyPath, *blinded)
+	default:
+		flag.Usage()
+		os.Exit(2)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error: %s\n", err)
+		os.Exit(1)
+	}
+}
+
+func keygen(path string) error {
+	if _, err := os.Stat(path); err == nil {
+		return errors.New("refusing to overwrite %s", path)
+	}
+	key, err := rsa.GenerateKey(rand.Reader, pkg.RegistrationTokenKeyBits)
+	if err != nil {
+		return err
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return err
+	}
+	data := pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})
+	if err := ioutil.WriteFile(path, data, 0600); err != nil {
+		return err
+	}
+	pub, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("wrote issuer key to %s\n", path)
+	fmt.Printf("registrationTokenKey = %q\n", base32.EncodeToString(pub))
+	return nil
+}
+
+func sign(path string, blindedStr string) error {
+	key, err := readKey(path)
+	if err != nil {
+		return err
+	}
+	blinded, err := base32.DecodeString(strings.TrimSpace(blindedStr))
+	if err != nil {
+		return errors.Wrap(err, "decoding blinded serial")
+	}
+	sig, err := pkg.SignBlindedToken(key, blinded)
+	if err != nil {
+		return err
+	}
+	fmt.Println(base32.EncodeToString(sig))
+	return nil
+}
+
+func readKey(path string) (*rsa.PrivateKey, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil || block.Type != "PRIVATE KEY" {
+		return nil, errors.New("%s: no private key", path)
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, errors.Wrap(err, "%s", path)
+	}
+	rsaKey, ok := key.(*rsa.PrivateKey)
+	if !ok {
+		return nil, errors.New("%s: not an RSA key", path)
+	}
+	return rsaKey, nil
+}
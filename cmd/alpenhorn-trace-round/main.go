@@ -0,0 +1,224 @@
+// Copyright 2018 David Lazar. All rights reserved.
+// Use of this source code is governed by the GNU AGPL
+// license that can be found in the LICENSE file.
+
+// Command alpenhorn-trace-round checks that the trace onion injected by
+// a coordinator running with -traceOnions reached the trace mailbox,
+// and prints how long the round spent in each stage.
+package main
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"vuvuzela.io/alpenhorn/addfriend"
+	"vuvuzela.io/alpenhorn/bloom"
+	"vuvuzela.io/alpenhorn/config"
+	"vuvuzela.io/alpenhorn/coordinator"
+	"vuvuzela.io/alpenhorn/dialing"
+	"vuvuzela.io/alpenhorn/edhttp"
+	"vuvuzela.io/alpenhorn/errors"
+	"vuvuzela.io/alpenhorn/internal/version"
+	"vuvuzela.io/alpenhorn/log"
+	"vuvuzela.io/crypto/rand"
+)
+
+var (
+	service      = flag.String("service", "Dialing", "service to trace (AddFriend or Dialing)")
+	round        = flag.Uint("round", 0, "round to trace (default: latest finished round)")
+	printVersion = flag.Bool("version", false, "print version information and exit")
+)
+
+func main() {
+	flag.Parse()
+	if *printVersion {
+		fmt.Println(version.String())
+		return
+	}
+
+	signedConfig, err := config.StdClient.CurrentConfig(*service)
+	if err != nil {
+		log.Fatalf("fetching current config: %s", err)
+	}
+	var coordinatorConf config.CoordinatorConfig
+	var cdnConf config.CDNServerConfig
+	switch inner := signedConfig.Inner.(type) {
+	case *config.AddFriendConfig:
+		coordinatorConf = inner.Coordinator
+		cdnConf = inner.CDNServer
+	case *config.DialingConfig:
+		coordinatorConf = inner.Coordinator
+		cdnConf = inner.CDNServer
+	default:
+		log.Fatalf("unsupported service: %q", *service)
+	}
+
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		log.Fatal(err)
+	}
+	client := &edhttp.Client{Key: key}
+
+	traceURL := fmt.Sprintf("https://%s/%s/trace", coordinatorConf.Address, strings.ToLower(*service))
+	if *round != 0 {
+		traceURL += fmt.Sprintf("?round=%d", *round)
+	}
+	trace := new(coordinator.RoundTrace)
+	if err := getJSON(client, coordinatorConf.Key, traceURL, trace); err != nil {
+		log.Fatalf("fetching trace: %s", err)
+	}
+
+	var fetchStage coordinator.TraceStage
+	var found bool
+	if trace.MailboxURL != "" {
+		fetchStage.Name = "fetch mailbox"
+		fetchStage.Start = time.Now()
+		found, err = checkMailbox(client, cdnConf, trace)
+		fetchStage.Duration = time.Now().Sub(fetchStage.Start)
+		if err != nil {
+			fetchStage.Err = err.Error()
+		}
+		trace.Stages = append(trace.Stages, fetchStage)
+	}
+
+	printReport(trace)
+
+	switch {
+	case trace.Err != "":
+		fmt.Printf("\nround %d failed: %s\n", trace.Round, trace.Err)
+	case !trace.Done():
+		fmt.Printf("\nround %d has not finished\n", trace.Round)
+	case fetchStage.Err != "":
+		fmt.Printf("\nround %d: error fetching mailbox: %s\n", trace.Round, fetchStage.Err)
+	case !found:
+		fmt.Printf("\nround %d: trace onion is missing from mailbox %d\n", trace.Round, trace.Mailbox)
+	default:
+		fmt.Printf("\nround %d: trace onion delivered to mailbox %d\n", trace.Round, trace.Mailbox)
+		return
+	}
+	os.Exit(1)
+}
+
+func getJSON(client *edhttp.Client, key ed25519.PublicKey, url string, v interface{}) error {
+	resp, err := client.Get(key, url)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := ioutil.ReadAll(resp.Body)
+		return errors.New("%s: %q", resp.Status, msg)
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+// checkMailbox fetches the trace mailbox from the CDN and reports
+// whether it contains the trace marker.
+func checkMailbox(client *edhttp.Client, cdnConf config.CDNServerConfig, trace *coordinator.RoundTrace) (bool, error) {
+	mailbox, err := getMailbox(client, cdnConf, trace.MailboxURL, dialing.MailboxKey(trace.Mailbox, 0))
+	if err != nil {
+		return false, err
+	}
+	if trace.Service == "Dialing" && trace.MailboxChunkSize > 0 {
+		numChunks, head, err := dialing.ParseMailboxHead(mailbox)
+		if err != nil {
+			return false, err
+		}
+		mailbox = append([]byte(nil), head...)
+		for i := 1; i < numChunks; i++ {
+			chunk, err := getMailbox(client, cdnConf, trace.MailboxURL, dialing.MailboxKey(trace.Mailbox, i))
+			if err != nil {
+				return false, errors.Wrap(err, "fetching mailbox chunk %d/%d", i, numChunks)
+			}
+			mailbox = append(mailbox, chunk...)
+		}
+	}
+
+	if trace.Service == "AddFriend" {
+		// The marker has the size of an intro in the round's format.
+		size := len(trace.Marker)
+		if size != addfriend.EncryptedIntroSize(addfriend.IntroVersionIBE, trace.PayloadVersion) &&
+			size != addfriend.EncryptedIntroSize(addfriend.IntroVersionHybrid, trace.PayloadVersion) {
+			return false, errors.New("unexpected marker size: %d", size)
+		}
+		if len(mailbox)%size != 0 {
+			return false, errors.New("malformed addfriend mailbox: len=%d", len(mailbox))
+		}
+		for i := 0; i < len(mailbox); i += size {
+			if bytes.Equal(mailbox[i:i+size], trace.Marker) {
+				return true, nil
+			}
+		}
+		return false, nil
+	}
+
+	filter := new(bloom.Filter)
+	if err := filter.UnmarshalBinary(mailbox); err != nil {
+		return false, errors.Wrap(err, "decoding bloom filter")
+	}
+	return filter.Test(trace.Marker), nil
+}
+
+func getMailbox(client *edhttp.Client, cdnConf config.CDNServerConfig, mailboxURL string, key string) ([]byte, error) {
+	u, err := url.Parse(mailboxURL)
+	if err != nil {
+		return nil, errors.Wrap(err, "parsing mailbox url")
+	}
+	vals := u.Query()
+	vals.Set("key", key)
+	u.RawQuery = vals.Encode()
+
+	req, err := version.CDN.NewRequest("GET", u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := client.Do(cdnConf.Key, req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if err := version.CDN.CheckHeader("cdn server", resp.Header); err != nil {
+		return nil, err
+	}
+	mailbox, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, errors.Wrap(err, "reading mailbox body")
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, errors.New("%s: %q", resp.Status, mailbox)
+	}
+	return mailbox, nil
+}
+
+func printReport(trace *coordinator.RoundTrace) {
+	fmt.Printf("service:  %s\n", trace.Service)
+	fmt.Printf("round:    %d\n", trace.Round)
+	fmt.Printf("config:   %s\n", trace.ConfigHash)
+	fmt.Printf("mailbox:  %d of %d\n\n", trace.Mailbox, trace.NumMailboxes)
+
+	if len(trace.Stages) == 0 {
+		return
+	}
+	origin := trace.Stages[0].Start
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintf(w, "STAGE\tSTART\tDURATION\tERROR\n")
+	for _, s := range trace.Stages {
+		fmt.Fprintf(w, "%s\t+%s\t%s\t%s\n",
+			s.Name,
+			s.Start.Sub(origin).Round(time.Millisecond),
+			s.Duration.Round(time.Millisecond),
+			s.Err,
+		)
+	}
+	w.Flush()
+}
@@ -0,0 +1,197 @@
+// Copyright 2018 David Lazar. All rights reserved.
+// Use of this source code is governed by the GNU AGPL
+// license that can be found in the LICENSE file.
+
+// Command alpenhorn-verify-config checks a signed config chain offline.
+//
+// The chain is read from a file or URL (for example, a config server's
+// /getchain endpoint) and every link is verified: each config must be
+// signed by the guardians of the config it replaces. The command prints
+// the details of each config so auditors can review the chain without
+// running any Alpenhorn server.
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/davidlazar/go-crypto/encoding/base32"
+
+	"vuvuzela.io/alpenhorn/config"
+	"vuvuzela.io/alpenhorn/errors"
+	"vuvuzela.io/alpenhorn/internal/version"
+
+	// Register the convo inner config.
+	_ "vuvuzela.io/vuvuzela/convo"
+)
+
+var (
+	rootHash     = flag.String("root", "", "hash of a trusted config that must begin the chain")
+	showAll      = flag.Bool("v", false, "print the inner config of each link")
+	printVersion = flag.Bool("version", false, "print version information and exit")
+)
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "Usage: %s [flags] FILE|URL\n", os.Args[0])
+	flag.PrintDefaults()
+}
+
+func main() {
+	flag.Usage = usage
+	flag.Parse()
+	if *printVersion {
+		fmt.Println(version.String())
+		return
+	}
+	if flag.NArg() != 1 {
+		usage()
+		os.Exit(2)
+	}
+
+	data, err := readSource(flag.Arg(0))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error reading chain: %s\n", err)
+		os.Exit(1)
+	}
+
+	chain, err := decodeChain(data)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error decoding chain: %s\n", err)
+		os.Exit(1)
+	}
+
+	for i := len(chain) - 1; i >= 0; i-- {
+		printConfig(len(chain)-1-i, chain, i)
+	}
+
+	if err := verifyChain(chain); err != nil {
+		fmt.Printf("\nFAIL: %s\n", err)
+		os.Exit(1)
+	}
+	fmt.Printf("\nOK: verified %d config(s) for service %q\n", len(chain), chain[0].Service)
+}
+
+func readSource(src string) ([]byte, error) {
+	if !strings.HasPrefix(src, "http://") && !strings.HasPrefix(src, "https://") {
+		return ioutil.ReadFile(src)
+	}
+
+	client := &http.Client{Timeout: 30 * time.Second}
+	resp, err := client.Get(src)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, errors.New("Get %q: %s: %q", src, resp.Status, body)
+	}
+	return body, nil
+}
+
+// decodeChain decodes a single config or a list of configs. The result
+// is ordered like the config server's /getchain response: newest first.
+func decodeChain(data []byte) ([]*config.SignedConfig, error) {
+	data = bytes.TrimSpace(data)
+	var chain []*config.SignedConfig
+	if len(data) > 0 && data[0] == '{' {
+		conf := new(config.SignedConfig)
+		if err := json.Unmarshal(data, conf); err != nil {
+			return nil, err
+		}
+		chain = []*config.SignedConfig{conf}
+	} else if err := json.Unmarshal(data, &chain); err != nil {
+		return nil, err
+	}
+	if len(chain) == 0 {
+		return nil, errors.New("empty config chain")
+	}
+
+	// Accept chains in either order.
+	if len(chain) > 1 && chain[0].PrevConfigHash != chain[1].Hash() && chain[1].PrevConfigHash == chain[0].Hash() {
+		for i, j := 0, len(chain)-1; i < j; i, j = i+1, j-1 {
+			chain[i], chain[j] = chain[j], chain[i]
+		}
+	}
+	return chain, nil
+}
+
+func verifyChain(chain []*config.SignedConfig) error {
+	oldest := chain[len(chain)-1]
+	for i, conf := range chain {
+		if err := conf.Validate(); err != nil {
+			return errors.Wrap(err, "config %s", conf.Hash())
+		}
+		if conf.Service != oldest.Service {
+			return errors.New("config %s: service %q does not match %q", conf.Hash(), conf.Service, oldest.Service)
+		}
+		if i < len(chain)-1 && !conf.Created.After(chain[i+1].Created) {
+			return errors.New("config %s: not created after its predecessor", conf.Hash())
+		}
+	}
+
+	if *rootHash != "" && oldest.Hash() != *rootHash {
+		return errors.New("chain starts at %s, not at trusted root %s", oldest.Hash(), *rootHash)
+	}
+	if *rootHash == "" {
+		// Without a trusted root, the best we can do is check that
+		// the first config is signed by its own guardians.
+		if err := oldest.Verify(); err != nil {
+			return errors.Wrap(err, "config %s", oldest.Hash())
+		}
+	}
+
+	if len(chain) > 1 {
+		return config.VerifyConfigChain(chain...)
+	}
+	return nil
+}
+
+func printConfig(n int, chain []*config.SignedConfig, i int) {
+	conf := chain[i]
+	fmt.Printf("[%d] %s\n", n, conf.Hash())
+	fmt.Printf("    service:   %s (version %d)\n", conf.Service, conf.Version)
+	fmt.Printf("    prev:      %s\n", orNone(conf.PrevConfigHash))
+	fmt.Printf("    created:   %s\n", conf.Created.Format(time.RFC3339))
+	if i > 0 {
+		fmt.Printf("    superseded: %s\n", chain[i-1].Created.Format(time.RFC3339))
+	}
+	expired := ""
+	if time.Now().After(conf.Expires) {
+		expired = " (expired)"
+	}
+	fmt.Printf("    expires:   %s%s\n", conf.Expires.Format(time.RFC3339), expired)
+	fmt.Printf("    guardians:\n")
+	for _, g := range conf.Guardians {
+		keystr := base32.EncodeToString(g.Key)
+		signed := ""
+		if _, ok := conf.Signatures[keystr]; ok {
+			signed = " (signed)"
+		}
+		fmt.Printf("      %-20s %s%s\n", g.Username, keystr, signed)
+	}
+	fmt.Printf("    signatures: %d\n", len(conf.Signatures))
+	if *showAll {
+		inner, err := json.MarshalIndent(conf.Inner, "    ", "  ")
+		if err == nil {
+			fmt.Printf("    inner: %s\n", inner)
+		}
+	}
+}
+
+func orNone(s string) string {
+	if s == "" {
+		return "(none)"
+	}
+	return s
+}
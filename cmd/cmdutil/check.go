@@ -0,0 +1,65 @@
+package cmdutil
+
+import (
+	"crypto/ed25519"
+	"fmt"
+	"net"
+	"os"
+
+	"vuvuzela.io/alpenhorn/errors"
+	"vuvuzela.io/alpenhorn/internal/keysafe"
+)
+
+// Checker reports the results of a -check dry run. Servers use it to
+// validate their config and storage without starting, so deploy
+// pipelines can catch mistakes before restarting a live service.
+type Checker struct {
+	failed bool
+}
+
+// Check prints the outcome of a single check and reports whether it
+// passed.
+func (c *Checker) Check(what string, err error) bool {
+	if err != nil {
+		c.failed = true
+		fmt.Printf("FAIL  %s: %s\n", what, err)
+		return false
+	}
+	fmt.Printf("ok    %s\n", what)
+	return true
+}
+
+// Exit exits with status 0 if every check passed and 1 otherwise.
+func (c *Checker) Exit() {
+	if c.failed {
+		fmt.Println("check failed")
+		os.Exit(1)
+	}
+	fmt.Println("check passed")
+	os.Exit(0)
+}
+
+// CheckKeyPair returns an error if the private key is malformed or
+// does not correspond to the public key.
+func CheckKeyPair(publicKey ed25519.PublicKey, privateKey ed25519.PrivateKey) error {
+	if len(privateKey) != ed25519.PrivateKeySize {
+		return errors.New("invalid private key")
+	}
+	if !keysafe.Equal(privateKey.Public().(ed25519.PublicKey), publicKey) {
+		return errors.New("public key does not correspond to private key")
+	}
+	return nil
+}
+
+// CheckListenAddr returns an error if addr is not a valid host:port.
+// IPv6 hosts are bracketed, as in "[::]:443".
+func CheckListenAddr(addr string) error {
+	if addr == "" {
+		return errors.New("no listen address specified")
+	}
+	_, _, err := net.SplitHostPort(addr)
+	if err != nil && net.ParseIP(addr) != nil {
+		return errors.New("IPv6 listen address %q must be bracketed, as in \"[::]:port\"", addr)
+	}
+	return err
+}
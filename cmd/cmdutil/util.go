@@ -1,9 +1,12 @@
 package cmdutil
 
 import (
+	"crypto/ed25519"
 	"fmt"
 	"log"
 	"os"
+
+	"vuvuzela.io/alpenhorn/internal/keysafe"
 )
 
 func Overwrite(path string) bool {
@@ -29,3 +32,16 @@ func Overwrite(path string) bool {
 	}
 	return true
 }
+
+// ProtectKey moves *key into a keysafe.Secret, locking it in memory if
+// mlock is true, and points *key at the secret's buffer.
+func ProtectKey(key *ed25519.PrivateKey, mlock bool) *keysafe.Secret {
+	secret := keysafe.New(*key)
+	if mlock {
+		if err := secret.Lock(); err != nil {
+			log.Fatalf("error locking private key in memory: %s", err)
+		}
+	}
+	*key = secret.Ed25519()
+	return secret
+}
@@ -0,0 +1,85 @@
+// Copyright 2018 David Lazar. All rights reserved.
+// Use of this source code is governed by the GNU AGPL
+// license that can be found in the LICENSE file.
+
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+
+	"github.com/davidlazar/go-crypto/encoding/base32"
+
+	"vuvuzela.io/alpenhorn/config"
+	"vuvuzela.io/alpenhorn/internal/version"
+	"vuvuzela.io/alpenhorn/log"
+
+	// Register the convo inner config.
+	_ "vuvuzela.io/vuvuzela/convo"
+)
+
+var configPath = flag.String("config", "", "path to next (unsigned) config")
+var requestPath = flag.String("request", "", "path to mixer join request (- for stdin)")
+var position = flag.Int("position", -1, "position of the new mixer in the chain (default: last)")
+var printVersion = flag.Bool("version", false, "print version information and exit")
+
+func main() {
+	flag.Parse()
+	if *printVersion {
+		fmt.Println(version.String())
+		return
+	}
+
+	if *configPath == "" || *requestPath == "" {
+		fmt.Println("Specify config file with -config and join request with -request.")
+		os.Exit(1)
+	}
+
+	var reqBytes []byte
+	var err error
+	if *requestPath == "-" {
+		reqBytes, err = ioutil.ReadAll(os.Stdin)
+	} else {
+		reqBytes, err = ioutil.ReadFile(*requestPath)
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+	req, err := config.DecodeMixerJoinRequest(string(reqBytes))
+	if err != nil {
+		log.Fatalf("invalid join request: %s", err)
+	}
+
+	configBytes, err := ioutil.ReadFile(*configPath)
+	if err != nil {
+		log.Fatal(err)
+	}
+	conf := new(config.SignedConfig)
+	if err := json.Unmarshal(configBytes, conf); err != nil {
+		log.Fatalf("error decoding json: %s", err)
+	}
+	if len(conf.Signatures) > 0 {
+		log.Fatalf("config is already signed; create a new config with alpenhorn-guardian-new-config")
+	}
+
+	fmt.Fprintf(os.Stderr, "Mixer key:  %s\n", base32.EncodeToString(req.Key))
+	fmt.Fprintf(os.Stderr, "Address:    %s\n", req.Address)
+	fmt.Fprintf(os.Stderr, "Services:   %v\n", req.Services)
+	fmt.Fprintf(os.Stderr, "Requested:  %s\n", req.Created)
+
+	if err := conf.AddMixer(req, *position); err != nil {
+		log.Fatal(err)
+	}
+	if err := conf.Validate(); err != nil {
+		log.Fatalf("invalid config: %s", err)
+	}
+
+	data, err := json.MarshalIndent(conf, "", "  ")
+	if err != nil {
+		panic(err)
+	}
+	fmt.Printf("%s\n", data)
+}
@@ -5,9 +5,9 @@
 package main
 
 import (
-	"bytes"
 	"crypto/ed25519"
 	"crypto/rand"
+	"flag"
 	"fmt"
 	"io/ioutil"
 	"log"
@@ -19,8 +19,12 @@ import (
 	"golang.org/x/crypto/ssh/terminal"
 
 	"vuvuzela.io/alpenhorn/cmd/guardian"
+	"vuvuzela.io/alpenhorn/internal/keysafe"
+	"vuvuzela.io/alpenhorn/internal/version"
 )
 
+var printVersion = flag.Bool("version", false, "print version information and exit")
+
 var inspirationalMessage = `
 !! You are generating an Alpenhorn guardian key.
 !! This key is crucial to the security of Alpenhorn.
@@ -29,6 +33,12 @@ var inspirationalMessage = `
 `
 
 func main() {
+	flag.Parse()
+	if *printVersion {
+		fmt.Println(version.String())
+		return
+	}
+
 	appDir := guardian.Appdir()
 	err := os.Mkdir(appDir, 0700)
 	if err == nil {
@@ -97,7 +107,7 @@ func confirmPassphrase() []byte {
 			log.Fatalf("terminal.ReadPassword: %s", err)
 		}
 
-		if bytes.Equal(pw, again) {
+		if keysafe.Equal(pw, again) {
 			return pw
 		}
 
@@ -13,6 +13,7 @@ import (
 	"time"
 
 	"vuvuzela.io/alpenhorn/config"
+	"vuvuzela.io/alpenhorn/internal/version"
 	// Register the convo inner config.
 	_ "vuvuzela.io/vuvuzela/convo"
 )
@@ -20,9 +21,14 @@ import (
 var service = flag.String("service", "", "service name")
 var printCurrent = flag.Bool("current", false, "print current config")
 var configServerURL = flag.String("url", "", "url of config server")
+var printVersion = flag.Bool("version", false, "print version information and exit")
 
 func main() {
 	flag.Parse()
+	if *printVersion {
+		fmt.Println(version.String())
+		return
+	}
 
 	if *service == "" {
 		fmt.Println("Specify a service name with -service.")
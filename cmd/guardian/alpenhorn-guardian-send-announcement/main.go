@@ -16,14 +16,20 @@ import (
 	"vuvuzela.io/alpenhorn/cmd/guardian"
 	"vuvuzela.io/alpenhorn/config"
 	"vuvuzela.io/alpenhorn/edhttp"
+	"vuvuzela.io/alpenhorn/internal/version"
 	"vuvuzela.io/vuvuzela/convo"
 	"vuvuzela.io/vuvuzela/coordinator"
 )
 
 var globalMsg = flag.String("msg", "", "message to announce")
+var printVersion = flag.Bool("version", false, "print version information and exit")
 
 func main() {
 	flag.Parse()
+	if *printVersion {
+		fmt.Println(version.String())
+		return
+	}
 
 	if *globalMsg == "" {
 		fmt.Println("Specify message with -msg.")
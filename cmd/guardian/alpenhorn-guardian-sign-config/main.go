@@ -5,7 +5,6 @@
 package main
 
 import (
-	"bytes"
 	"crypto/ed25519"
 	"encoding/json"
 	"flag"
@@ -18,6 +17,8 @@ import (
 
 	"vuvuzela.io/alpenhorn/cmd/guardian"
 	"vuvuzela.io/alpenhorn/config"
+	"vuvuzela.io/alpenhorn/internal/keysafe"
+	"vuvuzela.io/alpenhorn/internal/version"
 	"vuvuzela.io/alpenhorn/log"
 
 	// Register the convo inner config.
@@ -25,9 +26,14 @@ import (
 )
 
 var configPath = flag.String("config", "", "path to new signed config")
+var printVersion = flag.Bool("version", false, "print version information and exit")
 
 func main() {
 	flag.Parse()
+	if *printVersion {
+		fmt.Println(version.String())
+		return
+	}
 
 	if *configPath == "" {
 		fmt.Println("Specify config file with -config.")
@@ -55,7 +61,7 @@ func main() {
 
 	myPos := -1
 	for i, g := range conf.Guardians {
-		if bytes.Equal(g.Key, publicKey) {
+		if keysafe.Equal(g.Key, publicKey) {
 			myPos = i
 		}
 	}
@@ -13,15 +13,21 @@ import (
 	"os"
 
 	"vuvuzela.io/alpenhorn/config"
+	"vuvuzela.io/alpenhorn/internal/version"
 	// Register the convo inner config.
 	_ "vuvuzela.io/vuvuzela/convo"
 )
 
 var configPath = flag.String("config", "", "path to new signed config")
 var configServerURL = flag.String("url", "", "url of config server")
+var printVersion = flag.Bool("version", false, "print version information and exit")
 
 func main() {
 	flag.Parse()
+	if *printVersion {
+		fmt.Println(version.String())
+		return
+	}
 
 	if *configPath == "" {
 		fmt.Println("Specify config file with -config.")
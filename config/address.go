@@ -0,0 +1,51 @@
+// Copyright 2018 David Lazar. All rights reserved.
+// Use of this source code is governed by the GNU AGPL
+// license that can be found in the LICENSE file.
+
+package config
+
+import (
+	"net"
+	"strconv"
+	"strings"
+
+	"vuvuzela.io/alpenhorn/errors"
+)
+
+// CheckAddress returns an error if addr is not a valid server address:
+// a host name or IP address, optionally followed by a port. Addresses
+// are used in URLs, so IPv6 literals must be bracketed, as in
+// "[2001:db8::1]:443" or "[2001:db8::1]".
+func CheckAddress(addr string) error {
+	if addr == "" {
+		return errors.New("empty address")
+	}
+
+	host := addr
+	if h, port, err := net.SplitHostPort(addr); err == nil {
+		n, err := strconv.Atoi(port)
+		if err != nil || n <= 0 || n > 65535 {
+			return errors.New("invalid port in address %q", addr)
+		}
+		host = h
+	} else if strings.HasPrefix(addr, "[") && strings.HasSuffix(addr, "]") {
+		host = addr[1 : len(addr)-1]
+	} else if strings.Contains(addr, ":") {
+		if net.ParseIP(addr) != nil {
+			return errors.New("IPv6 address %q must be bracketed, as in \"[%s]:port\"", addr, addr)
+		}
+		return errors.New("invalid address %q: %s", addr, err)
+	}
+
+	if host == "" {
+		return errors.New("missing host in address %q", addr)
+	}
+	if strings.Contains(host, ":") {
+		if net.ParseIP(host) == nil {
+			return errors.New("invalid IPv6 address in %q", addr)
+		}
+	} else if strings.ContainsAny(host, "[]/ ") {
+		return errors.New("invalid host in address %q", addr)
+	}
+	return nil
+}
@@ -0,0 +1,39 @@
+// Copyright 2018 David Lazar. All rights reserved.
+// Use of this source code is governed by the GNU AGPL
+// license that can be found in the LICENSE file.
+
+package config
+
+import "testing"
+
+func TestCheckAddress(t *testing.T) {
+	valid := []string{
+		"localhost:8080",
+		"vuvuzela.io",
+		"192.0.2.1:443",
+		"[2001:db8::1]:443",
+		"[2001:db8::1]",
+		"[::1]:28000",
+	}
+	for _, addr := range valid {
+		if err := CheckAddress(addr); err != nil {
+			t.Errorf("CheckAddress(%q): %s", addr, err)
+		}
+	}
+
+	invalid := []string{
+		"",
+		"2001:db8::1",
+		"2001:db8::1:443",
+		"[2001:db8::zz]:443",
+		"localhost:http",
+		"localhost:0",
+		":8080",
+		"a:b:c",
+	}
+	for _, addr := range invalid {
+		if err := CheckAddress(addr); err == nil {
+			t.Errorf("CheckAddress(%q): expected error", addr)
+		}
+	}
+}
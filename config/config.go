@@ -15,7 +15,11 @@ import (
 
 	"github.com/davidlazar/go-crypto/encoding/base32"
 
+	"vuvuzela.io/alpenhorn/addfriend"
+	"vuvuzela.io/alpenhorn/dialing"
 	"vuvuzela.io/alpenhorn/errors"
+	"vuvuzela.io/alpenhorn/internal/keysafe"
+	"vuvuzela.io/alpenhorn/pairing"
 	"vuvuzela.io/alpenhorn/pkg"
 	"vuvuzela.io/vuvuzela/mixnet"
 )
@@ -282,7 +286,7 @@ func init() {
 	RegisterService("Dialing", &DialingConfig{})
 }
 
-const AddFriendConfigVersion = 2
+const AddFriendConfigVersion = 3
 
 type AddFriendConfig struct {
 	Version     int
@@ -291,6 +295,32 @@ type AddFriendConfig struct {
 	MixServers  []mixnet.PublicServerConfig
 	CDNServer   CDNServerConfig
 	Registrar   RegistrarConfig
+
+	// Curves lists the pairing curves the PKG servers serve each
+	// round. The empty list means bn256 only. During a migration,
+	// list both the old and the new curve. Clients currently encrypt
+	// add-friend requests with bn256, so it must always be listed.
+	Curves []string
+
+	// IntroVersion selects the add-friend introduction format. Zero
+	// and addfriend.IntroVersionIBE encrypt intros with IBE only;
+	// addfriend.IntroVersionHybrid also wraps them with ML-KEM to the
+	// recipient's PQ key. All clients and mixers must support the
+	// version before it is switched on.
+	IntroVersion int
+
+	// PKGThreshold, if not zero, has the PKG servers generate each
+	// round's master keys on the Curves other than bn256 with a DKG,
+	// so that clients can extract their keys from any PKGThreshold
+	// of them. Those curves must support threshold keys.
+	PKGThreshold int
+
+	// PayloadVersion selects the plaintext introduction format. Zero
+	// is the original unpadded format; addfriend.PayloadVersion1 and
+	// later use a padded format with a version byte. Clients write the
+	// highest version supported by both them and the config, so later
+	// versions can be switched on before every client supports them.
+	PayloadVersion int
 }
 
 func (c *AddFriendConfig) UseLatestVersion() {
@@ -335,6 +365,21 @@ type addFriendV2 struct {
 	Registrar   keyAddr
 }
 
+//easyjson:readable
+type addFriendV3 struct {
+	Version      int
+	Coordinator  keyAddr
+	PKGServers   []pkg.PublicServerConfig
+	MixServers   []keyAddr
+	CDNServer    keyAddr
+	Registrar    keyAddr
+	Curves       []string
+	IntroVersion int
+
+	PayloadVersion int
+	PKGThreshold   int `json:",omitempty"`
+}
+
 //easyjson:readable
 type keyAddr struct {
 	Key     ed25519.PublicKey
@@ -342,6 +387,23 @@ type keyAddr struct {
 }
 
 func (c *AddFriendConfig) v1() (*addFriendV1, error) {
+	if len(c.Curves) > 0 {
+		return nil, errors.New("curves require AddFriendConfig version 3")
+	}
+	if c.IntroVersion > addfriend.IntroVersionIBE {
+		return nil, errors.New("intro version %d requires AddFriendConfig version 3", c.IntroVersion)
+	}
+	if c.PayloadVersion != addfriend.PayloadVersionLegacy {
+		return nil, errors.New("payload version %d requires AddFriendConfig version 3", c.PayloadVersion)
+	}
+	if c.PKGThreshold != 0 {
+		return nil, errors.New("pkg threshold requires AddFriendConfig version 3")
+	}
+	for i, srv := range c.PKGServers {
+		if srv.ProtocolVersion != 0 {
+			return nil, errors.New("pkg %d: protocol versions require AddFriendConfig version 3", i)
+		}
+	}
 	c1 := &addFriendV1{
 		Version:       1,
 		Coordinator:   keyAddr{c.Coordinator.Key, c.Coordinator.Address},
@@ -360,6 +422,23 @@ func (c *AddFriendConfig) v1() (*addFriendV1, error) {
 }
 
 func (c *AddFriendConfig) v2() (*addFriendV2, error) {
+	if len(c.Curves) > 0 {
+		return nil, errors.New("curves require AddFriendConfig version 3")
+	}
+	if c.IntroVersion > addfriend.IntroVersionIBE {
+		return nil, errors.New("intro version %d requires AddFriendConfig version 3", c.IntroVersion)
+	}
+	if c.PayloadVersion != addfriend.PayloadVersionLegacy {
+		return nil, errors.New("payload version %d requires AddFriendConfig version 3", c.PayloadVersion)
+	}
+	if c.PKGThreshold != 0 {
+		return nil, errors.New("pkg threshold requires AddFriendConfig version 3")
+	}
+	for i, srv := range c.PKGServers {
+		if srv.ProtocolVersion != 0 {
+			return nil, errors.New("pkg %d: protocol versions require AddFriendConfig version 3", i)
+		}
+	}
 	c2 := &addFriendV2{
 		Version:     2,
 		Coordinator: keyAddr{c.Coordinator.Key, c.Coordinator.Address},
@@ -377,6 +456,27 @@ func (c *AddFriendConfig) v2() (*addFriendV2, error) {
 	return c2, nil
 }
 
+func (c *AddFriendConfig) v3() (*addFriendV3, error) {
+	c3 := &addFriendV3{
+		Version:      3,
+		Coordinator:  keyAddr{c.Coordinator.Key, c.Coordinator.Address},
+		PKGServers:   make([]pkg.PublicServerConfig, len(c.PKGServers)),
+		MixServers:   make([]keyAddr, len(c.MixServers)),
+		CDNServer:    keyAddr{c.CDNServer.Key, c.CDNServer.Address},
+		Registrar:    keyAddr{c.Registrar.Key, c.Registrar.Address},
+		Curves:       c.Curves,
+		IntroVersion: c.IntroVersion,
+
+		PayloadVersion: c.PayloadVersion,
+		PKGThreshold:   c.PKGThreshold,
+	}
+	copy(c3.PKGServers, c.PKGServers)
+	for i, srv := range c.MixServers {
+		c3.MixServers[i] = keyAddr{srv.Key, srv.Address}
+	}
+	return c3, nil
+}
+
 func (c *AddFriendConfig) fromV1(c1 *addFriendV1) error {
 	c.Version = 1
 	c.Coordinator = CoordinatorConfig{c1.Coordinator.Key, c1.Coordinator.Address}
@@ -409,6 +509,24 @@ func (c *AddFriendConfig) fromV2(c2 *addFriendV2) error {
 	return nil
 }
 
+func (c *AddFriendConfig) fromV3(c3 *addFriendV3) error {
+	c.Version = 3
+	c.Coordinator = CoordinatorConfig{c3.Coordinator.Key, c3.Coordinator.Address}
+	c.PKGServers = make([]pkg.PublicServerConfig, len(c3.PKGServers))
+	c.MixServers = make([]mixnet.PublicServerConfig, len(c3.MixServers))
+	c.CDNServer = CDNServerConfig{c3.CDNServer.Key, c3.CDNServer.Address}
+	copy(c.PKGServers, c3.PKGServers)
+	for i, srv := range c3.MixServers {
+		c.MixServers[i] = mixnet.PublicServerConfig{Key: srv.Key, Address: srv.Address}
+	}
+	c.Registrar = RegistrarConfig{c3.Registrar.Key, c3.Registrar.Address}
+	c.Curves = c3.Curves
+	c.IntroVersion = c3.IntroVersion
+	c.PayloadVersion = c3.PayloadVersion
+	c.PKGThreshold = c3.PKGThreshold
+	return nil
+}
+
 func (c *AddFriendConfig) Validate() error {
 	if c.Version <= 0 {
 		return errors.New("invalid version number: %d", c.Version)
@@ -416,6 +534,9 @@ func (c *AddFriendConfig) Validate() error {
 	if c.Coordinator.Address == "" {
 		return errors.New("empty address for coordinator")
 	}
+	if err := CheckAddress(c.Coordinator.Address); err != nil {
+		return errors.Wrap(err, "coordinator")
+	}
 	if len(c.Coordinator.Key) != ed25519.PublicKeySize {
 		return errors.New("invalid key for coordinator: %#v", c.Coordinator.Key)
 	}
@@ -427,11 +548,17 @@ func (c *AddFriendConfig) Validate() error {
 		if mix.Address == "" {
 			return errors.New("empty address for mix server %d", i)
 		}
+		if err := CheckAddress(mix.Address); err != nil {
+			return errors.Wrap(err, "mix server %d", i)
+		}
 	}
 
 	if c.CDNServer.Address == "" {
 		return errors.New("empty address for cdn server")
 	}
+	if err := CheckAddress(c.CDNServer.Address); err != nil {
+		return errors.Wrap(err, "cdn server")
+	}
 	if len(c.CDNServer.Key) != ed25519.PublicKeySize {
 		return errors.New("invalid key for cdn: %v", c.CDNServer.Key)
 	}
@@ -443,6 +570,53 @@ func (c *AddFriendConfig) Validate() error {
 		if pkg.Address == "" {
 			return errors.New("empty address for pkg %d", i)
 		}
+		if err := CheckAddress(pkg.Address); err != nil {
+			return errors.Wrap(err, "pkg %d", i)
+		}
+		if pkg.ProtocolVersion < 0 {
+			return errors.New("invalid protocol version for pkg %d: %d", i, pkg.ProtocolVersion)
+		}
+	}
+
+	if len(c.Curves) > 0 {
+		seen := make(map[string]bool)
+		for _, curve := range c.Curves {
+			if _, err := pairing.Lookup(curve); err != nil {
+				return err
+			}
+			if seen[curve] {
+				return errors.New("duplicate curve: %q", curve)
+			}
+			seen[curve] = true
+		}
+		if !seen[pairing.BN256] {
+			return errors.New("curves must include %s", pairing.BN256)
+		}
+	}
+	if c.PKGThreshold != 0 {
+		if c.PKGThreshold < 1 || c.PKGThreshold > len(c.PKGServers) {
+			return errors.New("pkg threshold %d out of range for %d pkgs", c.PKGThreshold, len(c.PKGServers))
+		}
+		if len(c.Curves) < 2 {
+			return errors.New("pkg threshold requires a curve other than %s", pairing.BN256)
+		}
+		for _, curve := range c.Curves {
+			if curve == pairing.BN256 {
+				continue
+			}
+			if _, err := pairing.LookupThreshold(curve); err != nil {
+				return err
+			}
+		}
+	}
+
+	if c.IntroVersion < 0 || c.IntroVersion > addfriend.IntroVersionHybrid {
+		return errors.New("unsupported intro version: %d", c.IntroVersion)
+	}
+	// Versions this build does not know are allowed: they are padded
+	// like version 1, and clients fall back to the highest they know.
+	if c.PayloadVersion < 0 || c.PayloadVersion > 255 {
+		return errors.New("invalid payload version: %d", c.PayloadVersion)
 	}
 
 	return nil
@@ -462,6 +636,12 @@ func (c *AddFriendConfig) MarshalJSON() ([]byte, error) {
 			return nil, err
 		}
 		return json.Marshal(c2)
+	case 3:
+		c3, err := c.v3()
+		if err != nil {
+			return nil, err
+		}
+		return json.Marshal(c3)
 	default:
 		return nil, errors.New("unknown AddFriendConfig version: %d", c.Version)
 	}
@@ -487,18 +667,45 @@ func (c *AddFriendConfig) UnmarshalJSON(data []byte) error {
 			return err
 		}
 		return c.fromV2(c2)
+	case 3:
+		c3 := new(addFriendV3)
+		err := json.Unmarshal(data, c3)
+		if err != nil {
+			return err
+		}
+		return c.fromV3(c3)
 	default:
 		return errors.New("unknown AddFriendConfig version: %d", version)
 	}
 }
 
-const DialingConfigVersion = 1
+const DialingConfigVersion = 2
 
 type DialingConfig struct {
 	Version     int
 	Coordinator CoordinatorConfig
 	MixServers  []mixnet.PublicServerConfig
 	CDNServer   CDNServerConfig
+
+	// PIRMirrors are CDN servers that mirror the CDN's dialing
+	// mailboxes. When set, clients may fetch their mailbox by
+	// private information retrieval across the CDN and its mirrors
+	// instead of downloading it. This is experimental.
+	PIRMirrors []CDNServerConfig
+
+	// These bound the Bloom filter parameters that dialing rounds may
+	// use. A round's false positive rate must be within the min and
+	// max rates, and its Bloom capacity at most MaxBloomCapacity. If
+	// the rates are zero, rounds must use the default rate.
+	MinBloomFalsePositiveRate float64
+	MaxBloomFalsePositiveRate float64
+	MaxBloomCapacity          int
+
+	// PayloadVersion selects the dialing mix message format. Zero is
+	// the original unpadded format; dialing.PayloadVersion1 and later
+	// use a padded format with a version byte. Clients write the
+	// highest version supported by both them and the config.
+	PayloadVersion int
 }
 
 func (c *DialingConfig) UseLatestVersion() {
@@ -514,6 +721,15 @@ type dialingV1 struct {
 }
 
 func (c *DialingConfig) v1() (*dialingV1, error) {
+	if len(c.PIRMirrors) > 0 {
+		return nil, errors.New("PIR mirrors are not supported in version 1")
+	}
+	if c.MinBloomFalsePositiveRate != 0 || c.MaxBloomFalsePositiveRate != 0 || c.MaxBloomCapacity != 0 {
+		return nil, errors.New("bloom bounds are not supported in version 1")
+	}
+	if c.PayloadVersion != dialing.PayloadVersionLegacy {
+		return nil, errors.New("payload version %d is not supported in version 1", c.PayloadVersion)
+	}
 	c1 := &dialingV1{
 		Version:     1,
 		Coordinator: keyAddr{c.Coordinator.Key, c.Coordinator.Address},
@@ -537,6 +753,62 @@ func (c *DialingConfig) fromV1(c1 *dialingV1) error {
 	return nil
 }
 
+//easyjson:readable
+type dialingV2 struct {
+	Version     int
+	Coordinator keyAddr
+	MixServers  []keyAddr
+	CDNServer   keyAddr
+	PIRMirrors  []keyAddr
+
+	MinBloomFalsePositiveRate float64
+	MaxBloomFalsePositiveRate float64
+	MaxBloomCapacity          int
+
+	PayloadVersion int
+}
+
+func (c *DialingConfig) v2() (*dialingV2, error) {
+	c2 := &dialingV2{
+		Version:     2,
+		Coordinator: keyAddr{c.Coordinator.Key, c.Coordinator.Address},
+		MixServers:  make([]keyAddr, len(c.MixServers)),
+		CDNServer:   keyAddr{c.CDNServer.Key, c.CDNServer.Address},
+
+		MinBloomFalsePositiveRate: c.MinBloomFalsePositiveRate,
+		MaxBloomFalsePositiveRate: c.MaxBloomFalsePositiveRate,
+		MaxBloomCapacity:          c.MaxBloomCapacity,
+
+		PayloadVersion: c.PayloadVersion,
+	}
+	for i, srv := range c.MixServers {
+		c2.MixServers[i] = keyAddr{srv.Key, srv.Address}
+	}
+	for _, srv := range c.PIRMirrors {
+		c2.PIRMirrors = append(c2.PIRMirrors, keyAddr{srv.Key, srv.Address})
+	}
+	return c2, nil
+}
+
+func (c *DialingConfig) fromV2(c2 *dialingV2) error {
+	c.Version = 2
+	c.Coordinator = CoordinatorConfig{c2.Coordinator.Key, c2.Coordinator.Address}
+	c.MixServers = make([]mixnet.PublicServerConfig, len(c2.MixServers))
+	c.CDNServer = CDNServerConfig{c2.CDNServer.Key, c2.CDNServer.Address}
+	for i, srv := range c2.MixServers {
+		c.MixServers[i] = mixnet.PublicServerConfig{Key: srv.Key, Address: srv.Address}
+	}
+	c.PIRMirrors = nil
+	for _, srv := range c2.PIRMirrors {
+		c.PIRMirrors = append(c.PIRMirrors, CDNServerConfig{srv.Key, srv.Address})
+	}
+	c.MinBloomFalsePositiveRate = c2.MinBloomFalsePositiveRate
+	c.MaxBloomFalsePositiveRate = c2.MaxBloomFalsePositiveRate
+	c.MaxBloomCapacity = c2.MaxBloomCapacity
+	c.PayloadVersion = c2.PayloadVersion
+	return nil
+}
+
 func (c *DialingConfig) MarshalJSON() ([]byte, error) {
 	switch c.Version {
 	case 1:
@@ -545,6 +817,12 @@ func (c *DialingConfig) MarshalJSON() ([]byte, error) {
 			return nil, err
 		}
 		return json.Marshal(c1)
+	case 2:
+		c2, err := c.v2()
+		if err != nil {
+			return nil, err
+		}
+		return json.Marshal(c2)
 	default:
 		return nil, errors.New("unknown DialingConfig version: %d", c.Version)
 	}
@@ -563,6 +841,13 @@ func (c *DialingConfig) UnmarshalJSON(data []byte) error {
 			return err
 		}
 		return c.fromV1(c1)
+	case 2:
+		c2 := new(dialingV2)
+		err := json.Unmarshal(data, c2)
+		if err != nil {
+			return err
+		}
+		return c.fromV2(c2)
 	default:
 		return errors.New("unknown DialingConfig version: %d", version)
 	}
@@ -575,6 +860,9 @@ func (c *DialingConfig) Validate() error {
 	if c.Coordinator.Address == "" {
 		return errors.New("empty address for coordinator")
 	}
+	if err := CheckAddress(c.Coordinator.Address); err != nil {
+		return errors.Wrap(err, "coordinator")
+	}
 	if len(c.Coordinator.Key) != ed25519.PublicKeySize {
 		return errors.New("invalid key for coordinator: %#v", c.Coordinator.Key)
 	}
@@ -586,12 +874,73 @@ func (c *DialingConfig) Validate() error {
 		if mix.Address == "" {
 			return errors.New("empty address for mix server %d", i)
 		}
+		if err := CheckAddress(mix.Address); err != nil {
+			return errors.Wrap(err, "mix server %d", i)
+		}
 	}
 
 	if c.CDNServer.Address != "" && len(c.CDNServer.Key) != ed25519.PublicKeySize {
 		return errors.New("invalid key for cdn: %v", c.CDNServer.Key)
 	}
+	if c.CDNServer.Address != "" {
+		if err := CheckAddress(c.CDNServer.Address); err != nil {
+			return errors.Wrap(err, "cdn server")
+		}
+	}
 
+	if len(c.PIRMirrors) > 0 && c.CDNServer.Address == "" {
+		return errors.New("PIR mirrors require a cdn server")
+	}
+	for i, mirror := range c.PIRMirrors {
+		if len(mirror.Key) != ed25519.PublicKeySize {
+			return errors.New("invalid key for PIR mirror %d: %v", i, mirror.Key)
+		}
+		if mirror.Address == "" {
+			return errors.New("empty address for PIR mirror %d", i)
+		}
+		if err := CheckAddress(mirror.Address); err != nil {
+			return errors.Wrap(err, "PIR mirror %d", i)
+		}
+		if keysafe.Equal(mirror.Key, c.CDNServer.Key) {
+			return errors.New("PIR mirror %d is the cdn server", i)
+		}
+		for j := 0; j < i; j++ {
+			if keysafe.Equal(mirror.Key, c.PIRMirrors[j].Key) {
+				return errors.New("duplicate PIR mirror: %d and %d", j, i)
+			}
+		}
+	}
+
+	min, max := c.MinBloomFalsePositiveRate, c.MaxBloomFalsePositiveRate
+	if min != 0 || max != 0 {
+		if !(0 < min && min <= max && max < 0.5) {
+			return errors.New("invalid bloom false positive rate bounds: [%v, %v]", min, max)
+		}
+	}
+	if c.MaxBloomCapacity < 0 || c.MaxBloomCapacity > dialing.MaxBloomCapacity {
+		return errors.New("invalid max bloom capacity: %d", c.MaxBloomCapacity)
+	}
+
+	if c.PayloadVersion < 0 || c.PayloadVersion > 255 {
+		return errors.New("invalid payload version: %d", c.PayloadVersion)
+	}
+
+	return nil
+}
+
+// CheckBloomParams checks a round's Bloom filter parameters against
+// the config's bounds.
+func (c *DialingConfig) CheckBloomParams(falsePositiveRate float64, capacity int) error {
+	min, max := c.MinBloomFalsePositiveRate, c.MaxBloomFalsePositiveRate
+	if min == 0 && max == 0 {
+		min, max = dialing.DefaultBloomFalsePositiveRate, dialing.DefaultBloomFalsePositiveRate
+	}
+	if falsePositiveRate < min || falsePositiveRate > max {
+		return errors.New("bloom false positive rate %v outside [%v, %v]", falsePositiveRate, min, max)
+	}
+	if capacity < 0 || capacity > c.MaxBloomCapacity {
+		return errors.New("bloom capacity %d exceeds %d", capacity, c.MaxBloomCapacity)
+	}
 	return nil
 }
 
@@ -7,6 +7,7 @@ import (
 	easyjson "github.com/davidlazar/easyjson"
 	jlexer "github.com/davidlazar/easyjson/jlexer"
 	jwriter "github.com/davidlazar/easyjson/jwriter"
+	pkg "vuvuzela.io/alpenhorn/pkg"
 )
 
 // suppress unused package warning
@@ -419,6 +420,438 @@ func (v *dialingV1) UnmarshalJSON(data []byte) error {
 func (v *dialingV1) UnmarshalEasyJSON(l *jlexer.Lexer) {
 	easyjsonDecodeDialingV16615c02e(l, v)
 }
+func easyjsonDecodeDialingV26615c02e(in *jlexer.Lexer, out *dialingV2) {
+	isTopLevel := in.IsStart()
+	if in.IsNull() {
+		if isTopLevel {
+			in.Consumed()
+		}
+		in.Skip()
+		return
+	}
+	in.Delim('{')
+	for !in.IsDelim('}') {
+		key := in.UnsafeString()
+		in.WantColon()
+		if in.IsNull() {
+			in.Skip()
+			in.WantComma()
+			continue
+		}
+		switch key {
+		case "Version":
+			out.Version = int(in.Int())
+		case "Coordinator":
+			(out.Coordinator).UnmarshalEasyJSON(in)
+		case "MixServers":
+			if in.IsNull() {
+				in.Skip()
+				out.MixServers = nil
+			} else {
+				in.Delim('[')
+				if out.MixServers == nil {
+					if !in.IsDelim(']') {
+						out.MixServers = make([]keyAddr, 0, 1)
+					} else {
+						out.MixServers = []keyAddr{}
+					}
+				} else {
+					out.MixServers = (out.MixServers)[:0]
+				}
+				for !in.IsDelim(']') {
+					var v27 keyAddr
+					(v27).UnmarshalEasyJSON(in)
+					out.MixServers = append(out.MixServers, v27)
+					in.WantComma()
+				}
+				in.Delim(']')
+			}
+		case "CDNServer":
+			(out.CDNServer).UnmarshalEasyJSON(in)
+		case "PIRMirrors":
+			if in.IsNull() {
+				in.Skip()
+				out.PIRMirrors = nil
+			} else {
+				in.Delim('[')
+				if out.PIRMirrors == nil {
+					if !in.IsDelim(']') {
+						out.PIRMirrors = make([]keyAddr, 0, 1)
+					} else {
+						out.PIRMirrors = []keyAddr{}
+					}
+				} else {
+					out.PIRMirrors = (out.PIRMirrors)[:0]
+				}
+				for !in.IsDelim(']') {
+					var v30 keyAddr
+					(v30).UnmarshalEasyJSON(in)
+					out.PIRMirrors = append(out.PIRMirrors, v30)
+					in.WantComma()
+				}
+				in.Delim(']')
+			}
+		case "MinBloomFalsePositiveRate":
+			out.MinBloomFalsePositiveRate = float64(in.Float64())
+		case "MaxBloomFalsePositiveRate":
+			out.MaxBloomFalsePositiveRate = float64(in.Float64())
+		case "MaxBloomCapacity":
+			out.MaxBloomCapacity = int(in.Int())
+		case "PayloadVersion":
+			out.PayloadVersion = int(in.Int())
+		default:
+			in.SkipRecursive()
+		}
+		in.WantComma()
+	}
+	in.Delim('}')
+	if isTopLevel {
+		in.Consumed()
+	}
+}
+func easyjsonEncodeDialingV26615c02e(out *jwriter.Writer, in dialingV2) {
+	out.RawByte('{')
+	first := true
+	_ = first
+	if !first {
+		out.RawByte(',')
+	}
+	first = false
+	out.RawString("\"Version\":")
+	out.Int(int(in.Version))
+	if !first {
+		out.RawByte(',')
+	}
+	first = false
+	out.RawString("\"Coordinator\":")
+	(in.Coordinator).MarshalEasyJSON(out)
+	if !first {
+		out.RawByte(',')
+	}
+	first = false
+	out.RawString("\"MixServers\":")
+	if in.MixServers == nil && (out.Flags&jwriter.NilSliceAsEmpty) == 0 {
+		out.RawString("null")
+	} else {
+		out.RawByte('[')
+		for v28, v29 := range in.MixServers {
+			if v28 > 0 {
+				out.RawByte(',')
+			}
+			(v29).MarshalEasyJSON(out)
+		}
+		out.RawByte(']')
+	}
+	if !first {
+		out.RawByte(',')
+	}
+	first = false
+	out.RawString("\"CDNServer\":")
+	(in.CDNServer).MarshalEasyJSON(out)
+	if !first {
+		out.RawByte(',')
+	}
+	first = false
+	out.RawString("\"PIRMirrors\":")
+	if in.PIRMirrors == nil && (out.Flags&jwriter.NilSliceAsEmpty) == 0 {
+		out.RawString("null")
+	} else {
+		out.RawByte('[')
+		for v31, v32 := range in.PIRMirrors {
+			if v31 > 0 {
+				out.RawByte(',')
+			}
+			(v32).MarshalEasyJSON(out)
+		}
+		out.RawByte(']')
+	}
+	if !first {
+		out.RawByte(',')
+	}
+	first = false
+	out.RawString("\"MinBloomFalsePositiveRate\":")
+	out.Float64(float64(in.MinBloomFalsePositiveRate))
+	if !first {
+		out.RawByte(',')
+	}
+	first = false
+	out.RawString("\"MaxBloomFalsePositiveRate\":")
+	out.Float64(float64(in.MaxBloomFalsePositiveRate))
+	if !first {
+		out.RawByte(',')
+	}
+	first = false
+	out.RawString("\"MaxBloomCapacity\":")
+	out.Int(int(in.MaxBloomCapacity))
+	if !first {
+		out.RawByte(',')
+	}
+	first = false
+	out.RawString("\"PayloadVersion\":")
+	out.Int(int(in.PayloadVersion))
+	out.RawByte('}')
+}
+
+// MarshalJSON supports json.Marshaler interface
+func (v dialingV2) MarshalJSON() ([]byte, error) {
+	w := jwriter.Writer{}
+	easyjsonEncodeDialingV26615c02e(&w, v)
+	return w.Buffer.BuildBytes(), w.Error
+}
+
+// MarshalEasyJSON supports easyjson.Marshaler interface
+func (v dialingV2) MarshalEasyJSON(w *jwriter.Writer) {
+	easyjsonEncodeDialingV26615c02e(w, v)
+}
+
+// UnmarshalJSON supports json.Unmarshaler interface
+func (v *dialingV2) UnmarshalJSON(data []byte) error {
+	r := jlexer.Lexer{Data: data}
+	easyjsonDecodeDialingV26615c02e(&r, v)
+	return r.Error()
+}
+
+// UnmarshalEasyJSON supports easyjson.Unmarshaler interface
+func (v *dialingV2) UnmarshalEasyJSON(l *jlexer.Lexer) {
+	easyjsonDecodeDialingV26615c02e(l, v)
+}
+func easyjsonDecodeAddFriendV36615c02e(in *jlexer.Lexer, out *addFriendV3) {
+	isTopLevel := in.IsStart()
+	if in.IsNull() {
+		if isTopLevel {
+			in.Consumed()
+		}
+		in.Skip()
+		return
+	}
+	in.Delim('{')
+	for !in.IsDelim('}') {
+		key := in.UnsafeString()
+		in.WantColon()
+		if in.IsNull() {
+			in.Skip()
+			in.WantComma()
+			continue
+		}
+		switch key {
+		case "Version":
+			out.Version = int(in.Int())
+		case "Coordinator":
+			(out.Coordinator).UnmarshalEasyJSON(in)
+		case "PKGServers":
+			if in.IsNull() {
+				in.Skip()
+				out.PKGServers = nil
+			} else {
+				in.Delim('[')
+				if out.PKGServers == nil {
+					if !in.IsDelim(']') {
+						out.PKGServers = make([]pkg.PublicServerConfig, 0, 1)
+					} else {
+						out.PKGServers = []pkg.PublicServerConfig{}
+					}
+				} else {
+					out.PKGServers = (out.PKGServers)[:0]
+				}
+				for !in.IsDelim(']') {
+					var v15 pkg.PublicServerConfig
+					(v15).UnmarshalEasyJSON(in)
+					out.PKGServers = append(out.PKGServers, v15)
+					in.WantComma()
+				}
+				in.Delim(']')
+			}
+		case "MixServers":
+			if in.IsNull() {
+				in.Skip()
+				out.MixServers = nil
+			} else {
+				in.Delim('[')
+				if out.MixServers == nil {
+					if !in.IsDelim(']') {
+						out.MixServers = make([]keyAddr, 0, 1)
+					} else {
+						out.MixServers = []keyAddr{}
+					}
+				} else {
+					out.MixServers = (out.MixServers)[:0]
+				}
+				for !in.IsDelim(']') {
+					var v16 keyAddr
+					(v16).UnmarshalEasyJSON(in)
+					out.MixServers = append(out.MixServers, v16)
+					in.WantComma()
+				}
+				in.Delim(']')
+			}
+		case "CDNServer":
+			(out.CDNServer).UnmarshalEasyJSON(in)
+		case "Registrar":
+			(out.Registrar).UnmarshalEasyJSON(in)
+		case "Curves":
+			if in.IsNull() {
+				in.Skip()
+				out.Curves = nil
+			} else {
+				in.Delim('[')
+				if out.Curves == nil {
+					if !in.IsDelim(']') {
+						out.Curves = make([]string, 0, 4)
+					} else {
+						out.Curves = []string{}
+					}
+				} else {
+					out.Curves = (out.Curves)[:0]
+				}
+				for !in.IsDelim(']') {
+					var v21 string
+					v21 = string(in.String())
+					out.Curves = append(out.Curves, v21)
+					in.WantComma()
+				}
+				in.Delim(']')
+			}
+		case "IntroVersion":
+			out.IntroVersion = int(in.Int())
+		case "PayloadVersion":
+			out.PayloadVersion = int(in.Int())
+		case "PKGThreshold":
+			out.PKGThreshold = int(in.Int())
+		default:
+			in.SkipRecursive()
+		}
+		in.WantComma()
+	}
+	in.Delim('}')
+	if isTopLevel {
+		in.Consumed()
+	}
+}
+func easyjsonEncodeAddFriendV36615c02e(out *jwriter.Writer, in addFriendV3) {
+	out.RawByte('{')
+	first := true
+	_ = first
+	if !first {
+		out.RawByte(',')
+	}
+	first = false
+	out.RawString("\"Version\":")
+	out.Int(int(in.Version))
+	if !first {
+		out.RawByte(',')
+	}
+	first = false
+	out.RawString("\"Coordinator\":")
+	(in.Coordinator).MarshalEasyJSON(out)
+	if !first {
+		out.RawByte(',')
+	}
+	first = false
+	out.RawString("\"PKGServers\":")
+	if in.PKGServers == nil && (out.Flags&jwriter.NilSliceAsEmpty) == 0 {
+		out.RawString("null")
+	} else {
+		out.RawByte('[')
+		for v17, v18 := range in.PKGServers {
+			if v17 > 0 {
+				out.RawByte(',')
+			}
+			(v18).MarshalEasyJSON(out)
+		}
+		out.RawByte(']')
+	}
+	if !first {
+		out.RawByte(',')
+	}
+	first = false
+	out.RawString("\"MixServers\":")
+	if in.MixServers == nil && (out.Flags&jwriter.NilSliceAsEmpty) == 0 {
+		out.RawString("null")
+	} else {
+		out.RawByte('[')
+		for v19, v20 := range in.MixServers {
+			if v19 > 0 {
+				out.RawByte(',')
+			}
+			(v20).MarshalEasyJSON(out)
+		}
+		out.RawByte(']')
+	}
+	if !first {
+		out.RawByte(',')
+	}
+	first = false
+	out.RawString("\"CDNServer\":")
+	(in.CDNServer).MarshalEasyJSON(out)
+	if !first {
+		out.RawByte(',')
+	}
+	first = false
+	out.RawString("\"Registrar\":")
+	(in.Registrar).MarshalEasyJSON(out)
+	if !first {
+		out.RawByte(',')
+	}
+	first = false
+	out.RawString("\"Curves\":")
+	if in.Curves == nil && (out.Flags&jwriter.NilSliceAsEmpty) == 0 {
+		out.RawString("null")
+	} else {
+		out.RawByte('[')
+		for v22, v23 := range in.Curves {
+			if v22 > 0 {
+				out.RawByte(',')
+			}
+			out.String(string(v23))
+		}
+		out.RawByte(']')
+	}
+	if !first {
+		out.RawByte(',')
+	}
+	first = false
+	out.RawString("\"IntroVersion\":")
+	out.Int(int(in.IntroVersion))
+	if !first {
+		out.RawByte(',')
+	}
+	first = false
+	out.RawString("\"PayloadVersion\":")
+	out.Int(int(in.PayloadVersion))
+	if in.PKGThreshold != 0 {
+		if !first {
+			out.RawByte(',')
+		}
+		first = false
+		out.RawString("\"PKGThreshold\":")
+		out.Int(int(in.PKGThreshold))
+	}
+	out.RawByte('}')
+}
+
+// MarshalJSON supports json.Marshaler interface
+func (v addFriendV3) MarshalJSON() ([]byte, error) {
+	w := jwriter.Writer{}
+	easyjsonEncodeAddFriendV36615c02e(&w, v)
+	return w.Buffer.BuildBytes(), w.Error
+}
+
+// MarshalEasyJSON supports easyjson.Marshaler interface
+func (v addFriendV3) MarshalEasyJSON(w *jwriter.Writer) {
+	easyjsonEncodeAddFriendV36615c02e(w, v)
+}
+
+// UnmarshalJSON supports json.Unmarshaler interface
+func (v *addFriendV3) UnmarshalJSON(data []byte) error {
+	r := jlexer.Lexer{Data: data}
+	easyjsonDecodeAddFriendV36615c02e(&r, v)
+	return r.Error()
+}
+
+// UnmarshalEasyJSON supports easyjson.Unmarshaler interface
+func (v *addFriendV3) UnmarshalEasyJSON(l *jlexer.Lexer) {
+	easyjsonDecodeAddFriendV36615c02e(l, v)
+}
 func easyjsonDecodeAddFriendV26615c02e(in *jlexer.Lexer, out *addFriendV2) {
 	isTopLevel := in.IsStart()
 	if in.IsNull() {
@@ -14,6 +14,9 @@ import (
 
 	"github.com/davidlazar/go-crypto/encoding/base32"
 
+	"vuvuzela.io/alpenhorn/addfriend"
+	"vuvuzela.io/alpenhorn/dialing"
+	"vuvuzela.io/alpenhorn/pairing"
 	"vuvuzela.io/alpenhorn/pkg"
 	"vuvuzela.io/internal/debug"
 	"vuvuzela.io/vuvuzela/mixnet"
@@ -201,6 +204,262 @@ func TestMarshalAddFriendConfig(t *testing.T) {
 	}
 }
 
+func TestAddFriendCurves(t *testing.T) {
+	key, _, _ := ed25519.GenerateKey(rand.Reader)
+	conf := &AddFriendConfig{
+		Version:     AddFriendConfigVersion,
+		Coordinator: CoordinatorConfig{Key: key, Address: "localhost:8080"},
+		CDNServer:   CDNServerConfig{Key: key, Address: "localhost:8888"},
+		Curves:      []string{"bn256", "bls12-381"},
+	}
+	if err := conf.Validate(); err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := json.Marshal(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conf2 := new(AddFriendConfig)
+	if err := json.Unmarshal(data, conf2); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(conf.Curves, conf2.Curves) {
+		t.Fatalf("curves did not round-trip: %v != %v", conf.Curves, conf2.Curves)
+	}
+
+	conf.Version = 2
+	if _, err := json.Marshal(conf); err == nil {
+		t.Fatal("expected error marshaling curves in a version 2 config")
+	}
+	conf.Version = AddFriendConfigVersion
+
+	for _, curves := range [][]string{
+		{"bls12-381"},
+		{"bn256", "bn256"},
+		{"bn256", "p256"},
+	} {
+		conf.Curves = curves
+		if err := conf.Validate(); err == nil {
+			t.Fatalf("expected error for curves %v", curves)
+		}
+	}
+}
+
+func TestAddFriendIntroVersion(t *testing.T) {
+	key, _, _ := ed25519.GenerateKey(rand.Reader)
+	conf := &AddFriendConfig{
+		Version:      AddFriendConfigVersion,
+		Coordinator:  CoordinatorConfig{Key: key, Address: "localhost:8080"},
+		CDNServer:    CDNServerConfig{Key: key, Address: "localhost:8888"},
+		IntroVersion: addfriend.IntroVersionHybrid,
+	}
+	if err := conf.Validate(); err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := json.Marshal(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conf2 := new(AddFriendConfig)
+	if err := json.Unmarshal(data, conf2); err != nil {
+		t.Fatal(err)
+	}
+	if conf2.IntroVersion != addfriend.IntroVersionHybrid {
+		t.Fatalf("intro version did not round-trip: got %d", conf2.IntroVersion)
+	}
+
+	conf.Version = 2
+	if _, err := json.Marshal(conf); err == nil {
+		t.Fatal("expected error marshaling hybrid intros in a version 2 config")
+	}
+	conf.Version = AddFriendConfigVersion
+
+	conf.IntroVersion = 3
+	if err := conf.Validate(); err == nil {
+		t.Fatal("expected error for unknown intro version")
+	}
+}
+
+func TestAddFriendPKGThreshold(t *testing.T) {
+	key, _, _ := ed25519.GenerateKey(rand.Reader)
+	pkgs := make([]pkg.PublicServerConfig, 3)
+	for i := range pkgs {
+		pkgKey, _, _ := ed25519.GenerateKey(rand.Reader)
+		pkgs[i] = pkg.PublicServerConfig{Key: pkgKey, Address: "localhost:8081"}
+	}
+	conf := &AddFriendConfig{
+		Version:      AddFriendConfigVersion,
+		Coordinator:  CoordinatorConfig{Key: key, Address: "localhost:8080"},
+		CDNServer:    CDNServerConfig{Key: key, Address: "localhost:8888"},
+		PKGServers:   pkgs,
+		Curves:       []string{pairing.BN256, pairing.BLS12381},
+		PKGThreshold: 2,
+	}
+	if err := conf.Validate(); err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := json.Marshal(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conf2 := new(AddFriendConfig)
+	if err := json.Unmarshal(data, conf2); err != nil {
+		t.Fatal(err)
+	}
+	if conf2.PKGThreshold != 2 {
+		t.Fatalf("pkg threshold did not round-trip: got %d", conf2.PKGThreshold)
+	}
+
+	conf.Version = 2
+	conf.Curves = nil
+	if _, err := json.Marshal(conf); err == nil {
+		t.Fatal("expected error marshaling a pkg threshold in a version 2 config")
+	}
+	conf.Version = AddFriendConfigVersion
+
+	if err := conf.Validate(); err == nil {
+		t.Fatal("expected error for a pkg threshold with bn256 only")
+	}
+	conf.Curves = []string{pairing.BN256, pairing.BLS12381}
+	conf.PKGThreshold = 4
+	if err := conf.Validate(); err == nil {
+		t.Fatal("expected error for a pkg threshold above the number of pkgs")
+	}
+}
+
+func TestDialingPIRMirrors(t *testing.T) {
+	cdnKey, _, _ := ed25519.GenerateKey(rand.Reader)
+	mirrorKey, _, _ := ed25519.GenerateKey(rand.Reader)
+	conf := &DialingConfig{
+		Version:     DialingConfigVersion,
+		Coordinator: CoordinatorConfig{Key: cdnKey, Address: "localhost:8080"},
+		CDNServer:   CDNServerConfig{Key: cdnKey, Address: "localhost:8888"},
+		PIRMirrors:  []CDNServerConfig{{Key: mirrorKey, Address: "localhost:8889"}},
+	}
+	if err := conf.Validate(); err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := json.Marshal(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conf2 := new(DialingConfig)
+	if err := json.Unmarshal(data, conf2); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(conf.PIRMirrors, conf2.PIRMirrors) {
+		t.Fatalf("mirrors did not round-trip: %v != %v", conf.PIRMirrors, conf2.PIRMirrors)
+	}
+
+	conf.Version = 1
+	if _, err := json.Marshal(conf); err == nil {
+		t.Fatal("expected error marshaling PIR mirrors in a version 1 config")
+	}
+	conf.Version = DialingConfigVersion
+
+	conf.PIRMirrors = append(conf.PIRMirrors, conf.CDNServer)
+	if err := conf.Validate(); err == nil {
+		t.Fatal("expected error for a mirror that is the cdn server")
+	}
+}
+
+func TestDialingBloomBounds(t *testing.T) {
+	key, _, _ := ed25519.GenerateKey(rand.Reader)
+	conf := &DialingConfig{
+		Version:     DialingConfigVersion,
+		Coordinator: CoordinatorConfig{Key: key, Address: "localhost:8080"},
+		CDNServer:   CDNServerConfig{Key: key, Address: "localhost:8888"},
+	}
+	if err := conf.CheckBloomParams(dialing.DefaultBloomFalsePositiveRate, 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := conf.CheckBloomParams(0.001, 0); err == nil {
+		t.Fatal("expected error for a non-default rate without bounds")
+	}
+
+	conf.MinBloomFalsePositiveRate = 0.0000001
+	conf.MaxBloomFalsePositiveRate = 0.001
+	conf.MaxBloomCapacity = 1000
+	if err := conf.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	if err := conf.CheckBloomParams(0.001, 1000); err != nil {
+		t.Fatal(err)
+	}
+	if err := conf.CheckBloomParams(0.01, 0); err == nil {
+		t.Fatal("expected error for a rate above the maximum")
+	}
+	if err := conf.CheckBloomParams(0.001, 1001); err == nil {
+		t.Fatal("expected error for a capacity above the maximum")
+	}
+
+	data, err := json.Marshal(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conf2 := new(DialingConfig)
+	if err := json.Unmarshal(data, conf2); err != nil {
+		t.Fatal(err)
+	}
+	if conf2.MinBloomFalsePositiveRate != conf.MinBloomFalsePositiveRate ||
+		conf2.MaxBloomFalsePositiveRate != conf.MaxBloomFalsePositiveRate ||
+		conf2.MaxBloomCapacity != conf.MaxBloomCapacity {
+		t.Fatalf("bloom bounds did not round-trip: %+v", conf2)
+	}
+
+	conf.Version = 1
+	if _, err := json.Marshal(conf); err == nil {
+		t.Fatal("expected error marshaling bloom bounds in a version 1 config")
+	}
+	conf.Version = DialingConfigVersion
+
+	conf.MinBloomFalsePositiveRate = 0.01
+	if err := conf.Validate(); err == nil {
+		t.Fatal("expected error for min rate above max rate")
+	}
+}
+
+func TestPayloadVersion(t *testing.T) {
+	key, _, _ := ed25519.GenerateKey(rand.Reader)
+	conf := &DialingConfig{
+		Version:        DialingConfigVersion,
+		Coordinator:    CoordinatorConfig{Key: key, Address: "localhost:8080"},
+		CDNServer:      CDNServerConfig{Key: key, Address: "localhost:8888"},
+		PayloadVersion: dialing.MaxPayloadVersion + 1,
+	}
+	// Versions newer than this build are allowed.
+	if err := conf.Validate(); err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := json.Marshal(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conf2 := new(DialingConfig)
+	if err := json.Unmarshal(data, conf2); err != nil {
+		t.Fatal(err)
+	}
+	if conf2.PayloadVersion != conf.PayloadVersion {
+		t.Fatalf("payload version did not round-trip: %d", conf2.PayloadVersion)
+	}
+
+	conf.Version = 1
+	if _, err := json.Marshal(conf); err == nil {
+		t.Fatal("expected error marshaling a payload version in a version 1 config")
+	}
+
+	conf.Version = DialingConfigVersion
+	conf.PayloadVersion = 256
+	if err := conf.Validate(); err == nil {
+		t.Fatal("expected error for a payload version that does not fit in a byte")
+	}
+}
+
 func TestMarshalDialingConfig(t *testing.T) {
 	guardianPub, guardianPriv, _ := ed25519.GenerateKey(rand.Reader)
 
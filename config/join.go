@@ -0,0 +1,154 @@
+// Copyright 2018 David Lazar. All rights reserved.
+// Use of this source code is governed by the GNU AGPL
+// license that can be found in the LICENSE file.
+
+package config
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"encoding/json"
+	"strings"
+	"time"
+
+	"github.com/davidlazar/go-crypto/encoding/base32"
+
+	"vuvuzela.io/alpenhorn/errors"
+	"vuvuzela.io/alpenhorn/internal/keysafe"
+	"vuvuzela.io/vuvuzela/mixnet"
+)
+
+const MixerJoinRequestVersion = 1
+
+// A MixerJoinRequest asks the guardians to add a new mix server to the
+// next config. The request is signed by the mixer's key, which proves
+// that the operator who sent it controls that key.
+type MixerJoinRequest struct {
+	Version  int
+	Services []string
+	Key      ed25519.PublicKey
+	Address  string
+	Created  time.Time
+
+	Signature []byte
+}
+
+// NewMixerJoinRequest returns a signed join request for the mixer with
+// the given key and address.
+func NewMixerJoinRequest(key ed25519.PrivateKey, address string, services []string) *MixerJoinRequest {
+	r := &MixerJoinRequest{
+		Version:  MixerJoinRequestVersion,
+		Services: services,
+		Key:      key.Public().(ed25519.PublicKey),
+		Address:  address,
+		Created:  time.Now().UTC().Truncate(time.Second),
+	}
+	r.Signature = ed25519.Sign(key, r.signingMessage())
+	return r
+}
+
+func (r *MixerJoinRequest) signingMessage() []byte {
+	buf := new(bytes.Buffer)
+	buf.WriteString("MixerJoinRequest")
+
+	clone := *r
+	clone.Signature = nil
+	if err := json.NewEncoder(buf).Encode(clone); err != nil {
+		panic(err)
+	}
+	return buf.Bytes()
+}
+
+// Verify checks that the request is well-formed and signed by the
+// mixer's key.
+func (r *MixerJoinRequest) Verify() error {
+	if r.Version != MixerJoinRequestVersion {
+		return errors.New("unknown join request version: %d", r.Version)
+	}
+	if len(r.Key) != ed25519.PublicKeySize {
+		return errors.New("invalid mixer key: %v", r.Key)
+	}
+	if r.Address == "" {
+		return errors.New("empty mixer address")
+	}
+	if err := CheckAddress(r.Address); err != nil {
+		return errors.Wrap(err, "mixer")
+	}
+	if len(r.Services) == 0 {
+		return errors.New("no services in join request")
+	}
+	if !ed25519.Verify(r.Key, r.signingMessage(), r.Signature) {
+		return errors.New("invalid join request signature")
+	}
+	return nil
+}
+
+// Encode returns the request as a string that is easy to copy and paste.
+func (r *MixerJoinRequest) Encode() string {
+	data, err := json.Marshal(r)
+	if err != nil {
+		panic(err)
+	}
+	return base32.EncodeToString(data)
+}
+
+// DecodeMixerJoinRequest decodes and verifies a request produced
+// by Encode.
+func DecodeMixerJoinRequest(s string) (*MixerJoinRequest, error) {
+	data, err := base32.DecodeString(strings.TrimSpace(s))
+	if err != nil {
+		return nil, errors.Wrap(err, "decoding join request")
+	}
+	r := new(MixerJoinRequest)
+	if err := json.Unmarshal(data, r); err != nil {
+		return nil, errors.Wrap(err, "unmarshaling join request")
+	}
+	if err := r.Verify(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// AddMixer adds the mixer from a verified join request to the config's
+// mix chain at the given position. A negative position appends the
+// mixer to the end of the chain.
+func (c *SignedConfig) AddMixer(r *MixerJoinRequest, position int) error {
+	found := false
+	for _, s := range r.Services {
+		if s == c.Service {
+			found = true
+		}
+	}
+	if !found {
+		return errors.New("join request is for %v, not %q", r.Services, c.Service)
+	}
+
+	var mixers *[]mixnet.PublicServerConfig
+	switch inner := c.Inner.(type) {
+	case *AddFriendConfig:
+		mixers = &inner.MixServers
+	case *DialingConfig:
+		mixers = &inner.MixServers
+	default:
+		return errors.New("service %q does not have a mix chain", c.Service)
+	}
+
+	for i, mix := range *mixers {
+		if keysafe.Equal(mix.Key, r.Key) {
+			return errors.New("mixer is already in the chain at position %d", i)
+		}
+	}
+	if position < 0 || position > len(*mixers) {
+		position = len(*mixers)
+	}
+
+	mix := mixnet.PublicServerConfig{
+		Key:     r.Key,
+		Address: r.Address,
+	}
+	chain := append([]mixnet.PublicServerConfig(nil), (*mixers)[:position]...)
+	chain = append(chain, mix)
+	chain = append(chain, (*mixers)[position:]...)
+	*mixers = chain
+	return nil
+}
@@ -0,0 +1,62 @@
+// Copyright 2018 David Lazar. All rights reserved.
+// Use of this source code is governed by the GNU AGPL
+// license that can be found in the LICENSE file.
+
+package config
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"testing"
+
+	"vuvuzela.io/crypto/rand"
+	"vuvuzela.io/vuvuzela/mixnet"
+)
+
+func TestMixerJoinRequest(t *testing.T) {
+	_, mixPriv, _ := ed25519.GenerateKey(rand.Reader)
+	req := NewMixerJoinRequest(mixPriv, "localhost:28000", []string{"AddFriend"})
+
+	decoded, err := DecodeMixerJoinRequest(req.Encode())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(decoded.Key, req.Key) || decoded.Address != req.Address {
+		t.Fatalf("decoded request does not match: got %#v, want %#v", decoded, req)
+	}
+
+	decoded.Address = "evil:28000"
+	if err := decoded.Verify(); err == nil {
+		t.Fatal("expected error for tampered request")
+	}
+
+	existingPub, _, _ := ed25519.GenerateKey(rand.Reader)
+	conf := &SignedConfig{
+		Version: SignedConfigVersion,
+		Service: "AddFriend",
+		Inner: &AddFriendConfig{
+			Version: AddFriendConfigVersion,
+			MixServers: []mixnet.PublicServerConfig{
+				{Key: existingPub, Address: "localhost:28001"},
+			},
+		},
+	}
+
+	if err := conf.AddMixer(req, 0); err != nil {
+		t.Fatal(err)
+	}
+	mixers := conf.Inner.(*AddFriendConfig).MixServers
+	if len(mixers) != 2 || !bytes.Equal(mixers[0].Key, req.Key) || mixers[0].Address != req.Address {
+		t.Fatalf("mixer not added at position 0: %#v", mixers)
+	}
+
+	if err := conf.AddMixer(req, -1); err == nil {
+		t.Fatal("expected error when adding the same mixer twice")
+	}
+
+	conf.Service = "Dialing"
+	conf.Inner = &DialingConfig{Version: DialingConfigVersion}
+	if err := conf.AddMixer(req, -1); err == nil {
+		t.Fatal("expected error when adding mixer to a service it did not request")
+	}
+}
@@ -10,6 +10,8 @@ import (
 	"net/http"
 	"strings"
 	"sync"
+
+	"vuvuzela.io/alpenhorn/internal/version"
 )
 
 type Server struct {
@@ -29,6 +31,8 @@ func (srv *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		srv.getCurrentHandler(w, r)
 	} else if strings.HasPrefix(r.URL.Path, "/new") {
 		srv.newConfigHandler(w, r)
+	} else if r.URL.Path == "/version" {
+		version.ServeHTTP(w, r)
 	} else if r.URL.Path == "/" {
 		w.Write([]byte("Alpenhorn config server."))
 	} else {
@@ -0,0 +1,305 @@
+// Copyright 2018 David Lazar. All rights reserved.
+// Use of this source code is governed by the GNU AGPL
+// license that can be found in the LICENSE file.
+
+package coordinator
+
+import (
+	"context"
+	"crypto/ed25519"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"io/ioutil"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/davidlazar/go-crypto/encoding/base32"
+
+	"vuvuzela.io/alpenhorn/cdn"
+	"vuvuzela.io/alpenhorn/config"
+	"vuvuzela.io/alpenhorn/edhttp"
+	"vuvuzela.io/alpenhorn/errors"
+	"vuvuzela.io/alpenhorn/internal/happyeyeballs"
+	"vuvuzela.io/alpenhorn/internal/keysafe"
+	"vuvuzela.io/alpenhorn/pkg"
+	"vuvuzela.io/vuvuzela/mixnet"
+)
+
+// probeTimeout bounds how long the dashboard waits on a single server.
+const probeTimeout = 3 * time.Second
+
+// Dashboard is an operator web UI that shows round progress, server
+// reachability, CDN storage, and config status for the coordinator's
+// services. Requests must carry the password using HTTP basic auth.
+//
+// The dashboard is plain HTTP, so it should listen on a loopback or
+// otherwise private address.
+type Dashboard struct {
+	Servers      []*Server
+	ConfigClient *config.Client
+	Password     string
+
+	// PrivateKey is the coordinator's key, used to query the CDN.
+	PrivateKey ed25519.PrivateKey
+
+	once   sync.Once
+	client *edhttp.Client
+}
+
+// DashboardStatus is the data shown on the dashboard.
+type DashboardStatus struct {
+	Time     time.Time
+	Services []ServiceStatus
+}
+
+type ServiceStatus struct {
+	ServerStatus
+
+	Config   ConfigStatus
+	Mixers   []Probe
+	PKGs     []Probe
+	CDN      Probe
+	CDNStats *cdn.Stats `json:",omitempty"`
+}
+
+type ConfigStatus struct {
+	Hash      string
+	Created   time.Time
+	Expires   time.Time
+	Guardians int
+	Err       string `json:",omitempty"`
+}
+
+// Probe is the result of contacting a server.
+type Probe struct {
+	Address string
+	Key     string
+	Latency time.Duration
+	Err     string `json:",omitempty"`
+}
+
+func (d *Dashboard) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	_, password, ok := r.BasicAuth()
+	if !ok || d.Password == "" || !keysafe.EqualString(password, d.Password) {
+		w.Header().Set("WWW-Authenticate", `Basic realm="alpenhorn"`)
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	switch r.URL.Path {
+	case "/", "":
+		st := d.Status()
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		if err := dashboardTemplate.Execute(w, st); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+	case "/status.json":
+		st := d.Status()
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(st)
+	default:
+		http.Error(w, "not found", http.StatusNotFound)
+	}
+}
+
+// Status collects the dashboard status, probing the servers listed in
+// each service's current config.
+func (d *Dashboard) Status() *DashboardStatus {
+	d.once.Do(func() {
+		d.client = &edhttp.Client{
+			Key: d.PrivateKey,
+		}
+	})
+
+	st := &DashboardStatus{
+		Time:     time.Now(),
+		Services: make([]ServiceStatus, len(d.Servers)),
+	}
+	var wg sync.WaitGroup
+	for i, srv := range d.Servers {
+		wg.Add(1)
+		go func(i int, srv *Server) {
+			defer wg.Done()
+			st.Services[i] = d.serviceStatus(srv)
+		}(i, srv)
+	}
+	wg.Wait()
+	return st
+}
+
+func (d *Dashboard) serviceStatus(srv *Server) ServiceStatus {
+	st := ServiceStatus{
+		ServerStatus: srv.Status(),
+	}
+
+	conf, err := d.ConfigClient.CurrentConfig(srv.Service)
+	if err != nil {
+		st.Config.Err = err.Error()
+		return st
+	}
+	st.Config = ConfigStatus{
+		Hash:      conf.Hash(),
+		Created:   conf.Created,
+		Expires:   conf.Expires,
+		Guardians: len(conf.Guardians),
+	}
+
+	var mixers []mixnet.PublicServerConfig
+	var cdnServer config.CDNServerConfig
+	var pkgServers []pkg.PublicServerConfig
+	switch inner := conf.Inner.(type) {
+	case *config.AddFriendConfig:
+		mixers = inner.MixServers
+		cdnServer = inner.CDNServer
+		pkgServers = inner.PKGServers
+	case *config.DialingConfig:
+		mixers = inner.MixServers
+		cdnServer = inner.CDNServer
+	}
+
+	st.Mixers = make([]Probe, len(mixers))
+	st.PKGs = make([]Probe, len(pkgServers))
+
+	var wg sync.WaitGroup
+	for i, mix := range mixers {
+		wg.Add(1)
+		go func(i int, mix mixnet.PublicServerConfig) {
+			defer wg.Done()
+			st.Mixers[i] = probeTCP(mix.Address, mix.Key)
+		}(i, mix)
+	}
+	for i, pkgServer := range pkgServers {
+		wg.Add(1)
+		go func(i int, key ed25519.PublicKey, addr string) {
+			defer wg.Done()
+			url := fmt.Sprintf("https://%s/version", addr)
+			st.PKGs[i] = d.probeHTTP(addr, key, url, nil)
+		}(i, pkgServer.Key, pkgServer.Address)
+	}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		stats := new(cdn.Stats)
+		url := fmt.Sprintf("https://%s/stats", cdnServer.Address)
+		st.CDN = d.probeHTTP(cdnServer.Address, cdnServer.Key, url, stats)
+		if st.CDN.Err == "" {
+			st.CDNStats = stats
+		}
+	}()
+	wg.Wait()
+
+	return st
+}
+
+// probeTCP measures how long it takes to connect to a server that
+// does not speak HTTP, such as a mixer.
+func probeTCP(addr string, key ed25519.PublicKey) Probe {
+	p := Probe{
+		Address: addr,
+		Key:     base32.EncodeToString(key),
+	}
+	start := time.Now()
+	dialer := &happyeyeballs.Dialer{Timeout: probeTimeout}
+	conn, err := dialer.DialContext(context.Background(), "tcp", addr)
+	p.Latency = time.Now().Sub(start)
+	if err != nil {
+		p.Err = err.Error()
+		return p
+	}
+	conn.Close()
+	return p
+}
+
+// probeHTTP fetches url from an edhttp server and decodes the JSON
+// response into v if v is not nil.
+func (d *Dashboard) probeHTTP(addr string, key ed25519.PublicKey, url string, v interface{}) Probe {
+	p := Probe{
+		Address: addr,
+		Key:     base32.EncodeToString(key),
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), probeTimeout)
+	defer cancel()
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		p.Err = err.Error()
+		return p
+	}
+
+	start := time.Now()
+	resp, err := d.client.Do(key, req.WithContext(ctx))
+	if err == nil {
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			msg, _ := ioutil.ReadAll(resp.Body)
+			err = errors.New("%s: %q", resp.Status, msg)
+		} else if v != nil {
+			err = json.NewDecoder(resp.Body).Decode(v)
+		}
+	}
+	p.Latency = time.Now().Sub(start)
+	if err != nil {
+		p.Err = err.Error()
+	}
+	return p
+}
+
+var dashboardTemplate = template.Must(template.New("dashboard").Funcs(template.FuncMap{
+	"ms": func(d time.Duration) string {
+		return d.Round(time.Millisecond).String()
+	},
+	"until": func(t time.Time) string {
+		return time.Until(t).Round(time.Minute).String()
+	},
+}).Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<meta http-equiv="refresh" content="5">
+<title>Alpenhorn coordinator</title>
+<style>
+body { font-family: sans-serif; margin: 2em; }
+table { border-collapse: collapse; margin-bottom: 1.5em; }
+th, td { border: 1px solid #ccc; padding: 0.3em 0.8em; text-align: left; }
+.err { color: #b00; }
+.ok { color: #070; }
+</style>
+</head>
+<body>
+<h1>Alpenhorn coordinator</h1>
+<p>Updated {{.Time.Format "2006-01-02 15:04:05 MST"}}</p>
+{{range .Services}}
+<h2>{{.Service}}</h2>
+<p>Round {{.Round}}: {{.PendingOnions}} onions received so far.</p>
+
+<h3>Config</h3>
+{{if .Config.Err}}<p class="err">{{.Config.Err}}</p>{{else}}
+<table>
+<tr><th>Hash</th><td>{{.Config.Hash}}</td></tr>
+<tr><th>Created</th><td>{{.Config.Created}}</td></tr>
+<tr><th>Expires</th><td>{{.Config.Expires}} (in {{until .Config.Expires}})</td></tr>
+<tr><th>Guardians</th><td>{{.Config.Guardians}}</td></tr>
+</table>
+{{end}}
+
+<h3>Servers</h3>
+<table>
+<tr><th>Role</th><th>Address</th><th>Key</th><th>Latency</th><th>Status</th></tr>
+{{range $i, $p := .Mixers}}<tr><td>mixer {{$i}}</td><td>{{$p.Address}}</td><td>{{$p.Key}}</td><td>{{ms $p.Latency}}</td><td>{{if $p.Err}}<span class="err">{{$p.Err}}</span>{{else}}<span class="ok">ok</span>{{end}}</td></tr>
+{{end}}{{range $i, $p := .PKGs}}<tr><td>pkg {{$i}}</td><td>{{$p.Address}}</td><td>{{$p.Key}}</td><td>{{ms $p.Latency}}</td><td>{{if $p.Err}}<span class="err">{{$p.Err}}</span>{{else}}<span class="ok">ok</span>{{end}}</td></tr>
+{{end}}{{with .CDN}}<tr><td>cdn</td><td>{{.Address}}</td><td>{{.Key}}</td><td>{{ms .Latency}}</td><td>{{if .Err}}<span class="err">{{.Err}}</span>{{else}}<span class="ok">ok</span>{{end}}</td></tr>{{end}}
+</table>
+{{with .CDNStats}}<p>CDN storage: {{.Buckets}} buckets, {{.Keys}} mailboxes, {{.SizeBytes}} bytes.</p>{{end}}
+
+<h3>Recent rounds</h3>
+<table>
+<tr><th>Round</th><th>Stage</th><th>Duration</th><th>Status</th></tr>
+{{range .Rounds}}{{$round := .Round}}{{range .Stages}}<tr><td>{{$round}}</td><td>{{.Name}}</td><td>{{ms .Duration}}</td><td>{{if .Err}}<span class="err">{{.Err}}</span>{{end}}</td></tr>
+{{end}}{{end}}
+</table>
+{{end}}
+</body>
+</html>
+`))
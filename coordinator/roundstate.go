@@ -0,0 +1,239 @@
+// Copyright 2018 David Lazar. All rights reserved.
+// Use of this source code is governed by the GNU AGPL
+// license that can be found in the LICENSE file.
+
+package coordinator
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"time"
+
+	"vuvuzela.io/alpenhorn/errors"
+	"vuvuzela.io/alpenhorn/log"
+)
+
+// A RoundPhase is a stage in the life of a round. Rounds move forward
+// through the phases in order and may be closed from any phase:
+//
+//	Created → Collecting → Mixing → Published → Closed
+type RoundPhase int
+
+const (
+	// RoundCreated rounds have been announced and are waiting for
+	// PKG and mixnet settings.
+	RoundCreated RoundPhase = iota + 1
+
+	// RoundCollecting rounds accept onions from clients.
+	RoundCollecting
+
+	// RoundMixing rounds have handed their onions to the mixnet.
+	RoundMixing
+
+	// RoundPublished rounds have announced their mailbox URL.
+	RoundPublished
+
+	// RoundClosed rounds are finished, successfully or not.
+	RoundClosed
+)
+
+var phaseNames = map[RoundPhase]string{
+	RoundCreated:    "created",
+	RoundCollecting: "collecting",
+	RoundMixing:     "mixing",
+	RoundPublished:  "published",
+	RoundClosed:     "closed",
+}
+
+func (p RoundPhase) String() string {
+	if name, ok := phaseNames[p]; ok {
+		return name
+	}
+	return "invalid"
+}
+
+func (p RoundPhase) MarshalText() ([]byte, error) {
+	return []byte(p.String()), nil
+}
+
+// canTransition reports whether a round may move from p to next.
+func (p RoundPhase) canTransition(next RoundPhase) bool {
+	if p == RoundClosed {
+		return false
+	}
+	return next == p+1 || next == RoundClosed
+}
+
+// DefaultMixTimeout bounds how long a round may stay in the mixing
+// phase when Server.MixTimeout is zero.
+const DefaultMixTimeout = 30 * time.Minute
+
+// RoundState is the coordinator's view of a round.
+type RoundState struct {
+	Round uint32
+	Phase RoundPhase
+
+	// Started is when the round was created.
+	Started time.Time
+
+	// Since is when the round entered its current phase.
+	Since time.Time
+
+	// Deadline is when the round must leave its current phase. A
+	// round past its deadline is stuck and gets closed.
+	Deadline time.Time `json:",omitempty"`
+
+	// Err is why the round was closed, if it failed.
+	Err string `json:",omitempty"`
+}
+
+// startRoundLocked creates the state for a new round, closing any
+// earlier round that never reached the mixnet. It assumes srv.mu is
+// locked.
+func (srv *Server) startRoundLocked(round uint32) {
+	if srv.rounds == nil {
+		srv.rounds = make(map[uint32]*RoundState)
+	}
+	for r, st := range srv.rounds {
+		if r >= round {
+			srv.violationLocked(r, "round %d exists before round %d started", r, round)
+			continue
+		}
+		switch st.Phase {
+		case RoundCreated, RoundCollecting:
+			srv.violationLocked(r, "round still %s when round %d started", st.Phase, round)
+		case RoundPublished:
+			// A round's mailbox is current until the next round.
+			srv.setPhaseLocked(r, RoundClosed, time.Time{})
+		}
+	}
+	now := srv.clock().Now()
+	srv.rounds[round] = &RoundState{
+		Round:   round,
+		Phase:   RoundCreated,
+		Started: now,
+		Since:   now,
+	}
+	delete(srv.rounds, round-maxTraces)
+}
+
+// setPhase moves the round to the next phase, reporting whether the
+// transition was valid. Invalid transitions are invariant violations:
+// they are logged and the round is closed, so callers must stop
+// working on the round when setPhase returns false.
+func (srv *Server) setPhase(round uint32, next RoundPhase, deadline time.Time) bool {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	return srv.setPhaseLocked(round, next, deadline)
+}
+
+func (srv *Server) setPhaseLocked(round uint32, next RoundPhase, deadline time.Time) bool {
+	st, ok := srv.rounds[round]
+	if !ok {
+		srv.Log.WithFields(log.Fields{"round": round}).Errorf("Invariant violation: no state for round moving to %s", next)
+		return false
+	}
+	if !st.Phase.canTransition(next) {
+		srv.violationLocked(round, "invalid transition from %s to %s", st.Phase, next)
+		return false
+	}
+	prev := st.Phase
+	st.Phase = next
+	st.Since = srv.clock().Now()
+	st.Deadline = deadline
+	if next == RoundPublished {
+		srv.observeRoundLocked(st.Since.Sub(st.Started), true)
+	} else if next == RoundClosed && prev != RoundPublished {
+		srv.observeRoundLocked(0, false)
+	}
+	if next == RoundCollecting {
+		srv.collecting = round
+	} else if srv.collecting == round {
+		srv.collecting = 0
+	}
+	return true
+}
+
+// closeRound closes the round, recording err if it failed.
+func (srv *Server) closeRound(round uint32, err error) {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	st, ok := srv.rounds[round]
+	if !ok || st.Phase == RoundClosed {
+		return
+	}
+	if err != nil {
+		st.Err = err.Error()
+	}
+	srv.setPhaseLocked(round, RoundClosed, time.Time{})
+	srv.endRoundSpanLocked(round, err)
+}
+
+func (srv *Server) violationLocked(round uint32, format string, args ...interface{}) {
+	srv.Log.WithFields(log.Fields{"round": round}).Errorf("Invariant violation: "+format, args...)
+	st, ok := srv.rounds[round]
+	if !ok || st.Phase == RoundClosed {
+		return
+	}
+	if st.Err == "" {
+		st.Err = "invariant violation"
+	}
+	srv.endRoundSpanLocked(round, errors.New("%s", st.Err))
+	if st.Phase != RoundPublished {
+		srv.observeRoundLocked(0, false)
+	}
+	st.Phase = RoundClosed
+	st.Since = srv.clock().Now()
+	st.Deadline = time.Time{}
+	if srv.collecting == round {
+		srv.collecting = 0
+		srv.onions = srv.onions[:0]
+	}
+}
+
+// expireRounds closes rounds that are past their deadline and tells
+// clients they failed.
+func (srv *Server) expireRounds(now time.Time) {
+	srv.mu.Lock()
+	var expired []uint32
+	for r, st := range srv.rounds {
+		if st.Phase != RoundClosed && !st.Deadline.IsZero() && now.After(st.Deadline) {
+			srv.Log.WithFields(log.Fields{"round": r}).Errorf("Round stuck %s since %s; closing", st.Phase, st.Since.Format(time.RFC3339))
+			st.Err = "stuck " + st.Phase.String()
+			srv.setPhaseLocked(r, RoundClosed, time.Time{})
+			expired = append(expired, r)
+		}
+	}
+	srv.mu.Unlock()
+
+	for _, r := range expired {
+		srv.hub.Broadcast("error", RoundError{Round: r, Err: "round timed out"})
+	}
+}
+
+// RoundStates returns the state of the recent rounds, newest first.
+func (srv *Server) RoundStates() []RoundState {
+	srv.mu.Lock()
+	states := make([]RoundState, 0, len(srv.rounds))
+	for _, st := range srv.rounds {
+		states = append(states, *st)
+	}
+	srv.mu.Unlock()
+
+	sort.Slice(states, func(i, j int) bool {
+		return states[i].Round > states[j].Round
+	})
+	return states
+}
+
+// roundsHandler is a debug endpoint that dumps the round states.
+func (srv *Server) roundsHandler(w http.ResponseWriter, r *http.Request) {
+	data, err := json.MarshalIndent(srv.RoundStates(), "", "  ")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(data)
+}
@@ -15,13 +15,18 @@ import (
 	"time"
 
 	"github.com/davidlazar/go-crypto/encoding/base32"
+	oteltrace "go.opentelemetry.io/otel/trace"
 	"golang.org/x/net/context"
 
 	"vuvuzela.io/alpenhorn/addfriend"
+	"vuvuzela.io/alpenhorn/clock"
 	"vuvuzela.io/alpenhorn/config"
 	"vuvuzela.io/alpenhorn/dialing"
 	"vuvuzela.io/alpenhorn/edhttp"
 	"vuvuzela.io/alpenhorn/errors"
+	"vuvuzela.io/alpenhorn/internal/rng"
+	"vuvuzela.io/alpenhorn/internal/tracing"
+	buildversion "vuvuzela.io/alpenhorn/internal/version"
 	"vuvuzela.io/alpenhorn/log"
 	"vuvuzela.io/alpenhorn/pkg"
 	"vuvuzela.io/alpenhorn/typesocket"
@@ -46,6 +51,45 @@ type Server struct {
 
 	PersistPath string
 
+	// Clock drives the round timers and deadlines. The real clock is
+	// used if Clock is nil.
+	Clock clock.Clock
+
+	// PKGTransport, if not nil, carries the requests to the PKGs in
+	// place of edTLS connections; see edhttp.Client.
+	PKGTransport edhttp.Transport
+
+	// MixTimeout bounds how long the mixnet may take to run a round
+	// before the round is closed as stuck. Zero means DefaultMixTimeout.
+	MixTimeout time.Duration
+
+	// BloomFalsePositiveRate and BloomCapacity set the mailbox Bloom
+	// filter parameters of dialing rounds. They must be within the
+	// bounds in the dialing config. A zero rate means
+	// dialing.DefaultBloomFalsePositiveRate.
+	BloomFalsePositiveRate float64
+	BloomCapacity          int
+
+	// MailboxChunkSize is the largest dialing mailbox object the
+	// mixer may store on the CDN; larger mailboxes are split into
+	// continuation objects. Zero means dialing.DefaultMailboxChunkSize.
+	MailboxChunkSize int
+
+	// TraceOnions enables the round tracing debug mode: each round
+	// carries a marked onion for the trace identity, and the round's
+	// stage timings are served at /trace.
+	TraceOnions bool
+
+	// SLOs are round-latency objectives, measured over the last
+	// SLOWindow rounds (zero means DefaultSLOWindow). When an SLO is
+	// breached or recovers, the server logs the change, calls
+	// OnSLOAlert in its own goroutine if it is set, and posts the
+	// SLOAlert as JSON to SLOWebhook if it is set.
+	SLOs       []SLO
+	SLOWindow  int
+	SLOWebhook string
+	OnSLOAlert func(SLOAlert)
+
 	mu             sync.Mutex
 	round          uint32
 	onions         [][]byte
@@ -53,6 +97,10 @@ type Server struct {
 	shutdown       chan struct{}
 	latestMixRound *MixRound
 	latestPKGRound *PKGRound
+	traces         map[uint32]*RoundTrace
+	rounds         map[uint32]*RoundState
+	collecting     uint32 // the round accepting onions, or 0
+	slo            sloTracker
 
 	hub *typesocket.Hub
 
@@ -73,17 +121,25 @@ func (srv *Server) Run() error {
 	if srv.PersistPath == "" {
 		return errors.New("no persist path specified")
 	}
+	for _, slo := range srv.SLOs {
+		if err := slo.Validate(); err != nil {
+			return err
+		}
+	}
 
 	mux := typesocket.NewMux(map[string]interface{}{
 		"onion": srv.incomingOnion,
 	})
 	srv.hub = &typesocket.Hub{
-		Mux: mux,
+		Mux:    mux,
+		Logger: srv.Log,
 	}
 
 	if srv.Service == "AddFriend" {
 		srv.pkgClient = &pkg.CoordinatorClient{
 			CoordinatorKey: srv.PrivateKey,
+			Clock:          srv.Clock,
+			Transport:      srv.PKGTransport,
 		}
 	}
 
@@ -121,9 +177,16 @@ func (srv *Server) Close() error {
 }
 
 func (srv *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	buildversion.Coordinator.SetHeader(w.Header())
 	switch {
 	case strings.HasPrefix(r.URL.Path, "/ws"):
 		srv.hub.ServeHTTP(w, r)
+	case r.URL.Path == "/trace":
+		srv.traceHandler(w, r)
+	case r.URL.Path == "/rounds":
+		srv.roundsHandler(w, r)
+	case r.URL.Path == "/version":
+		buildversion.ServeHTTP(w, r)
 	default:
 		http.Error(w, "not found", http.StatusNotFound)
 	}
@@ -137,6 +200,14 @@ type OnionMsg struct {
 type NewRound struct {
 	Round      uint32
 	ConfigHash string
+
+	// ServerVersion is the coordinator's build version.
+	ServerVersion string
+
+	// ProtocolVersion and MinProtocolVersion are the coordinator
+	// protocol versions the coordinator speaks. Zero means version 1.
+	ProtocolVersion    int
+	MinProtocolVersion int
 }
 
 type PKGRound struct {
@@ -183,12 +254,12 @@ func (srv *Server) onConnect(c typesocket.Conn) error {
 
 func (srv *Server) incomingOnion(c typesocket.Conn, o OnionMsg) {
 	srv.mu.Lock()
-	round := srv.round
-	if o.Round == round {
+	round := srv.collecting
+	if o.Round == round && round != 0 {
 		srv.onions = append(srv.onions, o.Onion)
 	}
 	srv.mu.Unlock()
-	if o.Round != round {
+	if o.Round != round || round == 0 {
 		log.Errorf("got onion for wrong round (want %d, got %d)", round, o.Round)
 		c.Send("error", RoundError{
 			Round: o.Round,
@@ -204,11 +275,18 @@ func (srv *Server) prepCDN(cdnServer config.CDNServerConfig, lastMixer mixnet.Pu
 		round,
 		base32.EncodeToString(lastMixer.Key),
 	)
-	resp, err := srv.cdnClient.Post(cdnServer.Key, url, "", nil)
+	req, err := buildversion.CDN.NewRequest("POST", url, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := srv.cdnClient.Do(cdnServer.Key, req)
 	if err != nil {
 		return errors.Wrap(err, "POST error")
 	}
 	defer resp.Body.Close()
+	if err := buildversion.CDN.CheckHeader("cdn server", resp.Header); err != nil {
+		return err
+	}
 	if resp.StatusCode != http.StatusOK {
 		msg, _ := ioutil.ReadAll(resp.Body)
 		return errors.New("unsuccessful status code: %s: %q", resp.Status, msg)
@@ -217,7 +295,22 @@ func (srv *Server) prepCDN(cdnServer config.CDNServerConfig, lastMixer mixnet.Pu
 }
 
 func (srv *Server) loop() {
+	mixTimeout := srv.MixTimeout
+	if mixTimeout == 0 {
+		mixTimeout = DefaultMixTimeout
+	}
+
 	for {
+		srv.expireRounds(srv.clock().Now())
+
+		if err := rng.Err(); err != nil {
+			srv.Log.Errorf("not starting round: %s", err)
+			if !srv.sleep(10 * time.Second) {
+				break
+			}
+			continue
+		}
+
 		currentConfig, err := srv.ConfigClient.CurrentConfig(srv.Service)
 		if err != nil {
 			log.Errorf("failed to fetch current config: %s", err)
@@ -228,64 +321,131 @@ func (srv *Server) loop() {
 		}
 		configHash := currentConfig.Hash()
 
+		// The round's span context goes in the service data, so
+		// mixers and clients can add their spans to the round.
+		roundCtx, roundSpan := tracing.Start(context.Background(), "coordinator.round",
+			oteltrace.WithAttributes(tracing.Service(srv.Service), tracing.ConfigHash(configHash)))
+		traceParent := tracing.TraceParent(roundCtx)
+
 		var rawServiceData []byte
 		var mixServers []mixnet.PublicServerConfig
 		var cdnServer config.CDNServerConfig
+		var mirrors []config.CDNServerConfig
 		var pkgServers []pkg.PublicServerConfig
+		var curves []string
+		var pkgThreshold int
+		var introVersion int
+		var mailboxChunkSize int
+		var payloadVersion int
+		var settingsErr error
 		switch srv.Service {
 		case "AddFriend":
 			conf := currentConfig.Inner.(*config.AddFriendConfig)
 			mixServers = conf.MixServers
 			cdnServer = conf.CDNServer
 			pkgServers = conf.PKGServers
+			curves = conf.Curves
+			pkgThreshold = conf.PKGThreshold
+			introVersion = conf.IntroVersion
+			payloadVersion = conf.PayloadVersion
 			rawServiceData = addfriend.ServiceData{
 				CDNKey:       cdnServer.Key,
 				CDNAddress:   cdnServer.Address,
 				NumMailboxes: srv.NumMailboxes,
+				IntroVersion: conf.IntroVersion,
+
+				PayloadVersion: conf.PayloadVersion,
+
+				MixnetProtocol:    buildversion.Mixnet.Version,
+				MinMixnetProtocol: buildversion.Mixnet.MinVersion,
+
+				TraceParent: traceParent,
 			}.Marshal()
 		case "Dialing":
 			conf := currentConfig.Inner.(*config.DialingConfig)
 			mixServers = conf.MixServers
 			cdnServer = conf.CDNServer
-			rawServiceData = dialing.ServiceData{
+			mirrors = conf.PIRMirrors
+			serviceData := dialing.ServiceData{
 				CDNKey:       cdnServer.Key,
 				CDNAddress:   cdnServer.Address,
 				NumMailboxes: srv.NumMailboxes,
-			}.Marshal()
+
+				BloomFalsePositiveRate: srv.BloomFalsePositiveRate,
+				BloomCapacity:          srv.BloomCapacity,
+
+				MailboxChunkSize: srv.MailboxChunkSize,
+				PayloadVersion:   conf.PayloadVersion,
+
+				MixnetProtocol:    buildversion.Mixnet.Version,
+				MinMixnetProtocol: buildversion.Mixnet.MinVersion,
+
+				TraceParent: traceParent,
+			}
+			if serviceData.MailboxChunkSize == 0 {
+				serviceData.MailboxChunkSize = dialing.DefaultMailboxChunkSize
+			}
+			mailboxChunkSize = serviceData.MailboxChunkSize
+			payloadVersion = conf.PayloadVersion
+			settingsErr = conf.CheckBloomParams(serviceData.FalsePositiveRate(), serviceData.BloomCapacity)
+			for _, m := range mirrors {
+				serviceData.Mirrors = append(serviceData.Mirrors, dialing.Mirror{Key: m.Key, Address: m.Address})
+			}
+			rawServiceData = serviceData.Marshal()
 		default:
 			log.Panicf("invalid service type: %q", srv.Service)
 		}
+		if settingsErr != nil {
+			log.Errorf("not starting round: %s", settingsErr)
+			tracing.End(roundSpan, settingsErr)
+			if !srv.sleep(10 * time.Second) {
+				break
+			}
+			continue
+		}
 
 		srv.mu.Lock()
 		srv.round++
 		round := srv.round
+		srv.startRoundLocked(round)
+		roundSpan.SetAttributes(tracing.Round(round))
 
 		logger := srv.Log.WithFields(log.Fields{"round": round, "config": configHash})
 
 		if err := srv.persistLocked(); err != nil {
 			logger.Errorf("error persisting state: %s", err)
 			srv.mu.Unlock()
+			srv.closeRound(round, err)
+			tracing.End(roundSpan, err)
 			break
 		}
 		srv.mu.Unlock()
 
 		logger.Info("Starting new round")
+		trace := srv.newTrace(roundCtx, round, configHash, introVersion, payloadVersion, mailboxChunkSize)
 
 		srv.hub.Broadcast("newround", NewRound{
-			Round:      round,
-			ConfigHash: configHash,
+			Round:         round,
+			ConfigHash:    configHash,
+			ServerVersion: buildversion.Version,
+
+			ProtocolVersion:    buildversion.Coordinator.Version,
+			MinProtocolVersion: buildversion.Coordinator.MinVersion,
 		})
 
-		time.Sleep(500 * time.Millisecond)
+		clock.Sleep(srv.clock(), 500*time.Millisecond)
 
 		// TODO perhaps pkg.NewRound, mixnet.NewRound, hub.Broadcast, etc
 		// should take a Context for better cancelation.
 
 		if srv.Service == "AddFriend" {
 			logger.WithFields(log.Fields{"numPKG": len(pkgServers)}).Info("Requesting PKG keys")
-			pkgSettings, err := srv.pkgClient.NewRound(pkgServers, round)
+			start := srv.clock().Now()
+			pkgSettings, err := srv.pkgClient.NewRoundThreshold(pkgServers, round, curves, pkgThreshold)
+			srv.traceStage(trace, "pkg.NewRound", start, err)
 			if err != nil {
 				logger.WithFields(log.Fields{"call": "pkg.NewRound"}).Errorf("pkg.NewRound failed: %s", err)
+				srv.closeRound(round, err)
 				if !srv.sleep(10 * time.Second) {
 					break
 				}
@@ -302,14 +462,23 @@ func (srv *Server) loop() {
 
 			srv.hub.Broadcast("pkg", pkgRound)
 
+			start = srv.clock().Now()
 			if !srv.sleep(srv.PKGWait) {
+				srv.closeRound(round, ErrServerClosed)
 				break
 			}
+			srv.traceStage(trace, "pkg wait", start, nil)
 		}
 
+		start := srv.clock().Now()
 		err = srv.prepCDN(cdnServer, mixServers[len(mixServers)-1], srv.Service, round)
+		for i := 0; err == nil && i < len(mirrors); i++ {
+			err = srv.prepCDN(mirrors[i], mixServers[len(mixServers)-1], srv.Service, round)
+		}
+		srv.traceStage(trace, "cdn.NewBucket", start, err)
 		if err != nil {
 			logger.Errorf("error preparing CDN for round: %s", err)
+			srv.closeRound(round, err)
 			break
 		}
 
@@ -318,34 +487,53 @@ func (srv *Server) loop() {
 			Round:          round,
 			RawServiceData: rawServiceData,
 		}
+		start = srv.clock().Now()
 		mixSigs, err := srv.mixnetClient.NewRound(context.Background(), mixServers, &mixSettings)
+		srv.traceStage(trace, "mixnet.NewRound", start, err)
 		if err != nil {
 			logger.WithFields(log.Fields{"call": "mixnet.NewRound"}).Errorf("mixnet.NewRound failed: %s", err)
+			srv.closeRound(round, err)
 			if !srv.sleep(10 * time.Second) {
 				break
 			}
 			continue
 		}
 
-		roundEnd := time.Now().Add(srv.MixWait)
+		roundEnd := srv.clock().Now().Add(srv.MixWait)
 		mixRound := &MixRound{
 			MixSettings:   mixSettings,
 			MixSignatures: mixSigs,
 			EndTime:       roundEnd,
 		}
 		srv.mu.Lock()
+		if !srv.setPhaseLocked(round, RoundCollecting, time.Time{}) {
+			srv.mu.Unlock()
+			continue
+		}
 		srv.latestMixRound = mixRound
+		if trace.Marker != nil {
+			srv.onions = append(srv.onions, trace.traceOnion(&mixSettings))
+		}
 		srv.mu.Unlock()
 
 		logger.WithFields(log.Fields{"wait": srv.MixWait}).Info("Announcing mixnet settings")
 		srv.hub.Broadcast("mix", mixRound)
 
+		start = srv.clock().Now()
 		if !srv.sleep(srv.MixWait) {
+			srv.closeRound(round, ErrServerClosed)
 			break
 		}
+		srv.traceStage(trace, "collect onions", start, nil)
 
 		srv.mu.Lock()
-		go srv.runRound(context.Background(), mixServers[0], round, srv.onions)
+		if srv.setPhaseLocked(round, RoundMixing, srv.clock().Now().Add(mixTimeout)) {
+			ctx, cancel := context.WithTimeout(context.Background(), mixTimeout)
+			go func(onions [][]byte) {
+				defer cancel()
+				srv.runRound(ctx, mixServers[0], round, onions, trace)
+			}(srv.onions)
+		}
 		srv.onions = make([][]byte, 0, len(srv.onions))
 		srv.mu.Unlock()
 
@@ -358,40 +546,54 @@ func (srv *Server) loop() {
 }
 
 func (srv *Server) sleep(d time.Duration) bool {
-	timer := time.NewTimer(d)
+	timer := srv.clock().NewTimer(d)
 	select {
 	case <-srv.shutdown:
 		timer.Stop()
 		return false
-	case <-timer.C:
+	case <-timer.C():
 		return true
 	}
 }
 
-func (srv *Server) runRound(ctx context.Context, firstServer mixnet.PublicServerConfig, round uint32, onions [][]byte) {
+func (srv *Server) clock() clock.Clock {
+	return clock.Or(srv.Clock)
+}
+
+func (srv *Server) runRound(ctx context.Context, firstServer mixnet.PublicServerConfig, round uint32, onions [][]byte, trace *RoundTrace) {
 	srv.Log.WithFields(log.Fields{
 		"round":  round,
 		"onions": len(onions),
 	}).Info("Start mixing")
-	start := time.Now()
+	start := srv.clock().Now()
 
 	url, err := srv.mixnetClient.RunRoundUnidirectional(ctx, firstServer, srv.Service, round, onions)
+	srv.traceStage(trace, "mixnet.RunRound", start, err)
 	if err != nil {
 		srv.Log.WithFields(log.Fields{
 			"round": round,
 			"call":  "mixnet.RunRound",
 		}).Error(err)
+		srv.closeRound(round, err)
 		srv.hub.Broadcast("error", RoundError{Round: round, Err: "server error"})
 		return
 	}
 
-	end := time.Now()
+	end := srv.clock().Now()
 	srv.Log.WithFields(log.Fields{
 		"round":    round,
 		"onions":   len(onions),
 		"duration": end.Sub(start),
 	}).Info("End mixing")
 
+	srv.traceDone(trace, url)
+
+	// The round may have been closed as stuck while it was mixing,
+	// in which case clients were already told it failed.
+	if !srv.setPhase(round, RoundPublished, time.Time{}) {
+		return
+	}
+
 	srv.hub.Broadcast("mailbox", MailboxURL{
 		Round:        round,
 		URL:          url,
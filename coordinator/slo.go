@@ -0,0 +1,233 @@
+// Copyright 2018 David Lazar. All rights reserved.
+// Use of this source code is governed by the GNU AGPL
+// license that can be found in the LICENSE file.
+
+package coordinator
+
+import (
+	"bytes"
+	"encoding/json"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"vuvuzela.io/alpenhorn/errors"
+	"vuvuzela.io/alpenhorn/log"
+)
+
+// An SLO is a round-latency objective: the given percentile of recent
+// rounds must publish their mailboxes within Target of starting.
+// Rounds that fail count as slower than any target.
+type SLO struct {
+	Percentile float64 // in (0, 100]
+	Target     time.Duration
+}
+
+func (s SLO) Validate() error {
+	if !(s.Percentile > 0 && s.Percentile <= 100) {
+		return errors.New("SLO percentile %v not in (0, 100]", s.Percentile)
+	}
+	if s.Target <= 0 {
+		return errors.New("SLO target must be positive: %s", s.Target)
+	}
+	return nil
+}
+
+// ParseSLO parses an SLO written as "p<percentile>=<target>", such as
+// "p99=90s" or "p99.9=2m".
+func ParseSLO(str string) (SLO, error) {
+	i := strings.IndexByte(str, '=')
+	if !strings.HasPrefix(str, "p") || i < 0 {
+		return SLO{}, errors.New("invalid SLO %q: want p<percentile>=<target>", str)
+	}
+	p, err := strconv.ParseFloat(str[1:i], 64)
+	if err != nil {
+		return SLO{}, errors.New("invalid SLO percentile in %q", str)
+	}
+	target, err := time.ParseDuration(str[i+1:])
+	if err != nil {
+		return SLO{}, errors.New("invalid SLO target in %q: %s", str, err)
+	}
+	slo := SLO{Percentile: p, Target: target}
+	return slo, slo.Validate()
+}
+
+// ParseSLOs parses a list of SLOs with ParseSLO.
+func ParseSLOs(strs []string) ([]SLO, error) {
+	slos := make([]SLO, len(strs))
+	for i, str := range strs {
+		var err error
+		slos[i], err = ParseSLO(str)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return slos, nil
+}
+
+func (s SLO) String() string {
+	return "p" + strconv.FormatFloat(s.Percentile, 'f', -1, 64) + "=" + s.Target.String()
+}
+
+const (
+	// DefaultSLOWindow is the number of recent rounds that SLOs are
+	// measured over when Server.SLOWindow is zero.
+	DefaultSLOWindow = 100
+
+	// minSLORounds is how many rounds must finish before SLOs are
+	// checked, so a single slow round after startup does not alert.
+	minSLORounds = 10
+
+	// failedRound is the latency recorded for rounds that fail.
+	failedRound = time.Duration(math.MaxInt64)
+)
+
+// An SLOAlert reports that an SLO was breached or has recovered.
+type SLOAlert struct {
+	Service  string
+	SLO      SLO
+	Breached bool
+
+	// Observed is the latency at the SLO's percentile over the last
+	// Rounds rounds, or -1 if that rank falls on a failed round.
+	Observed time.Duration
+	Rounds   int
+	Failed   int
+
+	Time time.Time
+}
+
+// sloTracker keeps a window of recent round latencies and remembers
+// which SLOs are currently breached.
+type sloTracker struct {
+	latencies []time.Duration // ring buffer
+	next      int
+	full      bool
+	breached  map[int]bool
+}
+
+// observe records a round's latency and returns alerts for the SLOs
+// whose state changed.
+func (t *sloTracker) observe(slos []SLO, window int, d time.Duration) []SLOAlert {
+	if len(t.latencies) != window {
+		t.latencies = make([]time.Duration, window)
+		t.next = 0
+		t.full = false
+	}
+	t.latencies[t.next] = d
+	t.next = (t.next + 1) % window
+	if t.next == 0 {
+		t.full = true
+	}
+
+	n := t.next
+	if t.full {
+		n = window
+	}
+	if n < minSLORounds || len(slos) == 0 {
+		return nil
+	}
+	sorted := append([]time.Duration(nil), t.latencies[:n]...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	failed := n - sort.Search(n, func(i int) bool { return sorted[i] == failedRound })
+
+	if t.breached == nil {
+		t.breached = make(map[int]bool)
+	}
+	var alerts []SLOAlert
+	for i, slo := range slos {
+		observed := percentile(sorted, slo.Percentile)
+		breached := observed > slo.Target
+		if breached == t.breached[i] {
+			continue
+		}
+		t.breached[i] = breached
+		if observed == failedRound {
+			observed = -1
+		}
+		alerts = append(alerts, SLOAlert{
+			SLO:      slo,
+			Breached: breached,
+			Observed: observed,
+			Rounds:   n,
+			Failed:   failed,
+		})
+	}
+	return alerts
+}
+
+// percentile returns the nearest-rank p-th percentile of sorted.
+func percentile(sorted []time.Duration, p float64) time.Duration {
+	i := int(math.Ceil(p/100*float64(len(sorted)))) - 1
+	if i < 0 {
+		i = 0
+	}
+	if i >= len(sorted) {
+		i = len(sorted) - 1
+	}
+	return sorted[i]
+}
+
+// observeRoundLocked records the latency of a round that published
+// its mailbox, or a failed round if ok is false. It assumes srv.mu
+// is locked.
+func (srv *Server) observeRoundLocked(latency time.Duration, ok bool) {
+	if len(srv.SLOs) == 0 {
+		return
+	}
+	if !ok {
+		latency = failedRound
+	}
+	window := srv.SLOWindow
+	if window <= 0 {
+		window = DefaultSLOWindow
+	}
+	alerts := srv.slo.observe(srv.SLOs, window, latency)
+	for _, a := range alerts {
+		a.Service = srv.Service
+		a.Time = srv.clock().Now()
+		go srv.fireSLOAlert(a)
+	}
+}
+
+var sloWebhookClient = &http.Client{Timeout: 10 * time.Second}
+
+func (srv *Server) fireSLOAlert(a SLOAlert) {
+	fields := log.Fields{
+		"percentile": a.SLO.Percentile,
+		"target":     a.SLO.Target,
+		"observed":   a.Observed,
+		"rounds":     a.Rounds,
+		"failed":     a.Failed,
+	}
+	if a.Breached {
+		srv.Log.WithFields(fields).Warnf("Round latency SLO breached")
+	} else {
+		srv.Log.WithFields(fields).Infof("Round latency SLO recovered")
+	}
+
+	if srv.OnSLOAlert != nil {
+		srv.OnSLOAlert(a)
+	}
+
+	if srv.SLOWebhook == "" {
+		return
+	}
+	data, err := json.Marshal(a)
+	if err != nil {
+		srv.Log.Errorf("Marshaling SLO alert: %s", err)
+		return
+	}
+	resp, err := sloWebhookClient.Post(srv.SLOWebhook, "application/json", bytes.NewReader(data))
+	if err != nil {
+		srv.Log.Errorf("Posting SLO alert: %s", err)
+		return
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		srv.Log.Errorf("Posting SLO alert: webhook returned %s", resp.Status)
+	}
+}
@@ -0,0 +1,64 @@
+// Copyright 2018 David Lazar. All rights reserved.
+// Use of this source code is governed by the GNU AGPL
+// license that can be found in the LICENSE file.
+
+package coordinator
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseSLO(t *testing.T) {
+	slo, err := ParseSLO("p99.9=90s")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if slo.Percentile != 99.9 || slo.Target != 90*time.Second {
+		t.Fatalf("got %+v", slo)
+	}
+	if s := slo.String(); s != "p99.9=1m30s" {
+		t.Fatalf("String: got %q", s)
+	}
+
+	for _, bad := range []string{"", "99=1m", "p99", "px=1m", "p0=1m", "p101=1m", "p50=-1s", "p50=soon"} {
+		if _, err := ParseSLO(bad); err == nil {
+			t.Errorf("ParseSLO(%q): expected error", bad)
+		}
+	}
+}
+
+func TestSLOTracker(t *testing.T) {
+	slos := []SLO{{Percentile: 90, Target: time.Second}}
+	tr := new(sloTracker)
+
+	for i := 0; i < minSLORounds; i++ {
+		if alerts := tr.observe(slos, 20, 500*time.Millisecond); len(alerts) != 0 {
+			t.Fatalf("round %d: unexpected alerts: %+v", i, alerts)
+		}
+	}
+
+	// 2 failures out of 12 rounds puts the 90th percentile on a failure.
+	tr.observe(slos, 20, failedRound)
+	alerts := tr.observe(slos, 20, failedRound)
+	if len(alerts) != 1 || !alerts[0].Breached || alerts[0].Observed != -1 || alerts[0].Failed != 2 {
+		t.Fatalf("expected breach, got %+v", alerts)
+	}
+	if alerts := tr.observe(slos, 20, failedRound); len(alerts) != 0 {
+		t.Fatalf("expected no repeated alert, got %+v", alerts)
+	}
+
+	// Fast rounds push the failures out of the window.
+	var recovered bool
+	for i := 0; i < 20; i++ {
+		for _, a := range tr.observe(slos, 20, 100*time.Millisecond) {
+			if a.Breached {
+				t.Fatalf("unexpected breach: %+v", a)
+			}
+			recovered = true
+		}
+	}
+	if !recovered {
+		t.Fatal("expected recovery")
+	}
+}
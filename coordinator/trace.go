@@ -0,0 +1,250 @@
+// Copyright 2018 David Lazar. All rights reserved.
+// Use of this source code is governed by the GNU AGPL
+// license that can be found in the LICENSE file.
+
+package coordinator
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	"go.opentelemetry.io/otel/trace"
+
+	"vuvuzela.io/alpenhorn/addfriend"
+	"vuvuzela.io/alpenhorn/dialing"
+	"vuvuzela.io/alpenhorn/internal/tracing"
+	"vuvuzela.io/crypto/onionbox"
+	"vuvuzela.io/crypto/rand"
+	"vuvuzela.io/vuvuzela/mixnet"
+)
+
+// TraceUsername is the test identity that receives trace onions.
+const TraceUsername = "trace@alpenhorn.test"
+
+// maxTraces is the number of recent round traces the server keeps.
+const maxTraces = 64
+
+// RoundTrace records the progress of a round. When tracing is enabled,
+// the round also carries a trace onion whose marker (a dialing token
+// or an encrypted introduction, depending on the service) should appear
+// in the trace mailbox once the round ends.
+type RoundTrace struct {
+	Service      string
+	Round        uint32
+	ConfigHash   string
+	NumMailboxes uint32
+	Mailbox      uint32 `json:",omitempty"`
+	Marker       []byte `json:",omitempty"`
+
+	// MailboxChunkSize is the dialing round's chunk size, needed
+	// to reassemble a split trace mailbox.
+	MailboxChunkSize int `json:",omitempty"`
+
+	// PayloadVersion is the round's payload format version.
+	PayloadVersion int `json:",omitempty"`
+
+	// MailboxURL is set when the round completes successfully.
+	MailboxURL string
+	Err        string
+
+	Stages []TraceStage
+
+	// ctx carries the round's OpenTelemetry span, which is the
+	// parent of a span for each stage.
+	ctx  context.Context
+	span trace.Span
+}
+
+// TraceStage records the time a round spent in one stage, such as
+// waiting on the PKGs or running through the mix chain.
+type TraceStage struct {
+	Name     string
+	Start    time.Time
+	Duration time.Duration
+	Err      string `json:",omitempty"`
+}
+
+// TraceMailbox returns the mailbox of the trace identity.
+func TraceMailbox(numMailboxes uint32) uint32 {
+	h := sha256.Sum256([]byte(TraceUsername))
+	k := binary.BigEndian.Uint32(h[0:4])
+	return k%numMailboxes + 1
+}
+
+// Done reports whether the round has finished, successfully or not.
+func (t *RoundTrace) Done() bool {
+	return t.MailboxURL != "" || t.Err != ""
+}
+
+func (srv *Server) newTrace(ctx context.Context, round uint32, configHash string, introVersion int, payloadVersion int, mailboxChunkSize int) *RoundTrace {
+	t := &RoundTrace{
+		ctx:  ctx,
+		span: trace.SpanFromContext(ctx),
+
+		Service:      srv.Service,
+		Round:        round,
+		ConfigHash:   configHash,
+		NumMailboxes: srv.NumMailboxes,
+
+		MailboxChunkSize: mailboxChunkSize,
+		PayloadVersion:   payloadVersion,
+	}
+	if srv.TraceOnions {
+		t.Mailbox = TraceMailbox(srv.NumMailboxes)
+		if srv.Service == "AddFriend" {
+			t.Marker = make([]byte, addfriend.EncryptedIntroSize(introVersion, payloadVersion))
+		} else {
+			t.Marker = make([]byte, dialing.SizeToken)
+		}
+		rand.Read(t.Marker)
+	}
+
+	srv.mu.Lock()
+	if srv.traces == nil {
+		srv.traces = make(map[uint32]*RoundTrace)
+	}
+	srv.traces[round] = t
+	delete(srv.traces, round-maxTraces)
+	srv.mu.Unlock()
+
+	return t
+}
+
+// traceStage records a stage that started at start and ended now.
+func (srv *Server) traceStage(t *RoundTrace, name string, start time.Time, err error) {
+	_, span := tracing.Start(t.ctx, name, trace.WithTimestamp(start))
+	tracing.End(span, err)
+
+	stage := TraceStage{
+		Name:     name,
+		Start:    start,
+		Duration: srv.clock().Now().Sub(start),
+	}
+	if err != nil {
+		stage.Err = err.Error()
+	}
+	srv.mu.Lock()
+	t.Stages = append(t.Stages, stage)
+	if err != nil && t.Err == "" {
+		t.Err = stage.Err
+	}
+	srv.mu.Unlock()
+}
+
+func (srv *Server) traceDone(t *RoundTrace, mailboxURL string) {
+	srv.mu.Lock()
+	t.MailboxURL = mailboxURL
+	srv.mu.Unlock()
+	t.span.End()
+}
+
+// endRoundSpanLocked ends the OpenTelemetry span of a round that
+// closed without publishing its mailboxes.
+func (srv *Server) endRoundSpanLocked(round uint32, err error) {
+	if t := srv.traces[round]; t != nil {
+		tracing.End(t.span, err)
+	}
+}
+
+// traceOnion seals the trace marker in an onion for the round.
+func (t *RoundTrace) traceOnion(settings *mixnet.RoundSettings) []byte {
+	var msg []byte
+	if t.Service == "AddFriend" {
+		// The marker size follows the round's intro and payload versions.
+		msg = make([]byte, 4+len(t.Marker))
+		binary.BigEndian.PutUint32(msg[0:4], t.Mailbox)
+		copy(msg[4:], t.Marker)
+	} else {
+		mx := &dialing.MixMessage{Mailbox: t.Mailbox}
+		copy(mx.Token[:], t.Marker)
+		if v := dialing.NegotiatePayloadVersion(t.PayloadVersion); v == dialing.PayloadVersionLegacy {
+			msg, _ = mx.MarshalBinary()
+		} else {
+			msg = mx.MarshalPadded(v)
+		}
+	}
+	onion, _ := onionbox.Seal(msg, mixnet.ForwardNonce(settings.Round), settings.OnionKeys)
+	return onion
+}
+
+// traceHandler serves the trace for the round in the query, or for the
+// latest finished round if no round is given.
+func (srv *Server) traceHandler(w http.ResponseWriter, r *http.Request) {
+	if !srv.TraceOnions {
+		http.Error(w, "tracing is disabled", http.StatusNotFound)
+		return
+	}
+
+	var round uint64
+	if s := r.URL.Query().Get("round"); s != "" {
+		var err error
+		round, err = strconv.ParseUint(s, 10, 32)
+		if err != nil {
+			http.Error(w, "invalid round", http.StatusBadRequest)
+			return
+		}
+	}
+
+	srv.mu.Lock()
+	var trace *RoundTrace
+	if round != 0 {
+		trace = srv.traces[uint32(round)]
+	} else {
+		for _, t := range srv.traces {
+			if t.Done() && (trace == nil || t.Round > trace.Round) {
+				trace = t
+			}
+		}
+	}
+	var data []byte
+	if trace != nil && trace.Marker != nil {
+		data, _ = json.Marshal(trace)
+	}
+	srv.mu.Unlock()
+
+	if data == nil {
+		http.Error(w, "round not found", http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(data)
+}
+
+// ServerStatus is a snapshot of a coordinator's progress.
+type ServerStatus struct {
+	Service       string
+	Round         uint32
+	PendingOnions int
+
+	// Rounds holds the recent rounds, newest first.
+	Rounds []RoundTrace
+}
+
+// Status returns a snapshot of the server's recent rounds.
+func (srv *Server) Status() ServerStatus {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+
+	st := ServerStatus{
+		Service:       srv.Service,
+		Round:         srv.round,
+		PendingOnions: len(srv.onions),
+		Rounds:        make([]RoundTrace, 0, len(srv.traces)),
+	}
+	for _, t := range srv.traces {
+		c := *t
+		c.Marker = nil
+		c.Stages = append([]TraceStage(nil), t.Stages...)
+		st.Rounds = append(st.Rounds, c)
+	}
+	sort.Slice(st.Rounds, func(i, j int) bool {
+		return st.Rounds[i].Round > st.Rounds[j].Round
+	})
+	return st
+}
@@ -0,0 +1,106 @@
+// Copyright 2018 David Lazar. All rights reserved.
+// Use of this source code is governed by the GNU AGPL
+// license that can be found in the LICENSE file.
+
+package coordinator
+
+import (
+	"time"
+
+	"vuvuzela.io/alpenhorn/errors"
+	"vuvuzela.io/alpenhorn/internal/wire"
+	"vuvuzela.io/vuvuzela/mixnet"
+)
+
+// Binary encodings of the messages the coordinator broadcasts to every
+// client each round. Clients that negotiate the binary websocket
+// subprotocol receive these instead of JSON.
+
+const (
+	mixRoundBinaryVersion   byte = 1
+	mailboxURLBinaryVersion byte = 1
+)
+
+func (r MixRound) MarshalBinary() ([]byte, error) {
+	w := wire.NewWriter(mixRoundBinaryVersion)
+	s := r.MixSettings
+	w.PutString(s.Service)
+	w.PutUint32(s.Round)
+	w.PutUint32(s.NumMailboxes)
+	w.PutCount(len(s.OnionKeys))
+	for _, key := range s.OnionKeys {
+		w.PutBytes(key[:])
+	}
+	w.PutBytes(s.RawServiceData)
+
+	w.PutCount(len(r.MixSignatures))
+	for _, sig := range r.MixSignatures {
+		w.PutBytes(sig)
+	}
+
+	var endTime int64
+	if !r.EndTime.IsZero() {
+		endTime = r.EndTime.UnixNano()
+	}
+	w.PutUint64(uint64(endTime))
+	return w.Data(), nil
+}
+
+func (r *MixRound) UnmarshalBinary(data []byte) error {
+	rd := wire.NewReader(mixRoundBinaryVersion, data)
+	s := mixnet.RoundSettings{
+		Service:      rd.Text(),
+		Round:        rd.Uint32(),
+		NumMailboxes: rd.Uint32(),
+	}
+	if n := rd.Count(1 + 32); n > 0 {
+		s.OnionKeys = make([]*[32]byte, n)
+		for i := range s.OnionKeys {
+			key := new([32]byte)
+			if b := rd.Bytes(); len(b) == 32 {
+				copy(key[:], b)
+			} else if rd.Err() == nil {
+				return errors.New("onion key %d has %d bytes", i, len(b))
+			}
+			s.OnionKeys[i] = key
+		}
+	}
+	s.RawServiceData = rd.Bytes()
+
+	var sigs [][]byte
+	if n := rd.Count(1); n > 0 {
+		sigs = make([][]byte, n)
+		for i := range sigs {
+			sigs[i] = rd.Bytes()
+		}
+	}
+
+	endTime := int64(rd.Uint64())
+	if err := rd.Err(); err != nil {
+		return err
+	}
+
+	r.MixSettings = s
+	r.MixSignatures = sigs
+	r.EndTime = time.Time{}
+	if endTime != 0 {
+		r.EndTime = time.Unix(0, endTime)
+	}
+	return nil
+}
+
+func (m MailboxURL) MarshalBinary() ([]byte, error) {
+	w := wire.NewWriter(mailboxURLBinaryVersion)
+	w.PutUint32(m.Round)
+	w.PutString(m.URL)
+	w.PutUint32(m.NumMailboxes)
+	return w.Data(), nil
+}
+
+func (m *MailboxURL) UnmarshalBinary(data []byte) error {
+	rd := wire.NewReader(mailboxURLBinaryVersion, data)
+	m.Round = rd.Uint32()
+	m.URL = rd.Text()
+	m.NumMailboxes = rd.Uint32()
+	return rd.Err()
+}
@@ -10,12 +10,13 @@ import (
 
 	"github.com/davidlazar/go-crypto/encoding/base32"
 
-	"vuvuzela.io/alpenhorn/addfriend"
 	"vuvuzela.io/alpenhorn/bloom"
 	"vuvuzela.io/alpenhorn/config"
 	"vuvuzela.io/alpenhorn/coordinator"
 	"vuvuzela.io/alpenhorn/dialing"
 	"vuvuzela.io/alpenhorn/errors"
+	"vuvuzela.io/alpenhorn/internal/tracing"
+	"vuvuzela.io/alpenhorn/internal/version"
 	"vuvuzela.io/alpenhorn/log"
 	"vuvuzela.io/alpenhorn/typesocket"
 	"vuvuzela.io/crypto/onionbox"
@@ -26,6 +27,9 @@ type dialingRoundState struct {
 	Round        uint32
 	Config       *config.DialingConfig
 	ConfigParent *config.SignedConfig
+
+	// ServiceData is set once the round's mixnet settings arrive.
+	ServiceData *dialing.ServiceData
 }
 
 func (c *Client) dialingMux() typesocket.Mux {
@@ -38,13 +42,18 @@ func (c *Client) dialingMux() typesocket.Mux {
 }
 
 func (c *Client) dialingRoundError(conn typesocket.Conn, v coordinator.RoundError) {
-	log.WithFields(log.Fields{"round": v.Round}).Errorf("error from dialing coordinator: %s", v.Err)
+	c.logger().WithFields(log.Fields{"round": v.Round}).Errorf("error from dialing coordinator: %s", v.Err)
 }
 
 func (c *Client) newDialingRound(conn typesocket.Conn, v coordinator.NewRound) {
 	c.mu.Lock()
 	defer c.mu.Unlock()
 
+	if err := version.Coordinator.Check("coordinator", v.ProtocolVersion, v.MinProtocolVersion); err != nil {
+		c.Handler.Error(errors.Wrap(err, "round %d", v.Round))
+		return
+	}
+
 	st, ok := c.dialingRounds[v.Round]
 	if ok {
 		if st.ConfigParent.Hash() != v.ConfigHash {
@@ -97,9 +106,17 @@ func (c *Client) sendDialingOnion(conn typesocket.Conn, v coordinator.MixRound)
 		return
 	}
 
-	serviceData := new(addfriend.ServiceData)
+	serviceData := new(dialing.ServiceData)
 	if err := serviceData.Unmarshal(v.MixSettings.RawServiceData); err != nil {
-		c.Handler.Error(errors.New("sendAddFriendOnion: round %d: error parsing service data: %s", round, err))
+		c.Handler.Error(errors.New("sendDialingOnion: round %d: error parsing service data: %s", round, err))
+		return
+	}
+	if err := serviceData.Validate(); err != nil {
+		c.Handler.Error(errors.Wrap(err, "sendDialingOnion: round %d", round))
+		return
+	}
+	if err := st.Config.CheckBloomParams(serviceData.FalsePositiveRate(), serviceData.BloomCapacity); err != nil {
+		c.Handler.Error(errors.Wrap(err, "sendDialingOnion: round %d", round))
 		return
 	}
 	settingsMsg := v.MixSettings.SigningMessage()
@@ -115,6 +132,10 @@ func (c *Client) sendDialingOnion(conn typesocket.Conn, v coordinator.MixRound)
 		}
 	}
 
+	c.mu.Lock()
+	st.ServiceData = serviceData
+	c.mu.Unlock()
+
 	atomic.StoreUint32(&c.lastDialingRound, round)
 
 	mixMessage := new(dialing.MixMessage)
@@ -136,14 +157,24 @@ func (c *Client) sendDialingOnion(conn typesocket.Conn, v coordinator.MixRound)
 		mixMessage.Mailbox = 0
 	}
 
-	onion, _ := onionbox.Seal(mustMarshal(mixMessage), mixnet.ForwardNonce(round), v.MixSettings.OnionKeys)
+	var msg []byte
+	if payloadVersion := dialing.NegotiatePayloadVersion(st.Config.PayloadVersion); payloadVersion == dialing.PayloadVersionLegacy {
+		msg = mustMarshal(mixMessage)
+	} else {
+		msg = mixMessage.MarshalPadded(payloadVersion)
+	}
+	onion, _ := onionbox.Seal(msg, mixnet.ForwardNonce(round), v.MixSettings.OnionKeys)
 
 	// respond to the entry server with our onion for this round
 	omsg := coordinator.OnionMsg{
 		Round: round,
 		Onion: onion,
 	}
-	conn.Send("onion", omsg)
+	_, span := tracing.StartRound(serviceData.TraceParent, "client.SubmitOnion", "Dialing", round)
+	tracing.End(span, conn.Send("onion", omsg))
+	if call == nil {
+		c.usage.cover.Add(len(onion), 0)
+	}
 }
 
 func (c *Client) nextOutgoingCall(round uint32) *OutgoingCall {
@@ -154,6 +185,10 @@ func (c *Client) nextOutgoingCall(round uint32) *OutgoingCall {
 	if len(c.outgoingCalls) > 0 {
 		call = c.outgoingCalls[0]
 		c.outgoingCalls = c.outgoingCalls[1:]
+		// Persist the queue so the call is not sent again after a restart.
+		if err := c.persistClientLocked(); err != nil {
+			c.logger().Errorf("Persisting outgoing calls: %s", err)
+		}
 	}
 
 	return call
@@ -162,13 +197,37 @@ func (c *Client) nextOutgoingCall(round uint32) *OutgoingCall {
 func (c *Client) scanBloomFilter(conn typesocket.Conn, v coordinator.MailboxURL) {
 	c.mu.Lock()
 	st, ok := c.dialingRounds[v.Round]
+	var serviceData *dialing.ServiceData
+	if ok {
+		serviceData = st.ServiceData
+	}
 	c.mu.Unlock()
 	if !ok {
 		return
 	}
 
 	mailboxID := usernameToMailbox(c.Username, v.NumMailboxes)
-	mailbox, err := c.fetchMailbox(st.Config.CDNServer, v.URL, mailboxID)
+	var mailbox []byte
+	var err error
+	if c.DialingPIR && len(st.Config.PIRMirrors) > 0 {
+		servers := append([]config.CDNServerConfig{st.Config.CDNServer}, st.Config.PIRMirrors...)
+		mailbox, err = c.fetchMailboxPIR(servers, v.URL, v.NumMailboxes, mailboxID)
+	} else {
+		mailbox, err = c.fetchMailbox(st.Config.CDNServer, v.URL, mailboxID)
+	}
+	if err == nil && serviceData != nil && serviceData.MailboxChunkSize > 0 {
+		if c.DialingPIR && len(st.Config.PIRMirrors) > 0 {
+			// Fetching the continuations directly would reveal the
+			// mailbox, so only single-chunk mailboxes work with PIR.
+			var numChunks int
+			numChunks, mailbox, err = dialing.ParseMailboxHead(mailbox)
+			if err == nil && numChunks > 1 {
+				err = errors.New("mailbox %d overflowed into %d chunks, which PIR cannot fetch", mailboxID, numChunks)
+			}
+		} else {
+			mailbox, err = c.fetchMailboxContinuations(st.Config.CDNServer, v.URL, mailboxID, mailbox)
+		}
+	}
 	if err != nil {
 		c.Handler.Error(errors.Wrap(err, "fetching mailbox"))
 		return
@@ -177,6 +236,16 @@ func (c *Client) scanBloomFilter(conn typesocket.Conn, v coordinator.MailboxURL)
 	filter := new(bloom.Filter)
 	if err := filter.UnmarshalBinary(mailbox); err != nil {
 		c.Handler.Error(errors.Wrap(err, "decoding bloom filter"))
+		return
+	}
+	// The number of hash functions depends only on the false positive
+	// rate, so a mismatch means the mailbox was built with parameters
+	// other than the ones announced for this round.
+	if serviceData != nil {
+		if _, numHashes := serviceData.BloomParams(0); filter.NumHashes() != numHashes {
+			c.Handler.Error(errors.New("round %d: bloom filter has %d hash functions, want %d", v.Round, filter.NumHashes(), numHashes))
+			return
+		}
 	}
 
 	allTokens := c.wheel.IncomingDialTokens(c.Username, v.Round, IntentMax)
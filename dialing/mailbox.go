@@ -0,0 +1,89 @@
+// Copyright 2018 David Lazar. All rights reserved.
+// Use of this source code is governed by the GNU AGPL
+// license that can be found in the LICENSE file.
+
+package dialing
+
+import (
+	"encoding/binary"
+	"fmt"
+
+	"vuvuzela.io/alpenhorn/errors"
+)
+
+// Mailboxes that are larger than the round's MailboxChunkSize are
+// split into chunks. The first chunk is stored under the mailbox's
+// usual key and starts with the total number of chunks; the rest are
+// continuation objects stored under MailboxKey(mailbox, i).
+const (
+	// MinMailboxChunkSize and MaxMailboxChunkSize bound a round's
+	// MailboxChunkSize.
+	MinMailboxChunkSize = 1024
+	MaxMailboxChunkSize = 64 << 20
+
+	// MaxMailboxChunks bounds the number of objects a client has
+	// to fetch for a single mailbox.
+	MaxMailboxChunks = 4096
+
+	// DefaultMailboxChunkSize is the chunk size used by coordinators
+	// that do not configure one.
+	DefaultMailboxChunkSize = 1 << 20
+
+	sizeChunkHeader = 4
+)
+
+// MailboxKey returns the CDN key of a mailbox's chunk. Chunk 0 is
+// stored under the mailbox number.
+func MailboxKey(mailbox uint32, chunk int) string {
+	if chunk == 0 {
+		return fmt.Sprintf("%d", mailbox)
+	}
+	return fmt.Sprintf("%d.%d", mailbox, chunk)
+}
+
+// SplitMailbox splits a mailbox into chunks of at most chunkSize bytes,
+// the first of which carries the chunk header.
+func SplitMailbox(data []byte, chunkSize int) ([][]byte, error) {
+	if chunkSize < MinMailboxChunkSize {
+		return nil, errors.New("chunk size too small: %d", chunkSize)
+	}
+	first := chunkSize - sizeChunkHeader
+	n := 1
+	if len(data) > first {
+		n += (len(data) - first + chunkSize - 1) / chunkSize
+	}
+	if n > MaxMailboxChunks {
+		return nil, errors.New("mailbox too large: %d bytes needs %d chunks, max %d", len(data), n, MaxMailboxChunks)
+	}
+
+	chunks := make([][]byte, n)
+	if first > len(data) {
+		first = len(data)
+	}
+	chunks[0] = make([]byte, sizeChunkHeader+first)
+	binary.BigEndian.PutUint32(chunks[0], uint32(n))
+	copy(chunks[0][sizeChunkHeader:], data[:first])
+	data = data[first:]
+	for i := 1; i < n; i++ {
+		m := chunkSize
+		if m > len(data) {
+			m = len(data)
+		}
+		chunks[i] = data[:m]
+		data = data[m:]
+	}
+	return chunks, nil
+}
+
+// ParseMailboxHead parses the first chunk of a split mailbox, returning
+// the total number of chunks and the chunk's data.
+func ParseMailboxHead(chunk []byte) (numChunks int, data []byte, err error) {
+	if len(chunk) < sizeChunkHeader {
+		return 0, nil, errors.New("short mailbox chunk: %d bytes", len(chunk))
+	}
+	n := binary.BigEndian.Uint32(chunk)
+	if n == 0 || n > MaxMailboxChunks {
+		return 0, nil, errors.New("invalid number of mailbox chunks: %d", n)
+	}
+	return int(n), chunk[sizeChunkHeader:], nil
+}
@@ -0,0 +1,47 @@
+// Copyright 2018 David Lazar. All rights reserved.
+// Use of this source code is governed by the GNU AGPL
+// license that can be found in the LICENSE file.
+
+package dialing
+
+import (
+	"bytes"
+	"crypto/rand"
+	"testing"
+)
+
+func TestSplitMailbox(t *testing.T) {
+	chunkSize := MinMailboxChunkSize
+	for _, size := range []int{0, 1, chunkSize - sizeChunkHeader, chunkSize, 5*chunkSize + 17} {
+		data := make([]byte, size)
+		rand.Read(data)
+
+		chunks, err := SplitMailbox(data, chunkSize)
+		if err != nil {
+			t.Fatal(err)
+		}
+		numChunks, head, err := ParseMailboxHead(chunks[0])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if numChunks != len(chunks) {
+			t.Fatalf("size %d: header says %d chunks, got %d", size, numChunks, len(chunks))
+		}
+		joined := append([]byte(nil), head...)
+		for _, chunk := range chunks {
+			if len(chunk) > chunkSize {
+				t.Fatalf("size %d: chunk of %d bytes exceeds %d", size, len(chunk), chunkSize)
+			}
+		}
+		for _, chunk := range chunks[1:] {
+			joined = append(joined, chunk...)
+		}
+		if !bytes.Equal(joined, data) {
+			t.Fatalf("size %d: mailbox did not round-trip", size)
+		}
+	}
+
+	if _, err := SplitMailbox(make([]byte, MaxMailboxChunks*chunkSize), chunkSize); err == nil {
+		t.Fatal("expected error for a mailbox with too many chunks")
+	}
+}
@@ -7,20 +7,24 @@ package dialing
 
 import (
 	"bytes"
+	"context"
 	"crypto/ed25519"
 	"encoding/binary"
 	"encoding/gob"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
+	"math"
 	"net/http"
-	"strconv"
 	"sync"
 	"unsafe"
 
 	"vuvuzela.io/alpenhorn/bloom"
 	"vuvuzela.io/alpenhorn/edhttp"
 	"vuvuzela.io/alpenhorn/errors"
+	"vuvuzela.io/alpenhorn/internal/rng"
+	"vuvuzela.io/alpenhorn/internal/tracing"
+	"vuvuzela.io/alpenhorn/internal/version"
 	"vuvuzela.io/concurrency"
 	"vuvuzela.io/crypto/onionbox"
 	"vuvuzela.io/crypto/rand"
@@ -45,6 +49,11 @@ type Mixer struct {
 
 	Laplace rand.Laplace
 
+	// PayloadVersion is the payload format version in the Dialing
+	// config. Versions above zero share a size, so the mixer only
+	// needs to know whether messages are padded.
+	PayloadVersion int
+
 	once      sync.Once
 	cdnClient *edhttp.Client
 }
@@ -54,7 +63,7 @@ func (srv *Mixer) Bidirectional() bool {
 }
 
 func (srv *Mixer) SizeIncomingMessage() int {
-	return sizeMixMessage
+	return SizeMixMessage(srv.PayloadVersion)
 }
 
 func (srv *Mixer) SizeReplyMessage() int {
@@ -65,21 +74,115 @@ type ServiceData struct {
 	CDNKey       ed25519.PublicKey
 	CDNAddress   string
 	NumMailboxes uint32
+
+	// Mirrors receive a copy of the mailboxes for PIR fetches.
+	Mirrors []Mirror `json:",omitempty"`
+
+	// BloomFalsePositiveRate is the false positive rate of the
+	// mailbox Bloom filters. Zero means DefaultBloomFalsePositiveRate.
+	BloomFalsePositiveRate float64 `json:",omitempty"`
+
+	// BloomCapacity is the minimum number of tokens each mailbox's
+	// Bloom filter is sized for, so filter sizes do not reveal how
+	// few tokens a mailbox got.
+	BloomCapacity int `json:",omitempty"`
+
+	// MailboxChunkSize is the largest object the mixer stores on the
+	// CDN. Larger mailboxes are split into continuation objects (see
+	// SplitMailbox). Zero means mailboxes are never split.
+	MailboxChunkSize int `json:",omitempty"`
+
+	// PayloadVersion is the payload format version for the round.
+	PayloadVersion int `json:",omitempty"`
+
+	// MixnetProtocol and MinMixnetProtocol are the coordinator's
+	// mixnet protocol versions. Zero means version 1.
+	MixnetProtocol    int `json:",omitempty"`
+	MinMixnetProtocol int `json:",omitempty"`
+
+	// TraceParent is the trace context of the coordinator's round
+	// span, so mixers and clients can add spans to the round.
+	TraceParent string `json:",omitempty"`
+}
+
+// DefaultBloomFalsePositiveRate is the false positive rate used by
+// rounds that do not specify one.
+const DefaultBloomFalsePositiveRate = 0.000001
+
+// MaxBloomCapacity bounds BloomCapacity.
+const MaxBloomCapacity = 1 << 20
+
+// FalsePositiveRate returns the round's Bloom filter false positive rate.
+func (d *ServiceData) FalsePositiveRate() float64 {
+	if d.BloomFalsePositiveRate == 0 {
+		return DefaultBloomFalsePositiveRate
+	}
+	return d.BloomFalsePositiveRate
+}
+
+// BloomParams returns the size and number of hash functions of the
+// Bloom filter for a mailbox with the given number of tokens.
+func (d *ServiceData) BloomParams(numTokens int) (sizeBits int, numHashes int) {
+	if numTokens < d.BloomCapacity {
+		numTokens = d.BloomCapacity
+	}
+	return bloom.Optimal(numTokens, d.FalsePositiveRate())
+}
+
+// Validate checks that the Bloom filter parameters are usable.
+func (d *ServiceData) Validate() error {
+	p := d.BloomFalsePositiveRate
+	if math.IsNaN(p) || p < 0 || p >= 0.5 {
+		return errors.New("invalid bloom false positive rate: %v", p)
+	}
+	if d.BloomCapacity < 0 || d.BloomCapacity > MaxBloomCapacity {
+		return errors.New("invalid bloom capacity: %d", d.BloomCapacity)
+	}
+	if d.MailboxChunkSize != 0 && (d.MailboxChunkSize < MinMailboxChunkSize || d.MailboxChunkSize > MaxMailboxChunkSize) {
+		return errors.New("invalid mailbox chunk size: %d", d.MailboxChunkSize)
+	}
+	return nil
+}
+
+// A Mirror is a CDN server that mirrors the dialing mailboxes.
+type Mirror struct {
+	Key     ed25519.PublicKey
+	Address string
 }
 
 const DialingServiceDataVersion = 0
 
 func (srv *Mixer) ParseServiceData(data []byte) (interface{}, error) {
 	d := new(ServiceData)
-	err := d.Unmarshal(data)
-	return d, err
+	if err := d.Unmarshal(data); err != nil {
+		return d, err
+	}
+	if err := version.Mixnet.Check("coordinator", d.MixnetProtocol, d.MinMixnetProtocol); err != nil {
+		return d, err
+	}
+	// Messages of the wrong size are dropped, so refuse the round
+	// instead of silently discarding every dial.
+	if SizeMixMessage(d.PayloadVersion) != SizeMixMessage(srv.PayloadVersion) {
+		return d, errors.New("round uses payload version %d, but mixer is configured for %d", d.PayloadVersion, srv.PayloadVersion)
+	}
+	return d, d.Validate()
 }
 
 func (srv *Mixer) GenerateNoise(settings mixnet.RoundSettings, myPos int) [][]byte {
+	traceParent := settings.ServiceData.(*ServiceData).TraceParent
+	_, span := tracing.StartRound(traceParent, "mixer.GenerateNoise", settings.Service, settings.Round, tracing.Hop(myPos))
+	defer span.End()
+
+	// Noise sampled from a bad random source could be subtracted
+	// from the mailbox counts, so fail closed.
+	if err := rng.Err(); err != nil {
+		panic("refusing to generate noise: " + err.Error())
+	}
+
 	noiseTotal := uint32(0)
 	noiseCounts := make([]uint32, settings.ServiceData.(*ServiceData).NumMailboxes+1)
 	for b := range noiseCounts {
-		bmu := srv.Laplace.Uint32()
+		bmu := rng.Laplace(srv.Laplace.Mu, srv.Laplace.B)
 		noiseCounts[b] = bmu
 		noiseTotal += bmu
 	}
@@ -95,15 +198,23 @@ func (srv *Mixer) GenerateNoise(settings mixnet.RoundSettings, myPos int) [][]by
 	}
 
 	nextServerKeys := settings.OnionKeys[myPos+1:]
+	payloadVersion := NegotiatePayloadVersion(srv.PayloadVersion)
 
 	concurrency.ParallelFor(len(noise), func(p *concurrency.P) {
 		for i, ok := p.Next(); ok; i, ok = p.Next() {
-			var exchange [sizeMixMessage]byte
-			binary.BigEndian.PutUint32(exchange[0:4], mailbox[i])
+			mx := &MixMessage{Mailbox: mailbox[i]}
 			if mailbox[i] != 0 {
-				rand.Read(exchange[4:])
+				if _, err := rng.Read(mx.Token[:]); err != nil {
+					panic(err)
+				}
 			}
-			onion, _ := onionbox.Seal(exchange[:], mixnet.ForwardNonce(settings.Round), nextServerKeys)
+			var exchange []byte
+			if payloadVersion == PayloadVersionLegacy {
+				exchange, _ = mx.MarshalBinary()
+			} else {
+				exchange = mx.MarshalPadded(payloadVersion)
+			}
+			onion, _ := onionbox.Seal(exchange, mixnet.ForwardNonce(settings.Round), nextServerKeys)
 			noise[i] = onion
 		}
 	})
@@ -112,26 +223,45 @@ func (srv *Mixer) GenerateNoise(settings mixnet.RoundSettings, myPos int) [][]by
 }
 
 func (srv *Mixer) HandleMessages(settings mixnet.RoundSettings, messages [][]byte) (interface{}, error) {
+	traceParent := settings.ServiceData.(*ServiceData).TraceParent
+	ctx, span := tracing.StartRound(traceParent, "mixer.HandleMessages", settings.Service, settings.Round)
+	url, err := srv.handleMessages(ctx, settings, messages)
+	tracing.End(span, err)
+	return url, err
+}
+
+func (srv *Mixer) handleMessages(ctx context.Context, settings mixnet.RoundSettings, messages [][]byte) (interface{}, error) {
 	srv.once.Do(func() {
 		srv.cdnClient = &edhttp.Client{
 			Key: srv.SigningKey,
 		}
 	})
 
+	if err := rng.Err(); err != nil {
+		return nil, errors.Wrap(err, "refusing to shuffle")
+	}
+
 	serviceData := settings.ServiceData.(*ServiceData)
 
 	// The last server doesn't shuffle by default, so shuffle here.
-	shuffler := shuffle.New(rand.Reader, len(messages))
+	shuffler := shuffle.New(rng.Reader, len(messages))
 	shuffler.Shuffle(messages)
 
 	groups := make(map[uint32][][]byte)
 
+	size := SizeMixMessage(srv.PayloadVersion)
 	for _, m := range messages {
-		if len(m) != sizeMixMessage {
+		if len(m) != size {
 			continue
 		}
 		mx := new(MixMessage)
-		if err := mx.UnmarshalBinary(m); err != nil {
+		var err error
+		if srv.PayloadVersion == PayloadVersionLegacy {
+			err = mx.UnmarshalBinary(m)
+		} else {
+			_, err = mx.UnmarshalPadded(m)
+		}
+		if err != nil {
 			continue
 		}
 		if mx.Mailbox == 0 {
@@ -142,12 +272,22 @@ func (srv *Mixer) HandleMessages(settings mixnet.RoundSettings, messages [][]byt
 
 	mailboxes := make(map[string][]byte)
 	for mbox, tokens := range groups {
-		f := bloom.New(bloom.Optimal(len(tokens), 0.000001))
+		f := bloom.New(serviceData.BloomParams(len(tokens)))
 		for _, token := range tokens {
 			f.Set(token)
 		}
-		mstr := strconv.FormatUint(uint64(mbox), 10)
-		mailboxes[mstr], _ = f.MarshalBinary()
+		data, _ := f.MarshalBinary()
+		if serviceData.MailboxChunkSize == 0 {
+			mailboxes[MailboxKey(mbox, 0)] = data
+			continue
+		}
+		chunks, err := SplitMailbox(data, serviceData.MailboxChunkSize)
+		if err != nil {
+			return "", errors.Wrap(err, "mailbox %d", mbox)
+		}
+		for i, chunk := range chunks {
+			mailboxes[MailboxKey(mbox, i)] = chunk
+		}
 	}
 
 	buf := new(bytes.Buffer)
@@ -155,23 +295,50 @@ func (srv *Mixer) HandleMessages(settings mixnet.RoundSettings, messages [][]byt
 	if err != nil {
 		return "", errors.Wrap(err, "gob.Encode")
 	}
+	data := buf.Bytes()
 
-	putURL := fmt.Sprintf("https://%s/put?bucket=%s/%d", serviceData.CDNAddress, settings.Service, settings.Round)
-	resp, err := srv.cdnClient.Post(serviceData.CDNKey, putURL, "application/octet-stream", buf)
-	if err != nil {
+	bucket := fmt.Sprintf("%s/%d", settings.Service, settings.Round)
+	if err := srv.upload(ctx, serviceData.CDNKey, serviceData.CDNAddress, bucket, data); err != nil {
 		return "", err
 	}
-	defer resp.Body.Close()
-	if resp.StatusCode != http.StatusOK {
-		msg, _ := ioutil.ReadAll(resp.Body)
-		err = errors.New("bad CDN response: %s: %q", resp.Status, msg)
-		return "", err
+	// PIR needs every mirror to serve the same mailboxes, so a
+	// failed mirror upload fails the round.
+	for i, mirror := range serviceData.Mirrors {
+		if err := srv.upload(ctx, mirror.Key, mirror.Address, bucket, data); err != nil {
+			return "", errors.Wrap(err, "mirror %d", i)
+		}
 	}
 
 	getURL := fmt.Sprintf("https://%s/get?bucket=%s/%d", serviceData.CDNAddress, settings.Service, settings.Round)
 	return getURL, nil
 }
 
+func (srv *Mixer) upload(ctx context.Context, key ed25519.PublicKey, address string, bucket string, data []byte) (err error) {
+	ctx, span := tracing.Start(ctx, "cdn.put")
+	defer func() { tracing.End(span, err) }()
+
+	putURL := fmt.Sprintf("https://%s/put?bucket=%s", address, bucket)
+	req, err := version.CDN.NewRequest("POST", putURL, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/octet-stream")
+	tracing.Inject(ctx, req.Header)
+	resp, err := srv.cdnClient.Do(key, req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if err := version.CDN.CheckHeader("cdn server", resp.Header); err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := ioutil.ReadAll(resp.Body)
+		return errors.New("bad CDN response: %s: %q", resp.Status, msg)
+	}
+	return nil
+}
+
 func (e *MixMessage) MarshalBinary() ([]byte, error) {
 	buf := new(bytes.Buffer)
 	if err := binary.Write(buf, binary.BigEndian, e); err != nil {
@@ -0,0 +1,77 @@
+// Copyright 2018 David Lazar. All rights reserved.
+// Use of this source code is governed by the GNU AGPL
+// license that can be found in the LICENSE file.
+
+package dialing
+
+import (
+	"encoding/binary"
+
+	"vuvuzela.io/alpenhorn/errors"
+)
+
+// Payload format versions of the dialing mix message, selected by the
+// PayloadVersion field of the Dialing config. Version 0 is the original
+// unpadded message. Every later version has the same padded size:
+//
+//	mailbox (4 bytes) | version (1 byte) | token (32 bytes) | reserved
+//
+// New fields go in the reserved bytes, so they can be added without
+// changing the message size.
+const (
+	PayloadVersionLegacy = 0
+	PayloadVersion1      = 1
+
+	// MaxPayloadVersion is the highest version this package writes.
+	MaxPayloadVersion = PayloadVersion1
+
+	// SizePaddedMixMessage is the size of a padded mix message.
+	SizePaddedMixMessage = 64
+)
+
+// NegotiatePayloadVersion returns the payload version to write when
+// the config selects configured: the highest version supported by
+// both the config and this client.
+func NegotiatePayloadVersion(configured int) int {
+	if configured > MaxPayloadVersion {
+		return MaxPayloadVersion
+	}
+	return configured
+}
+
+// SizeMixMessage returns the size of a mix message in the given
+// payload version.
+func SizeMixMessage(payloadVersion int) int {
+	if payloadVersion == PayloadVersionLegacy {
+		return sizeMixMessage
+	}
+	return SizePaddedMixMessage
+}
+
+// MarshalPadded encodes the message in the padded format with the
+// given payload version.
+func (e *MixMessage) MarshalPadded(payloadVersion int) []byte {
+	if payloadVersion <= PayloadVersionLegacy || payloadVersion > 255 {
+		panic("invalid payload version")
+	}
+	msg := make([]byte, SizePaddedMixMessage)
+	binary.BigEndian.PutUint32(msg[0:4], e.Mailbox)
+	msg[4] = byte(payloadVersion)
+	copy(msg[5:5+SizeToken], e.Token[:])
+	return msg
+}
+
+// UnmarshalPadded decodes a padded message, returning its payload
+// version. Messages from later versions are accepted: their mailbox
+// and token are in the same place.
+func (e *MixMessage) UnmarshalPadded(data []byte) (payloadVersion int, err error) {
+	if len(data) != SizePaddedMixMessage {
+		return 0, errors.New("bad message length: got %d, want %d", len(data), SizePaddedMixMessage)
+	}
+	if data[4] == PayloadVersionLegacy {
+		return 0, errors.New("invalid payload version: %d", data[4])
+	}
+	e.Mailbox = binary.BigEndian.Uint32(data[0:4])
+	copy(e.Token[:], data[5:5+SizeToken])
+	return int(data[4]), nil
+}
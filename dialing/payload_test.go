@@ -0,0 +1,36 @@
+// Copyright 2018 David Lazar. All rights reserved.
+// Use of this source code is governed by the GNU AGPL
+// license that can be found in the LICENSE file.
+
+package dialing
+
+import (
+	"crypto/rand"
+	"testing"
+)
+
+func TestPaddedMixMessage(t *testing.T) {
+	mx := &MixMessage{Mailbox: 42}
+	rand.Read(mx.Token[:])
+
+	for _, version := range []int{PayloadVersion1, MaxPayloadVersion + 1} {
+		data := mx.MarshalPadded(version)
+		if len(data) != SizeMixMessage(version) {
+			t.Fatalf("padded message is %d bytes, want %d", len(data), SizeMixMessage(version))
+		}
+		mx2 := new(MixMessage)
+		v, err := mx2.UnmarshalPadded(data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if v != version || *mx2 != *mx {
+			t.Fatalf("message did not round-trip: version %d", v)
+		}
+	}
+
+	data := mx.MarshalPadded(PayloadVersion1)
+	data[4] = PayloadVersionLegacy
+	if _, err := new(MixMessage).UnmarshalPadded(data); err == nil {
+		t.Fatal("accepted padded message with version 0")
+	}
+}
@@ -8,71 +8,133 @@ package edhttp
 
 import (
 	"bytes"
-	"context"
 	"crypto/ed25519"
 	"encoding/json"
 	"io"
-	"net"
 	"net/http"
 	"net/url"
 	"sync"
 
-	"vuvuzela.io/alpenhorn/edtls"
 	"vuvuzela.io/alpenhorn/errors"
+	"vuvuzela.io/alpenhorn/internal/fault"
 )
 
 type Client struct {
 	Key ed25519.PrivateKey
 
+	// CountTraffic, if not nil, is called with the number of bytes
+	// sent and received on the client's connections, including TLS
+	// and HTTP overhead.
+	CountTraffic func(sent, received int)
+
+	// Transport, if not nil, carries the client's requests in place
+	// of edTLS connections, as in the simulations of package
+	// internal/sim. CountTraffic is not called for its requests.
+	Transport Transport
+
 	initOnce sync.Once
 	client   *http.Client
 
 	mu         sync.RWMutex
-	serverKeys map[string]ed25519.PublicKey
+	serverKeys map[string][]ed25519.PublicKey
+}
+
+// A Transport carries a Client's requests to servers. Like edTLS, it
+// must only deliver a request to a server that holds one of
+// serverKeys, and it must tell the server that the request comes from
+// clientKey, which is nil if the client has no key.
+type Transport interface {
+	RoundTrip(req *http.Request, serverKeys []ed25519.PublicKey, clientKey ed25519.PublicKey) (*http.Response, error)
 }
 
+type roundTripperFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripperFunc) RoundTrip(req *http.Request) (*http.Response, error) { return f(req) }
+
 func (c *Client) init() {
 	c.initOnce.Do(func() {
-		c.serverKeys = make(map[string]ed25519.PublicKey)
+		c.serverKeys = make(map[string][]ed25519.PublicKey)
 
+		rt := c.transport()
+		if c.Transport != nil {
+			rt = roundTripperFunc(c.roundTrip)
+		}
 		c.client = &http.Client{
-			Transport: &http.Transport{
-				DialTLS: func(network, addr string) (net.Conn, error) {
-					c.mu.RLock()
-					serverKey := c.serverKeys[addr]
-					c.mu.RUnlock()
-					if serverKey == nil {
-						return nil, errors.New("no edtls key for %s", addr)
-					}
-					return edtls.Dial(network, addr, serverKey, c.Key)
-				},
-
-				DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
-					return nil, errors.New("edhttp does not allow unencrypted tcp connections")
-				},
-			},
+			Transport: fault.Transport(fault.EdHTTP, rt),
 		}
 	})
 }
 
+// roundTrip sends req with c.Transport.
+func (c *Client) roundTrip(req *http.Request) (*http.Response, error) {
+	c.mu.RLock()
+	serverKeys := c.serverKeys[req.URL.Host]
+	c.mu.RUnlock()
+	if serverKeys == nil {
+		return nil, errors.New("no edtls key for %s", req.URL.Host)
+	}
+	var clientKey ed25519.PublicKey
+	if c.Key != nil {
+		clientKey = c.Key.Public().(ed25519.PublicKey)
+	}
+	return c.Transport.RoundTrip(req, serverKeys, clientKey)
+}
+
 // assertKey tells the client to expect an edTLS certificate
 // signed by key when connecting to the given address.
 func (c *Client) assertKey(address string, key ed25519.PublicKey) error {
+	return c.assertKeys(address, []ed25519.PublicKey{key})
+}
+
+// assertKeys tells the client to expect an edTLS certificate signed
+// by any of keys when connecting to the given address. The keys for
+// an address may only change by adding or dropping keys, as when the
+// server rotates its key, and not by replacing them all.
+func (c *Client) assertKeys(address string, keys []ed25519.PublicKey) error {
 	c.mu.Lock()
 	defer c.mu.Unlock()
 
-	k := c.serverKeys[address]
-	if k != nil {
-		if bytes.Equal(k, key) {
-			return nil
-		}
+	old := c.serverKeys[address]
+	if old == nil {
+		c.serverKeys[address] = keys
+		return nil
+	}
+	if sameKeys(old, keys) {
+		return nil
+	}
+	if !shareKey(old, keys) {
 		return errors.New("multiple keys for address: %s", address)
 	}
-
-	c.serverKeys[address] = key
+	c.serverKeys[address] = keys
+	// Connections made with the old keys may not be trusted with
+	// the new ones.
+	c.client.CloseIdleConnections()
 	return nil
 }
 
+func sameKeys(a, b []ed25519.PublicKey) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if !bytes.Equal(a[i], b[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+func shareKey(a, b []ed25519.PublicKey) bool {
+	for _, x := range a {
+		for _, y := range b {
+			if bytes.Equal(x, y) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
 func (c *Client) assertKeyURL(urlStr string, key ed25519.PublicKey) error {
 	u, err := url.Parse(urlStr)
 	if err != nil {
@@ -90,6 +152,16 @@ func (c *Client) Do(key ed25519.PublicKey, req *http.Request) (*http.Response, e
 	return c.client.Do(req)
 }
 
+// DoAny is like Do but accepts a server certificate signed by any of
+// keys.
+func (c *Client) DoAny(keys []ed25519.PublicKey, req *http.Request) (*http.Response, error) {
+	c.init()
+	if err := c.assertKeys(req.URL.Host, keys); err != nil {
+		return nil, err
+	}
+	return c.client.Do(req)
+}
+
 func (c *Client) Get(key ed25519.PublicKey, url string) (*http.Response, error) {
 	c.init()
 	if err := c.assertKeyURL(url, key); err != nil {
@@ -0,0 +1,41 @@
+// Copyright 2017 David Lazar. All rights reserved.
+// Use of this source code is governed by the GNU AGPL
+// license that can be found in the LICENSE file.
+
+//go:build !js
+// +build !js
+
+package edhttp
+
+import (
+	"context"
+	"net"
+	"net/http"
+
+	"vuvuzela.io/alpenhorn/edtls"
+	"vuvuzela.io/alpenhorn/errors"
+	"vuvuzela.io/alpenhorn/internal/happyeyeballs"
+	"vuvuzela.io/alpenhorn/internal/meter"
+)
+
+func (c *Client) transport() http.RoundTripper {
+	return &http.Transport{
+		DialTLSContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			c.mu.RLock()
+			serverKeys := c.serverKeys[addr]
+			c.mu.RUnlock()
+			if serverKeys == nil {
+				return nil, errors.New("no edtls key for %s", addr)
+			}
+			rawConn, err := happyeyeballs.DialContext(ctx, network, addr)
+			if err != nil {
+				return nil, err
+			}
+			return edtls.ClientHandshakeAny(ctx, meter.Conn(rawConn, c.CountTraffic), addr, serverKeys, c.Key)
+		},
+
+		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			return nil, errors.New("edhttp does not allow unencrypted tcp connections")
+		},
+	}
+}
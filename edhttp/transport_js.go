@@ -0,0 +1,20 @@
+// Copyright 2018 David Lazar. All rights reserved.
+// Use of this source code is governed by the GNU AGPL
+// license that can be found in the LICENSE file.
+
+//go:build js
+// +build js
+
+package edhttp
+
+import "net/http"
+
+// In the browser, requests go through the Fetch API, which does its
+// own TLS. Servers are authenticated by their web PKI certificates
+// instead of their edtls keys, so they must be reachable with a
+// certificate the browser trusts. Replies that matter are signed with
+// the server's key, and clients check those signatures as usual.
+// Client keys and CountTraffic are not supported.
+func (c *Client) transport() http.RoundTripper {
+	return http.DefaultTransport
+}
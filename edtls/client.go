@@ -1,13 +1,15 @@
 package edtls
 
 import (
-	"bytes"
+	"context"
 	"crypto/ed25519"
 	"crypto/tls"
 	"crypto/x509"
 	"net"
 
 	"vuvuzela.io/alpenhorn/errors"
+	"vuvuzela.io/alpenhorn/internal/happyeyeballs"
+	"vuvuzela.io/alpenhorn/internal/keysafe"
 )
 
 var (
@@ -16,9 +18,40 @@ var (
 )
 
 func Dial(network, addr string, theirKey ed25519.PublicKey, myKey ed25519.PrivateKey) (*tls.Conn, error) {
-	config := NewTLSClientConfig(myKey, theirKey)
+	return DialContext(context.Background(), network, addr, theirKey, myKey)
+}
+
+// DialContext connects to addr and performs the TLS handshake. Host
+// names with both IPv4 and IPv6 addresses are dialed with happy
+// eyeballs, so a broken address family does not stall the dial.
+func DialContext(ctx context.Context, network, addr string, theirKey ed25519.PublicKey, myKey ed25519.PrivateKey) (*tls.Conn, error) {
+	rawConn, err := happyeyeballs.DialContext(ctx, network, addr)
+	if err != nil {
+		return nil, err
+	}
+	return ClientHandshake(ctx, rawConn, addr, theirKey, myKey)
+}
+
+// ClientHandshake performs the TLS handshake on rawConn, a connection
+// to addr, and closes rawConn if the handshake fails.
+func ClientHandshake(ctx context.Context, rawConn net.Conn, addr string, theirKey ed25519.PublicKey, myKey ed25519.PrivateKey) (*tls.Conn, error) {
+	return ClientHandshakeAny(ctx, rawConn, addr, []ed25519.PublicKey{theirKey}, myKey)
+}
 
-	return tls.Dial(network, addr, config)
+// ClientHandshakeAny is like ClientHandshake but accepts a certificate
+// signed by any of theirKeys, such as a server's keys before and after
+// a key rotation.
+func ClientHandshakeAny(ctx context.Context, rawConn net.Conn, addr string, theirKeys []ed25519.PublicKey, myKey ed25519.PrivateKey) (*tls.Conn, error) {
+	config := newTLSClientConfig(myKey, theirKeys)
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		config.ServerName = host
+	}
+	conn := tls.Client(rawConn, config)
+	if err := conn.HandshakeContext(ctx); err != nil {
+		rawConn.Close()
+		return nil, err
+	}
+	return conn, nil
 }
 
 func Client(rawConn net.Conn, theirKey ed25519.PublicKey, myKey ed25519.PrivateKey) *tls.Conn {
@@ -29,6 +62,10 @@ func Client(rawConn net.Conn, theirKey ed25519.PublicKey, myKey ed25519.PrivateK
 }
 
 func NewTLSClientConfig(myKey ed25519.PrivateKey, peerKey ed25519.PublicKey) *tls.Config {
+	return newTLSClientConfig(myKey, []ed25519.PublicKey{peerKey})
+}
+
+func newTLSClientConfig(myKey ed25519.PrivateKey, peerKeys []ed25519.PublicKey) *tls.Config {
 	var config = &tls.Config{
 		RootCAs:            x509.NewCertPool(),
 		ClientAuth:         tls.RequestClientCert,
@@ -72,11 +109,12 @@ func NewTLSClientConfig(myKey ed25519.PrivateKey, peerKey ed25519.PublicKey) *tl
 			if !ok {
 				return errors.New("invalid public key type in certificate: %T", cert.PublicKey)
 			}
-			if !bytes.Equal(theirKey, peerKey) {
-				return ErrVerificationFailed
+			for _, peerKey := range peerKeys {
+				if keysafe.Equal(theirKey, peerKey) {
+					return nil
+				}
 			}
-
-			return nil
+			return ErrVerificationFailed
 		},
 	}
 
@@ -1,7 +1,7 @@
 package edtls
 
 import (
-	"crypto/ed25519"
+	"crypto"
 	"crypto/rand"
 	"crypto/tls"
 	"crypto/x509"
@@ -14,19 +14,22 @@ import (
 	"vuvuzela.io/alpenhorn/errors"
 )
 
-func Listen(network, laddr string, key ed25519.PrivateKey) (net.Listener, error) {
+// Listen listens for edtls connections, presenting a certificate for
+// key. The key is usually an ed25519.PrivateKey, but it may be any
+// signer with an Ed25519 public key, such as a key in an HSM.
+func Listen(network, laddr string, key crypto.Signer) (net.Listener, error) {
 	config := NewTLSServerConfig(key)
 
 	return tls.Listen(network, laddr, config)
 }
 
-func Server(conn net.Conn, key ed25519.PrivateKey) *tls.Conn {
+func Server(conn net.Conn, key crypto.Signer) *tls.Conn {
 	config := NewTLSServerConfig(key)
 
 	return tls.Server(conn, config)
 }
 
-func NewTLSServerConfig(key ed25519.PrivateKey) *tls.Config {
+func NewTLSServerConfig(key crypto.Signer) *tls.Config {
 	var mu sync.Mutex
 	var expiry time.Time
 	var currCert *tls.Certificate
@@ -84,7 +87,7 @@ func NewTLSServerConfig(key ed25519.PrivateKey) *tls.Config {
 
 var certDuration = 1 * time.Hour
 
-func newSelfSignedCert(key ed25519.PrivateKey) ([]byte, error) {
+func newSelfSignedCert(key crypto.Signer) ([]byte, error) {
 	// generate a self-signed cert
 	now := time.Now()
 	expiry := now.Add(certDuration)
@@ -8,6 +8,9 @@ import (
 	"crypto/ed25519"
 	"fmt"
 	"time"
+
+	"vuvuzela.io/alpenhorn/errors"
+	"vuvuzela.io/alpenhorn/pkg"
 )
 
 // Friend is an entry in the client's address book.
@@ -61,6 +64,57 @@ func (f *Friend) Remove() error {
 	return err
 }
 
+// Rename changes the friend's username after they renamed their
+// account. The attestations must include one from each of the
+// client's PKG servers stating that the friend's username is now the
+// same new username. The friend keeps their keywheel state, so calls
+// between the client and the friend continue under the new name.
+func (f *Friend) Rename(attestations []*pkg.RenameAttestation) error {
+	c := f.client
+	oldUsername := f.Username
+	var newUsername string
+	for _, server := range c.PKGServers() {
+		var ok bool
+		for _, a := range attestations {
+			if a.OldUsername != oldUsername || !a.VerifyAny(server.Keys()) {
+				continue
+			}
+			if newUsername == "" {
+				newUsername = a.NewUsername
+			}
+			if a.NewUsername == newUsername {
+				ok = true
+				break
+			}
+		}
+		if !ok {
+			return errors.New("no attestation from PKG %s that %q is now %q", server.Address, oldUsername, newUsername)
+		}
+	}
+	if newUsername == "" {
+		return errors.New("no PKG servers")
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.friends[newUsername] != nil {
+		return errors.New("%q is already a friend", newUsername)
+	}
+	if !c.wheel.Rename(oldUsername, newUsername) {
+		return errors.New("no keywheel entry for %q", oldUsername)
+	}
+	delete(c.friends, oldUsername)
+	f.Username = newUsername
+	c.friends[newUsername] = f
+	for _, call := range c.outgoingCalls {
+		if call.Username == oldUsername {
+			call.Username = newUsername
+		}
+	}
+
+	return c.persistLocked()
+}
+
 // SetExtraData overwrites the friend's extra data field with the given
 // data. The extra data field is useful for application-specific data
 // about the friend, such as additional contact info, notes, or a photo.
@@ -104,9 +158,12 @@ const IntentMax = 3
 
 // Call is used to call a friend using Alpenhorn's dialing protocol.
 // Call does not send the call right away but queues the call for an
-// upcoming dialing round. The resulting OutgoingCall is the queued
-// call object. Call does nothing and returns nil if the friend is
-// not in the client's address book.
+// upcoming dialing round. The queue is persisted with the client state,
+// so calls queued while offline are sent after the client restarts.
+// The resulting OutgoingCall is the queued call object. If a call to
+// the friend is already queued, Call updates its intent and returns it
+// instead of queueing another. Call does nothing and returns nil if the
+// friend is not in the client's address book.
 func (f *Friend) Call(intent int) *OutgoingCall {
 	if intent >= IntentMax {
 		panic(fmt.Sprintf("invalid intent: %d", intent))
@@ -115,18 +172,38 @@ func (f *Friend) Call(intent int) *OutgoingCall {
 		return nil
 	}
 
-	call := &OutgoingCall{
-		Username: f.Username,
-		Created:  time.Now(),
-		client:   f.client,
-		intent:   intent,
+	c := f.client
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	call := c.queuedCallLocked(f.Username)
+	if call != nil {
+		call.intent = intent
+	} else {
+		call = &OutgoingCall{
+			Username: f.Username,
+			Created:  c.clock().Now(),
+			client:   c,
+			intent:   intent,
+		}
+		c.outgoingCalls = append(c.outgoingCalls, call)
+	}
+	if err := c.persistClientLocked(); err != nil {
+		c.logger().Errorf("Persisting call to %s: %s", f.Username, err)
 	}
-	f.client.mu.Lock()
-	f.client.outgoingCalls = append(f.client.outgoingCalls, call)
-	f.client.mu.Unlock()
 	return call
 }
 
+// queuedCallLocked returns the queued call to username, or nil.
+// It assumes c.mu is locked.
+func (c *Client) queuedCallLocked(username string) *OutgoingCall {
+	for _, call := range c.outgoingCalls {
+		if call.Username == username {
+			return call
+		}
+	}
+	return nil
+}
+
 type IncomingCall struct {
 	Username   string
 	Intent     int
@@ -166,7 +243,7 @@ func (r *OutgoingCall) UpdateIntent(intent int) error {
 		return ErrTooLate
 	}
 	r.intent = intent
-	return nil
+	return r.client.persistClientLocked()
 }
 
 type computeKeysResult struct{ token, sessionKey *[32]byte }
@@ -231,5 +308,5 @@ func (r *OutgoingCall) Cancel() error {
 	}
 
 	r.client.outgoingCalls = append(calls[:index], calls[index+1:]...)
-	return nil
+	return r.client.persistClientLocked()
 }
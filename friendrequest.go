@@ -5,6 +5,7 @@
 package alpenhorn
 
 import (
+	"bytes"
 	"crypto/ed25519"
 	"errors"
 
@@ -16,21 +17,45 @@ import (
 // username's long-term public key if it is known ahead of time.
 //
 // The friend request is not sent right away but queued for an upcoming
-// add-friend round. The resulting OutgoingFriendRequest is the queued
-// friend request.
+// add-friend round. The queue is persisted with the client state, so
+// requests queued while offline are sent after the client restarts.
+// The resulting OutgoingFriendRequest is the queued friend request.
+// If a request to username is already queued, SendFriendRequest
+// returns it instead of queueing another.
 func (c *Client) SendFriendRequest(username string, key ed25519.PublicKey) (*OutgoingFriendRequest, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
 	req := &OutgoingFriendRequest{
 		Username:    username,
 		ExpectedKey: key,
 		client:      c,
 	}
-	c.mu.Lock()
+	if queued := c.queuedFriendRequestLocked(req); queued != nil {
+		if key != nil && !bytes.Equal(queued.ExpectedKey, key) {
+			return nil, errors.New("a friend request with a different key is already queued")
+		}
+		return queued, nil
+	}
 	c.outgoingFriendRequests = append(c.outgoingFriendRequests, req)
 	err := c.persistLocked()
-	c.mu.Unlock()
 	return req, err
 }
 
+// queuedFriendRequestLocked returns the queued friend request that
+// duplicates req, or nil. It assumes c.mu is locked.
+func (c *Client) queuedFriendRequestLocked(req *OutgoingFriendRequest) *OutgoingFriendRequest {
+	for _, q := range c.outgoingFriendRequests {
+		if q.Username != req.Username || q.Confirmation != req.Confirmation {
+			continue
+		}
+		if q.Confirmation && q.DialRound != req.DialRound {
+			continue
+		}
+		return q
+	}
+	return nil
+}
+
 //easyjson:readable
 type OutgoingFriendRequest struct {
 	Username    string
@@ -131,13 +156,18 @@ type IncomingFriendRequest struct {
 // confirmation request is sent. Approve assumes that the friend request
 // has not been previously rejected.
 func (r *IncomingFriendRequest) Approve() (*OutgoingFriendRequest, error) {
+	c := r.client
 	out := &OutgoingFriendRequest{
 		Username:     r.Username,
 		Confirmation: true,
 		DialRound:    r.DialRound,
+		client:       c,
 	}
-	c := r.client
 	c.mu.Lock()
+	if queued := c.queuedFriendRequestLocked(out); queued != nil {
+		c.mu.Unlock()
+		return queued, nil
+	}
 	c.outgoingFriendRequests = append(c.outgoingFriendRequests, out)
 	// The incoming request stays in its queue so it can be matched to the
 	// outgoing request when it is sent.
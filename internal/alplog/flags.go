@@ -0,0 +1,129 @@
+// Copyright 2018 David Lazar. All rights reserved.
+// Use of this source code is governed by the GNU AGPL
+// license that can be found in the LICENSE file.
+
+package alplog
+
+import (
+	"flag"
+	"fmt"
+	"path/filepath"
+	"time"
+
+	"vuvuzela.io/alpenhorn/log"
+)
+
+// Flags are the logging options shared by the server commands.
+type Flags struct {
+	Level      string
+	File       string
+	Format     string
+	MaxSize    int
+	MaxAge     time.Duration
+	MaxBackups int
+	Privacy    string
+}
+
+// RegisterFlags defines the logging flags in fs.
+func RegisterFlags(fs *flag.FlagSet) *Flags {
+	f := new(Flags)
+	fs.StringVar(&f.Level, "logLevel", "info", "minimum log level (debug, info, warn, error)")
+	fs.StringVar(&f.File, "logFile", "", "write logs to this file instead of the persist logs directory")
+	fs.StringVar(&f.Format, "logFormat", "text", "log format: text or json")
+	fs.IntVar(&f.MaxSize, "logMaxSize", 100, "rotate -logFile after this many megabytes (0 disables)")
+	fs.DurationVar(&f.MaxAge, "logMaxAge", 24*time.Hour, "rotate -logFile after this long (0 disables)")
+	fs.IntVar(&f.MaxBackups, "logMaxBackups", 7, "number of rotated log files to keep (0 keeps all)")
+	fs.StringVar(&f.Privacy, "logPrivacy", "hash", "how to log usernames, IPs, and keys: off, truncate, hash, or redact")
+	return f
+}
+
+// Dir returns the directory of the -logFile flag, or the empty string
+// if logs go to the persist logs directory.
+func (f *Flags) Dir() string {
+	if f.File == "" {
+		return ""
+	}
+	return filepath.Dir(f.File)
+}
+
+// An Output is a log entry handler with a human-readable destination.
+type Output interface {
+	log.EntryHandler
+	Name() string
+}
+
+// NewLogger returns a logger configured by the flags. If no log file
+// is given, logs are written to logsDir as with NewProductionOutput.
+// Sensitive fields are scrubbed according to the -logPrivacy flag.
+func (f *Flags) NewLogger(logsDir string) (*log.Logger, Output, error) {
+	level, err := log.ParseLevel(f.Level)
+	if err != nil {
+		return nil, nil, err
+	}
+	privacy, err := ParsePrivacy(f.Privacy)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var stderr log.EntryHandler
+	switch f.Format {
+	case "text":
+		stderr = outputText{dst: log.Stderr}
+	case "json":
+		stderr = log.OutputJSON(log.Stderr)
+	default:
+		return nil, nil, fmt.Errorf("unknown log format: %q", f.Format)
+	}
+
+	var out Output
+	if f.File == "" {
+		h, err := NewProductionOutput(logsDir)
+		if err != nil {
+			return nil, nil, err
+		}
+		h.stderrHandler = stderr
+		out = h
+	} else {
+		file := &log.RotatingFile{
+			Path:       f.File,
+			MaxSize:    int64(f.MaxSize) << 20,
+			MaxAge:     f.MaxAge,
+			MaxBackups: f.MaxBackups,
+		}
+		var h log.EntryHandler
+		if f.Format == "json" {
+			h = log.OutputJSON(file)
+		} else {
+			h = &log.OutputText{Out: file, DisableColors: true}
+		}
+		out = fileOutput{
+			name:   f.File,
+			file:   h,
+			stderr: stderr,
+		}
+	}
+
+	logger := &log.Logger{
+		Level:        level,
+		EntryHandler: NewScrubber(privacy, out),
+	}
+	return logger, out, nil
+}
+
+type fileOutput struct {
+	name   string
+	file   log.EntryHandler
+	stderr log.EntryHandler
+}
+
+func (h fileOutput) Name() string {
+	return h.name
+}
+
+func (h fileOutput) Fire(e *log.Entry) {
+	h.file.Fire(e)
+	// Only print errors to stderr.
+	if e.Level <= log.ErrorLevel {
+		h.stderr.Fire(e)
+	}
+}
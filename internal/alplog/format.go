@@ -23,7 +23,7 @@ var bufPool = sync.Pool{
 
 type ProductionOutput struct {
 	dirHandler    *log.OutputDir
-	stderrHandler outputText
+	stderrHandler log.EntryHandler
 }
 
 func NewProductionOutput(logsDir string) (ProductionOutput, error) {
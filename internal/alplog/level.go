@@ -0,0 +1,41 @@
+// Copyright 2018 David Lazar. All rights reserved.
+// Use of this source code is governed by the GNU AGPL
+// license that can be found in the LICENSE file.
+
+package alplog
+
+import (
+	"sync/atomic"
+
+	"vuvuzela.io/alpenhorn/log"
+)
+
+// A LevelFilter passes entries at or above its level on to another
+// handler. Unlike a Logger's Level, the level can be changed while the
+// logger is in use, such as when a server reloads its config. Loggers
+// that use a LevelFilter should be at log.DebugLevel.
+type LevelFilter struct {
+	level uint32
+	next  log.EntryHandler
+}
+
+func NewLevelFilter(level log.Level, next log.EntryHandler) *LevelFilter {
+	return &LevelFilter{
+		level: uint32(level),
+		next:  next,
+	}
+}
+
+func (f *LevelFilter) Level() log.Level {
+	return log.Level(atomic.LoadUint32(&f.level))
+}
+
+func (f *LevelFilter) SetLevel(level log.Level) {
+	atomic.StoreUint32(&f.level, uint32(level))
+}
+
+func (f *LevelFilter) Fire(e *log.Entry) {
+	if e.Level <= f.Level() {
+		f.next.Fire(e)
+	}
+}
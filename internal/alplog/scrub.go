@@ -0,0 +1,188 @@
+// Copyright 2018 David Lazar. All rights reserved.
+// Use of this source code is governed by the GNU AGPL
+// license that can be found in the LICENSE file.
+
+package alplog
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"strings"
+
+	"vuvuzela.io/alpenhorn/log"
+)
+
+// A Privacy level says how much of a sensitive log field to keep.
+type Privacy int
+
+const (
+	// PrivacyOff logs sensitive fields as-is.
+	PrivacyOff Privacy = iota
+
+	// PrivacyTruncate keeps a coarse prefix of each sensitive field:
+	// the domain of a username, the /24 (or /48) of an IP address,
+	// and the first few characters of a key.
+	PrivacyTruncate
+
+	// PrivacyHash replaces sensitive fields with a keyed hash, so
+	// entries about the same user can be correlated within a run of
+	// the server but not across restarts.
+	PrivacyHash
+
+	// PrivacyRedact removes sensitive fields entirely.
+	PrivacyRedact
+)
+
+var privacyNames = []string{"off", "truncate", "hash", "redact"}
+
+func (p Privacy) String() string {
+	if p < 0 || int(p) >= len(privacyNames) {
+		return fmt.Sprintf("Privacy(%d)", int(p))
+	}
+	return privacyNames[p]
+}
+
+// ParsePrivacy parses a privacy level name.
+func ParsePrivacy(s string) (Privacy, error) {
+	for i, name := range privacyNames {
+		if s == name {
+			return Privacy(i), nil
+		}
+	}
+	return 0, fmt.Errorf("unknown log privacy level: %q", s)
+}
+
+type fieldKind int
+
+const (
+	notSensitive fieldKind = iota
+	usernameField
+	addrField
+	keyField
+)
+
+// classify decides whether a log field holds user metadata based on
+// its name, since the servers log these under consistent names.
+func classify(name string) fieldKind {
+	lower := strings.ToLower(name)
+	switch lower {
+	case "username", "user", "email", "from", "to":
+		return usernameField
+	case "ip", "remoteaddr", "remoteip", "clientip", "clientaddr":
+		return addrField
+	}
+	if strings.HasSuffix(lower, "key") {
+		return keyField
+	}
+	return notSensitive
+}
+
+// A Scrubber rewrites sensitive log fields before passing entries on
+// to the next handler.
+type Scrubber struct {
+	Privacy Privacy
+	Next    log.EntryHandler
+
+	hashKey []byte
+}
+
+// NewScrubber returns a Scrubber with a fresh hash key.
+func NewScrubber(privacy Privacy, next log.EntryHandler) *Scrubber {
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		panic(err)
+	}
+	return &Scrubber{
+		Privacy: privacy,
+		Next:    next,
+		hashKey: key,
+	}
+}
+
+func (s *Scrubber) Fire(e *log.Entry) {
+	if s.Privacy == PrivacyOff {
+		s.Next.Fire(e)
+		return
+	}
+
+	var fields log.Fields
+	for k, v := range e.Fields {
+		kind := classify(k)
+		if kind == notSensitive {
+			continue
+		}
+		if fields == nil {
+			// Entry fields are shared with the logger that created
+			// them, so scrub a copy.
+			fields = make(log.Fields, len(e.Fields))
+			for k, v := range e.Fields {
+				fields[k] = v
+			}
+		}
+		if s.Privacy == PrivacyRedact {
+			delete(fields, k)
+		} else {
+			fields[k] = s.scrub(kind, v)
+		}
+	}
+	if fields == nil {
+		s.Next.Fire(e)
+		return
+	}
+
+	scrubbed := *e
+	scrubbed.Fields = fields
+	s.Next.Fire(&scrubbed)
+}
+
+func (s *Scrubber) scrub(kind fieldKind, v interface{}) string {
+	var str string
+	switch v := v.(type) {
+	case string:
+		str = v
+	case []byte:
+		str = hex.EncodeToString(v)
+	default:
+		str = fmt.Sprint(v)
+	}
+
+	if s.Privacy == PrivacyHash {
+		mac := hmac.New(sha256.New, s.hashKey)
+		mac.Write([]byte(str))
+		return "h:" + hex.EncodeToString(mac.Sum(nil)[:8])
+	}
+
+	switch kind {
+	case usernameField:
+		if i := strings.LastIndexByte(str, '@'); i >= 0 {
+			return "*" + str[i:]
+		}
+		return "*"
+	case addrField:
+		return truncateAddr(str)
+	default:
+		if len(str) > 6 {
+			return str[:6] + "..."
+		}
+		return str
+	}
+}
+
+func truncateAddr(addr string) string {
+	host := addr
+	if h, _, err := net.SplitHostPort(addr); err == nil {
+		host = h
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return "*"
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		return ip4.Mask(net.CIDRMask(24, 32)).String() + "/24"
+	}
+	return ip.Mask(net.CIDRMask(48, 128)).String() + "/48"
+}
@@ -0,0 +1,100 @@
+// Copyright 2018 David Lazar. All rights reserved.
+// Use of this source code is governed by the GNU AGPL
+// license that can be found in the LICENSE file.
+
+package alplog
+
+import (
+	"strings"
+	"testing"
+
+	"vuvuzela.io/alpenhorn/log"
+)
+
+type lastEntry struct {
+	e *log.Entry
+}
+
+func (h *lastEntry) Fire(e *log.Entry) {
+	h.e = e
+}
+
+func TestScrubber(t *testing.T) {
+	fields := log.Fields{
+		"username":   "alice@example.org",
+		"remoteAddr": "203.0.113.77:4431",
+		"loginKey":   "ABCDEFGHIJKLMNOP",
+		"round":      42,
+	}
+
+	expected := map[Privacy]map[string]interface{}{
+		PrivacyOff: {
+			"username":   "alice@example.org",
+			"remoteAddr": "203.0.113.77:4431",
+			"loginKey":   "ABCDEFGHIJKLMNOP",
+		},
+		PrivacyTruncate: {
+			"username":   "*@example.org",
+			"remoteAddr": "203.0.113.0/24",
+			"loginKey":   "ABCDEF...",
+		},
+		PrivacyRedact: {
+			"username":   nil,
+			"remoteAddr": nil,
+			"loginKey":   nil,
+		},
+	}
+
+	for privacy, want := range expected {
+		h := new(lastEntry)
+		logger := &log.Logger{
+			Level:        log.InfoLevel,
+			EntryHandler: NewScrubber(privacy, h),
+		}
+		logger.WithFields(fields).Info("hello")
+
+		for k, v := range want {
+			if h.e.Fields[k] != v {
+				t.Errorf("%s: field %q: got %v, want %v", privacy, k, h.e.Fields[k], v)
+			}
+		}
+		if h.e.Fields["round"] != 42 {
+			t.Errorf("%s: non-sensitive field was changed: %v", privacy, h.e.Fields["round"])
+		}
+	}
+
+	if fields["username"] != "alice@example.org" {
+		t.Fatal("scrubber modified the logger's fields")
+	}
+}
+
+func TestScrubberHash(t *testing.T) {
+	h := new(lastEntry)
+	logger := &log.Logger{
+		Level:        log.InfoLevel,
+		EntryHandler: NewScrubber(PrivacyHash, h),
+	}
+
+	logger.WithFields(log.Fields{"username": "alice@example.org"}).Info("one")
+	first := h.e.Fields["username"].(string)
+	logger.WithFields(log.Fields{"username": "alice@example.org"}).Info("two")
+	second := h.e.Fields["username"].(string)
+	logger.WithFields(log.Fields{"username": "bob@example.org"}).Info("three")
+	third := h.e.Fields["username"].(string)
+
+	if !strings.HasPrefix(first, "h:") || strings.Contains(first, "alice") {
+		t.Fatalf("username was not hashed: %q", first)
+	}
+	if first != second {
+		t.Fatalf("hashes of the same username differ: %q != %q", first, second)
+	}
+	if first == third {
+		t.Fatalf("different usernames hash the same: %q", first)
+	}
+}
+
+func TestTruncateIPv6(t *testing.T) {
+	if got := truncateAddr("[2001:db8:1234:5678::1]:443"); got != "2001:db8:1234::/48" {
+		t.Fatalf("got %q", got)
+	}
+}
@@ -0,0 +1,179 @@
+// Copyright 2018 David Lazar. All rights reserved.
+// Use of this source code is governed by the GNU AGPL
+// license that can be found in the LICENSE file.
+
+// Package cryptobench benchmarks the cryptographic operations that
+// bound the size of Alpenhorn rounds. The benchmarks are shared by
+// `go test -bench` and the alpenhorn-bench command.
+package cryptobench
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"net"
+	"testing"
+
+	"golang.org/x/crypto/nacl/box"
+
+	"vuvuzela.io/alpenhorn/edtls"
+	"vuvuzela.io/crypto/bls"
+	"vuvuzela.io/crypto/ibe"
+	"vuvuzela.io/crypto/onionbox"
+)
+
+// A Benchmark is a named benchmark function.
+type Benchmark struct {
+	Name string
+	F    func(b *testing.B)
+}
+
+// All lists the benchmarks in the order alpenhorn-bench runs them.
+var All = []Benchmark{
+	{"IBEExtract", IBEExtract},
+	{"IBEEncrypt", IBEEncrypt},
+	{"IBEDecrypt", IBEDecrypt},
+	{"OnionSeal", OnionSeal},
+	{"OnionOpenLayer", OnionOpenLayer},
+	{"BLSSign", BLSSign},
+	{"BLSVerify", BLSVerify},
+	{"EdTLSHandshake", EdTLSHandshake},
+}
+
+var benchID = []byte("alice@example.org-padded-out-to-a-64-byte-identity-xxxxxxxxxxxxx")
+
+// IBEExtract measures the PKG's per-user cost of extracting an
+// identity private key.
+func IBEExtract(b *testing.B) {
+	_, priv := ibe.Setup(rand.Reader)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		ibe.Extract(priv, benchID)
+	}
+}
+
+// IBEEncrypt measures the client's cost of encrypting a friend request.
+func IBEEncrypt(b *testing.B) {
+	pub, _ := ibe.Setup(rand.Reader)
+	msg := make([]byte, 256)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		ibe.Encrypt(rand.Reader, pub, benchID, msg)
+	}
+}
+
+// IBEDecrypt measures the client's cost of trial-decrypting one
+// mailbox entry.
+func IBEDecrypt(b *testing.B) {
+	pub, priv := ibe.Setup(rand.Reader)
+	key := ibe.Extract(priv, benchID)
+	ctxt := ibe.Encrypt(rand.Reader, pub, benchID, make([]byte, 256))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		ibe.Decrypt(key, ctxt)
+	}
+}
+
+func onionKeys(n int) ([]*[32]byte, []*[32]byte) {
+	pubs := make([]*[32]byte, n)
+	privs := make([]*[32]byte, n)
+	for i := range pubs {
+		pub, priv, err := box.GenerateKey(rand.Reader)
+		if err != nil {
+			panic(err)
+		}
+		pubs[i], privs[i] = pub, priv
+	}
+	return pubs, privs
+}
+
+// OnionSeal measures the client's cost of wrapping a message for a
+// three-server mixnet.
+func OnionSeal(b *testing.B) {
+	pubs, _ := onionKeys(3)
+	msg := make([]byte, 256)
+	nonce := new([24]byte)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		onionbox.Seal(msg, nonce, pubs)
+	}
+}
+
+// OnionOpenLayer measures a mixer's cost of removing one onion layer,
+// which is a Curve25519 key exchange followed by an authenticated
+// decryption.
+func OnionOpenLayer(b *testing.B) {
+	serverPub, serverPriv, _ := box.GenerateKey(rand.Reader)
+	clientPub, clientPriv, _ := box.GenerateKey(rand.Reader)
+	nonce := new([24]byte)
+	layer := box.Seal(nil, make([]byte, 256), nonce, serverPub, clientPriv)
+	b.SetBytes(int64(len(layer)))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, ok := box.Open(nil, layer, nonce, clientPub, serverPriv); !ok {
+			b.Fatal("failed to open onion layer")
+		}
+	}
+}
+
+// BLSSign measures the PKG's cost of attesting to a user's identity.
+func BLSSign(b *testing.B) {
+	_, priv, _ := bls.GenerateKey(rand.Reader)
+	msg := make([]byte, 128)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		bls.Sign(priv, msg)
+	}
+}
+
+// BLSVerify measures the cost of verifying one PKG attestation.
+func BLSVerify(b *testing.B) {
+	pub, priv, _ := bls.GenerateKey(rand.Reader)
+	msg := make([]byte, 128)
+	sig := bls.Sign(priv, msg)
+	keys := []*bls.PublicKey{pub}
+	msgs := [][]byte{msg}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if !bls.Verify(keys, msgs, sig) {
+			b.Fatal("failed to verify signature")
+		}
+	}
+}
+
+// EdTLSHandshake measures the cost of establishing an edtls connection
+// between two servers (or a client and a server) over loopback TCP.
+func EdTLSHandshake(b *testing.B) {
+	serverPub, serverPriv, _ := ed25519.GenerateKey(rand.Reader)
+	_, clientPriv, _ := ed25519.GenerateKey(rand.Reader)
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer l.Close()
+
+	done := make(chan error, 1)
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			server := edtls.Server(c, serverPriv)
+			done <- server.Handshake()
+			server.Close()
+		}
+	}()
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		client, err := edtls.Dial("tcp", l.Addr().String(), serverPub, clientPriv)
+		if err != nil {
+			b.Fatal(err)
+		}
+		if err := <-done; err != nil {
+			b.Fatal(err)
+		}
+		client.Close()
+	}
+}
@@ -0,0 +1,16 @@
+// Copyright 2018 David Lazar. All rights reserved.
+// Use of this source code is governed by the GNU AGPL
+// license that can be found in the LICENSE file.
+
+package cryptobench
+
+import "testing"
+
+func BenchmarkIBEExtract(b *testing.B)     { IBEExtract(b) }
+func BenchmarkIBEEncrypt(b *testing.B)     { IBEEncrypt(b) }
+func BenchmarkIBEDecrypt(b *testing.B)     { IBEDecrypt(b) }
+func BenchmarkOnionSeal(b *testing.B)      { OnionSeal(b) }
+func BenchmarkOnionOpenLayer(b *testing.B) { OnionOpenLayer(b) }
+func BenchmarkBLSSign(b *testing.B)        { BLSSign(b) }
+func BenchmarkBLSVerify(b *testing.B)      { BLSVerify(b) }
+func BenchmarkEdTLSHandshake(b *testing.B) { EdTLSHandshake(b) }
@@ -0,0 +1,28 @@
+// Copyright 2018 David Lazar. All rights reserved.
+// Use of this source code is governed by the GNU AGPL
+// license that can be found in the LICENSE file.
+
+//go:build !faults
+// +build !faults
+
+package fault
+
+import "net/http"
+
+// Enabled reports whether the binary was built with fault injection.
+const Enabled = false
+
+// Set is a no-op without the faults build tag.
+func Set(point string, rule Rule) {}
+
+// Reset is a no-op without the faults build tag.
+func Reset() {}
+
+// Inject always returns nil without the faults build tag.
+func Inject(point string) error { return nil }
+
+// Corrupt returns data unchanged without the faults build tag.
+func Corrupt(point string, data []byte) []byte { return data }
+
+// Transport returns rt unchanged without the faults build tag.
+func Transport(point string, rt http.RoundTripper) http.RoundTripper { return rt }
@@ -0,0 +1,132 @@
+// Copyright 2018 David Lazar. All rights reserved.
+// Use of this source code is governed by the GNU AGPL
+// license that can be found in the LICENSE file.
+
+//go:build faults
+// +build faults
+
+package fault
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	mrand "math/rand"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Enabled reports whether the binary was built with fault injection.
+const Enabled = true
+
+var (
+	mu    sync.Mutex
+	rules = make(map[string]Rule)
+	rnd   = mrand.New(mrand.NewSource(time.Now().UnixNano()))
+)
+
+func init() {
+	if seed := os.Getenv("ALPENHORN_FAULTS_SEED"); seed != "" {
+		n, err := strconv.ParseInt(seed, 10, 64)
+		if err != nil {
+			panic(fmt.Sprintf("fault: invalid ALPENHORN_FAULTS_SEED: %s", err))
+		}
+		rnd = mrand.New(mrand.NewSource(n))
+	}
+	if spec := os.Getenv("ALPENHORN_FAULTS"); spec != "" {
+		rs, err := ParseSpec(spec)
+		if err != nil {
+			panic(err)
+		}
+		rules = rs
+	}
+}
+
+// Set configures the faults injected at the given point.
+func Set(point string, rule Rule) {
+	mu.Lock()
+	rules[point] = rule
+	mu.Unlock()
+}
+
+// Reset removes all fault rules.
+func Reset() {
+	mu.Lock()
+	rules = make(map[string]Rule)
+	mu.Unlock()
+}
+
+// Inject possibly delays and then possibly fails the operation at the
+// given point, according to its rule.
+func Inject(point string) error {
+	mu.Lock()
+	rule, ok := rules[point]
+	var delay time.Duration
+	var drop bool
+	if ok {
+		if rule.MaxDelay > 0 && rnd.Float64() < rule.Delay {
+			delay = time.Duration(rnd.Int63n(int64(rule.MaxDelay)))
+		}
+		drop = rnd.Float64() < rule.Drop
+	}
+	mu.Unlock()
+
+	if delay > 0 {
+		time.Sleep(delay)
+	}
+	if drop {
+		return ErrInjected
+	}
+	return nil
+}
+
+// Corrupt possibly flips a random bit in data, according to the rule
+// for the given point. The data is modified in place.
+func Corrupt(point string, data []byte) []byte {
+	if len(data) == 0 {
+		return data
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	rule, ok := rules[point]
+	if ok && rnd.Float64() < rule.Corrupt {
+		i := rnd.Intn(len(data))
+		data[i] ^= 1 << uint(rnd.Intn(8))
+	}
+	return data
+}
+
+// Transport wraps rt so that requests made through it are subject to
+// the faults configured for the given point.
+func Transport(point string, rt http.RoundTripper) http.RoundTripper {
+	return &transport{point: point, rt: rt}
+}
+
+type transport struct {
+	point string
+	rt    http.RoundTripper
+}
+
+func (t *transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if err := Inject(t.point); err != nil {
+		if req.Body != nil {
+			req.Body.Close()
+		}
+		return nil, err
+	}
+	resp, err := t.rt.RoundTrip(req)
+	if err != nil {
+		return resp, err
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	body = Corrupt(t.point, body)
+	resp.Body = ioutil.NopCloser(bytes.NewReader(body))
+	return resp, nil
+}
@@ -0,0 +1,38 @@
+// Copyright 2018 David Lazar. All rights reserved.
+// Use of this source code is governed by the GNU AGPL
+// license that can be found in the LICENSE file.
+
+//go:build faults
+// +build faults
+
+package fault
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestInject(t *testing.T) {
+	defer Reset()
+
+	if err := Inject("test"); err != nil {
+		t.Fatalf("unexpected fault without a rule: %s", err)
+	}
+
+	Set("test", Rule{Drop: 1})
+	if err := Inject("test"); err != ErrInjected {
+		t.Fatalf("expected ErrInjected, got %v", err)
+	}
+
+	Set("test", Rule{Corrupt: 1})
+	orig := []byte("hello world")
+	data := Corrupt("test", append([]byte(nil), orig...))
+	if bytes.Equal(data, orig) {
+		t.Fatal("data was not corrupted")
+	}
+
+	Reset()
+	if err := Inject("test"); err != nil {
+		t.Fatalf("unexpected fault after reset: %s", err)
+	}
+}
@@ -0,0 +1,99 @@
+// Copyright 2018 David Lazar. All rights reserved.
+// Use of this source code is governed by the GNU AGPL
+// license that can be found in the LICENSE file.
+
+// Package fault implements fault injection for chaos testing.
+//
+// Servers call Inject (and Corrupt) at named points before sending
+// inter-server messages or touching storage. In normal builds these
+// calls are no-ops. When built with the "faults" build tag, each point
+// can be configured to fail, stall, or corrupt data with some
+// probability, either with Set or through the ALPENHORN_FAULTS
+// environment variable:
+//
+//	ALPENHORN_FAULTS='edhttp=drop:0.1,delay:0.2@500ms;pkg.db=drop:0.05'
+//
+// The random choices are seeded by ALPENHORN_FAULTS_SEED so a failing
+// chaos run can be repeated.
+package fault
+
+import (
+	"strconv"
+	"strings"
+	"time"
+
+	"vuvuzela.io/alpenhorn/errors"
+)
+
+// Well-known injection points.
+const (
+	EdHTTP = "edhttp" // requests between servers
+	PKGDB  = "pkg.db" // PKG database transactions
+	CDNDB  = "cdn.db" // CDN database transactions
+)
+
+// Rule describes how often faults occur at an injection point.
+// Probabilities are between 0 and 1.
+type Rule struct {
+	Drop     float64       // fail the operation with ErrInjected
+	Delay    float64       // sleep for up to MaxDelay before the operation
+	MaxDelay time.Duration // upper bound on injected delays
+	Corrupt  float64       // flip a random bit in the data
+}
+
+// ErrInjected is the error returned by Inject when a fault is injected.
+var ErrInjected = errors.New("fault: injected failure")
+
+// ParseSpec parses a fault specification of the form
+//
+//	point=drop:P,delay:P@DURATION,corrupt:P;point2=...
+func ParseSpec(spec string) (map[string]Rule, error) {
+	rules := make(map[string]Rule)
+	for _, part := range strings.Split(spec, ";") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		eq := strings.IndexByte(part, '=')
+		if eq <= 0 {
+			return nil, errors.New("fault: invalid rule %q", part)
+		}
+		point := part[:eq]
+		var rule Rule
+		for _, kv := range strings.Split(part[eq+1:], ",") {
+			colon := strings.IndexByte(kv, ':')
+			if colon <= 0 {
+				return nil, errors.New("fault: invalid setting %q for %s", kv, point)
+			}
+			name, val := kv[:colon], kv[colon+1:]
+			if name == "delay" {
+				at := strings.IndexByte(val, '@')
+				if at < 0 {
+					return nil, errors.New("fault: delay for %s needs a duration (delay:P@DURATION)", point)
+				}
+				d, err := time.ParseDuration(val[at+1:])
+				if err != nil {
+					return nil, errors.Wrap(err, "fault: invalid delay for %s", point)
+				}
+				rule.MaxDelay = d
+				val = val[:at]
+			}
+			p, err := strconv.ParseFloat(val, 64)
+			if err != nil || p < 0 || p > 1 {
+				return nil, errors.New("fault: invalid probability %q for %s", val, point)
+			}
+			switch name {
+			case "drop":
+				rule.Drop = p
+			case "delay":
+				rule.Delay = p
+			case "corrupt":
+				rule.Corrupt = p
+			default:
+				return nil, errors.New("fault: unknown fault %q for %s", name, point)
+			}
+		}
+		rules[point] = rule
+	}
+	return rules, nil
+}
@@ -0,0 +1,30 @@
+// Copyright 2018 David Lazar. All rights reserved.
+// Use of this source code is governed by the GNU AGPL
+// license that can be found in the LICENSE file.
+
+package fault
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseSpec(t *testing.T) {
+	rules, err := ParseSpec("edhttp=drop:0.1,delay:0.2@500ms; pkg.db=corrupt:1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := Rule{Drop: 0.1, Delay: 0.2, MaxDelay: 500 * time.Millisecond}
+	if rules[EdHTTP] != want {
+		t.Fatalf("edhttp: got %+v, want %+v", rules[EdHTTP], want)
+	}
+	if rules[PKGDB] != (Rule{Corrupt: 1}) {
+		t.Fatalf("pkg.db: got %+v", rules[PKGDB])
+	}
+
+	for _, bad := range []string{"edhttp", "edhttp=drop", "edhttp=drop:2", "edhttp=delay:0.5", "edhttp=explode:0.1"} {
+		if _, err := ParseSpec(bad); err == nil {
+			t.Fatalf("expected error parsing %q", bad)
+		}
+	}
+}
@@ -0,0 +1,268 @@
+// Copyright 2018 David Lazar. All rights reserved.
+// Use of this source code is governed by the GNU AGPL
+// license that can be found in the LICENSE file.
+
+// Package happyeyeballs dials TCP connections to dual-stack hosts as
+// described in RFC 8305: it looks up both A and AAAA records, orders
+// the addresses by alternating IPv6 and IPv4, and races connection
+// attempts so a broken address family costs a short delay instead of
+// a timeout.
+package happyeyeballs
+
+import (
+	"context"
+	"net"
+	"time"
+
+	"vuvuzela.io/alpenhorn/errors"
+)
+
+// Defaults recommended by RFC 8305.
+const (
+	DefaultResolutionDelay = 50 * time.Millisecond
+	DefaultAttemptDelay    = 250 * time.Millisecond
+)
+
+type Dialer struct {
+	// Resolver looks up host names. If nil, net.DefaultResolver is used.
+	Resolver *net.Resolver
+
+	// ResolutionDelay is how long to wait for the AAAA answer after
+	// the A answer arrives. If zero, DefaultResolutionDelay is used.
+	ResolutionDelay time.Duration
+
+	// AttemptDelay is how long to wait for a connection attempt before
+	// starting the next one. If zero, DefaultAttemptDelay is used.
+	AttemptDelay time.Duration
+
+	// Timeout limits the entire dial, including name resolution.
+	// If zero, only the context limits the dial.
+	Timeout time.Duration
+}
+
+var defaultDialer = new(Dialer)
+
+// DialContext dials address with the default Dialer.
+func DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	return defaultDialer.DialContext(ctx, network, address)
+}
+
+// Dial dials address with the default Dialer.
+func Dial(network, address string) (net.Conn, error) {
+	return defaultDialer.DialContext(context.Background(), network, address)
+}
+
+// DialContext connects to address on the named network. Networks
+// other than "tcp", "tcp4", and "tcp6" are dialed with net.Dialer.
+func (d *Dialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	switch network {
+	case "tcp", "tcp4", "tcp6":
+	default:
+		return new(net.Dialer).DialContext(ctx, network, address)
+	}
+
+	if d.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, d.Timeout)
+		defer cancel()
+	}
+
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, err
+	}
+	var ips []net.IP
+	if ip := net.ParseIP(host); ip != nil {
+		ips = []net.IP{ip}
+	} else {
+		ips, err = d.resolve(ctx, network, host)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	addrs := make([]string, len(ips))
+	for i, ip := range Interleave(ips) {
+		addrs[i] = net.JoinHostPort(ip.String(), port)
+	}
+	return d.race(ctx, network, addrs)
+}
+
+type lookupResult struct {
+	ipv6 bool
+	ips  []net.IP
+	err  error
+}
+
+// resolve looks up the A and AAAA records of host concurrently. If the
+// A answer arrives first, resolve waits ResolutionDelay for the AAAA
+// answer before giving up on it.
+func (d *Dialer) resolve(ctx context.Context, network, host string) ([]net.IP, error) {
+	resolver := d.Resolver
+	if resolver == nil {
+		resolver = net.DefaultResolver
+	}
+
+	var families []string
+	switch network {
+	case "tcp4":
+		families = []string{"ip4"}
+	case "tcp6":
+		families = []string{"ip6"}
+	default:
+		families = []string{"ip6", "ip4"}
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	results := make(chan lookupResult, len(families))
+	for _, family := range families {
+		go func(family string) {
+			ips, err := resolver.LookupIP(ctx, family, host)
+			results <- lookupResult{ipv6: family == "ip6", ips: ips, err: err}
+		}(family)
+	}
+
+	var ipv4, ipv6 []net.IP
+	var firstErr error
+	var resolutionDelay <-chan time.Time
+loop:
+	for pending := len(families); pending > 0; pending-- {
+		var r lookupResult
+		select {
+		case r = <-results:
+		case <-resolutionDelay:
+			// Give up on the AAAA answer.
+			break loop
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+		if r.err != nil {
+			if firstErr == nil {
+				firstErr = r.err
+			}
+			continue
+		}
+		if r.ipv6 {
+			ipv6 = r.ips
+		} else {
+			ipv4 = r.ips
+			if len(ipv4) > 0 && pending > 1 {
+				resolutionDelay = time.After(d.resolutionDelay())
+			}
+		}
+	}
+
+	ips := append(ipv6, ipv4...)
+	if len(ips) == 0 {
+		if firstErr != nil {
+			return nil, firstErr
+		}
+		return nil, errors.New("no addresses found for %s", host)
+	}
+	return ips, nil
+}
+
+type dialResult struct {
+	conn net.Conn
+	err  error
+}
+
+// race dials addrs in order, starting the next attempt when the
+// previous one fails or AttemptDelay passes, and returns the first
+// connection to succeed.
+func (d *Dialer) race(ctx context.Context, network string, addrs []string) (net.Conn, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	results := make(chan dialResult)
+	next, pending := 0, 0
+	start := func() {
+		addr := addrs[next]
+		next++
+		pending++
+		go func() {
+			conn, err := new(net.Dialer).DialContext(ctx, network, addr)
+			select {
+			case results <- dialResult{conn, err}:
+			case <-ctx.Done():
+				if conn != nil {
+					conn.Close()
+				}
+			}
+		}()
+	}
+
+	start()
+	timer := time.NewTimer(d.attemptDelay())
+	defer timer.Stop()
+
+	var firstErr error
+	for {
+		select {
+		case r := <-results:
+			pending--
+			if r.err == nil {
+				return r.conn, nil
+			}
+			if firstErr == nil {
+				firstErr = r.err
+			}
+			if next < len(addrs) {
+				start()
+				timer.Reset(d.attemptDelay())
+			} else if pending == 0 {
+				return nil, firstErr
+			}
+		case <-timer.C:
+			if next < len(addrs) {
+				start()
+				timer.Reset(d.attemptDelay())
+			}
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// Interleave orders addresses by alternating address families,
+// starting with the family of the first address, as recommended by
+// RFC 8305 section 4. The order within each family is kept.
+func Interleave(ips []net.IP) []net.IP {
+	if len(ips) == 0 {
+		return ips
+	}
+	var first, second []net.IP
+	firstIsIPv4 := ips[0].To4() != nil
+	for _, ip := range ips {
+		if (ip.To4() != nil) == firstIsIPv4 {
+			first = append(first, ip)
+		} else {
+			second = append(second, ip)
+		}
+	}
+	out := make([]net.IP, 0, len(ips))
+	for i := 0; i < len(first) || i < len(second); i++ {
+		if i < len(first) {
+			out = append(out, first[i])
+		}
+		if i < len(second) {
+			out = append(out, second[i])
+		}
+	}
+	return out
+}
+
+func (d *Dialer) resolutionDelay() time.Duration {
+	if d.ResolutionDelay > 0 {
+		return d.ResolutionDelay
+	}
+	return DefaultResolutionDelay
+}
+
+func (d *Dialer) attemptDelay() time.Duration {
+	if d.AttemptDelay > 0 {
+		return d.AttemptDelay
+	}
+	return DefaultAttemptDelay
+}
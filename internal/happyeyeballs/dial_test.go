@@ -0,0 +1,73 @@
+// Copyright 2018 David Lazar. All rights reserved.
+// Use of this source code is governed by the GNU AGPL
+// license that can be found in the LICENSE file.
+
+package happyeyeballs
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestInterleave(t *testing.T) {
+	ips := []net.IP{
+		net.ParseIP("2001:db8::1"),
+		net.ParseIP("2001:db8::2"),
+		net.ParseIP("2001:db8::3"),
+		net.ParseIP("192.0.2.1"),
+		net.ParseIP("192.0.2.2"),
+	}
+	want := []string{"2001:db8::1", "192.0.2.1", "2001:db8::2", "192.0.2.2", "2001:db8::3"}
+	got := Interleave(ips)
+	if len(got) != len(want) {
+		t.Fatalf("got %d addresses, want %d", len(got), len(want))
+	}
+	for i := range want {
+		if got[i].String() != want[i] {
+			t.Fatalf("address %d: got %s, want %s", i, got[i], want[i])
+		}
+	}
+}
+
+func TestRaceFallback(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			c.Close()
+		}
+	}()
+	_, port, _ := net.SplitHostPort(l.Addr().String())
+
+	// A blackholed address should cost one attempt delay, not a timeout.
+	d := &Dialer{AttemptDelay: 50 * time.Millisecond, Timeout: 5 * time.Second}
+	addrs := []string{
+		net.JoinHostPort("192.0.2.1", port),
+		net.JoinHostPort("127.0.0.1", port),
+	}
+	start := time.Now()
+	conn, err := d.race(context.Background(), "tcp", addrs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Fatalf("dial took %s", elapsed)
+	}
+
+	// An IP literal is dialed directly.
+	conn, err = d.DialContext(context.Background(), "tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+}
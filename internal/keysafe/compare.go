@@ -0,0 +1,21 @@
+// Copyright 2018 David Lazar. All rights reserved.
+// Use of this source code is governed by the GNU AGPL
+// license that can be found in the LICENSE file.
+
+package keysafe
+
+import "crypto/subtle"
+
+// Equal reports whether a and b are equal without leaking, through
+// timing, where they differ. Use it for keys, tokens, signatures and
+// other values an attacker might guess byte by byte. The lengths of
+// a and b are not secret.
+func Equal(a, b []byte) bool {
+	return subtle.ConstantTimeCompare(a, b) == 1
+}
+
+// EqualString is like Equal for strings, such as passwords and
+// registration tokens.
+func EqualString(a, b string) bool {
+	return subtle.ConstantTimeCompare([]byte(a), []byte(b)) == 1
+}
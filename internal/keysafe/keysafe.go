@@ -0,0 +1,90 @@
+// Copyright 2018 David Lazar. All rights reserved.
+// Use of this source code is governed by the GNU AGPL
+// license that can be found in the LICENSE file.
+
+// Package keysafe limits how long secret key material stays in memory
+// and provides constant-time comparisons for secret-dependent checks.
+//
+// Go's garbage collector may copy or retain memory, so zeroing is a
+// best-effort defense: it shrinks the window in which secrets can leak
+// through core dumps or swap, but it is not a guarantee.
+package keysafe
+
+import (
+	"crypto/ed25519"
+	"runtime"
+	"sync"
+)
+
+// Zero overwrites b with zeros.
+func Zero(b []byte) {
+	for i := range b {
+		b[i] = 0
+	}
+	runtime.KeepAlive(b)
+}
+
+// Zero32 overwrites a fixed-size key, such as a box private key.
+func Zero32(k *[32]byte) {
+	if k == nil {
+		return
+	}
+	Zero(k[:])
+}
+
+// Secret holds key material in a buffer that is zeroed (and unlocked)
+// when the secret is destroyed.
+type Secret struct {
+	mu     sync.Mutex
+	buf    []byte
+	locked bool
+}
+
+// New copies b into a new Secret and zeros b.
+func New(b []byte) *Secret {
+	s := &Secret{
+		buf: make([]byte, len(b)),
+	}
+	copy(s.buf, b)
+	Zero(b)
+	return s
+}
+
+// Lock locks the secret's memory so it is not written to swap.
+// Lock returns an error if the platform or the process's resource
+// limits do not allow locking memory.
+func (s *Secret) Lock() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.locked || len(s.buf) == 0 {
+		return nil
+	}
+	if err := mlock(s.buf); err != nil {
+		return err
+	}
+	s.locked = true
+	return nil
+}
+
+// Bytes returns the secret's buffer. The result must not be used after
+// the secret is destroyed.
+func (s *Secret) Bytes() []byte {
+	return s.buf
+}
+
+// Ed25519 returns the secret as an ed25519 private key, sharing the
+// secret's buffer.
+func (s *Secret) Ed25519() ed25519.PrivateKey {
+	return ed25519.PrivateKey(s.buf)
+}
+
+// Destroy zeros and unlocks the secret's memory.
+func (s *Secret) Destroy() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	Zero(s.buf)
+	if s.locked {
+		munlock(s.buf)
+		s.locked = false
+	}
+}
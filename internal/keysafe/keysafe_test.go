@@ -0,0 +1,55 @@
+// Copyright 2018 David Lazar. All rights reserved.
+// Use of this source code is governed by the GNU AGPL
+// license that can be found in the LICENSE file.
+
+package keysafe
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"testing"
+
+	"vuvuzela.io/crypto/rand"
+)
+
+func TestSecret(t *testing.T) {
+	pub, priv, _ := ed25519.GenerateKey(rand.Reader)
+	orig := append([]byte(nil), priv...)
+
+	s := New(priv)
+	if !bytes.Equal(priv, make([]byte, len(priv))) {
+		t.Fatal("New did not zero its argument")
+	}
+	if !bytes.Equal(s.Bytes(), orig) {
+		t.Fatal("secret does not match original key")
+	}
+
+	// Locking may fail under a low RLIMIT_MEMLOCK; that is not an error here.
+	if err := s.Lock(); err != nil {
+		t.Logf("Lock: %s", err)
+	}
+
+	key := s.Ed25519()
+	sig := ed25519.Sign(key, []byte("hello"))
+	if !ed25519.Verify(pub, []byte("hello"), sig) {
+		t.Fatal("signature from secret key does not verify")
+	}
+
+	s.Destroy()
+	if !bytes.Equal(key, make([]byte, len(key))) {
+		t.Fatal("Destroy did not zero the key")
+	}
+}
+
+func TestEqual(t *testing.T) {
+	a := []byte("token-1234")
+	if !Equal(a, []byte("token-1234")) {
+		t.Fatal("Equal returned false for equal inputs")
+	}
+	if Equal(a, []byte("token-1235")) || Equal(a, []byte("token-123")) {
+		t.Fatal("Equal returned true for different inputs")
+	}
+	if !EqualString("", "") || EqualString("secret", "Secret") {
+		t.Fatal("EqualString returned the wrong result")
+	}
+}
@@ -0,0 +1,16 @@
+// Copyright 2018 David Lazar. All rights reserved.
+// Use of this source code is governed by the GNU AGPL
+// license that can be found in the LICENSE file.
+
+//go:build !linux && !darwin && !freebsd && !netbsd && !openbsd
+// +build !linux,!darwin,!freebsd,!netbsd,!openbsd
+
+package keysafe
+
+import "vuvuzela.io/alpenhorn/errors"
+
+func mlock(b []byte) error {
+	return errors.New("mlock is not supported on this platform")
+}
+
+func munlock(b []byte) {}
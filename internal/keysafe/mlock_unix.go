@@ -0,0 +1,18 @@
+// Copyright 2018 David Lazar. All rights reserved.
+// Use of this source code is governed by the GNU AGPL
+// license that can be found in the LICENSE file.
+
+//go:build linux || darwin || freebsd || netbsd || openbsd
+// +build linux darwin freebsd netbsd openbsd
+
+package keysafe
+
+import "golang.org/x/sys/unix"
+
+func mlock(b []byte) error {
+	return unix.Mlock(b)
+}
+
+func munlock(b []byte) {
+	unix.Munlock(b)
+}
@@ -0,0 +1,67 @@
+// Copyright 2018 David Lazar. All rights reserved.
+// Use of this source code is governed by the GNU AGPL
+// license that can be found in the LICENSE file.
+
+// Package meter counts the bytes sent and received on connections.
+package meter
+
+import (
+	"net"
+	"sync/atomic"
+)
+
+// A Counter accumulates byte counts. It is safe for concurrent use.
+type Counter struct {
+	sent     uint64
+	received uint64
+}
+
+func (c *Counter) Add(sent, received int) {
+	if sent > 0 {
+		atomic.AddUint64(&c.sent, uint64(sent))
+	}
+	if received > 0 {
+		atomic.AddUint64(&c.received, uint64(received))
+	}
+}
+
+// Load returns the bytes counted so far.
+func (c *Counter) Load() (sent, received uint64) {
+	return atomic.LoadUint64(&c.sent), atomic.LoadUint64(&c.received)
+}
+
+// Reset sets the counts to zero and returns the counts before the
+// reset, so no bytes are lost between reading and resetting.
+func (c *Counter) Reset() (sent, received uint64) {
+	return atomic.SwapUint64(&c.sent, 0), atomic.SwapUint64(&c.received, 0)
+}
+
+// Conn returns conn with its reads and writes reported to count.
+// If count is nil, Conn returns conn unchanged.
+func Conn(conn net.Conn, count func(sent, received int)) net.Conn {
+	if count == nil {
+		return conn
+	}
+	return &meteredConn{Conn: conn, count: count}
+}
+
+type meteredConn struct {
+	net.Conn
+	count func(sent, received int)
+}
+
+func (c *meteredConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	if n > 0 {
+		c.count(0, n)
+	}
+	return n, err
+}
+
+func (c *meteredConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	if n > 0 {
+		c.count(n, 0)
+	}
+	return n, err
+}
@@ -0,0 +1,48 @@
+// Copyright 2018 David Lazar. All rights reserved.
+// Use of this source code is governed by the GNU AGPL
+// license that can be found in the LICENSE file.
+
+package meter
+
+import (
+	"io"
+	"net"
+	"testing"
+)
+
+func TestConn(t *testing.T) {
+	a, b := net.Pipe()
+	defer b.Close()
+
+	var c Counter
+	conn := Conn(a, c.Add)
+	defer conn.Close()
+
+	go func() {
+		buf := make([]byte, 5)
+		io.ReadFull(b, buf)
+		b.Write([]byte("hi"))
+	}()
+
+	if _, err := conn.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 2)
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		t.Fatal(err)
+	}
+
+	if sent, received := c.Load(); sent != 5 || received != 2 {
+		t.Fatalf("got sent=%d received=%d, want 5 and 2", sent, received)
+	}
+	if sent, received := c.Reset(); sent != 5 || received != 2 {
+		t.Fatalf("Reset returned sent=%d received=%d, want 5 and 2", sent, received)
+	}
+	if sent, received := c.Load(); sent != 0 || received != 0 {
+		t.Fatalf("after Reset: sent=%d received=%d", sent, received)
+	}
+
+	if Conn(a, nil) != a {
+		t.Fatal("Conn with nil count should return the conn unchanged")
+	}
+}
@@ -0,0 +1,61 @@
+// Copyright 2018 David Lazar. All rights reserved.
+// Use of this source code is governed by the GNU AGPL
+// license that can be found in the LICENSE file.
+
+package metrics
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestWriteTo(t *testing.T) {
+	r := NewRegistry()
+	requests := r.Counter("requests_total", "Requests served.", "path", "code")
+	round := r.Gauge("round", "The latest round.")
+	latency := r.Histogram("latency_seconds", "Request latency.", []float64{0.1, 1})
+
+	requests.Inc("/extract", "200")
+	requests.Add(2, "/extract", "200")
+	requests.Inc("/register", "403")
+	requests.Inc("/a\"b", "200")
+	requests.Delete("/a\"b", "200")
+	round.Set(42)
+	latency.Observe(0.05)
+	latency.Observe(0.5)
+	latency.Observe(5)
+
+	buf := new(bytes.Buffer)
+	if _, err := r.WriteTo(buf); err != nil {
+		t.Fatal(err)
+	}
+	want := `# HELP requests_total Requests served.
+# TYPE requests_total counter
+requests_total{path="/extract",code="200"} 3
+requests_total{path="/register",code="403"} 1
+# HELP round The latest round.
+# TYPE round gauge
+round 42
+# HELP latency_seconds Request latency.
+# TYPE latency_seconds histogram
+latency_seconds_bucket{le="0.1"} 1
+latency_seconds_bucket{le="1"} 2
+latency_seconds_bucket{le="+Inf"} 3
+latency_seconds_sum 5.55
+latency_seconds_count 3
+`
+	if buf.String() != want {
+		t.Fatalf("got:\n%s\nwant:\n%s", buf, want)
+	}
+}
+
+func TestEscapeLabel(t *testing.T) {
+	r := NewRegistry()
+	r.Counter("c", "A \\ help\nstring.", "l").Inc("a\"b\\c\nd")
+	buf := new(bytes.Buffer)
+	r.WriteTo(buf)
+	want := "# HELP c A \\\\ help\\nstring.\n# TYPE c counter\nc{l=\"a\\\"b\\\\c\\nd\"} 1\n"
+	if buf.String() != want {
+		t.Fatalf("got %q, want %q", buf, want)
+	}
+}
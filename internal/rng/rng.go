@@ -0,0 +1,262 @@
+// Copyright 2018 David Lazar. All rights reserved.
+// Use of this source code is governed by the GNU AGPL
+// license that can be found in the LICENSE file.
+
+// Package rng provides a supervised source of randomness for noise
+// generation and shuffling.
+//
+// Output is the XOR of the operating system's randomness and a
+// process-local AES-CTR DRBG seeded from it, so a single weak source
+// does not make the output predictable. The operating system source
+// is checked continuously; once a check fails the source stays failed
+// and every read returns an error. Servers should run SelfTest at
+// startup and check Err before each round so that they fail closed.
+package rng
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	crand "crypto/rand"
+	"crypto/sha256"
+	"io"
+	"math"
+	"sync"
+
+	"vuvuzela.io/alpenhorn/errors"
+)
+
+const (
+	// blockSize is the granularity of the stuck-output test.
+	blockSize = 16
+
+	// repetitionCutoff is the number of identical consecutive bytes
+	// from the entropy source that counts as a failure. A healthy
+	// source produces this by chance with probability about 2^-56.
+	repetitionCutoff = 8
+
+	// reseedInterval is how many bytes the DRBG produces before it
+	// mixes in fresh entropy.
+	reseedInterval = 1 << 20
+)
+
+// Source is a supervised random source. It is safe for concurrent use.
+type Source struct {
+	entropy io.Reader
+
+	mu        sync.Mutex
+	err       error
+	key       [32]byte
+	seeded    bool
+	generated int
+	prevBlock [blockSize]byte
+	havePrev  bool
+	lastByte  byte
+	runLength int
+}
+
+// NewSource returns a Source that draws entropy from r.
+func NewSource(r io.Reader) *Source {
+	return &Source{entropy: r}
+}
+
+// Default draws entropy from crypto/rand.
+var Default = NewSource(crand.Reader)
+
+// Reader is Default as an io.Reader.
+var Reader io.Reader = Default
+
+// Read fills b from Default.
+func Read(b []byte) (int, error) {
+	return Default.Read(b)
+}
+
+// Err returns Default's failure, if any.
+func Err() error {
+	return Default.Err()
+}
+
+// SelfTest runs Default's startup self-tests.
+func SelfTest() error {
+	return Default.SelfTest()
+}
+
+// Laplace samples Default; see (*Source).Laplace.
+func Laplace(mu, b float64) uint32 {
+	return Default.Laplace(mu, b)
+}
+
+// Err returns the error that caused s to fail, or nil if s is healthy.
+func (s *Source) Err() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.err
+}
+
+func (s *Source) failLocked(err error) error {
+	if s.err == nil {
+		s.err = err
+	}
+	return s.err
+}
+
+// Read fills b with random bytes. It returns an error, and leaves s
+// failed, if the entropy source fails a health check.
+func (s *Source) Read(b []byte) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.err != nil {
+		return 0, s.err
+	}
+	if !s.seeded || s.generated >= reseedInterval {
+		if err := s.reseedLocked(); err != nil {
+			return 0, err
+		}
+	}
+
+	if err := s.readEntropyLocked(b); err != nil {
+		return 0, err
+	}
+	drbg := s.generateLocked(len(b))
+	for i := range b {
+		b[i] ^= drbg[i]
+	}
+	return len(b), nil
+}
+
+// readEntropyLocked reads from the entropy source and runs the
+// continuous health tests on its output.
+func (s *Source) readEntropyLocked(b []byte) error {
+	if _, err := io.ReadFull(s.entropy, b); err != nil {
+		return s.failLocked(errors.Wrap(err, "rng: reading entropy source"))
+	}
+
+	for _, x := range b {
+		if s.runLength > 0 && x == s.lastByte {
+			s.runLength++
+			if s.runLength >= repetitionCutoff {
+				return s.failLocked(errors.New("rng: entropy source repeated byte %#02x %d times", x, s.runLength))
+			}
+		} else {
+			s.lastByte = x
+			s.runLength = 1
+		}
+	}
+
+	for i := 0; i+blockSize <= len(b); i += blockSize {
+		var block [blockSize]byte
+		copy(block[:], b[i:i+blockSize])
+		if s.havePrev && block == s.prevBlock {
+			return s.failLocked(errors.New("rng: entropy source produced a repeated block"))
+		}
+		s.prevBlock = block
+		s.havePrev = true
+	}
+	return nil
+}
+
+// reseedLocked mixes fresh entropy into the DRBG key.
+func (s *Source) reseedLocked() error {
+	var seed [32]byte
+	if err := s.readEntropyLocked(seed[:]); err != nil {
+		return err
+	}
+	h := sha256.New()
+	h.Write(s.key[:])
+	h.Write(seed[:])
+	h.Sum(s.key[:0])
+	s.seeded = true
+	s.generated = 0
+	return nil
+}
+
+// generateLocked returns n bytes from the DRBG and replaces the key
+// with fresh output so that earlier output cannot be recovered.
+func (s *Source) generateLocked(n int) []byte {
+	out := drbgGenerate(&s.key, n)
+	s.generated += n
+	return out
+}
+
+func drbgGenerate(key *[32]byte, n int) []byte {
+	block, err := aes.NewCipher(key[:])
+	if err != nil {
+		panic(err)
+	}
+	var iv [aes.BlockSize]byte
+	buf := make([]byte, len(key)+n)
+	cipher.NewCTR(block, iv[:]).XORKeyStream(buf, buf)
+	copy(key[:], buf[:len(key)])
+	return buf[len(key):]
+}
+
+// SelfTest runs a known-answer test of the DRBG and statistical tests
+// of the entropy source. A failing self-test leaves s failed.
+func (s *Source) SelfTest() error {
+	var key [32]byte
+	for i := range key {
+		key[i] = byte(i)
+	}
+	got := drbgGenerate(&key, len(drbgKnownAnswer))
+	if string(got) != string(drbgKnownAnswer) {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		return s.failLocked(errors.New("rng: DRBG known-answer test failed"))
+	}
+
+	// FIPS 140-2 monobit test over 20,000 bits.
+	sample := make([]byte, 2500)
+	s.mu.Lock()
+	err := s.readEntropyLocked(sample)
+	s.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	ones := 0
+	for _, x := range sample {
+		for ; x != 0; x &= x - 1 {
+			ones++
+		}
+	}
+	if ones <= 9725 || ones >= 10275 {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		return s.failLocked(errors.New("rng: entropy source failed monobit test (%d ones in 20000 bits)", ones))
+	}
+
+	_, err = s.Read(sample)
+	return err
+}
+
+// Laplace returns a sample from the Laplace distribution with location
+// mu and scale b, rounded down and clamped to the range of a uint32.
+// It panics if s has failed, so noise is never generated from a bad
+// source; callers should check Err first.
+func (s *Source) Laplace(mu, b float64) uint32 {
+	var buf [8]byte
+	if _, err := s.Read(buf[:]); err != nil {
+		panic(err)
+	}
+	var x uint64
+	for _, c := range buf {
+		x = x<<8 | uint64(c)
+	}
+	// Uniform in the open interval (-0.5, 0.5).
+	u := (float64(x>>11)+0.5)/(1<<53) - 0.5
+	v := mu - b*math.Copysign(1, u)*math.Log(1-2*math.Abs(u))
+	if v <= 0 {
+		return 0
+	}
+	if v >= math.MaxUint32 {
+		return math.MaxUint32
+	}
+	return uint32(v)
+}
+
+// drbgKnownAnswer is the DRBG output for the key 00 01 02 ... 1f.
+var drbgKnownAnswer = []byte{
+	0x0e, 0xbc, 0xb5, 0xde, 0xb5, 0x2c, 0x83, 0xbd,
+	0x08, 0xa8, 0xa9, 0x35, 0x18, 0x2c, 0x91, 0x99,
+	0xd2, 0x43, 0x56, 0x53, 0x28, 0x81, 0x60, 0x2f,
+	0x80, 0x9e, 0xb3, 0x83, 0xc5, 0xff, 0x5d, 0x56,
+}
@@ -0,0 +1,119 @@
+// Copyright 2018 David Lazar. All rights reserved.
+// Use of this source code is governed by the GNU AGPL
+// license that can be found in the LICENSE file.
+
+package rng
+
+import (
+	"bytes"
+	crand "crypto/rand"
+	"io"
+	"testing"
+)
+
+func TestSelfTest(t *testing.T) {
+	s := NewSource(crand.Reader)
+	if err := s.SelfTest(); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Err(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+type zeroReader struct{}
+
+func (zeroReader) Read(b []byte) (int, error) {
+	for i := range b {
+		b[i] = 0
+	}
+	return len(b), nil
+}
+
+func TestStuckSource(t *testing.T) {
+	s := NewSource(zeroReader{})
+	if err := s.SelfTest(); err == nil {
+		t.Fatal("self-test passed with a stuck entropy source")
+	}
+	if _, err := s.Read(make([]byte, 32)); err == nil {
+		t.Fatal("read succeeded after the source failed")
+	}
+}
+
+// repeatReader returns the same random block forever.
+type repeatReader struct {
+	block [blockSize]byte
+}
+
+func (r *repeatReader) Read(b []byte) (int, error) {
+	for i := range b {
+		b[i] = r.block[i%blockSize]
+	}
+	return len(b), nil
+}
+
+func TestRepeatedBlock(t *testing.T) {
+	r := new(repeatReader)
+	crand.Read(r.block[:])
+	s := NewSource(r)
+	if _, err := s.Read(make([]byte, 64)); err == nil {
+		t.Fatal("expected repeated block to be detected")
+	}
+	if s.Err() == nil {
+		t.Fatal("source did not stay failed")
+	}
+}
+
+func TestBrokenSource(t *testing.T) {
+	s := NewSource(bytes.NewReader(make([]byte, 0)))
+	if _, err := s.Read(make([]byte, 8)); err == nil {
+		t.Fatal("expected error from exhausted entropy source")
+	}
+	if s.Err() == nil {
+		t.Fatal("source did not stay failed")
+	}
+}
+
+func TestOutputIsMixed(t *testing.T) {
+	// Even with identical entropy, two sources seeded differently
+	// must produce different output.
+	entropy := make([]byte, 1024)
+	crand.Read(entropy)
+	a := NewSource(bytes.NewReader(entropy))
+	b := NewSource(bytes.NewReader(entropy))
+	a.key[0] = 1
+
+	outA := make([]byte, 64)
+	outB := make([]byte, 64)
+	if _, err := io.ReadFull(a, outA); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.ReadFull(b, outB); err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Equal(outA, outB) {
+		t.Fatal("DRBG output was not mixed in")
+	}
+	if bytes.Equal(outA, entropy[32:96]) {
+		t.Fatal("output equals raw entropy")
+	}
+}
+
+func TestLaplace(t *testing.T) {
+	s := NewSource(crand.Reader)
+	const n = 20000
+	const mu = 100
+	sum := 0.0
+	for i := 0; i < n; i++ {
+		sum += float64(s.Laplace(mu, 3))
+	}
+	mean := sum / n
+	// Flooring shifts the mean down by about 0.5.
+	if mean < mu-1.5 || mean > mu+0.5 {
+		t.Fatalf("mean of Laplace(%d, 3) samples is %.2f", mu, mean)
+	}
+
+	if x := s.Laplace(-1000, 1); x != 0 {
+		t.Fatalf("negative samples should clamp to 0, got %d", x)
+	}
+}
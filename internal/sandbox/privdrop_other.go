@@ -0,0 +1,24 @@
+// Copyright 2018 David Lazar. All rights reserved.
+// Use of this source code is governed by the GNU AGPL
+// license that can be found in the LICENSE file.
+
+//go:build !linux && !darwin && !freebsd && !netbsd && !openbsd
+// +build !linux,!darwin,!freebsd,!netbsd,!openbsd
+
+package sandbox
+
+import "vuvuzela.io/alpenhorn/errors"
+
+type credential struct{}
+
+func lookupUser(name string) (*credential, error) {
+	return nil, errors.New("switching users is not supported on this platform")
+}
+
+func chroot(dir string) error {
+	return errors.New("chroot is not supported on this platform")
+}
+
+func setCredential(cred *credential) error {
+	return errors.New("switching users is not supported on this platform")
+}
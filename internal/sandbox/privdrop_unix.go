@@ -0,0 +1,85 @@
+// Copyright 2018 David Lazar. All rights reserved.
+// Use of this source code is governed by the GNU AGPL
+// license that can be found in the LICENSE file.
+
+//go:build linux || darwin || freebsd || netbsd || openbsd
+// +build linux darwin freebsd netbsd openbsd
+
+package sandbox
+
+import (
+	"os"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"syscall"
+
+	"vuvuzela.io/alpenhorn/errors"
+)
+
+type credential struct {
+	uid    int
+	gid    int
+	groups []int
+}
+
+func lookupUser(name string) (*credential, error) {
+	u, err := user.Lookup(name)
+	if err != nil {
+		return nil, err
+	}
+	cred := new(credential)
+	if cred.uid, err = strconv.Atoi(u.Uid); err != nil {
+		return nil, errors.New("user %s has non-numeric uid %q", name, u.Uid)
+	}
+	if cred.gid, err = strconv.Atoi(u.Gid); err != nil {
+		return nil, errors.New("user %s has non-numeric gid %q", name, u.Gid)
+	}
+	gids, err := u.GroupIds()
+	if err != nil {
+		return nil, err
+	}
+	for _, g := range gids {
+		gid, err := strconv.Atoi(g)
+		if err != nil {
+			return nil, errors.New("user %s has non-numeric group %q", name, g)
+		}
+		cred.groups = append(cred.groups, gid)
+	}
+	if cred.uid == 0 {
+		return nil, errors.New("user %s is root", name)
+	}
+	return cred, nil
+}
+
+func chroot(dir string) error {
+	wd, err := chrootWorkDir(dir)
+	if err != nil {
+		return err
+	}
+	dir, err = filepath.Abs(dir)
+	if err != nil {
+		return err
+	}
+	if err := syscall.Chroot(dir); err != nil {
+		return err
+	}
+	return os.Chdir(wd)
+}
+
+func setCredential(cred *credential) error {
+	if err := syscall.Setgroups(cred.groups); err != nil {
+		return err
+	}
+	if err := syscall.Setgid(cred.gid); err != nil {
+		return err
+	}
+	if err := syscall.Setuid(cred.uid); err != nil {
+		return err
+	}
+	// Make sure the change cannot be undone.
+	if err := syscall.Setuid(0); err == nil {
+		return errors.New("regained root after dropping privileges")
+	}
+	return nil
+}
@@ -0,0 +1,15 @@
+// Copyright 2018 David Lazar. All rights reserved.
+// Use of this source code is governed by the GNU AGPL
+// license that can be found in the LICENSE file.
+
+//go:build !openbsd && !(linux && (amd64 || arm64))
+// +build !openbsd
+// +build !linux !amd64,!arm64
+
+package sandbox
+
+import "vuvuzela.io/alpenhorn/errors"
+
+func restrict(writable []string) error {
+	return errors.New("not supported on this platform")
+}
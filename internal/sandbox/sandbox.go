@@ -0,0 +1,101 @@
+// Copyright 2018 David Lazar. All rights reserved.
+// Use of this source code is governed by the GNU AGPL
+// license that can be found in the LICENSE file.
+
+// Package sandbox reduces the privileges of the server commands once
+// they have opened their listeners, databases, and logs. A server can
+// chroot, switch to an unprivileged user, and restrict the system
+// calls it may make: on Linux with a seccomp filter, and on OpenBSD
+// with pledge and unveil.
+package sandbox
+
+import (
+	"crypto/x509"
+	"flag"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"vuvuzela.io/alpenhorn/errors"
+)
+
+// Flags are the sandboxing options shared by the server commands.
+type Flags struct {
+	User    string
+	Chroot  string
+	Sandbox bool
+}
+
+// RegisterFlags defines the sandboxing flags in fs.
+func RegisterFlags(fs *flag.FlagSet) *Flags {
+	f := new(Flags)
+	fs.StringVar(&f.User, "user", "", "switch to this user after binding listeners (requires root)")
+	fs.StringVar(&f.Chroot, "chroot", "", "chroot to this directory after binding listeners; it must contain the working directory, and etc/resolv.conf if the server resolves names")
+	fs.BoolVar(&f.Sandbox, "sandbox", false, "restrict system calls (seccomp on Linux, pledge and unveil on OpenBSD)")
+	return f
+}
+
+// Apply drops privileges as the flags ask. It should be called after
+// the server has opened everything that needs privileges, and before
+// it serves requests. writable lists the paths the server still needs
+// to write to, such as its persist directory; empty paths are ignored.
+// They are relative to the working directory or, if absolute, to the
+// chroot.
+func (f *Flags) Apply(writable ...string) error {
+	var cred *credential
+	if f.User != "" {
+		var err error
+		cred, err = lookupUser(f.User)
+		if err != nil {
+			return err
+		}
+	}
+
+	if f.Chroot != "" {
+		// Load the CA certificates while they are still in reach.
+		x509.SystemCertPool()
+		if err := chroot(f.Chroot); err != nil {
+			return errors.Wrap(err, "chroot %s", f.Chroot)
+		}
+	}
+
+	if cred != nil {
+		if err := setCredential(cred); err != nil {
+			return errors.Wrap(err, "switching to user %s", f.User)
+		}
+	}
+
+	if f.Sandbox {
+		var paths []string
+		for _, path := range writable {
+			if path != "" {
+				paths = append(paths, path)
+			}
+		}
+		if err := restrict(paths); err != nil {
+			return errors.Wrap(err, "sandbox")
+		}
+	}
+	return nil
+}
+
+// chrootWorkDir returns the working directory relative to dir, so
+// relative paths keep working after a chroot to dir.
+func chrootWorkDir(dir string) (string, error) {
+	dir, err := filepath.Abs(dir)
+	if err != nil {
+		return "", err
+	}
+	wd, err := os.Getwd()
+	if err != nil {
+		return "", err
+	}
+	rel, err := filepath.Rel(dir, wd)
+	if err != nil {
+		return "", err
+	}
+	if rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", errors.New("working directory %s is outside the chroot", wd)
+	}
+	return filepath.Join("/", rel), nil
+}
@@ -0,0 +1,30 @@
+// Copyright 2018 David Lazar. All rights reserved.
+// Use of this source code is governed by the GNU AGPL
+// license that can be found in the LICENSE file.
+
+package sandbox
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestChrootWorkDir(t *testing.T) {
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dir, err := chrootWorkDir(wd)
+	if err != nil || dir != "/" {
+		t.Fatalf("chroot to working directory: got %q, %v", dir, err)
+	}
+	dir, err = chrootWorkDir(filepath.Dir(wd))
+	if err != nil || dir != "/"+filepath.Base(wd) {
+		t.Fatalf("chroot to parent: got %q, %v", dir, err)
+	}
+	if _, err := chrootWorkDir(filepath.Join(wd, "sub")); err == nil {
+		t.Fatal("expected error for working directory outside chroot")
+	}
+}
@@ -0,0 +1,143 @@
+// Copyright 2018 David Lazar. All rights reserved.
+// Use of this source code is governed by the GNU AGPL
+// license that can be found in the LICENSE file.
+
+//go:build linux && (amd64 || arm64)
+// +build linux
+// +build amd64 arm64
+
+package sandbox
+
+import (
+	"runtime"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// deniedSyscalls are the system calls that the seccomp filter refuses
+// with EPERM. The servers never make them, but an attacker who takes
+// over a server process would need them to run programs, tamper with
+// other processes, regain privileges, or attack the kernel.
+var deniedSyscalls = []uint32{
+	unix.SYS_EXECVE,
+	unix.SYS_EXECVEAT,
+	unix.SYS_PTRACE,
+	unix.SYS_PROCESS_VM_READV,
+	unix.SYS_PROCESS_VM_WRITEV,
+	unix.SYS_KCMP,
+
+	unix.SYS_SETUID,
+	unix.SYS_SETGID,
+	unix.SYS_SETREUID,
+	unix.SYS_SETREGID,
+	unix.SYS_SETRESUID,
+	unix.SYS_SETRESGID,
+	unix.SYS_SETFSUID,
+	unix.SYS_SETFSGID,
+	unix.SYS_SETGROUPS,
+	unix.SYS_CAPSET,
+
+	unix.SYS_CHROOT,
+	unix.SYS_PIVOT_ROOT,
+	unix.SYS_MOUNT,
+	unix.SYS_UMOUNT2,
+	unix.SYS_UNSHARE,
+	unix.SYS_SETNS,
+	unix.SYS_OPEN_BY_HANDLE_AT,
+	unix.SYS_NAME_TO_HANDLE_AT,
+
+	unix.SYS_INIT_MODULE,
+	unix.SYS_FINIT_MODULE,
+	unix.SYS_DELETE_MODULE,
+	unix.SYS_KEXEC_LOAD,
+	unix.SYS_KEXEC_FILE_LOAD,
+	unix.SYS_BPF,
+	unix.SYS_PERF_EVENT_OPEN,
+	unix.SYS_USERFAULTFD,
+	unix.SYS_KEYCTL,
+	unix.SYS_ADD_KEY,
+	unix.SYS_REQUEST_KEY,
+	unix.SYS_PERSONALITY,
+
+	unix.SYS_REBOOT,
+	unix.SYS_SWAPON,
+	unix.SYS_SWAPOFF,
+	unix.SYS_ACCT,
+	unix.SYS_QUOTACTL,
+	unix.SYS_SETTIMEOFDAY,
+	unix.SYS_CLOCK_SETTIME,
+	unix.SYS_SETHOSTNAME,
+	unix.SYS_SETDOMAINNAME,
+	unix.SYS_VHANGUP,
+}
+
+var auditArch = map[string]uint32{
+	"amd64": unix.AUDIT_ARCH_X86_64,
+	"arm64": unix.AUDIT_ARCH_AARCH64,
+}
+
+// x32SyscallBit is set in the numbers of x32 system calls, which
+// share the amd64 audit arch and would bypass the filter.
+const x32SyscallBit = 0x40000000
+
+// Offsets of fields in struct seccomp_data.
+const (
+	seccompDataNR   = 0
+	seccompDataArch = 4
+)
+
+func restrict(writable []string) error {
+	filter := denyFilter(auditArch[runtime.GOARCH], runtime.GOARCH == "amd64", deniedSyscalls)
+	prog := &unix.SockFprog{
+		Len:    uint16(len(filter)),
+		Filter: &filter[0],
+	}
+	if err := unix.Prctl(unix.PR_SET_NO_NEW_PRIVS, 1, 0, 0, 0); err != nil {
+		return err
+	}
+	// TSYNC applies the filter to every thread in the process, not
+	// just the one the runtime happens to run this on.
+	_, _, errno := unix.Syscall(unix.SYS_SECCOMP,
+		unix.SECCOMP_SET_MODE_FILTER,
+		unix.SECCOMP_FILTER_FLAG_TSYNC,
+		uintptr(unsafe.Pointer(prog)))
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+// denyFilter returns a seccomp program that kills the process if it
+// makes a system call for another arch, fails the denied system calls
+// with EPERM, and allows everything else.
+func denyFilter(arch uint32, denyX32 bool, denied []uint32) []unix.SockFilter {
+	stmt := func(code uint16, k uint32) unix.SockFilter {
+		return unix.SockFilter{Code: code, K: k}
+	}
+	jump := func(code uint16, k uint32, jt, jf uint8) unix.SockFilter {
+		return unix.SockFilter{Code: code, Jt: jt, Jf: jf, K: k}
+	}
+
+	filter := []unix.SockFilter{
+		stmt(unix.BPF_LD|unix.BPF_W|unix.BPF_ABS, seccompDataArch),
+		jump(unix.BPF_JMP|unix.BPF_JEQ|unix.BPF_K, arch, 1, 0),
+		stmt(unix.BPF_RET|unix.BPF_K, unix.SECCOMP_RET_KILL_PROCESS),
+		stmt(unix.BPF_LD|unix.BPF_W|unix.BPF_ABS, seccompDataNR),
+	}
+	// Each check jumps over the remaining checks and the allow
+	// statement to the deny statement at the end.
+	checks := len(denied)
+	if denyX32 {
+		checks++
+		filter = append(filter, jump(unix.BPF_JMP|unix.BPF_JGE|unix.BPF_K, x32SyscallBit, uint8(checks), 0))
+	}
+	for i, nr := range denied {
+		remaining := len(denied) - i
+		filter = append(filter, jump(unix.BPF_JMP|unix.BPF_JEQ|unix.BPF_K, nr, uint8(remaining), 0))
+	}
+	return append(filter,
+		stmt(unix.BPF_RET|unix.BPF_K, unix.SECCOMP_RET_ALLOW),
+		stmt(unix.BPF_RET|unix.BPF_K, unix.SECCOMP_RET_ERRNO|uint32(unix.EPERM)),
+	)
+}
@@ -0,0 +1,102 @@
+// Copyright 2018 David Lazar. All rights reserved.
+// Use of this source code is governed by the GNU AGPL
+// license that can be found in the LICENSE file.
+
+//go:build linux && (amd64 || arm64)
+// +build linux
+// +build amd64 arm64
+
+package sandbox
+
+import (
+	"os"
+	"os/exec"
+	"runtime"
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+// runFilter interprets the subset of classic BPF used by denyFilter.
+func runFilter(t *testing.T, filter []unix.SockFilter, arch, nr uint32) uint32 {
+	var acc uint32
+	for pc := 0; pc < len(filter); pc++ {
+		ins := filter[pc]
+		switch ins.Code {
+		case unix.BPF_LD | unix.BPF_W | unix.BPF_ABS:
+			switch ins.K {
+			case seccompDataNR:
+				acc = nr
+			case seccompDataArch:
+				acc = arch
+			default:
+				t.Fatalf("load from unexpected offset %d", ins.K)
+			}
+		case unix.BPF_JMP | unix.BPF_JEQ | unix.BPF_K:
+			if acc == ins.K {
+				pc += int(ins.Jt)
+			} else {
+				pc += int(ins.Jf)
+			}
+		case unix.BPF_JMP | unix.BPF_JGE | unix.BPF_K:
+			if acc >= ins.K {
+				pc += int(ins.Jt)
+			} else {
+				pc += int(ins.Jf)
+			}
+		case unix.BPF_RET | unix.BPF_K:
+			return ins.K
+		default:
+			t.Fatalf("unexpected instruction %#x", ins.Code)
+		}
+	}
+	t.Fatal("filter fell off the end")
+	return 0
+}
+
+func TestDenyFilter(t *testing.T) {
+	arch := auditArch[runtime.GOARCH]
+	filter := denyFilter(arch, true, deniedSyscalls)
+	deny := unix.SECCOMP_RET_ERRNO | uint32(unix.EPERM)
+
+	for _, nr := range deniedSyscalls {
+		if got := runFilter(t, filter, arch, nr); got != deny {
+			t.Errorf("syscall %d: got %#x, want deny", nr, got)
+		}
+	}
+	for _, nr := range []uint32{unix.SYS_READ, unix.SYS_WRITE, unix.SYS_FUTEX, unix.SYS_MMAP} {
+		if got := runFilter(t, filter, arch, nr); got != unix.SECCOMP_RET_ALLOW {
+			t.Errorf("syscall %d: got %#x, want allow", nr, got)
+		}
+	}
+	if got := runFilter(t, filter, arch, x32SyscallBit|unix.SYS_READ); got != deny {
+		t.Errorf("x32 syscall: got %#x, want deny", got)
+	}
+	if got := runFilter(t, filter, arch+1, unix.SYS_READ); got != unix.SECCOMP_RET_KILL_PROCESS {
+		t.Errorf("foreign arch: got %#x, want kill", got)
+	}
+}
+
+// TestRestrict applies the filter in a child process and checks that
+// it can no longer run programs.
+func TestRestrict(t *testing.T) {
+	if os.Getenv("SANDBOX_TEST_CHILD") == "1" {
+		if err := restrict(nil); err != nil {
+			os.Exit(2)
+		}
+		if err := exec.Command("/bin/true").Run(); err == nil {
+			os.Exit(3)
+		}
+		os.Exit(0)
+	}
+
+	cmd := exec.Command(os.Args[0], "-test.run=^TestRestrict$")
+	cmd.Env = append(os.Environ(), "SANDBOX_TEST_CHILD=1")
+	err := cmd.Run()
+	if e, ok := err.(*exec.ExitError); ok && e.ExitCode() == 2 {
+		t.Skip("seccomp is not available")
+	}
+	if err != nil {
+		t.Fatalf("child: %s", err)
+	}
+}
@@ -0,0 +1,163 @@
+// Copyright 2018 David Lazar. All rights reserved.
+// Use of this source code is governed by the GNU AGPL
+// license that can be found in the LICENSE file.
+
+package sim
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/tls"
+	"crypto/x509"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"time"
+
+	"vuvuzela.io/alpenhorn/errors"
+)
+
+// DefaultHTTPTimeout is how long, in virtual time, an HTTPTransport
+// waits for a reply if its Timeout is zero.
+const DefaultHTTPTimeout = 10 * time.Second
+
+type httpRequest struct {
+	req       *http.Request
+	body      []byte
+	clientKey ed25519.PublicKey
+	exchange  *httpExchange
+}
+
+type httpReply struct {
+	resp     *http.Response
+	exchange *httpExchange
+}
+
+// An httpExchange is a request that an actor is waiting on. It is
+// finished by its reply or its timeout, whichever comes first.
+type httpExchange struct {
+	sched *Scheduler
+	done  bool
+	resp  *http.Response
+	err   error
+	c     chan struct{}
+}
+
+func (x *httpExchange) finish(resp *http.Response, err error) {
+	if x.done {
+		return
+	}
+	x.done = true
+	x.resp, x.err = resp, err
+	x.sched.wake()
+	close(x.c)
+}
+
+// ListenHTTP makes h serve the HTTP requests sent to the named node,
+// as a server whose edTLS key is key. h runs in the event that
+// delivers the request, and its reply goes back over the network.
+func (n *Network) ListenHTTP(name string, key ed25519.PublicKey, h http.Handler) {
+	if n.httpKeys == nil {
+		n.httpKeys = make(map[string]ed25519.PublicKey)
+	}
+	n.httpKeys[name] = key
+	n.Listen(name, func(from string, msg interface{}) {
+		m := msg.(*httpRequest)
+		req := m.req.Clone(context.Background())
+		req.Body = io.NopCloser(bytes.NewReader(m.body))
+		req.RequestURI = req.URL.RequestURI()
+		req.RemoteAddr = from
+		if m.clientKey != nil {
+			req.TLS = &tls.ConnectionState{
+				PeerCertificates: []*x509.Certificate{{PublicKey: m.clientKey}},
+			}
+		} else {
+			req.TLS = &tls.ConnectionState{}
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		resp := w.Result()
+		resp.Request = m.req
+		n.Send(name, from, resp.Status+" "+req.URL.Path, &httpReply{resp: resp, exchange: m.exchange})
+	})
+}
+
+// HTTPTransport carries the HTTP requests of a node over a Network to
+// the nodes that serve HTTP with ListenHTTP. It is an edhttp.Transport.
+// Its requests must be made by actors.
+type HTTPTransport struct {
+	net  *Network
+	name string
+
+	// Timeout is how long, in virtual time, a request waits for its
+	// reply before it fails. Zero means DefaultHTTPTimeout.
+	Timeout time.Duration
+}
+
+// HTTPTransport returns a transport for requests from the named node.
+// The node must not also be listening for messages.
+func (n *Network) HTTPTransport(name string) *HTTPTransport {
+	n.Listen(name, func(from string, msg interface{}) {
+		m := msg.(*httpReply)
+		m.exchange.finish(m.resp, nil)
+	})
+	return &HTTPTransport{net: n, name: name}
+}
+
+// RoundTrip sends req to the node named by its host and waits for the
+// reply. The node must serve HTTP with one of serverKeys.
+func (t *HTTPTransport) RoundTrip(req *http.Request, serverKeys []ed25519.PublicKey, clientKey ed25519.PublicKey) (*http.Response, error) {
+	var body []byte
+	if req.Body != nil {
+		var err error
+		body, err = io.ReadAll(req.Body)
+		req.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	n := t.net
+	to := req.URL.Host
+	key, ok := n.httpKeys[to]
+	if !ok {
+		return nil, errors.New("sim: no http server at %s", to)
+	}
+	if !hasKey(serverKeys, key) {
+		return nil, errors.New("sim: unexpected key for %s", to)
+	}
+
+	timeout := t.Timeout
+	if timeout == 0 {
+		timeout = DefaultHTTPTimeout
+	}
+	x := &httpExchange{
+		sched: n.Sched,
+		c:     make(chan struct{}),
+	}
+	n.Send(t.name, to, req.Method+" "+req.URL.Path, &httpRequest{
+		req:       req,
+		body:      body,
+		clientKey: clientKey,
+		exchange:  x,
+	})
+	n.Sched.After(timeout, func() {
+		if !x.done {
+			n.Sched.Tracef("%s->%s %s timed out", t.name, to, req.URL.Path)
+		}
+		x.finish(nil, errors.New("sim: %s %s timed out", req.Method, req.URL))
+	})
+	n.Sched.block()
+	<-x.c
+	return x.resp, x.err
+}
+
+func hasKey(keys []ed25519.PublicKey, key ed25519.PublicKey) bool {
+	for _, k := range keys {
+		if bytes.Equal(k, key) {
+			return true
+		}
+	}
+	return false
+}
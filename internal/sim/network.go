@@ -0,0 +1,83 @@
+// Copyright 2018 David Lazar. All rights reserved.
+// Use of this source code is governed by the GNU AGPL
+// license that can be found in the LICENSE file.
+
+package sim
+
+import (
+	"crypto/ed25519"
+	"time"
+)
+
+// Handler is called when a message is delivered to a node.
+type Handler func(from string, msg interface{})
+
+// Network simulates an unreliable network between named nodes.
+// Each message is delayed by a random amount between MinDelay and
+// MaxDelay, so messages may be delivered out of order, and each
+// message is dropped with probability DropRate.
+type Network struct {
+	Sched *Scheduler
+
+	MinDelay time.Duration
+	MaxDelay time.Duration
+	DropRate float64
+
+	nodes    map[string]Handler
+	down     map[string]bool
+	httpKeys map[string]ed25519.PublicKey
+}
+
+// NewNetwork returns a network driven by sched with the given delay
+// range and no message loss.
+func NewNetwork(sched *Scheduler, minDelay, maxDelay time.Duration) *Network {
+	return &Network{
+		Sched:    sched,
+		MinDelay: minDelay,
+		MaxDelay: maxDelay,
+	}
+}
+
+// Listen registers a handler for messages sent to the named node.
+func (n *Network) Listen(name string, h Handler) {
+	if n.nodes == nil {
+		n.nodes = make(map[string]Handler)
+	}
+	n.nodes[name] = h
+}
+
+// SetDown marks a node as crashed (or recovered). Messages to and
+// from a crashed node are silently lost.
+func (n *Network) SetDown(name string, down bool) {
+	if n.down == nil {
+		n.down = make(map[string]bool)
+	}
+	n.down[name] = down
+}
+
+// Send sends msg from one node to another. The kind is only used
+// for the trace.
+func (n *Network) Send(from, to string, kind string, msg interface{}) {
+	s := n.Sched
+	if n.down[from] {
+		s.Tracef("%s->%s %s lost (sender down)", from, to, kind)
+		return
+	}
+	if n.DropRate > 0 && s.rand.Float64() < n.DropRate {
+		s.Tracef("%s->%s %s dropped", from, to, kind)
+		return
+	}
+	delay := n.MinDelay
+	if n.MaxDelay > n.MinDelay {
+		delay += time.Duration(s.rand.Int63n(int64(n.MaxDelay - n.MinDelay)))
+	}
+	s.After(delay, func() {
+		h, ok := n.nodes[to]
+		if !ok || n.down[to] {
+			s.Tracef("%s->%s %s lost (receiver down)", from, to, kind)
+			return
+		}
+		s.Tracef("%s->%s %s", from, to, kind)
+		h(from, msg)
+	})
+}
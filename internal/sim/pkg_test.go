@@ -0,0 +1,196 @@
+// Copyright 2018 David Lazar. All rights reserved.
+// Use of this source code is governed by the GNU AGPL
+// license that can be found in the LICENSE file.
+
+package sim_test
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"testing"
+	"time"
+
+	"vuvuzela.io/alpenhorn/edhttp"
+	"vuvuzela.io/alpenhorn/internal/sim"
+	"vuvuzela.io/alpenhorn/pairing"
+	"vuvuzela.io/alpenhorn/pkg"
+	"vuvuzela.io/alpenhorn/pkg/kv"
+)
+
+// pkgSim runs real PKG servers and the coordinator's PKG client over a
+// simulated network, with the scheduler as everyone's clock.
+type pkgSim struct {
+	sched       *sim.Scheduler
+	net         *sim.Network
+	servers     []*pkg.Server
+	pkgs        []pkg.PublicServerConfig
+	keys        []ed25519.PublicKey
+	coordinator *pkg.CoordinatorClient
+}
+
+func newPKGSim(t *testing.T, seed int64, dropRate float64) *pkgSim {
+	sched := sim.New(seed)
+	net := sim.NewNetwork(sched, 1*time.Millisecond, 100*time.Millisecond)
+	net.DropRate = dropRate
+
+	coordinatorPub, coordinatorPriv, _ := ed25519.GenerateKey(rand.Reader)
+	p := &pkgSim{
+		sched: sched,
+		net:   net,
+		coordinator: &pkg.CoordinatorClient{
+			CoordinatorKey: coordinatorPriv,
+			Clock:          sched,
+			Transport:      net.HTTPTransport("coordinator"),
+		},
+	}
+	for i := 0; i < 3; i++ {
+		pub, priv, _ := ed25519.GenerateKey(rand.Reader)
+		srv, err := pkg.NewServer(&pkg.Config{
+			DB:               kv.NewMemory(),
+			SigningKey:       priv,
+			CoordinatorKey:   coordinatorPub,
+			RegistrationMode: pkg.RegistrationFCFS,
+			Clock:            sched,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		name := fmt.Sprintf("pkg%d", i)
+		net.ListenHTTP(name, pub, srv)
+		p.servers = append(p.servers, srv)
+		p.pkgs = append(p.pkgs, pkg.PublicServerConfig{Key: pub, Address: name})
+		p.keys = append(p.keys, pub)
+	}
+	return p
+}
+
+func (p *pkgSim) close() {
+	for _, srv := range p.servers {
+		srv.Close()
+	}
+}
+
+// newRound sets up rounds until one succeeds, as the coordinator does,
+// giving up after a few tries.
+func (p *pkgSim) newRound(threshold int) (pkg.RoundSettings, uint32) {
+	var settings pkg.RoundSettings
+	var round uint32
+	p.sched.Go(func() {
+		for round = 1; round <= 10; round++ {
+			var err error
+			settings, err = p.coordinator.NewRoundThreshold(p.pkgs, round, []string{pairing.BLS12381}, threshold)
+			if err == nil {
+				p.sched.Tracef("round %d set up", round)
+				return
+			}
+			p.sched.Tracef("round %d failed: %s", round, err)
+		}
+		settings = nil
+	})
+	p.sched.Run(time.Hour)
+	return settings, round
+}
+
+func TestPKGRoundReproducible(t *testing.T) {
+	retried := false
+	for seed := int64(0); seed < 6; seed++ {
+		var hashes [][32]byte
+		for i := 0; i < 2; i++ {
+			p := newPKGSim(t, seed, 0.05)
+			settings, round := p.newRound(2)
+			p.close()
+			if settings == nil {
+				t.Fatalf("seed %d: no round set up:\n%v", seed, p.sched.Trace())
+			}
+			if !settings.Verify(round, p.keys) {
+				t.Fatalf("seed %d: failed to verify round %d settings", seed, round)
+			}
+			hashes = append(hashes, p.sched.TraceHash())
+			retried = retried || round > 1
+		}
+		if hashes[0] != hashes[1] {
+			t.Fatalf("seed %d: traces differ", seed)
+		}
+	}
+	if !retried {
+		t.Fatal("no seed lost a round to the network")
+	}
+}
+
+func TestPKGThresholdExtract(t *testing.T) {
+	p := newPKGSim(t, 7, 0)
+	defer p.close()
+
+	username := "alice@example.org"
+	alicePub, alicePriv, _ := ed25519.GenerateKey(rand.Reader)
+	alice := &pkg.Client{
+		Username:        username,
+		LoginKey:        alicePriv,
+		UserLongTermKey: alicePub,
+		HTTPClient:      &edhttp.Client{Transport: p.net.HTTPTransport("alice")},
+		Clock:           p.sched,
+	}
+	var regErr error
+	p.sched.Go(func() {
+		for _, server := range p.pkgs {
+			if regErr = alice.Register(server, ""); regErr != nil {
+				return
+			}
+		}
+	})
+	p.sched.Run(time.Minute)
+	if regErr != nil {
+		t.Fatal(regErr)
+	}
+
+	settings, round := p.newRound(2)
+	if settings == nil {
+		t.Fatalf("no round set up:\n%v", p.sched.Trace())
+	}
+
+	// One PKG crashes after the round is set up; the other two serve it.
+	p.net.SetDown("pkg1", true)
+	idKeys := make(map[string][]byte)
+	var extractErrs []error
+	p.sched.Go(func() {
+		for _, server := range p.pkgs {
+			result, err := alice.ExtractCurve(server, round, pairing.BLS12381)
+			extractErrs = append(extractErrs, err)
+			if err == nil {
+				idKeys[hex.EncodeToString(server.Key)] = result.PrivateKey
+			}
+		}
+	})
+	p.sched.Run(time.Hour)
+	if len(extractErrs) != len(p.pkgs) {
+		t.Fatalf("extracted from %d of %d PKGs", len(extractErrs), len(p.pkgs))
+	}
+	for i, err := range extractErrs {
+		if (err == nil) == (i == 1) {
+			t.Fatalf("extract from pkg%d: %v", i, err)
+		}
+	}
+
+	curve, _ := pairing.LookupThreshold(pairing.BLS12381)
+	masterKeys := settings.CurveMasterPublicKeys(pairing.BLS12381, p.keys)
+	id := pkg.ValidUsernameToIdentity(username)
+	msg := []byte("hi alice")
+	ctxt, err := curve.IBEEncrypt(rand.Reader, masterKeys, id[:], msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	idKey, err := settings.CombineIdentityKeys(pairing.BLS12381, username, idKeys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	out, err := curve.IBEDecrypt([][]byte{idKey}, ctxt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(out, msg) {
+		t.Fatalf("got %q, want %q", out, msg)
+	}
+}
@@ -0,0 +1,299 @@
+// Copyright 2018 David Lazar. All rights reserved.
+// Use of this source code is governed by the GNU AGPL
+// license that can be found in the LICENSE file.
+
+// Package sim implements a deterministic simulator for testing
+// interactions between Alpenhorn servers and clients over HTTP.
+//
+// Time, randomness, and message delivery are all driven by a Scheduler
+// that is seeded once. Running a simulation twice with the same seed
+// produces the same sequence of events, so rare failures (reordered or
+// lost messages, slow servers) can be replayed exactly.
+//
+// The real servers and clients run in a simulation through the hooks
+// they already have: a Scheduler is a clock.Clock for their Clock
+// fields, and a Network carries their HTTP requests with
+// HTTPTransport, an edhttp.Transport, to handlers added with
+// ListenHTTP. That covers the PKGs, their clients, and the
+// coordinator's PKG client, which sets up rounds.
+//
+// The mixnet is not simulated. The coordinator and the mixers talk
+// over the vuvuzela mixnet's RPC, which has no transport to replace,
+// so the mixer chain, and the client round flow that goes through it,
+// only run on real connections.
+package sim
+
+import (
+	"container/heap"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	mrand "math/rand"
+	"sync"
+	"time"
+
+	"vuvuzela.io/alpenhorn/clock"
+)
+
+// Epoch is the virtual time at which every simulation starts.
+var Epoch = time.Date(2017, time.January, 1, 0, 0, 0, 0, time.UTC)
+
+// Scheduler is a discrete-event scheduler with a virtual clock.
+// Events run one at a time on the goroutine that calls Run or Step.
+//
+// Code under test that blocks, such as a client waiting for replies,
+// runs in actors started with Go. Step waits until every actor is
+// blocked on the simulation before it runs the next event, so actors
+// and events take turns in an order that is fixed by the seed. Actors
+// may only block in an HTTPTransport; a goroutine that waits on one of
+// the scheduler's timers is not an actor, and the events it causes are
+// not ordered with the simulation's.
+type Scheduler struct {
+	mu      sync.Mutex
+	idle    *sync.Cond
+	running int // actors that are not blocked
+
+	seed  int64
+	now   time.Time
+	seq   uint64
+	queue eventQueue
+	rand  *mrand.Rand
+
+	trace []string
+}
+
+// New returns a scheduler whose randomness is derived from seed.
+func New(seed int64) *Scheduler {
+	s := &Scheduler{
+		seed: seed,
+		now:  Epoch,
+		rand: mrand.New(mrand.NewSource(seed)),
+	}
+	s.idle = sync.NewCond(&s.mu)
+	return s
+}
+
+// Seed returns the seed the scheduler was created with.
+func (s *Scheduler) Seed() int64 {
+	return s.seed
+}
+
+// Now returns the current virtual time.
+func (s *Scheduler) Now() time.Time {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.now
+}
+
+// Rand returns the scheduler's deterministic source of randomness.
+// It may only be used by events and actors.
+func (s *Scheduler) Rand() *mrand.Rand {
+	return s.rand
+}
+
+// Reader returns a deterministic io.Reader that can stand in for
+// crypto/rand.Reader when generating keys inside a simulation.
+// It must never be used outside of tests.
+func (s *Scheduler) Reader() io.Reader {
+	return readerFunc(func(p []byte) (int, error) {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		return s.rand.Read(p)
+	})
+}
+
+type readerFunc func([]byte) (int, error)
+
+func (f readerFunc) Read(p []byte) (int, error) { return f(p) }
+
+// After schedules f to run once d has elapsed in virtual time.
+// Events scheduled for the same instant run in the order they
+// were scheduled.
+func (s *Scheduler) After(d time.Duration, f func()) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.after(d, f)
+}
+
+func (s *Scheduler) after(d time.Duration, f func()) {
+	if d < 0 {
+		d = 0
+	}
+	s.seq++
+	heap.Push(&s.queue, &event{
+		when: s.now.Add(d),
+		seq:  s.seq,
+		f:    f,
+	})
+}
+
+// NewTimer implements clock.Clock with a timer that fires in an event
+// once d has elapsed in virtual time.
+func (s *Scheduler) NewTimer(d time.Duration) clock.Timer {
+	t := &timer{
+		sched: s,
+		c:     make(chan time.Time, 1),
+	}
+	s.After(d, func() {
+		s.mu.Lock()
+		fire := !t.done
+		t.done = true
+		now := s.now
+		s.mu.Unlock()
+		if fire {
+			t.c <- now
+		}
+	})
+	return t
+}
+
+type timer struct {
+	sched *Scheduler
+	c     chan time.Time
+	done  bool // fired or stopped, guarded by sched.mu
+}
+
+func (t *timer) C() <-chan time.Time { return t.c }
+
+func (t *timer) Stop() bool {
+	t.sched.mu.Lock()
+	defer t.sched.mu.Unlock()
+	stopped := !t.done
+	t.done = true
+	return stopped
+}
+
+// Go runs f in a new goroutine as an actor.
+func (s *Scheduler) Go(f func()) {
+	s.mu.Lock()
+	s.running++
+	s.mu.Unlock()
+	go func() {
+		defer s.block()
+		f()
+	}()
+}
+
+// block records that an actor is blocked on the simulation, or done.
+func (s *Scheduler) block() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.running--
+	if s.running < 0 {
+		panic("sim: blocking outside of an actor")
+	}
+	s.idle.Broadcast()
+}
+
+// wake records that an event has unblocked an actor.
+func (s *Scheduler) wake() {
+	s.mu.Lock()
+	s.running++
+	s.mu.Unlock()
+}
+
+// Pending returns the number of events that have not run yet.
+func (s *Scheduler) Pending() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.queue)
+}
+
+// Step runs the next event, advancing the clock to its time.
+// It returns false if there are no events left.
+func (s *Scheduler) Step() bool {
+	return s.step(time.Time{})
+}
+
+// step runs the next event if there is one that is not after
+// deadline, or any next event if deadline is zero.
+func (s *Scheduler) step(deadline time.Time) bool {
+	s.mu.Lock()
+	for s.running > 0 {
+		s.idle.Wait()
+	}
+	if len(s.queue) == 0 || (!deadline.IsZero() && s.queue[0].when.After(deadline)) {
+		s.mu.Unlock()
+		return false
+	}
+	e := heap.Pop(&s.queue).(*event)
+	s.now = e.when
+	s.mu.Unlock()
+	e.f()
+	return true
+}
+
+// Run runs events until none are left or until the virtual clock
+// would pass the given duration from now. It returns the number of
+// events that ran.
+func (s *Scheduler) Run(limit time.Duration) int {
+	deadline := s.Now().Add(limit)
+	n := 0
+	for s.step(deadline) {
+		n++
+	}
+	s.mu.Lock()
+	if s.now.Before(deadline) {
+		s.now = deadline
+	}
+	s.mu.Unlock()
+	return n
+}
+
+// Tracef appends a timestamped line to the simulation trace.
+func (s *Scheduler) Tracef(format string, args ...interface{}) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	line := fmt.Sprintf("%s %s", s.now.Sub(Epoch), fmt.Sprintf(format, args...))
+	s.trace = append(s.trace, line)
+}
+
+// Trace returns the lines recorded by Tracef so far.
+func (s *Scheduler) Trace() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string(nil), s.trace...)
+}
+
+// TraceHash returns a digest of the trace. Two runs with the same
+// seed and the same inputs must have the same trace hash.
+func (s *Scheduler) TraceHash() [32]byte {
+	h := sha256.New()
+	for _, line := range s.Trace() {
+		io.WriteString(h, line)
+		h.Write([]byte{'\n'})
+	}
+	var sum [32]byte
+	copy(sum[:], h.Sum(nil))
+	return sum
+}
+
+type event struct {
+	when time.Time
+	seq  uint64
+	f    func()
+}
+
+type eventQueue []*event
+
+func (q eventQueue) Len() int { return len(q) }
+
+func (q eventQueue) Less(i, j int) bool {
+	if q[i].when.Equal(q[j].when) {
+		return q[i].seq < q[j].seq
+	}
+	return q[i].when.Before(q[j].when)
+}
+
+func (q eventQueue) Swap(i, j int) { q[i], q[j] = q[j], q[i] }
+
+func (q *eventQueue) Push(x interface{}) { *q = append(*q, x.(*event)) }
+
+func (q *eventQueue) Pop() interface{} {
+	old := *q
+	n := len(old)
+	e := old[n-1]
+	old[n-1] = nil
+	*q = old[:n-1]
+	return e
+}
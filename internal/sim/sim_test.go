@@ -0,0 +1,155 @@
+// Copyright 2018 David Lazar. All rights reserved.
+// Use of this source code is governed by the GNU AGPL
+// license that can be found in the LICENSE file.
+
+package sim
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+// roundSim is a toy model of the message flow of a single add-friend
+// or dialing round, for testing the Scheduler and Network: the
+// coordinator announces a round, clients submit onions, the
+// coordinator passes the batch down a chain of mixers, and the last
+// mixer reports a mailbox URL back to the coordinator. It runs none
+// of the real coordinator, mixer, or client code.
+type roundSim struct {
+	sched *Scheduler
+	net   *Network
+
+	numMixers  int
+	numClients int
+
+	onions    []int
+	delivered int
+	done      bool
+	failed    bool
+}
+
+type batch struct {
+	round  uint32
+	onions []int
+}
+
+func newRoundSim(seed int64, dropRate float64) *roundSim {
+	sched := New(seed)
+	net := NewNetwork(sched, 1*time.Millisecond, 50*time.Millisecond)
+	net.DropRate = dropRate
+	r := &roundSim{
+		sched:      sched,
+		net:        net,
+		numMixers:  3,
+		numClients: 10,
+	}
+
+	net.Listen("coordinator", r.coordinator)
+	for i := 0; i < r.numClients; i++ {
+		i := i
+		name := fmt.Sprintf("client%d", i)
+		net.Listen(name, func(from string, msg interface{}) {
+			net.Send(name, "coordinator", "onion", i)
+		})
+	}
+	for i := 0; i < r.numMixers; i++ {
+		i := i
+		name := fmt.Sprintf("mixer%d", i)
+		net.Listen(name, func(from string, msg interface{}) {
+			b := msg.(batch)
+			sched.Rand().Shuffle(len(b.onions), func(x, y int) {
+				b.onions[x], b.onions[y] = b.onions[y], b.onions[x]
+			})
+			if i == r.numMixers-1 {
+				net.Send(name, "coordinator", "mailbox", b)
+			} else {
+				net.Send(name, fmt.Sprintf("mixer%d", i+1), "batch", b)
+			}
+		})
+	}
+	return r
+}
+
+func (r *roundSim) coordinator(from string, msg interface{}) {
+	switch m := msg.(type) {
+	case int:
+		r.onions = append(r.onions, m)
+	case batch:
+		r.delivered = len(m.onions)
+		r.done = true
+	}
+}
+
+func (r *roundSim) run() {
+	const round = 1
+	for i := 0; i < r.numClients; i++ {
+		r.net.Send("coordinator", fmt.Sprintf("client%d", i), "newround", uint32(round))
+	}
+	r.sched.After(200*time.Millisecond, func() {
+		onions := append([]int(nil), r.onions...)
+		r.sched.Tracef("closing round with %d onions", len(onions))
+		r.net.Send("coordinator", "mixer0", "batch", batch{round: round, onions: onions})
+	})
+	r.sched.After(2*time.Second, func() {
+		if !r.done {
+			r.failed = true
+			r.sched.Tracef("round timed out")
+		}
+	})
+	r.sched.Run(time.Minute)
+}
+
+func TestSchedulerOrder(t *testing.T) {
+	s := New(1)
+	var order []int
+	s.After(2*time.Second, func() { order = append(order, 3) })
+	s.After(time.Second, func() { order = append(order, 1) })
+	s.After(time.Second, func() { order = append(order, 2) })
+	s.Run(time.Hour)
+	if fmt.Sprint(order) != "[1 2 3]" {
+		t.Fatalf("unexpected order: %v", order)
+	}
+	if got := s.Now().Sub(Epoch); got != time.Hour {
+		t.Fatalf("clock did not advance to deadline: %s", got)
+	}
+}
+
+func TestReproducible(t *testing.T) {
+	for seed := int64(0); seed < 20; seed++ {
+		a := newRoundSim(seed, 0.1)
+		a.run()
+		b := newRoundSim(seed, 0.1)
+		b.run()
+		if a.sched.TraceHash() != b.sched.TraceHash() {
+			t.Fatalf("seed %d: traces differ:\n%v\n%v", seed, a.sched.Trace(), b.sched.Trace())
+		}
+	}
+}
+
+func TestRoundCompletesOrFailsSafe(t *testing.T) {
+	for seed := int64(0); seed < 50; seed++ {
+		r := newRoundSim(seed, 0.05)
+		r.run()
+		if r.sched.Pending() != 0 {
+			t.Fatalf("seed %d: simulation did not quiesce", seed)
+		}
+		if r.done == r.failed {
+			t.Fatalf("seed %d: round must either finish or time out (done=%v failed=%v)", seed, r.done, r.failed)
+		}
+		if r.done && r.delivered > len(r.onions) {
+			t.Fatalf("seed %d: delivered %d onions but only %d were submitted", seed, r.delivered, len(r.onions))
+		}
+	}
+}
+
+func TestLosslessRound(t *testing.T) {
+	r := newRoundSim(42, 0)
+	r.run()
+	if !r.done {
+		t.Fatalf("round did not finish:\n%v", r.sched.Trace())
+	}
+	if r.delivered != r.numClients {
+		t.Fatalf("expected %d onions, got %d", r.numClients, r.delivered)
+	}
+}
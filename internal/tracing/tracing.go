@@ -0,0 +1,109 @@
+// Copyright 2018 David Lazar. All rights reserved.
+// Use of this source code is governed by the GNU AGPL
+// license that can be found in the LICENSE file.
+
+// Package tracing records OpenTelemetry spans for Alpenhorn rounds.
+//
+// Spans go to the global tracer provider, which discards them unless
+// the program installs one with otel.SetTracerProvider, so tracing
+// costs nothing when it is not configured. Trace context is carried
+// between servers in W3C traceparent headers, and from the coordinator
+// to mixers and clients in the round's service data.
+package tracing
+
+import (
+	"context"
+	"net/http"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const instrumentationName = "vuvuzela.io/alpenhorn"
+
+var propagator = propagation.TraceContext{}
+
+// Start starts a span named name as a child of any span in ctx.
+func Start(ctx context.Context, name string, opts ...trace.SpanStartOption) (context.Context, trace.Span) {
+	return otel.Tracer(instrumentationName).Start(ctx, name, opts...)
+}
+
+// Tracer returns the tracer that records spans with tp, or with the
+// global tracer provider if tp is nil. Servers that let their programs
+// configure an exporter start their spans with it instead of Start.
+func Tracer(tp trace.TracerProvider) trace.Tracer {
+	if tp == nil {
+		tp = otel.GetTracerProvider()
+	}
+	return tp.Tracer(instrumentationName)
+}
+
+// StartRound starts a span in a round, as a child of the round span
+// whose trace context is traceParent.
+func StartRound(traceParent string, name string, service string, round uint32, attrs ...attribute.KeyValue) (context.Context, trace.Span) {
+	ctx := WithTraceParent(context.Background(), traceParent)
+	attrs = append(attrs, Service(service), Round(round))
+	return Start(ctx, name, trace.WithAttributes(attrs...))
+}
+
+// End ends span, recording err if it is not nil.
+func End(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+// Round returns the attribute that labels a span with its round.
+func Round(round uint32) attribute.KeyValue {
+	return attribute.Int64("alpenhorn.round", int64(round))
+}
+
+// Hop returns the attribute that labels a span with a mixer's
+// position in the mix chain.
+func Hop(pos int) attribute.KeyValue {
+	return attribute.Int("alpenhorn.hop", pos)
+}
+
+// Service returns the attribute that labels a span with its service.
+func Service(service string) attribute.KeyValue {
+	return attribute.String("alpenhorn.service", service)
+}
+
+// ConfigHash returns the attribute that labels a span with the hash
+// of the config its round runs under.
+func ConfigHash(hash string) attribute.KeyValue {
+	return attribute.String("alpenhorn.config", hash)
+}
+
+// Inject adds the trace context in ctx to the request headers h.
+func Inject(ctx context.Context, h http.Header) {
+	propagator.Inject(ctx, propagation.HeaderCarrier(h))
+}
+
+// Extract returns ctx with the trace context from the headers h.
+func Extract(ctx context.Context, h http.Header) context.Context {
+	return propagator.Extract(ctx, propagation.HeaderCarrier(h))
+}
+
+// TraceParent returns the trace context in ctx as a W3C traceparent
+// string for round metadata, or "" if ctx has no sampled span.
+func TraceParent(ctx context.Context) string {
+	carrier := propagation.MapCarrier{}
+	propagator.Inject(ctx, carrier)
+	return carrier.Get("traceparent")
+}
+
+// WithTraceParent returns ctx with the trace context from a string
+// returned by TraceParent.
+func WithTraceParent(ctx context.Context, traceParent string) context.Context {
+	if traceParent == "" {
+		return ctx
+	}
+	carrier := propagation.MapCarrier{"traceparent": traceParent}
+	return propagator.Extract(ctx, carrier)
+}
@@ -0,0 +1,39 @@
+// Copyright 2018 David Lazar. All rights reserved.
+// Use of this source code is governed by the GNU AGPL
+// license that can be found in the LICENSE file.
+
+package tracing
+
+import (
+	"context"
+	"net/http"
+	"testing"
+
+	"go.opentelemetry.io/otel/trace"
+)
+
+func TestTraceParent(t *testing.T) {
+	if tp := TraceParent(context.Background()); tp != "" {
+		t.Fatalf("got trace parent %q without a span", tp)
+	}
+
+	sc := trace.NewSpanContext(trace.SpanContextConfig{
+		TraceID:    trace.TraceID{1, 2, 3},
+		SpanID:     trace.SpanID{4, 5, 6},
+		TraceFlags: trace.FlagsSampled,
+	})
+	ctx := trace.ContextWithSpanContext(context.Background(), sc)
+
+	tp := TraceParent(ctx)
+	got := trace.SpanContextFromContext(WithTraceParent(context.Background(), tp))
+	if got.TraceID() != sc.TraceID() || got.SpanID() != sc.SpanID() {
+		t.Fatalf("trace parent %q did not round-trip", tp)
+	}
+
+	h := make(http.Header)
+	Inject(ctx, h)
+	got = trace.SpanContextFromContext(Extract(context.Background(), h))
+	if got.TraceID() != sc.TraceID() {
+		t.Fatalf("headers %v did not carry the trace", h)
+	}
+}
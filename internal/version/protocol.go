@@ -0,0 +1,103 @@
+// Copyright 2018 David Lazar. All rights reserved.
+// Use of this source code is governed by the GNU AGPL
+// license that can be found in the LICENSE file.
+
+package version
+
+import (
+	"io"
+	"net/http"
+	"strconv"
+
+	"vuvuzela.io/alpenhorn/errors"
+)
+
+// A Protocol is the wire protocol spoken by one kind of Alpenhorn
+// server. Servers and their peers exchange protocol versions when they
+// connect, so a mixed-version deployment fails with a clear error
+// instead of with decode errors.
+//
+// Version 1 is the protocol spoken before versions were exchanged, so
+// a peer that does not send a version is treated as speaking version 1.
+type Protocol struct {
+	Name string
+
+	// Version is the protocol version this build speaks.
+	Version int
+
+	// MinVersion is the oldest version this build still talks to.
+	MinVersion int
+}
+
+var (
+	PKG         = Protocol{Name: "pkg", Version: 1, MinVersion: 1}
+	Coordinator = Protocol{Name: "coordinator", Version: 1, MinVersion: 1}
+	Mixnet      = Protocol{Name: "mixnet", Version: 1, MinVersion: 1}
+	CDN         = Protocol{Name: "cdn", Version: 1, MinVersion: 1}
+)
+
+// HTTP headers that carry the sender's protocol versions.
+const (
+	ProtocolHeader    = "Alpenhorn-Protocol"
+	MinProtocolHeader = "Alpenhorn-Protocol-Min"
+)
+
+// Check checks that a peer speaking versions minVersion through
+// version can talk to this build. Zero versions mean version 1.
+// The peer is named in the error, as in "server too old".
+func (p Protocol) Check(peer string, version, minVersion int) error {
+	if version == 0 {
+		version = 1
+	}
+	if minVersion == 0 {
+		minVersion = 1
+	}
+	if version < p.MinVersion {
+		return errors.New("%s too old: it speaks %s protocol version %d, but this build needs at least version %d", peer, p.Name, version, p.MinVersion)
+	}
+	if minVersion > p.Version {
+		return errors.New("%s too new: it needs %s protocol version %d or later, but this build speaks version %d", peer, p.Name, minVersion, p.Version)
+	}
+	return nil
+}
+
+// SetHeader adds this build's protocol versions to h.
+func (p Protocol) SetHeader(h http.Header) {
+	h.Set(ProtocolHeader, strconv.Itoa(p.Version))
+	h.Set(MinProtocolHeader, strconv.Itoa(p.MinVersion))
+}
+
+// CheckHeader checks the protocol versions in a peer's headers.
+func (p Protocol) CheckHeader(peer string, h http.Header) error {
+	version, err := headerInt(h, ProtocolHeader)
+	if err != nil {
+		return err
+	}
+	minVersion, err := headerInt(h, MinProtocolHeader)
+	if err != nil {
+		return err
+	}
+	return p.Check(peer, version, minVersion)
+}
+
+// NewRequest is like http.NewRequest but adds the protocol headers.
+func (p Protocol) NewRequest(method, url string, body io.Reader) (*http.Request, error) {
+	req, err := http.NewRequest(method, url, body)
+	if err != nil {
+		return nil, err
+	}
+	p.SetHeader(req.Header)
+	return req, nil
+}
+
+func headerInt(h http.Header, key string) (int, error) {
+	s := h.Get(key)
+	if s == "" {
+		return 0, nil
+	}
+	n, err := strconv.Atoi(s)
+	if err != nil || n < 0 {
+		return 0, errors.New("invalid %s header: %q", key, s)
+	}
+	return n, nil
+}
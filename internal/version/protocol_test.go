@@ -0,0 +1,53 @@
+// Copyright 2018 David Lazar. All rights reserved.
+// Use of this source code is governed by the GNU AGPL
+// license that can be found in the LICENSE file.
+
+package version
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestProtocolCheck(t *testing.T) {
+	p := Protocol{Name: "test", Version: 3, MinVersion: 2}
+
+	tests := []struct {
+		version, minVersion int
+		err                 string
+	}{
+		{3, 2, ""},
+		{5, 3, ""},
+		{2, 0, ""},
+		{0, 0, "too old"},
+		{1, 1, "too old"},
+		{5, 4, "too new"},
+	}
+	for _, tt := range tests {
+		err := p.Check("peer", tt.version, tt.minVersion)
+		if tt.err == "" && err != nil {
+			t.Errorf("Check(%d, %d): unexpected error: %s", tt.version, tt.minVersion, err)
+		}
+		if tt.err != "" && (err == nil || !strings.Contains(err.Error(), tt.err)) {
+			t.Errorf("Check(%d, %d): got error %v, want %q", tt.version, tt.minVersion, err, tt.err)
+		}
+	}
+}
+
+func TestProtocolHeader(t *testing.T) {
+	h := make(http.Header)
+	if err := PKG.CheckHeader("peer", h); err != nil {
+		t.Fatalf("missing headers should mean version 1: %s", err)
+	}
+
+	PKG.SetHeader(h)
+	if err := PKG.CheckHeader("peer", h); err != nil {
+		t.Fatal(err)
+	}
+
+	h.Set(ProtocolHeader, "x")
+	if err := PKG.CheckHeader("peer", h); err == nil {
+		t.Fatal("expected error for invalid header")
+	}
+}
@@ -0,0 +1,95 @@
+// Copyright 2018 David Lazar. All rights reserved.
+// Use of this source code is governed by the GNU AGPL
+// license that can be found in the LICENSE file.
+
+// Package version reports which build of Alpenhorn is running.
+//
+// Release builds set the variables with the linker:
+//
+//	go build -ldflags "-X vuvuzela.io/alpenhorn/internal/version.Version=v1.2.0 \
+//	    -X vuvuzela.io/alpenhorn/internal/version.Commit=$(git rev-parse HEAD) \
+//	    -X vuvuzela.io/alpenhorn/internal/version.BuildDate=$(date -u +%Y-%m-%dT%H:%M:%SZ)"
+//
+// Otherwise the commit and date are taken from the VCS information that
+// the go command embeds in the binary, when available.
+package version
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"runtime"
+	"runtime/debug"
+)
+
+var (
+	Version   = "devel"
+	Commit    = ""
+	BuildDate = ""
+)
+
+// Info describes a build of Alpenhorn.
+type Info struct {
+	Version   string
+	Commit    string
+	BuildDate string
+	GoVersion string
+}
+
+// Get returns information about the running binary.
+func Get() Info {
+	info := Info{
+		Version:   Version,
+		Commit:    Commit,
+		BuildDate: BuildDate,
+		GoVersion: runtime.Version(),
+	}
+	if bi, ok := debug.ReadBuildInfo(); ok {
+		for _, s := range bi.Settings {
+			switch s.Key {
+			case "vcs.revision":
+				if info.Commit == "" {
+					info.Commit = s.Value
+				}
+			case "vcs.time":
+				if info.BuildDate == "" {
+					info.BuildDate = s.Value
+				}
+			case "vcs.modified":
+				if s.Value == "true" && Commit == "" {
+					info.Commit += "-dirty"
+				}
+			}
+		}
+	}
+	return info
+}
+
+// String returns a one-line description of the build.
+func (i Info) String() string {
+	commit := i.Commit
+	if commit == "" {
+		commit = "unknown"
+	}
+	date := i.BuildDate
+	if date == "" {
+		date = "unknown"
+	}
+	return fmt.Sprintf("alpenhorn %s (commit %s, built %s, %s)", i.Version, commit, date, i.GoVersion)
+}
+
+// String is shorthand for Get().String().
+func String() string {
+	return Get().String()
+}
+
+// ServeHTTP serves the build information as JSON. Servers mount
+// it at /version.
+func ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	data, err := json.Marshal(Get())
+	if err != nil {
+		panic(err)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(data)
+}
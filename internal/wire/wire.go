@@ -0,0 +1,196 @@
+// Copyright 2018 David Lazar. All rights reserved.
+// Use of this source code is governed by the GNU AGPL
+// license that can be found in the LICENSE file.
+
+// Package wire implements the compact binary encoding that servers
+// use instead of JSON for high-volume messages when the client asks
+// for it. Fields are written in order with no names: integers are
+// big-endian and byte strings are prefixed with their uvarint length.
+package wire
+
+import (
+	"encoding/binary"
+	"mime"
+	"net/http"
+	"strings"
+
+	"vuvuzela.io/alpenhorn/errors"
+)
+
+const (
+	// ContentType is the HTTP media type of binary-encoded bodies.
+	// Clients list it in the Accept header to ask for them.
+	ContentType = "application/x-alpenhorn-binary"
+
+	// Subprotocol is the websocket subprotocol clients offer to
+	// receive binary-encoded messages.
+	Subprotocol = "alpenhorn-binary"
+)
+
+// Accepts reports whether the Accept header in h lists ContentType.
+func Accepts(h http.Header) bool {
+	for _, v := range h.Values("Accept") {
+		for _, part := range strings.Split(v, ",") {
+			mediaType, params, err := mime.ParseMediaType(strings.TrimSpace(part))
+			if err == nil && mediaType == ContentType && params["q"] != "0" {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// IsBinary reports whether h has ContentType as its Content-Type.
+func IsBinary(h http.Header) bool {
+	mediaType, _, err := mime.ParseMediaType(h.Get("Content-Type"))
+	return err == nil && mediaType == ContentType
+}
+
+// A Writer appends binary-encoded fields to a buffer.
+type Writer struct {
+	buf []byte
+}
+
+// NewWriter returns a Writer whose buffer starts with a version byte.
+func NewWriter(version byte) *Writer {
+	return &Writer{buf: []byte{version}}
+}
+
+func (w *Writer) PutByte(b byte) {
+	w.buf = append(w.buf, b)
+}
+
+func (w *Writer) PutUint32(x uint32) {
+	w.buf = binary.BigEndian.AppendUint32(w.buf, x)
+}
+
+func (w *Writer) PutUint64(x uint64) {
+	w.buf = binary.BigEndian.AppendUint64(w.buf, x)
+}
+
+// PutCount writes the length of a list of fields.
+func (w *Writer) PutCount(n int) {
+	w.buf = binary.AppendUvarint(w.buf, uint64(n))
+}
+
+func (w *Writer) PutBytes(b []byte) {
+	w.PutCount(len(b))
+	w.buf = append(w.buf, b...)
+}
+
+func (w *Writer) PutString(s string) {
+	w.PutCount(len(s))
+	w.buf = append(w.buf, s...)
+}
+
+// Data returns the encoded fields.
+func (w *Writer) Data() []byte {
+	return w.buf
+}
+
+// A Reader decodes fields written by a Writer. After the first error,
+// every method returns a zero value and Err returns the error.
+type Reader struct {
+	data []byte
+	err  error
+}
+
+// NewReader returns a Reader for data, which must start with the
+// given version byte.
+func NewReader(version byte, data []byte) *Reader {
+	r := &Reader{data: data}
+	if v := r.Byte(); r.err == nil && v != version {
+		r.err = errors.New("unexpected binary version: %v", v)
+	}
+	return r
+}
+
+func (r *Reader) next(n int) []byte {
+	if r.err != nil {
+		return nil
+	}
+	if n < 0 || n > len(r.data) {
+		r.err = errors.New("short data: need %d bytes, have %d", n, len(r.data))
+		return nil
+	}
+	b := r.data[:n]
+	r.data = r.data[n:]
+	return b
+}
+
+func (r *Reader) Byte() byte {
+	b := r.next(1)
+	if b == nil {
+		return 0
+	}
+	return b[0]
+}
+
+func (r *Reader) Uint32() uint32 {
+	b := r.next(4)
+	if b == nil {
+		return 0
+	}
+	return binary.BigEndian.Uint32(b)
+}
+
+func (r *Reader) Uint64() uint64 {
+	b := r.next(8)
+	if b == nil {
+		return 0
+	}
+	return binary.BigEndian.Uint64(b)
+}
+
+// Count reads the length of a list whose elements take at least
+// minSize bytes each. It fails if the rest of the data is too short
+// to hold that many elements, so a corrupt count cannot cause a
+// large allocation.
+func (r *Reader) Count(minSize int) int {
+	if r.err != nil {
+		return 0
+	}
+	n, k := binary.Uvarint(r.data)
+	if k <= 0 {
+		r.err = errors.New("invalid length")
+		return 0
+	}
+	r.data = r.data[k:]
+	if minSize < 1 {
+		minSize = 1
+	}
+	if n > uint64(len(r.data)/minSize) {
+		r.err = errors.New("length %d exceeds remaining data", n)
+		return 0
+	}
+	return int(n)
+}
+
+// Bytes reads a byte string. The result is a copy, so it is safe to
+// keep after the input buffer is reused. Empty strings decode as nil.
+func (r *Reader) Bytes() []byte {
+	n := r.Count(1)
+	b := r.next(n)
+	if len(b) == 0 {
+		return nil
+	}
+	return append([]byte(nil), b...)
+}
+
+// Text reads a string written by PutString.
+func (r *Reader) Text() string {
+	n := r.Count(1)
+	return string(r.next(n))
+}
+
+// Err returns the first decoding error, or an error if any data is
+// left over.
+func (r *Reader) Err() error {
+	if r.err != nil {
+		return r.err
+	}
+	if len(r.data) != 0 {
+		return errors.New("%d bytes of trailing data", len(r.data))
+	}
+	return nil
+}
@@ -0,0 +1,80 @@
+// Copyright 2018 David Lazar. All rights reserved.
+// Use of this source code is governed by the GNU AGPL
+// license that can be found in the LICENSE file.
+
+package wire
+
+import (
+	"bytes"
+	"net/http"
+	"testing"
+)
+
+func TestRoundTrip(t *testing.T) {
+	w := NewWriter(3)
+	w.PutByte(9)
+	w.PutUint32(1234)
+	w.PutUint64(1 << 40)
+	w.PutString("alice@example.org")
+	w.PutBytes([]byte{1, 2, 3})
+	w.PutBytes(nil)
+
+	r := NewReader(3, w.Data())
+	if b := r.Byte(); b != 9 {
+		t.Fatalf("got byte %d", b)
+	}
+	if x := r.Uint32(); x != 1234 {
+		t.Fatalf("got uint32 %d", x)
+	}
+	if x := r.Uint64(); x != 1<<40 {
+		t.Fatalf("got uint64 %d", x)
+	}
+	if s := r.Text(); s != "alice@example.org" {
+		t.Fatalf("got string %q", s)
+	}
+	if b := r.Bytes(); !bytes.Equal(b, []byte{1, 2, 3}) {
+		t.Fatalf("got bytes %v", b)
+	}
+	if b := r.Bytes(); b != nil {
+		t.Fatalf("got bytes %v, want nil", b)
+	}
+	if err := r.Err(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := NewReader(4, w.Data()).Err(); err == nil {
+		t.Fatal("expected version mismatch")
+	}
+	r = NewReader(3, w.Data()[:len(w.Data())-3])
+	r.Byte()
+	r.Uint32()
+	r.Uint64()
+	r.Text()
+	r.Bytes()
+	if r.Err() == nil {
+		t.Fatal("expected error for short data")
+	}
+
+	// A huge count must fail instead of allocating.
+	w = NewWriter(1)
+	w.PutCount(1 << 40)
+	r = NewReader(1, w.Data())
+	if n := r.Count(1); n != 0 || r.Err() == nil {
+		t.Fatalf("got count %d, err %v", n, r.Err())
+	}
+}
+
+func TestAccepts(t *testing.T) {
+	h := make(http.Header)
+	if Accepts(h) {
+		t.Fatal("empty header accepts binary")
+	}
+	h.Set("Accept", ContentType+", application/json")
+	if !Accepts(h) {
+		t.Fatal("binary not accepted")
+	}
+	h.Set("Accept", ContentType+";q=0, application/json")
+	if Accepts(h) {
+		t.Fatal("q=0 should refuse binary")
+	}
+}
@@ -91,6 +91,21 @@ func (w *Wheel) Remove(username string) {
 	w.mu.Unlock()
 }
 
+// Rename moves the keywheel entry for oldUsername to newUsername. It
+// returns false if there is no entry for oldUsername or there is
+// already one for newUsername.
+func (w *Wheel) Rename(oldUsername, newUsername string) bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	rs := w.secrets[oldUsername]
+	if rs == nil || w.secrets[newUsername] != nil {
+		return false
+	}
+	delete(w.secrets, oldUsername)
+	w.secrets[newUsername] = rs
+	return true
+}
+
 func (w *Wheel) SessionKey(username string, round uint32) *[32]byte {
 	rs := w.get(username)
 	if rs == nil || rs.Round > round {
@@ -134,3 +134,29 @@ func BenchmarkGetSecret(b *testing.B) {
 		_ = rs.getSecret(1)
 	}
 }
+
+func TestRename(t *testing.T) {
+	var w Wheel
+	secret := new([32]byte)
+	rand.Read(secret[:])
+	w.Put("alice", 100, secret)
+	w.Put("carol", 100, new([32]byte))
+	k1 := w.SessionKey("alice", 105)
+
+	if w.Rename("alice", "carol") {
+		t.Fatal("renamed over an existing entry")
+	}
+	if !w.Rename("alice", "alice2") {
+		t.Fatal("rename failed")
+	}
+	if w.Exists("alice") {
+		t.Fatal("old entry still exists")
+	}
+	k2 := w.SessionKey("alice2", 105)
+	if !bytes.Equal(k1[:], k2[:]) {
+		t.Fatal("session keys differ after rename")
+	}
+	if w.Rename("alice", "alice3") {
+		t.Fatal("renamed a missing entry")
+	}
+}
@@ -4,7 +4,12 @@
 
 package log
 
-import "vuvuzela.io/alpenhorn/log/ansi"
+import (
+	"fmt"
+	"strings"
+
+	"vuvuzela.io/alpenhorn/log/ansi"
+)
 
 // Level is a logging level. The levels are copied from logrus.
 type Level uint32
@@ -74,3 +79,22 @@ func (level Level) Color() ansi.Code {
 		return ansi.Red
 	}
 }
+
+// ParseLevel returns the level with the given name.
+func ParseLevel(name string) (Level, error) {
+	switch strings.ToLower(name) {
+	case "debug":
+		return DebugLevel, nil
+	case "info":
+		return InfoLevel, nil
+	case "warn", "warning":
+		return WarnLevel, nil
+	case "error":
+		return ErrorLevel, nil
+	case "fatal":
+		return FatalLevel, nil
+	case "panic":
+		return PanicLevel, nil
+	}
+	return 0, fmt.Errorf("unknown log level: %q", name)
+}
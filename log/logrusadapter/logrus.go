@@ -0,0 +1,49 @@
+// Copyright 2018 David Lazar. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package logrusadapter routes Alpenhorn log entries to logrus.
+// It is a separate package so that programs that do not use logrus
+// do not depend on it.
+package logrusadapter
+
+import (
+	"github.com/sirupsen/logrus"
+
+	"vuvuzela.io/alpenhorn/log"
+)
+
+// New returns an EntryHandler that writes entries to l.
+func New(l *logrus.Logger) log.EntryHandler {
+	return &handler{l}
+}
+
+type handler struct {
+	logger *logrus.Logger
+}
+
+func (h *handler) Fire(e *log.Entry) {
+	level := Level(e.Level)
+	if !h.logger.IsLevelEnabled(level) {
+		return
+	}
+	h.logger.WithFields(logrus.Fields(e.Fields)).WithTime(e.Time).Log(level, e.Message)
+}
+
+// Level returns the logrus level corresponding to level.
+func Level(level log.Level) logrus.Level {
+	switch level {
+	case log.PanicLevel:
+		return logrus.PanicLevel
+	case log.FatalLevel:
+		return logrus.FatalLevel
+	case log.ErrorLevel:
+		return logrus.ErrorLevel
+	case log.WarnLevel:
+		return logrus.WarnLevel
+	case log.InfoLevel:
+		return logrus.InfoLevel
+	default:
+		return logrus.DebugLevel
+	}
+}
@@ -0,0 +1,149 @@
+// Copyright 2018 David Lazar. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package log
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// RotatingFile is an io.WriteCloser that writes to the file at Path
+// and starts a new file when the current one grows past MaxSize bytes
+// or becomes older than MaxAge. Old files are renamed with a timestamp
+// suffix, and only the newest MaxBackups of them are kept. A zero
+// value for any limit disables that limit.
+type RotatingFile struct {
+	Path       string
+	MaxSize    int64
+	MaxAge     time.Duration
+	MaxBackups int
+
+	mu      sync.Mutex
+	file    *os.File
+	size    int64
+	created time.Time
+}
+
+const rotateTimeFormat = "2006-01-02T15-04-05.000"
+
+func (f *RotatingFile) Write(p []byte) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.file == nil {
+		if err := f.open(); err != nil {
+			return 0, err
+		}
+	}
+	if f.shouldRotate(int64(len(p))) {
+		if err := f.rotate(); err != nil {
+			return 0, err
+		}
+	}
+
+	n, err := f.file.Write(p)
+	f.size += int64(n)
+	return n, err
+}
+
+func (f *RotatingFile) Close() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.file == nil {
+		return nil
+	}
+	err := f.file.Close()
+	f.file = nil
+	return err
+}
+
+func (f *RotatingFile) shouldRotate(n int64) bool {
+	if f.size == 0 {
+		return false
+	}
+	if f.MaxSize > 0 && f.size+n > f.MaxSize {
+		return true
+	}
+	if f.MaxAge > 0 && time.Since(f.created) > f.MaxAge {
+		return true
+	}
+	return false
+}
+
+func (f *RotatingFile) open() error {
+	if err := os.MkdirAll(filepath.Dir(f.Path), 0770); err != nil {
+		return err
+	}
+	file, err := os.OpenFile(f.Path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0640)
+	if err != nil {
+		return fmt.Errorf("error opening log file %s: %s", f.Path, err)
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	f.file = file
+	f.size = info.Size()
+	f.created = info.ModTime()
+	if f.size == 0 {
+		f.created = time.Now()
+	}
+	return nil
+}
+
+func (f *RotatingFile) rotate() error {
+	if err := f.file.Close(); err != nil {
+		return fmt.Errorf("error closing log file %s: %s", f.Path, err)
+	}
+	f.file = nil
+
+	backup := f.Path + "." + time.Now().Format(rotateTimeFormat)
+	if err := os.Rename(f.Path, backup); err != nil {
+		return fmt.Errorf("error rotating log file %s: %s", f.Path, err)
+	}
+	if err := f.prune(); err != nil {
+		fmt.Fprintf(Stderr, "%s\n", err)
+	}
+	if err := f.open(); err != nil {
+		return err
+	}
+	f.created = time.Now()
+	return nil
+}
+
+// prune removes the oldest backups beyond MaxBackups.
+func (f *RotatingFile) prune() error {
+	if f.MaxBackups <= 0 {
+		return nil
+	}
+	backups, err := filepath.Glob(f.Path + ".*")
+	if err != nil {
+		return err
+	}
+	var valid []string
+	for _, b := range backups {
+		suffix := strings.TrimPrefix(b, f.Path+".")
+		if _, err := time.Parse(rotateTimeFormat, suffix); err == nil {
+			valid = append(valid, b)
+		}
+	}
+	if len(valid) <= f.MaxBackups {
+		return nil
+	}
+	sort.Strings(valid)
+	for _, b := range valid[:len(valid)-f.MaxBackups] {
+		if err := os.Remove(b); err != nil {
+			return fmt.Errorf("error removing old log file: %s", err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,64 @@
+// Copyright 2018 David Lazar. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package log
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestRotatingFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "alpenhorn_log_")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "server.log")
+	f := &RotatingFile{
+		Path:       path,
+		MaxSize:    10,
+		MaxBackups: 2,
+	}
+	defer f.Close()
+
+	for i := 0; i < 5; i++ {
+		if _, err := f.Write([]byte("0123456789")); err != nil {
+			t.Fatal(err)
+		}
+		// Backups are named by timestamp.
+		time.Sleep(2 * time.Millisecond)
+	}
+
+	backups, _ := filepath.Glob(path + ".*")
+	if len(backups) != 2 {
+		t.Fatalf("expected 2 backups, got %v", backups)
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "0123456789" {
+		t.Fatalf("unexpected current log contents: %q", data)
+	}
+}
+
+func TestParseLevel(t *testing.T) {
+	for _, level := range []Level{PanicLevel, FatalLevel, ErrorLevel, WarnLevel, InfoLevel, DebugLevel} {
+		l, err := ParseLevel(level.String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if l != level {
+			t.Fatalf("ParseLevel(%q) = %s", level.String(), l)
+		}
+	}
+	if _, err := ParseLevel("loud"); err == nil {
+		t.Fatal("expected error")
+	}
+}
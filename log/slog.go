@@ -0,0 +1,61 @@
+// Copyright 2018 David Lazar. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package log
+
+import (
+	"context"
+	"log/slog"
+	"sort"
+)
+
+// Slog returns an EntryHandler that writes entries to l. Applications
+// that use log/slog can set it as a Logger's EntryHandler to route
+// Alpenhorn's logs into their own handlers.
+func Slog(l *slog.Logger) EntryHandler {
+	return &slogHandler{l}
+}
+
+type slogHandler struct {
+	logger *slog.Logger
+}
+
+func (h *slogHandler) Fire(e *Entry) {
+	ctx := context.Background()
+	level := SlogLevel(e.Level)
+	if !h.logger.Enabled(ctx, level) {
+		return
+	}
+
+	keys := make([]string, 0, len(e.Fields))
+	for k := range e.Fields {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	r := slog.NewRecord(e.Time, level, e.Message, 0)
+	for _, k := range keys {
+		r.AddAttrs(slog.Any(k, e.Fields[k]))
+	}
+	h.logger.Handler().Handle(ctx, r)
+}
+
+// SlogLevel returns the slog level corresponding to level. Fatal and
+// panic entries are logged above slog.LevelError.
+func SlogLevel(level Level) slog.Level {
+	switch level {
+	case DebugLevel:
+		return slog.LevelDebug
+	case InfoLevel:
+		return slog.LevelInfo
+	case WarnLevel:
+		return slog.LevelWarn
+	case ErrorLevel:
+		return slog.LevelError
+	case FatalLevel:
+		return slog.LevelError + 4
+	default:
+		return slog.LevelError + 8
+	}
+}
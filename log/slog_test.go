@@ -0,0 +1,32 @@
+// Copyright 2018 David Lazar. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package log
+
+import (
+	"bytes"
+	"log/slog"
+	"strings"
+	"testing"
+)
+
+func TestSlog(t *testing.T) {
+	buf := new(bytes.Buffer)
+	sl := slog.New(slog.NewTextHandler(buf, &slog.HandlerOptions{Level: slog.LevelInfo}))
+	logger := &Logger{
+		EntryHandler: Slog(sl),
+		Level:        DebugLevel,
+	}
+
+	logger.WithFields(Fields{"round": 7}).Warnf("mailbox %d full", 3)
+	logger.Debug("dropped by slog")
+
+	out := buf.String()
+	if !strings.Contains(out, "level=WARN") || !strings.Contains(out, `msg="mailbox 3 full"`) || !strings.Contains(out, "round=7") {
+		t.Fatalf("unexpected output: %q", out)
+	}
+	if strings.Contains(out, "dropped") {
+		t.Fatalf("debug entry was not filtered: %q", out)
+	}
+}
@@ -0,0 +1,63 @@
+// Copyright 2018 David Lazar. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package zapadapter routes Alpenhorn log entries to zap.
+// It is a separate package so that programs that do not use zap
+// do not depend on it.
+package zapadapter
+
+import (
+	"sort"
+
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+
+	"vuvuzela.io/alpenhorn/log"
+)
+
+// New returns an EntryHandler that writes entries to l.
+func New(l *zap.Logger) log.EntryHandler {
+	return &handler{l}
+}
+
+type handler struct {
+	logger *zap.Logger
+}
+
+func (h *handler) Fire(e *log.Entry) {
+	ce := h.logger.Check(Level(e.Level), e.Message)
+	if ce == nil {
+		return
+	}
+	ce.Time = e.Time
+
+	keys := make([]string, 0, len(e.Fields))
+	for k := range e.Fields {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	fields := make([]zap.Field, len(keys))
+	for i, k := range keys {
+		fields[i] = zap.Any(k, e.Fields[k])
+	}
+	ce.Write(fields...)
+}
+
+// Level returns the zap level corresponding to level.
+func Level(level log.Level) zapcore.Level {
+	switch level {
+	case log.PanicLevel:
+		return zapcore.PanicLevel
+	case log.FatalLevel:
+		return zapcore.FatalLevel
+	case log.ErrorLevel:
+		return zapcore.ErrorLevel
+	case log.WarnLevel:
+		return zapcore.WarnLevel
+	case log.InfoLevel:
+		return zapcore.InfoLevel
+	default:
+		return zapcore.DebugLevel
+	}
+}
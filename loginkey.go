@@ -0,0 +1,143 @@
+// Copyright 2018 David Lazar. All rights reserved.
+// Use of this source code is governed by the GNU AGPL
+// license that can be found in the LICENSE file.
+
+package alpenhorn
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"fmt"
+
+	"vuvuzela.io/alpenhorn/config"
+	"vuvuzela.io/alpenhorn/errors"
+	"vuvuzela.io/alpenhorn/pkg"
+)
+
+// LoginKeyRotationError is returned by RotatePKGLoginKey when a
+// rotation failed and could not be rolled back on every PKG server.
+// The servers in Committed may accept only NewKey; the rest accept
+// the client's current login key.
+type LoginKeyRotationError struct {
+	Err       error
+	NewKey    crypto.Signer
+	Committed []pkg.PublicServerConfig
+}
+
+func (e *LoginKeyRotationError) Error() string {
+	return fmt.Sprintf("login key rotation left %d PKG server(s) on the new key: %s", len(e.Committed), e.Err)
+}
+
+// pkgLoginKey returns the key the client authenticates to the PKG
+// servers with.
+func (c *Client) pkgLoginKey() crypto.Signer {
+	if c.PKGLoginSigner != nil {
+		return c.PKGLoginSigner
+	}
+	return c.PKGLoginKey
+}
+
+// RotatePKGLoginKey replaces the client's PKG login key with a fresh
+// PKGLoginKey on every PKG server in the current add-friend config.
+// See RotatePKGLoginSigner.
+func (c *Client) RotatePKGLoginKey() error {
+	_, newKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return errors.Wrap(err, "generating login key")
+	}
+	return c.RotatePKGLoginSigner(newKey)
+}
+
+// RotatePKGLoginSigner replaces the client's PKG login key with newKey
+// on every PKG server in the current add-friend config. The rotation
+// is two-phase: the new key is prepared on all servers before it is
+// committed on any, and a failure in either phase is rolled back so
+// that every server keeps accepting the same key.
+//
+// On success, an ed25519.PrivateKey becomes the client's PKGLoginKey
+// and is persisted; any other signer becomes the PKGLoginSigner and
+// PKGLoginKey is cleared, which moves the login key into hardware.
+func (c *Client) RotatePKGLoginSigner(newKey crypto.Signer) error {
+	c.init()
+
+	var id [32]byte
+	if _, err := rand.Read(id[:]); err != nil {
+		return errors.Wrap(err, "generating rotation id")
+	}
+
+	c.mu.Lock()
+	conf := c.addFriendConfig
+	pkgc := &pkg.Client{
+		Username:        c.Username,
+		LoginKey:        c.pkgLoginKey(),
+		UserLongTermKey: c.LongTermPublicKey,
+		HTTPClient:      c.edhttpClient,
+		Clock:           c.Clock,
+	}
+	c.mu.Unlock()
+	if conf == nil {
+		return errors.New("no addfriend config")
+	}
+	servers := conf.Inner.(*config.AddFriendConfig).PKGServers
+
+	for i, server := range servers {
+		err := pkgc.PrepareLoginKey(server, id, newKey)
+		if err == nil {
+			continue
+		}
+		err = errors.Wrap(err, "preparing login key on %s", server.Address)
+		for _, prepared := range servers[:i] {
+			// Prepared rotations expire on their own, so a failed
+			// abort does not leave the user locked out.
+			pkgc.AbortLoginKey(prepared, id, newKey, false)
+		}
+		return err
+	}
+
+	for i, server := range servers {
+		err := pkgc.CommitLoginKey(server, id, newKey)
+		if err == nil {
+			continue
+		}
+		err = errors.Wrap(err, "committing login key on %s", server.Address)
+		var stuck []pkg.PublicServerConfig
+		for j, other := range servers {
+			if j == i {
+				// The commit may have succeeded even if we did not
+				// get the reply, so roll back both ways.
+				if pkgc.AbortLoginKey(other, id, newKey, true) != nil &&
+					pkgc.AbortLoginKey(other, id, newKey, false) != nil {
+					stuck = append(stuck, other)
+				}
+				continue
+			}
+			committed := j < i
+			if pkgc.AbortLoginKey(other, id, newKey, committed) != nil && committed {
+				stuck = append(stuck, other)
+			}
+		}
+		if len(stuck) > 0 {
+			return &LoginKeyRotationError{
+				Err:       err,
+				NewKey:    newKey,
+				Committed: stuck,
+			}
+		}
+		return err
+	}
+
+	c.mu.Lock()
+	if key, ok := newKey.(ed25519.PrivateKey); ok {
+		c.PKGLoginKey = key
+		c.PKGLoginSigner = nil
+	} else {
+		c.PKGLoginKey = nil
+		c.PKGLoginSigner = newKey
+	}
+	c.mu.Unlock()
+	if err := c.persistClient(); err != nil {
+		return errors.Wrap(err, "persisting client")
+	}
+	return nil
+}
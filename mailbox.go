@@ -5,38 +5,141 @@
 package alpenhorn
 
 import (
+	"bytes"
 	"crypto/sha256"
 	"encoding/binary"
 	"fmt"
 	"io/ioutil"
+	"net/http"
 	"net/url"
 
+	"vuvuzela.io/alpenhorn/cdn"
 	"vuvuzela.io/alpenhorn/config"
+	"vuvuzela.io/alpenhorn/dialing"
 	"vuvuzela.io/alpenhorn/errors"
+	"vuvuzela.io/alpenhorn/internal/version"
 )
 
 func (c *Client) fetchMailbox(cdnConfig config.CDNServerConfig, baseURL string, mailboxID uint32) ([]byte, error) {
+	return c.fetchMailboxKey(cdnConfig, baseURL, fmt.Sprintf("%d", mailboxID))
+}
+
+func (c *Client) fetchMailboxKey(cdnConfig config.CDNServerConfig, baseURL string, key string) ([]byte, error) {
 	u, err := url.Parse(baseURL)
 	if err != nil {
 		return nil, errors.Wrap(err, "parsing mailbox url")
 	}
 	vals := u.Query()
-	vals.Set("key", fmt.Sprintf("%d", mailboxID))
+	vals.Set("key", key)
 	u.RawQuery = vals.Encode()
 
-	resp, err := c.edhttpClient.Get(cdnConfig.Key, u.String())
+	req, err := version.CDN.NewRequest("GET", u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := c.cdnClient.Do(cdnConfig.Key, req)
 	if err != nil {
 		return nil, err
 	}
 	defer resp.Body.Close()
+	if err := version.CDN.CheckHeader("cdn server", resp.Header); err != nil {
+		return nil, err
+	}
 
 	mailbox, err := ioutil.ReadAll(resp.Body)
 	if err != nil {
 		return nil, errors.Wrap(err, "reading mailbox body")
 	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, errors.New("bad CDN response: %s: %q", resp.Status, mailbox)
+	}
+	return mailbox, nil
+}
+
+// fetchMailboxContinuations reassembles a split dialing mailbox from
+// its first chunk by fetching the continuation objects.
+func (c *Client) fetchMailboxContinuations(cdnConfig config.CDNServerConfig, baseURL string, mailboxID uint32, head []byte) ([]byte, error) {
+	numChunks, data, err := dialing.ParseMailboxHead(head)
+	if err != nil {
+		return nil, err
+	}
+	mailbox := append([]byte(nil), data...)
+	for i := 1; i < numChunks; i++ {
+		chunk, err := c.fetchMailboxKey(cdnConfig, baseURL, dialing.MailboxKey(mailboxID, i))
+		if err != nil {
+			return nil, errors.Wrap(err, "fetching mailbox chunk %d/%d", i, numChunks)
+		}
+		mailbox = append(mailbox, chunk...)
+	}
 	return mailbox, nil
 }
 
+// fetchMailboxPIR fetches the mailbox by querying each server for a
+// random-looking subset of mailboxes. No server learns which mailbox
+// was fetched unless all of them collude.
+func (c *Client) fetchMailboxPIR(servers []config.CDNServerConfig, baseURL string, numMailboxes uint32, mailboxID uint32) ([]byte, error) {
+	u, err := url.Parse(baseURL)
+	if err != nil {
+		return nil, errors.Wrap(err, "parsing mailbox url")
+	}
+	bucket := u.Query().Get("bucket")
+
+	queries, err := cdn.NewPIRQueries(len(servers), numMailboxes, mailboxID)
+	if err != nil {
+		return nil, err
+	}
+
+	answers := make([][]byte, len(servers))
+	errs := make(chan error, len(servers))
+	for i := range servers {
+		go func(i int) {
+			srv := servers[i]
+			vals := url.Values{}
+			vals.Set("bucket", bucket)
+			vals.Set("n", fmt.Sprintf("%d", numMailboxes))
+			pirURL := fmt.Sprintf("https://%s/pir?%s", srv.Address, vals.Encode())
+			req, err := version.CDN.NewRequest("POST", pirURL, bytes.NewReader(queries[i]))
+			if err != nil {
+				errs <- err
+				return
+			}
+			req.Header.Set("Content-Type", "application/octet-stream")
+			resp, err := c.cdnClient.Do(srv.Key, req)
+			if err != nil {
+				errs <- err
+				return
+			}
+			defer resp.Body.Close()
+			if err := version.CDN.CheckHeader("cdn server", resp.Header); err != nil {
+				errs <- errors.Wrap(err, "%s", srv.Address)
+				return
+			}
+			body, err := ioutil.ReadAll(resp.Body)
+			if err != nil {
+				errs <- errors.Wrap(err, "reading PIR answer from %s", srv.Address)
+				return
+			}
+			if resp.StatusCode != http.StatusOK {
+				errs <- errors.New("PIR query to %s failed: %s: %q", srv.Address, resp.Status, body)
+				return
+			}
+			answers[i] = body
+			errs <- nil
+		}(i)
+	}
+	var firstErr error
+	for range servers {
+		if err := <-errs; err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	if firstErr != nil {
+		return nil, firstErr
+	}
+
+	return cdn.CombinePIRAnswers(answers)
+}
+
 func usernameToMailbox(username string, numMailboxes uint32) uint32 {
 	h := sha256.Sum256([]byte(username))
 	k := binary.BigEndian.Uint32(h[0:4])
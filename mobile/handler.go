@@ -0,0 +1,103 @@
+// Copyright 2018 David Lazar. All rights reserved.
+// Use of this source code is governed by the GNU AGPL
+// license that can be found in the LICENSE file.
+
+package mobile
+
+import (
+	"vuvuzela.io/alpenhorn"
+	"vuvuzela.io/alpenhorn/config"
+)
+
+// A Handler receives events from the client. It mirrors
+// alpenhorn.EventHandler with types that gomobile can bind.
+// Its methods are called from the client's goroutines and
+// should not block.
+type Handler interface {
+	// Error is called when the client experiences an error.
+	Error(msg string)
+
+	// Disconnected is called when the connection to the coordinator
+	// of the "AddFriend" or "Dialing" service is lost.
+	Disconnected(service string, msg string)
+
+	// ConfirmedFriend is called when username becomes a friend.
+	ConfirmedFriend(username string, longTermKey []byte)
+
+	// SentFriendRequest is called when a friend request to username
+	// is sent to the entry server.
+	SentFriendRequest(username string)
+
+	// ReceivedFriendRequest is called when username sends a friend
+	// request. The app should eventually approve or reject it.
+	ReceivedFriendRequest(username string, longTermKey []byte)
+
+	// UnexpectedSigningKey is called when a friend request from
+	// username is signed by a different key than the one the app
+	// passed to SendFriendRequest.
+	UnexpectedSigningKey(username string, gotKey, expectedKey []byte)
+
+	// SendingCall is called when a call to username is about to be
+	// sent, with the session key the two friends will share.
+	SendingCall(username string, intent int, sessionKey []byte)
+
+	// ReceivedCall is called when username calls the client.
+	ReceivedCall(username string, intent int, sessionKey []byte)
+
+	// NewConfig is called when the config for the "AddFriend" or
+	// "Dialing" service changes.
+	NewConfig(service string)
+}
+
+// eventHandler adapts a Handler to alpenhorn.EventHandler.
+type eventHandler struct {
+	h Handler
+}
+
+func (e *eventHandler) Error(err error) {
+	e.h.Error(err.Error())
+}
+
+func (e *eventHandler) disconnected(service string, disconnect chan error) {
+	err := <-disconnect
+	msg := "connection closed"
+	if err != nil {
+		msg = err.Error()
+	}
+	e.h.Disconnected(service, msg)
+}
+
+func (e *eventHandler) ConfirmedFriend(f *alpenhorn.Friend) {
+	e.h.ConfirmedFriend(f.Username, f.LongTermKey)
+}
+
+func (e *eventHandler) SentFriendRequest(r *alpenhorn.OutgoingFriendRequest) {
+	e.h.SentFriendRequest(r.Username)
+}
+
+func (e *eventHandler) ReceivedFriendRequest(r *alpenhorn.IncomingFriendRequest) {
+	e.h.ReceivedFriendRequest(r.Username, r.LongTermKey)
+}
+
+func (e *eventHandler) UnexpectedSigningKey(in *alpenhorn.IncomingFriendRequest, out *alpenhorn.OutgoingFriendRequest) {
+	e.h.UnexpectedSigningKey(in.Username, in.LongTermKey, out.ExpectedKey)
+}
+
+func (e *eventHandler) SendingCall(call *alpenhorn.OutgoingCall) {
+	e.h.SendingCall(call.Username, call.Intent(), keyBytes(call.SessionKey()))
+}
+
+func (e *eventHandler) ReceivedCall(call *alpenhorn.IncomingCall) {
+	e.h.ReceivedCall(call.Username, call.Intent, keyBytes(call.SessionKey))
+}
+
+func (e *eventHandler) NewConfig(chain []*config.SignedConfig) {
+	e.h.NewConfig(chain[0].Service)
+}
+
+func keyBytes(key *[32]byte) []byte {
+	if key == nil {
+		return nil
+	}
+	return append([]byte(nil), key[:]...)
+}
@@ -0,0 +1,300 @@
+// Copyright 2018 David Lazar. All rights reserved.
+// Use of this source code is governed by the GNU AGPL
+// license that can be found in the LICENSE file.
+
+// Package mobile wraps the Alpenhorn client in an API that gomobile
+// can bind, so iOS and Android apps can embed Alpenhorn:
+//
+//	gomobile bind -target=android vuvuzela.io/alpenhorn/mobile
+//	gomobile bind -target=ios vuvuzela.io/alpenhorn/mobile
+//
+// The API uses only strings, byte slices, integers, and callback
+// interfaces. Keys are raw byte slices and configs are the JSON
+// encoding of a config.SignedConfig.
+package mobile
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/json"
+	"os"
+	"path/filepath"
+
+	"vuvuzela.io/alpenhorn"
+	"vuvuzela.io/alpenhorn/config"
+	"vuvuzela.io/alpenhorn/errors"
+	"vuvuzela.io/alpenhorn/pkg"
+)
+
+// Names of the files that a client keeps in its data directory.
+const (
+	clientFile   = "client.json"
+	keywheelFile = "keywheel"
+)
+
+// A Client is an Alpenhorn client whose state lives in a data
+// directory, such as the app's private storage.
+type Client struct {
+	client *alpenhorn.Client
+}
+
+// NewClient creates a client for username with fresh keys and stores
+// it in dataDir. The client trusts the given add-friend and dialing
+// configs, and fetches newer ones from the config server at
+// configServerURL.
+func NewClient(username, dataDir, configServerURL string, addFriendConfig, dialingConfig []byte, handler Handler) (*Client, error) {
+	if _, err := pkg.UsernameToIdentity(username); err != nil {
+		return nil, err
+	}
+	addFriend := new(config.SignedConfig)
+	if err := json.Unmarshal(addFriendConfig, addFriend); err != nil {
+		return nil, errors.Wrap(err, "decoding add-friend config")
+	}
+	dialing := new(config.SignedConfig)
+	if err := json.Unmarshal(dialingConfig, dialing); err != nil {
+		return nil, errors.Wrap(err, "decoding dialing config")
+	}
+	if err := os.MkdirAll(dataDir, 0700); err != nil {
+		return nil, err
+	}
+
+	longTermPub, longTermPriv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	_, loginKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+
+	c := &alpenhorn.Client{
+		Username:           username,
+		LongTermPublicKey:  longTermPub,
+		LongTermPrivateKey: longTermPriv,
+		PKGLoginKey:        loginKey,
+
+		ConfigClient: &config.Client{ConfigServerURL: configServerURL},
+		Handler:      &eventHandler{h: handler},
+
+		ClientPersistPath:   filepath.Join(dataDir, clientFile),
+		KeywheelPersistPath: filepath.Join(dataDir, keywheelFile),
+	}
+	if err := c.Bootstrap(addFriend, dialing); err != nil {
+		return nil, err
+	}
+	if err := c.Persist(); err != nil {
+		return nil, err
+	}
+	return &Client{client: c}, nil
+}
+
+// LoadClient loads a client that NewClient stored in dataDir.
+func LoadClient(dataDir, configServerURL string, handler Handler) (*Client, error) {
+	c, err := alpenhorn.LoadClient(
+		filepath.Join(dataDir, clientFile),
+		filepath.Join(dataDir, keywheelFile),
+	)
+	if err != nil {
+		return nil, err
+	}
+	c.ConfigClient = &config.Client{ConfigServerURL: configServerURL}
+	c.Handler = &eventHandler{h: handler}
+	return &Client{client: c}, nil
+}
+
+func (c *Client) Username() string {
+	return c.client.Username
+}
+
+// LongTermPublicKey returns the key that friends use to verify
+// the client's friend requests.
+func (c *Client) LongTermPublicKey() []byte {
+	return c.client.LongTermPublicKey
+}
+
+// Register registers the client's username with every PKG in the
+// current add-friend config, using the same registration token.
+// It is not an error to register again with a PKG that already
+// knows the client.
+func (c *Client) Register(token string) error {
+	for _, server := range c.client.PKGServers() {
+		err := c.client.Register(server, token)
+		if e, ok := err.(pkg.Error); ok && e.Code == pkg.ErrAlreadyRegistered {
+			continue
+		}
+		if err != nil {
+			return errors.Wrap(err, "registering with %s", server.Address)
+		}
+	}
+	return nil
+}
+
+// CheckRegistration returns an error if the client is not registered
+// with every PKG in the current add-friend config.
+func (c *Client) CheckRegistration() error {
+	for _, st := range c.client.PKGStatus() {
+		if st.Error != nil {
+			return errors.Wrap(st.Error, "%s", st.Server.Address)
+		}
+	}
+	return nil
+}
+
+// Connect connects to the add-friend and dialing coordinators.
+// If either connection is lost later, the handler's Disconnected
+// method is called and the app should call Connect again.
+func (c *Client) Connect() error {
+	addFriendDisconnect, err := c.client.ConnectAddFriend()
+	if err != nil {
+		return errors.Wrap(err, "connecting to add-friend coordinator")
+	}
+	dialingDisconnect, err := c.client.ConnectDialing()
+	if err != nil {
+		c.client.CloseAddFriend()
+		return errors.Wrap(err, "connecting to dialing coordinator")
+	}
+
+	h := c.client.Handler.(*eventHandler)
+	go h.disconnected("AddFriend", addFriendDisconnect)
+	go h.disconnected("Dialing", dialingDisconnect)
+	return nil
+}
+
+// Close disconnects from the coordinators.
+func (c *Client) Close() error {
+	err := c.client.CloseAddFriend()
+	if e := c.client.CloseDialing(); err == nil {
+		err = e
+	}
+	return err
+}
+
+// SendFriendRequest queues a friend request to username. If key is
+// not empty, the request is only completed if the friend's long-term
+// key matches it.
+func (c *Client) SendFriendRequest(username string, key []byte) error {
+	if len(key) != 0 && len(key) != ed25519.PublicKeySize {
+		return errors.New("invalid key length: got %d bytes, want %d", len(key), ed25519.PublicKeySize)
+	}
+	var expectedKey ed25519.PublicKey
+	if len(key) != 0 {
+		expectedKey = append(ed25519.PublicKey(nil), key...)
+	}
+	_, err := c.client.SendFriendRequest(username, expectedKey)
+	return err
+}
+
+// IncomingFriendRequests returns the usernames of the people waiting
+// for the app to approve or reject their friend requests.
+func (c *Client) IncomingFriendRequests() *StringList {
+	reqs := c.client.GetIncomingFriendRequests()
+	list := &StringList{}
+	for _, req := range reqs {
+		list.strs = append(list.strs, req.Username)
+	}
+	return list
+}
+
+func (c *Client) incomingFriendRequest(username string) (*alpenhorn.IncomingFriendRequest, error) {
+	for _, req := range c.client.GetIncomingFriendRequests() {
+		if req.Username == username {
+			return req, nil
+		}
+	}
+	return nil, errors.New("no friend request from %q", username)
+}
+
+// ApproveFriendRequest approves the friend request from username.
+func (c *Client) ApproveFriendRequest(username string) error {
+	req, err := c.incomingFriendRequest(username)
+	if err != nil {
+		return err
+	}
+	_, err = req.Approve()
+	return err
+}
+
+// RejectFriendRequest rejects the friend request from username.
+func (c *Client) RejectFriendRequest(username string) error {
+	req, err := c.incomingFriendRequest(username)
+	if err != nil {
+		return err
+	}
+	return req.Reject()
+}
+
+// Friends returns the usernames in the client's address book.
+func (c *Client) Friends() *StringList {
+	friends := c.client.GetFriends()
+	list := &StringList{}
+	for _, f := range friends {
+		list.strs = append(list.strs, f.Username)
+	}
+	return list
+}
+
+func (c *Client) friend(username string) (*alpenhorn.Friend, error) {
+	f := c.client.GetFriend(username)
+	if f == nil {
+		return nil, errors.New("%q is not a friend", username)
+	}
+	return f, nil
+}
+
+// FriendKey returns the long-term key of a friend.
+func (c *Client) FriendKey(username string) ([]byte, error) {
+	f, err := c.friend(username)
+	if err != nil {
+		return nil, err
+	}
+	return f.LongTermKey, nil
+}
+
+// RemoveFriend removes username from the address book.
+func (c *Client) RemoveFriend(username string) error {
+	f, err := c.friend(username)
+	if err != nil {
+		return err
+	}
+	return f.Remove()
+}
+
+// Call queues a call to a friend. The handler's SendingCall method
+// is called with the session key when the call is sent.
+func (c *Client) Call(username string, intent int) error {
+	f, err := c.friend(username)
+	if err != nil {
+		return err
+	}
+	f.Call(intent)
+	return nil
+}
+
+// DataUsage returns the total bytes sent and received by the client.
+func (c *Client) DataUsage() *Usage {
+	total := c.client.DataUsage().Total()
+	return &Usage{
+		Sent:     int64(total.Sent),
+		Received: int64(total.Received),
+	}
+}
+
+// Usage counts the bytes the client has sent and received.
+type Usage struct {
+	Sent     int64
+	Received int64
+}
+
+// A StringList is a list of strings. gomobile cannot bind slices of
+// strings, so lists are returned as a StringList instead.
+type StringList struct {
+	strs []string
+}
+
+func (l *StringList) Len() int {
+	return len(l.strs)
+}
+
+func (l *StringList) Get(i int) string {
+	return l.strs[i]
+}
@@ -0,0 +1,87 @@
+// Copyright 2018 David Lazar. All rights reserved.
+// Use of this source code is governed by the GNU AGPL
+// license that can be found in the LICENSE file.
+
+package mobile
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+
+	"vuvuzela.io/alpenhorn"
+)
+
+type recordingHandler struct {
+	Handler // panics on unexpected events
+
+	errors []string
+	calls  []string
+	keys   [][]byte
+}
+
+func (h *recordingHandler) Error(msg string) {
+	h.errors = append(h.errors, msg)
+}
+
+func (h *recordingHandler) Disconnected(service string, msg string) {
+	h.errors = append(h.errors, service+": "+msg)
+}
+
+func (h *recordingHandler) ReceivedCall(username string, intent int, sessionKey []byte) {
+	h.calls = append(h.calls, username)
+	h.keys = append(h.keys, sessionKey)
+}
+
+func TestEventHandler(t *testing.T) {
+	h := new(recordingHandler)
+	e := &eventHandler{h: h}
+
+	e.Error(errors.New("boom"))
+	disconnect := make(chan error, 1)
+	disconnect <- nil
+	e.disconnected("Dialing", disconnect)
+	if len(h.errors) != 2 || h.errors[0] != "boom" || h.errors[1] != "Dialing: connection closed" {
+		t.Fatalf("unexpected errors: %q", h.errors)
+	}
+
+	key := &[32]byte{1, 2, 3}
+	e.ReceivedCall(&alpenhorn.IncomingCall{
+		Username:   "bob@example.org",
+		Intent:     2,
+		SessionKey: key,
+	})
+	if len(h.calls) != 1 || h.calls[0] != "bob@example.org" {
+		t.Fatalf("unexpected calls: %q", h.calls)
+	}
+	if !bytes.Equal(h.keys[0], key[:]) {
+		t.Fatalf("wrong session key: %x", h.keys[0])
+	}
+	key[0] = 9
+	if h.keys[0][0] != 1 {
+		t.Fatal("session key aliases the client's key")
+	}
+}
+
+func TestNewClientErrors(t *testing.T) {
+	dir := t.TempDir()
+	_, err := NewClient("not a username!", dir, "", nil, nil, new(recordingHandler))
+	if err == nil {
+		t.Fatal("expected error for invalid username")
+	}
+	_, err = NewClient("alice@example.org", dir, "", []byte("{"), nil, new(recordingHandler))
+	if err == nil {
+		t.Fatal("expected error for invalid config")
+	}
+	_, err = LoadClient(dir, "", new(recordingHandler))
+	if err == nil {
+		t.Fatal("expected error loading a missing client")
+	}
+}
+
+func TestStringList(t *testing.T) {
+	l := &StringList{strs: []string{"a", "b"}}
+	if l.Len() != 2 || l.Get(0) != "a" || l.Get(1) != "b" {
+		t.Fatalf("unexpected list: %v", l.strs)
+	}
+}
@@ -0,0 +1,255 @@
+// Copyright 2018 David Lazar. All rights reserved.
+// Use of this source code is governed by the GNU AGPL
+// license that can be found in the LICENSE file.
+
+package pairing
+
+import (
+	"crypto/sha256"
+	"io"
+
+	bls12381 "github.com/kilic/bls12-381"
+	"golang.org/x/crypto/nacl/secretbox"
+
+	"vuvuzela.io/alpenhorn/errors"
+)
+
+// Domain separation tags for hashing to G1, following the hash-to-curve
+// naming convention.
+var (
+	ibeDomain = []byte("ALPENHORN-IBE-V01-CS01-with-BLS12381G1_XMD:SHA-256_SSWU_RO_")
+	sigDomain = []byte("ALPENHORN-SIG-V01-CS01-with-BLS12381G1_XMD:SHA-256_SSWU_RO_")
+)
+
+const (
+	sizeG1 = 48
+	sizeG2 = 96
+	sizeFr = 32
+)
+
+// bls12381Curve implements Boneh-Franklin IBE and BLS signatures on
+// BLS12-381. Identities and signatures live in G1 and public keys in
+// G2, so the per-user values that travel the network are small.
+//
+// Ciphertexts are U || secretbox(K, msg) where U = rP and
+// K = SHA-256(e(rH(id), sP) || U).
+type bls12381Curve struct{}
+
+func (bls12381Curve) Name() string { return BLS12381 }
+
+func randScalar(rand io.Reader) (*bls12381.Fr, error) {
+	for {
+		s, err := bls12381.NewFr().Rand(rand)
+		if err != nil {
+			return nil, err
+		}
+		if !s.IsZero() {
+			return s, nil
+		}
+	}
+}
+
+func decodeScalar(b []byte) (*bls12381.Fr, error) {
+	if len(b) != sizeFr {
+		return nil, errors.New("bad scalar length: %d", len(b))
+	}
+	return bls12381.NewFr().FromBytes(b), nil
+}
+
+func decodeG1(b []byte) (*bls12381.PointG1, error) {
+	g1 := bls12381.NewG1()
+	p, err := g1.FromCompressed(b)
+	if err != nil {
+		return nil, err
+	}
+	if !g1.InCorrectSubgroup(p) {
+		return nil, errors.New("G1 point not in subgroup")
+	}
+	return p, nil
+}
+
+func decodeG2(b []byte) (*bls12381.PointG2, error) {
+	g2 := bls12381.NewG2()
+	p, err := g2.FromCompressed(b)
+	if err != nil {
+		return nil, err
+	}
+	if !g2.InCorrectSubgroup(p) {
+		return nil, errors.New("G2 point not in subgroup")
+	}
+	return p, nil
+}
+
+// sumG1 decodes and adds compressed G1 points.
+func sumG1(points [][]byte) (*bls12381.PointG1, error) {
+	g1 := bls12381.NewG1()
+	sum := g1.Zero()
+	for i, b := range points {
+		p, err := decodeG1(b)
+		if err != nil {
+			return nil, errors.Wrap(err, "point %d", i)
+		}
+		g1.Add(sum, sum, p)
+	}
+	return sum, nil
+}
+
+// sumG2 decodes and adds compressed G2 points.
+func sumG2(points [][]byte) (*bls12381.PointG2, error) {
+	g2 := bls12381.NewG2()
+	sum := g2.Zero()
+	for i, b := range points {
+		p, err := decodeG2(b)
+		if err != nil {
+			return nil, errors.Wrap(err, "point %d", i)
+		}
+		g2.Add(sum, sum, p)
+	}
+	return sum, nil
+}
+
+func (bls12381Curve) IBESetup(rand io.Reader) ([]byte, []byte, error) {
+	s, err := randScalar(rand)
+	if err != nil {
+		return nil, nil, err
+	}
+	g2 := bls12381.NewG2()
+	pub := g2.MulScalar(g2.New(), g2.One(), s)
+	return g2.ToCompressed(pub), s.ToBytes(), nil
+}
+
+func (bls12381Curve) IBEExtract(masterPriv, id []byte) ([]byte, error) {
+	s, err := decodeScalar(masterPriv)
+	if err != nil {
+		return nil, err
+	}
+	g1 := bls12381.NewG1()
+	q, err := g1.HashToCurve(id, ibeDomain)
+	if err != nil {
+		return nil, err
+	}
+	return g1.ToCompressed(g1.MulScalar(g1.New(), q, s)), nil
+}
+
+func ibeKey(gt *bls12381.E, u []byte) *[32]byte {
+	h := sha256.New()
+	h.Write(bls12381.NewGT().ToBytes(gt))
+	h.Write(u)
+	key := new([32]byte)
+	h.Sum(key[:0])
+	return key
+}
+
+var zeroNonce = new([24]byte)
+
+func (bls12381Curve) IBEEncrypt(rand io.Reader, masterPubs [][]byte, id, msg []byte) ([]byte, error) {
+	masterPub, err := sumG2(masterPubs)
+	if err != nil {
+		return nil, errors.Wrap(err, "master public key")
+	}
+	r, err := randScalar(rand)
+	if err != nil {
+		return nil, err
+	}
+
+	g1 := bls12381.NewG1()
+	g2 := bls12381.NewG2()
+	q, err := g1.HashToCurve(id, ibeDomain)
+	if err != nil {
+		return nil, err
+	}
+	u := g2.ToCompressed(g2.MulScalar(g2.New(), g2.One(), r))
+	rq := g1.MulScalar(g1.New(), q, r)
+	gt := bls12381.NewEngine().AddPair(rq, masterPub).Result()
+
+	// The key is used once, so a zero nonce is safe.
+	return secretbox.Seal(u, msg, zeroNonce, ibeKey(gt, u)), nil
+}
+
+func (bls12381Curve) IBEDecrypt(idKeys [][]byte, ctxt []byte) ([]byte, error) {
+	if len(ctxt) < sizeG2+secretbox.Overhead {
+		return nil, errors.New("short ciphertext: %d bytes", len(ctxt))
+	}
+	idKey, err := sumG1(idKeys)
+	if err != nil {
+		return nil, errors.Wrap(err, "identity private key")
+	}
+	u := ctxt[:sizeG2]
+	uPoint, err := decodeG2(u)
+	if err != nil {
+		return nil, err
+	}
+	gt := bls12381.NewEngine().AddPair(idKey, uPoint).Result()
+	msg, ok := secretbox.Open(nil, ctxt[sizeG2:], zeroNonce, ibeKey(gt, u))
+	if !ok {
+		return nil, errors.New("decryption failed")
+	}
+	return msg, nil
+}
+
+func (bls12381Curve) IBEOverhead() int { return sizeG2 + secretbox.Overhead }
+
+func (bls12381Curve) BLSGenerateKey(rand io.Reader) ([]byte, []byte, error) {
+	x, err := randScalar(rand)
+	if err != nil {
+		return nil, nil, err
+	}
+	g2 := bls12381.NewG2()
+	pub := g2.MulScalar(g2.New(), g2.One(), x)
+	return g2.ToCompressed(pub), x.ToBytes(), nil
+}
+
+func (bls12381Curve) BLSSign(priv, msg []byte) ([]byte, error) {
+	x, err := decodeScalar(priv)
+	if err != nil {
+		return nil, err
+	}
+	g1 := bls12381.NewG1()
+	h, err := g1.HashToCurve(msg, sigDomain)
+	if err != nil {
+		return nil, err
+	}
+	return g1.ToCompressed(g1.MulScalar(g1.New(), h, x)), nil
+}
+
+func (bls12381Curve) BLSAggregate(sigs ...[]byte) ([]byte, error) {
+	sum, err := sumG1(sigs)
+	if err != nil {
+		return nil, errors.Wrap(err, "signature")
+	}
+	return bls12381.NewG1().ToCompressed(sum), nil
+}
+
+func (bls12381Curve) BLSVerify(pubs, msgs [][]byte, sig []byte) bool {
+	if len(pubs) != len(msgs) || len(pubs) == 0 {
+		return false
+	}
+	seen := make(map[string]bool, len(msgs))
+	for _, m := range msgs {
+		if seen[string(m)] {
+			return false
+		}
+		seen[string(m)] = true
+	}
+
+	s, err := decodeG1(sig)
+	if err != nil {
+		return false
+	}
+	g1 := bls12381.NewG1()
+	g2 := bls12381.NewG2()
+	e := bls12381.NewEngine()
+	for i := range pubs {
+		pub, err := decodeG2(pubs[i])
+		if err != nil || g2.IsZero(pub) {
+			return false
+		}
+		h, err := g1.HashToCurve(msgs[i], sigDomain)
+		if err != nil {
+			return false
+		}
+		e.AddPair(h, pub)
+	}
+	e.AddPairInv(s, g2.One())
+	return e.Check()
+}
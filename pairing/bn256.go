@@ -0,0 +1,116 @@
+// Copyright 2018 David Lazar. All rights reserved.
+// Use of this source code is governed by the GNU AGPL
+// license that can be found in the LICENSE file.
+
+package pairing
+
+import (
+	"io"
+
+	"vuvuzela.io/alpenhorn/errors"
+	"vuvuzela.io/crypto/bls"
+	"vuvuzela.io/crypto/ibe"
+)
+
+// bn256Curve wraps the vuvuzela.io/crypto IBE and BLS packages, which
+// are the curve Alpenhorn has always used.
+type bn256Curve struct{}
+
+func (bn256Curve) Name() string { return BN256 }
+
+func (bn256Curve) IBESetup(rand io.Reader) ([]byte, []byte, error) {
+	pub, priv := ibe.Setup(rand)
+	pubBytes, err := pub.MarshalBinary()
+	if err != nil {
+		return nil, nil, err
+	}
+	privBytes, err := priv.MarshalBinary()
+	if err != nil {
+		return nil, nil, err
+	}
+	return pubBytes, privBytes, nil
+}
+
+func (bn256Curve) IBEExtract(masterPriv, id []byte) ([]byte, error) {
+	priv := new(ibe.MasterPrivateKey)
+	if err := priv.UnmarshalBinary(masterPriv); err != nil {
+		return nil, errors.Wrap(err, "unmarshalling master private key")
+	}
+	return ibe.Extract(priv, id).MarshalBinary()
+}
+
+func (bn256Curve) IBEEncrypt(rand io.Reader, masterPubs [][]byte, id, msg []byte) ([]byte, error) {
+	keys := make([]*ibe.MasterPublicKey, len(masterPubs))
+	for i, b := range masterPubs {
+		keys[i] = new(ibe.MasterPublicKey)
+		if err := keys[i].UnmarshalBinary(b); err != nil {
+			return nil, errors.Wrap(err, "unmarshalling master public key %d", i)
+		}
+	}
+	masterKey := new(ibe.MasterPublicKey).Aggregate(keys...)
+	return ibe.Encrypt(rand, masterKey, id, msg).MarshalBinary()
+}
+
+func (bn256Curve) IBEDecrypt(idKeys [][]byte, ctxt []byte) ([]byte, error) {
+	keys := make([]*ibe.IdentityPrivateKey, len(idKeys))
+	for i, b := range idKeys {
+		keys[i] = new(ibe.IdentityPrivateKey)
+		if err := keys[i].UnmarshalBinary(b); err != nil {
+			return nil, errors.Wrap(err, "unmarshalling identity private key %d", i)
+		}
+	}
+	var c ibe.Ciphertext
+	if err := c.UnmarshalBinary(ctxt); err != nil {
+		return nil, errors.Wrap(err, "unmarshalling ciphertext")
+	}
+	msg, ok := ibe.Decrypt(new(ibe.IdentityPrivateKey).Aggregate(keys...), c)
+	if !ok {
+		return nil, errors.New("decryption failed")
+	}
+	return msg, nil
+}
+
+func (bn256Curve) IBEOverhead() int { return ibe.Overhead }
+
+func (bn256Curve) BLSGenerateKey(rand io.Reader) ([]byte, []byte, error) {
+	pub, priv, err := bls.GenerateKey(rand)
+	if err != nil {
+		return nil, nil, err
+	}
+	pubBytes, err := pub.MarshalBinary()
+	if err != nil {
+		return nil, nil, err
+	}
+	privBytes, err := priv.MarshalBinary()
+	if err != nil {
+		return nil, nil, err
+	}
+	return pubBytes, privBytes, nil
+}
+
+func (bn256Curve) BLSSign(priv, msg []byte) ([]byte, error) {
+	key := new(bls.PrivateKey)
+	if err := key.UnmarshalBinary(priv); err != nil {
+		return nil, errors.Wrap(err, "unmarshalling bls private key")
+	}
+	return bls.Sign(key, msg), nil
+}
+
+func (bn256Curve) BLSAggregate(sigs ...[]byte) ([]byte, error) {
+	blsSigs := make([]bls.Signature, len(sigs))
+	for i := range sigs {
+		blsSigs[i] = bls.Signature(sigs[i])
+	}
+	return bls.Aggregate(blsSigs...), nil
+}
+
+func (bn256Curve) BLSVerify(pubs, msgs [][]byte, sig []byte) bool {
+	keys := make([]*bls.PublicKey, len(pubs))
+	for i, b := range pubs {
+		keys[i] = new(bls.PublicKey)
+		if err := keys[i].UnmarshalBinary(b); err != nil {
+			return false
+		}
+	}
+	return bls.Verify(keys, msgs, bls.Signature(sig))
+}
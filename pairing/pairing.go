@@ -0,0 +1,85 @@
+// Copyright 2018 David Lazar. All rights reserved.
+// Use of this source code is governed by the GNU AGPL
+// license that can be found in the LICENSE file.
+
+// Package pairing abstracts the pairing-friendly curve used by the PKG
+// servers for identity-based encryption and BLS attestations.
+//
+// Keys, ciphertexts, and signatures are passed around as opaque byte
+// strings so that a PKG can serve several curves side by side while
+// the network migrates from one to another.
+//
+// Every curve, like the rest of Alpenhorn's cryptography, is written
+// in Go and needs no cgo. Where a dependency has assembly for the
+// target architecture it is selected automatically, and a portable Go
+// implementation is used everywhere else, so the client library and
+// servers cross-compile with CGO_ENABLED=0 for any GOOS and GOARCH that
+// Go supports. Building with -tags purego,generic forces the portable
+// code on every architecture.
+package pairing
+
+import (
+	"io"
+	"sort"
+
+	"vuvuzela.io/alpenhorn/errors"
+)
+
+// Names of the supported curves.
+const (
+	BN256    = "bn256"
+	BLS12381 = "bls12-381"
+)
+
+// A Curve provides Boneh-Franklin IBE and BLS signatures on a
+// pairing-friendly curve. Master public keys, identity private keys,
+// and signatures from different PKG servers on the same curve can be
+// aggregated.
+type Curve interface {
+	Name() string
+
+	// IBESetup generates a PKG master key pair.
+	IBESetup(rand io.Reader) (masterPub, masterPriv []byte, err error)
+	// IBEExtract returns the identity private key for id.
+	IBEExtract(masterPriv, id []byte) ([]byte, error)
+	// IBEEncrypt encrypts msg to id under the aggregate of masterPubs.
+	IBEEncrypt(rand io.Reader, masterPubs [][]byte, id, msg []byte) ([]byte, error)
+	// IBEDecrypt decrypts ctxt using the aggregate of idKeys.
+	IBEDecrypt(idKeys [][]byte, ctxt []byte) ([]byte, error)
+	// IBEOverhead is the ciphertext expansion of IBEEncrypt.
+	IBEOverhead() int
+
+	// BLSGenerateKey generates a signing key pair.
+	BLSGenerateKey(rand io.Reader) (pub, priv []byte, err error)
+	// BLSSign signs msg.
+	BLSSign(priv, msg []byte) ([]byte, error)
+	// BLSAggregate combines signatures into one.
+	BLSAggregate(sigs ...[]byte) ([]byte, error)
+	// BLSVerify verifies an aggregate signature where pubs[i]
+	// signed msgs[i]. The messages must be distinct.
+	BLSVerify(pubs, msgs [][]byte, sig []byte) bool
+}
+
+var curves = map[string]Curve{
+	BN256:    bn256Curve{},
+	BLS12381: bls12381Curve{},
+}
+
+// Lookup returns the curve with the given name.
+func Lookup(name string) (Curve, error) {
+	c, ok := curves[name]
+	if !ok {
+		return nil, errors.New("unknown pairing curve: %q", name)
+	}
+	return c, nil
+}
+
+// Names returns the names of the supported curves.
+func Names() []string {
+	names := make([]string, 0, len(curves))
+	for name := range curves {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
@@ -0,0 +1,143 @@
+// Copyright 2018 David Lazar. All rights reserved.
+// Use of this source code is governed by the GNU AGPL
+// license that can be found in the LICENSE file.
+
+package pairing
+
+import (
+	"bytes"
+	"crypto/rand"
+	"os"
+	"os/exec"
+	"strings"
+	"testing"
+)
+
+func TestBLS12381IBE(t *testing.T) {
+	curve, err := Lookup(BLS12381)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Two PKGs, as in a real deployment.
+	pub1, priv1, err := curve.IBESetup(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pub2, priv2, err := curve.IBESetup(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	id := []byte("alice@example.org")
+	msg := []byte("hello bob")
+	ctxt, err := curve.IBEEncrypt(rand.Reader, [][]byte{pub1, pub2}, id, msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ctxt) != len(msg)+curve.IBEOverhead() {
+		t.Fatalf("ciphertext length %d, want %d", len(ctxt), len(msg)+curve.IBEOverhead())
+	}
+
+	key1, err := curve.IBEExtract(priv1, id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key2, err := curve.IBEExtract(priv2, id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	out, err := curve.IBEDecrypt([][]byte{key1, key2}, ctxt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(out, msg) {
+		t.Fatalf("got %q, want %q", out, msg)
+	}
+
+	if _, err := curve.IBEDecrypt([][]byte{key1}, ctxt); err == nil {
+		t.Fatal("decrypted with one of two identity keys")
+	}
+	otherKey, _ := curve.IBEExtract(priv2, []byte("bob@example.org"))
+	if _, err := curve.IBEDecrypt([][]byte{key1, otherKey}, ctxt); err == nil {
+		t.Fatal("decrypted with another identity's key")
+	}
+}
+
+func TestBLS12381Signatures(t *testing.T) {
+	curve, _ := Lookup(BLS12381)
+
+	pub1, priv1, err := curve.BLSGenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pub2, priv2, err := curve.BLSGenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg1 := []byte("attestation 1")
+	msg2 := []byte("attestation 2")
+	sig1, err := curve.BLSSign(priv1, msg1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sig2, err := curve.BLSSign(priv2, msg2)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !curve.BLSVerify([][]byte{pub1}, [][]byte{msg1}, sig1) {
+		t.Fatal("single signature did not verify")
+	}
+	if curve.BLSVerify([][]byte{pub2}, [][]byte{msg1}, sig1) {
+		t.Fatal("signature verified under the wrong key")
+	}
+
+	agg, err := curve.BLSAggregate(sig1, sig2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !curve.BLSVerify([][]byte{pub1, pub2}, [][]byte{msg1, msg2}, agg) {
+		t.Fatal("aggregate signature did not verify")
+	}
+	if curve.BLSVerify([][]byte{pub1, pub2}, [][]byte{msg2, msg1}, agg) {
+		t.Fatal("aggregate signature verified with swapped messages")
+	}
+	if curve.BLSVerify([][]byte{pub1, pub1}, [][]byte{msg1, msg1}, sig1) {
+		t.Fatal("accepted duplicate messages")
+	}
+}
+
+func TestLookup(t *testing.T) {
+	for _, name := range Names() {
+		c, err := Lookup(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if c.Name() != name {
+			t.Fatalf("curve %q reports name %q", name, c.Name())
+		}
+	}
+	if _, err := Lookup("p256"); err == nil {
+		t.Fatal("expected error for unknown curve")
+	}
+}
+
+// TestNoCgo checks that nothing outside the standard library, which has
+// pure-Go fallbacks of its own, requires cgo to build.
+func TestNoCgo(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping go list in short mode")
+	}
+	cmd := exec.Command("go", "list", "-deps",
+		"-f", "{{if not .Standard}}{{if .CgoFiles}}{{.ImportPath}}{{end}}{{end}}",
+		"vuvuzela.io/alpenhorn/...")
+	cmd.Env = append(os.Environ(), "CGO_ENABLED=1")
+	out, err := cmd.Output()
+	if err != nil {
+		t.Skipf("go list: %s", err)
+	}
+	if pkgs := strings.Fields(string(out)); len(pkgs) > 0 {
+		t.Fatalf("packages require cgo: %s", strings.Join(pkgs, " "))
+	}
+}
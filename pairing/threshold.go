@@ -0,0 +1,261 @@
+// Copyright 2018 David Lazar. All rights reserved.
+// Use of this source code is governed by the GNU AGPL
+// license that can be found in the LICENSE file.
+
+package pairing
+
+import (
+	"io"
+
+	bls12381 "github.com/kilic/bls12-381"
+
+	"vuvuzela.io/alpenhorn/errors"
+)
+
+// A ThresholdCurve can also share a master key among n PKGs so that
+// any threshold of them can extract identity keys for it, using a
+// Feldman DKG: every PKG deals shares of its master private key from
+// IBESetup to every PKG, and each PKG adds up the shares it was dealt
+// into its share of the round's master private key. The master public
+// key is the sum of the dealers' master public keys, so a ciphertext
+// is encrypted with IBEEncrypt as before.
+//
+// Participants are numbered from 1 to n. A PKG extracts identity keys
+// with its share using IBEExtract, and a client combines the keys it
+// extracted from threshold PKGs with IBECombine.
+//
+// bn256, whose package exposes neither the scalars nor the points
+// needed, is not a ThresholdCurve.
+type ThresholdCurve interface {
+	Curve
+
+	// DKGDeal deals shares of masterPriv to n participants with the
+	// given threshold. commitments[k] commits to the k-th coefficient
+	// of the dealer's polynomial, so commitments[0] is the master
+	// public key for masterPriv; shares[j-1] is participant j's share.
+	DKGDeal(rand io.Reader, masterPriv []byte, threshold, n int) (commitments, shares [][]byte, err error)
+	// DKGVerifyShare checks participant index's share from a dealer
+	// against the dealer's commitments.
+	DKGVerifyShare(commitments [][]byte, index int, share []byte) bool
+	// DKGCombineCommitments adds up the commitments of the qualified
+	// dealers. The first of the sums is the master public key.
+	DKGCombineCommitments(commitments [][][]byte) ([][]byte, error)
+	// DKGCombineShares adds up a participant's shares from the
+	// qualified dealers into its share of the master private key.
+	DKGCombineShares(shares [][]byte) ([]byte, error)
+	// DKGPublicShare returns the public key of participant index's
+	// share of the master private key, given combined commitments.
+	DKGPublicShare(commitments [][]byte, index int) ([]byte, error)
+
+	// IBEVerifyShare checks an identity key extracted with the master
+	// key share whose public key is publicShare.
+	IBEVerifyShare(publicShare, id, idKey []byte) bool
+	// IBECombine interpolates the identity key for the master private
+	// key from the identity keys extracted by participants indexes.
+	// It needs keys from at least threshold participants; with fewer,
+	// it returns a key that does not decrypt.
+	IBECombine(indexes []int, idKeys [][]byte) ([]byte, error)
+}
+
+// LookupThreshold returns the named curve if it is a ThresholdCurve.
+func LookupThreshold(name string) (ThresholdCurve, error) {
+	c, err := Lookup(name)
+	if err != nil {
+		return nil, err
+	}
+	tc, ok := c.(ThresholdCurve)
+	if !ok {
+		return nil, errors.New("pairing curve %q does not support threshold keys", name)
+	}
+	return tc, nil
+}
+
+// frIndex returns participant index as a scalar.
+func frIndex(index int) *bls12381.Fr {
+	return &bls12381.Fr{uint64(index)}
+}
+
+func (bls12381Curve) DKGDeal(rand io.Reader, masterPriv []byte, threshold, n int) ([][]byte, [][]byte, error) {
+	if threshold < 1 || threshold > n {
+		return nil, nil, errors.New("bad threshold %d of %d", threshold, n)
+	}
+	s, err := decodeScalar(masterPriv)
+	if err != nil {
+		return nil, nil, err
+	}
+	coeffs := make([]*bls12381.Fr, threshold)
+	coeffs[0] = s
+	for k := 1; k < threshold; k++ {
+		coeffs[k], err = randScalar(rand)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+
+	g2 := bls12381.NewG2()
+	commitments := make([][]byte, threshold)
+	for k, a := range coeffs {
+		commitments[k] = g2.ToCompressed(g2.MulScalar(g2.New(), g2.One(), a))
+	}
+
+	shares := make([][]byte, n)
+	for j := 1; j <= n; j++ {
+		// Horner's rule: f(j) = a_0 + j(a_1 + j(a_2 + ...)).
+		x := frIndex(j)
+		f := bls12381.NewFr().Set(coeffs[threshold-1])
+		for k := threshold - 2; k >= 0; k-- {
+			f.Mul(f, x)
+			f.Add(f, coeffs[k])
+		}
+		shares[j-1] = f.ToBytes()
+	}
+	for _, a := range coeffs[1:] {
+		a.Zero()
+	}
+	return commitments, shares, nil
+}
+
+// evalCommitments returns the sum over k of index^k commitments[k].
+func evalCommitments(commitments [][]byte, index int) (*bls12381.PointG2, error) {
+	if len(commitments) == 0 {
+		return nil, errors.New("no commitments")
+	}
+	if index < 1 {
+		return nil, errors.New("bad participant index %d", index)
+	}
+	g2 := bls12381.NewG2()
+	x := frIndex(index)
+	sum := g2.Zero()
+	for k := len(commitments) - 1; k >= 0; k-- {
+		c, err := decodeG2(commitments[k])
+		if err != nil {
+			return nil, errors.Wrap(err, "commitment %d", k)
+		}
+		g2.MulScalar(sum, sum, x)
+		g2.Add(sum, sum, c)
+	}
+	return sum, nil
+}
+
+func (bls12381Curve) DKGVerifyShare(commitments [][]byte, index int, share []byte) bool {
+	s, err := decodeScalar(share)
+	if err != nil {
+		return false
+	}
+	want, err := evalCommitments(commitments, index)
+	if err != nil {
+		return false
+	}
+	g2 := bls12381.NewG2()
+	return g2.Equal(g2.MulScalar(g2.New(), g2.One(), s), want)
+}
+
+func (bls12381Curve) DKGCombineCommitments(commitments [][][]byte) ([][]byte, error) {
+	if len(commitments) == 0 {
+		return nil, errors.New("no commitments")
+	}
+	threshold := len(commitments[0])
+	for i, c := range commitments {
+		if len(c) != threshold {
+			return nil, errors.New("dealer %d: %d commitments, want %d", i, len(c), threshold)
+		}
+	}
+	g2 := bls12381.NewG2()
+	combined := make([][]byte, threshold)
+	column := make([][]byte, len(commitments))
+	for k := range combined {
+		for i, c := range commitments {
+			column[i] = c[k]
+		}
+		sum, err := sumG2(column)
+		if err != nil {
+			return nil, errors.Wrap(err, "commitment %d", k)
+		}
+		combined[k] = g2.ToCompressed(sum)
+	}
+	return combined, nil
+}
+
+func (bls12381Curve) DKGCombineShares(shares [][]byte) ([]byte, error) {
+	if len(shares) == 0 {
+		return nil, errors.New("no shares")
+	}
+	sum := bls12381.NewFr().Zero()
+	for i, b := range shares {
+		s, err := decodeScalar(b)
+		if err != nil {
+			return nil, errors.Wrap(err, "share %d", i)
+		}
+		sum.Add(sum, s)
+		s.Zero()
+	}
+	return sum.ToBytes(), nil
+}
+
+func (bls12381Curve) DKGPublicShare(commitments [][]byte, index int) ([]byte, error) {
+	p, err := evalCommitments(commitments, index)
+	if err != nil {
+		return nil, err
+	}
+	return bls12381.NewG2().ToCompressed(p), nil
+}
+
+func (bls12381Curve) IBEVerifyShare(publicShare, id, idKey []byte) bool {
+	pub, err := decodeG2(publicShare)
+	if err != nil {
+		return false
+	}
+	k, err := decodeG1(idKey)
+	if err != nil {
+		return false
+	}
+	g1 := bls12381.NewG1()
+	q, err := g1.HashToCurve(id, ibeDomain)
+	if err != nil {
+		return false
+	}
+	// e(sH(id), P) = e(H(id), sP)
+	e := bls12381.NewEngine()
+	e.AddPair(q, pub)
+	e.AddPairInv(k, bls12381.NewG2().One())
+	return e.Check()
+}
+
+func (bls12381Curve) IBECombine(indexes []int, idKeys [][]byte) ([]byte, error) {
+	if len(indexes) != len(idKeys) || len(indexes) == 0 {
+		return nil, errors.New("%d indexes for %d identity keys", len(indexes), len(idKeys))
+	}
+	seen := make(map[int]bool, len(indexes))
+	for _, j := range indexes {
+		if j < 1 || seen[j] {
+			return nil, errors.New("bad participant index %d", j)
+		}
+		seen[j] = true
+	}
+
+	g1 := bls12381.NewG1()
+	sum := g1.Zero()
+	for i, j := range indexes {
+		k, err := decodeG1(idKeys[i])
+		if err != nil {
+			return nil, errors.Wrap(err, "identity key %d", i)
+		}
+		// The Lagrange coefficient at 0: the product over the other
+		// indexes m of m/(m-j).
+		num := bls12381.NewFr().One()
+		den := bls12381.NewFr().One()
+		for _, m := range indexes {
+			if m == j {
+				continue
+			}
+			num.Mul(num, frIndex(m))
+			d := bls12381.NewFr()
+			d.Sub(frIndex(m), frIndex(j))
+			den.Mul(den, d)
+		}
+		den.Inverse(den)
+		num.Mul(num, den)
+		g1.Add(sum, sum, g1.MulScalar(k, k, num))
+	}
+	return g1.ToCompressed(sum), nil
+}
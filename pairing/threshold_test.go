@@ -0,0 +1,130 @@
+// Copyright 2018 David Lazar. All rights reserved.
+// Use of this source code is governed by the GNU AGPL
+// license that can be found in the LICENSE file.
+
+package pairing
+
+import (
+	"bytes"
+	"crypto/rand"
+	"testing"
+)
+
+func TestThresholdIBE(t *testing.T) {
+	curve, err := LookupThreshold(BLS12381)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := LookupThreshold(BN256); err == nil {
+		t.Fatal("bn256 claims to support threshold keys")
+	}
+
+	// Three PKGs, any two of which can extract keys.
+	const n, threshold = 3, 2
+	pubs := make([][]byte, n)
+	commitments := make([][][]byte, n)
+	shares := make([][][]byte, n) // shares[dealer][participant-1]
+	for i := range pubs {
+		var priv []byte
+		pubs[i], priv, err = curve.IBESetup(rand.Reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		commitments[i], shares[i], err = curve.DKGDeal(rand.Reader, priv, threshold, n)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(commitments[i][0], pubs[i]) {
+			t.Fatalf("dealer %d: first commitment is not the master public key", i)
+		}
+	}
+	if !curve.DKGVerifyShare(commitments[0], 2, shares[0][1]) {
+		t.Fatal("good share does not verify")
+	}
+	if curve.DKGVerifyShare(commitments[0], 2, shares[1][1]) {
+		t.Fatal("share from another dealer verifies")
+	}
+	if curve.DKGVerifyShare(commitments[0], 3, shares[0][1]) {
+		t.Fatal("share for another participant verifies")
+	}
+
+	group, err := curve.DKGCombineCommitments(commitments)
+	if err != nil {
+		t.Fatal(err)
+	}
+	masterShares := make([][]byte, n)
+	for j := 1; j <= n; j++ {
+		var dealt [][]byte
+		for i := range shares {
+			dealt = append(dealt, shares[i][j-1])
+		}
+		masterShares[j-1], err = curve.DKGCombineShares(dealt)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	id := []byte("alice@example.org")
+	msg := []byte("hello bob")
+	// Encrypting to the group key is encrypting to every dealer.
+	ctxt, err := curve.IBEEncrypt(rand.Reader, [][]byte{group[0]}, id, msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctxt2, err := curve.IBEEncrypt(rand.Reader, pubs, id, msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	idKeys := make([][]byte, n)
+	for j := 1; j <= n; j++ {
+		idKeys[j-1], err = curve.IBEExtract(masterShares[j-1], id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		pub, err := curve.DKGPublicShare(group, j)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !curve.IBEVerifyShare(pub, id, idKeys[j-1]) {
+			t.Fatalf("identity key from participant %d does not verify", j)
+		}
+		if curve.IBEVerifyShare(pub, []byte("bob@example.org"), idKeys[j-1]) {
+			t.Fatalf("identity key from participant %d verifies for another identity", j)
+		}
+	}
+
+	for _, indexes := range [][]int{{1, 2}, {1, 3}, {3, 2}, {1, 2, 3}} {
+		keys := make([][]byte, len(indexes))
+		for i, j := range indexes {
+			keys[i] = idKeys[j-1]
+		}
+		idKey, err := curve.IBECombine(indexes, keys)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, c := range [][]byte{ctxt, ctxt2} {
+			out, err := curve.IBEDecrypt([][]byte{idKey}, c)
+			if err != nil {
+				t.Fatalf("participants %v: %s", indexes, err)
+			}
+			if !bytes.Equal(out, msg) {
+				t.Fatalf("participants %v: got %q, want %q", indexes, out, msg)
+			}
+		}
+	}
+
+	idKey, err := curve.IBECombine([]int{2}, idKeys[1:2])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := curve.IBEDecrypt([][]byte{idKey}, ctxt); err == nil {
+		t.Fatal("decrypted with fewer than threshold identity keys")
+	}
+	if _, err := curve.IBECombine([]int{1, 1}, idKeys[:2]); err == nil {
+		t.Fatal("combined a repeated participant")
+	}
+	if _, _, err := curve.DKGDeal(rand.Reader, shares[0][0], n+1, n); err == nil {
+		t.Fatal("dealt with a threshold above n")
+	}
+}
@@ -8,6 +8,7 @@ import (
 	"crypto/ed25519"
 	"encoding/json"
 	"io/ioutil"
+	"time"
 
 	"vuvuzela.io/alpenhorn/config"
 	"vuvuzela.io/internal/ioutil2"
@@ -19,6 +20,7 @@ type persistedState struct {
 	LongTermPublicKey  ed25519.PublicKey
 	LongTermPrivateKey ed25519.PrivateKey
 	PKGLoginKey        ed25519.PrivateKey
+	PQSeed             []byte
 
 	AddFriendConfig *config.SignedConfig
 	DialingConfig   *config.SignedConfig
@@ -26,6 +28,7 @@ type persistedState struct {
 	IncomingFriendRequests []*IncomingFriendRequest
 	OutgoingFriendRequests []*OutgoingFriendRequest
 	SentFriendRequests     []*sentFriendRequest
+	OutgoingCalls          []*persistedCall
 	Friends                map[string]*persistedFriend
 }
 
@@ -38,10 +41,60 @@ type persistedFriend struct {
 	ExtraData   []byte
 }
 
+// persistedCall is the persisted representation of a queued OutgoingCall.
+//easyjson:readable
+type persistedCall struct {
+	Username string
+	Intent   int
+	Created  time.Time
+}
+
+// A Storage holds the client's persisted state, such as files on disk
+// or a browser's IndexedDB. The client's ClientPersistPath and
+// KeywheelPersistPath name the state in the storage.
+type Storage interface {
+	ReadFile(name string) ([]byte, error)
+
+	// WriteFile replaces the named state with data. It should not
+	// leave partially written state behind if it fails.
+	WriteFile(name string, data []byte) error
+}
+
+// FileStorage stores the client's state in files. It is the storage
+// used when Client.Storage is nil.
+type FileStorage struct{}
+
+func (FileStorage) ReadFile(name string) ([]byte, error) {
+	return ioutil.ReadFile(name)
+}
+
+func (FileStorage) WriteFile(name string, data []byte) error {
+	return ioutil2.WriteFileAtomic(name, data, 0600)
+}
+
+func (c *Client) storage() Storage {
+	if c.Storage == nil {
+		return FileStorage{}
+	}
+	return c.Storage
+}
+
 // LoadClient loads a client from persisted state at the given path.
 // You should set the client's KeywheelPersistPath before connecting.
 func LoadClient(clientPersistPath, keywheelPersistPath string) (*Client, error) {
-	clientData, err := ioutil.ReadFile(clientPersistPath)
+	return LoadClientFrom(nil, clientPersistPath, keywheelPersistPath)
+}
+
+// LoadClientFrom is like LoadClient but loads the client's state from
+// storage. If storage is nil, it loads from files.
+func LoadClientFrom(storage Storage, clientPersistPath, keywheelPersistPath string) (*Client, error) {
+	c := &Client{
+		Storage:             storage,
+		ClientPersistPath:   clientPersistPath,
+		KeywheelPersistPath: keywheelPersistPath,
+	}
+
+	clientData, err := c.storage().ReadFile(clientPersistPath)
 	if err != nil {
 		return nil, err
 	}
@@ -52,15 +105,11 @@ func LoadClient(clientPersistPath, keywheelPersistPath string) (*Client, error)
 		return nil, err
 	}
 
-	keywheelData, err := ioutil.ReadFile(keywheelPersistPath)
+	keywheelData, err := c.storage().ReadFile(keywheelPersistPath)
 	if err != nil {
 		return nil, err
 	}
 
-	c := &Client{
-		ClientPersistPath:   clientPersistPath,
-		KeywheelPersistPath: keywheelPersistPath,
-	}
 	err = c.wheel.UnmarshalBinary(keywheelData)
 	if err != nil {
 		return nil, err
@@ -75,6 +124,7 @@ func (c *Client) loadStateLocked(st *persistedState) {
 	c.LongTermPublicKey = st.LongTermPublicKey
 	c.LongTermPrivateKey = st.LongTermPrivateKey
 	c.PKGLoginKey = st.PKGLoginKey
+	c.pqSeed = st.PQSeed
 
 	c.addFriendConfig = st.AddFriendConfig
 	c.addFriendConfigHash = st.AddFriendConfig.Hash()
@@ -83,9 +133,27 @@ func (c *Client) loadStateLocked(st *persistedState) {
 	c.dialingConfigHash = st.DialingConfig.Hash()
 
 	c.incomingFriendRequests = st.IncomingFriendRequests
-	c.outgoingFriendRequests = st.OutgoingFriendRequests
 	c.sentFriendRequests = st.SentFriendRequests
 
+	// Drop duplicates that older clients may have queued.
+	c.outgoingFriendRequests = nil
+	for _, req := range st.OutgoingFriendRequests {
+		if c.queuedFriendRequestLocked(req) == nil {
+			c.outgoingFriendRequests = append(c.outgoingFriendRequests, req)
+		}
+	}
+	c.outgoingCalls = nil
+	for _, call := range st.OutgoingCalls {
+		if c.queuedCallLocked(call.Username) == nil {
+			c.outgoingCalls = append(c.outgoingCalls, &OutgoingCall{
+				Username: call.Username,
+				Created:  call.Created,
+				client:   c,
+				intent:   call.Intent,
+			})
+		}
+	}
+
 	for _, req := range c.incomingFriendRequests {
 		req.client = c
 	}
@@ -145,6 +213,7 @@ func (c *Client) persistClientLocked() error {
 		LongTermPublicKey:  c.LongTermPublicKey,
 		LongTermPrivateKey: c.LongTermPrivateKey,
 		PKGLoginKey:        c.PKGLoginKey,
+		PQSeed:             c.pqSeed,
 
 		AddFriendConfig: c.addFriendConfig,
 		DialingConfig:   c.dialingConfig,
@@ -153,9 +222,19 @@ func (c *Client) persistClientLocked() error {
 		OutgoingFriendRequests: c.outgoingFriendRequests,
 		SentFriendRequests:     c.sentFriendRequests,
 
+		OutgoingCalls: make([]*persistedCall, len(c.outgoingCalls)),
+
 		Friends: make(map[string]*persistedFriend, len(c.friends)),
 	}
 
+	for i, call := range c.outgoingCalls {
+		st.OutgoingCalls[i] = &persistedCall{
+			Username: call.Username,
+			Intent:   call.intent,
+			Created:  call.Created,
+		}
+	}
+
 	for username, friend := range c.friends {
 		st.Friends[username] = &persistedFriend{
 			Username:    friend.Username,
@@ -169,7 +248,7 @@ func (c *Client) persistClientLocked() error {
 		return err
 	}
 
-	return ioutil2.WriteFileAtomic(c.ClientPersistPath, data, 0600)
+	return c.storage().WriteFile(c.ClientPersistPath, data)
 }
 
 func (c *Client) persistKeywheel() error {
@@ -189,5 +268,5 @@ func (c *Client) persistKeywheelLocked() error {
 		return err
 	}
 
-	return ioutil2.WriteFileAtomic(c.KeywheelPersistPath, data, 0600)
+	return c.storage().WriteFile(c.KeywheelPersistPath, data)
 }
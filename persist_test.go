@@ -0,0 +1,135 @@
+// Copyright 2018 David Lazar. All rights reserved.
+// Use of this source code is governed by the GNU AGPL
+// license that can be found in the LICENSE file.
+
+package alpenhorn
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"vuvuzela.io/alpenhorn/config"
+)
+
+func TestPersistOutgoingQueue(t *testing.T) {
+	dir := t.TempDir()
+	c := &Client{
+		Username:            "alice@example.org",
+		ClientPersistPath:   filepath.Join(dir, "client"),
+		KeywheelPersistPath: filepath.Join(dir, "keywheel"),
+
+		addFriendConfig: &config.SignedConfig{
+			Version: config.SignedConfigVersion,
+			Service: "AddFriend",
+			Inner:   &config.AddFriendConfig{Version: config.AddFriendConfigVersion},
+		},
+		dialingConfig: &config.SignedConfig{
+			Version: config.SignedConfigVersion,
+			Service: "Dialing",
+			Inner:   &config.DialingConfig{Version: config.DialingConfigVersion},
+		},
+	}
+	c.wheel.Put("bob@example.org", 1, new([32]byte))
+	bob := &Friend{Username: "bob@example.org", client: c}
+	c.friends = map[string]*Friend{bob.Username: bob}
+
+	req1, err := c.SendFriendRequest("carol@example.org", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req2, err := c.SendFriendRequest("carol@example.org", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if req1 != req2 {
+		t.Fatal("duplicate friend request was queued")
+	}
+
+	call1 := bob.Call(1)
+	call2 := bob.Call(2)
+	if call1 != call2 || call1.Intent() != 2 {
+		t.Fatal("duplicate call was queued")
+	}
+
+	c2, err := LoadClient(c.ClientPersistPath, c.KeywheelPersistPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reqs := c2.GetOutgoingFriendRequests()
+	if len(reqs) != 1 || reqs[0].Username != "carol@example.org" {
+		t.Fatalf("unexpected friend requests after restart: %+v", reqs)
+	}
+	if len(c2.outgoingCalls) != 1 {
+		t.Fatalf("got %d calls after restart, want 1", len(c2.outgoingCalls))
+	}
+	call := c2.outgoingCalls[0]
+	if call.Username != "bob@example.org" || call.Intent() != 2 || !call.Created.Equal(call1.Created) {
+		t.Fatalf("unexpected call after restart: %+v", call)
+	}
+
+	if err := call.Cancel(); err != nil {
+		t.Fatal(err)
+	}
+	c3, err := LoadClient(c.ClientPersistPath, c.KeywheelPersistPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(c3.outgoingCalls) != 0 {
+		t.Fatal("canceled call was persisted")
+	}
+}
+
+type memStorage map[string][]byte
+
+func (s memStorage) ReadFile(name string) ([]byte, error) {
+	data, ok := s[name]
+	if !ok {
+		return nil, os.ErrNotExist
+	}
+	return data, nil
+}
+
+func (s memStorage) WriteFile(name string, data []byte) error {
+	s[name] = append([]byte(nil), data...)
+	return nil
+}
+
+func TestPersistStorage(t *testing.T) {
+	storage := make(memStorage)
+	c := &Client{
+		Username:            "alice@example.org",
+		Storage:             storage,
+		ClientPersistPath:   "client",
+		KeywheelPersistPath: "keywheel",
+
+		addFriendConfig: &config.SignedConfig{
+			Version: config.SignedConfigVersion,
+			Service: "AddFriend",
+			Inner:   &config.AddFriendConfig{Version: config.AddFriendConfigVersion},
+		},
+		dialingConfig: &config.SignedConfig{
+			Version: config.SignedConfigVersion,
+			Service: "Dialing",
+			Inner:   &config.DialingConfig{Version: config.DialingConfigVersion},
+		},
+	}
+	c.wheel.Put("bob@example.org", 1, new([32]byte))
+	if err := c.Persist(); err != nil {
+		t.Fatal(err)
+	}
+	if len(storage) != 2 {
+		t.Fatalf("got %d entries in storage, want 2", len(storage))
+	}
+
+	c2, err := LoadClientFrom(storage, "client", "keywheel")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c2.Username != c.Username || c2.Storage == nil {
+		t.Fatalf("unexpected client after load: %q", c2.Username)
+	}
+	if _, err := LoadClientFrom(storage, "missing", "keywheel"); !os.IsNotExist(err) {
+		t.Fatalf("expected not-exist error, got %v", err)
+	}
+}
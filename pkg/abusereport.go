@@ -0,0 +1,317 @@
+// Copyright 2018 David Lazar. All rights reserved.
+// Use of this source code is governed by the GNU AGPL
+// license that can be found in the LICENSE file.
+
+//go:build !js
+// +build !js
+
+package pkg
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"time"
+
+	"vuvuzela.io/alpenhorn/log"
+	"vuvuzela.io/alpenhorn/pkg/kv"
+)
+
+// A registered user can report another username to the operator, such
+// as one that floods them with friend requests. The report is signed
+// with the reporter's login key or a device key, and kept in the
+// database, where the admin API lists it for review, until
+// AbuseReportRetention passes.
+//
+// Reports carry only what the reporter chose to say. The server does
+// not record the reporter's address, and its reply does not say
+// whether the reported username is registered, so reports cannot be
+// used to probe for users. The PKG never sees friend requests or
+// calls, so a report cannot be checked against them either; the
+// operator acts on it with the blocklist or by deleting the account.
+
+// DefaultAbuseReportRetention is how long abuse reports are kept if
+// Config.AbuseReportRetention is zero.
+const DefaultAbuseReportRetention = 90 * 24 * time.Hour
+
+var dbAbuseReportPrefix = []byte("abusereport:")
+
+// An AbuseReport is a report filed by Reporter about Reported.
+type AbuseReport struct {
+	// ID identifies the report in the admin API.
+	ID string
+
+	Time     time.Time
+	Reporter string
+	Reported string
+	Category AbuseCategory
+	Details  string `json:",omitempty"`
+
+	// ReporterKey is the fingerprint of the key that signed the
+	// report, and Signature is the signature, kept as evidence that
+	// Reporter filed it.
+	ReporterKey string
+	Signature   []byte
+
+	// Resolved is when an operator resolved the report, and
+	// Resolution is what they noted.
+	Resolved   *time.Time `json:",omitempty"`
+	Resolution string     `json:",omitempty"`
+}
+
+func validAbuseCategory(c AbuseCategory) bool {
+	switch c {
+	case AbuseSpam, AbuseHarassment, AbuseImpersonation, AbuseOther:
+		return true
+	}
+	return false
+}
+
+func abuseReportKey(id string) ([]byte, error) {
+	b, err := hex.DecodeString(id)
+	if err != nil || len(b) != 16 {
+		return nil, errorf(ErrBadRequestJSON, "invalid report id %q", id)
+	}
+	return append(append([]byte(nil), dbAbuseReportPrefix...), b...), nil
+}
+
+func newAbuseReportKey(t time.Time) []byte {
+	key := appendUint64(append([]byte(nil), dbAbuseReportPrefix...), uint64(t.UnixNano()))
+	var r [8]byte
+	rand.Read(r[:])
+	return append(key, r[:]...)
+}
+
+func (srv *Server) abuseReportHandler(w http.ResponseWriter, req *http.Request) {
+	body := http.MaxBytesReader(w, req.Body, 4096)
+	args := new(abuseReportArgs)
+	err := json.NewDecoder(body).Decode(args)
+	if err != nil {
+		httpError(w, errorf(ErrBadRequestJSON, "%s", err))
+		return
+	}
+	if !srv.limitUsername(w, args.Username) {
+		return
+	}
+	args.ServerSigningKey = srv.publicKey
+
+	err = srv.reportAbuse(args)
+	if err != nil {
+		if isInternalError(err) {
+			srv.log.WithFields(log.Fields{
+				"username": args.Username,
+				"code":     errorCode(err).String(),
+			}).Errorf("Abuse report failed: %s", err)
+		}
+		httpError(w, err)
+		return
+	}
+	w.Write([]byte(`"OK"`))
+}
+
+func (srv *Server) reportAbuse(args *abuseReportArgs) error {
+	if err := ValidateUsername(args.Reported); err != nil {
+		return errorf(ErrInvalidUsername, "reported: %s", err)
+	}
+	if !validAbuseCategory(args.Category) {
+		return errorf(ErrBadRequestJSON, "unknown abuse category %q", args.Category)
+	}
+	if len(args.Details) > MaxAbuseReportDetails {
+		return errorf(ErrBadRequestJSON, "details are %d bytes, at most %d allowed", len(args.Details), MaxAbuseReportDetails)
+	}
+	now := srv.clock.Now()
+	if err := checkFresh(args.Time, now); err != nil {
+		return err
+	}
+	user, _, err := srv.getUser(nil, args.Username)
+	if err != nil {
+		return err
+	}
+	var signer ed25519.PublicKey
+	if !srv.verifyBound(&args.ServerSigningKey, func() bool {
+		signer = user.deviceSigner(args.msg(), args.Signature)
+		return signer != nil
+	}) {
+		return errorf(ErrInvalidSignature, "")
+	}
+
+	key := newAbuseReportKey(now)
+	report := &AbuseReport{
+		ID:          hex.EncodeToString(key[len(dbAbuseReportPrefix):]),
+		Time:        now,
+		Reporter:    args.Username,
+		Reported:    args.Reported,
+		Category:    args.Category,
+		Details:     args.Details,
+		ReporterKey: KeyFingerprint(signer),
+		Signature:   args.Signature,
+	}
+	data, err := json.Marshal(report)
+	if err != nil {
+		panic(err)
+	}
+	err = srv.db.Update(func(tx kv.Txn) error {
+		if err := checkReplay(tx, "report", args.Signature, now); err != nil {
+			return err
+		}
+		return tx.SetWithTTL(key, data, srv.abuseReportRetention)
+	})
+	if _, ok := err.(Error); ok {
+		return err
+	} else if err != nil {
+		return errorf(ErrDatabaseError, "%s", err)
+	}
+	srv.log.WithFields(log.Fields{"id": report.ID, "category": report.Category}).Info("Abuse report filed")
+	return nil
+}
+
+// An AbuseReportQuery selects abuse reports. Zero fields match every
+// report.
+type AbuseReportQuery struct {
+	Reporter string
+	Reported string
+	Since    time.Time
+
+	// Open selects only the reports that are not resolved.
+	Open bool
+
+	// Limit is the most reports to return, keeping the latest.
+	Limit int
+}
+
+func (q *AbuseReportQuery) matches(r *AbuseReport) bool {
+	return (q.Reporter == "" || r.Reporter == q.Reporter) &&
+		(q.Reported == "" || r.Reported == q.Reported) &&
+		!r.Time.Before(q.Since) &&
+		(!q.Open || r.Resolved == nil)
+}
+
+// AbuseReports returns the abuse reports in the database that match q,
+// oldest first.
+func (srv *Server) AbuseReports(q AbuseReportQuery) ([]*AbuseReport, error) {
+	reports := make([]*AbuseReport, 0)
+	err := srv.db.View(func(tx kv.Txn) error {
+		return tx.Iterate(dbAbuseReportPrefix, func(key, data []byte) error {
+			r := new(AbuseReport)
+			if err := json.Unmarshal(data, r); err != nil {
+				return errorf(ErrDatabaseError, "abuse report %x: %s", key, err)
+			}
+			if q.matches(r) {
+				reports = append(reports, r)
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	if q.Limit > 0 && len(reports) > q.Limit {
+		reports = reports[len(reports)-q.Limit:]
+	}
+	return reports, nil
+}
+
+// ResolveAbuseReport marks the report with the given ID resolved,
+// noting resolution. The report is kept until its retention passes.
+func (srv *Server) ResolveAbuseReport(id string, resolution string) (*AbuseReport, error) {
+	key, err := abuseReportKey(id)
+	if err != nil {
+		return nil, err
+	}
+	now := srv.clock.Now()
+	r := new(AbuseReport)
+	err = srv.db.Update(func(tx kv.Txn) error {
+		data, err := tx.Get(key)
+		if err == kv.ErrNotFound {
+			return errorf(ErrBadRequestJSON, "no abuse report %q", id)
+		} else if err != nil {
+			return err
+		}
+		if err := json.Unmarshal(data, r); err != nil {
+			return err
+		}
+		r.Resolved = &now
+		r.Resolution = resolution
+		data, err = json.Marshal(r)
+		if err != nil {
+			panic(err)
+		}
+		ttl := srv.abuseReportRetention - now.Sub(r.Time)
+		if ttl <= 0 {
+			return tx.Delete(key)
+		}
+		return tx.SetWithTTL(key, data, ttl)
+	})
+	if _, ok := err.(Error); ok {
+		return nil, err
+	} else if err != nil {
+		return nil, errorf(ErrDatabaseError, "%s", err)
+	}
+	return r, nil
+}
+
+// abuseReportsHandler serves the abuse report admin endpoints:
+// GET /admin/reports lists reports, selected by the query parameters
+// reporter, reported, since (RFC 3339), open, and limit, and POST
+// /admin/reports/resolve takes a JSON object with ID and Resolution.
+func (srv *Server) abuseReportsHandler(w http.ResponseWriter, req *http.Request) {
+	var reply interface{}
+	var err error
+	switch req.URL.Path {
+	case "/admin/reports":
+		q := AbuseReportQuery{
+			Reporter: req.FormValue("reporter"),
+			Reported: req.FormValue("reported"),
+			Open:     req.FormValue("open") == "true",
+		}
+		if s := req.FormValue("since"); s != "" {
+			q.Since, err = time.Parse(time.RFC3339, s)
+			if err != nil {
+				httpError(w, errorf(ErrBadRequestJSON, "since: %s", err))
+				return
+			}
+		}
+		if s := req.FormValue("limit"); s != "" {
+			q.Limit, err = strconv.Atoi(s)
+			if err != nil {
+				httpError(w, errorf(ErrBadRequestJSON, "limit: %s", err))
+				return
+			}
+		}
+		reply, err = srv.AbuseReports(q)
+	case "/admin/reports/resolve":
+		if req.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		var args struct {
+			ID         string
+			Resolution string
+		}
+		body := http.MaxBytesReader(w, req.Body, 4096)
+		if err := json.NewDecoder(body).Decode(&args); err != nil {
+			httpError(w, errorf(ErrBadRequestJSON, "%s", err))
+			return
+		}
+		reply, err = srv.ResolveAbuseReport(args.ID, args.Resolution)
+	default:
+		http.NotFound(w, req)
+		return
+	}
+	if err != nil {
+		if isInternalError(err) {
+			srv.log.Errorf("%s: %s", req.URL.Path, err)
+		}
+		httpError(w, err)
+		return
+	}
+	bs, err := json.Marshal(reply)
+	if err != nil {
+		panic(err)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(bs)
+}
@@ -0,0 +1,107 @@
+// Copyright 2018 David Lazar. All rights reserved.
+// Use of this source code is governed by the GNU AGPL
+// license that can be found in the LICENSE file.
+
+package pkg_test
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"strings"
+	"testing"
+
+	"vuvuzela.io/alpenhorn/edhttp"
+	"vuvuzela.io/alpenhorn/pkg"
+)
+
+func TestAbuseReports(t *testing.T) {
+	testpkg, _ := launchPKG(t, func(username string, token string) error {
+		return nil
+	})
+	defer testpkg.Close()
+	server := testpkg.PublicServerConfig
+
+	alicePub, aliceKey, _ := ed25519.GenerateKey(rand.Reader)
+	alice := &pkg.Client{
+		Username:        "alice@example.org",
+		LoginKey:        aliceKey,
+		UserLongTermKey: alicePub,
+		HTTPClient:      new(edhttp.Client),
+	}
+	if err := alice.Register(server, ""); err != nil {
+		t.Fatal(err)
+	}
+
+	// Reports are filed whether or not the reported user exists.
+	err := alice.ReportAbuse(server, "mallory@example.org", pkg.AbuseSpam, "sends a friend request every round")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := alice.ReportAbuse(server, "eve@example.org", pkg.AbuseHarassment, ""); err != nil {
+		t.Fatal(err)
+	}
+
+	err = alice.ReportAbuse(server, "eve@example.org", "unknown", "")
+	if err.(pkg.Error).Code != pkg.ErrBadRequestJSON {
+		t.Fatalf("expected ErrBadRequestJSON for unknown category, got %v", err)
+	}
+	err = alice.ReportAbuse(server, "eve@example.org", pkg.AbuseOther, strings.Repeat("x", pkg.MaxAbuseReportDetails+1))
+	if err.(pkg.Error).Code != pkg.ErrBadRequestJSON {
+		t.Fatalf("expected ErrBadRequestJSON for long details, got %v", err)
+	}
+
+	// Only registered users can report.
+	_, bobKey, _ := ed25519.GenerateKey(rand.Reader)
+	bob := *alice
+	bob.Username = "bob@example.org"
+	bob.LoginKey = bobKey
+	err = bob.ReportAbuse(server, "eve@example.org", pkg.AbuseSpam, "")
+	if err.(pkg.Error).Code != pkg.ErrNotRegistered {
+		t.Fatalf("expected ErrNotRegistered, got %v", err)
+	}
+	imposter := *alice
+	imposter.LoginKey = bobKey
+	err = imposter.ReportAbuse(server, "eve@example.org", pkg.AbuseSpam, "")
+	if err.(pkg.Error).Code != pkg.ErrInvalidSignature {
+		t.Fatalf("expected ErrInvalidSignature, got %v", err)
+	}
+
+	srv := testpkg.PKGServer
+	reports, err := srv.AbuseReports(pkg.AbuseReportQuery{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(reports) != 2 {
+		t.Fatalf("got %d reports, want 2", len(reports))
+	}
+	r := reports[0]
+	if r.Reporter != "alice@example.org" || r.Reported != "mallory@example.org" || r.Category != pkg.AbuseSpam || r.ReporterKey != pkg.KeyFingerprint(aliceKey.Public().(ed25519.PublicKey)) {
+		t.Fatalf("unexpected report: %+v", r)
+	}
+
+	resolved, err := srv.ResolveAbuseReport(r.ID, "blocked mallory")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resolved.Resolved == nil || resolved.Resolution != "blocked mallory" {
+		t.Fatalf("unexpected resolved report: %+v", resolved)
+	}
+	reports, err = srv.AbuseReports(pkg.AbuseReportQuery{Open: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(reports) != 1 || reports[0].Reported != "eve@example.org" {
+		t.Fatalf("unexpected open reports: %+v", reports)
+	}
+	reports, err = srv.AbuseReports(pkg.AbuseReportQuery{Reported: "mallory@example.org"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(reports) != 1 || reports[0].Resolved == nil {
+		t.Fatalf("unexpected reports about mallory: %+v", reports)
+	}
+
+	if _, err := srv.ResolveAbuseReport("00", ""); err == nil {
+		t.Fatal("resolved a report with a bad id")
+	}
+}
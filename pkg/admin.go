@@ -0,0 +1,99 @@
+// Copyright 2018 David Lazar. All rights reserved.
+// Use of this source code is governed by the GNU AGPL
+// license that can be found in the LICENSE file.
+
+//go:build !js
+// +build !js
+
+package pkg
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// AdminHandler returns a handler for the admin API, which only answers
+// requests made over TLS with Config.AdminKey. It should be served on
+// its own listener, not alongside the PKG's API.
+func (srv *Server) AdminHandler() http.Handler {
+	return http.HandlerFunc(srv.adminHandler)
+}
+
+func (srv *Server) adminHandler(w http.ResponseWriter, req *http.Request) {
+	if len(srv.adminKey) == 0 {
+		httpError(w, errorf(ErrUnauthorized, "no admin key configured"))
+		return
+	}
+	if !srv.authorized(srv.adminKey, w, req) {
+		return
+	}
+	if !srv.begin() {
+		httpError(w, errorf(ErrShuttingDown, ""))
+		return
+	}
+	defer srv.inflight.Done()
+
+	switch req.URL.Path {
+	case "/admin/audit":
+		srv.auditHandler(w, req)
+	case "/admin/blocklist", "/admin/blocklist/add", "/admin/blocklist/remove":
+		srv.blocklistHandler(w, req)
+	case "/admin/reserved/override":
+		srv.reservedHandler(w, req)
+	case "/admin/maintenance":
+		srv.maintenanceHandler(w, req)
+	case "/admin/reports", "/admin/reports/resolve":
+		srv.abuseReportsHandler(w, req)
+	case "/admin/roundstats":
+		srv.roundStatsHandler(w, req)
+	default:
+		if strings.HasPrefix(req.URL.Path, "/admin/debug/") {
+			srv.debugHandler(w, req)
+			return
+		}
+		http.NotFound(w, req)
+	}
+}
+
+// auditHandler answers audit log queries. The query parameters are
+// username, type, since (RFC 3339), and limit.
+func (srv *Server) auditHandler(w http.ResponseWriter, req *http.Request) {
+	q := AuditQuery{
+		Username: req.FormValue("username"),
+		Type:     AuditEventType(req.FormValue("type")),
+	}
+	if s := req.FormValue("since"); s != "" {
+		since, err := time.Parse(time.RFC3339, s)
+		if err != nil {
+			httpError(w, errorf(ErrBadRequestJSON, "since: %s", err))
+			return
+		}
+		q.Since = since
+	}
+	if s := req.FormValue("limit"); s != "" {
+		limit, err := strconv.Atoi(s)
+		if err != nil {
+			httpError(w, errorf(ErrBadRequestJSON, "limit: %s", err))
+			return
+		}
+		q.Limit = limit
+	}
+
+	events, err := srv.AuditEvents(q)
+	if err != nil {
+		if _, ok := err.(Error); !ok {
+			err = errorf(ErrDatabaseError, "%s", err)
+		}
+		httpError(w, err)
+		return
+	}
+	bs, err := json.Marshal(events)
+	if err != nil {
+		panic(err)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(bs)
+}
@@ -0,0 +1,126 @@
+// Copyright 2018 David Lazar. All rights reserved.
+// Use of this source code is governed by the GNU AGPL
+// license that can be found in the LICENSE file.
+
+//go:build !js
+// +build !js
+
+package pkg
+
+import (
+	"bytes"
+
+	"vuvuzela.io/alpenhorn/pkg/kv"
+)
+
+// With Config.DataKeys, the server encrypts the records that hold
+// users' login keys and contact details, so that a copy of the
+// database, such as a leaked backup, does not reveal them without the
+// keys: every per-user record (registrations, login key rotations,
+// user logs, PQ keys, recovery keys, rename attestations, and the
+// times of last extraction), the verifiers' records, the entries of
+// the registration and attestation logs and the registration log's
+// index, audit events, and abuse reports.
+//
+// The username in the keys of per-user records, verifier records, and
+// the registration log's index is blinded: it is replaced by an HMAC
+// of it under a key derived from the data key (see kv.SealedDB), so
+// the database does not show which usernames are registered, nor which
+// index entries belong to a username. Records written before DataKeys
+// was set are still read under the username until ResealDB rewrites
+// them.
+//
+// What the server publishes is not hidden. The registration and
+// attestation logs are served to anyone, and their entries name users
+// by LogUsernameHash, which anyone who guesses a username can compute,
+// so the logs show the login keys and long-term keys bound to a guessed
+// username whether or not the database is encrypted.
+//
+// To rotate the data key, the operator puts a new key first in
+// DataKeys, keeping the old keys after it, and runs ResealDB, which
+// also moves the records it rewrites to keys blinded with the new key.
+// Rename attestations, the records of code verifiers, audit events,
+// and abuse reports are left sealed with the old key until they
+// expire, after RenameHold, the verifier's TTL, AuditRetention, and
+// AbuseReportRetention; the old key can be removed from DataKeys once
+// ResealDB finds no stale records.
+
+// sealedPrefixes are the prefixes of the keys whose values are sealed.
+var sealedPrefixes = [][]byte{
+	dbUserPrefix,
+	dbVerifierPrefix,
+	regLogUserPrefix,
+	regLog.entryPrefix,
+	attestLog.entryPrefix,
+	dbAuditPrefix,
+	dbAbuseReportPrefix,
+}
+
+// sealedColumn reports whether the value of key is sealed. It depends
+// only on the key's prefix, as kv.SealedDB requires of keys that have
+// an identity.
+func sealedColumn(key []byte) bool {
+	for _, prefix := range sealedPrefixes {
+		if bytes.HasPrefix(key, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// identityColumn returns where the username's identity, or its
+// LogUsernameHash, is in key.
+func identityColumn(key []byte) (start, end int, ok bool) {
+	switch {
+	case bytes.HasPrefix(key, regLogUserPrefix):
+		start = len(regLogUserPrefix)
+		end = start + 32
+	case bytes.HasPrefix(key, dbUserPrefix):
+		start = len(dbUserPrefix)
+		end = start + 64
+	case bytes.HasPrefix(key, dbVerifierPrefix):
+		i := bytes.IndexByte(key[len(dbVerifierPrefix):], ':')
+		if i < 0 {
+			return 0, 0, false
+		}
+		start = len(dbVerifierPrefix) + i + 1
+		end = start + 64
+	default:
+		return 0, 0, false
+	}
+	return start, end, len(key) >= end
+}
+
+// resealableColumn reports whether ResealDB rewrites the value of key.
+// Records that expire are not rewritten, since that would drop their
+// expiry.
+func resealableColumn(key []byte) bool {
+	switch {
+	case bytes.HasPrefix(key, regLogUserPrefix),
+		bytes.HasPrefix(key, regLog.entryPrefix),
+		bytes.HasPrefix(key, attestLog.entryPrefix):
+		return true
+	case bytes.HasPrefix(key, dbVerifierPrefix):
+		// TOTP records are kept until the user unregisters.
+		return bytes.HasPrefix(key[len(dbVerifierPrefix):], []byte(new(TOTPVerifier).Name()+":"))
+	}
+	_, suffix, ok := splitUserKey(key)
+	return ok && !bytes.Equal(suffix, renamedSuffix)
+}
+
+// SealDB returns a DB that encrypts the values of db's user records
+// with keys and blinds the usernames in their keys, as the server does
+// with Config.DataKeys. keys[0] encrypts new records, and any of the
+// keys decrypts them.
+func SealDB(db kv.DB, keys []kv.SealKey) (*kv.SealedDB, error) {
+	return kv.NewSealedDB(db, keys, sealedColumn, identityColumn)
+}
+
+// ResealDB encrypts and blinds the user records in db that are not
+// encrypted and blinded with its first data key, such as records
+// written before the key was rotated in or before encryption was
+// enabled. It returns how many records it rewrote and how many it left
+// encrypted with an older key because they expire.
+func ResealDB(db *kv.SealedDB) (resealed int, stale int, err error) {
+	return db.Reseal(resealableColumn)
+}
@@ -0,0 +1,129 @@
+// Copyright 2018 David Lazar. All rights reserved.
+// Use of this source code is governed by the GNU AGPL
+// license that can be found in the LICENSE file.
+
+package pkg
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"testing"
+
+	"vuvuzela.io/alpenhorn/clock"
+	"vuvuzela.io/alpenhorn/pkg/kv"
+)
+
+func TestDataKeys(t *testing.T) {
+	dataKey := kv.SealKey{ID: 1, Key: make([]byte, 32)}
+	rand.Read(dataKey.Key)
+	mem := kv.NewMemory()
+
+	// Bob registered before the server had data keys.
+	bobPub, _, _ := ed25519.GenerateKey(rand.Reader)
+	bobID := ValidUsernameToIdentity("bob@example.org")
+	err := mem.Update(func(tx kv.Txn) error {
+		bob := userState{LoginKey: bobPub}
+		return tx.Set(dbUserKey(bobID, registrationSuffix), bob.Marshal())
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, serverKey, _ := ed25519.GenerateKey(rand.Reader)
+	srv, err := NewServer(&Config{
+		DB:              mem,
+		DataKeys:        []kv.SealKey{dataKey},
+		SigningKey:      serverKey,
+		RegTokenHandler: func(string, string) error { return nil },
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+
+	alicePub, _, _ := ed25519.GenerateKey(rand.Reader)
+	if _, err := srv.register(&registerArgs{Username: "alice@example.org", LoginKey: alicePub}); err != nil {
+		t.Fatal(err)
+	}
+	aliceID := ValidUsernameToIdentity("alice@example.org")
+	err = srv.db.Update(func(tx kv.Txn) error {
+		return tx.Set(dbUserKey(aliceID, pqKeySuffix), []byte{pqKeyBinaryVersion, 'p', 'q'})
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	store := newVerifierStore(srv.db, "totp", clock.Real)
+	err = store.Update("alice@example.org", 0, func([]byte) ([]byte, error) {
+		return []byte("totp secret"), nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The database shows neither alice's username, nor her log hash,
+	// nor what is bound to it.
+	aliceHash := LogUsernameHash(aliceID)
+	err = mem.View(func(tx kv.Txn) error {
+		return tx.Iterate(nil, func(key, value []byte) error {
+			if bytes.Contains(key, aliceID[:]) || bytes.Contains(key, aliceHash[:]) {
+				t.Errorf("alice's identity in key %q", key)
+			}
+			if bytes.Contains(value, alicePub) || bytes.Contains(value, []byte("totp secret")) {
+				t.Errorf("alice's records in the value of %q", key)
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, _, err := srv.getUser(nil, "alice@example.org"); err != nil {
+		t.Fatal(err)
+	}
+	if value, err := store.Get("alice@example.org"); err != nil || string(value) != "totp secret" {
+		t.Fatalf("verifier record: %q, %v", value, err)
+	}
+	reply, err := srv.regLogInclusion(&regLogInclusionArgs{Username: "alice@example.org", TreeSize: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	entry := new(RegistrationLogEntry)
+	if err := entry.Unmarshal(reply.Entry); err != nil {
+		t.Fatal(err)
+	}
+	if !entry.LoginKey.Equal(alicePub) {
+		t.Fatal("wrong registration log entry")
+	}
+
+	// Bob's record is read under his username until it is resealed.
+	if user, _, err := srv.getUser(nil, "bob@example.org"); err != nil || !user.LoginKey.Equal(bobPub) {
+		t.Fatalf("bob before reseal: %v", err)
+	}
+	sealed, err := SealDB(mem, []kv.SealKey{dataKey})
+	if err != nil {
+		t.Fatal(err)
+	}
+	resealed, stale, err := ResealDB(sealed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resealed != 1 || stale != 0 {
+		t.Fatalf("resealed %d, stale %d; want 1, 0", resealed, stale)
+	}
+	err = mem.View(func(tx kv.Txn) error {
+		return tx.Iterate(nil, func(key, _ []byte) error {
+			if bytes.Contains(key, bobID[:]) {
+				t.Errorf("bob's identity in key %q", key)
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if user, _, err := srv.getUser(nil, "bob@example.org"); err != nil || !user.LoginKey.Equal(bobPub) {
+		t.Fatalf("bob after reseal: %v", err)
+	}
+}
@@ -0,0 +1,204 @@
+// Copyright 2018 David Lazar. All rights reserved.
+// Use of this source code is governed by the GNU AGPL
+// license that can be found in the LICENSE file.
+
+//go:build !js
+// +build !js
+
+package pkg
+
+import (
+	"crypto/ed25519"
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"vuvuzela.io/alpenhorn/log"
+	"vuvuzela.io/alpenhorn/pkg/kv"
+)
+
+// The PKG appends an entry to its attestation log the first time it
+// attests to a user's long-term key in each epoch, before releasing
+// the attestation. The log is a Merkle tree (see package translog):
+// the PKG signs its tree heads, and clients check that attestations
+// about them are in the log and that the log only grows. A PKG that
+// attests to a different key for a user must either log it, where the
+// user can find it, or show the user a tree head that is inconsistent
+// with what other clients and auditors see, which is proof that it
+// misbehaved.
+
+var (
+	attestLog     = newMerkleLog("attestlog:")
+	attestLogLeaf = []byte("attestlog:leaf:")
+)
+
+func attestLogLeafKey(leafHash []byte) []byte {
+	return append(append([]byte(nil), attestLogLeaf...), leafHash...)
+}
+
+// logAttestation appends an entry for the user's long-term key to the
+// attestation log, unless it was already logged this epoch.
+func (srv *Server) logAttestation(id *[64]byte, longTermKey ed25519.PublicKey, now time.Time) error {
+	entry := &AttestationLogEntry{
+		UsernameHash: LogUsernameHash(id),
+		LongTermKey:  longTermKey,
+		Epoch:        AttestationEpoch(now),
+	}
+	leafHash := entry.LeafHash()
+
+	// Most extractions are for keys already logged this epoch.
+	err := srv.db.View(func(tx kv.Txn) error {
+		_, err := tx.Get(attestLogLeafKey(leafHash))
+		return err
+	})
+	if err == nil {
+		return nil
+	} else if err != kv.ErrNotFound {
+		return errorf(ErrDatabaseError, "attestation log: %s", err)
+	}
+
+	// Appends are serialized so they never conflict with each other.
+	srv.logMu.Lock()
+	defer srv.logMu.Unlock()
+
+	err = srv.db.Update(func(tx kv.Txn) error {
+		_, err := tx.Get(attestLogLeafKey(leafHash))
+		if err == nil {
+			return nil
+		} else if err != kv.ErrNotFound {
+			return err
+		}
+
+		index, err := attestLog.append(tx, entry.Marshal())
+		if err != nil {
+			return err
+		}
+		return tx.Set(attestLogLeafKey(leafHash), appendUint64(nil, index))
+	})
+	if err != nil {
+		return errorf(ErrDatabaseError, "attestation log: %s", err)
+	}
+	return nil
+}
+
+// LogHead returns a signed head for the current attestation log.
+func (srv *Server) LogHead() (*LogHead, error) {
+	head := new(LogHead)
+	err := srv.db.View(func(tx kv.Txn) error {
+		var err error
+		head.Size, head.RootHash, err = attestLog.head(tx)
+		return err
+	})
+	if err != nil {
+		return nil, errorf(ErrDatabaseError, "%s", err)
+	}
+	head.Time = srv.clock.Now().Unix()
+	head.Signature, err = srv.sign(head.msg(srv.publicKey))
+	if err != nil {
+		return nil, err
+	}
+	return head, nil
+}
+
+func (srv *Server) logInclusion(args *logInclusionArgs) (*logInclusionReply, error) {
+	id, err := UsernameToIdentity(args.Username)
+	if err != nil {
+		return nil, errorf(ErrInvalidUsername, "%s", err)
+	}
+	entry := &AttestationLogEntry{
+		UsernameHash: LogUsernameHash(id),
+		LongTermKey:  args.LongTermKey,
+		Epoch:        args.Epoch,
+	}
+
+	reply := new(logInclusionReply)
+	err = srv.db.View(func(tx kv.Txn) error {
+		data, err := tx.Get(attestLogLeafKey(entry.LeafHash()))
+		if err == kv.ErrNotFound {
+			return errorf(ErrNotInLog, "%q epoch %d", args.Username, args.Epoch)
+		} else if err != nil {
+			return errorf(ErrDatabaseError, "%s", err)
+		}
+		reply.Index, err = decodeIndex(data)
+		if err != nil {
+			return errorf(ErrDatabaseError, "bad leaf index: %s", err)
+		}
+		if reply.Index >= args.TreeSize {
+			return errorf(ErrNotInLog, "%q epoch %d was logged after tree size %d", args.Username, args.Epoch, args.TreeSize)
+		}
+		reply.Proof, err = attestLog.inclusion(tx, reply.Index, args.TreeSize)
+		return err
+	})
+	return reply, err
+}
+
+func (srv *Server) logConsistency(l *merkleLog, args *logConsistencyArgs) (*logConsistencyReply, error) {
+	var reply *logConsistencyReply
+	err := srv.db.View(func(tx kv.Txn) error {
+		var err error
+		reply, err = l.consistency(tx, args)
+		return err
+	})
+	return reply, err
+}
+
+func (srv *Server) logEntries(l *merkleLog, args *logEntriesArgs) (*logEntriesReply, error) {
+	var reply *logEntriesReply
+	err := srv.db.View(func(tx kv.Txn) error {
+		var err error
+		reply, err = l.entries(tx, args)
+		return err
+	})
+	return reply, err
+}
+
+func (srv *Server) attestLogHandler(w http.ResponseWriter, req *http.Request) {
+	var reply interface{}
+	var err error
+	body := http.MaxBytesReader(w, req.Body, 1024)
+	switch req.URL.Path {
+	case "/attestlog/head":
+		reply, err = srv.LogHead()
+	case "/attestlog/inclusion":
+		args := new(logInclusionArgs)
+		if err := json.NewDecoder(body).Decode(args); err != nil {
+			httpError(w, errorf(ErrBadRequestJSON, "%s", err))
+			return
+		}
+		reply, err = srv.logInclusion(args)
+	case "/attestlog/consistency":
+		args := new(logConsistencyArgs)
+		if err := json.NewDecoder(body).Decode(args); err != nil {
+			httpError(w, errorf(ErrBadRequestJSON, "%s", err))
+			return
+		}
+		reply, err = srv.logConsistency(attestLog, args)
+	case "/attestlog/entries":
+		args := new(logEntriesArgs)
+		if err := json.NewDecoder(body).Decode(args); err != nil {
+			httpError(w, errorf(ErrBadRequestJSON, "%s", err))
+			return
+		}
+		reply, err = srv.logEntries(attestLog, args)
+	default:
+		http.NotFound(w, req)
+		return
+	}
+	srv.writeLogReply(w, req, reply, err)
+}
+
+func (srv *Server) writeLogReply(w http.ResponseWriter, req *http.Request, reply interface{}, err error) {
+	if err != nil {
+		if isInternalError(err) {
+			srv.log.WithFields(log.Fields{"path": req.URL.Path}).Errorf("Log request failed: %s", err)
+		}
+		httpError(w, err)
+		return
+	}
+
+	bs, err := json.Marshal(reply)
+	if err != nil {
+		panic(err)
+	}
+	w.Write(bs)
+}
@@ -0,0 +1,118 @@
+// Copyright 2018 David Lazar. All rights reserved.
+// Use of this source code is governed by the GNU AGPL
+// license that can be found in the LICENSE file.
+
+package pkg_test
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"fmt"
+	"testing"
+	"time"
+
+	"vuvuzela.io/alpenhorn/edhttp"
+	"vuvuzela.io/alpenhorn/pkg"
+)
+
+func TestAttestationLog(t *testing.T) {
+	testpkg, coordinatorClient := launchPKG(t, func(username string, token string) error {
+		return nil
+	})
+	defer testpkg.Close()
+	server := testpkg.PublicServerConfig
+
+	clients := make([]*pkg.Client, 3)
+	for i := range clients {
+		pub, priv, _ := ed25519.GenerateKey(rand.Reader)
+		clients[i] = &pkg.Client{
+			Username:        fmt.Sprintf("user%d@example.org", i),
+			LoginKey:        priv,
+			UserLongTermKey: pub,
+			HTTPClient:      new(edhttp.Client),
+		}
+		if err := clients[i].Register(server, ""); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	head0, err := clients[0].AttestationLogHead(server)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if head0.Size != 0 {
+		t.Fatalf("expected empty log, got size %d", head0.Size)
+	}
+
+	pkgs := []pkg.PublicServerConfig{server}
+	var head1 *pkg.LogHead
+	for round := uint32(1); round <= 2; round++ {
+		if _, err := coordinatorClient.NewRound(pkgs, round); err != nil {
+			t.Fatal(err)
+		}
+		for _, c := range clients {
+			if _, err := c.Extract(server, round); err != nil {
+				t.Fatal(err)
+			}
+			if head1 == nil {
+				head1, err = c.AttestationLogHead(server)
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+		}
+	}
+
+	head, err := clients[0].AttestationLogHead(server)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Each key is logged once per epoch, not once per extraction.
+	if head.Size != uint64(len(clients)) {
+		t.Fatalf("expected %d log entries, got %d", len(clients), head.Size)
+	}
+
+	epoch := pkg.AttestationEpoch(time.Now())
+	for _, c := range clients {
+		if err := c.VerifyAttestationLogged(server, head, epoch); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := clients[0].VerifyAttestationLogged(server, head, epoch-1); errorCode(err) != pkg.ErrNotInLog {
+		t.Fatalf("expected ErrNotInLog, got %v", err)
+	}
+
+	for _, old := range []*pkg.LogHead{head0, head1, head} {
+		if err := clients[0].VerifyAttestationLogConsistency(server, old, head); err != nil {
+			t.Fatal(err)
+		}
+	}
+	forged := *head
+	forged.RootHash = make([]byte, len(head.RootHash))
+	if err := clients[0].VerifyAttestationLogConsistency(server, head1, &forged); err == nil {
+		t.Fatal("expected consistency check to fail for a forged head")
+	}
+	if forged.Verify(server.Key) {
+		t.Fatal("forged head has a valid signature")
+	}
+
+	entries, err := clients[0].AttestationLogEntries(server, 0, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != len(clients) {
+		t.Fatalf("expected %d entries, got %d", len(clients), len(entries))
+	}
+	for _, e := range entries {
+		if e.Epoch != epoch {
+			t.Fatalf("unexpected epoch %d, want %d", e.Epoch, epoch)
+		}
+	}
+}
+
+func errorCode(err error) pkg.ErrorCode {
+	if e, ok := err.(pkg.Error); ok {
+		return e.Code
+	}
+	return 0
+}
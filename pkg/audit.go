@@ -0,0 +1,173 @@
+// Copyright 2018 David Lazar. All rights reserved.
+// Use of this source code is governed by the GNU AGPL
+// license that can be found in the LICENSE file.
+
+//go:build !js
+// +build !js
+
+package pkg
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"sync"
+	"time"
+
+	"vuvuzela.io/alpenhorn/pkg/kv"
+)
+
+// The audit log records security-relevant events for incident
+// response: registrations, verifications, extractions, and key
+// changes. Each event is appended to the database, where the admin
+// API can query it until AuditRetention passes, and written as a line
+// of JSON to Config.AuditLog, such as a file or syslog, which keeps it
+// for as long as the operator likes. Events are recorded after the
+// request is answered, and failing to record one does not fail the
+// request.
+
+// DefaultAuditRetention is how long audit events stay in the database
+// if Config.AuditRetention is zero.
+const DefaultAuditRetention = 7 * 24 * time.Hour
+
+var dbAuditPrefix = []byte("audit:")
+
+type AuditEventType string
+
+const (
+	AuditRegister AuditEventType = "register"
+	AuditVerify   AuditEventType = "verify"
+	AuditExtract  AuditEventType = "extract"
+	AuditLoginKey AuditEventType = "loginkey"
+	AuditPQKey    AuditEventType = "pqkey"
+	AuditDelete   AuditEventType = "delete"
+	AuditRename   AuditEventType = "rename"
+
+	AuditRecoveryKey AuditEventType = "recoverykey"
+	AuditRevoke      AuditEventType = "revoke"
+	AuditDevice      AuditEventType = "device"
+)
+
+// An AuditEvent is an entry in the audit log.
+type AuditEvent struct {
+	Time     time.Time
+	Type     AuditEventType
+	Username string
+
+	// Key is the fingerprint of the key the requester presented:
+	// the login key for registrations, verifications, and key
+	// changes, and the long-term key being attested for extractions.
+	Key string `json:",omitempty"`
+
+	// Round is the round of an extraction.
+	Round uint32 `json:",omitempty"`
+
+	// Detail describes the event further, such as the verifier's name
+	// or the phase of a login key rotation.
+	Detail string `json:",omitempty"`
+
+	// Result is "ok" or the error code the request failed with.
+	Result   string
+	RemoteIP string `json:",omitempty"`
+}
+
+// KeyFingerprint returns the fingerprint of key used in audit events:
+// the hex encoding of the first 16 bytes of its SHA-256 hash.
+func KeyFingerprint(key []byte) string {
+	if len(key) == 0 {
+		return ""
+	}
+	h := sha256.Sum256(key)
+	return hex.EncodeToString(h[:16])
+}
+
+// auditLog writes audit events to the database and a writer.
+type auditLog struct {
+	db        kv.DB
+	retention time.Duration
+
+	mu sync.Mutex
+	w  io.Writer
+}
+
+func dbAuditKey(t time.Time) []byte {
+	key := appendUint64(append([]byte(nil), dbAuditPrefix...), uint64(t.UnixNano()))
+	// Random bytes keep the keys of simultaneous events distinct
+	// without a shared counter that concurrent requests would
+	// conflict on.
+	var r [8]byte
+	rand.Read(r[:])
+	return append(key, r[:]...)
+}
+
+func (a *auditLog) record(e *AuditEvent) error {
+	data, err := json.Marshal(e)
+	if err != nil {
+		panic(err)
+	}
+	if a.w != nil {
+		a.mu.Lock()
+		_, err = a.w.Write(append(data, '\n'))
+		a.mu.Unlock()
+		if err != nil {
+			return err
+		}
+	}
+	if a.retention < 0 {
+		return nil
+	}
+	return a.db.Update(func(tx kv.Txn) error {
+		return tx.SetWithTTL(dbAuditKey(e.Time), data, a.retention)
+	})
+}
+
+// audit records an audit event, logging any failure to do so.
+func (srv *Server) audit(e *AuditEvent) {
+	e.Time = srv.clock.Now()
+	if err := srv.auditLog.record(e); err != nil {
+		srv.log.Errorf("Recording audit event: %s", err)
+	}
+}
+
+// An AuditQuery selects audit events. Zero fields match every event.
+type AuditQuery struct {
+	Username string
+	Type     AuditEventType
+	Since    time.Time
+
+	// Limit is the most events to return, keeping the latest.
+	Limit int
+}
+
+func (q *AuditQuery) matches(e *AuditEvent) bool {
+	return (q.Username == "" || e.Username == q.Username) &&
+		(q.Type == "" || e.Type == q.Type) &&
+		!e.Time.Before(q.Since)
+}
+
+// AuditEvents returns the audit events in the database that match q,
+// oldest first.
+func (srv *Server) AuditEvents(q AuditQuery) ([]*AuditEvent, error) {
+	var events []*AuditEvent
+	err := srv.db.View(func(tx kv.Txn) error {
+		return tx.Iterate(dbAuditPrefix, func(key, data []byte) error {
+			e := new(AuditEvent)
+			if err := json.Unmarshal(data, e); err != nil {
+				return errorf(ErrDatabaseError, "audit event %x: %s", key, err)
+			}
+			if q.matches(e) {
+				events = append(events, e)
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	if q.Limit > 0 && len(events) > q.Limit {
+		events = events[len(events)-q.Limit:]
+	}
+	return events, nil
+}
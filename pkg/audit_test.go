@@ -0,0 +1,107 @@
+// Copyright 2018 David Lazar. All rights reserved.
+// Use of this source code is governed by the GNU AGPL
+// license that can be found in the LICENSE file.
+
+package pkg
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"vuvuzela.io/alpenhorn/clock"
+	"vuvuzela.io/alpenhorn/pkg/kv"
+)
+
+func TestAuditLog(t *testing.T) {
+	mockClock := clock.NewMock(time.Now())
+	adminPub, _, _ := ed25519.GenerateKey(rand.Reader)
+	_, serverKey, _ := ed25519.GenerateKey(rand.Reader)
+	auditFile := new(bytes.Buffer)
+	srv, err := NewServer(&Config{
+		DB:              kv.NewMemory(),
+		SigningKey:      serverKey,
+		RegTokenHandler: func(string, string) error { return nil },
+		Clock:           mockClock,
+		AdminKey:        adminPub,
+		AuditLog:        auditFile,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+
+	register := func(username string, loginKey ed25519.PublicKey) {
+		body, _ := json.Marshal(&registerArgs{Username: username, LoginKey: loginKey})
+		req := httptest.NewRequest("POST", "/register", bytes.NewReader(body))
+		srv.ServeHTTP(httptest.NewRecorder(), req)
+		mockClock.Add(time.Second)
+	}
+	aliceKey, _, _ := ed25519.GenerateKey(rand.Reader)
+	register("alice@example.org", aliceKey)
+	register("bob@example.org", aliceKey)
+	register("alice@example.org", aliceKey)
+
+	lines := strings.Split(strings.TrimSpace(auditFile.String()), "\n")
+	if len(lines) != 6 {
+		t.Fatalf("expected 6 audit lines, got %d:\n%s", len(lines), auditFile)
+	}
+	var e AuditEvent
+	if err := json.Unmarshal([]byte(lines[1]), &e); err != nil {
+		t.Fatal(err)
+	}
+	if e.Type != AuditRegister || e.Username != "alice@example.org" ||
+		e.Key != KeyFingerprint(aliceKey) || e.Result != "ok" || e.RemoteIP != "192.0.2.1" {
+		t.Fatalf("unexpected event: %+v", e)
+	}
+
+	events, err := srv.AuditEvents(AuditQuery{Username: "alice@example.org", Type: AuditRegister})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(events) != 2 || events[1].Result != "ErrAlreadyRegistered" {
+		t.Fatalf("unexpected events: %+v", events)
+	}
+
+	admin := func(key ed25519.PublicKey, query string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", "/admin/audit?"+query, nil)
+		req.TLS = &tls.ConnectionState{
+			PeerCertificates: []*x509.Certificate{{PublicKey: key}},
+		}
+		w := httptest.NewRecorder()
+		srv.AdminHandler().ServeHTTP(w, req)
+		return w
+	}
+	otherKey, _, _ := ed25519.GenerateKey(rand.Reader)
+	if w := admin(otherKey, ""); w.Code != http.StatusUnauthorized {
+		t.Fatalf("expected 401 for the wrong key, got %d", w.Code)
+	}
+	since := mockClock.Now().Add(-2 * time.Second).Format(time.RFC3339)
+	w := admin(adminPub, "type=register&limit=1&since="+since)
+	if w.Code != http.StatusOK {
+		t.Fatalf("admin query failed: %d %s", w.Code, w.Body)
+	}
+	events = nil
+	if err := json.Unmarshal(w.Body.Bytes(), &events); err != nil {
+		t.Fatal(err)
+	}
+	if len(events) != 1 || events[0].Username != "alice@example.org" {
+		t.Fatalf("unexpected events: %+v", events)
+	}
+
+	stats, err := CollectDBStats(srv.db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.AuditEvents != 6 {
+		t.Fatalf("expected 6 audit events in the database, got %d", stats.AuditEvents)
+	}
+}
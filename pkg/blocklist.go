@@ -0,0 +1,281 @@
+// Copyright 2018 David Lazar. All rights reserved.
+// Use of this source code is governed by the GNU AGPL
+// license that can be found in the LICENSE file.
+
+//go:build !js
+// +build !js
+
+package pkg
+
+import (
+	"encoding/json"
+	"net/http"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"vuvuzela.io/alpenhorn/pkg/kv"
+)
+
+// The blocklist is a list of usernames, domains, and patterns managed
+// through the admin API. Blocked usernames cannot be registered,
+// renamed to, or used to extract keys, and the client is told why.
+// Unlike Config.IsBanned, which hides the ban from the client, the
+// blocklist is meant for names an operator is willing to refuse openly.
+//
+// Entries are kept in the database and cached in memory. The cache is
+// loaded when the server starts and updated by the admin API, so PKG
+// servers sharing a database see each other's changes only after a
+// restart.
+
+var dbBlocklistPrefix = []byte("blocklist:")
+
+type BlocklistKind string
+
+const (
+	// BlockExact blocks a single username.
+	BlockExact BlocklistKind = "exact"
+
+	// BlockDomain blocks every username in a domain or its
+	// subdomains.
+	BlockDomain BlocklistKind = "domain"
+
+	// BlockRegexp blocks usernames that match a regular expression
+	// in their entirety.
+	BlockRegexp BlocklistKind = "regexp"
+)
+
+// A BlocklistEntry is an entry in the blocklist.
+type BlocklistEntry struct {
+	Kind    BlocklistKind
+	Pattern string
+
+	// Reason is returned to clients whose username the entry blocks.
+	Reason string
+
+	Added time.Time
+}
+
+func blocklistKey(kind BlocklistKind, pattern string) []byte {
+	return []byte(string(dbBlocklistPrefix) + string(kind) + ":" + pattern)
+}
+
+type blockedRegexp struct {
+	re    *regexp.Regexp
+	entry *BlocklistEntry
+}
+
+type blocklist struct {
+	mu      sync.RWMutex
+	exact   map[string]*BlocklistEntry
+	domains map[string]*BlocklistEntry
+	regexps []blockedRegexp
+}
+
+// compile checks the entry and returns the regexp for BlockRegexp
+// entries.
+func (e *BlocklistEntry) compile() (*regexp.Regexp, error) {
+	if e.Pattern == "" {
+		return nil, errorf(ErrBadRequestJSON, "empty blocklist pattern")
+	}
+	switch e.Kind {
+	case BlockExact, BlockDomain:
+		if e.Pattern != strings.ToLower(e.Pattern) {
+			return nil, errorf(ErrBadRequestJSON, "blocklist pattern must be lowercase: %q", e.Pattern)
+		}
+		return nil, nil
+	case BlockRegexp:
+		re, err := regexp.Compile("^(?:" + e.Pattern + ")$")
+		if err != nil {
+			return nil, errorf(ErrBadRequestJSON, "blocklist pattern: %s", err)
+		}
+		return re, nil
+	default:
+		return nil, errorf(ErrBadRequestJSON, "unknown blocklist kind %q", e.Kind)
+	}
+}
+
+// load replaces the cached entries with the ones in db.
+func (b *blocklist) load(db kv.DB) error {
+	exact := make(map[string]*BlocklistEntry)
+	domains := make(map[string]*BlocklistEntry)
+	var regexps []blockedRegexp
+	err := db.View(func(tx kv.Txn) error {
+		return tx.Iterate(dbBlocklistPrefix, func(key, value []byte) error {
+			e := new(BlocklistEntry)
+			if err := json.Unmarshal(value, e); err != nil {
+				return errorf(ErrDatabaseError, "%q: %s", key, err)
+			}
+			re, err := e.compile()
+			if err != nil {
+				return errorf(ErrDatabaseError, "%q: %s", key, err)
+			}
+			switch e.Kind {
+			case BlockExact:
+				exact[e.Pattern] = e
+			case BlockDomain:
+				domains[e.Pattern] = e
+			case BlockRegexp:
+				regexps = append(regexps, blockedRegexp{re, e})
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		return err
+	}
+
+	b.mu.Lock()
+	b.exact = exact
+	b.domains = domains
+	b.regexps = regexps
+	b.mu.Unlock()
+	return nil
+}
+
+// match returns the entry that blocks username, or nil.
+func (b *blocklist) match(username string) *BlocklistEntry {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	if e := b.exact[username]; e != nil {
+		return e
+	}
+	if ix := strings.LastIndex(username, "@"); ix >= 0 && len(b.domains) > 0 {
+		domain := username[ix+1:]
+		for {
+			if e := b.domains[domain]; e != nil {
+				return e
+			}
+			dot := strings.Index(domain, ".")
+			if dot == -1 {
+				break
+			}
+			domain = domain[dot+1:]
+		}
+	}
+	for _, r := range b.regexps {
+		if r.re.MatchString(username) {
+			return r.entry
+		}
+	}
+	return nil
+}
+
+// checkBlocklist returns an ErrUsernameBlocked error with the entry's
+// reason if username is on the blocklist.
+func (srv *Server) checkBlocklist(username string) error {
+	e := srv.blocklist.match(username)
+	if e == nil {
+		return nil
+	}
+	if e.Reason == "" {
+		return errorf(ErrUsernameBlocked, "%q", username)
+	}
+	return errorf(ErrUsernameBlocked, "%q: %s", username, e.Reason)
+}
+
+// BlocklistEntries returns the entries in the blocklist.
+func (srv *Server) BlocklistEntries() ([]*BlocklistEntry, error) {
+	entries := make([]*BlocklistEntry, 0)
+	err := srv.db.View(func(tx kv.Txn) error {
+		return tx.Iterate(dbBlocklistPrefix, func(key, value []byte) error {
+			e := new(BlocklistEntry)
+			if err := json.Unmarshal(value, e); err != nil {
+				return errorf(ErrDatabaseError, "%q: %s", key, err)
+			}
+			entries = append(entries, e)
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	return entries, nil
+}
+
+// AddBlocklistEntry adds e to the blocklist, replacing any entry with
+// the same kind and pattern. If e.Added is zero, it is set to the
+// current time.
+func (srv *Server) AddBlocklistEntry(e *BlocklistEntry) error {
+	if _, err := e.compile(); err != nil {
+		return err
+	}
+	if e.Added.IsZero() {
+		e.Added = srv.clock.Now()
+	}
+	data, err := json.Marshal(e)
+	if err != nil {
+		panic(err)
+	}
+	err = srv.db.Update(func(tx kv.Txn) error {
+		return tx.Set(blocklistKey(e.Kind, e.Pattern), data)
+	})
+	if err != nil {
+		return errorf(ErrDatabaseError, "%s", err)
+	}
+	return srv.blocklist.load(srv.db)
+}
+
+// RemoveBlocklistEntry removes the entry with the given kind and
+// pattern from the blocklist. Removing an entry that does not exist is
+// not an error.
+func (srv *Server) RemoveBlocklistEntry(kind BlocklistKind, pattern string) error {
+	err := srv.db.Update(func(tx kv.Txn) error {
+		return tx.Delete(blocklistKey(kind, pattern))
+	})
+	if err != nil {
+		return errorf(ErrDatabaseError, "%s", err)
+	}
+	return srv.blocklist.load(srv.db)
+}
+
+// blocklistHandler serves the blocklist admin endpoints:
+// GET /admin/blocklist lists the entries, and POST
+// /admin/blocklist/add and /admin/blocklist/remove take a
+// BlocklistEntry in the body (remove uses only Kind and Pattern).
+func (srv *Server) blocklistHandler(w http.ResponseWriter, req *http.Request) {
+	var reply interface{}
+	var err error
+	if req.URL.Path == "/admin/blocklist" {
+		reply, err = srv.BlocklistEntries()
+	} else {
+		if req.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		e := new(BlocklistEntry)
+		body := http.MaxBytesReader(w, req.Body, 4096)
+		if err := json.NewDecoder(body).Decode(e); err != nil {
+			httpError(w, errorf(ErrBadRequestJSON, "%s", err))
+			return
+		}
+		switch req.URL.Path {
+		case "/admin/blocklist/add":
+			err = srv.AddBlocklistEntry(e)
+			reply = e
+		case "/admin/blocklist/remove":
+			err = srv.RemoveBlocklistEntry(e.Kind, e.Pattern)
+			reply = e
+		default:
+			http.NotFound(w, req)
+			return
+		}
+	}
+	if err != nil {
+		if isInternalError(err) {
+			srv.log.Errorf("%s: %s", req.URL.Path, err)
+		} else {
+			srv.log.Infof("%s: %s", req.URL.Path, err)
+		}
+		httpError(w, err)
+		return
+	}
+	bs, err := json.Marshal(reply)
+	if err != nil {
+		panic(err)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(bs)
+}
@@ -0,0 +1,125 @@
+// Copyright 2018 David Lazar. All rights reserved.
+// Use of this source code is governed by the GNU AGPL
+// license that can be found in the LICENSE file.
+
+package pkg
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"vuvuzela.io/alpenhorn/pkg/kv"
+)
+
+func TestBlocklist(t *testing.T) {
+	adminPub, _, _ := ed25519.GenerateKey(rand.Reader)
+	_, serverKey, _ := ed25519.GenerateKey(rand.Reader)
+	db := kv.NewMemory()
+	srv, err := NewServer(&Config{
+		DB:              db,
+		SigningKey:      serverKey,
+		RegTokenHandler: func(string, string) error { return nil },
+		AdminKey:        adminPub,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+
+	admin := func(path string, e *BlocklistEntry) *httptest.ResponseRecorder {
+		method := "GET"
+		var body []byte
+		if e != nil {
+			method = "POST"
+			body, _ = json.Marshal(e)
+		}
+		req := httptest.NewRequest(method, path, bytes.NewReader(body))
+		req.TLS = &tls.ConnectionState{
+			PeerCertificates: []*x509.Certificate{{PublicKey: adminPub}},
+		}
+		w := httptest.NewRecorder()
+		srv.AdminHandler().ServeHTTP(w, req)
+		return w
+	}
+	for _, e := range []*BlocklistEntry{
+		{Kind: BlockExact, Pattern: "root@example.org", Reason: "reserved"},
+		{Kind: BlockDomain, Pattern: "spam.example", Reason: "spam domain"},
+		{Kind: BlockRegexp, Pattern: "admin.*@.*"},
+	} {
+		if w := admin("/admin/blocklist/add", e); w.Code != http.StatusOK {
+			t.Fatalf("adding %+v: %d %s", e, w.Code, w.Body)
+		}
+	}
+	if w := admin("/admin/blocklist/add", &BlocklistEntry{Kind: BlockRegexp, Pattern: "("}); w.Code != http.StatusBadRequest {
+		t.Fatalf("expected 400 for a bad regexp, got %d", w.Code)
+	}
+
+	aliceKey, _, _ := ed25519.GenerateKey(rand.Reader)
+	register := func(username string) error {
+		_, err := srv.register(&registerArgs{Username: username, LoginKey: aliceKey})
+		return err
+	}
+	blocked := []struct {
+		username string
+		reason   string
+	}{
+		{"root@example.org", "reserved"},
+		{"bob@spam.example", "spam domain"},
+		{"bob@mail.spam.example", "spam domain"},
+		{"administrator@example.org", ""},
+	}
+	for _, b := range blocked {
+		err := register(b.username)
+		if errorCode(err) != ErrUsernameBlocked {
+			t.Fatalf("%s: expected ErrUsernameBlocked, got %v", b.username, err)
+		}
+		if !strings.Contains(err.Error(), b.reason) {
+			t.Fatalf("%s: error %q does not give the reason %q", b.username, err, b.reason)
+		}
+	}
+	for _, username := range []string{"root2@example.org", "bob@notspam.example", "bob@admin.org"} {
+		if err := register(username); err != nil {
+			t.Fatalf("%s: %s", username, err)
+		}
+	}
+
+	w := admin("/admin/blocklist", nil)
+	var entries []*BlocklistEntry
+	if err := json.Unmarshal(w.Body.Bytes(), &entries); err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 3 || entries[0].Added.IsZero() {
+		t.Fatalf("unexpected entries: %+v", entries)
+	}
+	if w := admin("/admin/blocklist/remove", &BlocklistEntry{Kind: BlockExact, Pattern: "root@example.org"}); w.Code != http.StatusOK {
+		t.Fatalf("remove: %d %s", w.Code, w.Body)
+	}
+	if err := register("root@example.org"); err != nil {
+		t.Fatal(err)
+	}
+
+	problems, err := VerifyDB(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(problems) != 0 {
+		t.Fatalf("unexpected problems: %v", problems)
+	}
+
+	// A server started on the same database loads the blocklist.
+	b := new(blocklist)
+	if err := b.load(db); err != nil {
+		t.Fatal(err)
+	}
+	if e := b.match("carol@spam.example"); e == nil || e.Reason != "spam domain" {
+		t.Fatalf("unexpected match after reload: %+v", e)
+	}
+}
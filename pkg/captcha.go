@@ -0,0 +1,127 @@
+// Copyright 2018 David Lazar. All rights reserved.
+// Use of this source code is governed by the GNU AGPL
+// license that can be found in the LICENSE file.
+
+//go:build !js
+// +build !js
+
+package pkg
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"vuvuzela.io/alpenhorn/errors"
+)
+
+// A CaptchaVerifier checks the CAPTCHA solutions that come with
+// registrations when Config.Captcha is set. The server checks the
+// CAPTCHA before the username, so bots cannot make the Verifier send
+// codes to usernames they do not own.
+//
+// If a CaptchaVerifier has a method Check() error, NewServer calls it
+// to validate the verifier's configuration.
+type CaptchaVerifier interface {
+	// Name identifies the CAPTCHA service in logs and audit events.
+	Name() string
+
+	// VerifyCaptcha returns nil if token is a solved CAPTCHA.
+	// remoteIP is the address the registration came from, or "".
+	VerifyCaptcha(token string, remoteIP string) error
+}
+
+// The siteverify endpoints of common CAPTCHA services.
+const (
+	HCaptchaURL  = "https://hcaptcha.com/siteverify"
+	ReCaptchaURL = "https://www.google.com/recaptcha/api/siteverify"
+)
+
+// A SiteverifyCaptcha checks CAPTCHA tokens with a "siteverify"
+// endpoint like those of hCaptcha and reCAPTCHA. It posts the form
+// values "secret", "response", and "remoteip" to URL, which replies
+// with a JSON object whose "success" field says if the token is valid.
+type SiteverifyCaptcha struct {
+	URL    string
+	Secret string
+
+	// Client is the HTTP client used to reach URL. The default
+	// client is used if Client is nil.
+	Client *http.Client
+}
+
+func (c *SiteverifyCaptcha) Name() string {
+	u, err := url.Parse(c.URL)
+	if err != nil {
+		return "captcha"
+	}
+	return u.Host
+}
+
+func (c *SiteverifyCaptcha) Check() error {
+	u, err := url.Parse(c.URL)
+	if err != nil {
+		return errors.Wrap(err, "invalid captcha URL")
+	}
+	if u.Scheme != "https" && u.Scheme != "http" {
+		return errors.New("captcha URL must be http or https: %q", c.URL)
+	}
+	if c.Secret == "" {
+		return errors.New("no captcha secret")
+	}
+	return nil
+}
+
+func (c *SiteverifyCaptcha) VerifyCaptcha(token string, remoteIP string) error {
+	client := c.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	vals := url.Values{
+		"secret":   []string{c.Secret},
+		"response": []string{token},
+	}
+	if remoteIP != "" {
+		vals.Set("remoteip", remoteIP)
+	}
+	resp, err := client.PostForm(c.URL, vals)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return errors.New("captcha service replied %s", resp.Status)
+	}
+
+	var reply struct {
+		Success    bool     `json:"success"`
+		ErrorCodes []string `json:"error-codes"`
+	}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 64*1024)).Decode(&reply); err != nil {
+		return errors.Wrap(err, "decoding captcha reply")
+	}
+	if !reply.Success {
+		return errorf(ErrInvalidCaptcha, "%s", strings.Join(reply.ErrorCodes, ", "))
+	}
+	return nil
+}
+
+// checkCaptcha checks the registration's CAPTCHA if the server
+// requires one.
+func (srv *Server) checkCaptcha(args *registerArgs) error {
+	if srv.captcha == nil {
+		return nil
+	}
+	if args.CaptchaToken == "" {
+		return errorf(ErrCaptchaRequired, "%s", srv.captcha.Name())
+	}
+	err := srv.captcha.VerifyCaptcha(args.CaptchaToken, args.RemoteIP)
+	if err != nil {
+		if _, ok := err.(Error); !ok {
+			err = errorf(ErrUnknown, "captcha: %s", err)
+		}
+	}
+	return err
+}
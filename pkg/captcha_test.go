@@ -0,0 +1,83 @@
+// Copyright 2018 David Lazar. All rights reserved.
+// Use of this source code is governed by the GNU AGPL
+// license that can be found in the LICENSE file.
+
+package pkg
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"vuvuzela.io/alpenhorn/pkg/kv"
+)
+
+func TestCaptcha(t *testing.T) {
+	var remoteIPs []string
+	siteverify := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		remoteIPs = append(remoteIPs, req.FormValue("remoteip"))
+		reply := map[string]interface{}{"success": false, "error-codes": []string{"invalid-input-response"}}
+		if req.FormValue("secret") == "s3cret" && req.FormValue("response") == "solved" {
+			reply = map[string]interface{}{"success": true}
+		}
+		json.NewEncoder(w).Encode(reply)
+	}))
+	defer siteverify.Close()
+
+	_, serverKey, _ := ed25519.GenerateKey(rand.Reader)
+	if _, err := NewServer(&Config{
+		DB:               kv.NewMemory(),
+		SigningKey:       serverKey,
+		RegistrationMode: RegistrationFCFS,
+		Captcha:          &SiteverifyCaptcha{URL: siteverify.URL},
+	}); err == nil {
+		t.Fatal("expected error for a captcha without a secret")
+	}
+
+	verifierCalls := 0
+	srv, err := NewServer(&Config{
+		DB:         kv.NewMemory(),
+		SigningKey: serverKey,
+		RegTokenHandler: func(string, string) error {
+			verifierCalls++
+			return nil
+		},
+		Captcha: &SiteverifyCaptcha{URL: siteverify.URL, Secret: "s3cret"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+
+	loginKey, _, _ := ed25519.GenerateKey(rand.Reader)
+	register := func(captchaToken string) error {
+		_, err := srv.register(&registerArgs{
+			Username:     "alice@example.org",
+			LoginKey:     loginKey,
+			CaptchaToken: captchaToken,
+			RemoteIP:     "192.0.2.1",
+		})
+		return err
+	}
+	if err := register(""); errorCode(err) != ErrCaptchaRequired {
+		t.Fatalf("expected ErrCaptchaRequired, got %v", err)
+	}
+	if err := register("guessed"); errorCode(err) != ErrInvalidCaptcha {
+		t.Fatalf("expected ErrInvalidCaptcha, got %v", err)
+	}
+	if verifierCalls != 0 {
+		t.Fatalf("verifier called %d times without a solved captcha", verifierCalls)
+	}
+	if err := register("solved"); err != nil {
+		t.Fatal(err)
+	}
+	if verifierCalls != 1 {
+		t.Fatalf("verifier called %d times, want 1", verifierCalls)
+	}
+	if len(remoteIPs) != 2 || remoteIPs[1] != "192.0.2.1" {
+		t.Fatalf("unexpected remote IPs sent to the captcha service: %q", remoteIPs)
+	}
+}
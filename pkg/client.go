@@ -6,17 +6,31 @@ package pkg
 
 import (
 	"bytes"
+	"context"
+	"crypto"
 	"crypto/ed25519"
 	"crypto/rand"
+	"encoding"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"net/http"
+	"sync"
+	"time"
 
-	"golang.org/x/crypto/nacl/box"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 
+	"vuvuzela.io/alpenhorn/clock"
 	"vuvuzela.io/alpenhorn/edhttp"
 	"vuvuzela.io/alpenhorn/errors"
+	"vuvuzela.io/alpenhorn/internal/keysafe"
+	"vuvuzela.io/alpenhorn/internal/tracing"
+	"vuvuzela.io/alpenhorn/internal/version"
+	"vuvuzela.io/alpenhorn/internal/wire"
+	"vuvuzela.io/alpenhorn/pairing"
+	"vuvuzela.io/alpenhorn/translog"
 	"vuvuzela.io/crypto/bls"
 	"vuvuzela.io/crypto/ibe"
 )
@@ -30,50 +44,636 @@ type Client struct {
 	// Username is identity in Identity-Based Encryption.
 	Username string
 
-	// LoginKey is used to authenticate to the PKG server.
-	LoginKey ed25519.PrivateKey
+	// LoginKey is used to authenticate to the PKG server. It is
+	// usually an ed25519.PrivateKey, but it can be any signer that
+	// makes Ed25519 signatures, such as a DerivedLoginKey or a key
+	// held by a hardware keystore.
+	LoginKey crypto.Signer
 
 	// UserLongTermKey is the user's long-term signing key. The
 	// PKG server attests to this key during extraction.
 	UserLongTermKey ed25519.PublicKey
 
 	HTTPClient *edhttp.Client
+
+	// Clock timestamps signed requests and proofs of work. The real
+	// clock is used if Clock is nil.
+	Clock clock.Clock
+
+	// ReturnVersion selects how the server encrypts extracted keys
+	// for the client: ReturnBox, the default, or ReturnHybrid, which
+	// protects recorded replies from a future quantum computer but
+	// needs a server that supports it.
+	ReturnVersion int
 }
 
 // Register attempts to register the client's username and login key
 // with the PKG server. It only needs to be called once per PKG server.
+// The server does not say whether the username was taken, so Register
+// checks the client's status afterwards and returns ErrAlreadyRegistered
+// if the username belongs to a different login key.
+//
+// A server that verifies usernames by email replies to a registration
+// without a token with ErrVerificationSent. Register again with the
+// token from the email to finish registering.
 func (c *Client) Register(server PublicServerConfig, token string) error {
-	loginPublicKey := c.LoginKey.Public()
-	args := &registerArgs{
-		Username:          c.Username,
-		LoginKey:          loginPublicKey.(ed25519.PublicKey),
+	return c.RegisterWithCaptcha(server, token, "")
+}
+
+// RegisterWithCaptcha is like Register but includes a solved CAPTCHA,
+// which servers that require one check before anything else. Register
+// returns ErrCaptchaRequired from those servers.
+func (c *Client) RegisterWithCaptcha(server PublicServerConfig, token string, captchaToken string) error {
+	return c.register(server, &registerArgs{
+		RegistrationToken: token,
+		CaptchaToken:      captchaToken,
+	})
+}
+
+// RegisterReserved is like Register but includes an override token
+// that the server's admin issued for the username. Servers require one
+// to register usernames they reserve, and Register returns
+// ErrUsernameReserved for those usernames.
+func (c *Client) RegisterReserved(server PublicServerConfig, token string, overrideToken string) error {
+	return c.register(server, &registerArgs{
 		RegistrationToken: token,
+		OverrideToken:     overrideToken,
+	})
+}
+
+func (c *Client) register(server PublicServerConfig, args *registerArgs) error {
+	loginKey, err := loginPublicKey(c.LoginKey)
+	if err != nil {
+		return err
 	}
+	args.Username = c.Username
+	args.LoginKey = loginKey
 
 	var reply string
-	err := c.do(server, "register", args, &reply)
+	err = c.do(server, "register", args, &reply)
+	if requiredWork(err) > 0 {
+		args.Work, err = c.registerWork(server, loginKey)
+		if err == nil {
+			err = c.do(server, "register", args, &reply)
+		}
+	}
 	if err != nil {
 		return err
 	}
-	return nil
+
+	// The server replies OK even when it ignores the registration,
+	// so check that the username is now ours.
+	err = c.CheckStatus(server)
+	if e, ok := err.(Error); ok {
+		switch e.Code {
+		case ErrInvalidSignature:
+			return errorf(ErrAlreadyRegistered, "%q", c.Username)
+		case ErrNotRegistered:
+			return errorf(ErrNotRegistered, "registration of %q was not accepted", c.Username)
+		}
+	}
+	return err
+}
+
+// registerWork fetches a registration challenge from the server and
+// solves it.
+func (c *Client) registerWork(server PublicServerConfig, loginKey ed25519.PublicKey) (*RegisterWork, error) {
+	reply := new(registerChallengeReply)
+	err := c.do(server, "registerchallenge", &registerChallengeArgs{Username: c.Username}, reply)
+	if err != nil {
+		return nil, err
+	}
+	if reply.WorkBits > maxWorkBits {
+		return nil, errors.New("server requires too much work: %d bits", reply.WorkBits)
+	}
+	return solveRegisterWork(server.Key, loginKey, reply.Challenge, reply.WorkBits), nil
 }
 
+// Status is the state of a user's account on a PKG server.
+type Status struct {
+	// LastExtractionRound and LastExtraction are the round and time
+	// of the user's most recent key extraction, or zero if the server
+	// has no record of one. The server forgets extractions from rounds
+	// it no longer keeps. An application that tracks its own
+	// extractions can compare them with these to detect someone else
+	// extracting the user's keys with their login key.
+	LastExtractionRound uint32
+	LastExtraction      time.Time
+}
+
+// CheckStatus returns an error if the client is not registered with
+// the server or its login key is not accepted.
 func (c *Client) CheckStatus(server PublicServerConfig) error {
+	_, err := c.Status(server)
+	return err
+}
+
+// Status fetches the client's account status from the server, which
+// also checks that the client is registered and its login key is
+// accepted.
+func (c *Client) Status(server PublicServerConfig) (*Status, error) {
 	args := &statusArgs{
 		Username:         c.Username,
 		ServerSigningKey: server.Key,
 	}
 	rand.Read(args.Message[:])
-	args.Signature = ed25519.Sign(c.LoginKey, args.msg())
+	sig, err := signLogin(c.LoginKey, args.msg())
+	if err != nil {
+		return nil, err
+	}
+	args.Signature = sig
 
 	var reply statusReply
-	err := c.do(server, "status", args, &reply)
+	err = c.do(server, "status", args, &reply)
+	if err != nil {
+		return nil, err
+	}
+	st := &Status{
+		LastExtractionRound: reply.LastExtractRound,
+	}
+	if reply.LastExtractTime != 0 {
+		st.LastExtraction = time.Unix(reply.LastExtractTime, 0)
+	}
+	return st, nil
+}
+
+// PrepareLoginKey asks the PKG server to accept newKey as the client's
+// login key once the rotation with the given id is committed.
+func (c *Client) PrepareLoginKey(server PublicServerConfig, id [32]byte, newKey crypto.Signer) error {
+	args, err := c.rotateLoginArgs(server, RotatePrepare, id, newKey)
+	if err != nil {
+		return err
+	}
+	if args.Signature, err = signLogin(c.LoginKey, args.msg()); err != nil {
+		return err
+	}
+	if args.NewKeySignature, err = signLogin(newKey, args.msg()); err != nil {
+		return err
+	}
+	return c.do(server, "rotatelogin", args, new(string))
+}
+
+// CommitLoginKey switches the client's login key on the PKG server to
+// the key from a prepared rotation.
+func (c *Client) CommitLoginKey(server PublicServerConfig, id [32]byte, newKey crypto.Signer) error {
+	args, err := c.rotateLoginArgs(server, RotateCommit, id, newKey)
+	if err != nil {
+		return err
+	}
+	if args.Signature, err = signLogin(c.LoginKey, args.msg()); err != nil {
+		return err
+	}
+	return c.do(server, "rotatelogin", args, new(string))
+}
+
+// AbortLoginKey cancels a rotation, restoring the old login key on the
+// PKG server if the rotation was committed.
+func (c *Client) AbortLoginKey(server PublicServerConfig, id [32]byte, newKey crypto.Signer, committed bool) error {
+	args, err := c.rotateLoginArgs(server, RotateAbort, id, newKey)
+	if err != nil {
+		return err
+	}
+	signer := c.LoginKey
+	if committed {
+		signer = newKey
+	}
+	if args.Signature, err = signLogin(signer, args.msg()); err != nil {
+		return err
+	}
+	return c.do(server, "rotatelogin", args, new(string))
+}
+
+// RotateLoginKey switches the client's login key on the PKG server to
+// newKey in one step. The old key keeps working for the server's grace
+// window, so the user's other devices can switch over too. The caller
+// sets c.LoginKey to newKey after rotating on every PKG server.
+func (c *Client) RotateLoginKey(server PublicServerConfig, newKey crypto.Signer) error {
+	args, err := c.rotateLoginArgs(server, RotateInPlace, [32]byte{}, newKey)
 	if err != nil {
 		return err
 	}
+	if args.Signature, err = signLogin(c.LoginKey, args.msg()); err != nil {
+		return err
+	}
+	if args.NewKeySignature, err = signLogin(newKey, args.msg()); err != nil {
+		return err
+	}
+	return c.do(server, "rotatelogin", args, new(string))
+}
+
+func (c *Client) rotateLoginArgs(server PublicServerConfig, phase string, id [32]byte, newKey crypto.Signer) (*rotateLoginArgs, error) {
+	oldPub, err := loginPublicKey(c.LoginKey)
+	if err != nil {
+		return nil, err
+	}
+	newPub, err := loginPublicKey(newKey)
+	if err != nil {
+		return nil, err
+	}
+	return &rotateLoginArgs{
+		Username:         c.Username,
+		Phase:            phase,
+		ID:               id,
+		OldLoginKey:      oldPub,
+		NewLoginKey:      newPub,
+		Time:             clock.Or(c.Clock).Now().Unix(),
+		ServerSigningKey: server.Key,
+	}, nil
+}
+
+// SetPQKey publishes the client's ML-KEM public key on the PKG server.
+func (c *Client) SetPQKey(server PublicServerConfig, pqKey []byte) error {
+	args := &setPQKeyArgs{
+		Username:         c.Username,
+		PQKey:            pqKey,
+		Time:             clock.Or(c.Clock).Now().Unix(),
+		ServerSigningKey: server.Key,
+	}
+	sig, err := signLogin(c.LoginKey, args.msg())
+	if err != nil {
+		return err
+	}
+	args.Signature = sig
+	return c.do(server, "setpqkey", args, new(string))
+}
+
+// Unregister deletes the client's account on the PKG server. The
+// server erases the username and everything stored with it.
+func (c *Client) Unregister(server PublicServerConfig) error {
+	args := &deleteArgs{
+		Username:         c.Username,
+		Time:             clock.Or(c.Clock).Now().Unix(),
+		ServerSigningKey: server.Key,
+	}
+	sig, err := signLogin(c.LoginKey, args.msg())
+	if err != nil {
+		return err
+	}
+	args.Signature = sig
+	return c.do(server, "delete", args, new(string))
+}
+
+// SetRecoveryKey registers recoveryKey on the PKG server. The user
+// should keep the recovery key offline: it can revoke the login key if
+// the login key is stolen. See RevokeLoginKey.
+func (c *Client) SetRecoveryKey(server PublicServerConfig, recoveryKey crypto.Signer) error {
+	recoveryPub, err := loginPublicKey(recoveryKey)
+	if err != nil {
+		return err
+	}
+	args := &setRecoveryKeyArgs{
+		Username:         c.Username,
+		RecoveryKey:      recoveryPub,
+		Time:             clock.Or(c.Clock).Now().Unix(),
+		ServerSigningKey: server.Key,
+	}
+	if args.Signature, err = signLogin(c.LoginKey, args.msg()); err != nil {
+		return err
+	}
+	if args.RecoverySignature, err = signLogin(recoveryKey, args.msg()); err != nil {
+		return err
+	}
+	return c.do(server, "setrecoverykey", args, new(string))
+}
+
+// RevokeLoginKey revokes the client's login key on the PKG server with
+// the recovery key, naming newKey as its replacement. The server stops
+// answering requests made with the old key at once. The user then
+// registers newKey with a new registration token, verifying the
+// username again, to start using it.
+func (c *Client) RevokeLoginKey(server PublicServerConfig, recoveryKey crypto.Signer, newKey crypto.Signer) error {
+	newPub, err := loginPublicKey(newKey)
+	if err != nil {
+		return err
+	}
+	args := &revokeLoginArgs{
+		Username:         c.Username,
+		NewLoginKey:      newPub,
+		Time:             clock.Or(c.Clock).Now().Unix(),
+		ServerSigningKey: server.Key,
+	}
+	if args.Signature, err = signLogin(recoveryKey, args.msg()); err != nil {
+		return err
+	}
+	return c.do(server, "revokelogin", args, new(string))
+}
+
+// EnrollDevice enrolls deviceKey as a login key for another of the
+// user's devices. The request is signed with c.LoginKey, which can be
+// the login key or an enrolled device key.
+func (c *Client) EnrollDevice(server PublicServerConfig, deviceKey crypto.Signer) error {
+	devicePub, err := loginPublicKey(deviceKey)
+	if err != nil {
+		return err
+	}
+	args := &deviceKeyArgs{
+		Username:         c.Username,
+		Op:               DeviceEnroll,
+		DeviceKey:        devicePub,
+		Time:             clock.Or(c.Clock).Now().Unix(),
+		ServerSigningKey: server.Key,
+	}
+	if args.Signature, err = signLogin(c.LoginKey, args.msg()); err != nil {
+		return err
+	}
+	if args.DeviceSignature, err = signLogin(deviceKey, args.msg()); err != nil {
+		return err
+	}
+	return c.do(server, "devicekey", args, new(string))
+}
+
+// RevokeDevice revokes an enrolled device key, such as the key of a
+// lost device.
+func (c *Client) RevokeDevice(server PublicServerConfig, deviceKey ed25519.PublicKey) error {
+	args := &deviceKeyArgs{
+		Username:         c.Username,
+		Op:               DeviceRevoke,
+		DeviceKey:        deviceKey,
+		Time:             clock.Or(c.Clock).Now().Unix(),
+		ServerSigningKey: server.Key,
+	}
+	sig, err := signLogin(c.LoginKey, args.msg())
+	if err != nil {
+		return err
+	}
+	args.Signature = sig
+	return c.do(server, "devicekey", args, new(string))
+}
+
+// ReportAbuse files a report with the PKG server about another user,
+// such as one sending the client spam friend requests, for the
+// server's operator to review. The report is signed with the client's
+// login key. The server does not say whether the reported username is
+// registered.
+func (c *Client) ReportAbuse(server PublicServerConfig, username string, category AbuseCategory, details string) error {
+	if err := ValidateUsername(username); err != nil {
+		return errorf(ErrInvalidUsername, "%s", err)
+	}
+	args := &abuseReportArgs{
+		Username:         c.Username,
+		Reported:         username,
+		Category:         category,
+		Details:          details,
+		Time:             clock.Or(c.Clock).Now().Unix(),
+		ServerSigningKey: server.Key,
+	}
+	sig, err := signLogin(c.LoginKey, args.msg())
+	if err != nil {
+		return err
+	}
+	args.Signature = sig
+	return c.do(server, "report", args, new(string))
+}
+
+// DeviceKeys returns the user's login key and enrolled device keys.
+func (c *Client) DeviceKeys(server PublicServerConfig) (loginKey ed25519.PublicKey, deviceKeys []ed25519.PublicKey, err error) {
+	args := &deviceKeysArgs{
+		Username:         c.Username,
+		Time:             clock.Or(c.Clock).Now().Unix(),
+		ServerSigningKey: server.Key,
+	}
+	args.Signature, err = signLogin(c.LoginKey, args.msg())
+	if err != nil {
+		return nil, nil, err
+	}
+	reply := new(deviceKeysReply)
+	if err := c.do(server, "devicekeys", args, reply); err != nil {
+		return nil, nil, err
+	}
+	return reply.LoginKey, reply.DeviceKeys, nil
+}
+
+// Rename changes the client's username on the PKG server to
+// newUsername, using token to prove ownership of the new username as
+// when registering. It returns the server's attestation of the rename
+// for the client to show its friends. The client's Username is not
+// changed.
+func (c *Client) Rename(server PublicServerConfig, newUsername string, token string) (*RenameAttestation, error) {
+	if err := ValidateUsername(newUsername); err != nil {
+		return nil, errorf(ErrInvalidUsername, "%s", err)
+	}
+	args := &renameArgs{
+		OldUsername:       c.Username,
+		NewUsername:       newUsername,
+		RegistrationToken: token,
+		Time:              clock.Or(c.Clock).Now().Unix(),
+		ServerSigningKey:  server.Key,
+	}
+	sig, err := signLogin(c.LoginKey, args.msg())
+	if err != nil {
+		return nil, err
+	}
+	args.Signature = sig
+	reply := new(RenameAttestation)
+	if err := c.do(server, "rename", args, reply); err != nil {
+		return nil, err
+	}
+	if reply.OldUsername != c.Username || reply.NewUsername != newUsername {
+		return nil, errors.New("attestation is for %q -> %q", reply.OldUsername, reply.NewUsername)
+	}
+	if !reply.VerifyAny(server.Keys()) {
+		return nil, errors.New("invalid attestation signature")
+	}
+	return reply, nil
+}
+
+// LookupPQKey fetches the PQ key that username published on the PKG
+// server and checks the server's signature on it.
+func (c *Client) LookupPQKey(server PublicServerConfig, username string) ([]byte, error) {
+	id, err := UsernameToIdentity(username)
+	if err != nil {
+		return nil, err
+	}
+	args := &lookupPQKeyArgs{
+		Username: username,
+	}
+	reply := new(lookupPQKeyReply)
+	err = c.do(server, "pqkey", args, reply)
+	if workBits := requiredWork(err); workBits > 0 && workBits <= maxWorkBits {
+		args.Work = solveWork(server.Key, username, workBits, clock.Or(c.Clock).Now())
+		err = c.do(server, "pqkey", args, reply)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if reply.Username != username {
+		return nil, errors.New("expected reply for username %q, but got %q", username, reply.Username)
+	}
+	if !ed25519.Verify(server.Key, PQKeyAttestation(server.Key, id, reply.PQKey), reply.Signature) {
+		return nil, errors.New("invalid signature")
+	}
+	return reply.PQKey, nil
+}
+
+// AttestationLogHead fetches the PKG server's signed attestation log
+// head and checks its signature.
+func (c *Client) AttestationLogHead(server PublicServerConfig) (*LogHead, error) {
+	head := new(LogHead)
+	if err := c.do(server, "attestlog/head", struct{}{}, head); err != nil {
+		return nil, err
+	}
+	if !head.Verify(server.Key) {
+		return nil, errors.New("invalid log head signature")
+	}
+	return head, nil
+}
+
+// VerifyAttestationLogged checks that the PKG server logged its
+// attestation to the client's long-term key in the given epoch, in
+// the log with the given head.
+func (c *Client) VerifyAttestationLogged(server PublicServerConfig, head *LogHead, epoch uint32) error {
+	id, err := UsernameToIdentity(c.Username)
+	if err != nil {
+		return err
+	}
+	args := &logInclusionArgs{
+		Username:    c.Username,
+		LongTermKey: c.UserLongTermKey,
+		Epoch:       epoch,
+		TreeSize:    head.Size,
+	}
+	reply := new(logInclusionReply)
+	if err := c.do(server, "attestlog/inclusion", args, reply); err != nil {
+		return err
+	}
+	entry := &AttestationLogEntry{
+		UsernameHash: LogUsernameHash(id),
+		LongTermKey:  c.UserLongTermKey,
+		Epoch:        epoch,
+	}
+	if !translog.VerifyInclusion(entry.LeafHash(), reply.Index, head.Size, reply.Proof, head.RootHash) {
+		return errors.New("invalid inclusion proof for entry %d in log of size %d", reply.Index, head.Size)
+	}
+	return nil
+}
+
+// VerifyAttestationLogConsistency checks that the log with head
+// newHead extends the log with head oldHead. Both heads must come
+// from the same PKG server. An error means either the server is
+// misbehaving or the heads are not from the same log; together the
+// two signed heads are evidence of the former.
+func (c *Client) VerifyAttestationLogConsistency(server PublicServerConfig, oldHead, newHead *LogHead) error {
+	return c.verifyLogConsistency(server, "attestlog/consistency", oldHead, newHead)
+}
+
+func (c *Client) verifyLogConsistency(server PublicServerConfig, path string, oldHead, newHead *LogHead) error {
+	if oldHead.Size > newHead.Size {
+		return errors.New("log shrank from %d to %d entries", oldHead.Size, newHead.Size)
+	}
+	args := &logConsistencyArgs{
+		First:  oldHead.Size,
+		Second: newHead.Size,
+	}
+	reply := new(logConsistencyReply)
+	if err := c.do(server, path, args, reply); err != nil {
+		return err
+	}
+	if !translog.VerifyConsistency(oldHead.Size, newHead.Size, oldHead.RootHash, newHead.RootHash, reply.Proof) {
+		return errors.New("log of size %d is not a prefix of log of size %d", oldHead.Size, newHead.Size)
+	}
 	return nil
 }
 
+// AttestationLogEntries fetches up to count log entries starting at
+// index start, for auditors that replay the log.
+func (c *Client) AttestationLogEntries(server PublicServerConfig, start, count uint64) ([]*AttestationLogEntry, error) {
+	args := &logEntriesArgs{
+		Start: start,
+		Count: count,
+	}
+	reply := new(logEntriesReply)
+	if err := c.do(server, "attestlog/entries", args, reply); err != nil {
+		return nil, err
+	}
+	entries := make([]*AttestationLogEntry, len(reply.Entries))
+	for i, data := range reply.Entries {
+		entries[i] = new(AttestationLogEntry)
+		if err := entries[i].Unmarshal(data); err != nil {
+			return nil, errors.Wrap(err, "entry %d", start+uint64(i))
+		}
+	}
+	return entries, nil
+}
+
+// RegistrationLogHead fetches the PKG server's signed registration log
+// head and checks its signature.
+func (c *Client) RegistrationLogHead(server PublicServerConfig) (*RegistrationLogHead, error) {
+	head := new(RegistrationLogHead)
+	if err := c.do(server, "reglog/head", struct{}{}, head); err != nil {
+		return nil, err
+	}
+	if !head.Verify(server.Key) {
+		return nil, errors.New("invalid log head signature")
+	}
+	return head, nil
+}
+
+// VerifyRegistrationLogged checks that the latest entry for the
+// client's username in the registration log with the given head binds
+// the username to the client's login key. An error other than a
+// network or server error means the PKG server bound the username to
+// another key, and the returned entry and the signed head are
+// evidence of it.
+func (c *Client) VerifyRegistrationLogged(server PublicServerConfig, head *RegistrationLogHead) error {
+	id, err := UsernameToIdentity(c.Username)
+	if err != nil {
+		return err
+	}
+	loginKey, err := loginPublicKey(c.LoginKey)
+	if err != nil {
+		return err
+	}
+	args := &regLogInclusionArgs{
+		Username: c.Username,
+		TreeSize: head.Size,
+	}
+	reply := new(regLogInclusionReply)
+	if err := c.do(server, "reglog/inclusion", args, reply); err != nil {
+		return err
+	}
+	entry := new(RegistrationLogEntry)
+	if err := entry.Unmarshal(reply.Entry); err != nil {
+		return errors.Wrap(err, "registration log entry %d", reply.Index)
+	}
+	if entry.UsernameHash != LogUsernameHash(id) {
+		return errors.New("registration log entry %d is for another username", reply.Index)
+	}
+	if !translog.VerifyInclusion(entry.LeafHash(), reply.Index, head.Size, reply.Proof, head.RootHash) {
+		return errors.New("invalid inclusion proof for entry %d in log of size %d", reply.Index, head.Size)
+	}
+	if !loginKey.Equal(entry.LoginKey) {
+		return errors.New("registration log entry %d binds %q to login key %x, not ours", reply.Index, c.Username, []byte(entry.LoginKey))
+	}
+	return nil
+}
+
+// VerifyRegistrationLogConsistency checks that the registration log
+// with head newHead extends the log with head oldHead.
+func (c *Client) VerifyRegistrationLogConsistency(server PublicServerConfig, oldHead, newHead *RegistrationLogHead) error {
+	return c.verifyLogConsistency(server, "reglog/consistency", (*LogHead)(oldHead), (*LogHead)(newHead))
+}
+
+// RegistrationLogEntries fetches up to count registration log entries
+// starting at index start, for monitors that replay the log.
+func (c *Client) RegistrationLogEntries(server PublicServerConfig, start, count uint64) ([]*RegistrationLogEntry, error) {
+	args := &logEntriesArgs{
+		Start: start,
+		Count: count,
+	}
+	reply := new(logEntriesReply)
+	if err := c.do(server, "reglog/entries", args, reply); err != nil {
+		return nil, err
+	}
+	entries := make([]*RegistrationLogEntry, len(reply.Entries))
+	for i, data := range reply.Entries {
+		entries[i] = new(RegistrationLogEntry)
+		if err := entries[i].Unmarshal(data); err != nil {
+			return nil, errors.Wrap(err, "entry %d", start+uint64(i))
+		}
+	}
+	return entries, nil
+}
+
 type ExtractResult struct {
 	PrivateKey  *ibe.IdentityPrivateKey
 	IdentitySig bls.Signature
@@ -81,60 +681,164 @@ type ExtractResult struct {
 
 // Extract obtains the user's IBE private key for the given round from the PKG.
 func (c *Client) Extract(server PublicServerConfig, round uint32) (*ExtractResult, error) {
-	myPub, myPriv, err := box.GenerateKey(rand.Reader)
+	reply, msg, err := c.extract(server, round, "")
+	if err != nil {
+		return nil, err
+	}
+	// TODO un-hardcode 64
+	if len(reply.IdentitySig) != 64 {
+		keysafe.Zero(msg)
+		return nil, errors.New("invalid identity signature: got %d bytes, want %d", len(reply.IdentitySig), 64)
+	}
+
+	ibeKey := new(ibe.IdentityPrivateKey)
+	err = ibeKey.UnmarshalBinary(msg)
+	keysafe.Zero(msg)
+	if err != nil {
+		return nil, errors.Wrap(err, "unmarshalling ibe identity key")
+	}
+
+	return &ExtractResult{
+		PrivateKey:  ibeKey,
+		IdentitySig: reply.IdentitySig,
+	}, nil
+}
+
+// A CurveExtractResult is an extracted identity key on a pairing curve
+// other than bn256, in that curve's encoding.
+type CurveExtractResult struct {
+	Curve       string
+	PrivateKey  []byte
+	IdentitySig []byte
+}
+
+// ExtractCurve is like Extract but obtains the identity key on the
+// named pairing curve, which the PKG must be serving for the round.
+func (c *Client) ExtractCurve(server PublicServerConfig, round uint32, curve string) (*CurveExtractResult, error) {
+	reply, msg, err := c.extract(server, round, curve)
+	if err != nil {
+		return nil, err
+	}
+	return &CurveExtractResult{
+		Curve:       curve,
+		PrivateKey:  msg,
+		IdentitySig: reply.IdentitySig,
+	}, nil
+}
+
+// extract requests an identity key and returns the verified reply
+// along with the decrypted key bytes.
+func (c *Client) extract(server PublicServerConfig, round uint32, curve string) (*extractReply, []byte, error) {
+	keys, err := newReturnKeys(c.ReturnVersion)
 	if err != nil {
-		panic("box.GenerateKey: " + err.Error())
+		return nil, nil, err
 	}
+	defer keys.destroy()
 
 	args := &extractArgs{
 		Round:            round,
 		Username:         c.Username,
-		ReturnKey:        myPub,
+		ReturnKey:        keys.pub,
+		ReturnVersion:    keys.version,
+		ReturnPQKey:      keys.pqKey(),
 		UserLongTermKey:  c.UserLongTermKey,
+		Curve:            curve,
 		ServerSigningKey: server.Key,
 	}
-	args.Sign(c.LoginKey)
+	if err := args.Sign(c.LoginKey); err != nil {
+		return nil, nil, err
+	}
 
 	reply := new(extractReply)
 	err = c.do(server, "extract", args, reply)
+	if err != nil {
+		return nil, nil, err
+	}
+	msg, err := c.openExtractReply(server, reply, round, curve, keys)
+	if err != nil {
+		return nil, nil, err
+	}
+	return reply, msg, nil
+}
+
+// ExtractRange obtains the user's IBE private keys for the rounds from
+// through to, inclusive, in one request. The range can have at most
+// MaxExtractBatch rounds. Rounds the server no longer (or does not
+// yet) have keys for are missing from the result.
+func (c *Client) ExtractRange(server PublicServerConfig, from, to uint32) (map[uint32]*ExtractResult, error) {
+	keys, err := newReturnKeys(c.ReturnVersion)
+	if err != nil {
+		return nil, err
+	}
+	defer keys.destroy()
+
+	args := &extractBatchArgs{
+		FromRound:        from,
+		ToRound:          to,
+		Username:         c.Username,
+		ReturnKey:        keys.pub,
+		ReturnVersion:    keys.version,
+		ReturnPQKey:      keys.pqKey(),
+		UserLongTermKey:  c.UserLongTermKey,
+		ServerSigningKey: server.Key,
+	}
+	if err := args.Sign(c.LoginKey); err != nil {
+		return nil, err
+	}
+
+	reply := new(extractBatchReply)
+	err = c.do(server, "extractbatch", args, reply)
 	if err != nil {
 		return nil, err
 	}
 
+	results := make(map[uint32]*ExtractResult, len(reply.Replies))
+	for _, r := range reply.Replies {
+		if r == nil || r.Round < from || r.Round > to || results[r.Round] != nil {
+			return nil, errors.New("unexpected reply in batch for rounds %d-%d", from, to)
+		}
+		msg, err := c.openExtractReply(server, r, r.Round, "", keys)
+		if err != nil {
+			return nil, errors.Wrap(err, "round %d", r.Round)
+		}
+		// TODO un-hardcode 64
+		if len(r.IdentitySig) != 64 {
+			keysafe.Zero(msg)
+			return nil, errors.New("round %d: invalid identity signature: got %d bytes, want %d", r.Round, len(r.IdentitySig), 64)
+		}
+		ibeKey := new(ibe.IdentityPrivateKey)
+		err = ibeKey.UnmarshalBinary(msg)
+		keysafe.Zero(msg)
+		if err != nil {
+			return nil, errors.Wrap(err, "round %d: unmarshalling ibe identity key", r.Round)
+		}
+		results[r.Round] = &ExtractResult{
+			PrivateKey:  ibeKey,
+			IdentitySig: r.IdentitySig,
+		}
+	}
+	return results, nil
+}
+
+// openExtractReply checks that the reply is the server's answer to the
+// client's request for the round, and decrypts the key in it.
+func (c *Client) openExtractReply(server PublicServerConfig, reply *extractReply, round uint32, curve string, keys *returnKeys) ([]byte, error) {
 	if reply.Round != round {
 		return nil, errors.New("expected reply for round %d, but got %d", round, reply.Round)
 	}
 	if reply.Username != c.Username {
 		return nil, errors.New("expected reply for username %q, but got %q", c.Username, reply.Username)
 	}
+	if reply.Curve != curve {
+		return nil, errors.New("expected reply for curve %q, but got %q", curve, reply.Curve)
+	}
 	if l := len(reply.EncryptedPrivateKey); l < 32 {
 		return nil, errors.New("unexpectedly short ciphertext (%d bytes)", l)
 	}
-	if !reply.Verify(server.Key) {
+	if !reply.VerifyAny(server.Keys()) {
 		return nil, errors.New("invalid signature")
 	}
-	// TODO un-hardcode 64
-	if len(reply.IdentitySig) != 64 {
-		return nil, errors.New("invalid identity signature: got %d bytes, want %d", len(reply.IdentitySig), 64)
-	}
-
-	theirPub := new([32]byte)
-	copy(theirPub[:], reply.EncryptedPrivateKey[0:32])
-	ctxt := reply.EncryptedPrivateKey[32:]
-	msg, ok := box.Open(nil, ctxt, new([24]byte), theirPub, myPriv)
-	if !ok {
-		return nil, errors.New("box authentication failed")
-	}
-
-	ibeKey := new(ibe.IdentityPrivateKey)
-	if err := ibeKey.UnmarshalBinary(msg); err != nil {
-		return nil, errors.Wrap(err, "unmarshalling ibe identity key")
-	}
-
-	return &ExtractResult{
-		PrivateKey:  ibeKey,
-		IdentitySig: reply.IdentitySig,
-	}, nil
+	return keys.open(reply.EncryptedPrivateKey)
 }
 
 func (c *Client) do(server PublicServerConfig, path string, args, reply interface{}) error {
@@ -164,31 +868,60 @@ type pkgRequest struct {
 	TweakRequest func(*http.Request)
 }
 
-func (req *pkgRequest) Do() error {
+func (req *pkgRequest) Do() (err error) {
+	ctx, span := tracing.Start(context.Background(), "pkg.client/"+req.Path,
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(attribute.String("pkg.address", req.PublicServerConfig.Address)))
+	defer func() { tracing.End(span, err) }()
+
 	buf := new(bytes.Buffer)
 	if err := json.NewEncoder(buf).Encode(req.Args); err != nil {
 		return errors.Wrap(err, "json.Encode")
 	}
 
+	if v := req.PublicServerConfig.ProtocolVersion; v != 0 {
+		if err := version.PKG.Check("server", v, 0); err != nil {
+			return err
+		}
+	}
+
 	url := fmt.Sprintf("https://%s/%s", req.PublicServerConfig.Address, req.Path)
-	httpReq, err := http.NewRequest("POST", url, buf)
+	httpReq, err := version.PKG.NewRequest("POST", url, buf)
 	if err != nil {
 		return err
 	}
+	tracing.Inject(ctx, httpReq.Header)
+	binaryReply, acceptBinary := req.Reply.(encoding.BinaryUnmarshaler)
+	if acceptBinary {
+		httpReq.Header.Set("Accept", wire.ContentType+", application/json")
+	}
 	if req.TweakRequest != nil {
 		req.TweakRequest(httpReq)
 	}
 
-	resp, err := req.Client.Do(req.PublicServerConfig.Key, httpReq)
+	resp, err := req.Client.DoAny(req.PublicServerConfig.Keys(), httpReq)
 	if err != nil {
 		return err
 	}
 	defer resp.Body.Close()
+	// Check the server's version first: a server we cannot talk
+	// to may not reply in a format we can decode.
+	if err := version.PKG.CheckHeader("server", resp.Header); err != nil {
+		return err
+	}
 	body, err := ioutil.ReadAll(resp.Body)
 	if err != nil {
 		return errors.Wrap(err, "reading http response body")
 	}
 	if resp.StatusCode == http.StatusOK {
+		// Servers that predate the binary encoding ignore the
+		// Accept header and reply with JSON.
+		if acceptBinary && wire.IsBinary(resp.Header) {
+			if err := binaryReply.UnmarshalBinary(body); err != nil {
+				return errors.Wrap(err, "decoding binary reply")
+			}
+			return nil
+		}
 		if err := json.Unmarshal(body, req.Reply); err != nil {
 			return errors.Wrap(err, "json.Unmarshal")
 		}
@@ -204,3 +937,215 @@ func (req *pkgRequest) Do() error {
 		return pkgErr
 	}
 }
+
+type CoordinatorClient struct {
+	CoordinatorKey ed25519.PrivateKey
+
+	// Clock timestamps the coordinator's requests. The real clock is
+	// used if Clock is nil.
+	Clock clock.Clock
+
+	// Transport, if not nil, carries the requests to the PKGs in
+	// place of edTLS connections; see edhttp.Client.
+	Transport edhttp.Transport
+
+	initOnce sync.Once
+	client   *edhttp.Client
+}
+
+func (c *CoordinatorClient) init() {
+	c.initOnce.Do(func() {
+		c.client = &edhttp.Client{
+			Key:       c.CoordinatorKey,
+			Transport: c.Transport,
+		}
+	})
+}
+
+func (c *CoordinatorClient) nonce() coordinatorNonce {
+	return newCoordinatorNonce(clock.Or(c.Clock).Now())
+}
+
+func (c *CoordinatorClient) NewRound(pkgs []PublicServerConfig, round uint32) (RoundSettings, error) {
+	return c.NewRoundCurves(pkgs, round, nil)
+}
+
+// NewRoundCurves is like NewRound but also asks the PKGs to generate
+// round keys on the given pairing curves. bn256 keys are always
+// generated.
+func (c *CoordinatorClient) NewRoundCurves(pkgs []PublicServerConfig, round uint32, curves []string) (RoundSettings, error) {
+	return c.NewRoundThreshold(pkgs, round, curves, 0)
+}
+
+// NewRoundThreshold is like NewRoundCurves, but if threshold is not
+// zero, the PKGs generate the round's master keys on the curves other
+// than bn256 with a DKG, so that any threshold of them can serve the
+// round; see dkg.go. The curves must be pairing.ThresholdCurves.
+func (c *CoordinatorClient) NewRoundThreshold(pkgs []PublicServerConfig, round uint32, curves []string, threshold int) (RoundSettings, error) {
+	c.init()
+
+	keys := make([]ed25519.PublicKey, len(pkgs))
+	for i := range pkgs {
+		keys[i] = pkgs[i].Key
+	}
+	var participants []ed25519.PublicKey
+	if threshold != 0 {
+		participants = keys
+	}
+
+	commitments := make(map[string][]byte)
+	boxKeys := make(map[string][]*dkgBoxKey)
+	for i, pkg := range pkgs {
+		commitArgs := &commitArgs{
+			Round:            round,
+			Curves:           curves,
+			Threshold:        threshold,
+			Participants:     participants,
+			coordinatorNonce: c.nonce(),
+		}
+		commitReply := new(commitReply)
+		req := &pkgRequest{
+			PublicServerConfig: pkg,
+
+			Path:   "commit",
+			Args:   commitArgs,
+			Reply:  commitReply,
+			Client: c.client,
+		}
+		err := req.Do()
+		if err != nil {
+			return nil, err
+		}
+		commitments[hex.EncodeToString(pkg.Key)] = commitReply.Commitment
+		if threshold == 0 {
+			continue
+		}
+		for _, curve := range curves {
+			if curve == pairing.BN256 {
+				continue
+			}
+			if boxKeys[curve] == nil {
+				boxKeys[curve] = make([]*dkgBoxKey, len(pkgs))
+			}
+			if commitReply.BoxKeys[curve] == nil {
+				return nil, errors.New("pkg %s did not start a %s DKG", pkg.Address, curve)
+			}
+			boxKeys[curve][i] = commitReply.BoxKeys[curve]
+		}
+	}
+
+	for curve, curveBoxKeys := range boxKeys {
+		if err := c.dkg(pkgs, round, curve, threshold, curveBoxKeys); err != nil {
+			return nil, errors.Wrap(err, "%s dkg", curve)
+		}
+	}
+
+	settings := make(RoundSettings)
+	for _, pkg := range pkgs {
+		revealArgs := &revealArgs{
+			Round:            round,
+			Commitments:      commitments,
+			coordinatorNonce: c.nonce(),
+		}
+		var reply RevealReply
+		req := &pkgRequest{
+			PublicServerConfig: pkg,
+
+			Path:   "reveal",
+			Args:   revealArgs,
+			Reply:  &reply,
+			Client: c.client,
+		}
+		err := req.Do()
+		if err != nil {
+			return nil, err
+		}
+		for _, curve := range curves {
+			if curve != pairing.BN256 && reply.Curves[curve] == nil {
+				return nil, errors.New("pkg %s did not reveal %s keys", pkg.Address, curve)
+			}
+		}
+		settings[hex.EncodeToString(pkg.Key)] = reply
+	}
+
+	if !settings.Verify(round, keys) {
+		return nil, errors.New("could not verify round settings")
+	}
+
+	return settings, nil
+}
+
+// dkg runs the deal and combine phases of a round's DKG on curve. The
+// PKGs that deal bad shares are disqualified, as long as threshold
+// dealers are left.
+func (c *CoordinatorClient) dkg(pkgs []PublicServerConfig, round uint32, curve string, threshold int, boxKeys []*dkgBoxKey) error {
+	deals := make([]*dkgDeal, len(pkgs))
+	for i, pkg := range pkgs {
+		args := &dkgDealArgs{
+			Round:            round,
+			Curve:            curve,
+			BoxKeys:          boxKeys,
+			coordinatorNonce: c.nonce(),
+		}
+		deal := new(dkgDeal)
+		req := &pkgRequest{
+			PublicServerConfig: pkg,
+
+			Path:   "dkg/deal",
+			Args:   args,
+			Reply:  deal,
+			Client: c.client,
+		}
+		if err := req.Do(); err != nil {
+			return err
+		}
+		if deal.Dealer != i+1 {
+			return errors.New("pkg %s dealt as %d, not %d", pkg.Address, deal.Dealer, i+1)
+		}
+		deals[i] = deal
+	}
+
+	for {
+		disqualified := make(map[int]bool)
+		for _, pkg := range pkgs {
+			args := &dkgCombineArgs{
+				Round:            round,
+				Curve:            curve,
+				Deals:            deals,
+				coordinatorNonce: c.nonce(),
+			}
+			reply := new(dkgCombineReply)
+			req := &pkgRequest{
+				PublicServerConfig: pkg,
+
+				Path:   "dkg/combine",
+				Args:   args,
+				Reply:  reply,
+				Client: c.client,
+			}
+			if err := req.Do(); err != nil {
+				return err
+			}
+			for _, dealer := range reply.Complaints {
+				disqualified[dealer] = true
+			}
+		}
+		if len(disqualified) == 0 {
+			return nil
+		}
+
+		var qualified []*dkgDeal
+		for _, deal := range deals {
+			if !disqualified[deal.Dealer] {
+				qualified = append(qualified, deal)
+			}
+		}
+		if len(qualified) == len(deals) {
+			return errors.New("complaints about dealers that did not deal")
+		}
+		if len(qualified) < threshold {
+			return errors.New("%d dealers left after complaints, need %d", len(qualified), threshold)
+		}
+		deals = qualified
+	}
+}
@@ -0,0 +1,641 @@
+// Copyright 2018 David Lazar. All rights reserved.
+// Use of this source code is governed by the GNU AGPL
+// license that can be found in the LICENSE file.
+
+//go:build !js
+// +build !js
+
+package pkg
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/nacl/secretbox"
+
+	"vuvuzela.io/alpenhorn/edhttp"
+	"vuvuzela.io/alpenhorn/errors"
+	"vuvuzela.io/alpenhorn/internal/keysafe"
+	"vuvuzela.io/alpenhorn/internal/version"
+	"vuvuzela.io/alpenhorn/log"
+	"vuvuzela.io/alpenhorn/pairing"
+	"vuvuzela.io/alpenhorn/pkg/kv"
+	"vuvuzela.io/crypto/bls"
+	"vuvuzela.io/crypto/ibe"
+)
+
+// A large deployment can run several replicas of a PKG behind a load
+// balancer. The replicas share the PKG's signing key and one database,
+// such as a MySQL database, so any of them can answer any user.
+//
+// Round setup is different: a round's master keys must be the same on
+// every replica, and they live only in memory (see roundkeys.go). So
+// the replicas elect a leader, which holds a lease in the database that
+// it renews every LeaseTTL/3. Only the leader accepts commits and
+// reveals from the coordinator, which should reach the replicas through
+// an address whose load balancer checks /leaderz, and only the leader
+// runs the janitors that change the database. The other replicas, the
+// followers, fetch round keys from the leader over its PKG listener:
+// the latest revealed round every LeaseTTL/3, and other rounds when a
+// client asks for one they do not have. The master secrets stay sealed
+// with the round KEK, which the replicas share (see roundseal.go), and
+// the leader also encrypts the keys under the cluster key. The keys are
+// never written to the database.
+//
+// A leader that cannot renew its lease stops acting as leader when the
+// lease expires, and a follower takes over once it has expired, so the
+// replicas' clocks must agree to well within LeaseTTL.
+
+// DefaultClusterLeaseTTL is the leader's lease if ClusterConfig.LeaseTTL
+// is zero.
+const DefaultClusterLeaseTTL = 15 * time.Second
+
+// clusterRetry is how long a follower waits before asking the leader
+// again for a round the leader did not have.
+const clusterRetry = time.Second
+
+// A ClusterConfig makes a server a replica in a cluster of servers
+// that share one database.
+type ClusterConfig struct {
+	// NodeID names this replica. It must be unique in the cluster.
+	NodeID string
+
+	// Address is the host:port where the other replicas reach this
+	// replica's PKG listener.
+	Address string
+
+	// Key is shared by the replicas. It authenticates their requests
+	// for round keys and encrypts the keys the leader sends back.
+	Key *[32]byte
+
+	// LeaseTTL is how long the leader's lease lasts if it is not
+	// renewed. If zero, DefaultClusterLeaseTTL is used.
+	LeaseTTL time.Duration
+}
+
+var dbClusterLeaderKey = []byte("cluster:leader")
+
+type clusterLease struct {
+	Node    string
+	Address string
+	Expires time.Time
+}
+
+type cluster struct {
+	ClusterConfig
+
+	client *edhttp.Client
+	loop   *janitor
+
+	mu sync.Mutex
+	// lease is the latest lease read from the database. This replica
+	// is the leader if it holds the lease and leaderUntil is later
+	// than now.
+	lease       clusterLease
+	leaderUntil time.Time
+
+	// fetchMu serializes followers' requests to the leader. misses
+	// holds when the follower may ask again for rounds the leader did
+	// not have.
+	fetchMu sync.Mutex
+	misses  map[uint32]time.Time
+}
+
+func newCluster(conf *ClusterConfig) (*cluster, error) {
+	if conf.NodeID == "" {
+		return nil, errors.New("cluster NodeID is empty")
+	}
+	if conf.Address == "" {
+		return nil, errors.New("cluster Address is empty")
+	}
+	if conf.Key == nil {
+		return nil, errors.New("cluster Key is nil")
+	}
+	if conf.LeaseTTL < 0 {
+		return nil, errors.New("negative cluster LeaseTTL")
+	}
+	c := &cluster{
+		ClusterConfig: *conf,
+		client:        new(edhttp.Client),
+		misses:        make(map[uint32]time.Time),
+	}
+	if c.LeaseTTL == 0 {
+		c.LeaseTTL = DefaultClusterLeaseTTL
+	}
+	return c, nil
+}
+
+// startCluster tries to take the lease and starts renewing it, or
+// following the leader.
+func (srv *Server) startCluster() {
+	c := srv.cluster
+	srv.clusterTick()
+	c.loop = srv.newJanitor(c.LeaseTTL/3, srv.clusterTick)
+}
+
+func (srv *Server) clusterTick() {
+	if _, err := srv.renewLease(); err != nil {
+		srv.log.Errorf("Renewing cluster lease: %s", err)
+		return
+	}
+	if !srv.isLeader() {
+		if err := srv.syncLatestRound(); err != nil && errorCode(err) != ErrRoundNotFound {
+			srv.log.WithFields(log.Fields{"leader": srv.cluster.leaderAddress()}).Warnf("Fetching latest round from cluster leader: %s", err)
+		}
+	}
+}
+
+// isLeader reports whether the server sets up rounds and runs the
+// janitors. A server that is not in a cluster is always the leader.
+func (srv *Server) isLeader() bool {
+	c := srv.cluster
+	if c == nil {
+		return true
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return srv.clock.Now().Before(c.leaderUntil)
+}
+
+func (c *cluster) leaderAddress() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.lease.Address
+}
+
+// renewLease takes the lease if it has expired, or renews it if the
+// server holds it, and returns the lease in the database.
+func (srv *Server) renewLease() (*clusterLease, error) {
+	c := srv.cluster
+	now := srv.clock.Now()
+	var lease clusterLease
+	err := srv.db.Update(func(tx kv.Txn) error {
+		data, err := tx.Get(dbClusterLeaderKey)
+		if err == nil {
+			if err := json.Unmarshal(data, &lease); err != nil {
+				return err
+			}
+			if lease.Node != c.NodeID && now.Before(lease.Expires) {
+				return nil
+			}
+		} else if err != kv.ErrNotFound {
+			return err
+		}
+		lease = clusterLease{
+			Node:    c.NodeID,
+			Address: c.Address,
+			Expires: now.Add(c.LeaseTTL),
+		}
+		data, err = json.Marshal(&lease)
+		if err != nil {
+			panic(err)
+		}
+		return tx.Set(dbClusterLeaderKey, data)
+	})
+	if err != nil {
+		// Keep leading until the lease runs out, in case the
+		// database recovers in time.
+		return nil, errorf(ErrDatabaseError, "%s", err)
+	}
+
+	c.mu.Lock()
+	wasLeader := now.Before(c.leaderUntil)
+	c.lease = lease
+	if lease.Node == c.NodeID {
+		c.leaderUntil = lease.Expires
+	} else {
+		c.leaderUntil = time.Time{}
+	}
+	isLeader := now.Before(c.leaderUntil)
+	c.mu.Unlock()
+
+	if isLeader != wasLeader {
+		fields := log.Fields{"node": c.NodeID, "leader": lease.Node}
+		if isLeader {
+			srv.log.WithFields(fields).Info("Became cluster leader")
+		} else {
+			srv.log.WithFields(fields).Info("Following cluster leader")
+		}
+	}
+	return &lease, nil
+}
+
+// releaseLease gives up the lease, if the server holds it, so that
+// another replica can take over without waiting for it to expire.
+func (srv *Server) releaseLease() error {
+	c := srv.cluster
+	c.mu.Lock()
+	c.leaderUntil = time.Time{}
+	c.mu.Unlock()
+	return srv.db.Update(func(tx kv.Txn) error {
+		data, err := tx.Get(dbClusterLeaderKey)
+		if err == kv.ErrNotFound {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		var lease clusterLease
+		if err := json.Unmarshal(data, &lease); err != nil {
+			return err
+		}
+		if lease.Node != c.NodeID {
+			return nil
+		}
+		return tx.Delete(dbClusterLeaderKey)
+	})
+}
+
+func (srv *Server) closeCluster() {
+	if srv.cluster == nil {
+		return
+	}
+	srv.cluster.loop.close()
+	if err := srv.releaseLease(); err != nil {
+		srv.log.Errorf("Releasing cluster lease: %s", err)
+	}
+}
+
+// leaderzHandler replies 200 OK on the leader and 503 Service
+// Unavailable on followers, for load balancers that route round
+// setups.
+func (srv *Server) leaderzHandler(w http.ResponseWriter, req *http.Request) {
+	if !srv.isLeader() {
+		http.Error(w, "not leader", http.StatusServiceUnavailable)
+		return
+	}
+	w.Write([]byte("leader\n"))
+}
+
+type clusterRoundArgs struct {
+	// Round is the round the follower wants, unless Latest is true,
+	// in which case it wants the latest revealed round if it is not
+	// Round.
+	Round  uint32
+	Latest bool
+
+	UnixTime int64
+	MAC      []byte
+}
+
+func (a *clusterRoundArgs) mac(key *[32]byte) []byte {
+	h := hmac.New(sha256.New, key[:])
+	h.Write([]byte("ClusterRound"))
+	binary.Write(h, binary.BigEndian, a.Round)
+	binary.Write(h, binary.BigEndian, a.Latest)
+	binary.Write(h, binary.BigEndian, a.UnixTime)
+	return h.Sum(nil)
+}
+
+// A clusterRound is a round's keys as the leader sends them to
+// followers, sealed with the cluster key. The master secrets are also
+// sealed with the round KEK, as the leader holds them; see
+// roundseal.go.
+type clusterRound struct {
+	Round     uint32
+	Committed time.Time
+
+	// Revealed is when the coordinator revealed the round, if it is
+	// the leader's latest revealed round.
+	Revealed time.Time
+
+	MasterPublicKey []byte
+	SealedMasterKey []byte
+	BLSPublicKey    []byte
+	SealedBLSKey    []byte
+	Curves          map[string]*clusterCurveKeys
+}
+
+type clusterCurveKeys struct {
+	MasterPublicKey []byte
+	SealedMasterKey []byte
+	BLSPublicKey    []byte
+	SealedBLSKey    []byte
+
+	// Threshold is set if the master key is from a DKG, in which case
+	// SealedMasterKey is the leader's share of it.
+	Threshold *ThresholdKeys `json:",omitempty"`
+}
+
+func marshalClusterRound(round uint32, revealed time.Time, st *roundState) (*clusterRound, error) {
+	r := &clusterRound{
+		Round:           round,
+		Committed:       st.committed,
+		Revealed:        revealed,
+		SealedMasterKey: st.sealedMasterKey,
+		SealedBLSKey:    st.sealedBLSKey,
+	}
+	var err error
+	if r.MasterPublicKey, err = st.masterPublicKey.MarshalBinary(); err != nil {
+		return nil, err
+	}
+	if r.BLSPublicKey, err = st.blsPublicKey.MarshalBinary(); err != nil {
+		return nil, err
+	}
+	if len(st.curves) > 0 {
+		r.Curves = make(map[string]*clusterCurveKeys, len(st.curves))
+		for name, k := range st.curves {
+			r.Curves[name] = &clusterCurveKeys{
+				MasterPublicKey: k.MasterPublicKey,
+				SealedMasterKey: k.sealedMasterKey,
+				BLSPublicKey:    k.BLSPublicKey,
+				SealedBLSKey:    k.sealedBLSKey,
+				Threshold:       k.Threshold,
+			}
+		}
+	}
+	return r, nil
+}
+
+// roundState decodes the round. The follower checks that the master
+// secrets open with its round KEK, so that a follower whose KEK differs
+// from the leader's fails here rather than on every extraction.
+func (r *clusterRound) roundState(kek *roundKEK) (*roundState, error) {
+	st := &roundState{
+		masterPublicKey: new(ibe.MasterPublicKey),
+		sealedMasterKey: r.SealedMasterKey,
+		blsPublicKey:    new(bls.PublicKey),
+		sealedBLSKey:    r.SealedBLSKey,
+		committed:       r.Committed,
+	}
+	if err := st.masterPublicKey.UnmarshalBinary(r.MasterPublicKey); err != nil {
+		return nil, errors.Wrap(err, "master public key")
+	}
+	if err := st.blsPublicKey.UnmarshalBinary(r.BLSPublicKey); err != nil {
+		return nil, errors.Wrap(err, "bls public key")
+	}
+	if _, _, err := kek.openKeys(st); err != nil {
+		return nil, err
+	}
+	if len(r.Curves) > 0 {
+		st.curves = make(map[string]*curveRoundKeys, len(r.Curves))
+		for name, k := range r.Curves {
+			curve, err := pairing.Lookup(name)
+			if err != nil {
+				return nil, err
+			}
+			for _, box := range [][]byte{k.SealedMasterKey, k.SealedBLSKey} {
+				secret, err := kek.open(box)
+				if err != nil {
+					return nil, errors.Wrap(err, "%s", name)
+				}
+				keysafe.Zero(secret)
+			}
+			st.curves[name] = &curveRoundKeys{
+				curve: curve,
+				CurveKeys: CurveKeys{
+					MasterPublicKey: k.MasterPublicKey,
+					BLSPublicKey:    k.BLSPublicKey,
+					Threshold:       k.Threshold,
+				},
+				sealedMasterKey: k.SealedMasterKey,
+				sealedBLSKey:    k.SealedBLSKey,
+			}
+		}
+	}
+	return st, nil
+}
+
+// clusterRoundHandler serves POST /cluster/round, which sends a round's
+// keys to a follower, sealed with the cluster key. It replies 304 Not
+// Modified if the follower asked for the latest round and has it.
+func (srv *Server) clusterRoundHandler(w http.ResponseWriter, req *http.Request) {
+	c := srv.cluster
+	if c == nil {
+		http.NotFound(w, req)
+		return
+	}
+	args := new(clusterRoundArgs)
+	body := http.MaxBytesReader(w, req.Body, 1024)
+	if err := json.NewDecoder(body).Decode(args); err != nil {
+		httpError(w, errorf(ErrBadRequestJSON, "%s", err))
+		return
+	}
+	if !hmac.Equal(args.MAC, args.mac(c.Key)) {
+		httpError(w, errorf(ErrUnauthorized, "bad cluster mac"))
+		return
+	}
+	if err := checkFresh(args.UnixTime, srv.clock.Now()); err != nil {
+		httpError(w, err)
+		return
+	}
+
+	srv.mu.Lock()
+	round := args.Round
+	if args.Latest {
+		if srv.lastReveal.IsZero() {
+			srv.mu.Unlock()
+			httpError(w, errorf(ErrRoundNotFound, "no round revealed yet"))
+			return
+		}
+		if round == srv.latestRound {
+			srv.mu.Unlock()
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		round = srv.latestRound
+	}
+	st, ok := srv.rounds[round]
+	var revealed time.Time
+	if round == srv.latestRound {
+		revealed = srv.lastReveal
+	}
+	srv.mu.Unlock()
+	if !ok {
+		httpError(w, errorf(ErrRoundNotFound, "%d", round))
+		return
+	}
+	// Followers do not take part in DKGs, so they get the round once
+	// the leader has its share of the master key.
+	if st.checkDKGFinished(round) != nil {
+		httpError(w, errorf(ErrRoundNotFound, "%d: a DKG is not finished", round))
+		return
+	}
+
+	r, err := marshalClusterRound(round, revealed, st)
+	if err != nil {
+		httpError(w, errorf(ErrUnknown, "marshaling round keys: %s", err))
+		return
+	}
+	msg, err := json.Marshal(r)
+	if err != nil {
+		panic(err)
+	}
+	var nonce [24]byte
+	if _, err := rand.Read(nonce[:]); err != nil {
+		panic(err)
+	}
+	box := secretbox.Seal(nonce[:], msg, &nonce, c.Key)
+	keysafe.Zero(msg)
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Write(box)
+}
+
+// requestRound asks the leader for a round. It returns a nil
+// clusterRound if the leader replied that the follower already has
+// the latest round.
+func (srv *Server) requestRound(round uint32, latest bool) (*clusterRound, error) {
+	c := srv.cluster
+	address := c.leaderAddress()
+	if address == "" {
+		return nil, errors.New("no cluster leader")
+	}
+	args := &clusterRoundArgs{
+		Round:    round,
+		Latest:   latest,
+		UnixTime: srv.clock.Now().Unix(),
+	}
+	args.MAC = args.mac(c.Key)
+	data, err := json.Marshal(args)
+	if err != nil {
+		panic(err)
+	}
+	req, err := version.PKG.NewRequest("POST", "https://"+address+"/cluster/round", bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), c.LeaseTTL/3)
+	defer cancel()
+	resp, err := c.client.Do(srv.publicKey, req.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return nil, errors.Wrap(err, "reading reply")
+	}
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotModified:
+		return nil, nil
+	default:
+		var e Error
+		if json.Unmarshal(body, &e) == nil {
+			return nil, e
+		}
+		return nil, errors.New("leader replied %s", resp.Status)
+	}
+
+	if len(body) < 24 {
+		return nil, errors.New("short reply")
+	}
+	var nonce [24]byte
+	copy(nonce[:], body)
+	msg, ok := secretbox.Open(nil, body[24:], &nonce, c.Key)
+	if !ok {
+		return nil, errors.New("reply does not open with the cluster key")
+	}
+	defer keysafe.Zero(msg)
+	r := new(clusterRound)
+	if err := json.Unmarshal(msg, r); err != nil {
+		return nil, errors.Wrap(err, "decoding round keys")
+	}
+	if !latest && r.Round != round {
+		return nil, errors.New("asked for round %d, got round %d", round, r.Round)
+	}
+	return r, nil
+}
+
+// installRound adds a round fetched from the leader to the server's
+// rounds, unless the server already has it, and returns the round.
+func (srv *Server) installRound(r *clusterRound) (*roundState, error) {
+	st, err := r.roundState(srv.roundKEK)
+	if err != nil {
+		return nil, err
+	}
+
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	if !r.Revealed.IsZero() && (r.Round >= srv.latestRound || srv.lastReveal.IsZero()) {
+		srv.latestRound = r.Round
+		srv.lastReveal = r.Revealed
+	}
+	if cst, ok := srv.rounds[r.Round]; ok {
+		return cst, nil
+	}
+	srv.roundUses++
+	st.lastUsed = srv.roundUses
+	srv.rounds[r.Round] = st
+	srv.roundStats.start(r.Round, st.committed)
+	srv.evictRoundsLocked(r.Round)
+	return st, nil
+}
+
+// syncLatestRound fetches the leader's latest revealed round if the
+// follower does not have it yet.
+func (srv *Server) syncLatestRound() error {
+	c := srv.cluster
+	c.fetchMu.Lock()
+	defer c.fetchMu.Unlock()
+
+	srv.mu.Lock()
+	have := srv.latestRound
+	if srv.lastReveal.IsZero() {
+		// Round 0 is a valid round, so ask for it explicitly.
+		have = ^uint32(0)
+	}
+	srv.mu.Unlock()
+
+	r, err := srv.requestRound(have, true)
+	if err != nil || r == nil {
+		return err
+	}
+	_, err = srv.installRound(r)
+	return err
+}
+
+// fetchRound fetches a round that the follower does not have from the
+// leader. Fetches are serialized, and a round the leader did not have
+// is not asked for again for clusterRetry, so clients asking for
+// rounds that do not exist cannot flood the leader.
+func (srv *Server) fetchRound(round uint32) (*roundState, bool) {
+	c := srv.cluster
+	if srv.isLeader() {
+		return nil, false
+	}
+	c.fetchMu.Lock()
+	defer c.fetchMu.Unlock()
+
+	// Another request may have fetched the round while this one
+	// waited.
+	srv.mu.Lock()
+	st, ok := srv.rounds[round]
+	srv.mu.Unlock()
+	if ok {
+		return st, true
+	}
+	now := srv.clock.Now()
+	if now.Before(c.misses[round]) {
+		return nil, false
+	}
+
+	r, err := srv.requestRound(round, false)
+	if err == nil {
+		st, err = srv.installRound(r)
+	}
+	if err != nil {
+		if errorCode(err) != ErrRoundNotFound {
+			srv.log.WithFields(log.Fields{"round": round, "leader": c.leaderAddress()}).Warnf("Fetching round from cluster leader: %s", err)
+		}
+		if len(c.misses) >= 1024 {
+			for r, t := range c.misses {
+				if !now.Before(t) {
+					delete(c.misses, r)
+				}
+			}
+		}
+		c.misses[round] = now.Add(clusterRetry)
+		return nil, false
+	}
+	return st, true
+}
@@ -0,0 +1,148 @@
+// Copyright 2018 David Lazar. All rights reserved.
+// Use of this source code is governed by the GNU AGPL
+// license that can be found in the LICENSE file.
+
+package pkg
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"vuvuzela.io/alpenhorn/edtls"
+	"vuvuzela.io/alpenhorn/pkg/kv"
+)
+
+// sharedDB lets several servers in a test share one database.
+type sharedDB struct {
+	kv.DB
+}
+
+func (sharedDB) Close() error { return nil }
+
+func TestCluster(t *testing.T) {
+	coordinatorPub, _, _ := ed25519.GenerateKey(rand.Reader)
+	_, serverKey, _ := ed25519.GenerateKey(rand.Reader)
+	db := sharedDB{kv.NewMemory()}
+	clusterKey := new([32]byte)
+	rand.Read(clusterKey[:])
+
+	listener, err := edtls.Listen("tcp", "127.0.0.1:0", serverKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	newServer := func(node, address string) *Server {
+		srv, err := NewServer(&Config{
+			DB:               db,
+			SigningKey:       serverKey,
+			CoordinatorKey:   coordinatorPub,
+			RegistrationMode: RegistrationFCFS,
+			Cluster: &ClusterConfig{
+				NodeID:  node,
+				Address: address,
+				Key:     clusterKey,
+			},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return srv
+	}
+	a := newServer("a", listener.Addr().String())
+	defer a.Close()
+	go http.Serve(listener, a)
+	defer listener.Close()
+	b := newServer("b", "127.0.0.1:1")
+	defer b.Close()
+
+	if !a.isLeader() || b.isLeader() {
+		t.Fatalf("leaders: a=%v b=%v", a.isLeader(), b.isLeader())
+	}
+	for _, tt := range []struct {
+		srv  *Server
+		code int
+	}{{a, http.StatusOK}, {b, http.StatusServiceUnavailable}} {
+		w := httptest.NewRecorder()
+		tt.srv.leaderzHandler(w, httptest.NewRequest("GET", "/leaderz", nil))
+		if w.Code != tt.code {
+			t.Fatalf("leaderz: got %d, want %d", w.Code, tt.code)
+		}
+	}
+
+	commit := func(srv *Server, round uint32) int {
+		body, _ := json.Marshal(&commitArgs{Round: round, coordinatorNonce: newCoordinatorNonce(time.Now())})
+		req := httptest.NewRequest("POST", "/commit", bytes.NewReader(body))
+		req.TLS = &tls.ConnectionState{
+			PeerCertificates: []*x509.Certificate{{PublicKey: coordinatorPub}},
+		}
+		w := httptest.NewRecorder()
+		srv.commitHandler(w, req)
+		return w.Code
+	}
+	if code := commit(b, 1); code != http.StatusServiceUnavailable {
+		t.Fatalf("commit on follower: got %d", code)
+	}
+	if code := commit(a, 1); code != http.StatusOK {
+		t.Fatalf("commit on leader: got %d", code)
+	}
+
+	// The follower fetches the round from the leader.
+	st, ok := b.getRound(1)
+	if !ok {
+		t.Fatal("follower did not fetch round 1")
+	}
+	want, _ := a.roundKEK.open(a.rounds[1].sealedMasterKey)
+	got, err := b.roundKEK.open(st.sealedMasterKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Fatal("follower has different round keys")
+	}
+	if _, ok := b.getRound(2); ok {
+		t.Fatal("follower found a round that does not exist")
+	}
+
+	// A follower with another round KEK cannot use the leader's rounds.
+	c := newServer("c", "127.0.0.1:2")
+	c.roundKEK = newRoundKEK(new([32]byte), nil)
+	defer c.Close()
+	if r, err := c.requestRound(1, false); err != nil {
+		t.Fatal(err)
+	} else if _, err := c.installRound(r); err == nil {
+		t.Fatal("follower installed a round sealed with another KEK")
+	}
+
+	a.mu.Lock()
+	a.latestRound = 1
+	a.lastReveal = a.clock.Now()
+	a.mu.Unlock()
+	if err := b.syncLatestRound(); err != nil {
+		t.Fatal(err)
+	}
+	b.mu.Lock()
+	round, revealed := b.latestRound, b.lastReveal
+	b.mu.Unlock()
+	if round != 1 || revealed.IsZero() {
+		t.Fatalf("follower's latest round: %d at %s", round, revealed)
+	}
+
+	// The follower takes over when the leader releases its lease.
+	a.closeCluster()
+	if a.isLeader() {
+		t.Fatal("closed server is still leader")
+	}
+	if _, err := b.renewLease(); err != nil {
+		t.Fatal(err)
+	}
+	if !b.isLeader() {
+		t.Fatal("follower did not take over")
+	}
+}
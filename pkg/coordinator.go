@@ -0,0 +1,196 @@
+// Copyright 2018 David Lazar. All rights reserved.
+// Use of this source code is governed by the GNU AGPL
+// license that can be found in the LICENSE file.
+
+//go:build !js
+// +build !js
+
+package pkg
+
+import (
+	"crypto/ed25519"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"net/http"
+
+	"vuvuzela.io/alpenhorn/internal/keysafe"
+	"vuvuzela.io/alpenhorn/log"
+	"vuvuzela.io/alpenhorn/pkg/kv"
+)
+
+// A PKG can trust more than one coordinator, such as a standby or one
+// run by another party, and accepts round setups from any of them.
+// Round setup requests from a coordinator arrive over TLS, but the
+// PKG does not rely on that alone to keep them from being replayed.
+// Each commit and reveal carries a timestamp and a random nonce, which
+// the PKG remembers for ReplayWindow like other signed requests, and
+// the PKG records the last round each coordinator key committed and
+// revealed. A commit or reveal for a round that is not newer than the
+// coordinator's last one is rejected with ErrOldRound, so an old round
+// setup cannot be used to roll the PKG's round keys back, even across
+// a restart. The DKG requests between a commit and its reveal (see
+// dkg.go) carry nonces too, but are checked against the round's state
+// rather than the coordinator's last rounds.
+//
+// The server can also be limited to accepting round setups from
+// Config.CoordinatorNetworks. Requests from elsewhere are turned away
+// on their source address alone, before any key or nonce is checked.
+
+var dbCoordinatorPrefix = []byte("coordinator:")
+
+func dbCoordinatorKey(key ed25519.PublicKey) []byte {
+	return append(append([]byte{}, dbCoordinatorPrefix...), key...)
+}
+
+const coordinatorRoundsSize = 8
+
+// coordinatorRounds are the last rounds a coordinator committed and
+// revealed. The coordinator's rounds start at 1, so 0 means none.
+type coordinatorRounds struct {
+	Committed uint32
+	Revealed  uint32
+}
+
+func (r coordinatorRounds) marshal() []byte {
+	data := make([]byte, coordinatorRoundsSize)
+	binary.BigEndian.PutUint32(data[0:4], r.Committed)
+	binary.BigEndian.PutUint32(data[4:8], r.Revealed)
+	return data
+}
+
+func (r *coordinatorRounds) unmarshal(data []byte) error {
+	if len(data) != coordinatorRoundsSize {
+		return fmt.Errorf("bad coordinator rounds length: %d", len(data))
+	}
+	r.Committed = binary.BigEndian.Uint32(data[0:4])
+	r.Revealed = binary.BigEndian.Uint32(data[4:8])
+	return nil
+}
+
+// authorizedCoordinator returns the key of the coordinator that sent
+// req. If req is not from one of the server's coordinators, it replies
+// with ErrUnauthorized and returns false.
+func (srv *Server) authorizedCoordinator(w http.ResponseWriter, req *http.Request) (ed25519.PublicKey, bool) {
+	live := srv.live()
+	if !allowedAddr(live.coordinatorNetworks, remoteIP(req)) {
+		srv.log.WithFields(log.Fields{"path": req.URL.Path, "remoteIP": remoteIP(req)}).Warn("Round setup from outside the coordinator networks")
+		httpError(w, errorf(ErrUnauthorized, "source address is not allowed"))
+		return nil, false
+	}
+
+	peerKey, err := peerKey(req)
+	if err != nil {
+		httpError(w, err)
+		return nil, false
+	}
+	for _, key := range live.coordinatorKeys {
+		if keysafe.Equal(peerKey, key) {
+			return key, true
+		}
+	}
+	httpError(w, errorf(ErrUnauthorized, "peer key is not authorized"))
+	return nil, false
+}
+
+// allowedAddr reports whether the address addr is in one of networks,
+// or whether networks is empty and any address is allowed.
+func allowedAddr(networks []*net.IPNet, addr string) bool {
+	if len(networks) == 0 {
+		return true
+	}
+	ip := net.ParseIP(addr)
+	if ip == nil {
+		return false
+	}
+	for _, n := range networks {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// checkCoordinator records a commit, reveal, or DKG request for round
+// from the coordinator with the given key, failing if the request was
+// replayed or, for a commit or reveal, the coordinator already moved
+// past round.
+func (srv *Server) checkCoordinator(key ed25519.PublicKey, path string, round uint32, nonce *coordinatorNonce) error {
+	now := srv.clock.Now()
+	if err := checkFresh(nonce.Time, now); err != nil {
+		return err
+	}
+	if len(nonce.Nonce) != coordinatorNonceSize {
+		return errorf(ErrBadRequestJSON, "bad nonce length: %d", len(nonce.Nonce))
+	}
+
+	tx, err := srv.db.NewTransaction(true)
+	if err != nil {
+		return errorf(ErrDatabaseError, "%s", err)
+	}
+	defer tx.Discard()
+
+	if err := checkReplay(tx, "coordinator", nonce.Nonce, now); err != nil {
+		return err
+	}
+	if path != "commit" && path != "reveal" {
+		if err := tx.Commit(); err != nil {
+			return errorf(ErrDatabaseError, "%s", err)
+		}
+		return nil
+	}
+
+	var rounds coordinatorRounds
+	dbKey := dbCoordinatorKey(key)
+	data, err := tx.Get(dbKey)
+	switch err {
+	case nil:
+		if err := rounds.unmarshal(data); err != nil {
+			return errorf(ErrDatabaseError, "%s", err)
+		}
+	case kv.ErrNotFound:
+	default:
+		return errorf(ErrDatabaseError, "%s", err)
+	}
+
+	last := &rounds.Committed
+	if path == "reveal" {
+		last = &rounds.Revealed
+	}
+	if *last != 0 && round <= *last {
+		return errorf(ErrOldRound, "%s round %d, last round %d", path, round, *last)
+	}
+	*last = round
+
+	if err := tx.Set(dbKey, rounds.marshal()); err != nil {
+		return errorf(ErrDatabaseError, "%s", err)
+	}
+	if err := tx.Commit(); err != nil {
+		return errorf(ErrDatabaseError, "%s", err)
+	}
+
+	srv.mu.Lock()
+	srv.lastCoordinator = now
+	srv.mu.Unlock()
+	return nil
+}
+
+// roundSetupFailed replies to a commit or reveal that failed and tells
+// the webhooks about it.
+func (srv *Server) roundSetupFailed(w http.ResponseWriter, path string, round uint32, err error) {
+	logger := srv.log.WithFields(log.Fields{
+		"round": round,
+		"code":  errorCode(err).String(),
+	})
+	if isInternalError(err) {
+		logger.Errorf("Round setup %s failed: %s", path, err)
+	} else {
+		logger.Warnf("Round setup %s failed: %s", path, err)
+	}
+	srv.notify(&WebhookEvent{
+		Type:   WebhookRoundFailure,
+		Round:  round,
+		Detail: path + ": " + err.Error(),
+	})
+	httpError(w, err)
+}
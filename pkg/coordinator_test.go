@@ -0,0 +1,254 @@
+// Copyright 2018 David Lazar. All rights reserved.
+// Use of this source code is governed by the GNU AGPL
+// license that can be found in the LICENSE file.
+
+package pkg
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"vuvuzela.io/alpenhorn/pkg/kv"
+)
+
+func TestCoordinatorReplay(t *testing.T) {
+	dbPath, err := ioutil.TempDir("", "alpenhorn_pkg_coordinator_")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dbPath)
+
+	coordinatorPub, _, _ := ed25519.GenerateKey(rand.Reader)
+	serverPub, serverKey, _ := ed25519.GenerateKey(rand.Reader)
+	conf := &Config{
+		DBPath:          dbPath,
+		SigningKey:      serverKey,
+		CoordinatorKey:  coordinatorPub,
+		RegTokenHandler: func(string, string) error { return nil },
+	}
+	srv, err := NewServer(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	post := func(path string, body []byte) (*httptest.ResponseRecorder, ErrorCode) {
+		req := httptest.NewRequest("POST", path, bytes.NewReader(body))
+		req.TLS = &tls.ConnectionState{
+			PeerCertificates: []*x509.Certificate{{PublicKey: coordinatorPub}},
+		}
+		w := httptest.NewRecorder()
+		srv.ServeHTTP(w, req)
+		if w.Code == 200 {
+			return w, -1
+		}
+		var e Error
+		json.Unmarshal(w.Body.Bytes(), &e)
+		return w, e.Code
+	}
+	commit := func(round uint32) ([]byte, ErrorCode) {
+		body, _ := json.Marshal(&commitArgs{Round: round, coordinatorNonce: newCoordinatorNonce(time.Now())})
+		w, code := post("/commit", body)
+		return w.Body.Bytes(), code
+	}
+
+	body, _ := json.Marshal(&commitArgs{Round: 2, coordinatorNonce: newCoordinatorNonce(time.Now())})
+	w, code := post("/commit", body)
+	if code != -1 {
+		t.Fatalf("commit: %s", w.Body)
+	}
+	commitReply := new(commitReply)
+	if err := json.Unmarshal(w.Body.Bytes(), commitReply); err != nil {
+		t.Fatal(err)
+	}
+	if _, code := post("/commit", body); code != ErrReplayedRequest {
+		t.Fatalf("expected ErrReplayedRequest, got %s", code)
+	}
+	if _, code := commit(2); code != ErrOldRound {
+		t.Fatalf("expected ErrOldRound for a repeated round, got %s", code)
+	}
+	if _, code := commit(1); code != ErrOldRound {
+		t.Fatalf("expected ErrOldRound for an earlier round, got %s", code)
+	}
+
+	stale := &commitArgs{Round: 3, coordinatorNonce: newCoordinatorNonce(time.Now())}
+	stale.Time = time.Now().Add(-ReplayWindow).Unix()
+	body, _ = json.Marshal(stale)
+	if _, code := post("/commit", body); code != ErrStaleRequest {
+		t.Fatalf("expected ErrStaleRequest, got %s", code)
+	}
+	body, _ = json.Marshal(&commitArgs{Round: 3, coordinatorNonce: coordinatorNonce{Time: time.Now().Unix()}})
+	if _, code := post("/commit", body); code != ErrBadRequestJSON {
+		t.Fatalf("expected ErrBadRequestJSON without a nonce, got %s", code)
+	}
+
+	reveal := func() ErrorCode {
+		body, _ := json.Marshal(&revealArgs{
+			Round:            2,
+			Commitments:      map[string][]byte{hex.EncodeToString(serverPub): commitReply.Commitment},
+			coordinatorNonce: newCoordinatorNonce(time.Now()),
+		})
+		_, code := post("/reveal", body)
+		return code
+	}
+	if code := reveal(); code != -1 {
+		t.Fatalf("reveal: %s", code)
+	}
+	if code := reveal(); code != ErrOldRound {
+		t.Fatalf("expected ErrOldRound for a repeated reveal, got %s", code)
+	}
+
+	srv.Close()
+	srv, err = NewServer(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+
+	if _, code := commit(2); code != ErrOldRound {
+		t.Fatalf("expected ErrOldRound after restart, got %s", code)
+	}
+	if _, code := commit(3); code != -1 {
+		t.Fatalf("commit after restart: %s", code)
+	}
+
+	stats, err := CollectDBStats(srv.db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.CoordinatorRecords != 1 {
+		t.Fatalf("expected 1 coordinator record, got %d", stats.CoordinatorRecords)
+	}
+}
+
+func TestMultipleCoordinators(t *testing.T) {
+	primary, _, _ := ed25519.GenerateKey(rand.Reader)
+	standby, _, _ := ed25519.GenerateKey(rand.Reader)
+	other, _, _ := ed25519.GenerateKey(rand.Reader)
+	_, serverKey, _ := ed25519.GenerateKey(rand.Reader)
+
+	_, err := NewServer(&Config{
+		DB:              kv.NewMemory(),
+		SigningKey:      serverKey,
+		CoordinatorKey:  primary,
+		CoordinatorKeys: []ed25519.PublicKey{standby[:16]},
+		RegTokenHandler: func(string, string) error { return nil },
+	})
+	if err == nil {
+		t.Fatal("expected error for a short coordinator key")
+	}
+
+	srv, err := NewServer(&Config{
+		DB:              kv.NewMemory(),
+		SigningKey:      serverKey,
+		CoordinatorKey:  primary,
+		CoordinatorKeys: []ed25519.PublicKey{standby, primary},
+		RegTokenHandler: func(string, string) error { return nil },
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+	if n := len(srv.live().coordinatorKeys); n != 2 {
+		t.Fatalf("expected 2 coordinator keys, got %d", n)
+	}
+
+	commit := func(key ed25519.PublicKey, round uint32) int {
+		body, _ := json.Marshal(&commitArgs{Round: round, coordinatorNonce: newCoordinatorNonce(time.Now())})
+		req := httptest.NewRequest("POST", "/commit", bytes.NewReader(body))
+		req.TLS = &tls.ConnectionState{
+			PeerCertificates: []*x509.Certificate{{PublicKey: key}},
+		}
+		w := httptest.NewRecorder()
+		srv.commitHandler(w, req)
+		return w.Code
+	}
+
+	if code := commit(primary, 2); code != http.StatusOK {
+		t.Fatalf("primary commit: %d", code)
+	}
+	// Each coordinator's rounds are tracked separately.
+	if code := commit(standby, 1); code != http.StatusOK {
+		t.Fatalf("standby commit: %d", code)
+	}
+	if code := commit(other, 3); code != http.StatusUnauthorized {
+		t.Fatalf("expected unknown coordinator to be unauthorized, got %d", code)
+	}
+
+	err = srv.Reload(&Settings{
+		CoordinatorKey:   primary,
+		RegistrationMode: RegistrationFCFS,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if code := commit(standby, 3); code != http.StatusUnauthorized {
+		t.Fatalf("removed coordinator still accepted: %d", code)
+	}
+	if code := commit(primary, 3); code != http.StatusOK {
+		t.Fatalf("primary commit after reload: %d", code)
+	}
+}
+
+func TestCoordinatorNetworks(t *testing.T) {
+	coordinatorPub, _, _ := ed25519.GenerateKey(rand.Reader)
+	_, serverKey, _ := ed25519.GenerateKey(rand.Reader)
+	_, network, _ := net.ParseCIDR("10.1.0.0/16")
+	srv, err := NewServer(&Config{
+		DB:                  kv.NewMemory(),
+		SigningKey:          serverKey,
+		CoordinatorKey:      coordinatorPub,
+		CoordinatorNetworks: []*net.IPNet{network},
+		RegTokenHandler:     func(string, string) error { return nil },
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+
+	round := uint32(0)
+	commit := func(remoteAddr string) (int, ErrorCode) {
+		round++
+		body, _ := json.Marshal(&commitArgs{Round: round, coordinatorNonce: newCoordinatorNonce(time.Now())})
+		req := httptest.NewRequest("POST", "/commit", bytes.NewReader(body))
+		req.RemoteAddr = remoteAddr
+		req.TLS = &tls.ConnectionState{
+			PeerCertificates: []*x509.Certificate{{PublicKey: coordinatorPub}},
+		}
+		w := httptest.NewRecorder()
+		srv.ServeHTTP(w, req)
+		var e Error
+		json.Unmarshal(w.Body.Bytes(), &e)
+		return w.Code, e.Code
+	}
+
+	if code, _ := commit("10.1.2.3:4567"); code != http.StatusOK {
+		t.Fatalf("commit from the coordinator network: %d", code)
+	}
+	if code, errCode := commit("192.0.2.1:4567"); code != http.StatusUnauthorized || errCode != ErrUnauthorized {
+		t.Fatalf("expected ErrUnauthorized from outside the network, got %d %s", code, errCode)
+	}
+
+	// The allowlist is removed on reload.
+	err = srv.Reload(&Settings{
+		CoordinatorKey:   coordinatorPub,
+		RegistrationMode: RegistrationFCFS,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if code, _ := commit("192.0.2.1:4567"); code != http.StatusOK {
+		t.Fatalf("commit after removing the allowlist: %d", code)
+	}
+}
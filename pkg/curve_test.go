@@ -0,0 +1,92 @@
+// Copyright 2018 David Lazar. All rights reserved.
+// Use of this source code is governed by the GNU AGPL
+// license that can be found in the LICENSE file.
+
+package pkg_test
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/hex"
+	"testing"
+
+	"vuvuzela.io/alpenhorn/edhttp"
+	"vuvuzela.io/alpenhorn/pairing"
+	"vuvuzela.io/alpenhorn/pkg"
+)
+
+func TestCurveMigration(t *testing.T) {
+	testpkg, coordinatorClient := launchPKG(t, func(username string, token string) error {
+		return nil
+	})
+	defer testpkg.Close()
+
+	alicePub, alicePriv, _ := ed25519.GenerateKey(rand.Reader)
+	client := &pkg.Client{
+		Username:        "alice@example.org",
+		LoginKey:        alicePriv,
+		UserLongTermKey: alicePub,
+		HTTPClient:      new(edhttp.Client),
+	}
+	if err := client.Register(testpkg.PublicServerConfig, ""); err != nil {
+		t.Fatal(err)
+	}
+
+	pkgs := []pkg.PublicServerConfig{testpkg.PublicServerConfig}
+	curves := []string{pairing.BN256, pairing.BLS12381}
+	settings, err := coordinatorClient.NewRoundCurves(pkgs, 7, curves)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !settings.Verify(7, []ed25519.PublicKey{testpkg.Key}) {
+		t.Fatal("failed to verify pkg settings")
+	}
+	reveal := settings[hex.EncodeToString(testpkg.Key)]
+	keys := reveal.Curves[pairing.BLS12381]
+	if keys == nil {
+		t.Fatalf("no %s keys in reveal", pairing.BLS12381)
+	}
+
+	// Both curves are served in the same round.
+	if _, err := client.Extract(testpkg.PublicServerConfig, 7); err != nil {
+		t.Fatal(err)
+	}
+	result, err := client.ExtractCurve(testpkg.PublicServerConfig, 7, pairing.BLS12381)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	curve, _ := pairing.Lookup(pairing.BLS12381)
+	id := pkg.ValidUsernameToIdentity("alice@example.org")
+	ctxt, err := curve.IBEEncrypt(rand.Reader, [][]byte{keys.MasterPublicKey}, id[:], []byte("hi alice"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg, err := curve.IBEDecrypt([][]byte{result.PrivateKey}, ctxt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(msg, []byte("hi alice")) {
+		t.Fatalf("got %q", msg)
+	}
+
+	attestation := pkg.AttestationMessage(keys.BLSPublicKey, id, alicePub)
+	if !curve.BLSVerify([][]byte{keys.BLSPublicKey}, [][]byte{attestation}, result.IdentitySig) {
+		t.Fatal("failed to verify attestation")
+	}
+
+	// Rounds started without the curve do not serve it.
+	if _, err := coordinatorClient.NewRound(pkgs, 8); err != nil {
+		t.Fatal(err)
+	}
+	_, err = client.ExtractCurve(testpkg.PublicServerConfig, 8, pairing.BLS12381)
+	if err.(pkg.Error).Code != pkg.ErrUnknownCurve {
+		t.Fatalf("expected ErrUnknownCurve, got %v", err)
+	}
+
+	_, err = coordinatorClient.NewRoundCurves(pkgs, 9, []string{"p256"})
+	if err == nil {
+		t.Fatal("expected error for unknown curve")
+	}
+}
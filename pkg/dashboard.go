@@ -0,0 +1,251 @@
+// Copyright 2018 David Lazar. All rights reserved.
+// Use of this source code is governed by the GNU AGPL
+// license that can be found in the LICENSE file.
+
+//go:build !js
+// +build !js
+
+package pkg
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"html/template"
+	"net/http"
+	"sync"
+	"time"
+
+	"vuvuzela.io/alpenhorn/pkg/kv"
+)
+
+// The dashboard is a read-only status page for operators: the current
+// round, how many users are registered, the extraction rate, when a
+// coordinator last set up a round, and the server's key. It is served
+// as HTML at / and as JSON at /status.json by DashboardHandler, which,
+// like the metrics, should be served on its own listener and kept off
+// the public internet.
+
+// A DashboardStatus is the server's status as shown on the dashboard.
+type DashboardStatus struct {
+	Time time.Time
+
+	// PublicKey is the hex encoding of the server's signing key, and
+	// KeyFingerprint is its fingerprint as shown in audit events.
+	PublicKey      string
+	KeyFingerprint string
+
+	RegistrationMode RegistrationMode
+
+	// Maintenance is whether the server is in maintenance mode; see
+	// maintenancemode.go.
+	Maintenance bool
+
+	// ReadOnly is whether the server is in read-only mode; see
+	// readonly.go.
+	ReadOnly bool
+
+	// Round is the latest round the coordinator revealed, at
+	// LastReveal, and RoundsHeld is how many rounds' keys the server
+	// holds.
+	Round      uint32
+	LastReveal time.Time
+	RoundsHeld int
+
+	// LastCoordinatorContact is when a coordinator last committed or
+	// revealed a round.
+	LastCoordinatorContact time.Time
+
+	// Users is how many usernames are registered. It is counted at
+	// most once every dashboardCountInterval.
+	Users int
+
+	ExtractionsPerMinute uint64
+
+	Ready bool
+}
+
+// dashboardCountInterval is how long the dashboard reuses its count
+// of registered users, which takes a scan of the database.
+const dashboardCountInterval = time.Minute
+
+type userCount struct {
+	mu      sync.Mutex
+	users   int
+	counted time.Time
+}
+
+// DashboardStatus returns the server's current status.
+func (srv *Server) DashboardStatus() (*DashboardStatus, error) {
+	now := srv.clock.Now()
+	users, err := srv.countUsers(now)
+	if err != nil {
+		return nil, err
+	}
+
+	ready := true
+	for _, c := range srv.Ready() {
+		ready = ready && c.OK
+	}
+
+	srv.mu.Lock()
+	st := &DashboardStatus{
+		Round:                  srv.latestRound,
+		LastReveal:             srv.lastReveal,
+		RoundsHeld:             len(srv.rounds),
+		LastCoordinatorContact: srv.lastCoordinator,
+	}
+	srv.mu.Unlock()
+
+	st.Time = now
+	st.PublicKey = hex.EncodeToString(srv.publicKey)
+	st.KeyFingerprint = KeyFingerprint(srv.publicKey)
+	st.RegistrationMode = srv.live().mode
+	st.Maintenance = srv.Maintenance().Enabled
+	st.ReadOnly = srv.live().readOnly
+	st.Users = users
+	st.ExtractionsPerMinute = srv.extractRate.perMinute(now)
+	st.Ready = ready
+	return st, nil
+}
+
+func (srv *Server) countUsers(now time.Time) (int, error) {
+	c := &srv.userCount
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.counted.IsZero() && now.Sub(c.counted) < dashboardCountInterval {
+		return c.users, nil
+	}
+
+	n := 0
+	err := srv.replica.View(func(tx kv.Txn) error {
+		return tx.Iterate(dbUserPrefix, func(key, _ []byte) error {
+			if bytes.HasSuffix(key, registrationSuffix) {
+				n++
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		return 0, err
+	}
+	c.users = n
+	c.counted = now
+	return n, nil
+}
+
+// DashboardHandler returns a handler for the operator dashboard.
+func (srv *Server) DashboardHandler() http.Handler {
+	return http.HandlerFunc(srv.dashboardHandler)
+}
+
+func (srv *Server) dashboardHandler(w http.ResponseWriter, req *http.Request) {
+	if req.Method != "GET" && req.Method != "HEAD" {
+		w.Header().Set("Allow", "GET, HEAD")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if req.URL.Path != "/" && req.URL.Path != "/status.json" {
+		http.NotFound(w, req)
+		return
+	}
+
+	st, err := srv.DashboardStatus()
+	if err != nil {
+		srv.log.Errorf("Dashboard: %s", err)
+		httpError(w, errorf(ErrDatabaseError, "%s", err))
+		return
+	}
+
+	if req.URL.Path == "/status.json" {
+		bs, err := json.MarshalIndent(st, "", "  ")
+		if err != nil {
+			panic(err)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(bs)
+		return
+	}
+	buf := new(bytes.Buffer)
+	if err := dashboardTemplate.Execute(buf, st); err != nil {
+		panic(err)
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Write(buf.Bytes())
+}
+
+func formatDashboardTime(t time.Time) string {
+	if t.IsZero() {
+		return "never"
+	}
+	return t.UTC().Format(time.RFC3339)
+}
+
+var dashboardTemplate = template.Must(template.New("dashboard").Funcs(template.FuncMap{
+	"time": formatDashboardTime,
+}).Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<meta http-equiv="refresh" content="30">
+<title>Alpenhorn PKG</title>
+<style>
+body { font-family: sans-serif; margin: 2em; }
+th { text-align: left; padding-right: 2em; }
+td { font-family: monospace; }
+.bad { color: #b00; }
+</style>
+</head>
+<body>
+<h1>Alpenhorn PKG</h1>
+<table>
+<tr><th>Status</th><td>{{if .Ready}}ready{{else}}<span class="bad">not ready</span>{{end}}</td></tr>
+<tr><th>Round</th><td>{{.Round}}</td></tr>
+<tr><th>Last reveal</th><td>{{time .LastReveal}}</td></tr>
+<tr><th>Rounds held</th><td>{{.RoundsHeld}}</td></tr>
+<tr><th>Last coordinator contact</th><td>{{time .LastCoordinatorContact}}</td></tr>
+<tr><th>Registered users</th><td>{{.Users}}</td></tr>
+<tr><th>Extractions per minute</th><td>{{.ExtractionsPerMinute}}</td></tr>
+<tr><th>Registration mode</th><td>{{.RegistrationMode}}</td></tr>
+<tr><th>Maintenance mode</th><td>{{.Maintenance}}</td></tr>
+<tr><th>Read-only mode</th><td>{{.ReadOnly}}</td></tr>
+<tr><th>Public key</th><td>{{.PublicKey}}</td></tr>
+<tr><th>Key fingerprint</th><td>{{.KeyFingerprint}}</td></tr>
+</table>
+<p>As of {{time .Time}}. <a href="status.json">JSON</a></p>
+</body>
+</html>
+`))
+
+// eventRate counts events in one-second buckets over the last minute.
+type eventRate struct {
+	mu      sync.Mutex
+	counts  [60]uint64
+	seconds [60]int64
+}
+
+func (r *eventRate) add(now time.Time) {
+	s := now.Unix()
+	i := s % 60
+	r.mu.Lock()
+	if r.seconds[i] != s {
+		r.seconds[i] = s
+		r.counts[i] = 0
+	}
+	r.counts[i]++
+	r.mu.Unlock()
+}
+
+// perMinute returns the number of events in the minute before now.
+func (r *eventRate) perMinute(now time.Time) uint64 {
+	s := now.Unix()
+	var n uint64
+	r.mu.Lock()
+	for i := range r.counts {
+		if age := s - r.seconds[i]; age >= 0 && age < 60 {
+			n += r.counts[i]
+		}
+	}
+	r.mu.Unlock()
+	return n
+}
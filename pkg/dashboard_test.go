@@ -0,0 +1,104 @@
+// Copyright 2018 David Lazar. All rights reserved.
+// Use of this source code is governed by the GNU AGPL
+// license that can be found in the LICENSE file.
+
+package pkg
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"vuvuzela.io/alpenhorn/clock"
+	"vuvuzela.io/alpenhorn/pkg/kv"
+)
+
+func TestDashboard(t *testing.T) {
+	mockClock := clock.NewMock(time.Now())
+	coordinatorPub, _, _ := ed25519.GenerateKey(rand.Reader)
+	serverPub, serverKey, _ := ed25519.GenerateKey(rand.Reader)
+	srv, err := NewServer(&Config{
+		DB:               kv.NewMemory(),
+		SigningKey:       serverKey,
+		CoordinatorKey:   coordinatorPub,
+		RegistrationMode: RegistrationFCFS,
+		Clock:            mockClock,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+
+	for _, username := range []string{"alice@example.org", "bob@example.org"} {
+		loginKey, _, _ := ed25519.GenerateKey(rand.Reader)
+		if _, err := srv.register(&registerArgs{Username: username, LoginKey: loginKey}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	body, _ := json.Marshal(&commitArgs{Round: 3, coordinatorNonce: newCoordinatorNonce(time.Now())})
+	req := httptest.NewRequest("POST", "/commit", bytes.NewReader(body))
+	req.TLS = &tls.ConnectionState{
+		PeerCertificates: []*x509.Certificate{{PublicKey: coordinatorPub}},
+	}
+	w := httptest.NewRecorder()
+	srv.commitHandler(w, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("commit: %d %s", w.Code, w.Body)
+	}
+	for i := 0; i < 5; i++ {
+		srv.extractRate.add(mockClock.Now())
+	}
+
+	get := func(path string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		srv.DashboardHandler().ServeHTTP(w, httptest.NewRequest("GET", path, nil))
+		return w
+	}
+
+	w = get("/status.json")
+	if w.Code != http.StatusOK {
+		t.Fatalf("status.json: %d %s", w.Code, w.Body)
+	}
+	var st DashboardStatus
+	if err := json.Unmarshal(w.Body.Bytes(), &st); err != nil {
+		t.Fatal(err)
+	}
+	if st.Users != 2 {
+		t.Fatalf("expected 2 users, got %d", st.Users)
+	}
+	if st.ExtractionsPerMinute != 5 {
+		t.Fatalf("expected 5 extractions per minute, got %d", st.ExtractionsPerMinute)
+	}
+	if st.PublicKey != hex.EncodeToString(serverPub) || st.KeyFingerprint != KeyFingerprint(serverPub) {
+		t.Fatalf("unexpected key: %+v", st)
+	}
+	if !st.LastCoordinatorContact.Equal(mockClock.Now()) || st.RoundsHeld != 1 {
+		t.Fatalf("commit not shown: %+v", st)
+	}
+	if st.Ready {
+		t.Fatal("ready before any round was revealed")
+	}
+
+	w = get("/")
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), st.KeyFingerprint) {
+		t.Fatalf("dashboard page: %d %s", w.Code, w.Body)
+	}
+	if w := get("/admin/audit"); w.Code != http.StatusNotFound {
+		t.Fatalf("expected 404 for another path, got %d", w.Code)
+	}
+
+	// The extraction rate covers the last minute.
+	mockClock.Add(61 * time.Second)
+	if n := srv.extractRate.perMinute(mockClock.Now()); n != 0 {
+		t.Fatalf("expected no recent extractions, got %d", n)
+	}
+}
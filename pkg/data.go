@@ -2,6 +2,9 @@
 // Use of this source code is governed by the GNU AGPL
 // license that can be found in the LICENSE file.
 
+//go:build !js
+// +build !js
+
 package pkg
 
 import (
@@ -10,9 +13,8 @@ import (
 	"encoding/json"
 	"time"
 
-	"github.com/dgraph-io/badger"
-
 	"vuvuzela.io/alpenhorn/errors"
+	"vuvuzela.io/alpenhorn/pkg/kv"
 )
 
 var (
@@ -20,6 +22,10 @@ var (
 	registrationSuffix   = []byte(":registration")
 	lastExtractionSuffix = []byte(":lastextract")
 	userLogSuffix        = []byte(":log")
+	loginRotationSuffix  = []byte(":loginrotation")
+	pqKeySuffix          = []byte(":pqkey")
+	renamedSuffix        = []byte(":renamed")
+	recoveryKeySuffix    = []byte(":recoverykey")
 )
 
 func dbUserKey(identity *[64]byte, suffix []byte) []byte {
@@ -28,15 +34,62 @@ func dbUserKey(identity *[64]byte, suffix []byte) []byte {
 
 type userState struct {
 	LoginKey ed25519.PublicKey
+
+	// Revoked is set after the user revokes their login key with
+	// their recovery key. LoginKey is then the replacement key, which
+	// is bound once the user verifies their username again.
+	Revoked bool
+
+	// OldLoginKey is the login key that LoginKey replaced in an
+	// in-place rotation. It keeps working until OldKeyExpires, in Unix
+	// seconds, so the user's other devices can catch up.
+	OldLoginKey   ed25519.PublicKey
+	OldKeyExpires int64
+
+	// DeviceKeys are the login keys of the user's other devices. Any
+	// of them can sign the user's requests, as LoginKey does.
+	DeviceKeys []ed25519.PublicKey
 }
 
 const userStateBinaryVersion byte = 1
 
+// The optional flags byte that follows the login key. Older servers
+// ignore it and anything after it.
+const (
+	userRevoked byte = 1 << iota
+	userOldLoginKey
+	userDeviceKeys
+)
+
 func (u userState) Marshal() []byte {
-	data := make([]byte, 1+ed25519.PublicKeySize)
+	data := make([]byte, 1+ed25519.PublicKeySize, 1+ed25519.PublicKeySize+1+ed25519.PublicKeySize+8)
 	data[0] = userStateBinaryVersion
 	copy(data[1:], u.LoginKey)
 
+	var flags byte
+	if u.Revoked {
+		flags |= userRevoked
+	}
+	if u.OldLoginKey != nil {
+		flags |= userOldLoginKey
+	}
+	if len(u.DeviceKeys) > 0 {
+		flags |= userDeviceKeys
+	}
+	if flags == 0 {
+		return data
+	}
+	data = append(data, flags)
+	if u.OldLoginKey != nil {
+		data = append(data, u.OldLoginKey...)
+		data = binary.BigEndian.AppendUint64(data, uint64(u.OldKeyExpires))
+	}
+	if len(u.DeviceKeys) > 0 {
+		data = append(data, byte(len(u.DeviceKeys)))
+		for _, key := range u.DeviceKeys {
+			data = append(data, key...)
+		}
+	}
 	return data
 }
 
@@ -49,10 +102,75 @@ func (u *userState) Unmarshal(data []byte) error {
 	}
 	u.LoginKey = make(ed25519.PublicKey, ed25519.PublicKeySize)
 	copy(u.LoginKey, data[1:])
+	if len(data) == 33 {
+		return nil
+	}
+
+	flags := data[33]
+	rest := data[34:]
+	u.Revoked = flags&userRevoked != 0
+	if flags&userOldLoginKey != 0 {
+		if len(rest) < ed25519.PublicKeySize+8 {
+			return errors.New("short old login key: got %d bytes", len(rest))
+		}
+		u.OldLoginKey = append(ed25519.PublicKey(nil), rest[:ed25519.PublicKeySize]...)
+		u.OldKeyExpires = int64(binary.BigEndian.Uint64(rest[ed25519.PublicKeySize:]))
+		rest = rest[ed25519.PublicKeySize+8:]
+	}
+	if flags&userDeviceKeys != 0 {
+		if len(rest) < 1 {
+			return errors.New("missing device key count")
+		}
+		n := int(rest[0])
+		rest = rest[1:]
+		if len(rest) < n*ed25519.PublicKeySize {
+			return errors.New("short device keys: got %d bytes for %d keys", len(rest), n)
+		}
+		u.DeviceKeys = make([]ed25519.PublicKey, n)
+		for i := range u.DeviceKeys {
+			u.DeviceKeys[i] = append(ed25519.PublicKey(nil), rest[:ed25519.PublicKeySize]...)
+			rest = rest[ed25519.PublicKeySize:]
+		}
+	}
+	if len(rest) != 0 {
+		return errors.New("%d trailing bytes", len(rest))
+	}
 
 	return nil
 }
 
+// verifyLogin reports whether sig is the signature of msg by the
+// user's login key, one of their device keys, or their old login key
+// while it is still in its grace window. Requests that change the
+// account, such as rotating the login key or deleting the account,
+// need the current login key.
+func (u userState) verifyLogin(now time.Time, msg, sig []byte) bool {
+	if u.verifyDevice(msg, sig) {
+		return true
+	}
+	return u.OldLoginKey != nil && now.Unix() < u.OldKeyExpires && ed25519.Verify(u.OldLoginKey, msg, sig)
+}
+
+// verifyDevice reports whether sig is the signature of msg by the
+// user's login key or one of their device keys.
+func (u userState) verifyDevice(msg, sig []byte) bool {
+	return u.deviceSigner(msg, sig) != nil
+}
+
+// deviceSigner returns the key, the user's login key or one of their
+// device keys, that made sig on msg, or nil if none did.
+func (u userState) deviceSigner(msg, sig []byte) ed25519.PublicKey {
+	if ed25519.Verify(u.LoginKey, msg, sig) {
+		return u.LoginKey
+	}
+	for _, key := range u.DeviceKeys {
+		if ed25519.Verify(key, msg, sig) {
+			return key
+		}
+	}
+	return nil
+}
+
 type lastExtraction struct {
 	Round    uint32
 	UnixTime int64
@@ -93,12 +211,20 @@ type UserEventType int
 
 const (
 	EventRegistered UserEventType = iota + 1
+	EventLoginKeyChanged
+	EventRenamed
+	EventLoginKeyRevoked
+	EventDeviceEnrolled
+	EventDeviceRevoked
 )
 
 type UserEvent struct {
 	Time     time.Time
 	Type     UserEventType
 	LoginKey ed25519.PublicKey
+
+	// OldUsername is set on EventRenamed.
+	OldUsername string `json:",omitempty"`
 }
 
 func (e UserEventLog) Marshal() []byte {
@@ -119,26 +245,20 @@ func (e *UserEventLog) Unmarshal(data []byte) error {
 	return json.Unmarshal(data[1:], e)
 }
 
-func appendLog(tx *badger.Txn, identity *[64]byte, event UserEvent) error {
+func appendLog(tx kv.Txn, identity *[64]byte, event UserEvent) error {
 	logKey := dbUserKey(identity, userLogSuffix)
-	item, err := tx.Get(logKey)
+	data, err := tx.Get(logKey)
 	var currLog UserEventLog
-	if err == badger.ErrKeyNotFound {
+	if err == kv.ErrNotFound {
 		currLog = nil
 	} else if err != nil {
 		return errorf(ErrDatabaseError, "%s", err)
-	} else {
-		err := item.Value(func(data []byte) error {
-			return json.Unmarshal(data, currLog)
-		})
-		if err != nil {
-			return errorf(ErrDatabaseError, "%s", err)
-		}
+	} else if err := currLog.Unmarshal(data); err != nil {
+		return errorf(ErrDatabaseError, "%s", err)
 	}
 
 	currLog = append(currLog, event)
-	data := currLog.Marshal()
-	if err := tx.Set(logKey, data); err != nil {
+	if err := tx.Set(logKey, currLog.Marshal()); err != nil {
 		return errorf(ErrDatabaseError, "%s", err)
 	}
 	return nil
@@ -146,15 +266,12 @@ func appendLog(tx *badger.Txn, identity *[64]byte, event UserEvent) error {
 
 func (srv *Server) GetUserLog(identity *[64]byte) (UserEventLog, error) {
 	var log UserEventLog
-	err := srv.db.View(func(tx *badger.Txn) error {
-		item, err := tx.Get(dbUserKey(identity, userLogSuffix))
+	err := srv.db.View(func(tx kv.Txn) error {
+		data, err := tx.Get(dbUserKey(identity, userLogSuffix))
 		if err != nil {
 			return err
 		}
-		err = item.Value(func(data []byte) error {
-			return log.Unmarshal(data)
-		})
-		return err
+		return log.Unmarshal(data)
 	})
 	return log, err
 }
@@ -29,6 +29,43 @@ func TestMarshalUserState(t *testing.T) {
 	}
 }
 
+func TestMarshalUserStateKeys(t *testing.T) {
+	loginKey, loginPriv, _ := ed25519.GenerateKey(rand.Reader)
+	oldKey, oldPriv, _ := ed25519.GenerateKey(rand.Reader)
+	deviceKey, devicePriv, _ := ed25519.GenerateKey(rand.Reader)
+	now := time.Now()
+	user := userState{
+		LoginKey:      loginKey,
+		OldLoginKey:   oldKey,
+		OldKeyExpires: now.Add(time.Hour).Unix(),
+		DeviceKeys:    []ed25519.PublicKey{deviceKey},
+	}
+	var user2 userState
+	if err := user2.Unmarshal(user.Marshal()); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(user, user2) {
+		t.Fatalf("got %#v, want %#v", user2, user)
+	}
+
+	msg := []byte("hello")
+	if !user.verifyLogin(now, msg, ed25519.Sign(loginPriv, msg)) {
+		t.Fatal("login key rejected")
+	}
+	if !user.verifyLogin(now, msg, ed25519.Sign(oldPriv, msg)) {
+		t.Fatal("old login key rejected in its grace window")
+	}
+	if user.verifyLogin(now.Add(2*time.Hour), msg, ed25519.Sign(oldPriv, msg)) {
+		t.Fatal("old login key accepted after its grace window")
+	}
+	if !user.verifyLogin(now.Add(2*time.Hour), msg, ed25519.Sign(devicePriv, msg)) {
+		t.Fatal("device key rejected")
+	}
+	if user.verifyDevice(msg, ed25519.Sign(oldPriv, msg)) {
+		t.Fatal("old login key accepted as a device key")
+	}
+}
+
 func TestMarshalLastExtraction(t *testing.T) {
 	e := lastExtraction{
 		Round:    12345,
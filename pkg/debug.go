@@ -0,0 +1,205 @@
+// Copyright 2018 David Lazar. All rights reserved.
+// Use of this source code is governed by the GNU AGPL
+// license that can be found in the LICENSE file.
+
+//go:build !js
+// +build !js
+
+package pkg
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"runtime"
+	"runtime/debug"
+	"runtime/pprof"
+	"runtime/trace"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The admin API serves the runtime's profiles, so an operator can
+// profile a PKG under load without exposing them to its users:
+//
+//	/admin/debug/pprof/           lists the profiles
+//	/admin/debug/pprof/profile    CPU profile for ?seconds (default 30)
+//	/admin/debug/pprof/trace      execution trace for ?seconds (default 1)
+//	/admin/debug/pprof/NAME       the named profile, such as heap, with
+//	                              ?debug=N for text and ?gc=1 to collect
+//	                              garbage first
+//	/admin/debug/goroutines       every goroutine's stack, as text
+//	/admin/debug/gcstats          memory and garbage collector stats
+//
+// The profiles are in the format "go tool pprof" reads. They are
+// written with runtime/pprof rather than net/http/pprof, which would
+// also register them on http.DefaultServeMux, where programs that
+// serve it, such as the coordinator, would make them public.
+
+// maxProfileSeconds caps how long CPU profiles and traces run.
+const maxProfileSeconds = 60
+
+func (srv *Server) debugHandler(w http.ResponseWriter, req *http.Request) {
+	switch path := req.URL.Path; {
+	case path == "/admin/debug/goroutines":
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		pprof.Lookup("goroutine").WriteTo(w, 2)
+	case path == "/admin/debug/gcstats":
+		gcStatsHandler(w, req)
+	case path == "/admin/debug/pprof/":
+		profileIndexHandler(w, req)
+	case path == "/admin/debug/pprof/profile":
+		cpuProfileHandler(w, req)
+	case path == "/admin/debug/pprof/trace":
+		traceHandler(w, req)
+	case strings.HasPrefix(path, "/admin/debug/pprof/"):
+		profileHandler(w, req, strings.TrimPrefix(path, "/admin/debug/pprof/"))
+	default:
+		http.NotFound(w, req)
+	}
+}
+
+func profileIndexHandler(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	fmt.Fprintf(w, "profile\ntrace\n")
+	for _, p := range pprof.Profiles() {
+		fmt.Fprintf(w, "%s\t%d\n", p.Name(), p.Count())
+	}
+}
+
+func profileHandler(w http.ResponseWriter, req *http.Request, name string) {
+	p := pprof.Lookup(name)
+	if p == nil {
+		http.NotFound(w, req)
+		return
+	}
+	debugLevel, _ := strconv.Atoi(req.FormValue("debug"))
+	if name == "heap" && req.FormValue("gc") != "" {
+		runtime.GC()
+	}
+	if debugLevel == 0 {
+		w.Header().Set("Content-Type", "application/octet-stream")
+		w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", name))
+	} else {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	}
+	p.WriteTo(w, debugLevel)
+}
+
+// profileDuration returns the duration in the seconds query parameter.
+func profileDuration(req *http.Request, def int) (time.Duration, error) {
+	sec := def
+	if s := req.FormValue("seconds"); s != "" {
+		var err error
+		sec, err = strconv.Atoi(s)
+		if err != nil || sec <= 0 || sec > maxProfileSeconds {
+			return 0, errorf(ErrBadRequestJSON, "seconds must be between 1 and %d", maxProfileSeconds)
+		}
+	}
+	return time.Duration(sec) * time.Second, nil
+}
+
+// sleepRequest waits for d or until req is canceled.
+func sleepRequest(req *http.Request, d time.Duration) {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+	case <-req.Context().Done():
+	}
+}
+
+func cpuProfileHandler(w http.ResponseWriter, req *http.Request) {
+	d, err := profileDuration(req, 30)
+	if err != nil {
+		httpError(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Disposition", `attachment; filename="profile"`)
+	if err := pprof.StartCPUProfile(w); err != nil {
+		// Another CPU profile is running.
+		w.Header().Del("Content-Disposition")
+		httpError(w, errorf(ErrServerBusy, "%s", err))
+		return
+	}
+	sleepRequest(req, d)
+	pprof.StopCPUProfile()
+}
+
+func traceHandler(w http.ResponseWriter, req *http.Request) {
+	d, err := profileDuration(req, 1)
+	if err != nil {
+		httpError(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Disposition", `attachment; filename="trace"`)
+	if err := trace.Start(w); err != nil {
+		w.Header().Del("Content-Disposition")
+		httpError(w, errorf(ErrServerBusy, "%s", err))
+		return
+	}
+	sleepRequest(req, d)
+	trace.Stop()
+}
+
+// GCStats is the reply of /admin/debug/gcstats.
+type GCStats struct {
+	Goroutines int
+
+	HeapAlloc    uint64
+	HeapInuse    uint64
+	HeapObjects  uint64
+	HeapSys      uint64
+	StackInuse   uint64
+	Sys          uint64
+	TotalAlloc   uint64
+	NextGC       uint64
+	GCCPUPercent float64
+
+	NumGC      int64
+	LastGC     time.Time
+	PauseTotal time.Duration
+
+	// Pauses are the most recent GC pauses, latest first.
+	Pauses []time.Duration
+}
+
+// maxGCPauses is how many recent GC pauses GCStats lists.
+const maxGCPauses = 32
+
+func gcStatsHandler(w http.ResponseWriter, req *http.Request) {
+	var m runtime.MemStats
+	runtime.ReadMemStats(&m)
+	var gc debug.GCStats
+	debug.ReadGCStats(&gc)
+	if len(gc.Pause) > maxGCPauses {
+		gc.Pause = gc.Pause[:maxGCPauses]
+	}
+	stats := &GCStats{
+		Goroutines: runtime.NumGoroutine(),
+
+		HeapAlloc:    m.HeapAlloc,
+		HeapInuse:    m.HeapInuse,
+		HeapObjects:  m.HeapObjects,
+		HeapSys:      m.HeapSys,
+		StackInuse:   m.StackInuse,
+		Sys:          m.Sys,
+		TotalAlloc:   m.TotalAlloc,
+		NextGC:       m.NextGC,
+		GCCPUPercent: m.GCCPUFraction * 100,
+
+		NumGC:      gc.NumGC,
+		LastGC:     gc.LastGC,
+		PauseTotal: gc.PauseTotal,
+		Pauses:     gc.Pause,
+	}
+	bs, err := json.Marshal(stats)
+	if err != nil {
+		panic(err)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(bs)
+}
@@ -0,0 +1,87 @@
+// Copyright 2018 David Lazar. All rights reserved.
+// Use of this source code is governed by the GNU AGPL
+// license that can be found in the LICENSE file.
+
+package pkg
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"vuvuzela.io/alpenhorn/pkg/kv"
+)
+
+func TestDebugHandlers(t *testing.T) {
+	adminPub, _, _ := ed25519.GenerateKey(rand.Reader)
+	otherPub, _, _ := ed25519.GenerateKey(rand.Reader)
+	_, serverKey, _ := ed25519.GenerateKey(rand.Reader)
+	srv, err := NewServer(&Config{
+		DB:               kv.NewMemory(),
+		SigningKey:       serverKey,
+		RegistrationMode: RegistrationFCFS,
+		AdminKey:         adminPub,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+
+	get := func(key ed25519.PublicKey, path string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", path, nil)
+		req.TLS = &tls.ConnectionState{
+			PeerCertificates: []*x509.Certificate{{PublicKey: key}},
+		}
+		w := httptest.NewRecorder()
+		srv.AdminHandler().ServeHTTP(w, req)
+		return w
+	}
+
+	if w := get(otherPub, "/admin/debug/goroutines"); w.Code == http.StatusOK {
+		t.Fatal("goroutine dump served without the admin key")
+	}
+	// The profiles are not on the public API.
+	w := httptest.NewRecorder()
+	srv.ServeHTTP(w, httptest.NewRequest("GET", "/admin/debug/pprof/heap", nil))
+	if w.Code == http.StatusOK {
+		t.Fatal("heap profile served on the public API")
+	}
+
+	w = get(adminPub, "/admin/debug/goroutines")
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), "goroutine ") {
+		t.Fatalf("goroutines: %d %.100s", w.Code, w.Body)
+	}
+	w = get(adminPub, "/admin/debug/pprof/")
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), "heap") {
+		t.Fatalf("index: %d %s", w.Code, w.Body)
+	}
+	w = get(adminPub, "/admin/debug/pprof/heap?gc=1")
+	if w.Code != http.StatusOK || w.Body.Len() == 0 {
+		t.Fatalf("heap: %d", w.Code)
+	}
+	if w := get(adminPub, "/admin/debug/pprof/nope"); w.Code != http.StatusNotFound {
+		t.Fatalf("unknown profile: %d", w.Code)
+	}
+	if w := get(adminPub, "/admin/debug/pprof/profile?seconds=600"); w.Code == http.StatusOK {
+		t.Fatal("CPU profile longer than the limit")
+	}
+	w = get(adminPub, "/admin/debug/pprof/profile?seconds=1")
+	if w.Code != http.StatusOK || w.Body.Len() == 0 {
+		t.Fatalf("CPU profile: %d %s", w.Code, w.Body)
+	}
+
+	w = get(adminPub, "/admin/debug/gcstats")
+	var stats GCStats
+	if err := json.Unmarshal(w.Body.Bytes(), &stats); err != nil {
+		t.Fatal(err)
+	}
+	if stats.Goroutines == 0 || stats.HeapAlloc == 0 || stats.NumGC == 0 {
+		t.Fatalf("unexpected stats: %+v", stats)
+	}
+}
@@ -0,0 +1,201 @@
+// Copyright 2018 David Lazar. All rights reserved.
+// Use of this source code is governed by the GNU AGPL
+// license that can be found in the LICENSE file.
+
+//go:build !js
+// +build !js
+
+package pkg
+
+import (
+	"crypto/ed25519"
+	"encoding/json"
+	"net/http"
+
+	"vuvuzela.io/alpenhorn/internal/fault"
+	"vuvuzela.io/alpenhorn/internal/keysafe"
+	"vuvuzela.io/alpenhorn/log"
+)
+
+// DefaultMaxLoginKeys is the most login keys a user can have, counting
+// the login key and their device keys, if Config.MaxLoginKeys is zero.
+const DefaultMaxLoginKeys = 8
+
+// maxLoginKeys bounds Config.MaxLoginKeys: the user record counts
+// device keys in a byte.
+const maxLoginKeys = 256
+
+func (srv *Server) deviceKeyHandler(w http.ResponseWriter, req *http.Request) {
+	body := http.MaxBytesReader(w, req.Body, 1024)
+	args := new(deviceKeyArgs)
+	err := json.NewDecoder(body).Decode(args)
+	if err != nil {
+		httpError(w, errorf(ErrBadRequestJSON, "%s", err))
+		return
+	}
+	if !srv.limitUsername(w, args.Username) {
+		return
+	}
+	args.ServerSigningKey = srv.publicKey
+
+	logger := srv.log.WithFields(log.Fields{"username": args.Username, "op": args.Op})
+	err = srv.deviceKey(args)
+	srv.audit(&AuditEvent{
+		Type:     AuditDevice,
+		Username: args.Username,
+		Key:      KeyFingerprint(args.DeviceKey),
+		Detail:   args.Op,
+		Result:   result(err),
+		RemoteIP: remoteIP(req),
+	})
+	if err != nil {
+		logger = logger.WithFields(log.Fields{"code": errorCode(err).String()})
+		if isInternalError(err) {
+			logger.Errorf("Device key change failed: %s", err)
+		} else {
+			logger.Infof("Device key change failed: %s", err)
+		}
+		httpError(w, err)
+		return
+	}
+	logger.Info("Device key change")
+
+	w.Write([]byte("\"OK\""))
+}
+
+func (srv *Server) deviceKey(args *deviceKeyArgs) error {
+	if len(args.DeviceKey) != ed25519.PublicKeySize {
+		return errorf(ErrInvalidLoginKey, "got %d bytes, want %d bytes", len(args.DeviceKey), ed25519.PublicKeySize)
+	}
+	now := srv.clock.Now()
+	if err := checkFresh(args.Time, now); err != nil {
+		return err
+	}
+
+	if err := fault.Inject(fault.PKGDB); err != nil {
+		return errorf(ErrDatabaseError, "%s", err)
+	}
+
+	// Login key changes hold regLogMu, so holding it too keeps them
+	// from racing with this change to the user record.
+	srv.regLogMu.Lock()
+	defer srv.regLogMu.Unlock()
+	tx, err := srv.db.NewTransaction(true)
+	if err != nil {
+		return errorf(ErrDatabaseError, "%s", err)
+	}
+	defer tx.Discard()
+
+	user, id, err := srv.getUser(tx, args.Username)
+	if err != nil {
+		return err
+	}
+	if !srv.verifyBound(&args.ServerSigningKey, func() bool {
+		return user.verifyDevice(args.msg(), args.Signature)
+	}) {
+		return errorf(ErrInvalidSignature, "")
+	}
+
+	enrolled := -1
+	for i, key := range user.DeviceKeys {
+		if keysafe.Equal(key, args.DeviceKey) {
+			enrolled = i
+		}
+	}
+
+	var event UserEventType
+	switch args.Op {
+	case DeviceEnroll:
+		if enrolled >= 0 || keysafe.Equal(user.LoginKey, args.DeviceKey) {
+			return errorf(ErrInvalidLoginKey, "key is already enrolled")
+		}
+		if !ed25519.Verify(args.DeviceKey, args.msg(), args.DeviceSignature) {
+			return errorf(ErrInvalidSignature, "device key")
+		}
+		if 1+len(user.DeviceKeys) >= srv.maxLoginKeys {
+			return errorf(ErrTooManyDevices, "limit is %d login keys", srv.maxLoginKeys)
+		}
+		user.DeviceKeys = append(user.DeviceKeys, args.DeviceKey)
+		event = EventDeviceEnrolled
+
+	case DeviceRevoke:
+		if enrolled < 0 {
+			return errorf(ErrNoDeviceKey, "")
+		}
+		user.DeviceKeys = append(user.DeviceKeys[:enrolled:enrolled], user.DeviceKeys[enrolled+1:]...)
+		event = EventDeviceRevoked
+
+	default:
+		return errorf(ErrBadRequestJSON, "unknown device key op: %q", args.Op)
+	}
+
+	if err := checkReplay(tx, "devicekey", args.Signature, now); err != nil {
+		return err
+	}
+	if err := tx.Set(dbUserKey(id, registrationSuffix), user.Marshal()); err != nil {
+		return errorf(ErrDatabaseError, "%s", err)
+	}
+	err = appendLog(tx, id, UserEvent{
+		Time:     now,
+		Type:     event,
+		LoginKey: args.DeviceKey,
+	})
+	if err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return errorf(ErrDatabaseError, "%s", err)
+	}
+	return nil
+}
+
+func (srv *Server) deviceKeysHandler(w http.ResponseWriter, req *http.Request) {
+	body := http.MaxBytesReader(w, req.Body, 512)
+	args := new(deviceKeysArgs)
+	err := json.NewDecoder(body).Decode(args)
+	if err != nil {
+		httpError(w, errorf(ErrBadRequestJSON, "%s", err))
+		return
+	}
+	if !srv.limitUsername(w, args.Username) {
+		return
+	}
+	args.ServerSigningKey = srv.publicKey
+
+	reply, err := srv.deviceKeys(args)
+	if err != nil {
+		if isInternalError(err) {
+			srv.log.WithFields(log.Fields{
+				"username": args.Username,
+				"code":     errorCode(err).String(),
+			}).Errorf("Listing device keys failed: %s", err)
+		}
+		httpError(w, err)
+		return
+	}
+
+	bs, err := json.Marshal(reply)
+	if err != nil {
+		panic(err)
+	}
+	w.Write(bs)
+}
+
+func (srv *Server) deviceKeys(args *deviceKeysArgs) (*deviceKeysReply, error) {
+	if err := checkFresh(args.Time, srv.clock.Now()); err != nil {
+		return nil, err
+	}
+	user, _, err := srv.getUser(nil, args.Username)
+	if err != nil {
+		return nil, err
+	}
+	if !srv.verifyBound(&args.ServerSigningKey, func() bool {
+		return user.verifyDevice(args.msg(), args.Signature)
+	}) {
+		return nil, errorf(ErrInvalidSignature, "")
+	}
+	return &deviceKeysReply{
+		LoginKey:   user.LoginKey,
+		DeviceKeys: user.DeviceKeys,
+	}, nil
+}
@@ -0,0 +1,106 @@
+// Copyright 2018 David Lazar. All rights reserved.
+// Use of this source code is governed by the GNU AGPL
+// license that can be found in the LICENSE file.
+
+package pkg_test
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"testing"
+
+	"vuvuzela.io/alpenhorn/edhttp"
+	"vuvuzela.io/alpenhorn/pkg"
+)
+
+func TestDeviceKeys(t *testing.T) {
+	testpkg, coordinatorClient := launchPKG(t, func(username string, token string) error {
+		return nil
+	})
+	defer testpkg.Close()
+
+	alicePub, laptopKey, _ := ed25519.GenerateKey(rand.Reader)
+	phonePub, phoneKey, _ := ed25519.GenerateKey(rand.Reader)
+	laptop := &pkg.Client{
+		Username:        "alice@example.org",
+		LoginKey:        laptopKey,
+		UserLongTermKey: alicePub,
+		HTTPClient:      new(edhttp.Client),
+	}
+	phone := *laptop
+	phone.LoginKey = phoneKey
+	server := testpkg.PublicServerConfig
+	if err := laptop.Register(server, ""); err != nil {
+		t.Fatal(err)
+	}
+
+	err := phone.CheckStatus(server)
+	if err.(pkg.Error).Code != pkg.ErrInvalidSignature {
+		t.Fatalf("expected ErrInvalidSignature before enrolling, got %v", err)
+	}
+	// A device cannot enroll itself.
+	err = phone.EnrollDevice(server, phoneKey)
+	if err.(pkg.Error).Code != pkg.ErrInvalidSignature {
+		t.Fatalf("expected ErrInvalidSignature, got %v", err)
+	}
+
+	if err := laptop.EnrollDevice(server, phoneKey); err != nil {
+		t.Fatal(err)
+	}
+	err = laptop.EnrollDevice(server, phoneKey)
+	if err.(pkg.Error).Code != pkg.ErrInvalidLoginKey {
+		t.Fatalf("expected ErrInvalidLoginKey enrolling twice, got %v", err)
+	}
+
+	_, err = coordinatorClient.NewRound([]pkg.PublicServerConfig{server}, 42)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := phone.Extract(server, 42); err != nil {
+		t.Fatalf("extract with device key: %s", err)
+	}
+	if _, err := laptop.Extract(server, 42); err != nil {
+		t.Fatalf("extract with login key: %s", err)
+	}
+
+	loginKey, deviceKeys, err := phone.DeviceKeys(server)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !loginKey.Equal(laptopKey.Public()) || len(deviceKeys) != 1 || !deviceKeys[0].Equal(phonePub) {
+		t.Fatalf("unexpected keys: %x %x", loginKey, deviceKeys)
+	}
+
+	// Enrolled devices can enroll more, up to the limit.
+	for i := 2; i < pkg.DefaultMaxLoginKeys; i++ {
+		_, key, _ := ed25519.GenerateKey(rand.Reader)
+		if err := phone.EnrollDevice(server, key); err != nil {
+			t.Fatal(err)
+		}
+	}
+	_, extraKey, _ := ed25519.GenerateKey(rand.Reader)
+	err = phone.EnrollDevice(server, extraKey)
+	if err.(pkg.Error).Code != pkg.ErrTooManyDevices {
+		t.Fatalf("expected ErrTooManyDevices, got %v", err)
+	}
+
+	if err := laptop.RevokeDevice(server, phonePub); err != nil {
+		t.Fatal(err)
+	}
+	if err := phone.CheckStatus(server); err == nil {
+		t.Fatal("revoked device key still works")
+	}
+	err = laptop.RevokeDevice(server, phonePub)
+	if err.(pkg.Error).Code != pkg.ErrNoDeviceKey {
+		t.Fatalf("expected ErrNoDeviceKey, got %v", err)
+	}
+
+	log, err := testpkg.PKGServer.GetUserLog(pkg.ValidUsernameToIdentity("alice@example.org"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	last := log[len(log)-1]
+	if last.Type != pkg.EventDeviceRevoked || !last.LoginKey.Equal(phonePub) {
+		t.Fatalf("unexpected user log entry: %#v", last)
+	}
+}
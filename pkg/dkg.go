@@ -0,0 +1,322 @@
+// Copyright 2018 David Lazar. All rights reserved.
+// Use of this source code is governed by the GNU AGPL
+// license that can be found in the LICENSE file.
+
+package pkg
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"encoding/binary"
+	"encoding/hex"
+	"sort"
+
+	"vuvuzela.io/alpenhorn/errors"
+	"vuvuzela.io/alpenhorn/pairing"
+)
+
+// On curves that are a pairing.ThresholdCurve, the PKGs can generate a
+// round's master key jointly, so that any Threshold of them can serve
+// the round. The coordinator runs a Feldman DKG between the commit and
+// the reveal:
+//
+//  1. The commit lists the participants, the PKGs in the order of the
+//     config, and the threshold. Each PKG replies with a signed X25519
+//     box key for the round.
+//  2. /dkg/deal sends each PKG every participant's box key. The PKG
+//     deals shares of its master private key from the commit, boxed
+//     to each participant, and signs the deal along with its Feldman
+//     commitments. Its first commitment is its master public key.
+//  3. /dkg/combine sends each PKG the deals of the qualified dealers,
+//     at first all of them. A PKG checks its share from each dealer
+//     against the dealer's commitments and complains about the
+//     dealers whose shares are bad. The coordinator disqualifies them
+//     and tries again with the rest, as long as Threshold are left.
+//     Once a PKG has no complaints, it replaces its master private key
+//     with its share of the round's master key, the sum of its shares,
+//     and signs the round's ThresholdKeys.
+//  4. The reveal fails until the PKG has combined the deals, after
+//     which the deals cannot change. Each PKG's RevealReply carries
+//     the ThresholdKeys with its signature.
+//
+// Clients encrypt to ThresholdKeys.Commitments[0], which
+// RoundSettings.Verify checks is the sum of the qualified PKGs'
+// committed master public keys, and combine the identity keys they
+// extracted from any Threshold PKGs with RoundSettings.CombineIdentityKeys.
+//
+// A PKG extracts keys with its share once it has combined the deals,
+// and not before. Setting up the round still needs every PKG; it is
+// extraction that any Threshold of them can serve.
+
+// ThresholdKeys describe a round's master key on a curve that the PKGs
+// generated with a DKG.
+type ThresholdKeys struct {
+	Threshold int
+
+	// Participants are the keys of the PKGs that took part, in order:
+	// the PKG with Participants[i] holds share i+1.
+	Participants []ed25519.PublicKey
+
+	// Qualified lists the shares of the dealers whose deals make up
+	// the master key, in increasing order.
+	Qualified []int
+
+	// Commitments are the sums of the qualified dealers' commitments.
+	// Commitments[0] is the round's master public key.
+	Commitments [][]byte
+
+	// Signature is the PKG's signature on the above.
+	Signature []byte
+}
+
+func (k *ThresholdKeys) msg(round uint32, curve string) []byte {
+	buf := new(bytes.Buffer)
+	buf.WriteString("ThresholdKeys")
+	binary.Write(buf, binary.BigEndian, round)
+	writeDKGBytes(buf, []byte(curve))
+	binary.Write(buf, binary.BigEndian, uint32(k.Threshold))
+	binary.Write(buf, binary.BigEndian, uint32(len(k.Participants)))
+	for _, key := range k.Participants {
+		writeDKGBytes(buf, key)
+	}
+	binary.Write(buf, binary.BigEndian, uint32(len(k.Qualified)))
+	for _, q := range k.Qualified {
+		binary.Write(buf, binary.BigEndian, uint32(q))
+	}
+	writeDKGList(buf, k.Commitments)
+	return buf.Bytes()
+}
+
+// sameKeys reports whether k and other describe the same master key,
+// apart from their signatures.
+func (k *ThresholdKeys) sameKeys(other *ThresholdKeys, round uint32, curve string) bool {
+	return bytes.Equal(k.msg(round, curve), other.msg(round, curve))
+}
+
+// writeDKGBytes writes b to buf with its length, so that signed DKG
+// messages are unambiguous.
+func writeDKGBytes(buf *bytes.Buffer, b []byte) {
+	binary.Write(buf, binary.BigEndian, uint32(len(b)))
+	buf.Write(b)
+}
+
+func writeDKGList(buf *bytes.Buffer, list [][]byte) {
+	binary.Write(buf, binary.BigEndian, uint32(len(list)))
+	for _, b := range list {
+		writeDKGBytes(buf, b)
+	}
+}
+
+// A dkgBoxKey is a participant's X25519 key for receiving its shares
+// in a round.
+type dkgBoxKey struct {
+	Key       []byte
+	Signature []byte
+}
+
+func dkgBoxKeyMsg(round uint32, curve string, key []byte) []byte {
+	buf := new(bytes.Buffer)
+	buf.WriteString("DKGBoxKey")
+	binary.Write(buf, binary.BigEndian, round)
+	writeDKGBytes(buf, []byte(curve))
+	writeDKGBytes(buf, key)
+	return buf.Bytes()
+}
+
+// A dkgDeal is a dealer's Feldman commitments and the shares it dealt,
+// where Shares[j-1] is boxed to participant j.
+type dkgDeal struct {
+	Dealer      int
+	Commitments [][]byte
+	Shares      [][]byte
+	Signature   []byte
+}
+
+func (d *dkgDeal) msg(round uint32, curve string) []byte {
+	buf := new(bytes.Buffer)
+	buf.WriteString("DKGDeal")
+	binary.Write(buf, binary.BigEndian, round)
+	writeDKGBytes(buf, []byte(curve))
+	binary.Write(buf, binary.BigEndian, uint32(d.Dealer))
+	writeDKGList(buf, d.Commitments)
+	writeDKGList(buf, d.Shares)
+	return buf.Bytes()
+}
+
+type dkgDealArgs struct {
+	Round uint32
+	Curve string
+
+	// BoxKeys are the participants' box keys from their commits.
+	BoxKeys []*dkgBoxKey
+
+	coordinatorNonce
+}
+
+type dkgCombineArgs struct {
+	Round uint32
+	Curve string
+
+	// Deals are the deals of the qualified dealers.
+	Deals []*dkgDeal
+
+	coordinatorNonce
+}
+
+type dkgCombineReply struct {
+	// Complaints lists the dealers whose shares for the PKG are bad.
+	// If there are any, the PKG did not combine the deals.
+	Complaints []int `json:",omitempty"`
+}
+
+// verifyThreshold checks the ThresholdKeys in the round settings: on
+// each curve, either no PKG has them or every PKG signed the same
+// ones, for a master key that the PKGs in keys generated together from
+// the master public keys they committed to.
+func (s RoundSettings) verifyThreshold(round uint32, keys []ed25519.PublicKey) bool {
+	if len(keys) == 0 {
+		return true
+	}
+	first := s[hex.EncodeToString(keys[0])]
+	names := make(map[string]bool)
+	for _, key := range keys {
+		for name := range s[hex.EncodeToString(key)].Curves {
+			names[name] = true
+		}
+	}
+	for name := range names {
+		var tk *ThresholdKeys
+		if ck := first.Curves[name]; ck != nil {
+			tk = ck.Threshold
+		}
+		masterKeys := make([][]byte, len(keys))
+		for i, key := range keys {
+			ck := s[hex.EncodeToString(key)].Curves[name]
+			var ctk *ThresholdKeys
+			if ck != nil {
+				ctk = ck.Threshold
+			}
+			if (ctk == nil) != (tk == nil) {
+				return false
+			}
+			if tk == nil {
+				continue
+			}
+			if !ctk.sameKeys(tk, round, name) || !ed25519.Verify(key, tk.msg(round, name), ctk.Signature) {
+				return false
+			}
+			masterKeys[i] = ck.MasterPublicKey
+		}
+		if tk == nil {
+			continue
+		}
+
+		curve, err := pairing.LookupThreshold(name)
+		if err != nil {
+			return false
+		}
+		if tk.Threshold < 1 || tk.Threshold > len(keys) || len(tk.Participants) != len(keys) {
+			return false
+		}
+		for i, key := range keys {
+			if !bytes.Equal(tk.Participants[i], key) {
+				return false
+			}
+		}
+		if len(tk.Qualified) < tk.Threshold || len(tk.Commitments) != tk.Threshold {
+			return false
+		}
+		qualified := make([][][]byte, len(tk.Qualified))
+		for i, q := range tk.Qualified {
+			if q < 1 || q > len(keys) || (i > 0 && q <= tk.Qualified[i-1]) {
+				return false
+			}
+			qualified[i] = [][]byte{masterKeys[q-1]}
+		}
+		masterKey, err := curve.DKGCombineCommitments(qualified)
+		if err != nil || !bytes.Equal(masterKey[0], tk.Commitments[0]) {
+			return false
+		}
+	}
+	return true
+}
+
+// thresholdKeys returns the round's ThresholdKeys on curve, or nil if
+// the PKGs did not generate the curve's master key with a DKG. The
+// settings must have been verified.
+func (s RoundSettings) thresholdKeys(curve string) *ThresholdKeys {
+	for _, reveal := range s {
+		if ck := reveal.Curves[curve]; ck != nil {
+			return ck.Threshold
+		}
+	}
+	return nil
+}
+
+// CurveMasterPublicKeys returns the master public keys to encrypt to
+// on curve with pairing.Curve.IBEEncrypt: the round's master key if
+// the PKGs generated it with a DKG, and otherwise every PKG's master
+// key, in the order of keys. The settings must have been verified.
+func (s RoundSettings) CurveMasterPublicKeys(curve string, keys []ed25519.PublicKey) [][]byte {
+	if tk := s.thresholdKeys(curve); tk != nil {
+		return [][]byte{tk.Commitments[0]}
+	}
+	masterKeys := make([][]byte, len(keys))
+	for i, key := range keys {
+		if ck := s[hex.EncodeToString(key)].Curves[curve]; ck != nil {
+			masterKeys[i] = ck.MasterPublicKey
+		}
+	}
+	return masterKeys
+}
+
+// CombineIdentityKeys combines the identity keys that a user extracted
+// on curve from some of the PKGs in a round whose master key on curve
+// the PKGs generated with a DKG. idKeys maps the hex signing key of a
+// PKG to the key extracted from it. CombineIdentityKeys checks each
+// key against the PKG's share of the master key, skips those that are
+// wrong, and interpolates the user's identity key from Threshold of
+// the rest. The settings must have been verified.
+func (s RoundSettings) CombineIdentityKeys(curve, username string, idKeys map[string][]byte) ([]byte, error) {
+	tk := s.thresholdKeys(curve)
+	if tk == nil {
+		return nil, errors.New("round has no threshold keys on %s", curve)
+	}
+	c, err := pairing.LookupThreshold(curve)
+	if err != nil {
+		return nil, err
+	}
+	id, err := UsernameToIdentity(username)
+	if err != nil {
+		return nil, err
+	}
+
+	var indexes []int
+	var keys [][]byte
+	var bad []string
+	for i, participant := range tk.Participants {
+		if len(indexes) == tk.Threshold {
+			break
+		}
+		hexkey := hex.EncodeToString(participant)
+		idKey, ok := idKeys[hexkey]
+		if !ok {
+			continue
+		}
+		share, err := c.DKGPublicShare(tk.Commitments, i+1)
+		if err != nil {
+			return nil, err
+		}
+		if !c.IBEVerifyShare(share, id[:], idKey) {
+			bad = append(bad, hexkey)
+			continue
+		}
+		indexes = append(indexes, i+1)
+		keys = append(keys, idKey)
+	}
+	if len(indexes) < tk.Threshold {
+		sort.Strings(bad)
+		return nil, errors.New("%d of %d identity keys check out, need %d; bad keys from %v", len(indexes), len(idKeys), tk.Threshold, bad)
+	}
+	return c.IBECombine(indexes, keys)
+}
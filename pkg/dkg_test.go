@@ -0,0 +1,131 @@
+// Copyright 2018 David Lazar. All rights reserved.
+// Use of this source code is governed by the GNU AGPL
+// license that can be found in the LICENSE file.
+
+package pkg_test
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/hex"
+	"testing"
+
+	"vuvuzela.io/alpenhorn/edhttp"
+	"vuvuzela.io/alpenhorn/pairing"
+	"vuvuzela.io/alpenhorn/pkg"
+	"vuvuzela.io/internal/mock"
+)
+
+func TestThresholdRound(t *testing.T) {
+	coordinatorPub, coordinatorPriv, _ := ed25519.GenerateKey(rand.Reader)
+	coordinatorClient := &pkg.CoordinatorClient{
+		CoordinatorKey: coordinatorPriv,
+	}
+	testpkgs := make([]*mock.PKG, 3)
+	pkgs := make([]pkg.PublicServerConfig, len(testpkgs))
+	keys := make([]ed25519.PublicKey, len(testpkgs))
+	for i := range testpkgs {
+		testpkg, err := mock.LaunchPKG(coordinatorPub, func(string, string) error { return nil })
+		if err != nil {
+			t.Fatalf("error launching PKG: %s", err)
+		}
+		defer testpkg.Close()
+		testpkgs[i] = testpkg
+		pkgs[i] = testpkg.PublicServerConfig
+		keys[i] = testpkg.Key
+	}
+
+	username := "alice@example.org"
+	alicePub, alicePriv, _ := ed25519.GenerateKey(rand.Reader)
+	client := &pkg.Client{
+		Username:        username,
+		LoginKey:        alicePriv,
+		UserLongTermKey: alicePub,
+		HTTPClient:      new(edhttp.Client),
+	}
+	for _, server := range pkgs {
+		if err := client.Register(server, ""); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	curves := []string{pairing.BN256, pairing.BLS12381}
+	if _, err := coordinatorClient.NewRoundThreshold(pkgs, 4, curves, 4); err == nil {
+		t.Fatal("expected error for a threshold above the number of PKGs")
+	}
+	settings, err := coordinatorClient.NewRoundThreshold(pkgs, 5, curves, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !settings.Verify(5, keys) {
+		t.Fatal("failed to verify pkg settings")
+	}
+	masterKeys := settings.CurveMasterPublicKeys(pairing.BLS12381, keys)
+	if len(masterKeys) != 1 {
+		t.Fatalf("got %d master keys, want the round's master key", len(masterKeys))
+	}
+
+	// The PKGs sign the same master key, so it cannot differ between
+	// them.
+	reveal := settings[hex.EncodeToString(keys[0])]
+	tk := *reveal.Curves[pairing.BLS12381].Threshold
+	tk.Qualified = []int{1, 2}
+	reveal.Curves = map[string]*pkg.CurveKeys{
+		pairing.BLS12381: {
+			MasterPublicKey: reveal.Curves[pairing.BLS12381].MasterPublicKey,
+			BLSPublicKey:    reveal.Curves[pairing.BLS12381].BLSPublicKey,
+			Threshold:       &tk,
+		},
+	}
+	tampered := make(pkg.RoundSettings)
+	for k, v := range settings {
+		tampered[k] = v
+	}
+	tampered[hex.EncodeToString(keys[0])] = reveal
+	if tampered.Verify(5, keys) {
+		t.Fatal("verified settings with a different master key")
+	}
+
+	curve, _ := pairing.LookupThreshold(pairing.BLS12381)
+	id := pkg.ValidUsernameToIdentity(username)
+	msg := []byte("hi alice")
+	ctxt, err := curve.IBEEncrypt(rand.Reader, masterKeys, id[:], msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The round goes on without one of the PKGs.
+	testpkgs[1].Close()
+	idKeys := make(map[string][]byte)
+	for i, server := range pkgs {
+		result, err := client.ExtractCurve(server, 5, pairing.BLS12381)
+		if i == 1 {
+			if err == nil {
+				t.Fatal("extracted from a closed PKG")
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		idKeys[hex.EncodeToString(server.Key)] = result.PrivateKey
+	}
+	idKey, err := settings.CombineIdentityKeys(pairing.BLS12381, username, idKeys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	out, err := curve.IBEDecrypt([][]byte{idKey}, ctxt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(out, msg) {
+		t.Fatalf("got %q, want %q", out, msg)
+	}
+
+	// A PKG's key is checked against its share.
+	idKeys[hex.EncodeToString(keys[2])] = idKeys[hex.EncodeToString(keys[0])]
+	if _, err := settings.CombineIdentityKeys(pairing.BLS12381, username, idKeys); err == nil {
+		t.Fatal("combined a key that is not from its PKG")
+	}
+}
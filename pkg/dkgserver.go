@@ -0,0 +1,391 @@
+// Copyright 2018 David Lazar. All rights reserved.
+// Use of this source code is governed by the GNU AGPL
+// license that can be found in the LICENSE file.
+
+//go:build !js
+// +build !js
+
+package pkg
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/json"
+	"net/http"
+	"sort"
+	"sync"
+
+	"golang.org/x/crypto/nacl/box"
+
+	"vuvuzela.io/alpenhorn/internal/keysafe"
+	"vuvuzela.io/alpenhorn/log"
+	"vuvuzela.io/alpenhorn/pairing"
+)
+
+// A dkgState is the PKG's part in a round's DKG on a curve; see dkg.go.
+// mu guards boxKeys and deal and serializes the DKG requests; the other
+// fields do not change after the commit.
+type dkgState struct {
+	mu sync.Mutex
+
+	curve        pairing.ThresholdCurve
+	threshold    int
+	participants []ed25519.PublicKey
+	// index is the PKG's share.
+	index int
+
+	boxKey       *dkgBoxKey
+	sealedBoxKey []byte
+
+	// boxKeys are the participants' box keys, and deal is the PKG's
+	// deal, once it has dealt.
+	boxKeys [][32]byte
+	deal    *dkgDeal
+}
+
+// newDKGStates sets up the DKG that args asks for on each of the
+// round's curves.
+func (srv *Server) newDKGStates(args *commitArgs, curves map[string]*curveRoundKeys) error {
+	if args.Threshold == 0 {
+		return nil
+	}
+	n := len(args.Participants)
+	if args.Threshold < 0 || args.Threshold > n {
+		return errorf(ErrBadCommitment, "threshold %d of %d participants", args.Threshold, n)
+	}
+	index := 0
+	for i, key := range args.Participants {
+		if len(key) != ed25519.PublicKeySize {
+			return errorf(ErrBadCommitment, "participant %d: bad key length %d", i+1, len(key))
+		}
+		if bytes.Equal(key, srv.publicKey) {
+			if index != 0 {
+				return errorf(ErrBadCommitment, "participant %x appears twice", key)
+			}
+			index = i + 1
+		}
+	}
+	if index == 0 {
+		return errorf(ErrBadCommitment, "not a participant")
+	}
+	if len(curves) == 0 {
+		return errorf(ErrUnknownCurve, "no curve for a DKG")
+	}
+
+	for name, k := range curves {
+		curve, err := pairing.LookupThreshold(name)
+		if err != nil {
+			return errorf(ErrUnknownCurve, "%s", err)
+		}
+		pub, priv, err := box.GenerateKey(rand.Reader)
+		if err != nil {
+			panic(err)
+		}
+		sig, err := srv.sign(dkgBoxKeyMsg(args.Round, name, pub[:]))
+		if err != nil {
+			return err
+		}
+		k.dkg = &dkgState{
+			curve:        curve,
+			threshold:    args.Threshold,
+			participants: args.Participants,
+			index:        index,
+			boxKey:       &dkgBoxKey{Key: pub[:], Signature: sig},
+			sealedBoxKey: srv.roundKEK.seal(priv[:]),
+		}
+	}
+	return nil
+}
+
+// dkgBoxKeys returns the round's box keys for the commit reply.
+func (st *roundState) dkgBoxKeys() map[string]*dkgBoxKey {
+	var keys map[string]*dkgBoxKey
+	for name, k := range st.curves {
+		if k.dkg == nil {
+			continue
+		}
+		if keys == nil {
+			keys = make(map[string]*dkgBoxKey)
+		}
+		keys[name] = k.dkg.boxKey
+	}
+	return keys
+}
+
+// checkDKGFinished fails unless every DKG in the round is finished.
+// Once the round is revealed, combines fail, so its keys cannot change.
+func (st *roundState) checkDKGFinished(round uint32) error {
+	for name, k := range st.curves {
+		if k.dkg != nil && k.Threshold == nil {
+			return errorf(ErrBadCommitment, "round %d: the %s DKG is not finished", round, name)
+		}
+	}
+	return nil
+}
+
+// dkgRound returns the round's keys on curve, if the round has a DKG
+// on curve.
+func (srv *Server) dkgRound(round uint32, curve string) (*curveRoundKeys, error) {
+	st, ok := srv.getRound(round)
+	if !ok {
+		return nil, errorf(ErrRoundNotFound, "%d", round)
+	}
+	k := st.curves[curve]
+	if k == nil || k.dkg == nil {
+		return nil, errorf(ErrUnknownCurve, "round %d has no DKG on %q", round, curve)
+	}
+	return k, nil
+}
+
+func (srv *Server) dkgDealHandler(w http.ResponseWriter, req *http.Request) {
+	if !srv.isLeader() {
+		httpError(w, errorf(ErrNotLeader, ""))
+		return
+	}
+	coordinatorKey, ok := srv.authorizedCoordinator(w, req)
+	if !ok {
+		return
+	}
+
+	body := http.MaxBytesReader(w, req.Body, 1024*1024)
+	args := new(dkgDealArgs)
+	if err := json.NewDecoder(body).Decode(args); err != nil {
+		httpError(w, errorf(ErrBadRequestJSON, "%s", err))
+		return
+	}
+	if err := srv.checkCoordinator(coordinatorKey, "dkg/deal", args.Round, &args.coordinatorNonce); err != nil {
+		srv.roundSetupFailed(w, "dkg/deal", args.Round, err)
+		return
+	}
+	deal, err := srv.dkgDeal(args)
+	if err != nil {
+		srv.roundSetupFailed(w, "dkg/deal", args.Round, err)
+		return
+	}
+
+	srv.log.WithFields(log.Fields{"round": args.Round, "curve": args.Curve}).Info("DKG deal")
+
+	bs, err := json.Marshal(deal)
+	if err != nil {
+		panic(err)
+	}
+	w.Write(bs)
+}
+
+func (srv *Server) dkgDeal(args *dkgDealArgs) (*dkgDeal, error) {
+	k, err := srv.dkgRound(args.Round, args.Curve)
+	if err != nil {
+		return nil, err
+	}
+	d := k.dkg
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	n := len(d.participants)
+	if len(args.BoxKeys) != n {
+		return nil, errorf(ErrBadCommitment, "%d box keys for %d participants", len(args.BoxKeys), n)
+	}
+	boxKeys := make([][32]byte, n)
+	for i, bk := range args.BoxKeys {
+		if bk == nil || len(bk.Key) != 32 || !ed25519.Verify(d.participants[i], dkgBoxKeyMsg(args.Round, args.Curve, bk.Key), bk.Signature) {
+			return nil, errorf(ErrBadCommitment, "bad box key for participant %d", i+1)
+		}
+		copy(boxKeys[i][:], bk.Key)
+	}
+	if !bytes.Equal(boxKeys[d.index-1][:], d.boxKey.Key) {
+		return nil, errorf(ErrBadCommitment, "unexpected box key for participant %d", d.index)
+	}
+	if d.deal != nil {
+		// The coordinator is retrying; deal the same shares.
+		for i := range boxKeys {
+			if boxKeys[i] != d.boxKeys[i] {
+				return nil, errorf(ErrBadCommitment, "box key for participant %d changed", i+1)
+			}
+		}
+		return d.deal, nil
+	}
+
+	masterKey, err := srv.roundKEK.open(k.sealedMasterKey)
+	if err != nil {
+		return nil, errorf(ErrUnknown, "%s", err)
+	}
+	commitments, shares, err := d.curve.DKGDeal(rand.Reader, masterKey, d.threshold, n)
+	keysafe.Zero(masterKey)
+	if err != nil {
+		return nil, errorf(ErrUnknown, "%s deal: %s", args.Curve, err)
+	}
+	deal := &dkgDeal{
+		Dealer:      d.index,
+		Commitments: commitments,
+		Shares:      make([][]byte, n),
+	}
+	for i, share := range shares {
+		deal.Shares[i], err = box.SealAnonymous(nil, share, &boxKeys[i], rand.Reader)
+		keysafe.Zero(share)
+		if err != nil {
+			panic(err)
+		}
+	}
+	deal.Signature, err = srv.sign(deal.msg(args.Round, args.Curve))
+	if err != nil {
+		return nil, err
+	}
+	d.boxKeys = boxKeys
+	d.deal = deal
+	return deal, nil
+}
+
+func (srv *Server) dkgCombineHandler(w http.ResponseWriter, req *http.Request) {
+	if !srv.isLeader() {
+		httpError(w, errorf(ErrNotLeader, ""))
+		return
+	}
+	coordinatorKey, ok := srv.authorizedCoordinator(w, req)
+	if !ok {
+		return
+	}
+
+	body := http.MaxBytesReader(w, req.Body, 4*1024*1024)
+	args := new(dkgCombineArgs)
+	if err := json.NewDecoder(body).Decode(args); err != nil {
+		httpError(w, errorf(ErrBadRequestJSON, "%s", err))
+		return
+	}
+	if err := srv.checkCoordinator(coordinatorKey, "dkg/combine", args.Round, &args.coordinatorNonce); err != nil {
+		srv.roundSetupFailed(w, "dkg/combine", args.Round, err)
+		return
+	}
+	reply, err := srv.dkgCombine(args)
+	if err != nil {
+		srv.roundSetupFailed(w, "dkg/combine", args.Round, err)
+		return
+	}
+
+	srv.log.WithFields(log.Fields{
+		"round":      args.Round,
+		"curve":      args.Curve,
+		"complaints": reply.Complaints,
+	}).Info("DKG combine")
+
+	bs, err := json.Marshal(reply)
+	if err != nil {
+		panic(err)
+	}
+	w.Write(bs)
+}
+
+func (srv *Server) dkgCombine(args *dkgCombineArgs) (*dkgCombineReply, error) {
+	k, err := srv.dkgRound(args.Round, args.Curve)
+	if err != nil {
+		return nil, err
+	}
+	d := k.dkg
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.deal == nil {
+		return nil, errorf(ErrBadCommitment, "round %d: combine before deal", args.Round)
+	}
+	n := len(d.participants)
+	if len(args.Deals) < d.threshold {
+		return nil, errorf(ErrBadCommitment, "%d deals for threshold %d", len(args.Deals), d.threshold)
+	}
+	deals := append([]*dkgDeal(nil), args.Deals...)
+	for _, deal := range deals {
+		if deal == nil {
+			return nil, errorf(ErrBadCommitment, "missing deal")
+		}
+	}
+	sort.Slice(deals, func(i, j int) bool { return deals[i].Dealer < deals[j].Dealer })
+
+	boxPriv, err := srv.roundKEK.open(d.sealedBoxKey)
+	if err != nil {
+		return nil, errorf(ErrUnknown, "%s", err)
+	}
+	defer keysafe.Zero(boxPriv)
+	var boxPrivKey [32]byte
+	copy(boxPrivKey[:], boxPriv)
+	defer keysafe.Zero(boxPrivKey[:])
+
+	qualified := make([]int, len(deals))
+	commitments := make([][][]byte, len(deals))
+	shares := make([][]byte, 0, len(deals))
+	defer func() {
+		for _, share := range shares {
+			keysafe.Zero(share)
+		}
+	}()
+	var complaints []int
+	for i, deal := range deals {
+		if deal.Dealer < 1 || deal.Dealer > n || (i > 0 && deal.Dealer == deals[i-1].Dealer) {
+			return nil, errorf(ErrBadCommitment, "bad dealer %d", deal.Dealer)
+		}
+		// A deal that is not signed by its dealer is the coordinator's
+		// doing, not the dealer's, so it fails the combine rather than
+		// disqualifying the dealer.
+		if !ed25519.Verify(d.participants[deal.Dealer-1], deal.msg(args.Round, args.Curve), deal.Signature) {
+			return nil, errorf(ErrBadCommitment, "bad signature on the deal from %d", deal.Dealer)
+		}
+		qualified[i] = deal.Dealer
+		commitments[i] = deal.Commitments
+		if len(deal.Commitments) != d.threshold || len(deal.Shares) != n {
+			complaints = append(complaints, deal.Dealer)
+			continue
+		}
+		share, ok := box.OpenAnonymous(nil, deal.Shares[d.index-1], &d.boxKeys[d.index-1], &boxPrivKey)
+		if !ok || !d.curve.DKGVerifyShare(deal.Commitments, d.index, share) {
+			keysafe.Zero(share)
+			complaints = append(complaints, deal.Dealer)
+			continue
+		}
+		shares = append(shares, share)
+	}
+	if len(complaints) > 0 {
+		return &dkgCombineReply{Complaints: complaints}, nil
+	}
+
+	combined, err := d.curve.DKGCombineCommitments(commitments)
+	if err != nil {
+		return nil, errorf(ErrBadCommitment, "%s", err)
+	}
+	masterShare, err := d.curve.DKGCombineShares(shares)
+	if err != nil {
+		return nil, errorf(ErrUnknown, "%s", err)
+	}
+	keys := &ThresholdKeys{
+		Threshold:    d.threshold,
+		Participants: d.participants,
+		Qualified:    qualified,
+		Commitments:  combined,
+	}
+	keys.Signature, err = srv.sign(keys.msg(args.Round, args.Curve))
+	if err != nil {
+		keysafe.Zero(masterShare)
+		return nil, err
+	}
+
+	// Extractions read the round's keys without locking, so the
+	// combined keys replace them rather than change them in place.
+	combinedKeys := *k
+	combinedKeys.Threshold = keys
+	combinedKeys.sealedMasterKey = srv.roundKEK.seal(masterShare)
+
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	st, ok := srv.rounds[args.Round]
+	if !ok {
+		return nil, errorf(ErrRoundNotFound, "%d", args.Round)
+	}
+	if st.revealSignature != nil {
+		return nil, errorf(ErrBadCommitment, "round %d is already revealed", args.Round)
+	}
+	combinedSt := *st
+	combinedSt.curves = make(map[string]*curveRoundKeys, len(st.curves))
+	for name, ck := range st.curves {
+		combinedSt.curves[name] = ck
+	}
+	combinedSt.curves[args.Curve] = &combinedKeys
+	srv.rounds[args.Round] = &combinedSt
+	return &dkgCombineReply{}, nil
+}
@@ -0,0 +1,143 @@
+// Copyright 2018 David Lazar. All rights reserved.
+// Use of this source code is governed by the GNU AGPL
+// license that can be found in the LICENSE file.
+
+package pkg
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"reflect"
+	"testing"
+
+	"vuvuzela.io/alpenhorn/pairing"
+	"vuvuzela.io/alpenhorn/pkg/kv"
+)
+
+func TestDKGComplaints(t *testing.T) {
+	const round = 3
+	servers := make([]*Server, 3)
+	participants := make([]ed25519.PublicKey, len(servers))
+	for i := range servers {
+		pub, priv, _ := ed25519.GenerateKey(rand.Reader)
+		srv, err := NewServer(&Config{
+			DB:               kv.NewMemory(),
+			SigningKey:       priv,
+			RegistrationMode: RegistrationFCFS,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer srv.Close()
+		servers[i] = srv
+		participants[i] = pub
+	}
+
+	commit := &commitArgs{
+		Round:        round,
+		Curves:       []string{pairing.BLS12381},
+		Threshold:    2,
+		Participants: participants,
+	}
+	boxKeys := make([]*dkgBoxKey, len(servers))
+	for i, srv := range servers {
+		curves, err := newCurveRoundKeys(commit.Curves, srv.roundKEK)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := srv.newDKGStates(commit, curves); err != nil {
+			t.Fatal(err)
+		}
+		st := &roundState{curves: curves}
+		srv.mu.Lock()
+		srv.rounds[round] = st
+		srv.mu.Unlock()
+		boxKeys[i] = st.dkgBoxKeys()[pairing.BLS12381]
+	}
+
+	deals := make([]*dkgDeal, len(servers))
+	for i, srv := range servers {
+		deal, err := srv.dkgDeal(&dkgDealArgs{Round: round, Curve: pairing.BLS12381, BoxKeys: boxKeys})
+		if err != nil {
+			t.Fatal(err)
+		}
+		deals[i] = deal
+	}
+	returnKeys, err := newReturnKeys(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer returnKeys.destroy()
+	extract := &extractArgs{
+		Round:         round,
+		Curve:         pairing.BLS12381,
+		ReturnKey:     returnKeys.pub,
+		ReturnVersion: returnKeys.version,
+	}
+	if _, err := servers[0].extract(context.Background(), extract); errorCode(err) != ErrRoundNotFound {
+		t.Fatalf("expected ErrRoundNotFound before the DKG is finished, got %v", err)
+	}
+
+	// The third PKG deals the first a share that does not match its
+	// commitments.
+	bad := *deals[2]
+	bad.Shares = append([][]byte(nil), deals[2].Shares...)
+	bad.Shares[0] = deals[1].Shares[0]
+	sig, err := servers[2].sign(bad.msg(round, pairing.BLS12381))
+	if err != nil {
+		t.Fatal(err)
+	}
+	bad.Signature = sig
+	combine := &dkgCombineArgs{Round: round, Curve: pairing.BLS12381, Deals: []*dkgDeal{deals[0], deals[1], &bad}}
+	reply, err := servers[0].dkgCombine(combine)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(reply.Complaints, []int{3}) {
+		t.Fatalf("complaints: got %v, want [3]", reply.Complaints)
+	}
+
+	// A deal that its dealer did not sign is not the dealer's fault.
+	forged := bad
+	forged.Signature = deals[2].Signature
+	combine.Deals[2] = &forged
+	if _, err := servers[1].dkgCombine(combine); errorCode(err) != ErrBadCommitment {
+		t.Fatalf("expected ErrBadCommitment for a forged deal, got %v", err)
+	}
+
+	// Without the third PKG's deal, the first two are enough.
+	combine.Deals = deals[:2]
+	var keys []*ThresholdKeys
+	for _, srv := range servers {
+		reply, err := srv.dkgCombine(combine)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(reply.Complaints) != 0 {
+			t.Fatalf("unexpected complaints: %v", reply.Complaints)
+		}
+		st, _ := srv.getRound(round)
+		keys = append(keys, st.curves[pairing.BLS12381].Threshold)
+		if err := st.checkDKGFinished(round); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if !reflect.DeepEqual(keys[0].Qualified, []int{1, 2}) {
+		t.Fatalf("qualified: got %v, want [1 2]", keys[0].Qualified)
+	}
+	for i, k := range keys {
+		if !k.sameKeys(keys[0], round, pairing.BLS12381) {
+			t.Fatalf("pkg %d combined a different master key", i+1)
+		}
+	}
+
+	// The deals cannot change once the round is revealed.
+	servers[0].mu.Lock()
+	servers[0].rounds[round].revealSignature = []byte("revealed")
+	servers[0].mu.Unlock()
+	combine.Deals = deals
+	if _, err := servers[0].dkgCombine(combine); errorCode(err) != ErrBadCommitment {
+		t.Fatalf("expected ErrBadCommitment after the reveal, got %v", err)
+	}
+}
@@ -0,0 +1,105 @@
+// Copyright 2018 David Lazar. All rights reserved.
+// Use of this source code is governed by the GNU AGPL
+// license that can be found in the LICENSE file.
+
+//go:build !js
+// +build !js
+
+package pkg
+
+import (
+	"strings"
+	"time"
+
+	"vuvuzela.io/alpenhorn/errors"
+	"vuvuzela.io/alpenhorn/pkg/kv"
+)
+
+// Domain quotas cap the registrations accepted per email domain per
+// UTC day, which slows down anyone registering many accounts at a
+// free mail provider. Renames into another domain count against the
+// new username's domain so they cannot be used to get around the quota.
+
+// DefaultDomainQuota is the key in Config.DomainQuotas for the quota
+// of domains that are not listed.
+const DefaultDomainQuota = "*"
+
+var dbDomainQuotaPrefix = []byte("domainquota:")
+
+// domainQuotaTTL is how long a day's counters are kept. It is longer
+// than a day so that a counter outlives its day on any clock.
+const domainQuotaTTL = 48 * time.Hour
+
+func domainQuotaKey(day uint64, domain string) []byte {
+	key := appendUint64(append([]byte(nil), dbDomainQuotaPrefix...), day)
+	return append(key, domain...)
+}
+
+func checkDomainQuotas(quotas map[string]int) error {
+	for domain, quota := range quotas {
+		if domain == "" || domain != strings.ToLower(domain) {
+			return errors.New("DomainQuotas: invalid domain %q", domain)
+		}
+		if quota < 0 {
+			return errors.New("DomainQuotas: negative quota for %q", domain)
+		}
+	}
+	return nil
+}
+
+// usernameDomain returns the domain of a valid username.
+func usernameDomain(username string) string {
+	return username[strings.LastIndex(username, "@")+1:]
+}
+
+// A domainQuotaUse is a pending registration against a domain's quota.
+// The zero value means the domain has no quota.
+type domainQuotaUse struct {
+	key   []byte
+	count uint64
+}
+
+// checkDomainQuota returns ErrDomainQuota if the registration of
+// username would exceed its domain's quota for today. Otherwise, the
+// caller must call use on the result in the transaction that
+// registers the username.
+func (srv *Server) checkDomainQuota(tx kv.Txn, username string) (domainQuotaUse, error) {
+	if len(srv.domainQuotas) == 0 {
+		return domainQuotaUse{}, nil
+	}
+	domain := usernameDomain(username)
+	quota, ok := srv.domainQuotas[domain]
+	if !ok {
+		quota, ok = srv.domainQuotas[DefaultDomainQuota]
+	}
+	if !ok || quota == 0 {
+		return domainQuotaUse{}, nil
+	}
+
+	day := uint64(srv.clock.Now().Unix() / (24 * 60 * 60))
+	use := domainQuotaUse{key: domainQuotaKey(day, domain)}
+	data, err := tx.Get(use.key)
+	if err != nil && err != kv.ErrNotFound {
+		return use, errorf(ErrDatabaseError, "%s", err)
+	}
+	if err == nil {
+		use.count, err = decodeIndex(data)
+		if err != nil {
+			return use, errorf(ErrDatabaseError, "domain quota: %s", err)
+		}
+	}
+	if use.count >= uint64(quota) {
+		return use, errorf(ErrDomainQuota, "%d registrations at %s today", use.count, domain)
+	}
+	return use, nil
+}
+
+func (u domainQuotaUse) use(tx kv.Txn) error {
+	if u.key == nil {
+		return nil
+	}
+	if err := tx.SetWithTTL(u.key, appendUint64(nil, u.count+1), domainQuotaTTL); err != nil {
+		return errorf(ErrDatabaseError, "%s", err)
+	}
+	return nil
+}
@@ -0,0 +1,84 @@
+// Copyright 2018 David Lazar. All rights reserved.
+// Use of this source code is governed by the GNU AGPL
+// license that can be found in the LICENSE file.
+
+package pkg
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"testing"
+	"time"
+
+	"vuvuzela.io/alpenhorn/clock"
+	"vuvuzela.io/alpenhorn/pkg/kv"
+)
+
+func TestDomainQuotas(t *testing.T) {
+	mockClock := clock.NewMock(time.Date(2018, 5, 1, 12, 0, 0, 0, time.UTC))
+	_, serverKey, _ := ed25519.GenerateKey(rand.Reader)
+	db := kv.NewMemory()
+	srv, err := NewServer(&Config{
+		DB:               db,
+		SigningKey:       serverKey,
+		RegistrationMode: RegistrationFCFS,
+		Clock:            mockClock,
+		DomainQuotas: map[string]int{
+			"gmail.com":        2,
+			"example.org":      0,
+			DefaultDomainQuota: 1,
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+
+	register := func(username string) error {
+		loginKey, _, _ := ed25519.GenerateKey(rand.Reader)
+		_, err := srv.register(&registerArgs{Username: username, LoginKey: loginKey})
+		return err
+	}
+	accepted := []string{
+		"alice@gmail.com", "bob@gmail.com",
+		"carol@other.net",
+		"dave@example.org", "erin@example.org", "frank@example.org",
+	}
+	for _, username := range accepted {
+		if err := register(username); err != nil {
+			t.Fatalf("%s: %s", username, err)
+		}
+	}
+	for _, username := range []string{"carol@gmail.com", "dave@other.net"} {
+		if err := register(username); errorCode(err) != ErrDomainQuota {
+			t.Fatalf("%s: expected ErrDomainQuota, got %v", username, err)
+		}
+	}
+
+	// Each unlisted domain has its own quota.
+	if err := register("grace@third.net"); err != nil {
+		t.Fatal(err)
+	}
+
+	stats, err := CollectDBStats(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.DomainQuotaCounters != 3 {
+		t.Fatalf("expected 3 domain counters, got %d", stats.DomainQuotaCounters)
+	}
+
+	mockClock.Add(12 * time.Hour)
+	if err := register("carol@gmail.com"); err != nil {
+		t.Fatalf("quota did not reset the next day: %s", err)
+	}
+
+	if _, err := NewServer(&Config{
+		DB:               kv.NewMemory(),
+		SigningKey:       serverKey,
+		RegistrationMode: RegistrationFCFS,
+		DomainQuotas:     map[string]int{"Gmail.com": 1},
+	}); err == nil {
+		t.Fatal("expected error for an uppercase domain")
+	}
+}
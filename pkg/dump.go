@@ -0,0 +1,228 @@
+// Copyright 2018 David Lazar. All rights reserved.
+// Use of this source code is governed by the GNU AGPL
+// license that can be found in the LICENSE file.
+
+//go:build !js
+// +build !js
+
+package pkg
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"time"
+
+	"golang.org/x/crypto/nacl/secretbox"
+	"golang.org/x/crypto/scrypt"
+
+	"vuvuzela.io/alpenhorn/errors"
+	"vuvuzela.io/alpenhorn/pkg/kv"
+)
+
+// A dump is an archive of the records that a PKG server cannot
+// rebuild: registrations and everything else stored under a username,
+// the verifiers' records, the attestation and registration logs, the
+// schema version, the blocklist, and the last rounds each coordinator
+// set up.
+// Replay entries, registration attempts, audit events, and abuse
+// reports are left out. Operators use dumps to move a server to another storage backend
+// or to restore it after losing its disk.
+//
+// A dump is encrypted with a key derived from a passphrase, since it
+// holds every user's login key and verification state, and signed by
+// the server, so that a restore cannot be fed records the server never
+// wrote. Records that expire are restored without an expiry, except
+// for rename holds, which expire RenameHold after the rename.
+
+var dumpPrefixes = [][]byte{dbUserPrefix, dbVerifierPrefix, attestLog.prefix, regLog.prefix, dbSchemaPrefix, dbBlocklistPrefix, dbCoordinatorPrefix}
+
+var dumpMagic = []byte("ALPNDUMP")
+
+const (
+	dumpVersion    byte = 1
+	dumpHeaderSize      = 8 + 1 + 16 + 24
+
+	// restoreBatchSize is how many records RestoreDB writes in each
+	// transaction.
+	restoreBatchSize = 1000
+)
+
+func dumpKey(passphrase []byte, salt []byte) *[32]byte {
+	dk, err := scrypt.Key(passphrase, salt, 2<<15, 8, 1, 32)
+	if err != nil {
+		panic(err)
+	}
+	key := new([32]byte)
+	copy(key[:], dk)
+	return key
+}
+
+func dumpSigningMessage(data []byte) []byte {
+	return append([]byte("AlpenhornPKGDump"), data...)
+}
+
+// DumpDB writes an archive of the database to w, encrypted with
+// passphrase and signed by signer. It returns the number of records
+// in the archive.
+func DumpDB(db kv.DB, w io.Writer, passphrase []byte, signer crypto.Signer) (int, error) {
+	body := new(bytes.Buffer)
+	n := 0
+	err := db.View(func(tx kv.Txn) error {
+		for _, prefix := range dumpPrefixes {
+			err := tx.Iterate(prefix, func(key, value []byte) error {
+				writeDumpField(body, key)
+				writeDumpField(body, value)
+				n++
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	header := make([]byte, dumpHeaderSize)
+	copy(header, dumpMagic)
+	header[8] = dumpVersion
+	salt := header[9:25]
+	nonce := new([24]byte)
+	if _, err := rand.Read(header[9:]); err != nil {
+		return 0, err
+	}
+	copy(nonce[:], header[25:])
+
+	data := secretbox.Seal(header, body.Bytes(), nonce, dumpKey(passphrase, salt))
+	sig, err := signer.Sign(rand.Reader, dumpSigningMessage(data), crypto.Hash(0))
+	if err != nil {
+		return 0, errors.Wrap(err, "signing dump")
+	}
+	data = append(data, sig...)
+	if _, err := w.Write(data); err != nil {
+		return 0, err
+	}
+	return n, nil
+}
+
+func writeDumpField(w *bytes.Buffer, field []byte) {
+	var buf [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(buf[:], uint64(len(field)))
+	w.Write(buf[:n])
+	w.Write(field)
+}
+
+func readDumpField(r *bytes.Reader) ([]byte, error) {
+	size, err := binary.ReadUvarint(r)
+	if err != nil {
+		return nil, err
+	}
+	if size > uint64(r.Len()) {
+		return nil, io.ErrUnexpectedEOF
+	}
+	field := make([]byte, size)
+	_, err = io.ReadFull(r, field)
+	return field, err
+}
+
+// RestoreDB reads an archive written by DumpDB into db, which must not
+// have any of the records in the archive yet. The archive must be
+// signed by serverKey. RestoreDB returns the number of records
+// restored.
+func RestoreDB(db kv.DB, r io.Reader, passphrase []byte, serverKey ed25519.PublicKey) (int, error) {
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return 0, err
+	}
+	if len(data) < dumpHeaderSize+secretbox.Overhead+ed25519.SignatureSize || !bytes.Equal(data[:8], dumpMagic) {
+		return 0, errors.New("not a PKG dump")
+	}
+	if data[8] != dumpVersion {
+		return 0, errors.New("unsupported dump version %d", data[8])
+	}
+	signed, sig := data[:len(data)-ed25519.SignatureSize], data[len(data)-ed25519.SignatureSize:]
+	if !ed25519.Verify(serverKey, dumpSigningMessage(signed), sig) {
+		return 0, errors.New("dump is not signed by the server key")
+	}
+	salt := signed[9:25]
+	nonce := new([24]byte)
+	copy(nonce[:], signed[25:dumpHeaderSize])
+	body, ok := secretbox.Open(nil, signed[dumpHeaderSize:], nonce, dumpKey(passphrase, salt))
+	if !ok {
+		return 0, errors.New("wrong passphrase")
+	}
+
+	for _, prefix := range dumpPrefixes {
+		if bytes.Equal(prefix, dbSchemaPrefix) {
+			// Opening the database may have set the schema version.
+			continue
+		}
+		err := db.View(func(tx kv.Txn) error {
+			return tx.Iterate(prefix, func(key, _ []byte) error {
+				return errors.New("database is not empty: found %q", key)
+			})
+		})
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	now := time.Now()
+	br := bytes.NewReader(body)
+	n := 0
+	for {
+		tx, err := db.NewTransaction(true)
+		if err != nil {
+			return n, err
+		}
+		batch := 0
+		for ; batch < restoreBatchSize; batch++ {
+			key, err := readDumpField(br)
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				tx.Discard()
+				return n, errors.Wrap(err, "reading record %d", n+batch)
+			}
+			value, err := readDumpField(br)
+			if err != nil {
+				tx.Discard()
+				return n, errors.Wrap(err, "reading record %d", n+batch)
+			}
+			if err := restoreRecord(tx, key, value, now); err != nil {
+				tx.Discard()
+				return n, errors.Wrap(err, "restoring %q", key)
+			}
+		}
+		if err := tx.Commit(); err != nil {
+			return n, err
+		}
+		n += batch
+		if batch < restoreBatchSize {
+			return n, nil
+		}
+	}
+}
+
+func restoreRecord(tx kv.Txn, key, value []byte, now time.Time) error {
+	if _, suffix, ok := splitUserKey(key); ok && bytes.Equal(suffix, renamedSuffix) {
+		a, err := unmarshalRenamed(value)
+		if err != nil {
+			return err
+		}
+		ttl := RenameHold - now.Sub(time.Unix(a.Time, 0))
+		if ttl <= 0 {
+			return nil
+		}
+		return tx.SetWithTTL(key, value, ttl)
+	}
+	return tx.Set(key, value)
+}
@@ -0,0 +1,112 @@
+// Copyright 2018 David Lazar. All rights reserved.
+// Use of this source code is governed by the GNU AGPL
+// license that can be found in the LICENSE file.
+
+package pkg
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"testing"
+
+	"vuvuzela.io/alpenhorn/pkg/kv"
+)
+
+func TestDumpRestore(t *testing.T) {
+	serverPub, serverPriv, _ := ed25519.GenerateKey(rand.Reader)
+	srv, err := NewServer(&Config{
+		DB:              kv.NewMemory(),
+		SigningKey:      serverPriv,
+		RegTokenHandler: func(string, string) error { return nil },
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+
+	alicePub, _, _ := ed25519.GenerateKey(rand.Reader)
+	if _, err := srv.register(&registerArgs{Username: "alice@example.org", LoginKey: alicePub}); err != nil {
+		t.Fatal(err)
+	}
+	id := ValidUsernameToIdentity("alice@example.org")
+	if err := srv.logAttestation(id, alicePub, srv.clock.Now()); err != nil {
+		t.Fatal(err)
+	}
+	err = srv.db.Update(func(tx kv.Txn) error {
+		return checkReplay(tx, "extract", []byte("signature"), srv.clock.Now())
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	passphrase := []byte("correct horse")
+	buf := new(bytes.Buffer)
+	n, err := DumpDB(srv.db, buf, passphrase, serverPriv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n == 0 {
+		t.Fatal("empty dump")
+	}
+	archive := buf.Bytes()
+
+	otherPub, _, _ := ed25519.GenerateKey(rand.Reader)
+	if _, err := RestoreDB(kv.NewMemory(), bytes.NewReader(archive), passphrase, otherPub); err == nil {
+		t.Fatal("expected error for a dump signed by another key")
+	}
+	if _, err := RestoreDB(kv.NewMemory(), bytes.NewReader(archive), []byte("wrong"), serverPub); err == nil {
+		t.Fatal("expected error for the wrong passphrase")
+	}
+	tampered := append([]byte(nil), archive...)
+	tampered[dumpHeaderSize] ^= 1
+	if _, err := RestoreDB(kv.NewMemory(), bytes.NewReader(tampered), passphrase, serverPub); err == nil {
+		t.Fatal("expected error for a modified dump")
+	}
+	if _, err := RestoreDB(srv.db, bytes.NewReader(archive), passphrase, serverPub); err == nil {
+		t.Fatal("expected error for restoring into a database with users")
+	}
+
+	restored := kv.NewMemory()
+	m, err := RestoreDB(restored, bytes.NewReader(archive), passphrase, serverPub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m != n {
+		t.Fatalf("restored %d records, dumped %d", m, n)
+	}
+
+	srv2, err := NewServer(&Config{
+		DB:               restored,
+		ManualMigrations: true,
+		SigningKey:       serverPriv,
+		RegTokenHandler:  func(string, string) error { return nil },
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv2.Close()
+	user, _, err := srv2.getUser(nil, "alice@example.org")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !user.LoginKey.Equal(alicePub) {
+		t.Fatal("restored login key does not match")
+	}
+	head, err := srv2.LogHead()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if head.Size == 0 {
+		t.Fatal("attestation log was not restored")
+	}
+	err = restored.View(func(tx kv.Txn) error {
+		return tx.Iterate(dbReplayPrefix, func(key, _ []byte) error {
+			t.Errorf("replay entry %q was restored", key)
+			return nil
+		})
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
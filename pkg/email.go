@@ -0,0 +1,175 @@
+// Copyright 2018 David Lazar. All rights reserved.
+// Use of this source code is governed by the GNU AGPL
+// license that can be found in the LICENSE file.
+
+//go:build !js
+// +build !js
+
+package pkg
+
+import (
+	"bytes"
+	"crypto/rand"
+	"fmt"
+	"net"
+	"net/smtp"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/davidlazar/go-crypto/encoding/base32"
+
+	"vuvuzela.io/alpenhorn/errors"
+)
+
+const (
+	DefaultTokenTTL       = 24 * time.Hour
+	DefaultResendCooldown = 5 * time.Minute
+)
+
+// An EmailVerifier checks that users own their usernames, which are
+// email addresses, by emailing them a token.
+type EmailVerifier struct {
+	// SMTPAddr is the host:port of the mail server that relays the
+	// emails. If SMTPUsername is set, the server authenticates with
+	// PLAIN auth, which net/smtp only allows over TLS or to localhost.
+	SMTPAddr     string
+	SMTPUsername string
+	SMTPPassword string
+
+	// From is the address that the emails are sent from.
+	From string
+
+	// Subject is the subject line of the emails.
+	Subject string
+
+	// Template produces the body of the emails from an EmailData.
+	// DefaultEmailTemplate is used if Template is nil.
+	Template *template.Template
+
+	// TokenTTL is how long a token is valid. ResendCooldown is the
+	// least time between emails to the same username. Zero values
+	// mean DefaultTokenTTL and DefaultResendCooldown.
+	TokenTTL       time.Duration
+	ResendCooldown time.Duration
+
+	// Send, if not nil, is called to deliver each message instead of
+	// sending it to SMTPAddr.
+	Send func(to string, msg []byte) error
+}
+
+// EmailData is the data that verification email templates are
+// executed with.
+type EmailData struct {
+	Username string
+	Token    string
+	Expires  time.Time
+}
+
+var DefaultEmailTemplate = template.Must(template.New("email").Parse(
+	`Someone, hopefully you, asked to register {{.Username}}
+with an Alpenhorn key server. Your verification token is:
+
+    {{.Token}}
+
+The token expires at {{.Expires.UTC.Format "2006-01-02 15:04 MST"}}.
+If you did not ask to register, you can ignore this email.
+`))
+
+func (v *EmailVerifier) Name() string {
+	return "email"
+}
+
+func (v *EmailVerifier) Check() error {
+	if v.Send == nil && v.SMTPAddr == "" {
+		return errors.New("no SMTP server address")
+	}
+	if v.Send == nil {
+		if _, _, err := net.SplitHostPort(v.SMTPAddr); err != nil {
+			return errors.Wrap(err, "invalid SMTP server address")
+		}
+	}
+	if v.From == "" {
+		return errors.New("no From address for verification emails")
+	}
+	if strings.ContainsAny(v.From+v.Subject, "\r\n") {
+		return errors.New("email From and Subject must be a single line")
+	}
+	return nil
+}
+
+func (v *EmailVerifier) Verify(store *VerifierStore, username string, token string) error {
+	ch := &codeChallenge{
+		ttl:      v.TokenTTL,
+		cooldown: v.ResendCooldown,
+		newCode:  newEmailToken,
+		send: func(username string, token string, expires time.Time) error {
+			msg, err := v.message(username, &EmailData{
+				Username: username,
+				Token:    token,
+				Expires:  expires,
+			}, store.Now())
+			if err != nil {
+				return err
+			}
+			return v.send(username, msg)
+		},
+		// Tokens are read off an email and typed back in, so ignore
+		// case and the spaces and dashes that people add.
+		normalize: func(token string) string {
+			return strings.ToLower(strings.NewReplacer(" ", "", "-", "").Replace(token))
+		},
+	}
+	if ch.ttl == 0 {
+		ch.ttl = DefaultTokenTTL
+	}
+	if ch.cooldown == 0 {
+		ch.cooldown = DefaultResendCooldown
+	}
+	return ch.verify(store, username, token)
+}
+
+func newEmailToken() (string, error) {
+	b := make([]byte, 10)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base32.EncodeToString(b), nil
+}
+
+func (v *EmailVerifier) message(to string, data *EmailData, now time.Time) ([]byte, error) {
+	tmpl := v.Template
+	if tmpl == nil {
+		tmpl = DefaultEmailTemplate
+	}
+	body := new(bytes.Buffer)
+	if err := tmpl.Execute(body, data); err != nil {
+		return nil, err
+	}
+
+	msg := new(bytes.Buffer)
+	fmt.Fprintf(msg, "From: %s\r\n", v.From)
+	fmt.Fprintf(msg, "To: %s\r\n", to)
+	fmt.Fprintf(msg, "Subject: %s\r\n", v.Subject)
+	fmt.Fprintf(msg, "Date: %s\r\n", now.Format(time.RFC1123Z))
+	msg.WriteString("MIME-Version: 1.0\r\n")
+	msg.WriteString("Content-Type: text/plain; charset=utf-8\r\n")
+	msg.WriteString("\r\n")
+	// SMTP requires CRLF line endings.
+	for _, line := range strings.Split(strings.TrimRight(body.String(), "\n"), "\n") {
+		msg.WriteString(strings.TrimRight(line, "\r") + "\r\n")
+	}
+	return msg.Bytes(), nil
+}
+
+func (v *EmailVerifier) send(to string, msg []byte) error {
+	if v.Send != nil {
+		return v.Send(to, msg)
+	}
+	var auth smtp.Auth
+	if v.SMTPUsername != "" {
+		host, _, _ := net.SplitHostPort(v.SMTPAddr)
+		auth = smtp.PlainAuth("", v.SMTPUsername, v.SMTPPassword, host)
+	}
+	return smtp.SendMail(v.SMTPAddr, auth, v.From, []string{to}, msg)
+}
@@ -0,0 +1,126 @@
+// Copyright 2018 David Lazar. All rights reserved.
+// Use of this source code is governed by the GNU AGPL
+// license that can be found in the LICENSE file.
+
+package pkg
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"vuvuzela.io/alpenhorn/clock"
+	"vuvuzela.io/alpenhorn/pkg/kv"
+)
+
+func TestEmailVerification(t *testing.T) {
+	mockClock := clock.NewMock(time.Now())
+	var sent []string
+	_, serverKey, _ := ed25519.GenerateKey(rand.Reader)
+	srv, err := NewServer(&Config{
+		DB:         kv.NewMemory(),
+		SigningKey: serverKey,
+		Clock:      mockClock,
+		Verifier: &EmailVerifier{
+			From:    "pkg@example.org",
+			Subject: "Your token",
+			Send: func(to string, msg []byte) error {
+				if to != "alice@example.org" {
+					t.Errorf("email sent to %q", to)
+				}
+				sent = append(sent, string(msg))
+				return nil
+			},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+
+	loginPub, _, _ := ed25519.GenerateKey(rand.Reader)
+	register := func(token string) error {
+		_, err := srv.register(&registerArgs{
+			Username:          "alice@example.org",
+			LoginKey:          loginPub,
+			RegistrationToken: token,
+		})
+		return err
+	}
+	tokenRegexp := regexp.MustCompile(`(?m)^    ([a-z0-9]+)\r$`)
+	lastToken := func() string {
+		m := tokenRegexp.FindStringSubmatch(sent[len(sent)-1])
+		if m == nil {
+			t.Fatalf("no token in email:\n%s", sent[len(sent)-1])
+		}
+		return m[1]
+	}
+
+	if err := register(""); errorCode(err) != ErrVerificationSent {
+		t.Fatalf("expected ErrVerificationSent, got %v", err)
+	}
+	if len(sent) != 1 || !strings.Contains(sent[0], "Subject: Your token\r\n") {
+		t.Fatalf("unexpected emails: %q", sent)
+	}
+	first := lastToken()
+
+	if err := register(""); errorCode(err) != ErrResendTooSoon {
+		t.Fatalf("expected ErrResendTooSoon, got %v", err)
+	}
+	mockClock.Add(DefaultResendCooldown)
+	if err := register(""); errorCode(err) != ErrVerificationSent {
+		t.Fatalf("expected ErrVerificationSent after the cooldown, got %v", err)
+	}
+	token := lastToken()
+	if len(sent) != 2 || token == first {
+		t.Fatalf("expected a new token")
+	}
+
+	if err := register(first); errorCode(err) != ErrInvalidToken {
+		t.Fatalf("expected ErrInvalidToken for the replaced token, got %v", err)
+	}
+	if err := register(strings.ToUpper(token)); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := srv.getUser(nil, "alice@example.org"); err != nil {
+		t.Fatalf("user not registered: %s", err)
+	}
+	if err := register(token); errorCode(err) != ErrInvalidToken {
+		t.Fatalf("expected ErrInvalidToken for a used token, got %v", err)
+	}
+}
+
+func TestEmailTokenExpires(t *testing.T) {
+	mockClock := clock.NewMock(time.Now())
+	var msg []byte
+	_, serverKey, _ := ed25519.GenerateKey(rand.Reader)
+	srv, err := NewServer(&Config{
+		DB:         kv.NewMemory(),
+		SigningKey: serverKey,
+		Clock:      mockClock,
+		Verifier: &EmailVerifier{
+			From:     "pkg@example.org",
+			TokenTTL: time.Hour,
+			Send: func(to string, m []byte) error {
+				msg = m
+				return nil
+			},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+
+	if err := srv.live().verifier.Verify(srv.live().verifierStore, "bob@example.org", ""); errorCode(err) != ErrVerificationSent {
+		t.Fatalf("expected ErrVerificationSent, got %v", err)
+	}
+	token := regexp.MustCompile(`(?m)^    ([a-z0-9]+)\r$`).FindSubmatch(msg)[1]
+	mockClock.Add(time.Hour)
+	if err := srv.live().verifier.Verify(srv.live().verifierStore, "bob@example.org", string(token)); errorCode(err) != ErrExpiredToken {
+		t.Fatalf("expected ErrExpiredToken, got %v", err)
+	}
+}
@@ -4,9 +4,9 @@ package pkg
 
 import "fmt"
 
-const _ErrorCode_name = "ErrBadRequestJSONErrDatabaseErrorErrInvalidUsernameErrInvalidLoginKeyErrNotRegisteredErrAlreadyRegisteredErrRoundNotFoundErrInvalidUserLongTermKeyErrInvalidSignatureErrInvalidTokenErrExpiredTokenErrUnauthorizedErrBadCommitmentErrUnknown"
+const _ErrorCode_name = "ErrBadRequestJSONErrDatabaseErrorErrInvalidUsernameErrInvalidLoginKeyErrNotRegisteredErrAlreadyRegisteredErrRoundNotFoundErrInvalidUserLongTermKeyErrInvalidSignatureErrInvalidTokenErrExpiredTokenErrUnauthorizedErrBadCommitmentErrNoRotationErrUnknownCurveErrInvalidPQKeyErrNoPQKeyErrReplayedRequestErrStaleRequestErrNotInLogErrInvalidLogRangeErrProtocolVersionErrTooManyLookupsErrWorkRequiredErrVerificationSentErrResendTooSoonErrTooManyAttemptsErrRateLimitedErrShuttingDownErrInvalidRoundRangeErrRegistrationClosedErrUsernameBlockedErrDomainQuotaErrCaptchaRequiredErrInvalidCaptchaErrRequestTooLargeErrServerBusyErrOldRoundErrLoginKeyRevokedErrNoRecoveryKeyErrTooManyDevicesErrNoDeviceKeyErrExtractQuotaErrUsernameReservedErrNotLeaderErrMaintenanceErrReadOnlyModeErrUnknown"
 
-var _ErrorCode_index = [...]uint8{0, 17, 33, 51, 69, 85, 105, 121, 146, 165, 180, 195, 210, 226, 236}
+var _ErrorCode_index = [...]uint16{0, 17, 33, 51, 69, 85, 105, 121, 146, 165, 180, 195, 210, 226, 239, 254, 269, 279, 297, 312, 323, 341, 359, 376, 391, 410, 426, 444, 458, 473, 493, 514, 532, 546, 564, 581, 599, 612, 623, 641, 657, 674, 688, 703, 722, 734, 748, 763, 773}
 
 func (i ErrorCode) String() string {
 	i -= 1
@@ -27,6 +27,40 @@ const (
 	ErrExpiredToken
 	ErrUnauthorized
 	ErrBadCommitment
+	ErrNoRotation
+	ErrUnknownCurve
+	ErrInvalidPQKey
+	ErrNoPQKey
+	ErrReplayedRequest
+	ErrStaleRequest
+	ErrNotInLog
+	ErrInvalidLogRange
+	ErrProtocolVersion
+	ErrTooManyLookups
+	ErrWorkRequired
+	ErrVerificationSent
+	ErrResendTooSoon
+	ErrTooManyAttempts
+	ErrRateLimited
+	ErrShuttingDown
+	ErrInvalidRoundRange
+	ErrRegistrationClosed
+	ErrUsernameBlocked
+	ErrDomainQuota
+	ErrCaptchaRequired
+	ErrInvalidCaptcha
+	ErrRequestTooLarge
+	ErrServerBusy
+	ErrOldRound
+	ErrLoginKeyRevoked
+	ErrNoRecoveryKey
+	ErrTooManyDevices
+	ErrNoDeviceKey
+	ErrExtractQuota
+	ErrUsernameReserved
+	ErrNotLeader
+	ErrMaintenance
+	ErrReadOnlyMode
 
 	ErrUnknown
 )
@@ -45,6 +79,40 @@ var errText = map[ErrorCode]string{
 	ErrExpiredToken:           "expired token",
 	ErrUnauthorized:           "unauthorized",
 	ErrBadCommitment:          "bad commitment",
+	ErrNoRotation:             "no pending login key rotation",
+	ErrUnknownCurve:           "pairing curve not served",
+	ErrInvalidPQKey:           "invalid PQ key",
+	ErrNoPQKey:                "no PQ key for user",
+	ErrReplayedRequest:        "replayed request",
+	ErrStaleRequest:           "request time outside replay window",
+	ErrNotInLog:               "entry not in log",
+	ErrInvalidLogRange:        "invalid log range",
+	ErrProtocolVersion:        "unsupported protocol version",
+	ErrTooManyLookups:         "too many distinct usernames looked up",
+	ErrWorkRequired:           "proof of work required",
+	ErrVerificationSent:       "verification code sent",
+	ErrResendTooSoon:          "verification code sent too recently",
+	ErrTooManyAttempts:        "too many wrong verification codes",
+	ErrRateLimited:            "too many requests",
+	ErrShuttingDown:           "server is shutting down",
+	ErrInvalidRoundRange:      "invalid round range",
+	ErrRegistrationClosed:     "registration is closed",
+	ErrUsernameBlocked:        "username is blocked",
+	ErrDomainQuota:            "too many registrations for domain today",
+	ErrCaptchaRequired:        "captcha required",
+	ErrInvalidCaptcha:         "invalid captcha",
+	ErrRequestTooLarge:        "request too large",
+	ErrServerBusy:             "server is busy",
+	ErrOldRound:               "round is not newer than the coordinator's last round",
+	ErrLoginKeyRevoked:        "login key revoked; verify the username again",
+	ErrNoRecoveryKey:          "no recovery key for user",
+	ErrTooManyDevices:         "too many device keys",
+	ErrNoDeviceKey:            "device key not enrolled",
+	ErrExtractQuota:           "extraction quota exceeded",
+	ErrUsernameReserved:       "username is reserved",
+	ErrNotLeader:              "server is not the cluster leader",
+	ErrMaintenance:            "server is down for maintenance",
+	ErrReadOnlyMode:           "server is read-only; registrations and key changes are disabled",
 
 	ErrUnknown: "unknown error",
 }
@@ -55,6 +123,14 @@ func (e ErrorCode) httpCode() int {
 		return http.StatusInternalServerError
 	case ErrUnauthorized:
 		return http.StatusUnauthorized
+	case ErrTooManyLookups, ErrResendTooSoon, ErrTooManyAttempts, ErrRateLimited, ErrDomainQuota, ErrExtractQuota:
+		return http.StatusTooManyRequests
+	case ErrVerificationSent:
+		return http.StatusAccepted
+	case ErrShuttingDown, ErrServerBusy, ErrNotLeader, ErrMaintenance, ErrReadOnlyMode:
+		return http.StatusServiceUnavailable
+	case ErrRequestTooLarge:
+		return http.StatusRequestEntityTooLarge
 	default:
 		return http.StatusBadRequest
 	}
@@ -100,6 +176,12 @@ func errorf(code ErrorCode, format string, args ...interface{}) Error {
 	}
 }
 
+// An errorRecorder is a ResponseWriter that notes the errors
+// written to it, for the server's metrics.
+type errorRecorder interface {
+	recordError(code ErrorCode)
+}
+
 func httpError(w http.ResponseWriter, err error) {
 	var pkgError Error
 	switch v := err.(type) {
@@ -114,6 +196,9 @@ func httpError(w http.ResponseWriter, err error) {
 		// this shouldn't happen
 		panic(err)
 	}
+	if rec, ok := w.(errorRecorder); ok {
+		rec.recordError(pkgError.Code)
+	}
 	httpCode := pkgError.Code.httpCode()
 	w.WriteHeader(httpCode)
 	w.Write(data)
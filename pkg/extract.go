@@ -2,103 +2,64 @@
 // Use of this source code is governed by the GNU AGPL
 // license that can be found in the LICENSE file.
 
+//go:build !js
+// +build !js
+
 package pkg
 
 import (
-	"bytes"
+	"context"
 	"crypto/ed25519"
-	"crypto/rand"
-	"encoding/binary"
 	"encoding/json"
+	"fmt"
 	"net/http"
+	"strconv"
 	"time"
 
-	"github.com/dgraph-io/badger"
-	"golang.org/x/crypto/nacl/box"
+	"go.opentelemetry.io/otel/trace"
 
+	"vuvuzela.io/alpenhorn/internal/fault"
+	"vuvuzela.io/alpenhorn/internal/keysafe"
+	"vuvuzela.io/alpenhorn/internal/tracing"
+	"vuvuzela.io/alpenhorn/internal/wire"
 	"vuvuzela.io/alpenhorn/log"
+	"vuvuzela.io/alpenhorn/pairing"
+	"vuvuzela.io/alpenhorn/pkg/kv"
 	"vuvuzela.io/crypto/bls"
 	"vuvuzela.io/crypto/ibe"
 )
 
-type extractArgs struct {
-	Round    uint32
-	Username string
-
-	// ReturnKey is a box key that is used to encrypt the
-	// extracted IBE private key.
-	ReturnKey *[32]byte
-
-	// UserLongTermKey is the user's long-term signing key.
-	// The PKG attests to this key in the extractReply.
-	UserLongTermKey ed25519.PublicKey
-
-	// ServerSigningKey ensures the request is tied to a single PKG.
-	// This field is set locally by the client and server, so it does
-	// not need to be included in the JSON request.
-	ServerSigningKey ed25519.PublicKey `json:"-"`
-
-	// Signature signs everything above with the user's login key.
-	Signature []byte
-}
-
-func (a *extractArgs) Sign(loginKey ed25519.PrivateKey) {
-	a.Signature = ed25519.Sign(loginKey, a.msg())
-}
-
-func (a *extractArgs) Verify(loginKey ed25519.PublicKey) bool {
-	return ed25519.Verify(loginKey, a.msg(), a.Signature)
-}
-
-func (a *extractArgs) msg() []byte {
-	buf := new(bytes.Buffer)
-	buf.WriteString("ExtractArgs")
-	buf.Write(a.ServerSigningKey)
-	binary.Write(buf, binary.BigEndian, a.Round)
-	id := ValidUsernameToIdentity(a.Username)
-	buf.Write(id[:])
-	buf.Write(a.ReturnKey[:])
-	buf.Write(a.UserLongTermKey)
-	return buf.Bytes()
-}
-
-type extractReply struct {
-	Round               uint32
-	Username            string
-	EncryptedPrivateKey []byte
-	Signature           []byte
-	IdentitySig         bls.Signature
-}
-
-func (r *extractReply) Sign(key ed25519.PrivateKey) {
-	r.Signature = ed25519.Sign(key, r.msg())
-}
-
-func (r *extractReply) Verify(key ed25519.PublicKey) bool {
-	return ed25519.Verify(key, r.msg(), r.Signature)
-}
-
-func (r *extractReply) msg() []byte {
-	buf := new(bytes.Buffer)
-	buf.WriteString("ExtractReply")
-	binary.Write(buf, binary.BigEndian, r.Round)
-	id := ValidUsernameToIdentity(r.Username)
-	buf.Write(id[:])
-	buf.Write(r.EncryptedPrivateKey)
-	return buf.Bytes()
-}
+// maxExtractArgsBytes caps extraction requests, which are larger with
+// a ReturnHybrid ML-KEM key.
+const maxExtractArgsBytes = 4096
 
 func (srv *Server) extractHandler(w http.ResponseWriter, req *http.Request) {
-	body := http.MaxBytesReader(w, req.Body, 1024)
+	body := http.MaxBytesReader(w, req.Body, maxExtractArgsBytes)
 	args := new(extractArgs)
 	err := json.NewDecoder(body).Decode(args)
 	if err != nil {
 		httpError(w, errorf(ErrBadRequestJSON, "%s", err))
 		return
 	}
+	if !srv.limitUsername(w, args.Username) {
+		return
+	}
 	args.ServerSigningKey = srv.publicKey
 
-	reply, err := srv.extract(args)
+	ctx, span := srv.startSpan(req.Context(), "pkg.extract",
+		trace.WithAttributes(tracing.Round(args.Round)))
+	start := time.Now()
+	reply, err := srv.extract(ctx, args)
+	tracing.End(span, err)
+	srv.roundStats.record(args.Round, time.Since(start), err)
+	srv.audit(&AuditEvent{
+		Type:     AuditExtract,
+		Username: args.Username,
+		Key:      KeyFingerprint(args.UserLongTermKey),
+		Round:    args.Round,
+		Result:   result(err),
+		RemoteIP: remoteIP(req),
+	})
 	if err != nil {
 		if isInternalError(err) {
 			srv.log.WithFields(log.Fields{
@@ -107,10 +68,19 @@ func (srv *Server) extractHandler(w http.ResponseWriter, req *http.Request) {
 				"code":     errorCode(err).String(),
 			}).Errorf("Extraction failed: %s", err)
 		}
-		httpError(w, err)
+		httpError(w, srv.lookupFailed(req, args.Username, err))
+		return
+	}
+	srv.metrics.extractLatency.Since(start)
+	srv.metrics.extractions.Inc(strconv.FormatUint(uint64(args.Round), 10))
+	srv.extractRate.add(srv.clock.Now())
+
+	if wire.Accepts(req.Header) {
+		bs, _ := reply.MarshalBinary()
+		w.Header().Set("Content-Type", wire.ContentType)
+		w.Write(bs)
 		return
 	}
-
 	bs, err := json.Marshal(reply)
 	if err != nil {
 		panic(err)
@@ -118,34 +88,24 @@ func (srv *Server) extractHandler(w http.ResponseWriter, req *http.Request) {
 	w.Write(bs)
 }
 
-// An Attestation attests that UserLongTermKey belongs to UserIdentity.
-// The attestation is signed using the AttestKey from a PKG server.
-type Attestation struct {
-	// AttestKey is included in the attestation message to satisfy the
-	// BLS requirement that messages must be distinct.
-	AttestKey       *bls.PublicKey
-	UserIdentity    *[64]byte
-	UserLongTermKey ed25519.PublicKey
-}
-
-func (a *Attestation) Marshal() []byte {
-	blsKeyBytes, _ := a.AttestKey.MarshalBinary()
-	buf := new(bytes.Buffer)
-	buf.Write(blsKeyBytes)
-	buf.Write(a.UserIdentity[:])
-	buf.Write([]byte(a.UserLongTermKey))
-	return buf.Bytes()
-}
-
-var zeroNonce = new([24]byte)
-
-func (srv *Server) extract(args *extractArgs) (*extractReply, error) {
-	srv.mu.Lock()
-	st, ok := srv.rounds[args.Round]
-	srv.mu.Unlock()
+func (srv *Server) extract(ctx context.Context, args *extractArgs) (*extractReply, error) {
+	if err := checkReturnKeys(args.ReturnVersion, args.ReturnKey, args.ReturnPQKey); err != nil {
+		return nil, err
+	}
+	st, ok := srv.getRound(args.Round)
 	if !ok {
 		return nil, errorf(ErrRoundNotFound, "%d", args.Round)
 	}
+	var curveKeys *curveRoundKeys
+	if args.Curve != "" && args.Curve != pairing.BN256 {
+		curveKeys = st.curves[args.Curve]
+		if curveKeys == nil {
+			return nil, errorf(ErrUnknownCurve, "round %d does not serve %q", args.Round, args.Curve)
+		}
+		if curveKeys.dkg != nil && curveKeys.Threshold == nil {
+			return nil, errorf(ErrRoundNotFound, "round %d: the %s DKG is not finished", args.Round, args.Curve)
+		}
+	}
 
 	if len(args.UserLongTermKey) != ed25519.PublicKeySize {
 		return nil, errorf(
@@ -156,74 +116,337 @@ func (srv *Server) extract(args *extractArgs) (*extractReply, error) {
 		)
 	}
 
+	if err := srv.checkBlocklist(args.Username); err != nil {
+		return nil, err
+	}
+	_, span := srv.startSpan(ctx, "pkg.db.getUser")
 	user, id, err := srv.getUser(nil, args.Username)
+	tracing.End(span, err)
 	if err != nil {
 		return nil, err
 	}
-	if !args.Verify(user.LoginKey) {
+	now := srv.clock.Now()
+	if !srv.verifyBound(&args.ServerSigningKey, func() bool { return user.verifyLogin(now, args.msg(), args.Signature) }) {
 		return nil, errorf(ErrInvalidSignature, "key=%x", user.LoginKey)
 	}
 
 	lastExtraction := lastExtraction{
 		Round:    args.Round,
-		UnixTime: time.Now().Unix(),
+		UnixTime: now.Unix(),
+	}
+	if err := fault.Inject(fault.PKGDB); err != nil {
+		return nil, errorf(ErrDatabaseError, "%s", err)
 	}
-	err = srv.db.Update(func(tx *badger.Txn) error {
+	_, span = srv.startSpan(ctx, "pkg.db.lastExtraction")
+	err = srv.db.Update(func(tx kv.Txn) error {
+		if err := checkReplay(tx, "extract", args.Signature, now); err != nil {
+			return err
+		}
+		if err := srv.extractCounts.take(srv.extractQuota, id, []uint32{args.Round}, now); err != nil {
+			return err
+		}
 		key := dbUserKey(id, lastExtractionSuffix)
 		return tx.Set(key, lastExtraction.Marshal())
 	})
-	if err != nil {
+	tracing.End(span, err)
+	if _, ok := err.(Error); ok {
+		return nil, err
+	} else if err != nil {
 		return nil, errorf(ErrDatabaseError, "%s", err)
 	}
 
-	idKeyBytes, _ := ibe.Extract(st.masterPrivateKey, id[:]).MarshalBinary()
-	publicKey, privateKey, err := box.GenerateKey(rand.Reader)
+	// Log the attestation before releasing it.
+	_, span = srv.startSpan(ctx, "pkg.db.logAttestation")
+	err = srv.logAttestation(id, args.UserLongTermKey, now)
+	tracing.End(span, err)
 	if err != nil {
-		panic("box.GenerateKey: " + err.Error())
+		return nil, err
 	}
-	ctxt := box.Seal(publicKey[:], idKeyBytes, zeroNonce, args.ReturnKey, privateKey)
 
-	attestation := &Attestation{
-		AttestKey:       st.blsPublicKey,
-		UserIdentity:    id,
-		UserLongTermKey: args.UserLongTermKey,
+	_, span = srv.startSpan(ctx, "pkg.extractKey")
+	reply, err := srv.extractKey(st, curveKeys, id, args)
+	tracing.End(span, err)
+	return reply, err
+}
+
+// extractKey extracts the user's identity key for the round, seals it
+// to args.ReturnKey, and attests to the user's long-term key.
+func (srv *Server) extractKey(st *roundState, curveKeys *curveRoundKeys, id *[64]byte, args *extractArgs) (*extractReply, error) {
+	var idKeyBytes []byte
+	var idSig []byte
+	var err error
+	srv.extractWorkers.do(func() {
+		idKeyBytes, idSig, err = identityKey(srv.roundKEK, st, curveKeys, id, args)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	ctxt, err := sealReturn(args.ReturnVersion, args.ReturnKey, args.ReturnPQKey, idKeyBytes)
+	keysafe.Zero(idKeyBytes)
+	if err != nil {
+		return nil, errorf(ErrBadRequestJSON, "%s", err)
 	}
-	idSig := bls.Sign(st.blsPrivateKey, attestation.Marshal())
 
 	reply := &extractReply{
 		Round:               args.Round,
 		Username:            args.Username,
 		EncryptedPrivateKey: ctxt,
 		IdentitySig:         idSig,
+		Curve:               args.Curve,
+	}
+	if err := srv.signExtractReply(reply); err != nil {
+		return nil, err
+	}
+
+	return reply, nil
+}
+
+// identityKey does the pairing operations of an extraction: it opens
+// the round's master secrets with kek, extracts the user's identity
+// key, and signs the attestation.
+func identityKey(kek *roundKEK, st *roundState, curveKeys *curveRoundKeys, id *[64]byte, args *extractArgs) (idKeyBytes []byte, idSig []byte, err error) {
+	if curveKeys != nil {
+		masterKey, err := kek.open(curveKeys.sealedMasterKey)
+		if err != nil {
+			return nil, nil, errorf(ErrUnknown, "%s", err)
+		}
+		idKeyBytes, err = curveKeys.curve.IBEExtract(masterKey, id[:])
+		keysafe.Zero(masterKey)
+		if err != nil {
+			return nil, nil, errorf(ErrUnknown, "%s extract: %s", args.Curve, err)
+		}
+		blsKey, err := kek.open(curveKeys.sealedBLSKey)
+		if err != nil {
+			keysafe.Zero(idKeyBytes)
+			return nil, nil, errorf(ErrUnknown, "%s", err)
+		}
+		msg := AttestationMessage(curveKeys.BLSPublicKey, id, args.UserLongTermKey)
+		idSig, err = curveKeys.curve.BLSSign(blsKey, msg)
+		keysafe.Zero(blsKey)
+		if err != nil {
+			keysafe.Zero(idKeyBytes)
+			return nil, nil, errorf(ErrUnknown, "%s attest: %s", args.Curve, err)
+		}
+		return idKeyBytes, idSig, nil
+	}
+
+	masterKey, blsKey, err := kek.openKeys(st)
+	if err != nil {
+		return nil, nil, errorf(ErrUnknown, "%s", err)
+	}
+	idKeyBytes, _ = ibe.Extract(masterKey, id[:]).MarshalBinary()
+	attestation := &Attestation{
+		AttestKey:       st.blsPublicKey,
+		UserIdentity:    id,
+		UserLongTermKey: args.UserLongTermKey,
+	}
+	idSig = bls.Sign(blsKey, attestation.Marshal())
+	return idKeyBytes, idSig, nil
+}
+
+func (srv *Server) extractBatchHandler(w http.ResponseWriter, req *http.Request) {
+	body := http.MaxBytesReader(w, req.Body, maxExtractArgsBytes)
+	args := new(extractBatchArgs)
+	err := json.NewDecoder(body).Decode(args)
+	if err != nil {
+		httpError(w, errorf(ErrBadRequestJSON, "%s", err))
+		return
+	}
+	if !srv.limitUsername(w, args.Username) {
+		return
+	}
+	args.ServerSigningKey = srv.publicKey
+
+	ctx, span := srv.startSpan(req.Context(), "pkg.extractBatch",
+		trace.WithAttributes(tracing.Round(args.FromRound)))
+	start := time.Now()
+	reply, err := srv.extractBatch(ctx, args)
+	tracing.End(span, err)
+	if err != nil {
+		srv.roundStats.record(args.FromRound, 0, err)
+	}
+	srv.audit(&AuditEvent{
+		Type:     AuditExtract,
+		Username: args.Username,
+		Key:      KeyFingerprint(args.UserLongTermKey),
+		Round:    args.FromRound,
+		Detail:   fmt.Sprintf("rounds %d-%d", args.FromRound, args.ToRound),
+		Result:   result(err),
+		RemoteIP: remoteIP(req),
+	})
+	if err != nil {
+		if isInternalError(err) {
+			srv.log.WithFields(log.Fields{
+				"fromRound": args.FromRound,
+				"toRound":   args.ToRound,
+				"username":  args.Username,
+				"code":      errorCode(err).String(),
+			}).Errorf("Batch extraction failed: %s", err)
+		}
+		httpError(w, srv.lookupFailed(req, args.Username, err))
+		return
+	}
+	srv.metrics.extractLatency.Since(start)
+	for _, r := range reply.Replies {
+		srv.metrics.extractions.Inc(strconv.FormatUint(uint64(r.Round), 10))
+		srv.roundStats.record(r.Round, 0, nil)
+		srv.extractRate.add(srv.clock.Now())
+	}
+
+	bs, err := json.Marshal(reply)
+	if err != nil {
+		panic(err)
+	}
+	w.Write(bs)
+}
+
+// extractBatch extracts the user's keys for each round in the range
+// that the server has keys for. It is like a series of calls to
+// extract, but the request is checked, and the attestation logged,
+// only once.
+func (srv *Server) extractBatch(ctx context.Context, args *extractBatchArgs) (*extractBatchReply, error) {
+	if args.ToRound < args.FromRound || args.ToRound-args.FromRound >= MaxExtractBatch {
+		return nil, errorf(ErrInvalidRoundRange, "%d-%d (at most %d rounds)", args.FromRound, args.ToRound, MaxExtractBatch)
+	}
+	if len(args.UserLongTermKey) != ed25519.PublicKeySize {
+		return nil, errorf(
+			ErrInvalidUserLongTermKey,
+			"got %d bytes, want %d",
+			len(args.UserLongTermKey),
+			ed25519.PublicKeySize,
+		)
+	}
+	if err := checkReturnKeys(args.ReturnVersion, args.ReturnKey, args.ReturnPQKey); err != nil {
+		return nil, err
+	}
+
+	var rounds []uint32
+	states := make(map[uint32]*roundState)
+	for round := args.FromRound; ; round++ {
+		if st, ok := srv.getRound(round); ok {
+			rounds = append(rounds, round)
+			states[round] = st
+		}
+		if round == args.ToRound {
+			break
+		}
+	}
+	if len(rounds) == 0 {
+		return nil, errorf(ErrRoundNotFound, "%d-%d", args.FromRound, args.ToRound)
 	}
-	reply.Sign(srv.privateKey)
 
+	if err := srv.checkBlocklist(args.Username); err != nil {
+		return nil, err
+	}
+	_, span := srv.startSpan(ctx, "pkg.db.getUser")
+	user, id, err := srv.getUser(nil, args.Username)
+	tracing.End(span, err)
+	if err != nil {
+		return nil, err
+	}
+	now := srv.clock.Now()
+	if !srv.verifyBound(&args.ServerSigningKey, func() bool { return user.verifyLogin(now, args.msg(), args.Signature) }) {
+		return nil, errorf(ErrInvalidSignature, "key=%x", user.LoginKey)
+	}
+
+	lastExtraction := lastExtraction{
+		Round:    rounds[len(rounds)-1],
+		UnixTime: now.Unix(),
+	}
+	if err := fault.Inject(fault.PKGDB); err != nil {
+		return nil, errorf(ErrDatabaseError, "%s", err)
+	}
+	_, span = srv.startSpan(ctx, "pkg.db.lastExtraction")
+	err = srv.db.Update(func(tx kv.Txn) error {
+		if err := checkReplay(tx, "extractbatch", args.Signature, now); err != nil {
+			return err
+		}
+		if err := srv.extractCounts.take(srv.extractQuota, id, rounds, now); err != nil {
+			return err
+		}
+		key := dbUserKey(id, lastExtractionSuffix)
+		return tx.Set(key, lastExtraction.Marshal())
+	})
+	tracing.End(span, err)
+	if _, ok := err.(Error); ok {
+		return nil, err
+	} else if err != nil {
+		return nil, errorf(ErrDatabaseError, "%s", err)
+	}
+
+	_, span = srv.startSpan(ctx, "pkg.db.logAttestation")
+	err = srv.logAttestation(id, args.UserLongTermKey, now)
+	tracing.End(span, err)
+	if err != nil {
+		return nil, err
+	}
+
+	reply := &extractBatchReply{
+		Replies: make([]*extractReply, len(rounds)),
+	}
+	_, span = srv.startSpan(ctx, "pkg.extractKey")
+	for i, round := range rounds {
+		reply.Replies[i], err = srv.extractKey(states[round], nil, id, &extractArgs{
+			Round:           round,
+			Username:        args.Username,
+			ReturnKey:       args.ReturnKey,
+			ReturnVersion:   args.ReturnVersion,
+			ReturnPQKey:     args.ReturnPQKey,
+			UserLongTermKey: args.UserLongTermKey,
+		})
+		if err != nil {
+			break
+		}
+	}
+	tracing.End(span, err)
+	if err != nil {
+		return nil, err
+	}
 	return reply, nil
 }
 
-func (srv *Server) getUser(tx *badger.Txn, username string) (user userState, id *[64]byte, err error) {
+// getUser looks up a registered user. If tx is nil, the user is read
+// in a new transaction on the primary database, never the replica:
+// a lagging replica would keep accepting a login key after the user
+// revoked or rotated it. If the user revoked their login key, getUser
+// returns the user along with ErrLoginKeyRevoked.
+func (srv *Server) getUser(tx kv.Txn, username string) (user userState, id *[64]byte, err error) {
 	id, err = UsernameToIdentity(username)
 	if err != nil {
 		return user, id, errorf(ErrInvalidUsername, "%s", err)
 	}
 
-	if tx == nil {
-		tx = srv.db.NewTransaction(false)
-		defer tx.Discard()
+	if err := fault.Inject(fault.PKGDB); err != nil {
+		return user, id, errorf(ErrDatabaseError, "%s", err)
 	}
 
-	item, err := tx.Get(dbUserKey(id, registrationSuffix))
-	if err == badger.ErrKeyNotFound {
+	var data []byte
+	if tx == nil {
+		err = srv.db.View(func(tx kv.Txn) error {
+			v, err := tx.Get(dbUserKey(id, registrationSuffix))
+			data = append([]byte(nil), v...)
+			return err
+		})
+	} else {
+		data, err = tx.Get(dbUserKey(id, registrationSuffix))
+	}
+	if err == kv.ErrNotFound {
+		// Registered users keep usernames that a later policy
+		// rejects, so the policy only explains why others are not.
+		if _, err := srv.checkUsername(username); err != nil {
+			return user, id, err
+		}
 		return user, id, errorf(ErrNotRegistered, "%q", username)
 	}
 	if err != nil {
 		return user, id, errorf(ErrDatabaseError, "%s", err)
 	}
-	err = item.Value(func(data []byte) error {
-		return user.Unmarshal(data)
-	})
-	if err != nil {
+	if err := user.Unmarshal(data); err != nil {
 		return user, id, errorf(ErrDatabaseError, "%s", err)
 	}
+	if user.Revoked {
+		return user, id, errorf(ErrLoginKeyRevoked, "%q", username)
+	}
 	return user, id, nil
 }
@@ -0,0 +1,90 @@
+// Copyright 2018 David Lazar. All rights reserved.
+// Use of this source code is governed by the GNU AGPL
+// license that can be found in the LICENSE file.
+
+//go:build !js
+// +build !js
+
+package pkg
+
+import (
+	"sync"
+	"time"
+)
+
+// An honest client extracts its key for each round once, and again
+// only if something went wrong. Extraction quotas cap how many keys a
+// user may extract, so someone holding a stolen login key cannot
+// extract the user's keys over and over without the server noticing.
+// Extractions over the quota fail with ErrExtractQuota, which clients
+// report as a sign that the login key may be compromised.
+//
+// Only extractions with a valid signature that is not a replay count
+// against the quota, so nobody but the holder of a login key can use
+// up its user's quota. The counts are kept in memory: they reset at
+// the start of each attestation epoch and when the server restarts.
+
+// An ExtractQuota caps the extractions of each user. Zero fields are
+// not limited.
+type ExtractQuota struct {
+	// PerRound is how many times a user may extract their key for
+	// one round.
+	PerRound int
+
+	// PerEpoch is how many keys a user may extract in an attestation
+	// epoch (AttestationEpochLength), across all rounds.
+	PerEpoch int
+}
+
+func (q ExtractQuota) enabled() bool {
+	return q.PerRound > 0 || q.PerEpoch > 0
+}
+
+type extractCounter struct {
+	mu    sync.Mutex
+	epoch uint32
+	users map[[64]byte]*userExtractions
+}
+
+type userExtractions struct {
+	total  int
+	rounds map[uint32]int
+}
+
+// take counts an extraction by the user id of their keys for rounds.
+// If the extraction would put the user over quota, take counts nothing
+// and returns ErrExtractQuota.
+func (c *extractCounter) take(quota ExtractQuota, id *[64]byte, rounds []uint32, now time.Time) error {
+	if !quota.enabled() {
+		return nil
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	epoch := AttestationEpoch(now)
+	if c.users == nil || epoch != c.epoch {
+		c.epoch = epoch
+		c.users = make(map[[64]byte]*userExtractions)
+	}
+	u := c.users[*id]
+	if u == nil {
+		u = &userExtractions{rounds: make(map[uint32]int)}
+		c.users[*id] = u
+	}
+
+	if quota.PerEpoch > 0 && u.total+len(rounds) > quota.PerEpoch {
+		return errorf(ErrExtractQuota, "%d extractions per epoch", quota.PerEpoch)
+	}
+	if quota.PerRound > 0 {
+		for _, r := range rounds {
+			if u.rounds[r] >= quota.PerRound {
+				return errorf(ErrExtractQuota, "%d extractions of round %d", quota.PerRound, r)
+			}
+		}
+	}
+	u.total += len(rounds)
+	for _, r := range rounds {
+		u.rounds[r]++
+	}
+	return nil
+}
@@ -0,0 +1,100 @@
+// Copyright 2018 David Lazar. All rights reserved.
+// Use of this source code is governed by the GNU AGPL
+// license that can be found in the LICENSE file.
+
+package pkg
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"testing"
+	"time"
+
+	"vuvuzela.io/alpenhorn/clock"
+	"vuvuzela.io/alpenhorn/pkg/kv"
+	"vuvuzela.io/crypto/bls"
+	"vuvuzela.io/crypto/ibe"
+)
+
+func TestExtractQuota(t *testing.T) {
+	mockClock := clock.NewMock(time.Now())
+	_, serverKey, _ := ed25519.GenerateKey(rand.Reader)
+	srv, err := NewServer(&Config{
+		DB:               kv.NewMemory(),
+		SigningKey:       serverKey,
+		RegistrationMode: RegistrationFCFS,
+		ExtractQuota:     ExtractQuota{PerRound: 2, PerEpoch: 3},
+		Clock:            mockClock,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+
+	loginPub, loginPriv, _ := ed25519.GenerateKey(rand.Reader)
+	if _, err := srv.register(&registerArgs{Username: "alice@example.org", LoginKey: loginPub}); err != nil {
+		t.Fatal(err)
+	}
+	for _, round := range []uint32{1, 2} {
+		ibePub, ibePriv := ibe.Setup(rand.Reader)
+		blsPub, blsPriv, _ := bls.GenerateKey(rand.Reader)
+		sealedMaster, sealedBLS := srv.roundKEK.sealKeys(ibePriv, blsPriv)
+		srv.rounds[round] = &roundState{
+			masterPublicKey: ibePub,
+			sealedMasterKey: sealedMaster,
+			blsPublicKey:    blsPub,
+			sealedBLSKey:    sealedBLS,
+			committed:       mockClock.Now(),
+		}
+	}
+
+	longTermPub, _, _ := ed25519.GenerateKey(rand.Reader)
+	extract := func(round uint32, loginKey ed25519.PrivateKey) error {
+		// A fresh return key keeps the requests from being replays.
+		returnKey := new([32]byte)
+		rand.Read(returnKey[:])
+		args := &extractArgs{
+			Round:            round,
+			Username:         "alice@example.org",
+			ReturnKey:        returnKey,
+			UserLongTermKey:  longTermPub,
+			ServerSigningKey: srv.publicKey,
+		}
+		if err := args.Sign(loginKey); err != nil {
+			t.Fatal(err)
+		}
+		_, err := srv.extract(context.Background(), args)
+		return err
+	}
+
+	// Requests that are not signed with the login key do not use up
+	// the user's quota.
+	_, otherKey, _ := ed25519.GenerateKey(rand.Reader)
+	for i := 0; i < 5; i++ {
+		if err := extract(1, otherKey); errorCode(err) != ErrInvalidSignature {
+			t.Fatalf("expected ErrInvalidSignature, got %v", err)
+		}
+	}
+
+	for i := 0; i < 2; i++ {
+		if err := extract(1, loginPriv); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := extract(1, loginPriv); errorCode(err) != ErrExtractQuota {
+		t.Fatalf("expected ErrExtractQuota for the round, got %v", err)
+	}
+	if err := extract(2, loginPriv); err != nil {
+		t.Fatal(err)
+	}
+	if err := extract(2, loginPriv); errorCode(err) != ErrExtractQuota {
+		t.Fatalf("expected ErrExtractQuota for the epoch, got %v", err)
+	}
+
+	// The quota resets in the next epoch.
+	mockClock.Add(AttestationEpochLength)
+	if err := extract(2, loginPriv); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,192 @@
+// Copyright 2018 David Lazar. All rights reserved.
+// Use of this source code is governed by the GNU AGPL
+// license that can be found in the LICENSE file.
+
+package pkg
+
+import (
+	"crypto/mlkem"
+	"crypto/rand"
+	"crypto/sha256"
+
+	"golang.org/x/crypto/nacl/box"
+	"golang.org/x/crypto/nacl/secretbox"
+
+	"vuvuzela.io/alpenhorn/errors"
+	"vuvuzela.io/alpenhorn/internal/keysafe"
+)
+
+// Return versions select how the server encrypts the extracted key for
+// the client. The client picks one with extractArgs.ReturnVersion and
+// signs it with the rest of the request, so it cannot be downgraded.
+const (
+	// ReturnBox seals the key in a NaCl box to the client's ephemeral
+	// X25519 ReturnKey. Anyone who records the reply and later solves
+	// the discrete log for ReturnKey, such as with a quantum computer,
+	// can decrypt it.
+	ReturnBox = 0
+
+	// ReturnHybrid also encapsulates a secret to the client's
+	// ephemeral ML-KEM-768 (Kyber) ReturnPQKey, and seals the key
+	// under both shared secrets, so the reply stays confidential
+	// unless both X25519 and ML-KEM are broken. Servers from before
+	// this version reject it with ErrInvalidSignature.
+	ReturnHybrid = 1
+)
+
+// ReturnHybridOverhead is how much longer a ReturnHybrid ciphertext is
+// than the extracted key.
+const ReturnHybridOverhead = 32 + mlkem.CiphertextSize768 + secretbox.Overhead
+
+// The keys are fresh for every reply, so a fixed nonce is safe.
+var returnNonce = new([24]byte)
+
+// checkReturnKeys checks the return keys in an extraction request.
+func checkReturnKeys(version int, returnKey *[32]byte, pqKey []byte) error {
+	if returnKey == nil {
+		return errorf(ErrBadRequestJSON, "no return key")
+	}
+	switch version {
+	case ReturnBox:
+		if pqKey != nil {
+			return errorf(ErrBadRequestJSON, "return PQ key without ReturnHybrid")
+		}
+	case ReturnHybrid:
+		if len(pqKey) != mlkem.EncapsulationKeySize768 {
+			return errorf(ErrBadRequestJSON, "return PQ key has %d bytes, want %d", len(pqKey), mlkem.EncapsulationKeySize768)
+		}
+	default:
+		return errorf(ErrBadRequestJSON, "unknown return version %d", version)
+	}
+	return nil
+}
+
+// sealReturn encrypts the extracted key msg to the client's return keys.
+func sealReturn(version int, returnKey *[32]byte, pqKey []byte, msg []byte) ([]byte, error) {
+	publicKey, privateKey, err := box.GenerateKey(rand.Reader)
+	if err != nil {
+		panic("box.GenerateKey: " + err.Error())
+	}
+	defer keysafe.Zero32(privateKey)
+	if version == ReturnBox {
+		return box.Seal(publicKey[:], msg, returnNonce, returnKey, privateKey), nil
+	}
+
+	ek, err := mlkem.NewEncapsulationKey768(pqKey)
+	if err != nil {
+		return nil, errors.Wrap(err, "parsing return PQ key")
+	}
+	pqShared, kemCtxt := ek.Encapsulate()
+	dhShared := new([32]byte)
+	box.Precompute(dhShared, returnKey, privateKey)
+	key := hybridReturnKey(dhShared, pqShared, publicKey, returnKey, kemCtxt)
+	keysafe.Zero32(dhShared)
+	keysafe.Zero(pqShared)
+	defer keysafe.Zero32(key)
+
+	out := make([]byte, 0, len(msg)+ReturnHybridOverhead)
+	out = append(out, publicKey[:]...)
+	out = append(out, kemCtxt...)
+	return secretbox.Seal(out, msg, returnNonce, key), nil
+}
+
+// openHybridReturn decrypts a ReturnHybrid ciphertext with the
+// client's ephemeral return keys.
+func openHybridReturn(myPub, myPriv *[32]byte, dk *mlkem.DecapsulationKey768, ctxt []byte) ([]byte, error) {
+	if len(ctxt) < ReturnHybridOverhead {
+		return nil, errors.New("unexpectedly short ciphertext (%d bytes)", len(ctxt))
+	}
+	theirPub := new([32]byte)
+	copy(theirPub[:], ctxt[:32])
+	kemCtxt := ctxt[32 : 32+mlkem.CiphertextSize768]
+	pqShared, err := dk.Decapsulate(kemCtxt)
+	if err != nil {
+		return nil, errors.Wrap(err, "decapsulating")
+	}
+	dhShared := new([32]byte)
+	box.Precompute(dhShared, theirPub, myPriv)
+	key := hybridReturnKey(dhShared, pqShared, theirPub, myPub, kemCtxt)
+	keysafe.Zero32(dhShared)
+	keysafe.Zero(pqShared)
+	defer keysafe.Zero32(key)
+
+	msg, ok := secretbox.Open(nil, ctxt[32+mlkem.CiphertextSize768:], returnNonce, key)
+	if !ok {
+		return nil, errors.New("secretbox authentication failed")
+	}
+	return msg, nil
+}
+
+// hybridReturnKey combines the X25519 and ML-KEM shared secrets into
+// the key that seals a ReturnHybrid reply. It hashes in the ephemeral
+// public keys and the ML-KEM ciphertext as well, so the key is bound
+// to this exchange even if one of the two KEMs is broken.
+func hybridReturnKey(dhShared *[32]byte, pqShared []byte, serverPub, clientPub *[32]byte, kemCtxt []byte) *[32]byte {
+	h := sha256.New()
+	h.Write([]byte("AlpenhornExtractReturnHybrid"))
+	h.Write(dhShared[:])
+	h.Write(pqShared)
+	h.Write(serverPub[:])
+	h.Write(clientPub[:])
+	h.Write(kemCtxt)
+	key := new([32]byte)
+	h.Sum(key[:0])
+	return key
+}
+
+// returnKeys are the ephemeral keys a client receives extracted keys
+// with.
+type returnKeys struct {
+	version int
+	pub     *[32]byte
+	priv    *[32]byte
+	pq      *mlkem.DecapsulationKey768
+}
+
+func newReturnKeys(version int) (*returnKeys, error) {
+	pub, priv, err := box.GenerateKey(rand.Reader)
+	if err != nil {
+		panic("box.GenerateKey: " + err.Error())
+	}
+	k := &returnKeys{version: version, pub: pub, priv: priv}
+	switch version {
+	case ReturnBox:
+	case ReturnHybrid:
+		k.pq, err = mlkem.GenerateKey768()
+		if err != nil {
+			panic("mlkem.GenerateKey768: " + err.Error())
+		}
+	default:
+		return nil, errors.New("unknown return version %d", version)
+	}
+	return k, nil
+}
+
+// pqKey returns the ML-KEM encapsulation key to send as ReturnPQKey,
+// or nil.
+func (k *returnKeys) pqKey() []byte {
+	if k.pq == nil {
+		return nil
+	}
+	return k.pq.EncapsulationKey().Bytes()
+}
+
+func (k *returnKeys) open(ctxt []byte) ([]byte, error) {
+	if k.version == ReturnHybrid {
+		return openHybridReturn(k.pub, k.priv, k.pq, ctxt)
+	}
+	if len(ctxt) < 32 {
+		return nil, errors.New("unexpectedly short ciphertext (%d bytes)", len(ctxt))
+	}
+	theirPub := new([32]byte)
+	copy(theirPub[:], ctxt[0:32])
+	msg, ok := box.Open(nil, ctxt[32:], returnNonce, theirPub, k.priv)
+	if !ok {
+		return nil, errors.New("box authentication failed")
+	}
+	return msg, nil
+}
+
+func (k *returnKeys) destroy() {
+	keysafe.Zero32(k.priv)
+}
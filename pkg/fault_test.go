@@ -0,0 +1,58 @@
+// Copyright 2018 David Lazar. All rights reserved.
+// Use of this source code is governed by the GNU AGPL
+// license that can be found in the LICENSE file.
+
+//go:build faults
+// +build faults
+
+package pkg_test
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"testing"
+
+	"vuvuzela.io/alpenhorn/edhttp"
+	"vuvuzela.io/alpenhorn/internal/fault"
+	"vuvuzela.io/alpenhorn/pkg"
+)
+
+func TestRegisterFailsSafe(t *testing.T) {
+	testpkg, _ := launchPKG(t, func(username string, token string) error {
+		return nil
+	})
+	defer testpkg.Close()
+	defer fault.Reset()
+
+	alicePub, alicePriv, _ := ed25519.GenerateKey(rand.Reader)
+	client := &pkg.Client{
+		Username:        "alice@example.org",
+		LoginKey:        alicePriv,
+		UserLongTermKey: alicePub,
+		HTTPClient:      new(edhttp.Client),
+	}
+
+	fault.Set(fault.PKGDB, fault.Rule{Drop: 1})
+	err := client.Register(testpkg.PublicServerConfig, "token")
+	if e, ok := err.(pkg.Error); !ok || e.Code != pkg.ErrDatabaseError {
+		t.Fatalf("expected database error, got %v", err)
+	}
+
+	usernames, err := testpkg.PKGServer.RegisteredUsernames()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(usernames) != 0 {
+		t.Fatalf("failed registration left state behind: %v", usernames)
+	}
+
+	fault.Reset()
+	if err := client.Register(testpkg.PublicServerConfig, "token"); err != nil {
+		t.Fatalf("register after faults cleared: %s", err)
+	}
+
+	fault.Set(fault.EdHTTP, fault.Rule{Drop: 1})
+	if err := client.CheckStatus(testpkg.PublicServerConfig); err == nil {
+		t.Fatal("expected error with all requests dropped")
+	}
+}
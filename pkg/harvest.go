@@ -0,0 +1,201 @@
+// Copyright 2018 David Lazar. All rights reserved.
+// Use of this source code is governed by the GNU AGPL
+// license that can be found in the LICENSE file.
+
+//go:build !js
+// +build !js
+
+package pkg
+
+import (
+	"container/list"
+	"crypto/ed25519"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/davidlazar/go-crypto/encoding/base32"
+
+	"vuvuzela.io/alpenhorn/log"
+	"vuvuzela.io/alpenhorn/pkg/kv"
+)
+
+// The status, extract, and PQ key endpoints answer differently for
+// registered and unregistered usernames, so they can be used to
+// enumerate or monitor the user base. An honest client only ever looks
+// up a handful of usernames (its own, and its friends' PQ keys), so the
+// PKG counts the distinct usernames each client asks about and refuses
+// clients that exceed Config.LookupLimit.
+//
+// Clients are counted by IP address, or by /64 prefix for IPv6, since
+// a TLS key costs nothing to make: a client that presents one is also
+// counted by its key, and is refused if either count is over the
+// limit. Many users may share an address behind a NAT, so a status or
+// extraction request that the user signed for their own username is
+// not counted; only the requests that fail, which may be probes of
+// someone else's username, are. The server remembers at most
+// maxLookupClients clients, forgetting those whose windows started
+// longest ago, so a client that churns through addresses cannot grow
+// the tracker without bound.
+
+// DefaultLookupWindow is the window that lookup limits apply to when
+// Config.LookupWindow is zero.
+const DefaultLookupWindow = time.Hour
+
+// maxLookupClients caps the clients a lookupTracker remembers.
+var maxLookupClients = 1 << 16
+
+type lookupTracker struct {
+	mu      sync.Mutex
+	clients map[string]*list.Element
+
+	// order holds the *clientLookups, oldest window first.
+	order list.List
+}
+
+type clientLookups struct {
+	client    string
+	start     time.Time
+	usernames map[string]bool
+	flagged   bool
+}
+
+// check records that client looked up username. It reports whether
+// the client is over the limit, and whether this is the first lookup
+// over the limit in the current window.
+func (t *lookupTracker) check(client, username string, now time.Time, limit int, window time.Duration) (exceeded, first bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.clients == nil {
+		t.clients = make(map[string]*list.Element)
+	}
+	for e := t.order.Front(); e != nil; e = t.order.Front() {
+		if now.Sub(e.Value.(*clientLookups).start) < window {
+			break
+		}
+		t.remove(e)
+	}
+
+	e := t.clients[client]
+	if e != nil && now.Sub(e.Value.(*clientLookups).start) >= window {
+		// The windows are out of order, as after the clock went
+		// backwards, so the sweep above missed this one.
+		t.remove(e)
+		e = nil
+	}
+	if e == nil {
+		for len(t.clients) >= maxLookupClients {
+			t.remove(t.order.Front())
+		}
+		e = t.order.PushBack(&clientLookups{
+			client:    client,
+			start:     now,
+			usernames: make(map[string]bool),
+		})
+		t.clients[client] = e
+	}
+	cl := e.Value.(*clientLookups)
+	if cl.usernames[username] {
+		return false, false
+	}
+	if len(cl.usernames) >= limit {
+		first = !cl.flagged
+		cl.flagged = true
+		return true, first
+	}
+	cl.usernames[username] = true
+	return false, false
+}
+
+func (t *lookupTracker) remove(e *list.Element) {
+	t.order.Remove(e)
+	delete(t.clients, e.Value.(*clientLookups).client)
+}
+
+// lookupClients returns the counts that a lookup in req goes against:
+// the client's address, and its TLS key if it presented one.
+func lookupClients(req *http.Request) []string {
+	clients := []string{"ip:" + lookupAddr(req)}
+	if req.TLS != nil && len(req.TLS.PeerCertificates) > 0 {
+		if key, ok := req.TLS.PeerCertificates[0].PublicKey.(ed25519.PublicKey); ok {
+			clients = append(clients, "key:"+base32.EncodeToString(key))
+		}
+	}
+	return clients
+}
+
+// lookupAddr returns the client's IP address, or its /64 prefix if it
+// is an IPv6 address, since a host may have a whole /64 to itself.
+func lookupAddr(req *http.Request) string {
+	addr := remoteIP(req)
+	ip := net.ParseIP(addr)
+	if ip == nil || ip.To4() != nil {
+		return addr
+	}
+	return ip.Mask(net.CIDRMask(64, 128)).String() + "/64"
+}
+
+// checkLookup throttles clients that look up too many distinct
+// usernames, logging a warning the first time a client goes over.
+func (srv *Server) checkLookup(req *http.Request, username string) error {
+	if srv.lookupLimit <= 0 {
+		return nil
+	}
+	now := srv.clock.Now()
+	var err error
+	for _, client := range lookupClients(req) {
+		exceeded, first := srv.lookups.check(client, username, now, srv.lookupLimit, srv.lookupWindow)
+		if !exceeded {
+			continue
+		}
+		if first {
+			srv.log.WithFields(log.Fields{
+				"client": client,
+				"limit":  srv.lookupLimit,
+				"window": srv.lookupWindow,
+			}).Warnf("Possible username harvesting: client exceeded lookup limit")
+		}
+		err = errorf(ErrTooManyLookups, "limit is %d per %s", srv.lookupLimit, srv.lookupWindow)
+	}
+	return err
+}
+
+// lookupFailed counts a failed status or extraction request for
+// username, which may be a probe of someone else's username, and
+// returns ErrTooManyLookups instead of err if the client is over the
+// limit. Requests that succeed are the user's own, and are not
+// counted.
+func (srv *Server) lookupFailed(req *http.Request, username string, err error) error {
+	if lerr := srv.checkLookup(req, username); lerr != nil {
+		return lerr
+	}
+	return err
+}
+
+// checkWork verifies that stamp is a recent proof of work on the
+// lookup of username, and spends it, so it cannot be used again.
+func (srv *Server) checkWork(username string, stamp *WorkStamp, now time.Time) error {
+	if srv.lookupWorkBits <= 0 {
+		return nil
+	}
+	if stamp == nil {
+		return errorf(ErrWorkRequired, "%d", srv.lookupWorkBits)
+	}
+	t := time.Unix(stamp.Time, 0)
+	if t.Before(now.Add(-workWindow)) || t.After(now.Add(workWindow)) {
+		return errorf(ErrStaleRequest, "%s", t.UTC().Format(time.RFC3339))
+	}
+	h := workHash(srv.publicKey, username, stamp)
+	if leadingZeros(h) < srv.lookupWorkBits {
+		return errorf(ErrWorkRequired, "%d", srv.lookupWorkBits)
+	}
+	err := srv.db.Update(func(tx kv.Txn) error {
+		return checkSpent(tx, "work", h[:], now, 2*workWindow)
+	})
+	if _, ok := err.(Error); !ok && err != nil {
+		return errorf(ErrDatabaseError, "%s", err)
+	}
+	return err
+}
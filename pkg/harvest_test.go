@@ -0,0 +1,189 @@
+// Copyright 2018 David Lazar. All rights reserved.
+// Use of this source code is governed by the GNU AGPL
+// license that can be found in the LICENSE file.
+
+package pkg
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"vuvuzela.io/alpenhorn/pkg/kv"
+)
+
+func TestLookupTracker(t *testing.T) {
+	var tr lookupTracker
+	now := time.Now()
+	window := time.Hour
+
+	for i := 0; i < 3; i++ {
+		// Repeated lookups of the same username are free.
+		for j := 0; j < 2; j++ {
+			if exceeded, _ := tr.check("ip:1.2.3.4", fmt.Sprintf("user%d@example.org", i), now, 3, window); exceeded {
+				t.Fatalf("lookup %d: unexpectedly exceeded", i)
+			}
+		}
+	}
+	exceeded, first := tr.check("ip:1.2.3.4", "user3@example.org", now, 3, window)
+	if !exceeded || !first {
+		t.Fatalf("expected first excess lookup, got exceeded=%v first=%v", exceeded, first)
+	}
+	exceeded, first = tr.check("ip:1.2.3.4", "user4@example.org", now, 3, window)
+	if !exceeded || first {
+		t.Fatalf("expected repeated excess lookup, got exceeded=%v first=%v", exceeded, first)
+	}
+	if exceeded, _ := tr.check("ip:1.2.3.4", "user0@example.org", now, 3, window); exceeded {
+		t.Fatal("lookup of an already-seen username should be allowed")
+	}
+	if exceeded, _ := tr.check("ip:5.6.7.8", "user4@example.org", now, 3, window); exceeded {
+		t.Fatal("limits should be per client")
+	}
+	if exceeded, _ := tr.check("ip:1.2.3.4", "user4@example.org", now.Add(window), 3, window); exceeded {
+		t.Fatal("limit should reset after the window")
+	}
+}
+
+func TestLookupTrackerBound(t *testing.T) {
+	defer func(n int) { maxLookupClients = n }(maxLookupClients)
+	maxLookupClients = 10
+
+	var tr lookupTracker
+	now := time.Now()
+	window := time.Hour
+	for i := 0; i < 3; i++ {
+		tr.check("ip:1.2.3.4", fmt.Sprintf("user%d@example.org", i), now, 3, window)
+	}
+	// A client churning through addresses within the window.
+	for i := 0; i < 100; i++ {
+		tr.check(fmt.Sprintf("ip:10.0.0.%d", i), "alice@example.org", now.Add(time.Duration(i)*time.Second), 3, window)
+		if len(tr.clients) > maxLookupClients || tr.order.Len() != len(tr.clients) {
+			t.Fatalf("tracker holds %d clients (%d in order), want at most %d", len(tr.clients), tr.order.Len(), maxLookupClients)
+		}
+	}
+	// The oldest client was forgotten.
+	if _, ok := tr.clients["ip:1.2.3.4"]; ok {
+		t.Fatal("oldest client was not evicted")
+	}
+	if _, ok := tr.clients["ip:10.0.0.99"]; !ok {
+		t.Fatal("newest client was evicted")
+	}
+
+	// Clients whose windows are over are swept.
+	tr.check("ip:5.6.7.8", "alice@example.org", now.Add(2*window), 3, window)
+	if len(tr.clients) != 1 {
+		t.Fatalf("tracker holds %d clients after the window, want 1", len(tr.clients))
+	}
+}
+
+func TestLookupLimitHTTP(t *testing.T) {
+	_, serverKey, _ := ed25519.GenerateKey(rand.Reader)
+	srv, err := NewServer(&Config{
+		DB:               kv.NewMemory(),
+		SigningKey:       serverKey,
+		RegistrationMode: RegistrationFCFS,
+		LookupLimit:      2,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+
+	alicePub, alicePriv, _ := ed25519.GenerateKey(rand.Reader)
+	if _, err := srv.register(&registerArgs{Username: "alice@example.org", LoginKey: alicePub}); err != nil {
+		t.Fatal(err)
+	}
+
+	// status posts a status request from addr with a fresh TLS key,
+	// as a harvester that makes a key per connection would.
+	status := func(addr string, args *statusArgs) *httptest.ResponseRecorder {
+		body, _ := json.Marshal(args)
+		req := httptest.NewRequest("POST", "/status", bytes.NewReader(body))
+		req.RemoteAddr = addr
+		key, _, _ := ed25519.GenerateKey(rand.Reader)
+		req.TLS = &tls.ConnectionState{
+			PeerCertificates: []*x509.Certificate{{PublicKey: key}},
+		}
+		w := httptest.NewRecorder()
+		srv.ServeHTTP(w, req)
+		return w
+	}
+	code := func(w *httptest.ResponseRecorder) ErrorCode {
+		var e Error
+		json.Unmarshal(w.Body.Bytes(), &e)
+		return e.Code
+	}
+
+	for _, username := range []string{"bob@example.org", "carol@example.org"} {
+		if c := code(status("10.0.0.1:1234", &statusArgs{Username: username})); c != ErrNotRegistered {
+			t.Fatalf("%s: expected ErrNotRegistered, got %s", username, c)
+		}
+	}
+	if c := code(status("10.0.0.1:1234", &statusArgs{Username: "dave@example.org"})); c != ErrTooManyLookups {
+		t.Fatalf("expected ErrTooManyLookups with a fresh key, got %s", c)
+	}
+	if c := code(status("10.0.0.2:1234", &statusArgs{Username: "dave@example.org"})); c != ErrNotRegistered {
+		t.Fatalf("other address: expected ErrNotRegistered, got %s", c)
+	}
+
+	// A user behind the same address can still check their status.
+	args := &statusArgs{Username: "alice@example.org", ServerSigningKey: srv.publicKey}
+	args.Signature = ed25519.Sign(alicePriv, args.msg())
+	if w := status("10.0.0.1:1234", args); w.Code != http.StatusOK {
+		t.Fatalf("signed status over the limit: %d %s", w.Code, w.Body)
+	}
+
+	// IPv6 clients are counted by /64.
+	a := httptest.NewRequest("POST", "/status", nil)
+	a.RemoteAddr = "[2001:db8::1]:1234"
+	b := httptest.NewRequest("POST", "/status", nil)
+	b.RemoteAddr = "[2001:db8::ffff:1]:1234"
+	if lookupAddr(a) != lookupAddr(b) || lookupAddr(a) != "2001:db8::/64" {
+		t.Fatalf("IPv6 prefixes: %s, %s", lookupAddr(a), lookupAddr(b))
+	}
+}
+
+func TestLookupWork(t *testing.T) {
+	pub, _, _ := ed25519.GenerateKey(rand.Reader)
+	srv := &Server{publicKey: pub, lookupWorkBits: 8, db: kv.NewMemory()}
+	now := time.Now()
+
+	err := srv.checkWork("alice@example.org", nil, now)
+	if requiredWork(err) != 8 {
+		t.Fatalf("expected ErrWorkRequired for 8 bits, got %v", err)
+	}
+
+	stamp := solveWork(pub, "alice@example.org", 8, now)
+	if err := srv.checkWork("alice@example.org", stamp, now); err != nil {
+		t.Fatal(err)
+	}
+	err = srv.checkWork("alice@example.org", stamp, now.Add(time.Minute))
+	if e, ok := err.(Error); !ok || e.Code != ErrReplayedRequest {
+		t.Fatalf("expected ErrReplayedRequest for a spent stamp, got %v", err)
+	}
+	if err := srv.checkWork("alice@example.org", solveWork(pub, "alice@example.org", 8, now), now); err != nil {
+		t.Fatalf("second stamp in the same second: %s", err)
+	}
+	// A stamp for alice passes for bob by chance one time in 2^8, so
+	// try a few: it is unbound only if they all pass.
+	bound := false
+	for i := 0; i < 4 && !bound; i++ {
+		stamp := solveWork(pub, "alice@example.org", 8, now.Add(time.Duration(i)*time.Second))
+		bound = requiredWork(srv.checkWork("bob@example.org", stamp, now)) == 8
+	}
+	if !bound {
+		t.Fatal("work should be bound to the username")
+	}
+	err = srv.checkWork("alice@example.org", stamp, now.Add(2*workWindow))
+	if e, ok := err.(Error); !ok || e.Code != ErrStaleRequest {
+		t.Fatalf("expected ErrStaleRequest, got %v", err)
+	}
+}
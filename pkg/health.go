@@ -0,0 +1,104 @@
+// Copyright 2018 David Lazar. All rights reserved.
+// Use of this source code is governed by the GNU AGPL
+// license that can be found in the LICENSE file.
+
+//go:build !js
+// +build !js
+
+package pkg
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"vuvuzela.io/alpenhorn/pkg/kv"
+)
+
+// DefaultReadyRoundAge is how long the server stays ready after the
+// coordinator last revealed a round if Config.ReadyRoundAge is zero.
+const DefaultReadyRoundAge = 15 * time.Minute
+
+// A HealthCheck is the result of one of the checks behind /readyz.
+type HealthCheck struct {
+	Name   string
+	OK     bool
+	Detail string `json:",omitempty"`
+}
+
+// Ready runs the server's readiness checks: the database (and replica)
+// can be read, the keys for the latest revealed round are loaded, and
+// the coordinator revealed that round within Config.ReadyRoundAge. A
+// server that fails them cannot answer extractions for the current
+// round and should be taken out of rotation.
+func (srv *Server) Ready() []HealthCheck {
+	checks := []HealthCheck{
+		checkDB("db", srv.db),
+	}
+	if srv.replica != srv.db {
+		checks = append(checks, checkDB("replica", srv.replica))
+	}
+
+	srv.mu.Lock()
+	round, revealed := srv.latestRound, srv.lastReveal
+	_, loaded := srv.rounds[round]
+	srv.mu.Unlock()
+
+	switch {
+	case revealed.IsZero():
+		checks = append(checks, HealthCheck{Name: "round", Detail: "no round revealed yet"})
+	case !loaded:
+		checks = append(checks, HealthCheck{Name: "round", Detail: fmt.Sprintf("round %d keys evicted", round)})
+	default:
+		checks = append(checks, HealthCheck{Name: "round", OK: true, Detail: fmt.Sprintf("round %d", round)})
+	}
+
+	if !revealed.IsZero() {
+		age := srv.clock.Now().Sub(revealed)
+		checks = append(checks, HealthCheck{
+			Name:   "coordinator",
+			OK:     age <= srv.readyRoundAge,
+			Detail: fmt.Sprintf("last reveal %s ago", age.Round(time.Second)),
+		})
+	}
+	return checks
+}
+
+func checkDB(name string, db kv.DB) HealthCheck {
+	err := db.View(func(tx kv.Txn) error {
+		_, err := tx.Get(dbSchemaVersionKey)
+		if err == kv.ErrNotFound {
+			return nil
+		}
+		return err
+	})
+	if err != nil {
+		return HealthCheck{Name: name, Detail: err.Error()}
+	}
+	return HealthCheck{Name: name, OK: true}
+}
+
+// healthzHandler reports that the process is alive.
+func healthzHandler(w http.ResponseWriter, req *http.Request) {
+	w.Write([]byte("ok\n"))
+}
+
+// readyzHandler replies with the results of srv.Ready, and with 503
+// Service Unavailable if any check failed.
+func (srv *Server) readyzHandler(w http.ResponseWriter, req *http.Request) {
+	checks := srv.Ready()
+	status := http.StatusOK
+	for _, c := range checks {
+		if !c.OK {
+			status = http.StatusServiceUnavailable
+		}
+	}
+	bs, err := json.Marshal(checks)
+	if err != nil {
+		panic(err)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(bs)
+}
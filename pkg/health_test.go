@@ -0,0 +1,106 @@
+// Copyright 2018 David Lazar. All rights reserved.
+// Use of this source code is governed by the GNU AGPL
+// license that can be found in the LICENSE file.
+
+package pkg
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"vuvuzela.io/alpenhorn/clock"
+	"vuvuzela.io/alpenhorn/pkg/kv"
+)
+
+func TestHealth(t *testing.T) {
+	mockClock := clock.NewMock(time.Now())
+	coordinatorPub, _, _ := ed25519.GenerateKey(rand.Reader)
+	serverPub, serverKey, _ := ed25519.GenerateKey(rand.Reader)
+	srv, err := NewServer(&Config{
+		DB:              kv.NewMemory(),
+		SigningKey:      serverKey,
+		CoordinatorKey:  coordinatorPub,
+		RegTokenHandler: func(string, string) error { return nil },
+		Clock:           mockClock,
+		ReadyRoundAge:   10 * time.Minute,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+
+	get := func(path string) (*httptest.ResponseRecorder, []HealthCheck) {
+		w := httptest.NewRecorder()
+		srv.ServeHTTP(w, httptest.NewRequest("GET", path, nil))
+		var checks []HealthCheck
+		if path == "/readyz" {
+			if err := json.Unmarshal(w.Body.Bytes(), &checks); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return w, checks
+	}
+	coordinator := func(path string, args interface{}) []byte {
+		body, _ := json.Marshal(args)
+		req := httptest.NewRequest("POST", path, bytes.NewReader(body))
+		req.TLS = &tls.ConnectionState{
+			PeerCertificates: []*x509.Certificate{{PublicKey: coordinatorPub}},
+		}
+		w := httptest.NewRecorder()
+		srv.ServeHTTP(w, req)
+		if w.Code != http.StatusOK {
+			t.Fatalf("%s: %d %s", path, w.Code, w.Body)
+		}
+		return w.Body.Bytes()
+	}
+
+	if w, _ := get("/healthz"); w.Code != http.StatusOK {
+		t.Fatalf("healthz: %d", w.Code)
+	}
+	w, checks := get("/readyz")
+	if w.Code != http.StatusServiceUnavailable {
+		t.Fatalf("ready before any round was revealed: %+v", checks)
+	}
+
+	commitReply := new(commitReply)
+	if err := json.Unmarshal(coordinator("/commit", &commitArgs{Round: 1, coordinatorNonce: newCoordinatorNonce(time.Now())}), commitReply); err != nil {
+		t.Fatal(err)
+	}
+	coordinator("/reveal", &revealArgs{
+		Round:            1,
+		Commitments:      map[string][]byte{hex.EncodeToString(serverPub): commitReply.Commitment},
+		coordinatorNonce: newCoordinatorNonce(time.Now()),
+	})
+	w, checks = get("/readyz")
+	if w.Code != http.StatusOK {
+		t.Fatalf("not ready after a reveal: %+v", checks)
+	}
+
+	mockClock.Add(11 * time.Minute)
+	w, checks = get("/readyz")
+	if w.Code != http.StatusServiceUnavailable {
+		t.Fatalf("ready with a stale round: %+v", checks)
+	}
+	for _, c := range checks {
+		if c.Name == "db" && !c.OK {
+			t.Fatalf("db check failed: %+v", c)
+		}
+	}
+
+	if err := srv.Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if w, _ := get("/healthz"); w.Code != http.StatusOK {
+		t.Fatalf("healthz after shutdown: %d", w.Code)
+	}
+}
@@ -0,0 +1,262 @@
+// Copyright 2018 David Lazar. All rights reserved.
+// Use of this source code is governed by the GNU AGPL
+// license that can be found in the LICENSE file.
+
+//go:build !js
+// +build !js
+
+package pkg
+
+import (
+	"bytes"
+	"sync"
+	"time"
+
+	"vuvuzela.io/alpenhorn/log"
+	"vuvuzela.io/alpenhorn/pkg/kv"
+)
+
+// Registrations are verified before they are stored, with one
+// exception: after a user revokes their login key, the username waits
+// for them to verify it again (see recovery.go). The janitor deletes
+// registrations left unverified for Config.UnverifiedTTL, freeing the
+// username, so abandoned registrations do not fill the users table.
+//
+// Registrations that are still waiting to be verified exist only as
+// the verifiers' records, such as the codes sent by email. The janitor
+// also deletes the records that were created more than UnverifiedTTL
+// ago for usernames that are still not registered, so that signups
+// that never finish, and TOTP secrets enrolled for users who never
+// register, do not pile up either.
+
+// JanitorInterval is how often the janitor looks for expired
+// registrations.
+var JanitorInterval = time.Hour
+
+// A janitor runs a cleanup task in the background every interval until
+// it is closed.
+type janitor struct {
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+func (srv *Server) newJanitor(interval time.Duration, task func()) *janitor {
+	j := &janitor{
+		done: make(chan struct{}),
+	}
+	go j.run(srv, interval, task)
+	return j
+}
+
+func (j *janitor) run(srv *Server, interval time.Duration, task func()) {
+	for {
+		timer := srv.clock.NewTimer(interval)
+		select {
+		case <-timer.C():
+		case <-j.done:
+			timer.Stop()
+			return
+		}
+		task()
+	}
+}
+
+func (j *janitor) close() {
+	if j != nil {
+		j.closeOnce.Do(func() { close(j.done) })
+	}
+}
+
+// startUnverifiedJanitor starts deleting registrations left unverified
+// for ttl. It returns nil, starting nothing, if ttl is zero.
+func (srv *Server) startUnverifiedJanitor(ttl time.Duration) *janitor {
+	if ttl <= 0 {
+		return nil
+	}
+	return srv.newJanitor(JanitorInterval, func() {
+		if !srv.isLeader() {
+			return
+		}
+		n, err := srv.expireUnverified(ttl)
+		if err != nil {
+			srv.log.Errorf("Expiring unverified registrations: %s", err)
+		} else if n > 0 {
+			srv.log.WithFields(log.Fields{"deleted": n}).Info("Expired unverified registrations")
+		}
+		n, err = srv.expireVerifierRecords(ttl)
+		if err != nil {
+			srv.log.Errorf("Expiring verifier records: %s", err)
+		} else if n > 0 {
+			srv.log.WithFields(log.Fields{"deleted": n}).Info("Expired verifier records")
+		}
+	})
+}
+
+// expireUnverified deletes registrations that have waited for
+// verification for longer than ttl, and returns how many it deleted.
+func (srv *Server) expireUnverified(ttl time.Duration) (int, error) {
+	var ids []*[64]byte
+	err := srv.db.View(func(tx kv.Txn) error {
+		return tx.Iterate(dbUserPrefix, func(key, value []byte) error {
+			id, suffix, ok := splitUserKey(key)
+			if !ok || !bytes.Equal(suffix, registrationSuffix) {
+				return nil
+			}
+			var user userState
+			if err := user.Unmarshal(value); err == nil && user.Revoked {
+				ids = append(ids, id)
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		return 0, errorf(ErrDatabaseError, "%s", err)
+	}
+
+	deleted := 0
+	for _, id := range ids {
+		ok, err := srv.expireUser(id, ttl)
+		if err != nil {
+			return deleted, err
+		}
+		if ok {
+			deleted++
+		}
+	}
+	return deleted, nil
+}
+
+func (srv *Server) expireUser(id *[64]byte, ttl time.Duration) (bool, error) {
+	srv.regLogMu.Lock()
+	defer srv.regLogMu.Unlock()
+	tx, err := srv.db.NewTransaction(true)
+	if err != nil {
+		return false, errorf(ErrDatabaseError, "%s", err)
+	}
+	defer tx.Discard()
+
+	// The user may have verified their username since the scan.
+	data, err := tx.Get(dbUserKey(id, registrationSuffix))
+	if err == kv.ErrNotFound {
+		return false, nil
+	} else if err != nil {
+		return false, errorf(ErrDatabaseError, "%s", err)
+	}
+	var user userState
+	if err := user.Unmarshal(data); err != nil {
+		return false, errorf(ErrDatabaseError, "%s", err)
+	}
+	if !user.Revoked {
+		return false, nil
+	}
+
+	since, err := revokedSince(tx, id)
+	if err != nil {
+		return false, err
+	}
+	if srv.clock.Now().Sub(since) < ttl {
+		return false, nil
+	}
+
+	// The registration log entry was removed when the login key was
+	// revoked, so only the records are left to delete.
+	if err := srv.eraseUser(tx, id); err != nil {
+		return false, err
+	}
+	if err := tx.Commit(); err != nil {
+		return false, errorf(ErrDatabaseError, "%s", err)
+	}
+	return true, nil
+}
+
+// revokedSince returns when the user's login key was revoked, according
+// to their event log.
+func revokedSince(tx kv.Txn, id *[64]byte) (time.Time, error) {
+	data, err := tx.Get(dbUserKey(id, userLogSuffix))
+	if err == kv.ErrNotFound {
+		return time.Time{}, nil
+	} else if err != nil {
+		return time.Time{}, errorf(ErrDatabaseError, "%s", err)
+	}
+	var userLog UserEventLog
+	if err := userLog.Unmarshal(data); err != nil {
+		return time.Time{}, errorf(ErrDatabaseError, "%s", err)
+	}
+	for i := len(userLog) - 1; i >= 0; i-- {
+		if userLog[i].Type == EventLoginKeyRevoked {
+			return userLog[i].Time, nil
+		}
+	}
+	return time.Time{}, nil
+}
+
+// expireVerifierRecords deletes the verifiers' records that were
+// created more than ttl ago for usernames that are not registered, and
+// returns how many it deleted.
+func (srv *Server) expireVerifierRecords(ttl time.Duration) (int, error) {
+	cutoff := srv.clock.Now().Add(-ttl)
+	var keys [][]byte
+	err := srv.db.View(func(tx kv.Txn) error {
+		return tx.Iterate(dbVerifierPrefix, func(key, value []byte) error {
+			if _, _, since, ok := splitVerifierKey(key); !ok || !since {
+				return nil
+			}
+			if created, err := decodeIndex(value); err == nil && int64(created) < cutoff.Unix() {
+				keys = append(keys, append([]byte(nil), key...))
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		return 0, errorf(ErrDatabaseError, "%s", err)
+	}
+
+	deleted := 0
+	for _, key := range keys {
+		ok, err := srv.expireVerifierRecord(key, cutoff)
+		if err != nil {
+			return deleted, err
+		}
+		if ok {
+			deleted++
+		}
+	}
+	return deleted, nil
+}
+
+// expireVerifierRecord deletes the record whose creation time is in
+// sinceKey if it was created before cutoff. If the record's username
+// has been registered since, the record is the verifier's to keep and
+// only sinceKey is deleted.
+func (srv *Server) expireVerifierRecord(sinceKey []byte, cutoff time.Time) (bool, error) {
+	record, id, _, _ := splitVerifierKey(sinceKey)
+	expired := false
+	err := srv.db.Update(func(tx kv.Txn) error {
+		// The record may have been deleted and created again since
+		// the scan.
+		data, err := tx.Get(sinceKey)
+		if err == kv.ErrNotFound {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		if created, err := decodeIndex(data); err == nil && int64(created) >= cutoff.Unix() {
+			return nil
+		}
+
+		_, err = tx.Get(dbUserKey(id, registrationSuffix))
+		if err == kv.ErrNotFound {
+			if err := tx.Delete(record); err != nil {
+				return err
+			}
+			expired = true
+		} else if err != nil {
+			return err
+		}
+		return tx.Delete(sinceKey)
+	})
+	if err != nil {
+		return false, errorf(ErrDatabaseError, "%s", err)
+	}
+	return expired, nil
+}
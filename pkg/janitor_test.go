@@ -0,0 +1,156 @@
+// Copyright 2018 David Lazar. All rights reserved.
+// Use of this source code is governed by the GNU AGPL
+// license that can be found in the LICENSE file.
+
+package pkg
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"testing"
+	"time"
+
+	"vuvuzela.io/alpenhorn/clock"
+	"vuvuzela.io/alpenhorn/pkg/kv"
+)
+
+func TestJanitorExpiresUnverified(t *testing.T) {
+	mockClock := clock.NewMock(time.Now())
+	_, serverKey, _ := ed25519.GenerateKey(rand.Reader)
+	srv, err := NewServer(&Config{
+		DB:               kv.NewMemory(),
+		SigningKey:       serverKey,
+		RegistrationMode: RegistrationFCFS,
+		UnverifiedTTL:    24 * time.Hour,
+		Clock:            mockClock,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+
+	register := func(username string) ed25519.PrivateKey {
+		loginPub, loginKey, _ := ed25519.GenerateKey(rand.Reader)
+		if _, err := srv.register(&registerArgs{Username: username, LoginKey: loginPub}); err != nil {
+			t.Fatal(err)
+		}
+		return loginKey
+	}
+	aliceKey := register("alice@example.org")
+	register("bob@example.org")
+
+	// Alice revokes her login key and never verifies her username again.
+	recoveryPub, recoveryKey, _ := ed25519.GenerateKey(rand.Reader)
+	setArgs := &setRecoveryKeyArgs{
+		Username:         "alice@example.org",
+		RecoveryKey:      recoveryPub,
+		Time:             mockClock.Now().Unix(),
+		ServerSigningKey: srv.publicKey,
+	}
+	setArgs.Signature = ed25519.Sign(aliceKey, setArgs.msg())
+	setArgs.RecoverySignature = ed25519.Sign(recoveryKey, setArgs.msg())
+	if err := srv.setRecoveryKey(setArgs); err != nil {
+		t.Fatal(err)
+	}
+	newPub, _, _ := ed25519.GenerateKey(rand.Reader)
+	revokeArgs := &revokeLoginArgs{
+		Username:         "alice@example.org",
+		NewLoginKey:      newPub,
+		Time:             mockClock.Now().Unix(),
+		ServerSigningKey: srv.publicKey,
+	}
+	revokeArgs.Signature = ed25519.Sign(recoveryKey, revokeArgs.msg())
+	if err := srv.revokeLogin(revokeArgs); err != nil {
+		t.Fatal(err)
+	}
+
+	registered := func(username string) bool {
+		_, _, err := srv.getUser(nil, username)
+		return errorCode(err) != ErrNotRegistered
+	}
+
+	// The first run is within the TTL. The sweeper (see sweep.go)
+	// waits on the clock along with the janitor.
+	mockClock.BlockUntil(2)
+	mockClock.Add(JanitorInterval)
+	mockClock.BlockUntil(2)
+	if !registered("alice@example.org") {
+		t.Fatal("registration deleted before its TTL")
+	}
+
+	mockClock.Add(24 * time.Hour)
+	mockClock.BlockUntil(2)
+	if registered("alice@example.org") {
+		t.Fatal("unverified registration not deleted")
+	}
+	if !registered("bob@example.org") {
+		t.Fatal("verified registration deleted")
+	}
+
+	// The username is free again.
+	register("alice@example.org")
+	if problems, err := VerifyDB(srv.db); err != nil || len(problems) > 0 {
+		t.Fatalf("VerifyDB: %v %v", problems, err)
+	}
+}
+
+func TestJanitorExpiresVerifierRecords(t *testing.T) {
+	mockClock := clock.NewMock(time.Now())
+	_, serverKey, _ := ed25519.GenerateKey(rand.Reader)
+	srv, err := NewServer(&Config{
+		DB:               kv.NewMemory(),
+		SigningKey:       serverKey,
+		RegistrationMode: RegistrationFCFS,
+		UnverifiedTTL:    24 * time.Hour,
+		Clock:            mockClock,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+
+	store := srv.live().verifierStore
+	put := func(username string) {
+		err := store.Update(username, 0, func([]byte) ([]byte, error) {
+			return []byte("record"), nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	get := func(username string) []byte {
+		value, err := store.Get(username)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return value
+	}
+	// Carol never finishes signing up; dave does.
+	put("carol@example.org")
+	put("dave@example.org")
+	loginPub, _, _ := ed25519.GenerateKey(rand.Reader)
+	if _, err := srv.register(&registerArgs{Username: "dave@example.org", LoginKey: loginPub}); err != nil {
+		t.Fatal(err)
+	}
+
+	mockClock.BlockUntil(2)
+	mockClock.Add(JanitorInterval)
+	mockClock.BlockUntil(2)
+	// Updates keep the record's creation time.
+	put("carol@example.org")
+	if get("carol@example.org") == nil {
+		t.Fatal("record deleted before its TTL")
+	}
+
+	mockClock.Add(24 * time.Hour)
+	mockClock.BlockUntil(2)
+	if get("carol@example.org") != nil {
+		t.Fatal("record of an unregistered username not deleted")
+	}
+	if get("dave@example.org") == nil {
+		t.Fatal("record of a registered username deleted")
+	}
+	if stats, err := CollectDBStats(srv.db); err != nil || stats.VerifierRecords != 1 {
+		t.Fatalf("got %d verifier records, want 1 (%v)", stats.VerifierRecords, err)
+	}
+}
@@ -0,0 +1,113 @@
+// Copyright 2018 David Lazar. All rights reserved.
+// Use of this source code is governed by the GNU AGPL
+// license that can be found in the LICENSE file.
+
+//go:build !js
+// +build !js
+
+package pkg
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"io/ioutil"
+	"strings"
+	"sync"
+
+	"vuvuzela.io/alpenhorn/encoding/toml"
+	"vuvuzela.io/alpenhorn/errors"
+)
+
+// The PKG's signing key need not be kept in its config file. A key URI
+// names the key instead, and the signer it opens does the signing, so
+// a key in a PKCS#11 token or a cloud key management service never
+// leaves it. Support for each kind of key is registered by URI scheme;
+// this package only knows "file:" URIs, and programs link in the
+// drivers for their hardware, which usually need cgo or vendor SDKs,
+// from other packages that call RegisterSigner. The round's IBE and
+// BLS master keys are generated for each round and never stored, so
+// they stay in the server's memory.
+
+// A SignerOpener opens the key named by uri. The signer must have an
+// Ed25519 public key and produce plain Ed25519 signatures.
+type SignerOpener func(uri string) (crypto.Signer, error)
+
+var (
+	signerMu      sync.Mutex
+	signerOpeners = map[string]SignerOpener{
+		"file": openFileSigner,
+	}
+)
+
+// RegisterSigner makes OpenSigner open URIs with the given scheme,
+// such as "pkcs11", using open. It panics if the scheme is already
+// registered.
+func RegisterSigner(scheme string, open SignerOpener) {
+	signerMu.Lock()
+	defer signerMu.Unlock()
+	if signerOpeners[scheme] != nil {
+		panic("pkg: signer scheme registered twice: " + scheme)
+	}
+	signerOpeners[scheme] = open
+}
+
+// OpenSigner opens the signing key named by uri. A "file:" URI names a
+// file holding a base32-encoded Ed25519 private key.
+func OpenSigner(uri string) (crypto.Signer, error) {
+	scheme, _, ok := strings.Cut(uri, ":")
+	if !ok {
+		return nil, errors.New("key URI %q has no scheme", uri)
+	}
+	signerMu.Lock()
+	open := signerOpeners[scheme]
+	signerMu.Unlock()
+	if open == nil {
+		return nil, errors.New("no signer registered for %q URIs", scheme)
+	}
+	signer, err := open(uri)
+	if err != nil {
+		return nil, errors.Wrap(err, "opening %s key", scheme)
+	}
+	if _, err := signerPublicKey(signer); err != nil {
+		return nil, err
+	}
+	return signer, nil
+}
+
+func signerPublicKey(signer crypto.Signer) (ed25519.PublicKey, error) {
+	pub, ok := signer.Public().(ed25519.PublicKey)
+	if !ok || len(pub) != ed25519.PublicKeySize {
+		return nil, errors.New("signing key is not an Ed25519 key: %T", signer.Public())
+	}
+	return pub, nil
+}
+
+func openFileSigner(uri string) (crypto.Signer, error) {
+	path := strings.TrimPrefix(strings.TrimPrefix(uri, "file:"), "//")
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	key, err := toml.DecodeBytes(strings.TrimSpace(string(data)))
+	if err != nil {
+		return nil, err
+	}
+	if len(key) != ed25519.PrivateKeySize {
+		return nil, errors.New("%s: got %d bytes, want an Ed25519 private key", path, len(key))
+	}
+	return ed25519.PrivateKey(key), nil
+}
+
+// sign signs msg with the server's signing key, using Ed25519.
+func (srv *Server) sign(msg []byte) ([]byte, error) {
+	return srv.signWith(ed25519Scheme{}, srv.signer, msg)
+}
+
+// signWith signs msg with signer in the given scheme.
+func (srv *Server) signWith(scheme SignatureScheme, signer crypto.Signer, msg []byte) ([]byte, error) {
+	sig, err := scheme.Sign(signer, msg)
+	if err != nil {
+		return nil, errorf(ErrUnknown, "signing: %s", err)
+	}
+	return sig, nil
+}
@@ -0,0 +1,91 @@
+// Copyright 2018 David Lazar. All rights reserved.
+// Use of this source code is governed by the GNU AGPL
+// license that can be found in the LICENSE file.
+
+package pkg
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"io"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"vuvuzela.io/alpenhorn/encoding/toml"
+	"vuvuzela.io/alpenhorn/pkg/kv"
+)
+
+// testHSM stands in for a key that never leaves a token.
+type testHSM struct {
+	key   ed25519.PrivateKey
+	signs int
+}
+
+func (h *testHSM) Public() crypto.PublicKey {
+	return h.key.Public()
+}
+
+func (h *testHSM) Sign(rand io.Reader, msg []byte, opts crypto.SignerOpts) ([]byte, error) {
+	h.signs++
+	return h.key.Sign(rand, msg, opts)
+}
+
+var testHSMKey *testHSM
+
+func init() {
+	RegisterSigner("testhsm", func(uri string) (crypto.Signer, error) {
+		return testHSMKey, nil
+	})
+}
+
+func TestOpenSigner(t *testing.T) {
+	pub, priv, _ := ed25519.GenerateKey(rand.Reader)
+	path := filepath.Join(t.TempDir(), "key")
+	if err := ioutil.WriteFile(path, []byte(toml.EncodeBytes(priv)+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	signer, err := OpenSigner("file:" + path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !pub.Equal(signer.Public()) {
+		t.Fatal("file signer has the wrong public key")
+	}
+
+	hsm := &testHSM{key: priv}
+	testHSMKey = hsm
+	if _, err := OpenSigner("nosuchscheme:key"); err == nil {
+		t.Fatal("expected error for an unregistered scheme")
+	}
+	signer, err = OpenSigner("testhsm:slot=1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	srv, err := NewServer(&Config{
+		DB:              kv.NewMemory(),
+		Signer:          signer,
+		RegTokenHandler: func(string, string) error { return nil },
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+
+	loginKey, _, _ := ed25519.GenerateKey(rand.Reader)
+	if _, err := srv.register(&registerArgs{Username: "alice@example.org", LoginKey: loginKey}); err != nil {
+		t.Fatal(err)
+	}
+	head, err := srv.LogHead()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !head.Verify(pub) {
+		t.Fatal("log head signature does not verify")
+	}
+	if hsm.signs == 0 {
+		t.Fatal("server did not sign with the registered signer")
+	}
+}
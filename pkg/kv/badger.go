@@ -0,0 +1,129 @@
+// Copyright 2018 David Lazar. All rights reserved.
+// Use of this source code is governed by the GNU AGPL
+// license that can be found in the LICENSE file.
+
+package kv
+
+import (
+	"time"
+
+	"github.com/dgraph-io/badger"
+
+	"vuvuzela.io/alpenhorn/errors"
+)
+
+// BadgerDB is a DB backed by a Badger database.
+type BadgerDB struct {
+	db *badger.DB
+}
+
+// OpenBadger opens the Badger database in dir. Writes are synced to
+// disk before they are committed.
+func OpenBadger(dir string, readOnly bool) (*BadgerDB, error) {
+	opts := badger.DefaultOptions(dir).WithSyncWrites(true).WithLogger(nil)
+	if readOnly {
+		opts = opts.WithReadOnly(true)
+	}
+	db, err := badger.Open(opts)
+	if err != nil {
+		return nil, err
+	}
+	return &BadgerDB{db: db}, nil
+}
+
+func (b *BadgerDB) NewTransaction(update bool) (Txn, error) {
+	return badgerTxn{b.db.NewTransaction(update)}, nil
+}
+
+func (b *BadgerDB) View(fn func(tx Txn) error) error {
+	return view(b, fn)
+}
+
+func (b *BadgerDB) Update(fn func(tx Txn) error) error {
+	return update(b, fn)
+}
+
+func (b *BadgerDB) Size() int64 {
+	lsm, vlog := b.db.Size()
+	return lsm + vlog
+}
+
+// Vacuum compacts the LSM tree and garbage collects the value log.
+func (b *BadgerDB) Vacuum() error {
+	if err := b.db.Flatten(2); err != nil {
+		return errors.Wrap(err, "flatten")
+	}
+	for {
+		err := b.db.RunValueLogGC(0.5)
+		if err == badger.ErrNoRewrite {
+			return nil
+		}
+		if err != nil {
+			return errors.Wrap(err, "value log gc")
+		}
+	}
+}
+
+func (b *BadgerDB) Close() error {
+	return b.db.Close()
+}
+
+type badgerTxn struct {
+	tx *badger.Txn
+}
+
+func (t badgerTxn) Get(key []byte) ([]byte, error) {
+	item, err := t.tx.Get(key)
+	if err == badger.ErrKeyNotFound {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return item.ValueCopy(nil)
+}
+
+func (t badgerTxn) Set(key, value []byte) error {
+	return badgerErr(t.tx.Set(key, value))
+}
+
+func (t badgerTxn) SetWithTTL(key, value []byte, ttl time.Duration) error {
+	return badgerErr(t.tx.SetEntry(badger.NewEntry(key, value).WithTTL(ttl)))
+}
+
+func (t badgerTxn) Delete(key []byte) error {
+	return badgerErr(t.tx.Delete(key))
+}
+
+func (t badgerTxn) Iterate(prefix []byte, fn func(key, value []byte) error) error {
+	opts := badger.DefaultIteratorOptions
+	opts.Prefix = prefix
+	it := t.tx.NewIterator(opts)
+	defer it.Close()
+
+	for it.Seek(prefix); it.ValidForPrefix(prefix); it.Next() {
+		item := it.Item()
+		err := item.Value(func(value []byte) error {
+			return fn(item.Key(), value)
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (t badgerTxn) Commit() error {
+	return t.tx.Commit()
+}
+
+func (t badgerTxn) Discard() {
+	t.tx.Discard()
+}
+
+func badgerErr(err error) error {
+	if err == badger.ErrReadOnlyTxn {
+		return ErrReadOnly
+	}
+	return err
+}
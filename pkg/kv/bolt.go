@@ -0,0 +1,279 @@
+// Copyright 2018 David Lazar. All rights reserved.
+// Use of this source code is governed by the GNU AGPL
+// license that can be found in the LICENSE file.
+
+package kv
+
+import (
+	"bytes"
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/boltdb/bolt"
+
+	"vuvuzela.io/alpenhorn/errors"
+)
+
+// BoltFile is the name of the Bolt database file in its directory.
+const BoltFile = "pkg.bolt"
+
+var boltBucket = []byte("pkg")
+
+// BoltDB is a DB backed by a single Bolt file. Bolt has no native key
+// expiry, so values set with a TTL carry their expiry time and are
+// hidden once it passes; SweepExpired and Vacuum delete them.
+type BoltDB struct {
+	db *bolt.DB
+}
+
+// OpenBolt opens the Bolt database in dir.
+func OpenBolt(dir string, readOnly bool) (*BoltDB, error) {
+	path := filepath.Join(dir, BoltFile)
+	if readOnly {
+		if _, err := os.Stat(path); err != nil {
+			return nil, err
+		}
+	}
+	db, err := bolt.Open(path, 0600, &bolt.Options{
+		Timeout:  time.Second,
+		ReadOnly: readOnly,
+	})
+	if err == bolt.ErrTimeout {
+		return nil, ErrLocked
+	} else if err != nil {
+		return nil, errors.Wrap(err, "opening %s", path)
+	}
+	if !readOnly {
+		err = db.Update(func(tx *bolt.Tx) error {
+			_, err := tx.CreateBucketIfNotExists(boltBucket)
+			return err
+		})
+		if err != nil {
+			db.Close()
+			return nil, err
+		}
+	}
+	return &BoltDB{db: db}, nil
+}
+
+func (b *BoltDB) NewTransaction(update bool) (Txn, error) {
+	tx, err := b.db.Begin(update)
+	if err != nil {
+		return nil, err
+	}
+	return &boltTxn{tx: tx, now: time.Now()}, nil
+}
+
+func (b *BoltDB) View(fn func(tx Txn) error) error {
+	return view(b, fn)
+}
+
+func (b *BoltDB) Update(fn func(tx Txn) error) error {
+	return update(b, fn)
+}
+
+func (b *BoltDB) Size() int64 {
+	var size int64
+	b.db.View(func(tx *bolt.Tx) error {
+		size = tx.Size()
+		return nil
+	})
+	return size
+}
+
+// Vacuum deletes expired keys so that Bolt can reuse their pages.
+// Bolt files never shrink.
+func (b *BoltDB) Vacuum() error {
+	return b.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(boltBucket)
+		if bucket == nil {
+			return nil
+		}
+		now := time.Now()
+		var expired [][]byte
+		err := bucket.ForEach(func(key, value []byte) error {
+			if _, ok := decodeBoltValue(value, now); !ok {
+				expired = append(expired, append([]byte(nil), key...))
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		for _, key := range expired {
+			if err := bucket.Delete(key); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// SweepExpired finds expired keys in a read transaction, which does
+// not hold up writers, and deletes up to limit of them in a short
+// update transaction.
+func (b *BoltDB) SweepExpired(limit int) (int, error) {
+	var expired [][]byte
+	err := b.db.View(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(boltBucket)
+		if bucket == nil {
+			return nil
+		}
+		now := time.Now()
+		c := bucket.Cursor()
+		for key, value := c.First(); key != nil && len(expired) < limit; key, value = c.Next() {
+			if _, ok := decodeBoltValue(value, now); !ok {
+				expired = append(expired, append([]byte(nil), key...))
+			}
+		}
+		return nil
+	})
+	if err != nil || len(expired) == 0 {
+		return 0, err
+	}
+
+	deleted := 0
+	err = b.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(boltBucket)
+		now := time.Now()
+		for _, key := range expired {
+			// The key may have been deleted or set again since
+			// it was found.
+			raw := bucket.Get(key)
+			if _, ok := decodeBoltValue(raw, now); ok || raw == nil {
+				continue
+			}
+			if err := bucket.Delete(key); err != nil {
+				return err
+			}
+			deleted++
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	return deleted, nil
+}
+
+func (b *BoltDB) Close() error {
+	return b.db.Close()
+}
+
+type boltTxn struct {
+	tx  *bolt.Tx
+	now time.Time
+}
+
+// bucket returns the bucket, which is nil in a read-only database
+// that has never been written.
+func (t *boltTxn) bucket() *bolt.Bucket {
+	return t.tx.Bucket(boltBucket)
+}
+
+func (t *boltTxn) Get(key []byte) ([]byte, error) {
+	bucket := t.bucket()
+	if bucket == nil {
+		return nil, ErrNotFound
+	}
+	value, ok := decodeBoltValue(bucket.Get(key), t.now)
+	if !ok {
+		return nil, ErrNotFound
+	}
+	// Bolt values are only valid until the transaction ends.
+	return append([]byte(nil), value...), nil
+}
+
+func (t *boltTxn) Set(key, value []byte) error {
+	return t.put(key, encodeBoltValue(value, time.Time{}))
+}
+
+func (t *boltTxn) SetWithTTL(key, value []byte, ttl time.Duration) error {
+	return t.put(key, encodeBoltValue(value, time.Now().Add(ttl)))
+}
+
+func (t *boltTxn) put(key, value []byte) error {
+	if !t.tx.Writable() {
+		return ErrReadOnly
+	}
+	return t.bucket().Put(key, value)
+}
+
+func (t *boltTxn) Delete(key []byte) error {
+	if !t.tx.Writable() {
+		return ErrReadOnly
+	}
+	return t.bucket().Delete(key)
+}
+
+func (t *boltTxn) Iterate(prefix []byte, fn func(key, value []byte) error) error {
+	bucket := t.bucket()
+	if bucket == nil {
+		return nil
+	}
+	c := bucket.Cursor()
+	for key, raw := c.Seek(prefix); key != nil && bytes.HasPrefix(key, prefix); key, raw = c.Next() {
+		value, ok := decodeBoltValue(raw, t.now)
+		if !ok {
+			continue
+		}
+		if err := fn(key, value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (t *boltTxn) Commit() error {
+	if !t.tx.Writable() {
+		return t.tx.Rollback()
+	}
+	return t.tx.Commit()
+}
+
+func (t *boltTxn) Discard() {
+	// Rollback fails harmlessly if the transaction was committed.
+	t.tx.Rollback()
+}
+
+// Bolt values are a flag byte, an expiry time in Unix nanoseconds if
+// the flag is set, and the value.
+const (
+	boltNoExpiry = 0
+	boltExpiry   = 1
+)
+
+func encodeBoltValue(value []byte, expires time.Time) []byte {
+	if expires.IsZero() {
+		return append([]byte{boltNoExpiry}, value...)
+	}
+	buf := make([]byte, 9, 9+len(value))
+	buf[0] = boltExpiry
+	binary.BigEndian.PutUint64(buf[1:], uint64(expires.UnixNano()))
+	return append(buf, value...)
+}
+
+// decodeBoltValue returns the value stored in raw, and whether it
+// exists and has not expired.
+func decodeBoltValue(raw []byte, now time.Time) ([]byte, bool) {
+	if len(raw) == 0 {
+		return nil, false
+	}
+	switch raw[0] {
+	case boltNoExpiry:
+		return raw[1:], true
+	case boltExpiry:
+		if len(raw) < 9 {
+			return nil, false
+		}
+		expires := int64(binary.BigEndian.Uint64(raw[1:9]))
+		if now.UnixNano() >= expires {
+			return nil, false
+		}
+		return raw[9:], true
+	default:
+		return nil, false
+	}
+}
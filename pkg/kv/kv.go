@@ -0,0 +1,143 @@
+// Copyright 2018 David Lazar. All rights reserved.
+// Use of this source code is governed by the GNU AGPL
+// license that can be found in the LICENSE file.
+
+// Package kv defines the transactional key-value store that the PKG
+// server keeps its state in. Badger is the default backend; Bolt keeps
+// a small deployment's state in a single file, and MySQL keeps it in a
+// MySQL or MariaDB database.
+package kv
+
+import (
+	"time"
+
+	"vuvuzela.io/alpenhorn/errors"
+)
+
+// Names of the storage backends, as used in the PKG config file.
+const (
+	Badger = "badger"
+	Bolt   = "bolt"
+	MySQL  = "mysql"
+)
+
+// ErrNotFound is returned by Txn.Get when the key does not exist.
+var ErrNotFound = errors.New("kv: key not found")
+
+// ErrLocked is returned by Open when another process has the database
+// open for writing.
+var ErrLocked = errors.New("kv: database in use by another process")
+
+// ErrReadOnly is returned when writing in a read-only transaction.
+var ErrReadOnly = errors.New("kv: read-only transaction")
+
+// A DB is a key-value store with serializable transactions.
+type DB interface {
+	// NewTransaction starts a transaction, which must be ended with
+	// Commit or Discard. Only update transactions can write.
+	NewTransaction(update bool) (Txn, error)
+
+	// View runs fn in a read-only transaction.
+	View(fn func(tx Txn) error) error
+
+	// Update runs fn in an update transaction, and commits it if
+	// fn returns nil.
+	Update(fn func(tx Txn) error) error
+
+	// Size returns the size of the database on disk in bytes.
+	Size() int64
+
+	// Vacuum reclaims the space used by deleted and expired keys.
+	// The database must not be in use by a server.
+	Vacuum() error
+
+	Close() error
+}
+
+// A Txn is a transaction. A transaction sees a consistent snapshot of
+// the database along with its own writes.
+type Txn interface {
+	// Get returns the value of key, or ErrNotFound. The value must
+	// not be modified.
+	Get(key []byte) ([]byte, error)
+
+	Set(key, value []byte) error
+
+	// SetWithTTL sets key to value until ttl has passed, after which
+	// the key is treated as deleted.
+	SetWithTTL(key, value []byte, ttl time.Duration) error
+
+	Delete(key []byte) error
+
+	// Iterate calls fn on each key with the given prefix in key
+	// order, stopping at the first error. The key and value are only
+	// valid until fn returns.
+	Iterate(prefix []byte, fn func(key, value []byte) error) error
+
+	Commit() error
+	Discard()
+}
+
+// PoolStats describe the connection pool of a networked backend.
+type PoolStats struct {
+	Open  int // connections, in use or idle
+	InUse int
+	Idle  int
+
+	// WaitCount and WaitDuration are how many times, and for how
+	// long in all, transactions waited for a connection.
+	WaitCount    int64
+	WaitDuration time.Duration
+}
+
+// A Pooled DB is backed by a pool of connections to a database server.
+type Pooled interface {
+	PoolStats() PoolStats
+}
+
+// A Sweeper DB keeps expired keys, hidden, until they are swept.
+// Badger drops expired keys itself; Bolt, MySQL and memory databases
+// are Sweepers.
+type Sweeper interface {
+	// SweepExpired deletes at most limit expired keys and returns how
+	// many it deleted. Unlike Vacuum, it can run while a server is
+	// using the database.
+	SweepExpired(limit int) (int, error)
+}
+
+// Open opens the named backend's database in dir, creating it if
+// needed and readOnly is false. For MySQL, dir is the data source name.
+func Open(backend, dir string, readOnly bool) (DB, error) {
+	switch backend {
+	case Badger, "":
+		return OpenBadger(dir, readOnly)
+	case Bolt:
+		return OpenBolt(dir, readOnly)
+	case MySQL:
+		return OpenMySQL(dir, readOnly, MySQLPool{})
+	default:
+		return nil, errors.New("unknown storage backend %q", backend)
+	}
+}
+
+// view and update implement DB.View and DB.Update for any DB.
+func view(db DB, fn func(tx Txn) error) error {
+	tx, err := db.NewTransaction(false)
+	if err != nil {
+		return err
+	}
+	defer tx.Discard()
+	return fn(tx)
+}
+
+func update(db DB, fn func(tx Txn) error) error {
+	tx, err := db.NewTransaction(true)
+	if err != nil {
+		return err
+	}
+	defer tx.Discard()
+	if err := fn(tx); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
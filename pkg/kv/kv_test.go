@@ -0,0 +1,252 @@
+// Copyright 2018 David Lazar. All rights reserved.
+// Use of this source code is governed by the GNU AGPL
+// license that can be found in the LICENSE file.
+
+package kv
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestBackends(t *testing.T) {
+	for _, backend := range []string{Badger, Bolt} {
+		t.Run(backend, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "alpenhorn_kv_")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(dir)
+
+			db, err := Open(backend, dir, false)
+			if err != nil {
+				t.Fatal(err)
+			}
+			testDB(t, db)
+			if err := db.Close(); err != nil {
+				t.Fatal(err)
+			}
+
+			// The data survives reopening, read-only.
+			db, err = Open(backend, dir, true)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer db.Close()
+			err = db.View(func(tx Txn) error {
+				return expectValue(tx, "user:alice", "1")
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = db.Update(func(tx Txn) error {
+				return tx.Set([]byte("user:carol"), []byte("3"))
+			})
+			if err == nil {
+				t.Fatal("expected error writing to a read-only database")
+			}
+		})
+	}
+}
+
+func TestMemory(t *testing.T) {
+	db := NewMemory()
+	testDB(t, db)
+
+	// Concurrent updates are serialized.
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			err := db.Update(func(tx Txn) error {
+				value, err := tx.Get([]byte("counter"))
+				if err == ErrNotFound {
+					value = []byte{0}
+				} else if err != nil {
+					return err
+				}
+				return tx.Set([]byte("counter"), []byte{value[0] + 1})
+			})
+			if err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+	err := db.View(func(tx Txn) error {
+		return expectValue(tx, "counter", "\x0a")
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	db.Close()
+	if _, err := db.NewTransaction(false); err == nil {
+		t.Fatal("expected error using a closed database")
+	}
+}
+
+func TestOpenUnknownBackend(t *testing.T) {
+	if _, err := Open("floppy", os.TempDir(), true); err == nil {
+		t.Fatal("expected error")
+	}
+}
+
+// testDB checks the semantics that the PKG server relies on.
+func testDB(t *testing.T, db DB) {
+	err := db.Update(func(tx Txn) error {
+		for _, kv := range [][2]string{
+			{"user:bob", "2"},
+			{"user:alice", "1"},
+			{"round:1", "r"},
+			{"user:dave", "4"},
+		} {
+			if err := tx.Set([]byte(kv[0]), []byte(kv[1])); err != nil {
+				return err
+			}
+		}
+		return tx.SetWithTTL([]byte("replay:x"), []byte("x"), time.Hour)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = db.View(func(tx Txn) error {
+		if err := expectValue(tx, "user:alice", "1"); err != nil {
+			return err
+		}
+		if err := expectValue(tx, "replay:x", "x"); err != nil {
+			return err
+		}
+		if _, err := tx.Get([]byte("user:eve")); err != ErrNotFound {
+			return fmt.Errorf("Get missing key: got %v, want ErrNotFound", err)
+		}
+		if err := tx.Set([]byte("user:eve"), nil); err != ErrReadOnly {
+			return fmt.Errorf("Set in read-only transaction: got %v, want ErrReadOnly", err)
+		}
+
+		var keys []string
+		err := tx.Iterate([]byte("user:"), func(key, value []byte) error {
+			keys = append(keys, string(key))
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		if fmt.Sprint(keys) != "[user:alice user:bob user:dave]" {
+			return fmt.Errorf("Iterate: got keys %q", keys)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Discarded writes are rolled back, and a transaction sees its
+	// own writes.
+	tx, err := db.NewTransaction(true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := tx.Delete([]byte("user:bob")); err != nil {
+		t.Fatal(err)
+	}
+	if err := tx.Set([]byte("user:alice"), []byte("changed")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tx.Get([]byte("user:bob")); err != ErrNotFound {
+		t.Fatalf("Get deleted key in same transaction: got %v", err)
+	}
+	if err := expectValue(tx, "user:alice", "changed"); err != nil {
+		t.Fatal(err)
+	}
+	tx.Discard()
+
+	err = db.View(func(tx Txn) error {
+		if err := expectValue(tx, "user:bob", "2"); err != nil {
+			return err
+		}
+		return expectValue(tx, "user:alice", "1")
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// An error from Update's function rolls back the transaction.
+	errAbort := fmt.Errorf("abort")
+	err = db.Update(func(tx Txn) error {
+		tx.Delete([]byte("user:bob"))
+		return errAbort
+	})
+	if err != errAbort {
+		t.Fatalf("Update: got %v, want errAbort", err)
+	}
+
+	// Expired keys disappear.
+	err = db.Update(func(tx Txn) error {
+		return tx.SetWithTTL([]byte("replay:y"), []byte("y"), time.Nanosecond)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(time.Second)
+	err = db.View(func(tx Txn) error {
+		if _, err := tx.Get([]byte("replay:y")); err != ErrNotFound {
+			return fmt.Errorf("Get expired key: got %v, want ErrNotFound", err)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sweeper, ok := db.(Sweeper); ok {
+		err = db.Update(func(tx Txn) error {
+			for _, key := range []string{"replay:z1", "replay:z2"} {
+				if err := tx.SetWithTTL([]byte(key), []byte("z"), time.Nanosecond); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		time.Sleep(10 * time.Millisecond)
+		// replay:y, replay:z1, and replay:z2 have expired.
+		for _, want := range []int{2, 1, 0} {
+			n, err := sweeper.SweepExpired(2)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if n != want {
+				t.Fatalf("SweepExpired: deleted %d keys, want %d", n, want)
+			}
+		}
+	}
+	if err := db.Vacuum(); err != nil {
+		t.Fatal(err)
+	}
+	err = db.View(func(tx Txn) error {
+		return expectValue(tx, "replay:x", "x")
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func expectValue(tx Txn, key, want string) error {
+	got, err := tx.Get([]byte(key))
+	if err != nil {
+		return fmt.Errorf("Get %q: %s", key, err)
+	}
+	if !bytes.Equal(got, []byte(want)) {
+		return fmt.Errorf("Get %q: got %q, want %q", key, got, want)
+	}
+	return nil
+}
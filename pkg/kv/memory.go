@@ -0,0 +1,263 @@
+// Copyright 2018 David Lazar. All rights reserved.
+// Use of this source code is governed by the GNU AGPL
+// license that can be found in the LICENSE file.
+
+package kv
+
+import (
+	"bytes"
+	"sort"
+	"sync"
+	"time"
+
+	"vuvuzela.io/alpenhorn/errors"
+)
+
+// MemoryDB is a DB that keeps its data in memory, so tests can run a
+// full PKG server without touching the disk. Update transactions run
+// one at a time; readers see the data as of their transaction's start.
+type MemoryDB struct {
+	writer sync.Mutex
+
+	mu     sync.Mutex
+	data   map[string]memoryValue
+	closed bool
+}
+
+var errClosed = errors.New("kv: database is closed")
+
+type memoryValue struct {
+	value   []byte
+	expires time.Time
+}
+
+func (v memoryValue) live(now time.Time) bool {
+	return v.expires.IsZero() || now.Before(v.expires)
+}
+
+// NewMemory returns an empty in-memory database.
+func NewMemory() *MemoryDB {
+	return &MemoryDB{data: make(map[string]memoryValue)}
+}
+
+// snapshot returns the current data, which must not be modified.
+// Commits replace the map rather than change it.
+func (m *MemoryDB) snapshot() (map[string]memoryValue, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.closed {
+		return nil, errClosed
+	}
+	return m.data, nil
+}
+
+func (m *MemoryDB) NewTransaction(update bool) (Txn, error) {
+	if update {
+		m.writer.Lock()
+	}
+	data, err := m.snapshot()
+	if err != nil {
+		if update {
+			m.writer.Unlock()
+		}
+		return nil, err
+	}
+	tx := &memoryTxn{
+		db:     m,
+		data:   data,
+		update: update,
+		now:    time.Now(),
+	}
+	if update {
+		tx.writes = make(map[string]*memoryValue)
+	}
+	return tx, nil
+}
+
+func (m *MemoryDB) View(fn func(tx Txn) error) error {
+	return view(m, fn)
+}
+
+func (m *MemoryDB) Update(fn func(tx Txn) error) error {
+	return update(m, fn)
+}
+
+func (m *MemoryDB) Size() int64 {
+	data, _ := m.snapshot()
+	var size int64
+	for key, v := range data {
+		size += int64(len(key) + len(v.value))
+	}
+	return size
+}
+
+// Vacuum deletes expired keys.
+func (m *MemoryDB) Vacuum() error {
+	return m.Update(func(tx Txn) error {
+		t := tx.(*memoryTxn)
+		for key, v := range t.data {
+			if !v.live(t.now) {
+				t.writes[key] = nil
+			}
+		}
+		return nil
+	})
+}
+
+// SweepExpired deletes up to limit expired keys.
+func (m *MemoryDB) SweepExpired(limit int) (int, error) {
+	deleted := 0
+	err := m.Update(func(tx Txn) error {
+		t := tx.(*memoryTxn)
+		for key, v := range t.data {
+			if deleted == limit {
+				break
+			}
+			if !v.live(t.now) {
+				t.writes[key] = nil
+				deleted++
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	return deleted, nil
+}
+
+func (m *MemoryDB) Close() error {
+	m.mu.Lock()
+	m.closed = true
+	m.data = nil
+	m.mu.Unlock()
+	return nil
+}
+
+type memoryTxn struct {
+	db     *MemoryDB
+	data   map[string]memoryValue
+	update bool
+	now    time.Time
+
+	// writes maps keys to their new values, or nil for deleted keys.
+	writes map[string]*memoryValue
+	done   bool
+}
+
+func (t *memoryTxn) lookup(key string) (memoryValue, bool) {
+	if w, ok := t.writes[key]; ok {
+		if w == nil {
+			return memoryValue{}, false
+		}
+		return *w, w.live(t.now)
+	}
+	v, ok := t.data[key]
+	return v, ok && v.live(t.now)
+}
+
+func (t *memoryTxn) Get(key []byte) ([]byte, error) {
+	v, ok := t.lookup(string(key))
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return v.value, nil
+}
+
+func (t *memoryTxn) Set(key, value []byte) error {
+	return t.put(key, value, time.Time{})
+}
+
+func (t *memoryTxn) SetWithTTL(key, value []byte, ttl time.Duration) error {
+	return t.put(key, value, time.Now().Add(ttl))
+}
+
+func (t *memoryTxn) put(key, value []byte, expires time.Time) error {
+	if !t.update {
+		return ErrReadOnly
+	}
+	t.writes[string(key)] = &memoryValue{
+		value:   append([]byte(nil), value...),
+		expires: expires,
+	}
+	return nil
+}
+
+func (t *memoryTxn) Delete(key []byte) error {
+	if !t.update {
+		return ErrReadOnly
+	}
+	t.writes[string(key)] = nil
+	return nil
+}
+
+func (t *memoryTxn) Iterate(prefix []byte, fn func(key, value []byte) error) error {
+	var keys []string
+	for key := range t.data {
+		if _, ok := t.writes[key]; !ok && bytes.HasPrefix([]byte(key), prefix) {
+			keys = append(keys, key)
+		}
+	}
+	for key := range t.writes {
+		if bytes.HasPrefix([]byte(key), prefix) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		v, ok := t.lookup(key)
+		if !ok {
+			continue
+		}
+		if err := fn([]byte(key), v.value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (t *memoryTxn) Commit() error {
+	if t.done {
+		return nil
+	}
+	if !t.update || len(t.writes) == 0 {
+		t.Discard()
+		return nil
+	}
+
+	data := make(map[string]memoryValue, len(t.data)+len(t.writes))
+	for key, v := range t.data {
+		data[key] = v
+	}
+	for key, w := range t.writes {
+		if w == nil {
+			delete(data, key)
+		} else {
+			data[key] = *w
+		}
+	}
+
+	t.db.mu.Lock()
+	closed := t.db.closed
+	if !closed {
+		t.db.data = data
+	}
+	t.db.mu.Unlock()
+
+	t.Discard()
+	if closed {
+		return errClosed
+	}
+	return nil
+}
+
+func (t *memoryTxn) Discard() {
+	if t.done {
+		return
+	}
+	t.done = true
+	if t.update {
+		t.db.writer.Unlock()
+	}
+}
@@ -0,0 +1,390 @@
+// Copyright 2018 David Lazar. All rights reserved.
+// Use of this source code is governed by the GNU AGPL
+// license that can be found in the LICENSE file.
+
+package kv
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"strings"
+	"time"
+
+	"vuvuzela.io/alpenhorn/errors"
+)
+
+// MySQLTable is the table that MySQLDB keeps its keys in.
+const MySQLTable = "alpenhorn_kv"
+
+// mysqlPageSize is how many keys Iterate reads in each query.
+const mysqlPageSize = 1000
+
+// mysqlBatchSize is the most keys a transaction writes or deletes in
+// one statement.
+const mysqlBatchSize = 500
+
+// MySQLDB is a DB backed by a MySQL or MariaDB table, for operators
+// who run their databases there. Unlike the other backends, several
+// PKG processes can open the same MySQL database.
+//
+// Transactions are SERIALIZABLE InnoDB transactions. Where Badger fails
+// conflicting transactions when they commit, MySQL may fail one with a
+// deadlock error before then; either way the request fails with a
+// database error and the client retries. Like Bolt, MySQL has no key
+// expiry, so keys set with a TTL carry their expiry time and are hidden
+// once it passes; SweepExpired deletes them in batches, and Vacuum
+// deletes them all and rebuilds the table.
+//
+// The queries are prepared once when the database is opened, and each
+// connection in the pool keeps its own prepared copy, so requests do
+// not pay to parse and plan them. A transaction holds its writes until
+// it next reads or commits, and then sends runs of them in one
+// statement, so that transactions that write many keys, such as the
+// round garbage collector's, do not pay a round trip for each. Errors
+// from those writes are returned by the read or by Commit. PoolStats
+// reports how busy the pool is.
+//
+// This package does not link a MySQL driver. Binaries that use MySQLDB
+// must register one as "mysql", such as github.com/go-sql-driver/mysql,
+// which alpenhorn-pkg links when built with the mysql build tag.
+type MySQLDB struct {
+	db       *sql.DB
+	readOnly bool
+
+	get, put, del, iterFrom, iterAfter *sql.Stmt
+}
+
+const mysqlLive = `(expires = 0 OR expires > ?)`
+
+// MySQLPool sizes a MySQLDB's connection pool. Several PKG servers
+// that share a database must fit under its max_connections between
+// them, so each should cap its pool. Zero fields keep database/sql's
+// defaults: no limit on open connections, 2 idle connections, and no
+// limit on a connection's lifetime.
+type MySQLPool struct {
+	// MaxOpenConns caps the connections open to the database.
+	MaxOpenConns int
+
+	// MaxIdleConns caps the open connections kept idle.
+	MaxIdleConns int
+
+	// ConnMaxLifetime is how long a connection is reused before it
+	// is closed, such as to stay under the server's wait_timeout.
+	ConnMaxLifetime time.Duration
+}
+
+// OpenMySQL opens the MySQL database named by the data source name dsn
+// with a connection pool sized by pool, and creates MySQLTable in it if
+// needed and readOnly is false.
+func OpenMySQL(dsn string, readOnly bool, pool MySQLPool) (*MySQLDB, error) {
+	db, err := sql.Open("mysql", dsn)
+	if err != nil {
+		return nil, errors.Wrap(err, "opening mysql database")
+	}
+	if pool.MaxOpenConns > 0 {
+		db.SetMaxOpenConns(pool.MaxOpenConns)
+	}
+	if pool.MaxIdleConns > 0 {
+		db.SetMaxIdleConns(pool.MaxIdleConns)
+	}
+	if pool.ConnMaxLifetime > 0 {
+		db.SetConnMaxLifetime(pool.ConnMaxLifetime)
+	}
+	if err := db.Ping(); err != nil {
+		db.Close()
+		return nil, errors.Wrap(err, "connecting to mysql database")
+	}
+	if !readOnly {
+		_, err := db.Exec(`CREATE TABLE IF NOT EXISTS ` + MySQLTable + ` (
+			k VARBINARY(1024) NOT NULL PRIMARY KEY,
+			v LONGBLOB NOT NULL,
+			expires BIGINT NOT NULL DEFAULT 0,
+			KEY expires (expires)
+		) ENGINE=InnoDB`)
+		if err != nil {
+			db.Close()
+			return nil, errors.Wrap(err, "creating %s", MySQLTable)
+		}
+	}
+	m := &MySQLDB{db: db, readOnly: readOnly}
+	// Iterate reads pages of keys that start at or after a key.
+	queries := []struct {
+		stmt  **sql.Stmt
+		query string
+	}{
+		{&m.get, `SELECT v FROM ` + MySQLTable + ` WHERE k = ? AND ` + mysqlLive},
+		{&m.put, `INSERT INTO ` + MySQLTable + ` (k, v, expires) VALUES (?, ?, ?)
+			ON DUPLICATE KEY UPDATE v = VALUES(v), expires = VALUES(expires)`},
+		{&m.del, `DELETE FROM ` + MySQLTable + ` WHERE k = ?`},
+		{&m.iterFrom, `SELECT k, v FROM ` + MySQLTable + ` WHERE k >= ? AND ` + mysqlLive + ` ORDER BY k LIMIT ?`},
+		{&m.iterAfter, `SELECT k, v FROM ` + MySQLTable + ` WHERE k > ? AND ` + mysqlLive + ` ORDER BY k LIMIT ?`},
+	}
+	for _, q := range queries {
+		*q.stmt, err = db.Prepare(q.query)
+		if err != nil {
+			m.Close()
+			return nil, errors.Wrap(err, "preparing mysql statements")
+		}
+	}
+	return m, nil
+}
+
+func (m *MySQLDB) NewTransaction(update bool) (Txn, error) {
+	update = update && !m.readOnly
+	tx, err := m.db.BeginTx(context.Background(), &sql.TxOptions{
+		Isolation: sql.LevelSerializable,
+		ReadOnly:  !update,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &mysqlTxn{db: m, tx: tx, update: update, now: time.Now()}, nil
+}
+
+func (m *MySQLDB) View(fn func(tx Txn) error) error {
+	return view(m, fn)
+}
+
+func (m *MySQLDB) Update(fn func(tx Txn) error) error {
+	return update(m, fn)
+}
+
+func (m *MySQLDB) Size() int64 {
+	var size sql.NullInt64
+	m.db.QueryRow(`SELECT data_length + index_length FROM information_schema.tables
+		WHERE table_schema = DATABASE() AND table_name = ?`, MySQLTable).Scan(&size)
+	return size.Int64
+}
+
+// mysqlSweepBatch is how many keys Vacuum deletes in each statement.
+const mysqlSweepBatch = 10000
+
+// SweepExpired deletes up to limit expired keys in one statement, which
+// the index on expires keeps from scanning or locking the live keys.
+func (m *MySQLDB) SweepExpired(limit int) (int, error) {
+	if m.readOnly {
+		return 0, ErrReadOnly
+	}
+	res, err := m.db.Exec(`DELETE FROM `+MySQLTable+` WHERE expires <> 0 AND expires <= ? LIMIT ?`, time.Now().UnixNano(), limit)
+	if err != nil {
+		return 0, err
+	}
+	n, err := res.RowsAffected()
+	return int(n), err
+}
+
+// Vacuum deletes expired keys and rebuilds the table to reclaim their
+// space.
+func (m *MySQLDB) Vacuum() error {
+	for {
+		n, err := m.SweepExpired(mysqlSweepBatch)
+		if err != nil {
+			return err
+		}
+		if n < mysqlSweepBatch {
+			break
+		}
+	}
+	rows, err := m.db.Query(`OPTIMIZE TABLE ` + MySQLTable)
+	if err != nil {
+		return err
+	}
+	return rows.Close()
+}
+
+// PoolStats reports on the database's connection pool.
+func (m *MySQLDB) PoolStats() PoolStats {
+	s := m.db.Stats()
+	return PoolStats{
+		Open:         s.OpenConnections,
+		InUse:        s.InUse,
+		Idle:         s.Idle,
+		WaitCount:    s.WaitCount,
+		WaitDuration: s.WaitDuration,
+	}
+}
+
+func (m *MySQLDB) Close() error {
+	for _, stmt := range []*sql.Stmt{m.get, m.put, m.del, m.iterFrom, m.iterAfter} {
+		if stmt != nil {
+			stmt.Close()
+		}
+	}
+	return m.db.Close()
+}
+
+type mysqlTxn struct {
+	db     *MySQLDB
+	tx     *sql.Tx
+	update bool
+	now    time.Time
+
+	// writes are waiting to be sent; see flush.
+	writes []mysqlWrite
+}
+
+// A mysqlWrite sets a key, or deletes it if del is true.
+type mysqlWrite struct {
+	key, value []byte
+	expires    int64
+	del        bool
+}
+
+// flush sends the transaction's waiting writes, in order, batching
+// runs of sets and runs of deletes.
+func (t *mysqlTxn) flush() error {
+	writes := t.writes
+	t.writes = nil
+	for len(writes) > 0 {
+		n := 1
+		for n < len(writes) && n < mysqlBatchSize && writes[n].del == writes[0].del {
+			n++
+		}
+		if err := t.exec(writes[:n]); err != nil {
+			return err
+		}
+		writes = writes[n:]
+	}
+	return nil
+}
+
+// exec sends a run of sets or a run of deletes in one statement.
+func (t *mysqlTxn) exec(run []mysqlWrite) error {
+	var err error
+	switch {
+	case len(run) == 1 && run[0].del:
+		_, err = t.tx.Stmt(t.db.del).Exec(run[0].key)
+	case len(run) == 1:
+		_, err = t.tx.Stmt(t.db.put).Exec(run[0].key, run[0].value, run[0].expires)
+	case run[0].del:
+		args := make([]interface{}, len(run))
+		for i, w := range run {
+			args[i] = w.key
+		}
+		query := `DELETE FROM ` + MySQLTable + ` WHERE k IN (?` + strings.Repeat(`, ?`, len(run)-1) + `)`
+		_, err = t.tx.Exec(query, args...)
+	default:
+		args := make([]interface{}, 0, 3*len(run))
+		for _, w := range run {
+			args = append(args, w.key, w.value, w.expires)
+		}
+		query := `INSERT INTO ` + MySQLTable + ` (k, v, expires) VALUES (?, ?, ?)` +
+			strings.Repeat(`, (?, ?, ?)`, len(run)-1) +
+			` ON DUPLICATE KEY UPDATE v = VALUES(v), expires = VALUES(expires)`
+		_, err = t.tx.Exec(query, args...)
+	}
+	return err
+}
+
+func (t *mysqlTxn) Get(key []byte) ([]byte, error) {
+	if err := t.flush(); err != nil {
+		return nil, err
+	}
+	var value []byte
+	err := t.tx.Stmt(t.db.get).QueryRow(key, t.now.UnixNano()).Scan(&value)
+	if err == sql.ErrNoRows {
+		return nil, ErrNotFound
+	}
+	return value, err
+}
+
+func (t *mysqlTxn) Set(key, value []byte) error {
+	return t.put(key, value, 0)
+}
+
+func (t *mysqlTxn) SetWithTTL(key, value []byte, ttl time.Duration) error {
+	return t.put(key, value, time.Now().Add(ttl).UnixNano())
+}
+
+func (t *mysqlTxn) put(key, value []byte, expires int64) error {
+	if !t.update {
+		return ErrReadOnly
+	}
+	if value == nil {
+		// database/sql sends nil slices as NULL.
+		value = []byte{}
+	}
+	// The caller may reuse key and value once put returns.
+	t.writes = append(t.writes, mysqlWrite{
+		key:     append([]byte(nil), key...),
+		value:   append([]byte{}, value...),
+		expires: expires,
+	})
+	return nil
+}
+
+func (t *mysqlTxn) Delete(key []byte) error {
+	if !t.update {
+		return ErrReadOnly
+	}
+	t.writes = append(t.writes, mysqlWrite{key: append([]byte(nil), key...), del: true})
+	return nil
+}
+
+// Iterate reads the keys a page at a time, since a transaction's
+// connection cannot run fn's queries while a result set is open.
+func (t *mysqlTxn) Iterate(prefix []byte, fn func(key, value []byte) error) error {
+	if prefix == nil {
+		prefix = []byte{}
+	}
+	from := prefix
+	stmt := t.db.iterFrom
+	for {
+		// Each page sees the writes fn made on the last one.
+		if err := t.flush(); err != nil {
+			return err
+		}
+		rows, err := t.tx.Stmt(stmt).Query(from, t.now.UnixNano(), mysqlPageSize)
+		if err != nil {
+			return err
+		}
+		var keys, values [][]byte
+		done := false
+		for rows.Next() {
+			var key, value []byte
+			if err := rows.Scan(&key, &value); err != nil {
+				rows.Close()
+				return err
+			}
+			if !bytes.HasPrefix(key, prefix) {
+				done = true
+				break
+			}
+			keys = append(keys, key)
+			values = append(values, value)
+		}
+		if err := rows.Close(); err != nil {
+			return err
+		}
+		if err := rows.Err(); err != nil {
+			return err
+		}
+		for i := range keys {
+			if err := fn(keys[i], values[i]); err != nil {
+				return err
+			}
+		}
+		if done || len(keys) < mysqlPageSize {
+			return nil
+		}
+		from = keys[len(keys)-1]
+		stmt = t.db.iterAfter
+	}
+}
+
+func (t *mysqlTxn) Commit() error {
+	if !t.update {
+		return t.tx.Rollback()
+	}
+	if err := t.flush(); err != nil {
+		t.tx.Rollback()
+		return err
+	}
+	return t.tx.Commit()
+}
+
+func (t *mysqlTxn) Discard() {
+	// Rollback fails harmlessly if the transaction was committed.
+	t.tx.Rollback()
+}
@@ -0,0 +1,10 @@
+// Copyright 2018 David Lazar. All rights reserved.
+// Use of this source code is governed by the GNU AGPL
+// license that can be found in the LICENSE file.
+
+//go:build mysql
+// +build mysql
+
+package kv
+
+import _ "github.com/go-sql-driver/mysql"
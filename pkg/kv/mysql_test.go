@@ -0,0 +1,102 @@
+// Copyright 2018 David Lazar. All rights reserved.
+// Use of this source code is governed by the GNU AGPL
+// license that can be found in the LICENSE file.
+
+package kv
+
+import (
+	"database/sql"
+	"fmt"
+	"os"
+	"testing"
+	"time"
+)
+
+// TestMySQL runs against the database in $ALPENHORN_TEST_MYSQL, which
+// it empties first, when the test is built with the mysql build tag.
+func TestMySQL(t *testing.T) {
+	dsn := os.Getenv("ALPENHORN_TEST_MYSQL")
+	if dsn == "" {
+		t.Skip("ALPENHORN_TEST_MYSQL is not set")
+	}
+	linked := false
+	for _, name := range sql.Drivers() {
+		linked = linked || name == MySQL
+	}
+	if !linked {
+		t.Skip("no MySQL driver; test with -tags mysql")
+	}
+
+	db, err := OpenMySQL(dsn, false, MySQLPool{MaxOpenConns: 4, MaxIdleConns: 2, ConnMaxLifetime: time.Minute})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.db.Exec(`DELETE FROM ` + MySQLTable); err != nil {
+		t.Fatal(err)
+	}
+	testDB(t, db)
+	testMySQLBatches(t, db)
+	if n := db.db.Stats().MaxOpenConnections; n != 4 {
+		t.Fatalf("pool allows %d open connections, want 4", n)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	db, err = OpenMySQL(dsn, true, MySQLPool{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	err = db.Update(func(tx Txn) error {
+		return tx.Set([]byte("user:carol"), []byte("3"))
+	})
+	if err == nil {
+		t.Fatal("expected error writing to a read-only database")
+	}
+}
+
+// testMySQLBatches checks that a transaction's batched writes keep
+// their order and are seen by its reads.
+func testMySQLBatches(t *testing.T, db *MySQLDB) {
+	const n = 2*mysqlBatchSize + 1
+	key := func(i int) []byte {
+		return []byte(fmt.Sprintf("batch:%04d", i))
+	}
+	err := db.Update(func(tx Txn) error {
+		for i := 0; i < n; i++ {
+			if err := tx.Set(key(i), []byte("1")); err != nil {
+				return err
+			}
+		}
+		for i := 0; i < n; i += 3 {
+			if err := tx.Delete(key(i)); err != nil {
+				return err
+			}
+		}
+		// Set again after its delete.
+		if err := tx.Set(key(0), []byte("2")); err != nil {
+			return err
+		}
+		if _, err := tx.Get(key(3)); err != ErrNotFound {
+			return fmt.Errorf("Get deleted key: got %v, want ErrNotFound", err)
+		}
+		return expectValue(tx, string(key(0)), "2")
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	count := 0
+	err = db.View(func(tx Txn) error {
+		return tx.Iterate([]byte("batch:"), func(_, _ []byte) error {
+			count++
+			return nil
+		})
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := n - (n+2)/3 + 1; count != want {
+		t.Fatalf("got %d keys, want %d", count, want)
+	}
+}
@@ -0,0 +1,381 @@
+// Copyright 2018 David Lazar. All rights reserved.
+// Use of this source code is governed by the GNU AGPL
+// license that can be found in the LICENSE file.
+
+package kv
+
+import (
+	"bytes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"time"
+
+	"golang.org/x/crypto/chacha20poly1305"
+
+	"vuvuzela.io/alpenhorn/errors"
+)
+
+// A SealKey is one of the keys a SealedDB encrypts values with. The ID
+// is stored with each value sealed under the key, so that the key can
+// be replaced without rewriting every value at once.
+type SealKey struct {
+	ID  byte
+	Key []byte
+}
+
+// sealMagic starts every sealed value. Values without it were written
+// before sealing was enabled and are returned as they are.
+var sealMagic = []byte("\xffSV1")
+
+// blindMagic starts the sealed values of blinded keys. They also hold
+// the key they were written under, which their stored key does not
+// show.
+var blindMagic = []byte("\xffSV2")
+
+// blindKeyInfo separates a seal key's blinding key from the key itself.
+const blindKeyInfo = "alpenhorn kv blind"
+
+// A blinded identity is stored as blindMarker, the ID of the seal key
+// whose blinding key it was computed with, and the HMAC.
+const (
+	blindMarker  = 0
+	blindedIDLen = 2 + sha256.Size
+)
+
+const sealOverhead = 4 + 1 + chacha20poly1305.NonceSizeX + chacha20poly1305.Overhead
+
+// SealedDB encrypts the values of some of the keys in a DB, so that a
+// copy of the database, such as a backup, does not reveal them without
+// the seal keys. Values are sealed with XChaCha20-Poly1305 under the
+// first of the keys, with the key they are stored under as additional
+// data, so a sealed value cannot be moved to another key. Any of the
+// keys can open values.
+//
+// Keys are not encrypted, but the part of a key that names someone,
+// its identity, can be blinded: the key is stored with the identity
+// replaced by an HMAC of it, under a blinding key derived from the
+// first seal key, and the key's value is sealed together with the key.
+// Gets and prefix iterations that include the whole identity look it
+// up under each seal key's blinding key, and then as it is, where it
+// was stored before blinding was enabled. Sets store it blinded with
+// the first key and delete it from the other places.
+type SealedDB struct {
+	DB
+
+	primary  byte
+	ids      []byte
+	aeads    map[byte]cipher.AEAD
+	blinds   map[byte][]byte
+	sealed   func(key []byte) bool
+	identity func(key []byte) (start, end int, ok bool)
+}
+
+// NewSealedDB returns a DB that seals the values of the keys in db for
+// which sealed returns true. keys[0] seals new values.
+//
+// If identity is not nil, it returns where the identity is in a key or
+// a prefix, if it contains a whole one. Identities are blinded only in
+// sealed keys. sealed must also hold for a blinded key, so it should
+// depend only on what comes before the identity, and prefixes passed
+// to Iterate must contain all of an identity or none of it.
+func NewSealedDB(db DB, keys []SealKey, sealed func(key []byte) bool, identity func(key []byte) (start, end int, ok bool)) (*SealedDB, error) {
+	if len(keys) == 0 {
+		return nil, errors.New("no seal keys")
+	}
+	s := &SealedDB{
+		DB:       db,
+		primary:  keys[0].ID,
+		aeads:    make(map[byte]cipher.AEAD, len(keys)),
+		blinds:   make(map[byte][]byte, len(keys)),
+		sealed:   sealed,
+		identity: identity,
+	}
+	for _, k := range keys {
+		if _, ok := s.aeads[k.ID]; ok {
+			return nil, errors.New("duplicate seal key id %d", k.ID)
+		}
+		aead, err := chacha20poly1305.NewX(k.Key)
+		if err != nil {
+			return nil, errors.Wrap(err, "seal key %d", k.ID)
+		}
+		s.ids = append(s.ids, k.ID)
+		s.aeads[k.ID] = aead
+		mac := hmac.New(sha256.New, k.Key)
+		mac.Write([]byte(blindKeyInfo))
+		s.blinds[k.ID] = mac.Sum(nil)
+	}
+	return s, nil
+}
+
+// Unwrap returns the underlying DB.
+func (s *SealedDB) Unwrap() DB {
+	return s.DB
+}
+
+// storedKeys returns the keys the value of key may be stored under:
+// blinded with each seal key, the first key first, and as it is.
+func (s *SealedDB) storedKeys(key []byte) [][]byte {
+	if s.identity == nil || !s.sealed(key) {
+		return [][]byte{key}
+	}
+	start, end, ok := s.identity(key)
+	if !ok {
+		return [][]byte{key}
+	}
+	stored := make([][]byte, 0, len(s.ids)+1)
+	for _, id := range s.ids {
+		mac := hmac.New(sha256.New, s.blinds[id])
+		mac.Write(key[start:end])
+		b := make([]byte, 0, len(key)-(end-start)+blindedIDLen)
+		b = append(b, key[:start]...)
+		b = append(b, blindMarker, id)
+		b = mac.Sum(b)
+		stored = append(stored, append(b, key[end:]...))
+	}
+	return append(stored, key)
+}
+
+// seal seals value to be stored under stored, which is key, or key
+// blinded.
+func (s *SealedDB) seal(stored, key, value []byte) []byte {
+	magic := sealMagic
+	if !bytes.Equal(stored, key) {
+		magic = blindMagic
+		var n [binary.MaxVarintLen64]byte
+		msg := make([]byte, 0, len(n)+len(key)+len(value))
+		msg = append(msg, n[:binary.PutUvarint(n[:], uint64(len(key)))]...)
+		msg = append(msg, key...)
+		value = append(msg, value...)
+	}
+	out := make([]byte, 0, len(value)+sealOverhead)
+	out = append(out, magic...)
+	out = append(out, s.primary)
+	nonce := out[len(out) : len(out)+chacha20poly1305.NonceSizeX]
+	if _, err := rand.Read(nonce); err != nil {
+		panic(err)
+	}
+	out = out[:len(out)+len(nonce)]
+	return s.aeads[s.primary].Seal(out, nonce, value, stored)
+}
+
+// open opens the value stored under stored, and returns it with the
+// key it was written under.
+func (s *SealedDB) open(stored, value []byte) (key []byte, msg []byte, err error) {
+	id, ok := SealKeyID(value)
+	if !ok {
+		return stored, value, nil
+	}
+	aead := s.aeads[id]
+	if aead == nil {
+		return nil, nil, errors.New("kv: value sealed with unknown key %d", id)
+	}
+	if len(value) < sealOverhead {
+		return nil, nil, errors.New("kv: short sealed value")
+	}
+	nonce := value[len(sealMagic)+1 : len(sealMagic)+1+chacha20poly1305.NonceSizeX]
+	ctxt := value[len(sealMagic)+1+chacha20poly1305.NonceSizeX:]
+	msg, err = aead.Open(nil, nonce, ctxt, stored)
+	if err != nil {
+		return nil, nil, errors.New("kv: sealed value does not open with key %d", id)
+	}
+	if !bytes.HasPrefix(value, blindMagic) {
+		return stored, msg, nil
+	}
+	n, k := binary.Uvarint(msg)
+	if k <= 0 || uint64(len(msg)-k) < n {
+		return nil, nil, errors.New("kv: bad blinded value")
+	}
+	return msg[k : k+int(n)], msg[k+int(n):], nil
+}
+
+// SealKeyID returns the ID of the key value was sealed with, or false
+// if value is not sealed.
+func SealKeyID(value []byte) (byte, bool) {
+	if len(value) <= len(sealMagic) {
+		return 0, false
+	}
+	if !bytes.HasPrefix(value, sealMagic) && !bytes.HasPrefix(value, blindMagic) {
+		return 0, false
+	}
+	return value[len(sealMagic)], true
+}
+
+func (s *SealedDB) NewTransaction(update bool) (Txn, error) {
+	tx, err := s.DB.NewTransaction(update)
+	if err != nil {
+		return nil, err
+	}
+	return &sealedTxn{Txn: tx, db: s}, nil
+}
+
+func (s *SealedDB) View(fn func(tx Txn) error) error {
+	return view(s, fn)
+}
+
+func (s *SealedDB) Update(fn func(tx Txn) error) error {
+	return update(s, fn)
+}
+
+// resealBatch is how many values Reseal rewrites in each transaction.
+const resealBatch = 1000
+
+// current reports whether the value stored under stored is sealed with
+// the first key, under the key blinded with the first key if it has
+// an identity.
+func (s *SealedDB) current(stored, key, value []byte) bool {
+	id, ok := SealKeyID(value)
+	return ok && id == s.primary && bytes.Equal(stored, s.storedKeys(key)[0])
+}
+
+// Reseal rewrites the values of the keys for which rewrite returns
+// true that are not sealed with the first key, or not blinded with it,
+// sealing and blinding them with it. It returns how many values it
+// rewrote, and how many other values are still not sealed with the
+// first key. Since Txn cannot read a key's TTL, rewrite should exclude
+// keys that expire; their values are left as they are until they
+// expire, and the keys that sealed them must be kept until then.
+func (s *SealedDB) Reseal(rewrite func(key []byte) bool) (resealed int, stale int, err error) {
+	var keys [][]byte
+	err = s.DB.View(func(tx Txn) error {
+		return tx.Iterate(nil, func(stored, value []byte) error {
+			if !s.sealed(stored) {
+				return nil
+			}
+			key, _, err := s.open(stored, value)
+			if err != nil {
+				return err
+			}
+			if s.current(stored, key, value) {
+				return nil
+			}
+			if rewrite(key) {
+				keys = append(keys, append([]byte(nil), key...))
+			} else {
+				stale++
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		return 0, 0, err
+	}
+	for len(keys) > 0 {
+		n := len(keys)
+		if n > resealBatch {
+			n = resealBatch
+		}
+		done := 0
+		err := s.Update(func(tx Txn) error {
+			done = 0
+			for _, key := range keys[:n] {
+				value, err := tx.Get(key)
+				if err == ErrNotFound {
+					continue
+				} else if err != nil {
+					return err
+				}
+				if err := tx.Set(key, value); err != nil {
+					return err
+				}
+				done++
+			}
+			return nil
+		})
+		if err != nil {
+			return resealed, stale, err
+		}
+		resealed += done
+		keys = keys[n:]
+	}
+	return resealed, stale, nil
+}
+
+type sealedTxn struct {
+	Txn
+	db *SealedDB
+}
+
+func (t *sealedTxn) Get(key []byte) ([]byte, error) {
+	if !t.db.sealed(key) {
+		return t.Txn.Get(key)
+	}
+	for _, stored := range t.db.storedKeys(key) {
+		value, err := t.Txn.Get(stored)
+		if err == ErrNotFound {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		k, msg, err := t.db.open(stored, value)
+		if err != nil {
+			return nil, err
+		}
+		if !bytes.Equal(k, key) {
+			return nil, errors.New("kv: blinded value belongs to another key")
+		}
+		return msg, nil
+	}
+	return nil, ErrNotFound
+}
+
+// set stores value under key blinded with the first seal key, and
+// deletes key from the other places it may be stored.
+func (t *sealedTxn) set(key, value []byte, set func(stored, value []byte) error) error {
+	if !t.db.sealed(key) {
+		return set(key, value)
+	}
+	stored := t.db.storedKeys(key)
+	if err := set(stored[0], t.db.seal(stored[0], key, value)); err != nil {
+		return err
+	}
+	for _, old := range stored[1:] {
+		if err := t.Txn.Delete(old); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (t *sealedTxn) Set(key, value []byte) error {
+	return t.set(key, value, t.Txn.Set)
+}
+
+func (t *sealedTxn) SetWithTTL(key, value []byte, ttl time.Duration) error {
+	return t.set(key, value, func(stored, value []byte) error {
+		return t.Txn.SetWithTTL(stored, value, ttl)
+	})
+}
+
+func (t *sealedTxn) Delete(key []byte) error {
+	if !t.db.sealed(key) {
+		return t.Txn.Delete(key)
+	}
+	for _, stored := range t.db.storedKeys(key) {
+		if err := t.Txn.Delete(stored); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (t *sealedTxn) Iterate(prefix []byte, fn func(key, value []byte) error) error {
+	for _, p := range t.db.storedKeys(prefix) {
+		err := t.Txn.Iterate(p, func(stored, value []byte) error {
+			if !t.db.sealed(stored) {
+				return fn(stored, value)
+			}
+			key, msg, err := t.db.open(stored, value)
+			if err != nil {
+				return err
+			}
+			return fn(key, msg)
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
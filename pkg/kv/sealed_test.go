@@ -0,0 +1,281 @@
+// Copyright 2018 David Lazar. All rights reserved.
+// Use of this source code is governed by the GNU AGPL
+// license that can be found in the LICENSE file.
+
+package kv
+
+import (
+	"bytes"
+	"crypto/rand"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newSealKey(id byte) SealKey {
+	key := make([]byte, 32)
+	rand.Read(key)
+	return SealKey{ID: id, Key: key}
+}
+
+func TestSealedDB(t *testing.T) {
+	mem := NewMemory()
+	db, err := NewSealedDB(mem, []SealKey{newSealKey(1)}, func(key []byte) bool {
+		return bytes.HasPrefix(key, []byte("user:"))
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testDB(t, db)
+
+	err = db.Update(func(tx Txn) error {
+		if err := tx.Set([]byte("user:dave"), []byte("dave@example.org")); err != nil {
+			return err
+		}
+		return tx.Set([]byte("round:1"), []byte("public"))
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var sealed []byte
+	err = mem.View(func(tx Txn) error {
+		if err := expectValue(tx, "round:1", "public"); err != nil {
+			return err
+		}
+		sealed, err = tx.Get([]byte("user:dave"))
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(sealed, []byte("dave@example.org")) {
+		t.Fatal("value stored in plaintext")
+	}
+	if id, ok := SealKeyID(sealed); !ok || id != 1 {
+		t.Fatalf("sealed with key %d (%v)", id, ok)
+	}
+
+	// A sealed value does not open under another key.
+	err = mem.Update(func(tx Txn) error {
+		return tx.Set([]byte("user:erin"), sealed)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = db.View(func(tx Txn) error {
+		_, err := tx.Get([]byte("user:erin"))
+		return err
+	})
+	if err == nil {
+		t.Fatal("moved value opened")
+	}
+}
+
+func TestReseal(t *testing.T) {
+	sealed := func(key []byte) bool { return bytes.HasPrefix(key, []byte("user:")) }
+	oldKey, newKey := newSealKey(1), newSealKey(2)
+	mem := NewMemory()
+
+	// A value written before sealing was enabled.
+	err := mem.Update(func(tx Txn) error {
+		return tx.Set([]byte("user:alice"), []byte("alice@example.org"))
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	db, err := NewSealedDB(mem, []SealKey{oldKey}, sealed, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = db.Update(func(tx Txn) error {
+		if err := tx.Set([]byte("user:bob"), []byte("bob@example.org")); err != nil {
+			return err
+		}
+		return tx.Set([]byte("user:bob:renamed"), []byte("robert@example.org"))
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Without the old key, bob's value does not open.
+	db, err = NewSealedDB(mem, []SealKey{newKey}, sealed, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = db.View(func(tx Txn) error {
+		_, err := tx.Get([]byte("user:bob"))
+		return err
+	})
+	if err == nil {
+		t.Fatal("value opened without its key")
+	}
+
+	db, err = NewSealedDB(mem, []SealKey{newKey, oldKey}, sealed, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resealed, stale, err := db.Reseal(func(key []byte) bool {
+		return !bytes.HasSuffix(key, []byte(":renamed"))
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resealed != 2 || stale != 1 {
+		t.Fatalf("resealed %d, stale %d; want 2, 1", resealed, stale)
+	}
+
+	err = mem.View(func(tx Txn) error {
+		for _, key := range []string{"user:alice", "user:bob"} {
+			value, err := tx.Get([]byte(key))
+			if err != nil {
+				return err
+			}
+			if id, ok := SealKeyID(value); !ok || id != newKey.ID {
+				t.Fatalf("%s: sealed with key %d (%v)", key, id, ok)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = db.View(func(tx Txn) error {
+		if err := expectValue(tx, "user:alice", "alice@example.org"); err != nil {
+			return err
+		}
+		if err := expectValue(tx, "user:bob", "bob@example.org"); err != nil {
+			return err
+		}
+		return expectValue(tx, "user:bob:renamed", "robert@example.org")
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSealedDBBlind(t *testing.T) {
+	sealed := func(key []byte) bool { return bytes.HasPrefix(key, []byte("user:")) }
+	// Identities are the 8 bytes after the prefix.
+	identity := func(key []byte) (int, int, bool) {
+		return 5, 13, sealed(key) && len(key) >= 13
+	}
+	oldKey, newKey := newSealKey(1), newSealKey(2)
+	mem := NewMemory()
+
+	// A record written before blinding was enabled.
+	err := mem.Update(func(tx Txn) error {
+		return tx.Set([]byte("user:alice123:log"), []byte("alice's log"))
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	db, err := NewSealedDB(NewMemory(), []SealKey{oldKey}, sealed, identity)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testDB(t, db)
+	db, err = NewSealedDB(mem, []SealKey{oldKey}, sealed, identity)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = db.Update(func(tx Txn) error {
+		if err := tx.Set([]byte("user:bob45678:log"), []byte("bob's log")); err != nil {
+			return err
+		}
+		return tx.SetWithTTL([]byte("user:bob45678:renamed"), []byte("robert"), time.Hour)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rawKeys := func() []string {
+		var keys []string
+		err := mem.View(func(tx Txn) error {
+			return tx.Iterate([]byte("user:"), func(key, value []byte) error {
+				if bytes.Contains(value, []byte("bob")) {
+					t.Fatalf("value of %q stored in plaintext", key)
+				}
+				keys = append(keys, string(key))
+				return nil
+			})
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return keys
+	}
+	for _, key := range rawKeys() {
+		if strings.Contains(key, "bob45678") {
+			t.Fatalf("identity stored in the clear: %q", key)
+		}
+	}
+
+	expectKeys := func(prefix string, want ...string) {
+		var got []string
+		err := db.View(func(tx Txn) error {
+			return tx.Iterate([]byte(prefix), func(key, _ []byte) error {
+				got = append(got, string(key))
+				return nil
+			})
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		sort.Strings(got)
+		if strings.Join(got, ",") != strings.Join(want, ",") {
+			t.Fatalf("keys under %q: got %q, want %q", prefix, got, want)
+		}
+	}
+	expectKeys("user:", "user:alice123:log", "user:bob45678:log", "user:bob45678:renamed")
+	expectKeys("user:bob45678", "user:bob45678:log", "user:bob45678:renamed")
+	expectKeys("user:alice123", "user:alice123:log")
+
+	// Rotate in a new key: records blinded with the old key are still
+	// found, and Reseal moves them.
+	db, err = NewSealedDB(mem, []SealKey{newKey, oldKey}, sealed, identity)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = db.View(func(tx Txn) error {
+		if err := expectValue(tx, "user:alice123:log", "alice's log"); err != nil {
+			return err
+		}
+		return expectValue(tx, "user:bob45678:log", "bob's log")
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	resealed, stale, err := db.Reseal(func(key []byte) bool {
+		return !bytes.HasSuffix(key, []byte(":renamed"))
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resealed != 2 || stale != 1 {
+		t.Fatalf("resealed %d, stale %d; want 2, 1", resealed, stale)
+	}
+	keys := rawKeys()
+	if len(keys) != 3 {
+		t.Fatalf("stored keys after reseal: %q", keys)
+	}
+	for _, key := range keys {
+		if strings.Contains(key, "alice123") {
+			t.Fatalf("identity stored in the clear: %q", key)
+		}
+	}
+	expectKeys("user:bob45678", "user:bob45678:log", "user:bob45678:renamed")
+
+	err = db.Update(func(tx Txn) error {
+		if err := tx.Delete([]byte("user:bob45678:renamed")); err != nil {
+			return err
+		}
+		return tx.Delete([]byte("user:alice123:log"))
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if keys := rawKeys(); len(keys) != 1 {
+		t.Fatalf("stored keys after deletes: %q", keys)
+	}
+}
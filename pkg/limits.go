@@ -0,0 +1,143 @@
+// Copyright 2018 David Lazar. All rights reserved.
+// Use of this source code is governed by the GNU AGPL
+// license that can be found in the LICENSE file.
+
+//go:build !js
+// +build !js
+
+package pkg
+
+import (
+	"net/http"
+	"time"
+
+	"vuvuzela.io/alpenhorn/errors"
+)
+
+// Each handler limits the size of the requests it decodes, but the
+// server also caps every request body at Config.MaxRequestBytes and
+// the handlers running at once at Config.MaxConcurrentRequests, so a
+// client cannot exhaust the server's memory by sending large bodies
+// or by holding many requests open. Requests from the coordinator and
+// the registrar do not count against the concurrency limit, so
+// clients cannot hold up rounds.
+//
+// Config.EndpointLimits also caps the handlers running at once on
+// each path it lists, so a burst of extractions cannot starve
+// registrations, or the other way around. Unlike the overall limit,
+// a request over its path's limit waits in line for a slot, for up to
+// Config.EndpointQueueTimeout, before it is refused with ErrServerBusy.
+// It waits before taking one of the server's overall slots, so waiting
+// requests do not crowd out other paths.
+
+// DefaultMaxRequestBytes is the largest request body the server reads
+// if Config.MaxRequestBytes is zero. The largest requests are the
+// coordinator's reveals, which carry a commitment from every PKG.
+const DefaultMaxRequestBytes = 1 << 20
+
+// DefaultEndpointQueueTimeout is how long a request waits for a slot
+// on its path if Config.EndpointQueueTimeout is zero.
+const DefaultEndpointQueueTimeout = time.Second
+
+// unlimitedPaths are the paths of authenticated requests that do not
+// count against Config.MaxConcurrentRequests.
+var unlimitedPaths = map[string]bool{
+	"/commit":               true,
+	"/reveal":               true,
+	"/registrar/userfilter": true,
+	"/readyz":               true,
+}
+
+// limitBody caps the size of req's body, replying to the request and
+// returning false if the client says it is too large.
+func (srv *Server) limitBody(w http.ResponseWriter, req *http.Request) bool {
+	if req.ContentLength > srv.maxRequestBytes {
+		httpError(w, errorf(ErrRequestTooLarge, "%d bytes exceeds the limit of %d", req.ContentLength, srv.maxRequestBytes))
+		return false
+	}
+	req.Body = http.MaxBytesReader(w, req.Body, srv.maxRequestBytes)
+	return true
+}
+
+// acquireHandler takes one of the server's handler slots for req. If
+// none are free, it replies with ErrServerBusy and returns false. The
+// caller must call releaseHandler when acquireHandler returns true.
+func (srv *Server) acquireHandler(w http.ResponseWriter, req *http.Request) bool {
+	if srv.handlerSlots == nil || unlimitedPaths[req.URL.Path] {
+		return true
+	}
+	select {
+	case srv.handlerSlots <- struct{}{}:
+		return true
+	default:
+		w.Header().Set("Retry-After", "1")
+		httpError(w, errorf(ErrServerBusy, ""))
+		return false
+	}
+}
+
+func (srv *Server) releaseHandler(req *http.Request) {
+	if srv.handlerSlots == nil || unlimitedPaths[req.URL.Path] {
+		return
+	}
+	<-srv.handlerSlots
+}
+
+// newEndpointSlots checks Config.EndpointLimits and returns a semaphore
+// for each path it limits.
+func newEndpointSlots(limits map[string]int) (map[string]chan struct{}, error) {
+	if len(limits) == 0 {
+		return nil, nil
+	}
+	slots := make(map[string]chan struct{}, len(limits))
+	for path, limit := range limits {
+		if !paths[path] || unlimitedPaths[path] {
+			return nil, errors.New("EndpointLimits: cannot limit %q", path)
+		}
+		if limit <= 0 {
+			return nil, errors.New("EndpointLimits: limit for %q must be positive", path)
+		}
+		slots[path] = make(chan struct{}, limit)
+	}
+	return slots, nil
+}
+
+// acquireEndpoint takes one of the slots of req's path, waiting up to
+// the server's endpoint queue timeout for one. If none frees up, it
+// replies with ErrServerBusy and returns false. The caller must call
+// releaseEndpoint when acquireEndpoint returns true.
+func (srv *Server) acquireEndpoint(w http.ResponseWriter, req *http.Request) bool {
+	path := req.URL.Path
+	slots := srv.endpointSlots[path]
+	if slots == nil {
+		return true
+	}
+	select {
+	case slots <- struct{}{}:
+		srv.metrics.endpointWait.Observe(0, path)
+		return true
+	default:
+	}
+
+	srv.metrics.endpointQueue.Add(1, path)
+	defer srv.metrics.endpointQueue.Add(-1, path)
+	start := time.Now()
+	timer := time.NewTimer(srv.endpointQueueTimeout)
+	defer timer.Stop()
+	select {
+	case slots <- struct{}{}:
+		srv.metrics.endpointWait.Since(start, path)
+		return true
+	case <-timer.C:
+	case <-req.Context().Done():
+	}
+	w.Header().Set("Retry-After", "1")
+	httpError(w, errorf(ErrServerBusy, "too many %s requests", path))
+	return false
+}
+
+func (srv *Server) releaseEndpoint(req *http.Request) {
+	if slots := srv.endpointSlots[req.URL.Path]; slots != nil {
+		<-slots
+	}
+}
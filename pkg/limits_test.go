@@ -0,0 +1,126 @@
+// Copyright 2018 David Lazar. All rights reserved.
+// Use of this source code is governed by the GNU AGPL
+// license that can be found in the LICENSE file.
+
+package pkg
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"vuvuzela.io/alpenhorn/pkg/kv"
+)
+
+func TestRequestLimits(t *testing.T) {
+	_, serverKey, _ := ed25519.GenerateKey(rand.Reader)
+	srv, err := NewServer(&Config{
+		DB:                    kv.NewMemory(),
+		SigningKey:            serverKey,
+		RegistrationMode:      RegistrationFCFS,
+		MaxRequestBytes:       4096,
+		MaxConcurrentRequests: 1,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+
+	post := func(path string, body []byte) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		srv.ServeHTTP(w, httptest.NewRequest("POST", path, bytes.NewReader(body)))
+		return w
+	}
+	errCode := func(w *httptest.ResponseRecorder) ErrorCode {
+		var e Error
+		json.Unmarshal(w.Body.Bytes(), &e)
+		return e.Code
+	}
+
+	if w := post("/register", make([]byte, 5000)); w.Code != http.StatusRequestEntityTooLarge {
+		t.Fatalf("expected 413 for a large body, got %d %s", w.Code, w.Body)
+	}
+
+	// Take the only handler slot, as a slow request would.
+	srv.handlerSlots <- struct{}{}
+	w := post("/status", []byte("{}"))
+	if w.Code != http.StatusServiceUnavailable || errCode(w) != ErrServerBusy {
+		t.Fatalf("expected ErrServerBusy, got %d %s", w.Code, w.Body)
+	}
+	if w.Header().Get("Retry-After") == "" {
+		t.Fatal("no Retry-After header")
+	}
+	// Coordinator requests are not limited.
+	if w := post("/commit", []byte("{}")); errCode(w) != ErrUnauthorized {
+		t.Fatalf("expected the commit to be handled, got %d %s", w.Code, w.Body)
+	}
+	<-srv.handlerSlots
+
+	if w := post("/status", []byte("{}")); errCode(w) == ErrServerBusy {
+		t.Fatal("server busy with a free handler slot")
+	}
+	if len(srv.handlerSlots) != 0 {
+		t.Fatal("handler slot was not released")
+	}
+}
+
+func TestEndpointLimits(t *testing.T) {
+	_, serverKey, _ := ed25519.GenerateKey(rand.Reader)
+	for _, limits := range []map[string]int{{"/commit": 1}, {"/nope": 1}, {"/extract": 0}} {
+		_, err := NewServer(&Config{DB: kv.NewMemory(), SigningKey: serverKey, EndpointLimits: limits})
+		if err == nil {
+			t.Fatalf("expected error for EndpointLimits %v", limits)
+		}
+	}
+
+	srv, err := NewServer(&Config{
+		DB:                   kv.NewMemory(),
+		SigningKey:           serverKey,
+		RegistrationMode:     RegistrationFCFS,
+		EndpointLimits:       map[string]int{"/extract": 1, "/register": 1},
+		EndpointQueueTimeout: 250 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+
+	post := func(path string) ErrorCode {
+		w := httptest.NewRecorder()
+		srv.ServeHTTP(w, httptest.NewRequest("POST", path, bytes.NewReader([]byte("{}"))))
+		var e Error
+		json.Unmarshal(w.Body.Bytes(), &e)
+		return e.Code
+	}
+
+	// A burst of extractions holds the only extract slot.
+	extractSlots := srv.endpointSlots["/extract"]
+	extractSlots <- struct{}{}
+	if code := post("/extract"); code != ErrServerBusy {
+		t.Fatalf("expected ErrServerBusy, got %s", code)
+	}
+	// Other paths are not held up.
+	if code := post("/register"); code == ErrServerBusy {
+		t.Fatal("register refused while extractions are busy")
+	}
+	if code := post("/status"); code == ErrServerBusy {
+		t.Fatal("unlimited path refused while extractions are busy")
+	}
+
+	// A waiting request gets the slot when it frees up.
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		<-extractSlots
+	}()
+	if code := post("/extract"); code == ErrServerBusy {
+		t.Fatal("extract refused after its slot was freed")
+	}
+	if len(extractSlots) != 0 || len(srv.endpointSlots["/register"]) != 0 {
+		t.Fatal("endpoint slot was not released")
+	}
+}
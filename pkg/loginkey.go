@@ -0,0 +1,293 @@
+// Copyright 2018 David Lazar. All rights reserved.
+// Use of this source code is governed by the GNU AGPL
+// license that can be found in the LICENSE file.
+
+//go:build !js
+// +build !js
+
+package pkg
+
+import (
+	"crypto/ed25519"
+	"encoding/binary"
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"vuvuzela.io/alpenhorn/errors"
+	"vuvuzela.io/alpenhorn/internal/fault"
+	"vuvuzela.io/alpenhorn/internal/keysafe"
+	"vuvuzela.io/alpenhorn/log"
+	"vuvuzela.io/alpenhorn/pkg/kv"
+)
+
+// RotationWindow is how long a prepared rotation can be committed, and
+// how long a committed rotation can be rolled back.
+var RotationWindow = 10 * time.Minute
+
+// DefaultLoginKeyGrace is how long the old login key keeps working
+// after an in-place rotation when Config.LoginKeyGrace is zero.
+const DefaultLoginKeyGrace = 24 * time.Hour
+
+// loginRotation is the pending rotation stored for a user.
+type loginRotation struct {
+	ID          [32]byte
+	OldLoginKey ed25519.PublicKey
+	NewLoginKey ed25519.PublicKey
+	Expires     int64
+	Committed   bool
+}
+
+const loginRotationBinaryVersion byte = 1
+
+func (r loginRotation) size() int {
+	return 1 + 32 + 2*ed25519.PublicKeySize + 8 + 1
+}
+
+func (r loginRotation) Marshal() []byte {
+	data := make([]byte, r.size())
+	data[0] = loginRotationBinaryVersion
+	off := 1
+	off += copy(data[off:], r.ID[:])
+	off += copy(data[off:], r.OldLoginKey)
+	off += copy(data[off:], r.NewLoginKey)
+	binary.BigEndian.PutUint64(data[off:], uint64(r.Expires))
+	off += 8
+	if r.Committed {
+		data[off] = 1
+	}
+	return data
+}
+
+func (r *loginRotation) Unmarshal(data []byte) error {
+	if len(data) != r.size() {
+		return errors.New("bad data length: got %d, want %d", len(data), r.size())
+	}
+	if data[0] != loginRotationBinaryVersion {
+		return errors.New("unexpected binary version: %v", data[0])
+	}
+	off := 1
+	off += copy(r.ID[:], data[off:])
+	r.OldLoginKey = append(ed25519.PublicKey(nil), data[off:off+ed25519.PublicKeySize]...)
+	off += ed25519.PublicKeySize
+	r.NewLoginKey = append(ed25519.PublicKey(nil), data[off:off+ed25519.PublicKeySize]...)
+	off += ed25519.PublicKeySize
+	r.Expires = int64(binary.BigEndian.Uint64(data[off:]))
+	off += 8
+	r.Committed = data[off] == 1
+	return nil
+}
+
+func (srv *Server) rotateLoginHandler(w http.ResponseWriter, req *http.Request) {
+	body := http.MaxBytesReader(w, req.Body, 1024)
+	args := new(rotateLoginArgs)
+	err := json.NewDecoder(body).Decode(args)
+	if err != nil {
+		httpError(w, errorf(ErrBadRequestJSON, "%s", err))
+		return
+	}
+	if !srv.limitUsername(w, args.Username) {
+		return
+	}
+	args.ServerSigningKey = srv.publicKey
+
+	logger := srv.log.WithFields(log.Fields{"username": args.Username, "phase": args.Phase})
+	err = srv.rotateLogin(args)
+	srv.audit(&AuditEvent{
+		Type:     AuditLoginKey,
+		Username: args.Username,
+		Key:      KeyFingerprint(args.NewLoginKey),
+		Detail:   args.Phase,
+		Result:   result(err),
+		RemoteIP: remoteIP(req),
+	})
+	if err != nil {
+		logger = logger.WithFields(log.Fields{"code": errorCode(err).String()})
+		if isInternalError(err) {
+			logger.Errorf("Login key rotation failed: %s", err)
+		} else {
+			logger.Infof("Login key rotation failed: %s", err)
+		}
+		httpError(w, err)
+		return
+	}
+	logger.Info("Login key rotation")
+
+	w.Write([]byte("\"OK\""))
+}
+
+func (srv *Server) rotateLogin(args *rotateLoginArgs) error {
+	if len(args.OldLoginKey) != ed25519.PublicKeySize || len(args.NewLoginKey) != ed25519.PublicKeySize {
+		return errorf(ErrInvalidLoginKey, "got %d and %d bytes, want %d bytes", len(args.OldLoginKey), len(args.NewLoginKey), ed25519.PublicKeySize)
+	}
+
+	now := srv.clock.Now()
+	if err := checkFresh(args.Time, now); err != nil {
+		return err
+	}
+
+	if err := fault.Inject(fault.PKGDB); err != nil {
+		return errorf(ErrDatabaseError, "%s", err)
+	}
+
+	srv.regLogMu.Lock()
+	defer srv.regLogMu.Unlock()
+	tx, err := srv.db.NewTransaction(true)
+	if err != nil {
+		return errorf(ErrDatabaseError, "%s", err)
+	}
+	defer tx.Discard()
+
+	user, id, err := srv.getUser(tx, args.Username)
+	if err != nil {
+		return err
+	}
+
+	rotationKey := dbUserKey(id, loginRotationSuffix)
+	var pending *loginRotation
+	data, err := tx.Get(rotationKey)
+	if err == nil {
+		pending = new(loginRotation)
+		if err := pending.Unmarshal(data); err != nil {
+			return errorf(ErrDatabaseError, "%s", err)
+		}
+		if now.Unix() > pending.Expires {
+			pending = nil
+		}
+	} else if err != kv.ErrNotFound {
+		return errorf(ErrDatabaseError, "%s", err)
+	}
+
+	switch args.Phase {
+	case RotatePrepare:
+		if !keysafe.Equal(args.OldLoginKey, user.LoginKey) {
+			return errorf(ErrInvalidLoginKey, "old login key is not the current login key")
+		}
+		if !srv.verifyBound(&args.ServerSigningKey, func() bool {
+			return ed25519.Verify(user.LoginKey, args.msg(), args.Signature)
+		}) {
+			return errorf(ErrInvalidSignature, "")
+		}
+		if !ed25519.Verify(args.NewLoginKey, args.msg(), args.NewKeySignature) {
+			return errorf(ErrInvalidSignature, "new login key")
+		}
+		if err := checkReplay(tx, "rotatelogin", args.Signature, now); err != nil {
+			return err
+		}
+		pending = &loginRotation{
+			ID:          args.ID,
+			OldLoginKey: args.OldLoginKey,
+			NewLoginKey: args.NewLoginKey,
+			Expires:     now.Add(RotationWindow).Unix(),
+		}
+		if err := tx.Set(rotationKey, pending.Marshal()); err != nil {
+			return errorf(ErrDatabaseError, "%s", err)
+		}
+
+	case RotateCommit:
+		if pending == nil || pending.ID != args.ID ||
+			!keysafe.Equal(pending.OldLoginKey, args.OldLoginKey) ||
+			!keysafe.Equal(pending.NewLoginKey, args.NewLoginKey) {
+			return errorf(ErrNoRotation, "")
+		}
+		if !srv.verifyBound(&args.ServerSigningKey, func() bool {
+			return ed25519.Verify(pending.OldLoginKey, args.msg(), args.Signature)
+		}) {
+			return errorf(ErrInvalidSignature, "")
+		}
+		if pending.Committed {
+			// Retried commit.
+			return nil
+		}
+		if !keysafe.Equal(user.LoginKey, pending.OldLoginKey) {
+			return errorf(ErrNoRotation, "login key changed since prepare")
+		}
+		// Retried commits are answered above, so only the first
+		// commit is recorded.
+		if err := checkReplay(tx, "rotatelogin", args.Signature, now); err != nil {
+			return err
+		}
+
+		pending.Committed = true
+		pending.Expires = now.Add(RotationWindow).Unix()
+		if err := tx.Set(rotationKey, pending.Marshal()); err != nil {
+			return errorf(ErrDatabaseError, "%s", err)
+		}
+		if err := srv.setLoginKey(tx, id, userState{DeviceKeys: user.DeviceKeys}, pending.NewLoginKey); err != nil {
+			return err
+		}
+
+	case RotateAbort:
+		if pending == nil || pending.ID != args.ID {
+			// Nothing to abort; aborts are idempotent.
+			return nil
+		}
+		signer := pending.OldLoginKey
+		if pending.Committed {
+			signer = pending.NewLoginKey
+		}
+		if !srv.verifyBound(&args.ServerSigningKey, func() bool {
+			return ed25519.Verify(signer, args.msg(), args.Signature)
+		}) {
+			return errorf(ErrInvalidSignature, "")
+		}
+		if err := tx.Delete(rotationKey); err != nil {
+			return errorf(ErrDatabaseError, "%s", err)
+		}
+		if pending.Committed {
+			if err := srv.setLoginKey(tx, id, userState{DeviceKeys: user.DeviceKeys}, pending.OldLoginKey); err != nil {
+				return err
+			}
+		}
+
+	case RotateInPlace:
+		if !keysafe.Equal(args.OldLoginKey, user.LoginKey) {
+			return errorf(ErrInvalidLoginKey, "old login key is not the current login key")
+		}
+		if !srv.verifyBound(&args.ServerSigningKey, func() bool {
+			return ed25519.Verify(user.LoginKey, args.msg(), args.Signature)
+		}) {
+			return errorf(ErrInvalidSignature, "")
+		}
+		if !ed25519.Verify(args.NewLoginKey, args.msg(), args.NewKeySignature) {
+			return errorf(ErrInvalidSignature, "new login key")
+		}
+		if err := checkReplay(tx, "rotatelogin", args.Signature, now); err != nil {
+			return err
+		}
+		// An in-place rotation replaces any pending two-phase one.
+		if err := tx.Delete(rotationKey); err != nil {
+			return errorf(ErrDatabaseError, "%s", err)
+		}
+		user.OldLoginKey = user.LoginKey
+		user.OldKeyExpires = now.Add(srv.loginKeyGrace).Unix()
+		if err := srv.setLoginKey(tx, id, user, args.NewLoginKey); err != nil {
+			return err
+		}
+
+	default:
+		return errorf(ErrBadRequestJSON, "unknown rotation phase: %q", args.Phase)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return errorf(ErrDatabaseError, "%s", err)
+	}
+	return nil
+}
+
+// setLoginKey changes the user's login key. The caller must hold
+// srv.regLogMu.
+func (srv *Server) setLoginKey(tx kv.Txn, id *[64]byte, user userState, loginKey ed25519.PublicKey) error {
+	user.LoginKey = loginKey
+	if err := tx.Set(dbUserKey(id, registrationSuffix), user.Marshal()); err != nil {
+		return errorf(ErrDatabaseError, "%s", err)
+	}
+	if err := srv.logRegistration(tx, id, loginKey); err != nil {
+		return err
+	}
+	return appendLog(tx, id, UserEvent{
+		Time:     srv.clock.Now(),
+		Type:     EventLoginKeyChanged,
+		LoginKey: loginKey,
+	})
+}
@@ -0,0 +1,184 @@
+// Copyright 2018 David Lazar. All rights reserved.
+// Use of this source code is governed by the GNU AGPL
+// license that can be found in the LICENSE file.
+
+package pkg_test
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"testing"
+
+	"vuvuzela.io/alpenhorn/edhttp"
+	"vuvuzela.io/alpenhorn/pkg"
+)
+
+func TestRotateLoginKey(t *testing.T) {
+	testpkg, _ := launchPKG(t, func(username string, token string) error {
+		return nil
+	})
+	defer testpkg.Close()
+
+	alicePub, oldKey, _ := ed25519.GenerateKey(rand.Reader)
+	_, newKey, _ := ed25519.GenerateKey(rand.Reader)
+	client := &pkg.Client{
+		Username:        "alice@example.org",
+		LoginKey:        oldKey,
+		UserLongTermKey: alicePub,
+		HTTPClient:      new(edhttp.Client),
+	}
+	server := testpkg.PublicServerConfig
+	if err := client.Register(server, ""); err != nil {
+		t.Fatal(err)
+	}
+
+	var id [32]byte
+	rand.Read(id[:])
+
+	err := client.CommitLoginKey(server, id, newKey)
+	if err.(pkg.Error).Code != pkg.ErrNoRotation {
+		t.Fatalf("expected ErrNoRotation for commit without prepare, got %v", err)
+	}
+
+	if err := client.PrepareLoginKey(server, id, newKey); err != nil {
+		t.Fatal(err)
+	}
+	// The old key still works until the rotation is committed.
+	if err := client.CheckStatus(server); err != nil {
+		t.Fatal(err)
+	}
+	if err := client.CommitLoginKey(server, id, newKey); err != nil {
+		t.Fatal(err)
+	}
+	if err := client.CheckStatus(server); err == nil {
+		t.Fatal("old login key still works after commit")
+	}
+
+	// Roll back the committed rotation.
+	if err := client.AbortLoginKey(server, id, newKey, true); err != nil {
+		t.Fatal(err)
+	}
+	if err := client.CheckStatus(server); err != nil {
+		t.Fatalf("old login key does not work after rollback: %s", err)
+	}
+
+	// Rotate for real.
+	rand.Read(id[:])
+	if err := client.PrepareLoginKey(server, id, newKey); err != nil {
+		t.Fatal(err)
+	}
+	if err := client.CommitLoginKey(server, id, newKey); err != nil {
+		t.Fatal(err)
+	}
+	client.LoginKey = newKey
+	if err := client.CheckStatus(server); err != nil {
+		t.Fatal(err)
+	}
+
+	log, err := testpkg.PKGServer.GetUserLog(pkg.ValidUsernameToIdentity("alice@example.org"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(log) != 4 || log[3].Type != pkg.EventLoginKeyChanged {
+		t.Fatalf("unexpected user log: %#v", log)
+	}
+}
+
+func TestRotateLoginKeyInPlace(t *testing.T) {
+	testpkg, _ := launchPKG(t, func(username string, token string) error {
+		return nil
+	})
+	defer testpkg.Close()
+
+	alicePub, oldKey, _ := ed25519.GenerateKey(rand.Reader)
+	_, newKey, _ := ed25519.GenerateKey(rand.Reader)
+	client := &pkg.Client{
+		Username:        "alice@example.org",
+		LoginKey:        oldKey,
+		UserLongTermKey: alicePub,
+		HTTPClient:      new(edhttp.Client),
+	}
+	server := testpkg.PublicServerConfig
+	if err := client.Register(server, ""); err != nil {
+		t.Fatal(err)
+	}
+
+	// Only the current login key can rotate it.
+	_, mallory, _ := ed25519.GenerateKey(rand.Reader)
+	impostor := *client
+	impostor.LoginKey = mallory
+	err := impostor.RotateLoginKey(server, newKey)
+	if err.(pkg.Error).Code != pkg.ErrInvalidLoginKey {
+		t.Fatalf("expected ErrInvalidLoginKey, got %v", err)
+	}
+
+	if err := client.RotateLoginKey(server, newKey); err != nil {
+		t.Fatal(err)
+	}
+	// The old key works for the grace window.
+	if err := client.CheckStatus(server); err != nil {
+		t.Fatalf("old login key does not work in the grace window: %s", err)
+	}
+	// It cannot rotate the key again, though.
+	_, otherKey, _ := ed25519.GenerateKey(rand.Reader)
+	if err := client.RotateLoginKey(server, otherKey); err == nil {
+		t.Fatal("old login key rotated the new one")
+	}
+
+	client.LoginKey = newKey
+	if err := client.CheckStatus(server); err != nil {
+		t.Fatal(err)
+	}
+
+	log, err := testpkg.PKGServer.GetUserLog(pkg.ValidUsernameToIdentity("alice@example.org"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(log) != 2 || log[1].Type != pkg.EventLoginKeyChanged {
+		t.Fatalf("unexpected user log: %#v", log)
+	}
+}
+
+func TestDerivedLoginKey(t *testing.T) {
+	testpkg, _ := launchPKG(t, func(username string, token string) error {
+		return nil
+	})
+	defer testpkg.Close()
+
+	// Stand in for a FIDO2 authenticator's hmac-secret output.
+	deviceSecret := make([]byte, 32)
+	rand.Read(deviceSecret)
+	touches := 0
+	seed := func() ([]byte, error) {
+		touches++
+		return append([]byte(nil), deviceSecret...), nil
+	}
+	loginKey, err := pkg.NewDerivedLoginKey(seed)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	alicePub, _, _ := ed25519.GenerateKey(rand.Reader)
+	client := &pkg.Client{
+		Username:        "alice@example.org",
+		LoginKey:        loginKey,
+		UserLongTermKey: alicePub,
+		HTTPClient:      new(edhttp.Client),
+	}
+	server := testpkg.PublicServerConfig
+	if err := client.Register(server, ""); err != nil {
+		t.Fatal(err)
+	}
+	if err := client.CheckStatus(server); err != nil {
+		t.Fatal(err)
+	}
+	if touches < 3 {
+		t.Fatalf("expected the seed to be derived for every signature, got %d derivations", touches)
+	}
+
+	// A different authenticator cannot sign for the key.
+	rand.Read(deviceSecret)
+	if err := client.CheckStatus(server); err == nil {
+		t.Fatal("expected error signing with the wrong seed")
+	}
+}
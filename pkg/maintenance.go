@@ -0,0 +1,308 @@
+// Copyright 2018 David Lazar. All rights reserved.
+// Use of this source code is governed by the GNU AGPL
+// license that can be found in the LICENSE file.
+
+//go:build !js
+// +build !js
+
+package pkg
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"encoding/json"
+	"fmt"
+
+	"vuvuzela.io/alpenhorn/errors"
+	"vuvuzela.io/alpenhorn/pkg/kv"
+)
+
+// OpenDB opens a PKG database in the named storage backend for offline
+// maintenance. The PKG server must not be running on the same database
+// unless readOnly is true and the server was also opened read-only.
+func OpenDB(backend, path string, readOnly bool) (kv.DB, error) {
+	return kv.Open(backend, path, readOnly)
+}
+
+// DBStats summarizes the contents of a PKG database.
+type DBStats struct {
+	Registrations          int
+	LastExtractions        int
+	UserLogs               int
+	PQKeys                 int
+	RenameHolds            int
+	RecoveryKeys           int
+	ReplayEntries          int
+	DomainQuotaCounters    int
+	SpentTokens            int
+	ReservedOverrides      int
+	VerifierRecords        int
+	LogEntries             int
+	RegistrationLogEntries int
+	AuditEvents            int
+	AbuseReports           int
+	BlocklistEntries       int
+	CoordinatorRecords     int
+	OtherKeys              int
+
+	// SchemaVersion is the database's schema version.
+	SchemaVersion int
+
+	KeyBytes   int64
+	ValueBytes int64
+
+	// DiskSize is the size of the database on disk in bytes.
+	DiskSize int64
+}
+
+// CollectDBStats counts the records in the database.
+func CollectDBStats(db kv.DB) (*DBStats, error) {
+	stats := new(DBStats)
+	err := db.View(func(tx kv.Txn) error {
+		return tx.Iterate(nil, func(key, value []byte) error {
+			stats.KeyBytes += int64(len(key))
+			stats.ValueBytes += int64(len(value))
+
+			switch _, suffix, ok := splitUserKey(key); {
+			case bytes.HasPrefix(key, dbReplayPrefix):
+				stats.ReplayEntries++
+			case bytes.HasPrefix(key, dbDomainQuotaPrefix):
+				stats.DomainQuotaCounters++
+			case bytes.HasPrefix(key, dbRegTokenPrefix):
+				stats.SpentTokens++
+			case bytes.HasPrefix(key, dbReservedOverridePrefix):
+				stats.ReservedOverrides++
+			case bytes.HasPrefix(key, dbVerifierPrefix):
+				if _, _, since, _ := splitVerifierKey(key); !since {
+					stats.VerifierRecords++
+				}
+			case bytes.HasPrefix(key, attestLog.entryPrefix):
+				stats.LogEntries++
+			case bytes.HasPrefix(key, regLog.entryPrefix):
+				stats.RegistrationLogEntries++
+			case bytes.HasPrefix(key, dbAuditPrefix):
+				stats.AuditEvents++
+			case bytes.HasPrefix(key, dbAbuseReportPrefix):
+				stats.AbuseReports++
+			case bytes.HasPrefix(key, dbBlocklistPrefix):
+				stats.BlocklistEntries++
+			case bytes.HasPrefix(key, dbCoordinatorPrefix):
+				stats.CoordinatorRecords++
+			case bytes.HasPrefix(key, attestLog.prefix), bytes.HasPrefix(key, regLog.prefix):
+				// Log nodes and indexes are counted with the entries.
+			case bytes.HasPrefix(key, dbSchemaPrefix):
+				if bytes.Equal(key, dbSchemaVersionKey) {
+					var err error
+					stats.SchemaVersion, err = decodeSchemaVersion(value)
+					return err
+				}
+			case !ok:
+				stats.OtherKeys++
+			case bytes.Equal(suffix, registrationSuffix):
+				stats.Registrations++
+			case bytes.Equal(suffix, lastExtractionSuffix):
+				stats.LastExtractions++
+			case bytes.Equal(suffix, userLogSuffix):
+				stats.UserLogs++
+			case bytes.Equal(suffix, pqKeySuffix):
+				stats.PQKeys++
+			case bytes.Equal(suffix, renamedSuffix):
+				stats.RenameHolds++
+			case bytes.Equal(suffix, recoveryKeySuffix):
+				stats.RecoveryKeys++
+			default:
+				stats.OtherKeys++
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	stats.DiskSize = db.Size()
+	return stats, nil
+}
+
+// A DBProblem is an invariant violation found by VerifyDB.
+type DBProblem struct {
+	Key     string
+	Problem string
+}
+
+func (p DBProblem) String() string {
+	return fmt.Sprintf("%s: %s", p.Key, p.Problem)
+}
+
+// VerifyDB checks the database for records that cannot be decoded,
+// records that belong to unregistered users, and identities that do
+// not map back to a single valid username.
+func VerifyDB(db kv.DB) ([]DBProblem, error) {
+	var problems []DBProblem
+	report := func(key []byte, format string, args ...interface{}) {
+		problems = append(problems, DBProblem{
+			Key:     fmt.Sprintf("%q", key),
+			Problem: fmt.Sprintf(format, args...),
+		})
+	}
+
+	err := db.View(func(tx kv.Txn) error {
+		return tx.Iterate(nil, func(key, data []byte) error {
+			if bytes.HasPrefix(key, dbReplayPrefix) {
+				return nil
+			}
+			if bytes.HasPrefix(key, dbDomainQuotaPrefix) {
+				if _, err := decodeIndex(data); err != nil {
+					report(key, "%s", err)
+				}
+				return nil
+			}
+			if bytes.HasPrefix(key, dbRegTokenPrefix) {
+				if _, err := decodeIndex(data); err != nil {
+					report(key, "%s", err)
+				}
+				return nil
+			}
+			if bytes.HasPrefix(key, dbReservedOverridePrefix) {
+				var r reservedOverrideRecord
+				if err := json.Unmarshal(data, &r); err != nil {
+					report(key, "%s", err)
+				}
+				return nil
+			}
+			if bytes.HasPrefix(key, dbVerifierPrefix) {
+				// Only the verifier knows its records' format.
+				return nil
+			}
+			if bytes.HasPrefix(key, dbAuditPrefix) {
+				var e AuditEvent
+				if err := json.Unmarshal(data, &e); err != nil {
+					report(key, "%s", err)
+				}
+				return nil
+			}
+			if bytes.HasPrefix(key, dbAbuseReportPrefix) {
+				var r AbuseReport
+				if err := json.Unmarshal(data, &r); err != nil {
+					report(key, "%s", err)
+				}
+				return nil
+			}
+			if bytes.HasPrefix(key, dbBlocklistPrefix) {
+				var e BlocklistEntry
+				if err := json.Unmarshal(data, &e); err != nil {
+					report(key, "%s", err)
+				} else if _, err := e.compile(); err != nil {
+					report(key, "%s", err)
+				} else if !bytes.Equal(key, blocklistKey(e.Kind, e.Pattern)) {
+					report(key, "blocklist entry stored under the wrong key")
+				}
+				return nil
+			}
+			if bytes.HasPrefix(key, dbCoordinatorPrefix) {
+				var r coordinatorRounds
+				if len(key) != len(dbCoordinatorPrefix)+ed25519.PublicKeySize {
+					report(key, "bad coordinator key length: %d", len(key)-len(dbCoordinatorPrefix))
+				} else if err := r.unmarshal(data); err != nil {
+					report(key, "%s", err)
+				}
+				return nil
+			}
+			if bytes.HasPrefix(key, dbSchemaPrefix) {
+				if bytes.HasPrefix(key, dbSchemaAppliedPrefix) {
+					var m AppliedMigration
+					if err := json.Unmarshal(data, &m); err != nil {
+						report(key, "%s", err)
+					}
+				} else if bytes.Equal(key, dbSchemaVersionKey) {
+					if _, err := decodeSchemaVersion(data); err != nil {
+						report(key, "%s", err)
+					}
+				}
+				return nil
+			}
+			if bytes.HasPrefix(key, attestLog.prefix) {
+				if bytes.HasPrefix(key, attestLog.entryPrefix) {
+					var e AttestationLogEntry
+					if err := e.Unmarshal(data); err != nil {
+						report(key, "%s", err)
+					}
+				}
+				return nil
+			}
+			if bytes.HasPrefix(key, regLog.prefix) {
+				if bytes.HasPrefix(key, regLog.entryPrefix) {
+					var e RegistrationLogEntry
+					if err := e.Unmarshal(data); err != nil {
+						report(key, "%s", err)
+					}
+				}
+				return nil
+			}
+			id, suffix, ok := splitUserKey(key)
+			if !ok {
+				report(key, "unknown key")
+				return nil
+			}
+
+			username := IdentityToUsername(id)
+			if err := ValidateUsername(username); err != nil {
+				report(key, "invalid username: %s", err)
+			} else if *ValidUsernameToIdentity(username) != *id {
+				report(key, "non-canonical identity duplicates username %q", username)
+			}
+
+			if !bytes.Equal(suffix, registrationSuffix) && !bytes.Equal(suffix, renamedSuffix) {
+				_, err := tx.Get(dbUserKey(id, registrationSuffix))
+				if err == kv.ErrNotFound {
+					report(key, "orphaned record for unregistered user %q", username)
+				} else if err != nil {
+					return err
+				}
+			}
+
+			var decodeErr error
+			switch {
+			case bytes.Equal(suffix, registrationSuffix):
+				var u userState
+				decodeErr = u.Unmarshal(data)
+			case bytes.Equal(suffix, lastExtractionSuffix):
+				var e lastExtraction
+				decodeErr = e.Unmarshal(data)
+			case bytes.Equal(suffix, userLogSuffix):
+				var l UserEventLog
+				decodeErr = l.Unmarshal(data)
+			case bytes.Equal(suffix, loginRotationSuffix):
+				var r loginRotation
+				decodeErr = r.Unmarshal(data)
+			case bytes.Equal(suffix, pqKeySuffix):
+				_, decodeErr = unmarshalPQKey(data)
+			case bytes.Equal(suffix, renamedSuffix):
+				_, decodeErr = unmarshalRenamed(data)
+			case bytes.Equal(suffix, recoveryKeySuffix):
+				_, decodeErr = unmarshalRecoveryKey(data)
+			default:
+				decodeErr = errors.New("unknown record type %q", suffix)
+			}
+			if decodeErr != nil {
+				report(key, "%s", decodeErr)
+			}
+			return nil
+		})
+	})
+	return problems, err
+}
+
+// VacuumDB reclaims the space used by deleted and expired records.
+func VacuumDB(db kv.DB) error {
+	return db.Vacuum()
+}
+
+// splitUserKey splits a user key into its identity and suffix.
+func splitUserKey(key []byte) (*[64]byte, []byte, bool) {
+	if !bytes.HasPrefix(key, dbUserPrefix) || len(key) < len(dbUserPrefix)+64 {
+		return nil, nil, false
+	}
+	id := new([64]byte)
+	copy(id[:], key[len(dbUserPrefix):])
+	return id, key[len(dbUserPrefix)+64:], true
+}
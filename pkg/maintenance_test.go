@@ -0,0 +1,80 @@
+// Copyright 2018 David Lazar. All rights reserved.
+// Use of this source code is governed by the GNU AGPL
+// license that can be found in the LICENSE file.
+
+package pkg
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"vuvuzela.io/alpenhorn/pkg/kv"
+)
+
+func TestVerifyDB(t *testing.T) {
+	for _, backend := range []string{kv.Badger, kv.Bolt} {
+		t.Run(backend, func(t *testing.T) {
+			testVerifyDB(t, backend)
+		})
+	}
+}
+
+func testVerifyDB(t *testing.T, backend string) {
+	dbPath, err := ioutil.TempDir("", "alpenhorn_pkg_db_")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dbPath)
+
+	db, err := OpenDB(backend, dbPath, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	pub, _, _ := ed25519.GenerateKey(rand.Reader)
+	alice := ValidUsernameToIdentity("alice@example.org")
+	bob := ValidUsernameToIdentity("bob@example.org")
+	dup := ValidUsernameToIdentity("alice@example.org")
+	dup[63] = 'x'
+
+	err = db.Update(func(tx kv.Txn) error {
+		user := userState{LoginKey: pub}
+		if err := tx.Set(dbUserKey(alice, registrationSuffix), user.Marshal()); err != nil {
+			return err
+		}
+		if err := tx.Set(dbUserKey(alice, lastExtractionSuffix), lastExtraction{Round: 1}.Marshal()); err != nil {
+			return err
+		}
+		if err := tx.Set(dbUserKey(bob, lastExtractionSuffix), lastExtraction{Round: 1}.Marshal()); err != nil {
+			return err
+		}
+		return tx.Set(dbUserKey(dup, registrationSuffix), user.Marshal())
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	stats, err := CollectDBStats(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Registrations != 2 || stats.LastExtractions != 2 || stats.OtherKeys != 0 {
+		t.Fatalf("unexpected stats: %+v", stats)
+	}
+
+	problems, err := VerifyDB(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(problems) != 2 {
+		t.Fatalf("expected 2 problems, got %v", problems)
+	}
+
+	if err := VacuumDB(db); err != nil {
+		t.Fatal(err)
+	}
+}
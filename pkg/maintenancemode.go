@@ -0,0 +1,153 @@
+// Copyright 2018 David Lazar. All rights reserved.
+// Use of this source code is governed by the GNU AGPL
+// license that can be found in the LICENSE file.
+
+//go:build !js
+// +build !js
+
+package pkg
+
+import (
+	"encoding/json"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	"vuvuzela.io/alpenhorn/log"
+)
+
+// An operator can put the server in maintenance mode through the admin
+// API before working on its database. In maintenance mode, the server
+// refuses the requests that register users, change their keys, or
+// extract keys with ErrMaintenance and a Retry-After header, so clients
+// back off and retry instead of treating the failure as final. Status
+// lookups, the logs, round setup, and the health checks keep working.
+//
+// The mode is kept in memory: a restarted server is out of maintenance
+// mode, and each replica in a cluster is switched on its own.
+
+// DefaultMaintenanceRetry is the Retry-After the server sends in
+// maintenance mode if the operator did not say when it ends.
+const DefaultMaintenanceRetry = time.Minute
+
+// Maintenance is the state of the server's maintenance mode.
+type Maintenance struct {
+	Enabled bool
+	Since   time.Time
+
+	// Until is when the operator expects the maintenance to end, or
+	// zero if they did not say.
+	Until time.Time
+
+	// Message is passed on to clients in ErrMaintenance errors.
+	Message string
+}
+
+// maintenancePaths are the paths the server refuses in maintenance
+// mode.
+var maintenancePaths = map[string]bool{
+	"/extract":           true,
+	"/extractbatch":      true,
+	"/register":          true,
+	"/registerchallenge": true,
+	"/rotatelogin":       true,
+	"/setpqkey":          true,
+	"/delete":            true,
+	"/rename":            true,
+	"/setrecoverykey":    true,
+	"/revokelogin":       true,
+	"/devicekey":         true,
+	"/report":            true,
+}
+
+// Maintenance returns the state of the server's maintenance mode.
+func (srv *Server) Maintenance() Maintenance {
+	m, _ := srv.maintenance.Load().(*Maintenance)
+	if m == nil {
+		return Maintenance{}
+	}
+	return *m
+}
+
+// SetMaintenance switches maintenance mode on or off. When it is
+// switched on, Since is set to the current time.
+func (srv *Server) SetMaintenance(m Maintenance) {
+	if m.Enabled {
+		m.Since = srv.clock.Now()
+	} else {
+		m = Maintenance{}
+	}
+	srv.maintenance.Store(&m)
+	if m.Enabled {
+		srv.log.WithFields(log.Fields{"until": m.Until, "message": m.Message}).Info("Entered maintenance mode")
+	} else {
+		srv.log.Info("Left maintenance mode")
+	}
+}
+
+// inMaintenance replies with ErrMaintenance and returns true if the
+// server is in maintenance mode and refuses req.
+func (srv *Server) inMaintenance(w http.ResponseWriter, req *http.Request) bool {
+	if !maintenancePaths[req.URL.Path] {
+		return false
+	}
+	m, _ := srv.maintenance.Load().(*Maintenance)
+	if m == nil || !m.Enabled {
+		return false
+	}
+	wait := DefaultMaintenanceRetry
+	if !m.Until.IsZero() {
+		wait = m.Until.Sub(srv.clock.Now())
+	}
+	secs := int64(math.Ceil(wait.Seconds()))
+	if secs < 1 {
+		secs = 1
+	}
+	w.Header().Set("Retry-After", strconv.FormatInt(secs, 10))
+	httpError(w, errorf(ErrMaintenance, "%s", m.Message))
+	return true
+}
+
+// maintenanceHandler serves /admin/maintenance. GET replies with the
+// state of maintenance mode, and POST sets it from a JSON object with
+// Enabled, Message, and Duration, an optional estimate of how long the
+// maintenance will take, such as "30m".
+func (srv *Server) maintenanceHandler(w http.ResponseWriter, req *http.Request) {
+	switch req.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		var args struct {
+			Enabled  bool
+			Message  string
+			Duration string
+		}
+		body := http.MaxBytesReader(w, req.Body, 4096)
+		if err := json.NewDecoder(body).Decode(&args); err != nil {
+			httpError(w, errorf(ErrBadRequestJSON, "%s", err))
+			return
+		}
+		m := Maintenance{
+			Enabled: args.Enabled,
+			Message: args.Message,
+		}
+		if args.Duration != "" {
+			d, err := time.ParseDuration(args.Duration)
+			if err != nil || d <= 0 {
+				httpError(w, errorf(ErrBadRequestJSON, "invalid duration %q", args.Duration))
+				return
+			}
+			m.Until = srv.clock.Now().Add(d)
+		}
+		srv.SetMaintenance(m)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	bs, err := json.Marshal(srv.Maintenance())
+	if err != nil {
+		panic(err)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(bs)
+}
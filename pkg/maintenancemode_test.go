@@ -0,0 +1,91 @@
+// Copyright 2018 David Lazar. All rights reserved.
+// Use of this source code is governed by the GNU AGPL
+// license that can be found in the LICENSE file.
+
+package pkg
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"vuvuzela.io/alpenhorn/clock"
+	"vuvuzela.io/alpenhorn/pkg/kv"
+)
+
+func TestMaintenanceMode(t *testing.T) {
+	adminPub, _, _ := ed25519.GenerateKey(rand.Reader)
+	_, serverKey, _ := ed25519.GenerateKey(rand.Reader)
+	srv, err := NewServer(&Config{
+		DB:               kv.NewMemory(),
+		SigningKey:       serverKey,
+		RegistrationMode: RegistrationFCFS,
+		AdminKey:         adminPub,
+		Clock:            clock.NewMock(time.Now()),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+
+	admin := func(args string) Maintenance {
+		req := httptest.NewRequest("POST", "/admin/maintenance", bytes.NewReader([]byte(args)))
+		req.TLS = &tls.ConnectionState{
+			PeerCertificates: []*x509.Certificate{{PublicKey: adminPub}},
+		}
+		w := httptest.NewRecorder()
+		srv.AdminHandler().ServeHTTP(w, req)
+		if w.Code != http.StatusOK {
+			t.Fatalf("admin: %d %s", w.Code, w.Body)
+		}
+		var m Maintenance
+		if err := json.Unmarshal(w.Body.Bytes(), &m); err != nil {
+			t.Fatal(err)
+		}
+		return m
+	}
+	post := func(path string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		srv.ServeHTTP(w, httptest.NewRequest("POST", path, bytes.NewReader([]byte("{}"))))
+		return w
+	}
+	errCode := func(w *httptest.ResponseRecorder) ErrorCode {
+		var e Error
+		json.Unmarshal(w.Body.Bytes(), &e)
+		return e.Code
+	}
+
+	m := admin(`{"Enabled": true, "Message": "upgrading the database", "Duration": "90s"}`)
+	if !m.Enabled || m.Until.Sub(m.Since) != 90*time.Second {
+		t.Fatalf("unexpected maintenance state: %+v", m)
+	}
+	for _, path := range []string{"/register", "/extract", "/rotatelogin"} {
+		w := post(path)
+		if w.Code != http.StatusServiceUnavailable || errCode(w) != ErrMaintenance {
+			t.Fatalf("%s: expected ErrMaintenance, got %d %s", path, w.Code, w.Body)
+		}
+		if w.Header().Get("Retry-After") != "90" {
+			t.Fatalf("%s: unexpected Retry-After %q", path, w.Header().Get("Retry-After"))
+		}
+	}
+	if w := post("/status"); errCode(w) == ErrMaintenance {
+		t.Fatal("status refused in maintenance mode")
+	}
+	if w := post("/healthz"); w.Code != http.StatusOK {
+		t.Fatalf("healthz: %d", w.Code)
+	}
+
+	if m := admin(`{"Enabled": false}`); m.Enabled {
+		t.Fatal("maintenance mode still on")
+	}
+	if w := post("/register"); errCode(w) == ErrMaintenance {
+		t.Fatal("register refused after maintenance")
+	}
+}
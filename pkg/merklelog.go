@@ -0,0 +1,172 @@
+// Copyright 2018 David Lazar. All rights reserved.
+// Use of this source code is governed by the GNU AGPL
+// license that can be found in the LICENSE file.
+
+//go:build !js
+// +build !js
+
+package pkg
+
+import (
+	"encoding/binary"
+
+	"vuvuzela.io/alpenhorn/errors"
+	"vuvuzela.io/alpenhorn/pkg/kv"
+	"vuvuzela.io/alpenhorn/translog"
+)
+
+// A merkleLog is an append-only Merkle tree (see package translog)
+// kept in the database under prefix. The PKG keeps two: the
+// attestation log and the registration log.
+type merkleLog struct {
+	prefix      []byte
+	sizeKey     []byte
+	nodePrefix  []byte
+	entryPrefix []byte
+}
+
+func newMerkleLog(prefix string) *merkleLog {
+	return &merkleLog{
+		prefix:      []byte(prefix),
+		sizeKey:     []byte(prefix + "size"),
+		nodePrefix:  []byte(prefix + "node:"),
+		entryPrefix: []byte(prefix + "entry:"),
+	}
+}
+
+func (l *merkleLog) subkey(prefix []byte, suffix []byte) []byte {
+	return append(append([]byte(nil), prefix...), suffix...)
+}
+
+func (l *merkleLog) nodeKey(level uint8, index uint64) []byte {
+	return appendUint64(l.subkey(l.nodePrefix, []byte{level}), index)
+}
+
+func (l *merkleLog) entryKey(index uint64) []byte {
+	return appendUint64(l.subkey(l.entryPrefix, nil), index)
+}
+
+func appendUint64(b []byte, x uint64) []byte {
+	var buf [8]byte
+	binary.BigEndian.PutUint64(buf[:], x)
+	return append(b, buf[:]...)
+}
+
+func decodeIndex(data []byte) (uint64, error) {
+	if len(data) != 8 {
+		return 0, errors.New("bad data length: got %d, want 8", len(data))
+	}
+	return binary.BigEndian.Uint64(data), nil
+}
+
+func (l *merkleLog) size(tx kv.Txn) (uint64, error) {
+	data, err := tx.Get(l.sizeKey)
+	if err == kv.ErrNotFound {
+		return 0, nil
+	} else if err != nil {
+		return 0, err
+	}
+	return decodeIndex(data)
+}
+
+func (l *merkleLog) nodeReader(tx kv.Txn) translog.NodeReader {
+	return func(level uint8, index uint64) ([]byte, error) {
+		hash, err := tx.Get(l.nodeKey(level, index))
+		if err != nil {
+			return nil, errors.Wrap(err, "log node %d/%d", level, index)
+		}
+		return hash, nil
+	}
+}
+
+// append adds an entry to the log and returns its index. Appends to
+// the same log must be serialized so they do not conflict.
+func (l *merkleLog) append(tx kv.Txn, entry []byte) (uint64, error) {
+	size, err := l.size(tx)
+	if err != nil {
+		return 0, err
+	}
+	nodes, err := translog.AppendNodes(l.nodeReader(tx), size, translog.LeafHash(entry))
+	if err != nil {
+		return 0, err
+	}
+	for _, n := range nodes {
+		if err := tx.Set(l.nodeKey(n.Level, n.Index), n.Hash); err != nil {
+			return 0, err
+		}
+	}
+	if err := tx.Set(l.entryKey(size), entry); err != nil {
+		return 0, err
+	}
+	return size, tx.Set(l.sizeKey, appendUint64(nil, size+1))
+}
+
+// head returns the log's size and root hash.
+func (l *merkleLog) head(tx kv.Txn) (uint64, []byte, error) {
+	size, err := l.size(tx)
+	if err != nil {
+		return 0, nil, err
+	}
+	root, err := translog.RootHash(l.nodeReader(tx), size)
+	return size, root, err
+}
+
+// inclusion returns a proof that the entry at index is in the tree of
+// the given size.
+func (l *merkleLog) inclusion(tx kv.Txn, index, treeSize uint64) ([][]byte, error) {
+	size, err := l.size(tx)
+	if err != nil {
+		return nil, errorf(ErrDatabaseError, "%s", err)
+	}
+	if treeSize > size {
+		return nil, errorf(ErrInvalidLogRange, "tree size %d exceeds log size %d", treeSize, size)
+	}
+	proof, err := translog.InclusionProof(l.nodeReader(tx), index, treeSize)
+	if err != nil {
+		return nil, errorf(ErrDatabaseError, "%s", err)
+	}
+	return proof, nil
+}
+
+func (l *merkleLog) consistency(tx kv.Txn, args *logConsistencyArgs) (*logConsistencyReply, error) {
+	size, err := l.size(tx)
+	if err != nil {
+		return nil, errorf(ErrDatabaseError, "%s", err)
+	}
+	if args.First > args.Second || args.Second > size {
+		return nil, errorf(ErrInvalidLogRange, "%d to %d in log of size %d", args.First, args.Second, size)
+	}
+	reply := new(logConsistencyReply)
+	reply.Proof, err = translog.ConsistencyProof(l.nodeReader(tx), args.First, args.Second)
+	if err != nil {
+		return nil, errorf(ErrDatabaseError, "%s", err)
+	}
+	return reply, nil
+}
+
+func (l *merkleLog) entries(tx kv.Txn, args *logEntriesArgs) (*logEntriesReply, error) {
+	count := args.Count
+	if count > MaxLogEntriesPerRequest {
+		count = MaxLogEntriesPerRequest
+	}
+	size, err := l.size(tx)
+	if err != nil {
+		return nil, errorf(ErrDatabaseError, "%s", err)
+	}
+	if args.Start > size {
+		return nil, errorf(ErrInvalidLogRange, "start %d exceeds log size %d", args.Start, size)
+	}
+	end := args.Start + count
+	if end > size {
+		end = size
+	}
+	reply := new(logEntriesReply)
+	for i := args.Start; i < end; i++ {
+		data, err := tx.Get(l.entryKey(i))
+		if err != nil {
+			return nil, errorf(ErrDatabaseError, "entry %d: %s", i, err)
+		}
+		reply.Entries = append(reply.Entries, append([]byte(nil), data...))
+	}
+	return reply, nil
+}
@@ -0,0 +1,259 @@
+// Copyright 2018 David Lazar. All rights reserved.
+// Use of this source code is governed by the GNU AGPL
+// license that can be found in the LICENSE file.
+
+//go:build !js
+// +build !js
+
+package pkg
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"vuvuzela.io/alpenhorn/internal/metrics"
+	"vuvuzela.io/alpenhorn/pkg/kv"
+)
+
+type serverMetrics struct {
+	registry *metrics.Registry
+
+	requests       *metrics.Counter
+	registrations  *metrics.Counter
+	verifications  *metrics.Counter
+	extractions    *metrics.Counter
+	extractLatency *metrics.Histogram
+	extractQueue   *metrics.Gauge
+	extractWait    *metrics.Histogram
+	endpointQueue  *metrics.Gauge
+	endpointWait   *metrics.Histogram
+	dbLatency      *metrics.Histogram
+	dbConns        *metrics.Gauge
+	dbWaits        *metrics.Gauge
+	dbWaitTime     *metrics.Gauge
+	errors         *metrics.Counter
+	reclaimed      *metrics.Counter
+}
+
+func newServerMetrics() *serverMetrics {
+	r := metrics.NewRegistry()
+	return &serverMetrics{
+		registry: r,
+
+		requests: r.Counter("alpenhorn_pkg_requests_total",
+			"Requests answered, by path and HTTP status.", "path", "status"),
+		registrations: r.Counter("alpenhorn_pkg_registrations_total",
+			"Registration attempts, by result.", "result"),
+		verifications: r.Counter("alpenhorn_pkg_verifications_total",
+			"Username verifications, by verifier and result.", "verifier", "result"),
+		extractions: r.Counter("alpenhorn_pkg_extractions_total",
+			"Private keys extracted in each round the server still holds.", "round"),
+		extractLatency: r.Histogram("alpenhorn_pkg_extract_duration_seconds",
+			"Time to answer successful extraction requests.", metrics.LatencyBuckets),
+		extractQueue: r.Gauge("alpenhorn_pkg_extract_queue_depth",
+			"Extractions waiting for a worker."),
+		extractWait: r.Histogram("alpenhorn_pkg_extract_queue_wait_seconds",
+			"Time extractions waited for a worker.", metrics.LatencyBuckets),
+		endpointQueue: r.Gauge("alpenhorn_pkg_endpoint_queue_depth",
+			"Requests waiting for a slot on a path with an endpoint limit, by path.", "path"),
+		endpointWait: r.Histogram("alpenhorn_pkg_endpoint_queue_wait_seconds",
+			"Time requests waited for a slot on a path with an endpoint limit, by path.", metrics.LatencyBuckets, "path"),
+		dbLatency: r.Histogram("alpenhorn_pkg_db_duration_seconds",
+			"Database transaction latency, by kind of transaction.", metrics.LatencyBuckets, "op"),
+		dbConns: r.Gauge("alpenhorn_pkg_db_connections",
+			"Connections to a networked database, by database and state.", "db", "state"),
+		dbWaits: r.Gauge("alpenhorn_pkg_db_connection_waits",
+			"Times transactions waited for a database connection, by database.", "db"),
+		dbWaitTime: r.Gauge("alpenhorn_pkg_db_connection_wait_seconds",
+			"Total time transactions waited for a database connection, by database.", "db"),
+		errors: r.Counter("alpenhorn_pkg_errors_total",
+			"Errors returned to clients, by error code.", "code"),
+		reclaimed: r.Counter("alpenhorn_pkg_gc_reclaimed_total",
+			"Round keys and last extraction records erased by the round garbage collector, by kind.", "kind"),
+	}
+}
+
+// Metrics returns a handler that serves the server's metrics in the
+// Prometheus text format. It should be served on its own listener,
+// not alongside the PKG's API.
+func (srv *Server) Metrics() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		srv.updatePoolMetrics()
+		srv.metrics.registry.ServeHTTP(w, req)
+	})
+}
+
+// updatePoolMetrics reports on the connection pools of networked
+// databases, such as MySQL.
+func (srv *Server) updatePoolMetrics() {
+	dbs := map[string]kv.DB{"primary": srv.db}
+	if srv.replica != srv.db {
+		dbs["replica"] = srv.replica
+	}
+	for name, db := range dbs {
+		p, ok := backendDB(db).(kv.Pooled)
+		if !ok {
+			continue
+		}
+		s := p.PoolStats()
+		srv.metrics.dbConns.Set(float64(s.InUse), name, "in_use")
+		srv.metrics.dbConns.Set(float64(s.Idle), name, "idle")
+		srv.metrics.dbWaits.Set(float64(s.WaitCount), name)
+		srv.metrics.dbWaitTime.Set(s.WaitDuration.Seconds(), name)
+	}
+}
+
+// paths are the request paths the server counts requests to. Other
+// paths are counted as "other" so clients cannot grow the metrics.
+var paths = map[string]bool{
+	"/extract":               true,
+	"/extractbatch":          true,
+	"/status":                true,
+	"/register":              true,
+	"/registerchallenge":     true,
+	"/rotatelogin":           true,
+	"/setpqkey":              true,
+	"/pqkey":                 true,
+	"/delete":                true,
+	"/rename":                true,
+	"/setrecoverykey":        true,
+	"/revokelogin":           true,
+	"/devicekey":             true,
+	"/devicekeys":            true,
+	"/report":                true,
+	"/attestlog/head":        true,
+	"/attestlog/inclusion":   true,
+	"/attestlog/consistency": true,
+	"/attestlog/entries":     true,
+	"/reglog/head":           true,
+	"/reglog/inclusion":      true,
+	"/reglog/consistency":    true,
+	"/reglog/entries":        true,
+	"/commit":                true,
+	"/reveal":                true,
+	"/registrar/userfilter":  true,
+	"/version":               true,
+	"/healthz":               true,
+	"/readyz":                true,
+	"/leaderz":               true,
+	"/cluster/round":         true,
+}
+
+// statusRecorder records the status of a response, the code of any
+// error written to it, and the username the request is about.
+type statusRecorder struct {
+	http.ResponseWriter
+	status   int
+	errors   []ErrorCode
+	username string
+}
+
+func (w *statusRecorder) recordError(code ErrorCode) {
+	w.errors = append(w.errors, code)
+}
+
+func (w *statusRecorder) recordUsername(username string) {
+	if w.username == "" {
+		w.username = username
+	}
+}
+
+func (w *statusRecorder) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *statusRecorder) Write(p []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	return w.ResponseWriter.Write(p)
+}
+
+func (m *serverMetrics) countRequest(path string, w *statusRecorder) {
+	if !paths[path] {
+		path = "other"
+	}
+	status := w.status
+	if status == 0 {
+		status = http.StatusOK
+	}
+	m.requests.Inc(path, strconv.Itoa(status))
+	for _, code := range w.errors {
+		m.errors.Inc(code.String())
+	}
+}
+
+// result returns the label for an operation's outcome: "ok" or the
+// error code.
+func result(err error) string {
+	if err == nil {
+		return "ok"
+	}
+	return errorCode(err).String()
+}
+
+// timedDB records the latency of transactions on a kv.DB.
+type timedDB struct {
+	kv.DB
+	latency *metrics.Histogram
+	replica bool
+}
+
+func (db *timedDB) View(fn func(tx kv.Txn) error) error {
+	defer db.latency.Since(time.Now(), db.op(false))
+	return db.DB.View(fn)
+}
+
+func (db *timedDB) Update(fn func(tx kv.Txn) error) error {
+	defer db.latency.Since(time.Now(), db.op(true))
+	return db.DB.Update(fn)
+}
+
+func (db *timedDB) op(update bool) string {
+	switch {
+	case update:
+		return "update"
+	case db.replica:
+		return "replica_view"
+	default:
+		return "view"
+	}
+}
+
+func (db *timedDB) NewTransaction(update bool) (kv.Txn, error) {
+	tx, err := db.DB.NewTransaction(update)
+	if err != nil {
+		return nil, err
+	}
+	return &timedTxn{Txn: tx, latency: db.latency, op: db.op(update), start: time.Now()}, nil
+}
+
+type timedTxn struct {
+	kv.Txn
+	latency *metrics.Histogram
+	op      string
+	start   time.Time
+	done    bool
+}
+
+func (tx *timedTxn) observe() {
+	if !tx.done {
+		tx.done = true
+		tx.latency.Since(tx.start, tx.op)
+	}
+}
+
+func (tx *timedTxn) Commit() error {
+	err := tx.Txn.Commit()
+	tx.observe()
+	return err
+}
+
+func (tx *timedTxn) Discard() {
+	tx.Txn.Discard()
+	tx.observe()
+}
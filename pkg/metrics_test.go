@@ -0,0 +1,105 @@
+// Copyright 2018 David Lazar. All rights reserved.
+// Use of this source code is governed by the GNU AGPL
+// license that can be found in the LICENSE file.
+
+package pkg
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/json"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"vuvuzela.io/alpenhorn/pkg/kv"
+)
+
+func TestMetrics(t *testing.T) {
+	_, serverKey, _ := ed25519.GenerateKey(rand.Reader)
+	srv, err := NewServer(&Config{
+		DB:              kv.NewMemory(),
+		SigningKey:      serverKey,
+		RegTokenHandler: func(string, string) error { return nil },
+		// Keep audit events from adding to the database latencies.
+		AuditRetention: -1,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+
+	post := func(path string, args interface{}) {
+		body, _ := json.Marshal(args)
+		req := httptest.NewRequest("POST", path, bytes.NewReader(body))
+		srv.ServeHTTP(httptest.NewRecorder(), req)
+	}
+
+	loginKey, _, _ := ed25519.GenerateKey(rand.Reader)
+	post("/register", &registerArgs{Username: "alice@example.org", LoginKey: loginKey})
+	post("/register", &registerArgs{Username: "alice@example.org", LoginKey: loginKey})
+	post("/status", &statusArgs{Username: "bob@example.org"})
+	post("/no/such/path", nil)
+
+	w := httptest.NewRecorder()
+	srv.Metrics().ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+	out := w.Body.String()
+	for _, line := range []string{
+		`alpenhorn_pkg_requests_total{path="/register",status="200"} 1`,
+		`alpenhorn_pkg_requests_total{path="/register",status="400"} 1`,
+		`alpenhorn_pkg_requests_total{path="other",status="404"} 1`,
+		`alpenhorn_pkg_registrations_total{result="accepted"} 1`,
+		`alpenhorn_pkg_registrations_total{result="ErrAlreadyRegistered"} 1`,
+		`alpenhorn_pkg_verifications_total{verifier="token",result="ok"} 2`,
+		`alpenhorn_pkg_errors_total{code="ErrAlreadyRegistered"} 1`,
+		`alpenhorn_pkg_errors_total{code="ErrNotRegistered"} 1`,
+		`alpenhorn_pkg_db_duration_seconds_count{op="update"} 2`,
+	} {
+		if !strings.Contains(out, line+"\n") {
+			t.Errorf("metrics missing %s", line)
+		}
+	}
+	if t.Failed() {
+		t.Logf("metrics:\n%s", out)
+	}
+}
+
+type pooledMemory struct {
+	kv.DB
+}
+
+func (pooledMemory) PoolStats() kv.PoolStats {
+	return kv.PoolStats{Open: 5, InUse: 3, Idle: 2, WaitCount: 7, WaitDuration: 1500 * time.Millisecond}
+}
+
+func TestPoolMetrics(t *testing.T) {
+	_, serverKey, _ := ed25519.GenerateKey(rand.Reader)
+	srv, err := NewServer(&Config{
+		DB:              pooledMemory{kv.NewMemory()},
+		SigningKey:      serverKey,
+		RegTokenHandler: func(string, string) error { return nil },
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+
+	w := httptest.NewRecorder()
+	srv.Metrics().ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+	out := w.Body.String()
+	for _, line := range []string{
+		`alpenhorn_pkg_db_connections{db="primary",state="in_use"} 3`,
+		`alpenhorn_pkg_db_connections{db="primary",state="idle"} 2`,
+		`alpenhorn_pkg_db_connection_waits{db="primary"} 7`,
+		`alpenhorn_pkg_db_connection_wait_seconds{db="primary"} 1.5`,
+	} {
+		if !strings.Contains(out, line+"\n") {
+			t.Errorf("metrics missing %s", line)
+		}
+	}
+	if strings.Contains(out, `db="replica"`) {
+		t.Errorf("metrics report a replica the server does not have")
+	}
+}
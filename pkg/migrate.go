@@ -0,0 +1,194 @@
+// Copyright 2018 David Lazar. All rights reserved.
+// Use of this source code is governed by the GNU AGPL
+// license that can be found in the LICENSE file.
+
+//go:build !js
+// +build !js
+
+package pkg
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"time"
+
+	"vuvuzela.io/alpenhorn/errors"
+	"vuvuzela.io/alpenhorn/log"
+	"vuvuzela.io/alpenhorn/pkg/kv"
+)
+
+// The PKG database is a key-value store, so its schema is the layout
+// of its keys and the binary formats of its values. A change to the
+// schema that existing databases must be rewritten for is a migration:
+// append it to the migrations list with the next version number.
+// Migrate applies the migrations a database has not seen yet, in order,
+// and records each one under "schema:applied:" so operators can see
+// what ran and when.
+//
+// A migration runs against the whole database so that it can split a
+// large rewrite into several transactions. If the server stops part
+// way through, the migration runs again from the start on the next
+// Migrate, so migrations must be safe to repeat.
+
+var (
+	dbSchemaPrefix        = []byte("schema:")
+	dbSchemaVersionKey    = []byte("schema:version")
+	dbSchemaAppliedPrefix = []byte("schema:applied:")
+)
+
+var errStopIteration = errors.New("stop iteration")
+
+type migration struct {
+	version int
+	name    string
+	migrate func(db kv.DB) error
+}
+
+var migrations = []migration{
+	{
+		version: 1,
+		name:    "initial schema",
+		migrate: func(kv.DB) error { return nil },
+	},
+}
+
+// SchemaVersion is the database schema version this server uses.
+func SchemaVersion() int {
+	return migrations[len(migrations)-1].version
+}
+
+// An AppliedMigration records a migration that ran on a database.
+type AppliedMigration struct {
+	Version int
+	Name    string
+	Applied time.Time
+}
+
+// DBSchemaVersion returns the schema version of the database. Databases
+// created before schema versioning have version 0.
+func DBSchemaVersion(db kv.DB) (int, error) {
+	var version int
+	err := db.View(func(tx kv.Txn) error {
+		var err error
+		version, err = getSchemaVersion(tx)
+		return err
+	})
+	return version, err
+}
+
+func getSchemaVersion(tx kv.Txn) (int, error) {
+	data, err := tx.Get(dbSchemaVersionKey)
+	if err == kv.ErrNotFound {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	return decodeSchemaVersion(data)
+}
+
+func decodeSchemaVersion(data []byte) (int, error) {
+	if len(data) != 4 {
+		return 0, errors.New("invalid schema version: %x", data)
+	}
+	return int(binary.BigEndian.Uint32(data)), nil
+}
+
+// AppliedMigrations lists the migrations that ran on the database, in
+// the order they ran.
+func AppliedMigrations(db kv.DB) ([]AppliedMigration, error) {
+	var applied []AppliedMigration
+	err := db.View(func(tx kv.Txn) error {
+		return tx.Iterate(dbSchemaAppliedPrefix, func(_, value []byte) error {
+			var m AppliedMigration
+			if err := json.Unmarshal(value, &m); err != nil {
+				return err
+			}
+			applied = append(applied, m)
+			return nil
+		})
+	})
+	return applied, err
+}
+
+// Migrate brings the database up to SchemaVersion and returns the
+// migrations it applied. It fails if the database was written by a
+// newer server. The server must not be running on the database.
+func Migrate(db kv.DB, logger *log.Logger) ([]AppliedMigration, error) {
+	if logger == nil {
+		logger = log.StdLogger
+	}
+	current, err := DBSchemaVersion(db)
+	if err != nil {
+		return nil, errors.Wrap(err, "reading schema version")
+	}
+	if current > SchemaVersion() {
+		return nil, errors.New("database schema version %d is newer than this server's version %d", current, SchemaVersion())
+	}
+
+	var applied []AppliedMigration
+	for _, m := range migrations {
+		if m.version <= current {
+			continue
+		}
+		logger.Infof("Applying database migration %d: %s", m.version, m.name)
+		if err := m.migrate(db); err != nil {
+			return applied, errors.Wrap(err, "migration %d (%s)", m.version, m.name)
+		}
+		record := AppliedMigration{
+			Version: m.version,
+			Name:    m.name,
+			Applied: time.Now(),
+		}
+		err := db.Update(func(tx kv.Txn) error {
+			return setSchemaVersion(tx, record)
+		})
+		if err != nil {
+			return applied, errors.Wrap(err, "recording migration %d", m.version)
+		}
+		applied = append(applied, record)
+	}
+	return applied, nil
+}
+
+func setSchemaVersion(tx kv.Txn, m AppliedMigration) error {
+	version := make([]byte, 4)
+	binary.BigEndian.PutUint32(version, uint32(m.Version))
+	data, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+	if err := tx.Set(append(append([]byte(nil), dbSchemaAppliedPrefix...), version...), data); err != nil {
+		return err
+	}
+	return tx.Set(dbSchemaVersionKey, version)
+}
+
+// checkSchema is used by NewServer when migrations are manual. It
+// fails unless the database is up to date or empty.
+func checkSchema(db kv.DB, logger *log.Logger) error {
+	version, err := DBSchemaVersion(db)
+	if err != nil {
+		return errors.Wrap(err, "reading schema version")
+	}
+	if version == 0 {
+		empty := true
+		err := db.View(func(tx kv.Txn) error {
+			return tx.Iterate(nil, func(_, _ []byte) error {
+				empty = false
+				return errStopIteration
+			})
+		})
+		if err != nil && err != errStopIteration {
+			return err
+		}
+		if empty {
+			_, err := Migrate(db, logger)
+			return err
+		}
+	}
+	if version != SchemaVersion() {
+		return errors.New("database schema version is %d, want %d: migrate the database first", version, SchemaVersion())
+	}
+	return nil
+}
@@ -0,0 +1,100 @@
+// Copyright 2018 David Lazar. All rights reserved.
+// Use of this source code is governed by the GNU AGPL
+// license that can be found in the LICENSE file.
+
+package pkg
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"testing"
+
+	"vuvuzela.io/alpenhorn/log"
+	"vuvuzela.io/alpenhorn/pkg/kv"
+)
+
+func TestMigrate(t *testing.T) {
+	logger := &log.Logger{Level: log.ErrorLevel, EntryHandler: &log.OutputText{Out: log.Stderr}}
+	_, serverPriv, _ := ed25519.GenerateKey(rand.Reader)
+	newServer := func(db kv.DB, manual bool) (*Server, error) {
+		return NewServer(&Config{
+			DB:               db,
+			ManualMigrations: manual,
+			SigningKey:       serverPriv,
+			RegTokenHandler:  func(string, string) error { return nil },
+			Logger:           logger,
+		})
+	}
+
+	// A database from before schema versioning.
+	db := kv.NewMemory()
+	err := db.Update(func(tx kv.Txn) error {
+		return tx.Set([]byte("legacy"), []byte("1"))
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := newServer(db, true); err == nil {
+		t.Fatal("expected error for an unmigrated database with manual migrations")
+	}
+
+	runs := 0
+	defer func(saved []migration) { migrations = saved }(migrations)
+	migrations = append(migrations, migration{
+		version: SchemaVersion() + 1,
+		name:    "rename legacy key",
+		migrate: func(db kv.DB) error {
+			runs++
+			return db.Update(func(tx kv.Txn) error {
+				if _, err := tx.Get([]byte("legacy")); err == kv.ErrNotFound {
+					return nil
+				}
+				if err := tx.Delete([]byte("legacy")); err != nil {
+					return err
+				}
+				return tx.Set([]byte("user:legacy"), []byte("1"))
+			})
+		},
+	})
+
+	applied, err := Migrate(db, logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(applied) != 2 || applied[0].Version != 1 || applied[1].Version != 2 {
+		t.Fatalf("unexpected migrations applied: %+v", applied)
+	}
+	if version, _ := DBSchemaVersion(db); version != 2 {
+		t.Fatalf("schema version is %d, want 2", version)
+	}
+	if _, err := Migrate(db, logger); err != nil || runs != 1 {
+		t.Fatalf("second Migrate: runs=%d err=%v", runs, err)
+	}
+	records, err := AppliedMigrations(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 2 || records[1].Name != "rename legacy key" {
+		t.Fatalf("unexpected migration records: %+v", records)
+	}
+
+	srv, err := newServer(db, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+
+	// A server that does not know the newest migration refuses the
+	// database.
+	migrations = migrations[:1]
+	if _, err := Migrate(db, logger); err == nil {
+		t.Fatal("expected error for a database from a newer server")
+	}
+
+	// An empty database is migrated even when migrations are manual.
+	srv2, err := newServer(kv.NewMemory(), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv2.Close()
+}
@@ -15,11 +15,10 @@ import (
 	"testing"
 	"time"
 
-	"github.com/dgraph-io/badger"
-
 	"vuvuzela.io/alpenhorn/edhttp"
 	"vuvuzela.io/alpenhorn/log"
 	"vuvuzela.io/alpenhorn/pkg"
+	"vuvuzela.io/alpenhorn/pkg/kv"
 	"vuvuzela.io/crypto/ibe"
 	"vuvuzela.io/internal/mock"
 )
@@ -71,10 +70,13 @@ func TestSingleClient(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	err = client.CheckStatus(testpkg.PublicServerConfig)
+	status, err := client.Status(testpkg.PublicServerConfig)
 	if err != nil {
 		t.Fatal(err)
 	}
+	if status.LastExtractionRound != 0 || !status.LastExtraction.IsZero() {
+		t.Fatalf("unexpected status before extracting: %+v", status)
+	}
 
 	aliceLog, err := testpkg.PKGServer.GetUserLog(pkg.ValidUsernameToIdentity(aliceUsername))
 	if err != nil {
@@ -91,7 +93,7 @@ func TestSingleClient(t *testing.T) {
 	}
 
 	_, err = testpkg.PKGServer.GetUserLog(pkg.ValidUsernameToIdentity("nonexistent"))
-	if err != badger.ErrKeyNotFound {
+	if err != kv.ErrNotFound {
 		t.Fatal(err)
 	}
 
@@ -126,6 +128,31 @@ func TestSingleClient(t *testing.T) {
 		t.Fatalf("ibe private key differs across calls to extract")
 	}
 
+	client.ReturnVersion = pkg.ReturnHybrid
+	result3, err := client.Extract(testpkg.PublicServerConfig, 42)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(marshal(result1.PrivateKey), marshal(result3.PrivateKey)) {
+		t.Fatalf("ibe private key differs with hybrid return")
+	}
+	results, err := client.ExtractRange(testpkg.PublicServerConfig, 42, 42)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(marshal(result1.PrivateKey), marshal(results[42].PrivateKey)) {
+		t.Fatalf("ibe private key differs in hybrid batch extraction")
+	}
+	client.ReturnVersion = pkg.ReturnBox
+
+	status, err = client.Status(testpkg.PublicServerConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status.LastExtractionRound != 42 || status.LastExtraction.IsZero() {
+		t.Fatalf("unexpected status after extracting: %+v", status)
+	}
+
 	_, err = client.Extract(testpkg.PublicServerConfig, 40)
 	if err.(pkg.Error).Code != pkg.ErrRoundNotFound {
 		t.Fatal(err)
@@ -231,3 +258,52 @@ func marshal(v encoding.BinaryMarshaler) []byte {
 	}
 	return data
 }
+
+func TestExtractRange(t *testing.T) {
+	testpkg, coordinatorClient := launchPKG(t, func(username string, token string) error {
+		return nil
+	})
+	defer testpkg.Close()
+
+	alicePub, alicePriv, _ := ed25519.GenerateKey(rand.Reader)
+	client := &pkg.Client{
+		Username:        "alice@example.org",
+		LoginKey:        alicePriv,
+		UserLongTermKey: alicePub,
+		HTTPClient:      new(edhttp.Client),
+	}
+	if err := client.Register(testpkg.PublicServerConfig, ""); err != nil {
+		t.Fatal(err)
+	}
+
+	pkgs := []pkg.PublicServerConfig{testpkg.PublicServerConfig}
+	for _, round := range []uint32{42, 43} {
+		if _, err := coordinatorClient.NewRound(pkgs, round); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	results, err := client.ExtractRange(testpkg.PublicServerConfig, 40, 45)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 2 || results[42] == nil || results[43] == nil {
+		t.Fatalf("expected keys for rounds 42 and 43, got %v", results)
+	}
+	single, err := client.Extract(testpkg.PublicServerConfig, 43)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(marshal(single.PrivateKey), marshal(results[43].PrivateKey)) {
+		t.Fatal("batch key differs from single extraction")
+	}
+
+	_, err = client.ExtractRange(testpkg.PublicServerConfig, 10, 20)
+	if err.(pkg.Error).Code != pkg.ErrRoundNotFound {
+		t.Fatalf("expected ErrRoundNotFound, got %v", err)
+	}
+	_, err = client.ExtractRange(testpkg.PublicServerConfig, 0, pkg.MaxExtractBatch)
+	if err.(pkg.Error).Code != pkg.ErrInvalidRoundRange {
+		t.Fatalf("expected ErrInvalidRoundRange, got %v", err)
+	}
+}
@@ -0,0 +1,181 @@
+// Copyright 2018 David Lazar. All rights reserved.
+// Use of this source code is governed by the GNU AGPL
+// license that can be found in the LICENSE file.
+
+//go:build !js
+// +build !js
+
+package pkg
+
+import (
+	"crypto/mlkem"
+	"encoding/json"
+	"net/http"
+
+	"vuvuzela.io/alpenhorn/errors"
+	"vuvuzela.io/alpenhorn/log"
+	"vuvuzela.io/alpenhorn/pkg/kv"
+)
+
+// Users publish an ML-KEM public key through the PKGs so that senders
+// can wrap add-friend requests in a post-quantum layer. Each PKG signs
+// the key it serves; senders require all PKGs to agree, just as they
+// trust the PKGs collectively for IBE.
+
+const pqKeyBinaryVersion byte = 1
+
+func (srv *Server) setPQKeyHandler(w http.ResponseWriter, req *http.Request) {
+	body := http.MaxBytesReader(w, req.Body, 4096)
+	args := new(setPQKeyArgs)
+	err := json.NewDecoder(body).Decode(args)
+	if err != nil {
+		httpError(w, errorf(ErrBadRequestJSON, "%s", err))
+		return
+	}
+	if !srv.limitUsername(w, args.Username) {
+		return
+	}
+	args.ServerSigningKey = srv.publicKey
+
+	logger := srv.log.WithFields(log.Fields{"username": args.Username})
+	err = srv.setPQKey(args)
+	srv.audit(&AuditEvent{
+		Type:     AuditPQKey,
+		Username: args.Username,
+		Key:      KeyFingerprint(args.PQKey),
+		Result:   result(err),
+		RemoteIP: remoteIP(req),
+	})
+	if err != nil {
+		logger = logger.WithFields(log.Fields{"code": errorCode(err).String()})
+		if isInternalError(err) {
+			logger.Errorf("Set PQ key failed: %s", err)
+		} else {
+			logger.Infof("Set PQ key failed: %s", err)
+		}
+		httpError(w, err)
+		return
+	}
+	logger.Info("Set PQ key")
+
+	w.Write([]byte("\"OK\""))
+}
+
+func (srv *Server) setPQKey(args *setPQKeyArgs) error {
+	if _, err := mlkem.NewEncapsulationKey768(args.PQKey); err != nil {
+		return errorf(ErrInvalidPQKey, "%s", err)
+	}
+	now := srv.clock.Now()
+	if err := checkFresh(args.Time, now); err != nil {
+		return err
+	}
+
+	tx, err := srv.db.NewTransaction(true)
+	if err != nil {
+		return errorf(ErrDatabaseError, "%s", err)
+	}
+	defer tx.Discard()
+
+	user, id, err := srv.getUser(tx, args.Username)
+	if err != nil {
+		return err
+	}
+	if !srv.verifyBound(&args.ServerSigningKey, func() bool {
+		return user.verifyLogin(now, args.msg(), args.Signature)
+	}) {
+		return errorf(ErrInvalidSignature, "")
+	}
+	if err := checkReplay(tx, "setpqkey", args.Signature, now); err != nil {
+		return err
+	}
+
+	data := append([]byte{pqKeyBinaryVersion}, args.PQKey...)
+	if err := tx.Set(dbUserKey(id, pqKeySuffix), data); err != nil {
+		return errorf(ErrDatabaseError, "%s", err)
+	}
+	if err := tx.Commit(); err != nil {
+		return errorf(ErrDatabaseError, "%s", err)
+	}
+	return nil
+}
+
+func (srv *Server) lookupPQKeyHandler(w http.ResponseWriter, req *http.Request) {
+	body := http.MaxBytesReader(w, req.Body, 1024)
+	args := new(lookupPQKeyArgs)
+	err := json.NewDecoder(body).Decode(args)
+	if err != nil {
+		httpError(w, errorf(ErrBadRequestJSON, "%s", err))
+		return
+	}
+	if !srv.limitUsername(w, args.Username) {
+		return
+	}
+
+	if err := srv.checkWork(args.Username, args.Work, srv.clock.Now()); err != nil {
+		httpError(w, err)
+		return
+	}
+	if err := srv.checkLookup(req, args.Username); err != nil {
+		httpError(w, err)
+		return
+	}
+
+	reply, err := srv.lookupPQKey(args.Username)
+	if err != nil {
+		if isInternalError(err) {
+			srv.log.WithFields(log.Fields{"username": args.Username}).Errorf("PQ key lookup failed: %s", err)
+		}
+		httpError(w, err)
+		return
+	}
+
+	bs, err := json.Marshal(reply)
+	if err != nil {
+		panic(err)
+	}
+	w.Write(bs)
+}
+
+func (srv *Server) lookupPQKey(username string) (*lookupPQKeyReply, error) {
+	tx, err := srv.db.NewTransaction(false)
+	if err != nil {
+		return nil, errorf(ErrDatabaseError, "%s", err)
+	}
+	defer tx.Discard()
+
+	_, id, err := srv.getUser(tx, username)
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := tx.Get(dbUserKey(id, pqKeySuffix))
+	if err == kv.ErrNotFound {
+		return nil, errorf(ErrNoPQKey, "%q", username)
+	} else if err != nil {
+		return nil, errorf(ErrDatabaseError, "%s", err)
+	}
+	pqKey, err := unmarshalPQKey(data)
+	if err != nil {
+		return nil, errorf(ErrDatabaseError, "%s", err)
+	}
+
+	sig, err := srv.sign(PQKeyAttestation(srv.publicKey, id, pqKey))
+	if err != nil {
+		return nil, err
+	}
+	return &lookupPQKeyReply{
+		Username:  username,
+		PQKey:     pqKey,
+		Signature: sig,
+	}, nil
+}
+
+func unmarshalPQKey(data []byte) ([]byte, error) {
+	if len(data) != 1+mlkem.EncapsulationKeySize768 {
+		return nil, errors.New("bad data length: got %d, want %d", len(data), 1+mlkem.EncapsulationKeySize768)
+	}
+	if data[0] != pqKeyBinaryVersion {
+		return nil, errors.New("unexpected binary version: %v", data[0])
+	}
+	return append([]byte(nil), data[1:]...), nil
+}
@@ -0,0 +1,70 @@
+// Copyright 2018 David Lazar. All rights reserved.
+// Use of this source code is governed by the GNU AGPL
+// license that can be found in the LICENSE file.
+
+package pkg_test
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/mlkem"
+	"crypto/rand"
+	"testing"
+
+	"vuvuzela.io/alpenhorn/edhttp"
+	"vuvuzela.io/alpenhorn/pkg"
+)
+
+func TestPQKey(t *testing.T) {
+	testpkg, _ := launchPKG(t, func(username string, token string) error {
+		return nil
+	})
+	defer testpkg.Close()
+
+	alicePub, aliceKey, _ := ed25519.GenerateKey(rand.Reader)
+	client := &pkg.Client{
+		Username:        "alice@example.org",
+		LoginKey:        aliceKey,
+		UserLongTermKey: alicePub,
+		HTTPClient:      new(edhttp.Client),
+	}
+	server := testpkg.PublicServerConfig
+	if err := client.Register(server, ""); err != nil {
+		t.Fatal(err)
+	}
+
+	_, err := client.LookupPQKey(server, "alice@example.org")
+	if err.(pkg.Error).Code != pkg.ErrNoPQKey {
+		t.Fatalf("expected ErrNoPQKey, got %v", err)
+	}
+
+	err = client.SetPQKey(server, []byte("not a key"))
+	if err.(pkg.Error).Code != pkg.ErrInvalidPQKey {
+		t.Fatalf("expected ErrInvalidPQKey, got %v", err)
+	}
+
+	dk, _ := mlkem.GenerateKey768()
+	pqKey := dk.EncapsulationKey().Bytes()
+
+	// Only the owner of the login key can set the PQ key.
+	_, mallory, _ := ed25519.GenerateKey(rand.Reader)
+	impostor := *client
+	impostor.LoginKey = mallory
+	err = impostor.SetPQKey(server, pqKey)
+	if err.(pkg.Error).Code != pkg.ErrInvalidSignature {
+		t.Fatalf("expected ErrInvalidSignature, got %v", err)
+	}
+
+	if err := client.SetPQKey(server, pqKey); err != nil {
+		t.Fatal(err)
+	}
+
+	bob := &pkg.Client{HTTPClient: new(edhttp.Client)}
+	key, err := bob.LookupPQKey(server, "alice@example.org")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(key, pqKey) {
+		t.Fatal("looked up PQ key does not match")
+	}
+}
@@ -0,0 +1,1084 @@
+// Copyright 2018 David Lazar. All rights reserved.
+// Use of this source code is governed by the GNU AGPL
+// license that can be found in the LICENSE file.
+
+package pkg
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/binary"
+	"encoding/hex"
+	"sort"
+	"time"
+
+	"vuvuzela.io/alpenhorn/errors"
+	"vuvuzela.io/alpenhorn/internal/wire"
+	"vuvuzela.io/alpenhorn/translog"
+	"vuvuzela.io/crypto/bls"
+	"vuvuzela.io/crypto/ibe"
+)
+
+// Messages exchanged by PKG clients and servers live here, apart from
+// the server code, which needs badger and does not build for js/wasm.
+
+// Use github.com/davidlazar/easyjson:
+//go:generate easyjson protocol.go
+
+// CurveKeys are a PKG's public round keys on a curve other than bn256.
+type CurveKeys struct {
+	MasterPublicKey []byte
+	BLSPublicKey    []byte
+
+	// Threshold describes the round's master key if the PKGs
+	// generated it with a DKG, in which case MasterPublicKey is the
+	// PKG's part of it; see dkg.go.
+	Threshold *ThresholdKeys `json:",omitempty"`
+}
+
+// A coordinatorNonce makes each coordinator request unique and binds
+// it to a time, so the PKG can reject replayed round setups.
+type coordinatorNonce struct {
+	Time  int64
+	Nonce []byte
+}
+
+// coordinatorNonceSize is the size of a coordinatorNonce's Nonce.
+const coordinatorNonceSize = 16
+
+func newCoordinatorNonce(now time.Time) coordinatorNonce {
+	nonce := make([]byte, coordinatorNonceSize)
+	if _, err := rand.Read(nonce); err != nil {
+		panic(err)
+	}
+	return coordinatorNonce{
+		Time:  now.Unix(),
+		Nonce: nonce,
+	}
+}
+
+type commitArgs struct {
+	Round uint32
+	coordinatorNonce
+
+	// Curves lists the pairing curves to serve in this round in
+	// addition to bn256.
+	Curves []string `json:",omitempty"`
+
+	// Threshold, if not zero, has the Participants generate the
+	// round's master keys on Curves other than bn256 with a DKG, so
+	// that any Threshold of them can serve the round; see dkg.go.
+	Threshold    int                 `json:",omitempty"`
+	Participants []ed25519.PublicKey `json:",omitempty"`
+}
+
+type commitReply struct {
+	Commitment []byte
+
+	// BoxKeys are the PKG's box keys for the DKG on each curve.
+	BoxKeys map[string]*dkgBoxKey `json:",omitempty"`
+}
+
+func commitTo(ibeKey *ibe.MasterPublicKey, blsKey *bls.PublicKey, curves map[string]*CurveKeys) []byte {
+	ibeKeyBytes, _ := ibeKey.MarshalBinary()
+	blsKeyBytes, _ := blsKey.MarshalBinary()
+	msg := append(ibeKeyBytes, blsKeyBytes...)
+
+	// Rounds that only use bn256 keep the original commitment.
+	names := make([]string, 0, len(curves))
+	for name := range curves {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		msg = append(msg, name...)
+		msg = append(msg, curves[name].MasterPublicKey...)
+		msg = append(msg, curves[name].BLSPublicKey...)
+	}
+
+	h := sha512.Sum512_256(msg)
+	return h[:]
+}
+
+type revealArgs struct {
+	Round       uint32
+	Commitments map[string][]byte // map from hex(signingPublicKey) -> commitment
+	coordinatorNonce
+}
+
+type RevealReply struct {
+	MasterPublicKey *ibe.MasterPublicKey
+	BLSPublicKey    *bls.PublicKey
+
+	// Curves holds the round keys for curves other than bn256.
+	Curves map[string]*CurveKeys `json:",omitempty"`
+
+	// Signature signs the commitments in RevealArgs.
+	Signature []byte
+}
+
+type RoundSettings map[string]RevealReply
+
+func (s RoundSettings) Verify(round uint32, keys []ed25519.PublicKey) bool {
+	hexkeys := make([]string, len(keys))
+	for i := range keys {
+		hexkeys[i] = hex.EncodeToString(keys[i])
+	}
+	sort.Strings(hexkeys)
+
+	buf := new(bytes.Buffer)
+	buf.WriteString("Commitments")
+	binary.Write(buf, binary.BigEndian, round)
+
+	for _, hexkey := range hexkeys {
+		reveal, ok := s[hexkey]
+		if !ok {
+			return false
+		}
+
+		commitment := commitTo(reveal.MasterPublicKey, reveal.BLSPublicKey, reveal.Curves)
+
+		buf.WriteString(hexkey)
+		buf.Write(commitment)
+	}
+	msg := buf.Bytes()
+
+	for _, key := range keys {
+		sig := s[hex.EncodeToString(key)].Signature
+		if !ed25519.Verify(key, msg, sig) {
+			return false
+		}
+	}
+	return s.verifyThreshold(round, keys)
+}
+
+//easyjson:readable
+type PublicServerConfig struct {
+	Key     ed25519.PublicKey
+	Address string
+
+	// ProtocolVersion is the PKG protocol version the server speaks,
+	// if advertised. Clients refuse servers they cannot talk to before
+	// sending them anything.
+	ProtocolVersion int `json:",omitempty"`
+
+	// PreviousKey is the server's key before it rotated to Key. While
+	// a config lists it, clients accept the server's signatures and
+	// TLS certificate with either key, so that clients and servers
+	// need not switch keys at the same moment.
+	PreviousKey ed25519.PublicKey `json:",omitempty"`
+}
+
+// Keys returns the keys clients accept from the server: Key and, if
+// set, PreviousKey.
+func (c PublicServerConfig) Keys() []ed25519.PublicKey {
+	if len(c.PreviousKey) == 0 {
+		return []ed25519.PublicKey{c.Key}
+	}
+	return []ed25519.PublicKey{c.Key, c.PreviousKey}
+}
+
+type registerArgs struct {
+	Username string
+
+	// LoginKey is how clients authenticate to the PKG server.
+	LoginKey ed25519.PublicKey
+
+	// RegistrationToken can be used to authenticate registrations.
+	RegistrationToken string
+
+	// Work is required when the server sets Config.RegisterWorkBits.
+	Work *RegisterWork `json:",omitempty"`
+
+	// CaptchaToken is required when the server sets Config.Captcha.
+	CaptchaToken string `json:",omitempty"`
+
+	// OverrideToken is required to register a reserved username.
+	OverrideToken string `json:",omitempty"`
+
+	RemoteIP string `json:"-"`
+}
+
+type registerChallengeArgs struct {
+	Username string
+}
+
+type registerChallengeReply struct {
+	Challenge []byte
+	WorkBits  int
+}
+
+type statusArgs struct {
+	Username         string
+	Message          [32]byte
+	ServerSigningKey ed25519.PublicKey `json:"-"`
+
+	Signature []byte
+}
+
+func (a *statusArgs) msg() []byte {
+	buf := new(bytes.Buffer)
+	buf.WriteString("StatusArgs")
+	buf.Write(a.ServerSigningKey)
+	id := ValidUsernameToIdentity(a.Username)
+	buf.Write(id[:])
+	buf.Write(a.Message[:])
+	return buf.Bytes()
+}
+
+type statusReply struct {
+	// LastExtractRound and LastExtractTime (in Unix seconds) are the
+	// round and time of the user's most recent key extraction, or zero
+	// if the server has no record of one.
+	LastExtractRound uint32 `json:",omitempty"`
+	LastExtractTime  int64  `json:",omitempty"`
+}
+
+// A login key rotation is a two-phase change of a user's login key.
+// Clients prepare the new key on every PKG before committing it on any,
+// and can abort (rolling back a commit) for RotationWindow afterwards,
+// so a failure partway through never leaves the user with different
+// login keys on different PKGs.
+//
+// An in-place rotation (RotateInPlace) switches to the new key in one
+// request instead, and the old key keeps working for the server's
+// login key grace window so the user's other devices can catch up.
+const (
+	RotatePrepare = "prepare"
+	RotateCommit  = "commit"
+	RotateAbort   = "abort"
+	RotateInPlace = "rotate"
+)
+
+type rotateLoginArgs struct {
+	Username string
+	Phase    string
+
+	// ID identifies the rotation across PKGs.
+	ID          [32]byte
+	OldLoginKey ed25519.PublicKey
+	NewLoginKey ed25519.PublicKey
+
+	// Time is when the request was made, in Unix seconds.
+	Time int64
+
+	ServerSigningKey ed25519.PublicKey `json:"-"`
+
+	// Signature signs everything above. Prepare, commit, and in-place
+	// requests are signed with the old login key. Abort requests are
+	// signed with the old key before the commit, and the new key
+	// after it.
+	Signature []byte
+
+	// NewKeySignature proves possession of the new login key. It is
+	// only needed to prepare a rotation or rotate in place.
+	NewKeySignature []byte
+}
+
+func (a *rotateLoginArgs) msg() []byte {
+	buf := new(bytes.Buffer)
+	buf.WriteString("RotateLoginArgs")
+	buf.Write(a.ServerSigningKey)
+	id := ValidUsernameToIdentity(a.Username)
+	buf.Write(id[:])
+	buf.WriteString(a.Phase)
+	buf.Write(a.ID[:])
+	buf.Write(a.OldLoginKey)
+	buf.Write(a.NewLoginKey)
+	binary.Write(buf, binary.BigEndian, a.Time)
+	return buf.Bytes()
+}
+
+type setPQKeyArgs struct {
+	Username string
+	PQKey    []byte
+
+	// Time is when the request was made, in Unix seconds.
+	Time int64
+
+	ServerSigningKey ed25519.PublicKey `json:"-"`
+
+	// Signature is made with the user's login key.
+	Signature []byte
+}
+
+func (a *setPQKeyArgs) msg() []byte {
+	buf := new(bytes.Buffer)
+	buf.WriteString("SetPQKeyArgs")
+	buf.Write(a.ServerSigningKey)
+	id := ValidUsernameToIdentity(a.Username)
+	buf.Write(id[:])
+	buf.Write(a.PQKey)
+	binary.Write(buf, binary.BigEndian, a.Time)
+	return buf.Bytes()
+}
+
+type deleteArgs struct {
+	Username string
+
+	// Time is when the request was made, in Unix seconds.
+	Time int64
+
+	ServerSigningKey ed25519.PublicKey `json:"-"`
+
+	// Signature is made with the user's login key.
+	Signature []byte
+}
+
+func (a *deleteArgs) msg() []byte {
+	buf := new(bytes.Buffer)
+	buf.WriteString("DeleteArgs")
+	buf.Write(a.ServerSigningKey)
+	id := ValidUsernameToIdentity(a.Username)
+	buf.Write(id[:])
+	binary.Write(buf, binary.BigEndian, a.Time)
+	return buf.Bytes()
+}
+
+type setRecoveryKeyArgs struct {
+	Username    string
+	RecoveryKey ed25519.PublicKey
+
+	// Time is when the request was made, in Unix seconds.
+	Time int64
+
+	ServerSigningKey ed25519.PublicKey `json:"-"`
+
+	// Signature is made with the user's login key, and
+	// RecoverySignature with the recovery key.
+	Signature         []byte
+	RecoverySignature []byte
+}
+
+func (a *setRecoveryKeyArgs) msg() []byte {
+	buf := new(bytes.Buffer)
+	buf.WriteString("SetRecoveryKeyArgs")
+	buf.Write(a.ServerSigningKey)
+	id := ValidUsernameToIdentity(a.Username)
+	buf.Write(id[:])
+	buf.Write(a.RecoveryKey)
+	binary.Write(buf, binary.BigEndian, a.Time)
+	return buf.Bytes()
+}
+
+type revokeLoginArgs struct {
+	Username string
+
+	// NewLoginKey replaces the revoked login key once the user
+	// registers it again.
+	NewLoginKey ed25519.PublicKey
+
+	// Time is when the request was made, in Unix seconds.
+	Time int64
+
+	ServerSigningKey ed25519.PublicKey `json:"-"`
+
+	// Signature is made with the user's recovery key.
+	Signature []byte
+}
+
+func (a *revokeLoginArgs) msg() []byte {
+	buf := new(bytes.Buffer)
+	buf.WriteString("RevokeLoginArgs")
+	buf.Write(a.ServerSigningKey)
+	id := ValidUsernameToIdentity(a.Username)
+	buf.Write(id[:])
+	buf.Write(a.NewLoginKey)
+	binary.Write(buf, binary.BigEndian, a.Time)
+	return buf.Bytes()
+}
+
+// A user can enroll the login keys of their other devices, up to the
+// server's limit, so each device can extract with its own key. Device
+// keys are enrolled and revoked with a request signed by the login key
+// or another enrolled device key.
+const (
+	DeviceEnroll = "enroll"
+	DeviceRevoke = "revoke"
+)
+
+type deviceKeyArgs struct {
+	Username  string
+	Op        string
+	DeviceKey ed25519.PublicKey
+
+	// Time is when the request was made, in Unix seconds.
+	Time int64
+
+	ServerSigningKey ed25519.PublicKey `json:"-"`
+
+	// Signature signs everything above with the login key or an
+	// enrolled device key.
+	Signature []byte
+
+	// DeviceSignature proves possession of the device key. It is only
+	// needed to enroll the key.
+	DeviceSignature []byte
+}
+
+func (a *deviceKeyArgs) msg() []byte {
+	buf := new(bytes.Buffer)
+	buf.WriteString("DeviceKeyArgs")
+	buf.Write(a.ServerSigningKey)
+	id := ValidUsernameToIdentity(a.Username)
+	buf.Write(id[:])
+	buf.WriteString(a.Op)
+	buf.Write(a.DeviceKey)
+	binary.Write(buf, binary.BigEndian, a.Time)
+	return buf.Bytes()
+}
+
+type deviceKeysArgs struct {
+	Username string
+
+	// Time is when the request was made, in Unix seconds.
+	Time int64
+
+	ServerSigningKey ed25519.PublicKey `json:"-"`
+
+	// Signature is made with the login key or an enrolled device key.
+	Signature []byte
+}
+
+func (a *deviceKeysArgs) msg() []byte {
+	buf := new(bytes.Buffer)
+	buf.WriteString("DeviceKeysArgs")
+	buf.Write(a.ServerSigningKey)
+	id := ValidUsernameToIdentity(a.Username)
+	buf.Write(id[:])
+	binary.Write(buf, binary.BigEndian, a.Time)
+	return buf.Bytes()
+}
+
+type deviceKeysReply struct {
+	LoginKey   ed25519.PublicKey
+	DeviceKeys []ed25519.PublicKey
+}
+
+// An AbuseCategory says what an abuse report is about.
+type AbuseCategory string
+
+const (
+	AbuseSpam          AbuseCategory = "spam"
+	AbuseHarassment    AbuseCategory = "harassment"
+	AbuseImpersonation AbuseCategory = "impersonation"
+	AbuseOther         AbuseCategory = "other"
+)
+
+// MaxAbuseReportDetails is the most bytes of details an abuse report
+// can carry.
+const MaxAbuseReportDetails = 2000
+
+type abuseReportArgs struct {
+	Username string
+
+	// Reported is the username the report is about.
+	Reported string
+	Category AbuseCategory
+	Details  string
+
+	// Time is when the report was made, in Unix seconds.
+	Time int64
+
+	ServerSigningKey ed25519.PublicKey `json:"-"`
+
+	// Signature is made with the login key or an enrolled device key.
+	Signature []byte
+}
+
+func (a *abuseReportArgs) msg() []byte {
+	buf := new(bytes.Buffer)
+	buf.WriteString("AbuseReportArgs")
+	buf.Write(a.ServerSigningKey)
+	id := ValidUsernameToIdentity(a.Username)
+	buf.Write(id[:])
+	reported := ValidUsernameToIdentity(a.Reported)
+	buf.Write(reported[:])
+	binary.Write(buf, binary.BigEndian, uint32(len(a.Category)))
+	buf.WriteString(string(a.Category))
+	binary.Write(buf, binary.BigEndian, uint32(len(a.Details)))
+	buf.WriteString(a.Details)
+	binary.Write(buf, binary.BigEndian, a.Time)
+	return buf.Bytes()
+}
+
+type renameArgs struct {
+	OldUsername string
+	NewUsername string
+
+	// RegistrationToken proves ownership of NewUsername, as when
+	// registering it.
+	RegistrationToken string
+
+	// Time is when the request was made, in Unix seconds.
+	Time int64
+
+	ServerSigningKey ed25519.PublicKey `json:"-"`
+
+	// Signature is made with the user's login key.
+	Signature []byte
+}
+
+func (a *renameArgs) msg() []byte {
+	buf := new(bytes.Buffer)
+	buf.WriteString("RenameArgs")
+	buf.Write(a.ServerSigningKey)
+	oldID := ValidUsernameToIdentity(a.OldUsername)
+	buf.Write(oldID[:])
+	newID := ValidUsernameToIdentity(a.NewUsername)
+	buf.Write(newID[:])
+	binary.Write(buf, binary.BigEndian, a.Time)
+	return buf.Bytes()
+}
+
+// A RenameAttestation is a PKG's statement that the account registered
+// as OldUsername is now NewUsername. A user shows the attestations from
+// all PKGs to their friends, who can then keep calling them under the
+// new name.
+type RenameAttestation struct {
+	OldUsername string
+	NewUsername string
+
+	// Time is when the account was renamed, in Unix seconds.
+	Time int64
+
+	// Signature is the PKG's signature on the attestation.
+	Signature []byte
+
+	// SignatureAlgorithm is the scheme of Signature, or empty for
+	// Ed25519; see sigscheme.go.
+	SignatureAlgorithm SignatureAlgorithm `json:",omitempty"`
+}
+
+func (a *RenameAttestation) msg(serverKey ed25519.PublicKey) []byte {
+	buf := new(bytes.Buffer)
+	buf.WriteString("RenameAttestation")
+	buf.Write(serverKey)
+	oldID := ValidUsernameToIdentity(a.OldUsername)
+	buf.Write(oldID[:])
+	newID := ValidUsernameToIdentity(a.NewUsername)
+	buf.Write(newID[:])
+	binary.Write(buf, binary.BigEndian, a.Time)
+	if a.SignatureAlgorithm != "" {
+		buf.WriteString("SignatureAlgorithm")
+		buf.WriteString(string(a.SignatureAlgorithm))
+	}
+	return buf.Bytes()
+}
+
+// Verify reports whether the attestation is signed by the PKG with the
+// given key.
+func (a *RenameAttestation) Verify(serverKey ed25519.PublicKey) bool {
+	if ValidateUsername(a.OldUsername) != nil || ValidateUsername(a.NewUsername) != nil {
+		return false
+	}
+	return verifySignature(a.SignatureAlgorithm, serverKey, a.msg(serverKey), a.Signature)
+}
+
+// VerifyAny reports whether the attestation is signed by the PKG with
+// any of the given keys, such as those from PublicServerConfig.Keys.
+func (a *RenameAttestation) VerifyAny(keys []ed25519.PublicKey) bool {
+	for _, key := range keys {
+		if a.Verify(key) {
+			return true
+		}
+	}
+	return false
+}
+
+type lookupPQKeyArgs struct {
+	Username string
+
+	// Work is required when the server sets Config.LookupWorkBits.
+	Work *WorkStamp `json:",omitempty"`
+}
+
+type lookupPQKeyReply struct {
+	Username string
+	PQKey    []byte
+
+	// Signature is the PKG's signature on PQKeyAttestation.
+	Signature []byte
+}
+
+// PQKeyAttestation is the message a PKG signs with its signing key when
+// serving a user's PQ key.
+func PQKeyAttestation(serverKey ed25519.PublicKey, userIdentity *[64]byte, pqKey []byte) []byte {
+	buf := new(bytes.Buffer)
+	buf.WriteString("PQKeyAttestation")
+	buf.Write(serverKey)
+	buf.Write(userIdentity[:])
+	buf.Write(pqKey)
+	return buf.Bytes()
+}
+
+type extractArgs struct {
+	Round    uint32
+	Username string
+
+	// ReturnKey is a box key that is used to encrypt the
+	// extracted IBE private key.
+	ReturnKey *[32]byte
+
+	// ReturnVersion selects how the key is encrypted: ReturnBox, or
+	// ReturnHybrid, which also encrypts it to ReturnPQKey, an
+	// ML-KEM-768 encapsulation key. See extractreturn.go.
+	ReturnVersion int    `json:",omitempty"`
+	ReturnPQKey   []byte `json:",omitempty"`
+
+	// UserLongTermKey is the user's long-term signing key.
+	// The PKG attests to this key in the extractReply.
+	UserLongTermKey ed25519.PublicKey
+
+	// Curve selects the pairing curve of the extracted key.
+	// The empty string means bn256.
+	Curve string `json:",omitempty"`
+
+	// ServerSigningKey ensures the request is tied to a single PKG.
+	// This field is set locally by the client and server, so it does
+	// not need to be included in the JSON request.
+	ServerSigningKey ed25519.PublicKey `json:"-"`
+
+	// Signature signs everything above with the user's login key.
+	Signature []byte
+}
+
+func (a *extractArgs) Sign(loginKey crypto.Signer) error {
+	sig, err := signLogin(loginKey, a.msg())
+	if err != nil {
+		return err
+	}
+	a.Signature = sig
+	return nil
+}
+
+func (a *extractArgs) Verify(loginKey ed25519.PublicKey) bool {
+	return ed25519.Verify(loginKey, a.msg(), a.Signature)
+}
+
+func (a *extractArgs) msg() []byte {
+	buf := new(bytes.Buffer)
+	buf.WriteString("ExtractArgs")
+	buf.Write(a.ServerSigningKey)
+	binary.Write(buf, binary.BigEndian, a.Round)
+	id := ValidUsernameToIdentity(a.Username)
+	buf.Write(id[:])
+	buf.Write(a.ReturnKey[:])
+	buf.Write(a.UserLongTermKey)
+	if a.Curve != "" {
+		buf.WriteString(a.Curve)
+	}
+	writeReturnVersion(buf, a.ReturnVersion, a.ReturnPQKey)
+	return buf.Bytes()
+}
+
+// MaxExtractBatch is the most rounds a client can extract in one
+// batch request.
+const MaxExtractBatch = 64
+
+// extractBatchArgs requests the user's identity keys for the rounds
+// FromRound through ToRound, inclusive.
+type extractBatchArgs struct {
+	FromRound uint32
+	ToRound   uint32
+	Username  string
+
+	// ReturnKey, ReturnVersion, ReturnPQKey, UserLongTermKey, and
+	// ServerSigningKey are as in extractArgs.
+	ReturnKey        *[32]byte
+	ReturnVersion    int    `json:",omitempty"`
+	ReturnPQKey      []byte `json:",omitempty"`
+	UserLongTermKey  ed25519.PublicKey
+	ServerSigningKey ed25519.PublicKey `json:"-"`
+
+	// Signature signs everything above with the user's login key.
+	Signature []byte
+}
+
+func (a *extractBatchArgs) Sign(loginKey crypto.Signer) error {
+	sig, err := signLogin(loginKey, a.msg())
+	if err != nil {
+		return err
+	}
+	a.Signature = sig
+	return nil
+}
+
+func (a *extractBatchArgs) Verify(loginKey ed25519.PublicKey) bool {
+	return ed25519.Verify(loginKey, a.msg(), a.Signature)
+}
+
+func (a *extractBatchArgs) msg() []byte {
+	buf := new(bytes.Buffer)
+	buf.WriteString("ExtractBatchArgs")
+	buf.Write(a.ServerSigningKey)
+	binary.Write(buf, binary.BigEndian, a.FromRound)
+	binary.Write(buf, binary.BigEndian, a.ToRound)
+	id := ValidUsernameToIdentity(a.Username)
+	buf.Write(id[:])
+	buf.Write(a.ReturnKey[:])
+	buf.Write(a.UserLongTermKey)
+	writeReturnVersion(buf, a.ReturnVersion, a.ReturnPQKey)
+	return buf.Bytes()
+}
+
+// writeReturnVersion adds the return version to an extraction
+// request's signed message. ReturnBox requests leave it out, so their
+// messages are the same as before return versions.
+func writeReturnVersion(buf *bytes.Buffer, version int, pqKey []byte) {
+	if version == ReturnBox && pqKey == nil {
+		return
+	}
+	buf.WriteString("ReturnVersion")
+	binary.Write(buf, binary.BigEndian, uint32(version))
+	buf.Write(pqKey)
+}
+
+// extractBatchReply has a reply for each round in the range that the
+// server still has keys for, in round order.
+type extractBatchReply struct {
+	Replies []*extractReply
+}
+
+type extractReply struct {
+	Round               uint32
+	Username            string
+	EncryptedPrivateKey []byte
+	Signature           []byte
+	IdentitySig         bls.Signature
+	Curve               string `json:",omitempty"`
+
+	// PreviousSignature is made with the server's previous signing
+	// key while the server is rotating its key.
+	PreviousSignature []byte `json:",omitempty"`
+
+	// SignatureAlgorithm is the scheme of Signature and
+	// PreviousSignature, or empty for Ed25519; see sigscheme.go.
+	SignatureAlgorithm SignatureAlgorithm `json:",omitempty"`
+}
+
+// Replies with a PreviousSignature use version 2 of the binary format,
+// so clients that do not know the field can still decode the others.
+// Replies with a SignatureAlgorithm use version 3, which clients that
+// do not know the scheme could not verify anyway.
+const (
+	extractReplyBinaryVersion         byte = 1
+	extractReplyRotatingBinaryVersion byte = 2
+	extractReplySchemeBinaryVersion   byte = 3
+)
+
+// MarshalBinary encodes the reply in the compact wire format that
+// clients can ask for instead of JSON.
+func (r *extractReply) MarshalBinary() ([]byte, error) {
+	version := extractReplyBinaryVersion
+	if r.SignatureAlgorithm != "" {
+		version = extractReplySchemeBinaryVersion
+	} else if len(r.PreviousSignature) != 0 {
+		version = extractReplyRotatingBinaryVersion
+	}
+	w := wire.NewWriter(version)
+	w.PutUint32(r.Round)
+	w.PutString(r.Username)
+	w.PutBytes(r.EncryptedPrivateKey)
+	w.PutBytes(r.Signature)
+	w.PutBytes(r.IdentitySig)
+	w.PutString(r.Curve)
+	if version >= extractReplyRotatingBinaryVersion {
+		w.PutBytes(r.PreviousSignature)
+	}
+	if version == extractReplySchemeBinaryVersion {
+		w.PutString(string(r.SignatureAlgorithm))
+	}
+	return w.Data(), nil
+}
+
+func (r *extractReply) UnmarshalBinary(data []byte) error {
+	version := extractReplyBinaryVersion
+	if len(data) > 0 && (data[0] == extractReplyRotatingBinaryVersion || data[0] == extractReplySchemeBinaryVersion) {
+		version = data[0]
+	}
+	rd := wire.NewReader(version, data)
+	r.Round = rd.Uint32()
+	r.Username = rd.Text()
+	r.EncryptedPrivateKey = rd.Bytes()
+	r.Signature = rd.Bytes()
+	r.IdentitySig = rd.Bytes()
+	r.Curve = rd.Text()
+	r.PreviousSignature = nil
+	if version >= extractReplyRotatingBinaryVersion {
+		if sig := rd.Bytes(); len(sig) != 0 {
+			r.PreviousSignature = sig
+		}
+	}
+	r.SignatureAlgorithm = ""
+	if version == extractReplySchemeBinaryVersion {
+		r.SignatureAlgorithm = SignatureAlgorithm(rd.Text())
+	}
+	return rd.Err()
+}
+
+func (r *extractReply) Sign(key ed25519.PrivateKey) {
+	r.Signature = ed25519.Sign(key, r.msg())
+}
+
+func (r *extractReply) Verify(key ed25519.PublicKey) bool {
+	return verifySignature(r.SignatureAlgorithm, key, r.msg(), r.Signature)
+}
+
+// VerifyAny reports whether the reply is signed, with either of its
+// signatures, by any of keys.
+func (r *extractReply) VerifyAny(keys []ed25519.PublicKey) bool {
+	scheme, err := LookupSignatureScheme(r.SignatureAlgorithm)
+	if err != nil {
+		return false
+	}
+	msg := r.msg()
+	for _, key := range keys {
+		if scheme.Verify(key, msg, r.Signature) {
+			return true
+		}
+		if len(r.PreviousSignature) != 0 && scheme.Verify(key, msg, r.PreviousSignature) {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *extractReply) msg() []byte {
+	buf := new(bytes.Buffer)
+	buf.WriteString("ExtractReply")
+	binary.Write(buf, binary.BigEndian, r.Round)
+	id := ValidUsernameToIdentity(r.Username)
+	buf.Write(id[:])
+	buf.Write(r.EncryptedPrivateKey)
+	if r.Curve != "" {
+		buf.WriteString(r.Curve)
+	}
+	if r.SignatureAlgorithm != "" {
+		buf.WriteString("SignatureAlgorithm")
+		buf.WriteString(string(r.SignatureAlgorithm))
+	}
+	return buf.Bytes()
+}
+
+// An Attestation attests that UserLongTermKey belongs to UserIdentity.
+// The attestation is signed using the AttestKey from a PKG server.
+type Attestation struct {
+	// AttestKey is included in the attestation message to satisfy the
+	// BLS requirement that messages must be distinct.
+	AttestKey       *bls.PublicKey
+	UserIdentity    *[64]byte
+	UserLongTermKey ed25519.PublicKey
+}
+
+func (a *Attestation) Marshal() []byte {
+	blsKeyBytes, _ := a.AttestKey.MarshalBinary()
+	return AttestationMessage(blsKeyBytes, a.UserIdentity, a.UserLongTermKey)
+}
+
+// AttestationMessage is the message a PKG signs with its BLS attest
+// key during extraction. It is curve-independent so that attestations
+// on any pairing curve can be checked the same way.
+func AttestationMessage(attestKey []byte, userIdentity *[64]byte, userLongTermKey ed25519.PublicKey) []byte {
+	buf := new(bytes.Buffer)
+	buf.Write(attestKey)
+	buf.Write(userIdentity[:])
+	buf.Write([]byte(userLongTermKey))
+	return buf.Bytes()
+}
+
+// AttestationEpochLength is the length of an attestation log epoch.
+// A user's key is logged at most once per epoch.
+const AttestationEpochLength = 24 * time.Hour
+
+// AttestationEpoch returns the epoch containing t.
+func AttestationEpoch(t time.Time) uint32 {
+	return uint32(t.Unix() / int64(AttestationEpochLength/time.Second))
+}
+
+// MaxLogEntriesPerRequest bounds the number of entries returned by
+// one attestation log entries request.
+const MaxLogEntriesPerRequest = 1024
+
+// An AttestationLogEntry records that a PKG attested to a user's
+// long-term key during an epoch. Usernames are hashed so the log
+// does not list them in the clear.
+type AttestationLogEntry struct {
+	UsernameHash [32]byte
+	LongTermKey  ed25519.PublicKey
+	Epoch        uint32
+}
+
+// LogUsernameHash returns the username hash used in log entries.
+func LogUsernameHash(identity *[64]byte) [32]byte {
+	return sha256.Sum256(append([]byte("AttestationLogUsername"), identity[:]...))
+}
+
+const attestationLogEntryBinaryVersion byte = 1
+
+func (e *AttestationLogEntry) size() int {
+	return 1 + 32 + ed25519.PublicKeySize + 4
+}
+
+func (e *AttestationLogEntry) Marshal() []byte {
+	data := make([]byte, 0, e.size())
+	data = append(data, attestationLogEntryBinaryVersion)
+	data = append(data, e.UsernameHash[:]...)
+	data = append(data, e.LongTermKey...)
+	var epoch [4]byte
+	binary.BigEndian.PutUint32(epoch[:], e.Epoch)
+	return append(data, epoch[:]...)
+}
+
+func (e *AttestationLogEntry) Unmarshal(data []byte) error {
+	if len(data) != e.size() {
+		return errors.New("bad data length: got %d, want %d", len(data), e.size())
+	}
+	if data[0] != attestationLogEntryBinaryVersion {
+		return errors.New("unexpected binary version: %v", data[0])
+	}
+	copy(e.UsernameHash[:], data[1:33])
+	e.LongTermKey = append(ed25519.PublicKey(nil), data[33:33+ed25519.PublicKeySize]...)
+	e.Epoch = binary.BigEndian.Uint32(data[33+ed25519.PublicKeySize:])
+	return nil
+}
+
+// LeafHash returns the entry's leaf hash in the log's Merkle tree.
+func (e *AttestationLogEntry) LeafHash() []byte {
+	return translog.LeafHash(e.Marshal())
+}
+
+// A LogHead is a PKG's signed statement of its attestation log's
+// size and root hash at a point in time.
+type LogHead struct {
+	Size     uint64
+	RootHash []byte
+	Time     int64
+
+	// Signature is made with the PKG's signing key.
+	Signature []byte
+}
+
+func (h *LogHead) msg(serverKey ed25519.PublicKey) []byte {
+	return logHeadMsg("AttestationLogHead", serverKey, h)
+}
+
+func logHeadMsg(domain string, serverKey ed25519.PublicKey, h *LogHead) []byte {
+	buf := new(bytes.Buffer)
+	buf.WriteString(domain)
+	buf.Write(serverKey)
+	binary.Write(buf, binary.BigEndian, h.Size)
+	buf.Write(h.RootHash)
+	binary.Write(buf, binary.BigEndian, h.Time)
+	return buf.Bytes()
+}
+
+// Verify checks the head's signature.
+func (h *LogHead) Verify(serverKey ed25519.PublicKey) bool {
+	return len(h.RootHash) == translog.HashSize && ed25519.Verify(serverKey, h.msg(serverKey), h.Signature)
+}
+
+type logInclusionArgs struct {
+	Username    string
+	LongTermKey ed25519.PublicKey
+	Epoch       uint32
+	TreeSize    uint64
+}
+
+type logInclusionReply struct {
+	Index uint64
+	Proof [][]byte
+}
+
+type logConsistencyArgs struct {
+	First  uint64
+	Second uint64
+}
+
+type logConsistencyReply struct {
+	Proof [][]byte
+}
+
+type logEntriesArgs struct {
+	Start uint64
+	Count uint64
+}
+
+type logEntriesReply struct {
+	Entries [][]byte
+}
+
+// A RegistrationLogEntry records that a PKG bound a username to a
+// login key, either when the user registered or rotated their login
+// key or renamed their account. An entry without a login key records
+// that the username was released, when its user deleted or renamed
+// their account. Usernames are hashed with LogUsernameHash.
+type RegistrationLogEntry struct {
+	UsernameHash [32]byte
+	LoginKey     ed25519.PublicKey
+	Time         int64
+}
+
+const registrationLogEntryBinaryVersion byte = 1
+
+func (e *RegistrationLogEntry) Marshal() []byte {
+	data := make([]byte, 0, 1+32+8+len(e.LoginKey))
+	data = append(data, registrationLogEntryBinaryVersion)
+	data = append(data, e.UsernameHash[:]...)
+	var t [8]byte
+	binary.BigEndian.PutUint64(t[:], uint64(e.Time))
+	data = append(data, t[:]...)
+	return append(data, e.LoginKey...)
+}
+
+func (e *RegistrationLogEntry) Unmarshal(data []byte) error {
+	const size = 1 + 32 + 8
+	if len(data) != size && len(data) != size+ed25519.PublicKeySize {
+		return errors.New("bad data length: got %d, want %d or %d", len(data), size, size+ed25519.PublicKeySize)
+	}
+	if data[0] != registrationLogEntryBinaryVersion {
+		return errors.New("unexpected binary version: %v", data[0])
+	}
+	copy(e.UsernameHash[:], data[1:33])
+	e.Time = int64(binary.BigEndian.Uint64(data[33:size]))
+	e.LoginKey = nil
+	if len(data) > size {
+		e.LoginKey = append(ed25519.PublicKey(nil), data[size:]...)
+	}
+	return nil
+}
+
+// LeafHash returns the entry's leaf hash in the log's Merkle tree.
+func (e *RegistrationLogEntry) LeafHash() []byte {
+	return translog.LeafHash(e.Marshal())
+}
+
+// A RegistrationLogHead is a PKG's signed statement of its
+// registration log's size and root hash at a point in time.
+type RegistrationLogHead LogHead
+
+func (h *RegistrationLogHead) msg(serverKey ed25519.PublicKey) []byte {
+	return logHeadMsg("RegistrationLogHead", serverKey, (*LogHead)(h))
+}
+
+// Verify checks the head's signature.
+func (h *RegistrationLogHead) Verify(serverKey ed25519.PublicKey) bool {
+	return len(h.RootHash) == translog.HashSize && ed25519.Verify(serverKey, h.msg(serverKey), h.Signature)
+}
+
+type regLogInclusionArgs struct {
+	Username string
+	TreeSize uint64
+}
+
+// regLogInclusionReply proves that Entry, the latest entry for the
+// username in the tree of the requested size, is in the log.
+type regLogInclusionReply struct {
+	Index uint64
+	Entry []byte
+	Proof [][]byte
+}
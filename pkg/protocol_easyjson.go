@@ -45,6 +45,15 @@ func easyjsonDecodePublicServerConfig22b57fa5(in *jlexer.Lexer, out *PublicServe
 			}
 		case "Address":
 			out.Address = string(in.String())
+		case "ProtocolVersion":
+			out.ProtocolVersion = int(in.Int())
+		case "PreviousKey":
+			if in.IsNull() {
+				in.Skip()
+				out.PreviousKey = nil
+			} else {
+				out.PreviousKey = in.BytesReadable()
+			}
 		default:
 			in.SkipRecursive()
 		}
@@ -71,6 +80,22 @@ func easyjsonEncodePublicServerConfig22b57fa5(out *jwriter.Writer, in PublicServ
 	first = false
 	out.RawString("\"Address\":")
 	out.String(string(in.Address))
+	if in.ProtocolVersion != 0 {
+		if !first {
+			out.RawByte(',')
+		}
+		first = false
+		out.RawString("\"ProtocolVersion\":")
+		out.Int(int(in.ProtocolVersion))
+	}
+	if len(in.PreviousKey) != 0 {
+		if !first {
+			out.RawByte(',')
+		}
+		first = false
+		out.RawString("\"PreviousKey\":")
+		out.Base32Bytes(in.PreviousKey)
+	}
 	out.RawByte('}')
 }
 
@@ -0,0 +1,138 @@
+// Copyright 2018 David Lazar. All rights reserved.
+// Use of this source code is governed by the GNU AGPL
+// license that can be found in the LICENSE file.
+
+//go:build !js
+// +build !js
+
+package pkg
+
+import (
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Requests from users are rate limited twice: by source IP address
+// before the request is decoded, and by username after. The username
+// limit stops an attacker with many addresses from guessing one user's
+// verification codes or flooding their records. Coordinator and
+// registrar requests are not limited.
+
+// A RateLimit is a token bucket: a client may make Burst requests at
+// once, and then Rate requests per second. A zero Rate disables the
+// limit.
+type RateLimit struct {
+	Rate  float64
+	Burst int
+}
+
+type rateLimiter struct {
+	limit RateLimit
+
+	mu        sync.Mutex
+	buckets   map[string]*tokenBucket
+	lastSweep time.Time
+}
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+func newRateLimiter(limit RateLimit) *rateLimiter {
+	if limit.Rate <= 0 {
+		return nil
+	}
+	if limit.Burst < 1 {
+		limit.Burst = 1
+	}
+	return &rateLimiter{
+		limit:   limit,
+		buckets: make(map[string]*tokenBucket),
+	}
+}
+
+// take takes a token from key's bucket. It returns zero if there was
+// one, and otherwise how long until there will be.
+func (l *rateLimiter) take(key string, now time.Time) time.Duration {
+	if l == nil {
+		return 0
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	burst := float64(l.limit.Burst)
+	refill := time.Duration(burst / l.limit.Rate * float64(time.Second))
+
+	// Forget buckets that have filled back up.
+	if now.Sub(l.lastSweep) >= refill {
+		for k, b := range l.buckets {
+			if now.Sub(b.last) >= refill {
+				delete(l.buckets, k)
+			}
+		}
+		l.lastSweep = now
+	}
+
+	b := l.buckets[key]
+	if b == nil {
+		b = &tokenBucket{tokens: burst, last: now}
+		l.buckets[key] = b
+	}
+	if elapsed := now.Sub(b.last); elapsed > 0 {
+		b.tokens = math.Min(burst, b.tokens+elapsed.Seconds()*l.limit.Rate)
+		b.last = now
+	}
+	if b.tokens >= 1 {
+		b.tokens--
+		return 0
+	}
+	return time.Duration((1 - b.tokens) / l.limit.Rate * float64(time.Second))
+}
+
+func remoteIP(req *http.Request) string {
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		return req.RemoteAddr
+	}
+	return host
+}
+
+// rateLimited replies with ErrRateLimited and a Retry-After header if
+// wait is nonzero.
+func rateLimited(w http.ResponseWriter, wait time.Duration) bool {
+	if wait == 0 {
+		return false
+	}
+	secs := int64(math.Ceil(wait.Seconds()))
+	w.Header().Set("Retry-After", strconv.FormatInt(secs, 10))
+	httpError(w, errorf(ErrRateLimited, "retry after %ds", secs))
+	return true
+}
+
+// limitIP applies the per-IP rate limit to req, replying to it and
+// returning false if the client is over the limit.
+func (srv *Server) limitIP(w http.ResponseWriter, req *http.Request) bool {
+	return !rateLimited(w, srv.live().ipLimiter.take(remoteIP(req), srv.clock.Now()))
+}
+
+// limitUsername applies the per-username rate limit, replying to the
+// request and returning false if the username is over the limit. It
+// also records the username for the request log.
+func (srv *Server) limitUsername(w http.ResponseWriter, username string) bool {
+	recordUsername(w, username)
+	limiter := srv.live().usernameLimiter
+	if limiter == nil {
+		return true
+	}
+	id, err := UsernameToIdentity(username)
+	if err != nil {
+		// The handler rejects the username.
+		return true
+	}
+	return !rateLimited(w, limiter.take(string(id[:]), srv.clock.Now()))
+}
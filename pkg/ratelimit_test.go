@@ -0,0 +1,100 @@
+// Copyright 2018 David Lazar. All rights reserved.
+// Use of this source code is governed by the GNU AGPL
+// license that can be found in the LICENSE file.
+
+package pkg
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"vuvuzela.io/alpenhorn/clock"
+	"vuvuzela.io/alpenhorn/pkg/kv"
+)
+
+func TestRateLimiter(t *testing.T) {
+	l := newRateLimiter(RateLimit{Rate: 2, Burst: 3})
+	now := time.Now()
+	for i := 0; i < 3; i++ {
+		if wait := l.take("a", now); wait != 0 {
+			t.Fatalf("request %d: limited for %s within the burst", i, wait)
+		}
+	}
+	if wait := l.take("a", now); wait != 500*time.Millisecond {
+		t.Fatalf("expected to wait 500ms, got %s", wait)
+	}
+	if wait := l.take("b", now); wait != 0 {
+		t.Fatalf("other key limited for %s", wait)
+	}
+	if wait := l.take("a", now.Add(500*time.Millisecond)); wait != 0 {
+		t.Fatalf("limited for %s after refill", wait)
+	}
+
+	// Idle buckets are forgotten once they have refilled.
+	l.take("c", now.Add(10*time.Second))
+	if len(l.buckets) != 1 {
+		t.Fatalf("expected idle buckets to be swept, have %d", len(l.buckets))
+	}
+
+	if newRateLimiter(RateLimit{}).take("a", now) != 0 {
+		t.Fatal("zero limit should be disabled")
+	}
+}
+
+func TestRateLimitHTTP(t *testing.T) {
+	mockClock := clock.NewMock(time.Now())
+	_, serverKey, _ := ed25519.GenerateKey(rand.Reader)
+	srv, err := NewServer(&Config{
+		DB:                kv.NewMemory(),
+		SigningKey:        serverKey,
+		RegTokenHandler:   func(string, string) error { return nil },
+		Clock:             mockClock,
+		IPRateLimit:       RateLimit{Rate: 1, Burst: 2},
+		UsernameRateLimit: RateLimit{Rate: 0.1, Burst: 2},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+
+	do := func(ip string, username string) *httptest.ResponseRecorder {
+		body := strings.NewReader(`{"Username":"` + username + `"}`)
+		req := httptest.NewRequest("POST", "/status", body)
+		req.RemoteAddr = ip + ":1234"
+		w := httptest.NewRecorder()
+		srv.ServeHTTP(w, req)
+		return w
+	}
+
+	do("10.0.0.1", "alice@example.org")
+	do("10.0.0.1", "alice@example.org")
+	w := do("10.0.0.1", "alice@example.org")
+	if w.Code != http.StatusTooManyRequests {
+		t.Fatalf("expected 429 over the IP limit, got %d", w.Code)
+	}
+	if w.Header().Get("Retry-After") != "1" {
+		t.Fatalf("unexpected Retry-After: %q", w.Header().Get("Retry-After"))
+	}
+
+	// The username is over its limit whatever the source address.
+	w = do("10.0.0.2", "alice@example.org")
+	if w.Code != http.StatusTooManyRequests {
+		t.Fatalf("expected 429 over the username limit, got %d", w.Code)
+	}
+	if w.Header().Get("Retry-After") != "10" {
+		t.Fatalf("unexpected Retry-After: %q", w.Header().Get("Retry-After"))
+	}
+	if w = do("10.0.0.2", "bob@example.org"); w.Code == http.StatusTooManyRequests {
+		t.Fatal("other username limited")
+	}
+
+	mockClock.Add(10 * time.Second)
+	if w = do("10.0.0.1", "alice@example.org"); w.Code == http.StatusTooManyRequests {
+		t.Fatal("still limited after the buckets refilled")
+	}
+}
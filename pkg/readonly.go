@@ -0,0 +1,43 @@
+// Copyright 2018 David Lazar. All rights reserved.
+// Use of this source code is governed by the GNU AGPL
+// license that can be found in the LICENSE file.
+
+//go:build !js
+// +build !js
+
+package pkg
+
+import (
+	"net/http"
+)
+
+// In read-only mode, set by Settings.ReadOnly, the server refuses
+// registrations and changes to users' keys with ErrReadOnlyMode, but
+// keeps answering extractions and lookups. Operators can use it while
+// migrating to a new database, or to stop a wave of abusive
+// registrations without cutting off existing users. Unlike maintenance
+// mode (see maintenancemode.go), read-only mode is a setting, so it
+// survives restarts and alpenhorn-pkg applies it on reload.
+
+// readOnlyPaths are the paths the server refuses in read-only mode.
+var readOnlyPaths = map[string]bool{
+	"/register":          true,
+	"/registerchallenge": true,
+	"/rotatelogin":       true,
+	"/setpqkey":          true,
+	"/delete":            true,
+	"/rename":            true,
+	"/setrecoverykey":    true,
+	"/revokelogin":       true,
+	"/devicekey":         true,
+}
+
+// inReadOnlyMode replies with ErrReadOnlyMode and returns true if the
+// server is in read-only mode and refuses req.
+func (srv *Server) inReadOnlyMode(w http.ResponseWriter, req *http.Request) bool {
+	if !readOnlyPaths[req.URL.Path] || !srv.live().readOnly {
+		return false
+	}
+	httpError(w, errorf(ErrReadOnlyMode, ""))
+	return true
+}
@@ -0,0 +1,60 @@
+// Copyright 2018 David Lazar. All rights reserved.
+// Use of this source code is governed by the GNU AGPL
+// license that can be found in the LICENSE file.
+
+package pkg
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"vuvuzela.io/alpenhorn/pkg/kv"
+)
+
+func TestReadOnlyMode(t *testing.T) {
+	_, serverKey, _ := ed25519.GenerateKey(rand.Reader)
+	srv, err := NewServer(&Config{
+		DB:               kv.NewMemory(),
+		SigningKey:       serverKey,
+		RegistrationMode: RegistrationFCFS,
+		ReadOnly:         true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+
+	post := func(path string) ErrorCode {
+		w := httptest.NewRecorder()
+		srv.ServeHTTP(w, httptest.NewRequest("POST", path, bytes.NewReader([]byte("{}"))))
+		var e Error
+		json.Unmarshal(w.Body.Bytes(), &e)
+		if e.Code == ErrReadOnlyMode && w.Code != http.StatusServiceUnavailable {
+			t.Fatalf("%s: unexpected status %d", path, w.Code)
+		}
+		return e.Code
+	}
+
+	for _, path := range []string{"/register", "/rotatelogin", "/setpqkey", "/delete"} {
+		if code := post(path); code != ErrReadOnlyMode {
+			t.Fatalf("%s: expected ErrReadOnlyMode, got %s", path, code)
+		}
+	}
+	for _, path := range []string{"/extract", "/extractbatch", "/status"} {
+		if code := post(path); code == ErrReadOnlyMode {
+			t.Fatalf("%s refused in read-only mode", path)
+		}
+	}
+
+	if err := srv.Reload(&Settings{RegistrationMode: RegistrationFCFS}); err != nil {
+		t.Fatal(err)
+	}
+	if code := post("/register"); code == ErrReadOnlyMode {
+		t.Fatal("register refused after leaving read-only mode")
+	}
+}
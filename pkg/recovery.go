@@ -0,0 +1,232 @@
+// Copyright 2018 David Lazar. All rights reserved.
+// Use of this source code is governed by the GNU AGPL
+// license that can be found in the LICENSE file.
+
+//go:build !js
+// +build !js
+
+package pkg
+
+import (
+	"crypto/ed25519"
+	"encoding/json"
+	"net/http"
+
+	"vuvuzela.io/alpenhorn/errors"
+	"vuvuzela.io/alpenhorn/log"
+	"vuvuzela.io/alpenhorn/pkg/kv"
+)
+
+// A user can register a recovery key, kept offline, to recover from a
+// stolen login key. Revoking the login key with the recovery key stops
+// extractions and every other request under the old key at once, and
+// names the login key that replaces it. The replacement is bound only
+// once the user registers it, verifying their username again as for a
+// new registration, so a stolen recovery key alone cannot take over
+// the account. Until then, the username's registration log entry is
+// removed, so monitors see the revocation, and if the user never
+// verifies, the janitor deletes the registration; see janitor.go.
+
+const recoveryKeyBinaryVersion byte = 1
+
+func marshalRecoveryKey(key ed25519.PublicKey) []byte {
+	return append([]byte{recoveryKeyBinaryVersion}, key...)
+}
+
+func unmarshalRecoveryKey(data []byte) (ed25519.PublicKey, error) {
+	if len(data) != 1+ed25519.PublicKeySize {
+		return nil, errors.New("bad recovery key length: %d", len(data))
+	}
+	if data[0] != recoveryKeyBinaryVersion {
+		return nil, errors.New("unexpected binary version: %v", data[0])
+	}
+	return ed25519.PublicKey(append([]byte(nil), data[1:]...)), nil
+}
+
+func (srv *Server) setRecoveryKeyHandler(w http.ResponseWriter, req *http.Request) {
+	body := http.MaxBytesReader(w, req.Body, 1024)
+	args := new(setRecoveryKeyArgs)
+	err := json.NewDecoder(body).Decode(args)
+	if err != nil {
+		httpError(w, errorf(ErrBadRequestJSON, "%s", err))
+		return
+	}
+	if !srv.limitUsername(w, args.Username) {
+		return
+	}
+	args.ServerSigningKey = srv.publicKey
+
+	logger := srv.log.WithFields(log.Fields{"username": args.Username})
+	err = srv.setRecoveryKey(args)
+	srv.audit(&AuditEvent{
+		Type:     AuditRecoveryKey,
+		Username: args.Username,
+		Key:      KeyFingerprint(args.RecoveryKey),
+		Result:   result(err),
+		RemoteIP: remoteIP(req),
+	})
+	if err != nil {
+		logger = logger.WithFields(log.Fields{"code": errorCode(err).String()})
+		if isInternalError(err) {
+			logger.Errorf("Set recovery key failed: %s", err)
+		} else {
+			logger.Infof("Set recovery key failed: %s", err)
+		}
+		httpError(w, err)
+		return
+	}
+	logger.Info("Set recovery key")
+
+	w.Write([]byte("\"OK\""))
+}
+
+func (srv *Server) setRecoveryKey(args *setRecoveryKeyArgs) error {
+	if len(args.RecoveryKey) != ed25519.PublicKeySize {
+		return errorf(ErrInvalidLoginKey, "recovery key: got %d bytes, want %d bytes", len(args.RecoveryKey), ed25519.PublicKeySize)
+	}
+	now := srv.clock.Now()
+	if err := checkFresh(args.Time, now); err != nil {
+		return err
+	}
+
+	tx, err := srv.db.NewTransaction(true)
+	if err != nil {
+		return errorf(ErrDatabaseError, "%s", err)
+	}
+	defer tx.Discard()
+
+	user, id, err := srv.getUser(tx, args.Username)
+	if err != nil {
+		return err
+	}
+	if !srv.verifyBound(&args.ServerSigningKey, func() bool {
+		return ed25519.Verify(user.LoginKey, args.msg(), args.Signature)
+	}) {
+		return errorf(ErrInvalidSignature, "")
+	}
+	if !ed25519.Verify(args.RecoveryKey, args.msg(), args.RecoverySignature) {
+		return errorf(ErrInvalidSignature, "recovery key")
+	}
+	if err := checkReplay(tx, "setrecoverykey", args.Signature, now); err != nil {
+		return err
+	}
+
+	if err := tx.Set(dbUserKey(id, recoveryKeySuffix), marshalRecoveryKey(args.RecoveryKey)); err != nil {
+		return errorf(ErrDatabaseError, "%s", err)
+	}
+	if err := tx.Commit(); err != nil {
+		return errorf(ErrDatabaseError, "%s", err)
+	}
+	return nil
+}
+
+func (srv *Server) revokeLoginHandler(w http.ResponseWriter, req *http.Request) {
+	body := http.MaxBytesReader(w, req.Body, 1024)
+	args := new(revokeLoginArgs)
+	err := json.NewDecoder(body).Decode(args)
+	if err != nil {
+		httpError(w, errorf(ErrBadRequestJSON, "%s", err))
+		return
+	}
+	if !srv.limitUsername(w, args.Username) {
+		return
+	}
+	args.ServerSigningKey = srv.publicKey
+
+	logger := srv.log.WithFields(log.Fields{"username": args.Username})
+	err = srv.revokeLogin(args)
+	srv.audit(&AuditEvent{
+		Type:     AuditRevoke,
+		Username: args.Username,
+		Key:      KeyFingerprint(args.NewLoginKey),
+		Result:   result(err),
+		RemoteIP: remoteIP(req),
+	})
+	if err != nil {
+		logger = logger.WithFields(log.Fields{"code": errorCode(err).String()})
+		if isInternalError(err) {
+			logger.Errorf("Login key revocation failed: %s", err)
+		} else {
+			logger.Infof("Login key revocation failed: %s", err)
+		}
+		httpError(w, err)
+		return
+	}
+	logger.Info("Revoked login key")
+
+	w.Write([]byte("\"OK\""))
+}
+
+func (srv *Server) revokeLogin(args *revokeLoginArgs) error {
+	if len(args.NewLoginKey) != ed25519.PublicKeySize {
+		return errorf(ErrInvalidLoginKey, "got %d bytes, want %d bytes", len(args.NewLoginKey), ed25519.PublicKeySize)
+	}
+	now := srv.clock.Now()
+	if err := checkFresh(args.Time, now); err != nil {
+		return err
+	}
+
+	srv.regLogMu.Lock()
+	defer srv.regLogMu.Unlock()
+	tx, err := srv.db.NewTransaction(true)
+	if err != nil {
+		return errorf(ErrDatabaseError, "%s", err)
+	}
+	defer tx.Discard()
+
+	// A user can revoke again before registering the new login key,
+	// such as to replace a lost one.
+	user, id, err := srv.getUser(tx, args.Username)
+	if err != nil && errorCode(err) != ErrLoginKeyRevoked {
+		return err
+	}
+	data, err := tx.Get(dbUserKey(id, recoveryKeySuffix))
+	if err == kv.ErrNotFound {
+		return errorf(ErrNoRecoveryKey, "%q", args.Username)
+	} else if err != nil {
+		return errorf(ErrDatabaseError, "%s", err)
+	}
+	recoveryKey, err := unmarshalRecoveryKey(data)
+	if err != nil {
+		return errorf(ErrDatabaseError, "%s", err)
+	}
+	if !srv.verifyBound(&args.ServerSigningKey, func() bool {
+		return ed25519.Verify(recoveryKey, args.msg(), args.Signature)
+	}) {
+		return errorf(ErrInvalidSignature, "")
+	}
+	if err := checkReplay(tx, "revokelogin", args.Signature, now); err != nil {
+		return err
+	}
+
+	// Records set with the old login key go with it.
+	for _, suffix := range [][]byte{pqKeySuffix, loginRotationSuffix} {
+		if err := tx.Delete(dbUserKey(id, suffix)); err != nil {
+			return errorf(ErrDatabaseError, "%s", err)
+		}
+	}
+	revoked := userState{
+		LoginKey: args.NewLoginKey,
+		Revoked:  true,
+	}
+	if err := tx.Set(dbUserKey(id, registrationSuffix), revoked.Marshal()); err != nil {
+		return errorf(ErrDatabaseError, "%s", err)
+	}
+	if !user.Revoked {
+		err := appendLog(tx, id, UserEvent{
+			Time:     now,
+			Type:     EventLoginKeyRevoked,
+			LoginKey: user.LoginKey,
+		})
+		if err != nil {
+			return err
+		}
+		if err := srv.logRegistration(tx, id, nil); err != nil {
+			return err
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return errorf(ErrDatabaseError, "%s", err)
+	}
+	return nil
+}
@@ -0,0 +1,92 @@
+// Copyright 2018 David Lazar. All rights reserved.
+// Use of this source code is governed by the GNU AGPL
+// license that can be found in the LICENSE file.
+
+package pkg_test
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"testing"
+
+	"vuvuzela.io/alpenhorn/edhttp"
+	"vuvuzela.io/alpenhorn/pkg"
+)
+
+func TestRevokeLoginKey(t *testing.T) {
+	testpkg, _ := launchPKG(t, func(username string, token string) error {
+		if token == "valid token" {
+			return nil
+		}
+		return pkg.Error{Code: pkg.ErrInvalidToken}
+	})
+	defer testpkg.Close()
+
+	alicePub, oldKey, _ := ed25519.GenerateKey(rand.Reader)
+	_, recoveryKey, _ := ed25519.GenerateKey(rand.Reader)
+	_, newKey, _ := ed25519.GenerateKey(rand.Reader)
+	client := &pkg.Client{
+		Username:        "alice@example.org",
+		LoginKey:        oldKey,
+		UserLongTermKey: alicePub,
+		HTTPClient:      new(edhttp.Client),
+	}
+	server := testpkg.PublicServerConfig
+	if err := client.Register(server, "valid token"); err != nil {
+		t.Fatal(err)
+	}
+
+	err := client.RevokeLoginKey(server, recoveryKey, newKey)
+	if err.(pkg.Error).Code != pkg.ErrNoRecoveryKey {
+		t.Fatalf("expected ErrNoRecoveryKey, got %v", err)
+	}
+	if err := client.SetRecoveryKey(server, recoveryKey); err != nil {
+		t.Fatal(err)
+	}
+
+	// Only the recovery key can revoke the login key.
+	_, mallory, _ := ed25519.GenerateKey(rand.Reader)
+	err = client.RevokeLoginKey(server, mallory, newKey)
+	if err.(pkg.Error).Code != pkg.ErrInvalidSignature {
+		t.Fatalf("expected ErrInvalidSignature, got %v", err)
+	}
+
+	if err := client.RevokeLoginKey(server, recoveryKey, newKey); err != nil {
+		t.Fatal(err)
+	}
+	err = client.CheckStatus(server)
+	if err.(pkg.Error).Code != pkg.ErrLoginKeyRevoked {
+		t.Fatalf("expected ErrLoginKeyRevoked for the old key, got %v", err)
+	}
+
+	// The new key is bound only after the username is verified again.
+	client.LoginKey = newKey
+	err = client.CheckStatus(server)
+	if err.(pkg.Error).Code != pkg.ErrLoginKeyRevoked {
+		t.Fatalf("expected ErrLoginKeyRevoked before verification, got %v", err)
+	}
+	err = client.Register(server, "wrong token")
+	if err.(pkg.Error).Code != pkg.ErrInvalidToken {
+		t.Fatalf("expected ErrInvalidToken, got %v", err)
+	}
+	if err := client.Register(server, "valid token"); err != nil {
+		t.Fatal(err)
+	}
+	if err := client.CheckStatus(server); err != nil {
+		t.Fatal(err)
+	}
+
+	// The recovery key survives, so it can be used again.
+	_, newerKey, _ := ed25519.GenerateKey(rand.Reader)
+	if err := client.RevokeLoginKey(server, recoveryKey, newerKey); err != nil {
+		t.Fatal(err)
+	}
+
+	log, err := testpkg.PKGServer.GetUserLog(pkg.ValidUsernameToIdentity("alice@example.org"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(log) != 4 || log[1].Type != pkg.EventLoginKeyRevoked || log[2].Type != pkg.EventLoginKeyChanged {
+		t.Fatalf("unexpected user log: %#v", log)
+	}
+}
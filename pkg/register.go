@@ -2,42 +2,83 @@
 // Use of this source code is governed by the GNU AGPL
 // license that can be found in the LICENSE file.
 
+//go:build !js
+// +build !js
+
 package pkg
 
 import (
 	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
 	"encoding/json"
 	"net/http"
-	"net/url"
 	"time"
 
 	"github.com/davidlazar/go-crypto/encoding/base32"
-	"github.com/dgraph-io/badger"
 
+	"vuvuzela.io/alpenhorn/internal/fault"
+	"vuvuzela.io/alpenhorn/internal/keysafe"
 	"vuvuzela.io/alpenhorn/log"
+	"vuvuzela.io/alpenhorn/pkg/kv"
 )
 
-type registerArgs struct {
-	Username string
+// Register replies are the same whether the username is new, already
+// registered under another login key, or banned, so probing the
+// register endpoint does not reveal who uses the service. In the
+// last two cases the server pretends to succeed and records the
+// attempt, which costs a database commit just like a registration.
+// The client learns the real outcome from its next signed request:
+// pkg.Client.Register checks its status after registering.
+//
+// Only re-registering with the login key the username is already
+// registered under is reported as ErrAlreadyRegistered, since that
+// tells the caller nothing it did not already know.
+
+var dbRegisterAttemptPrefix = []byte("regattempt:")
 
-	// LoginKey is how clients authenticate to the PKG server.
-	LoginKey ed25519.PublicKey
+// dbRegTokenPrefix keys the serials of the registration tokens that
+// have been spent; see regtoken.go.
+var dbRegTokenPrefix = []byte("regtoken:")
 
-	// RegistrationToken can be used to authenticate registrations.
-	RegistrationToken string
+func regTokenKey(serial []byte) []byte {
+	h := sha256.Sum256(serial)
+	return append(append([]byte(nil), dbRegTokenPrefix...), h[:]...)
 }
 
 func (srv *Server) registerHandler(w http.ResponseWriter, req *http.Request) {
-	body := http.MaxBytesReader(w, req.Body, 256)
+	// CAPTCHA tokens can be a few kilobytes.
+	body := http.MaxBytesReader(w, req.Body, 8192)
 	args := new(registerArgs)
 	err := json.NewDecoder(body).Decode(args)
 	if err != nil {
 		httpError(w, errorf(ErrBadRequestJSON, "%s", err))
 		return
 	}
+	if !srv.limitUsername(w, args.Username) {
+		return
+	}
+
+	args.RemoteIP = remoteIP(req)
 
 	logger := srv.log.WithFields(log.Fields{"username": args.Username, "loginKey": base32.EncodeToString(args.LoginKey)})
-	err = srv.register(args)
+	accepted, err := srv.register(args)
+	srv.audit(&AuditEvent{
+		Type:     AuditRegister,
+		Username: args.Username,
+		Key:      KeyFingerprint(args.LoginKey),
+		Result:   result(err),
+		RemoteIP: args.RemoteIP,
+	})
+	switch {
+	case err != nil:
+		srv.metrics.registrations.Inc(errorCode(err).String())
+	case accepted:
+		srv.metrics.registrations.Inc("accepted")
+	default:
+		srv.metrics.registrations.Inc("ignored")
+	}
 	if err != nil {
 		logger = logger.WithFields(log.Fields{"code": errorCode(err).String()})
 		if isInternalError(err) {
@@ -49,36 +90,153 @@ func (srv *Server) registerHandler(w http.ResponseWriter, req *http.Request) {
 		httpError(w, err)
 		return
 	}
-	logger.Info("Registration successful")
+	if accepted {
+		logger.Info("Registration successful")
+		srv.notify(&WebhookEvent{
+			Type:     WebhookRegister,
+			Username: args.Username,
+			RemoteIP: args.RemoteIP,
+		})
+	} else {
+		logger.Info("Registration ignored: username taken or banned")
+	}
 
 	// reply with valid json
 	w.Write([]byte("\"OK\""))
 }
 
-func (srv *Server) register(args *registerArgs) error {
-	id, err := UsernameToIdentity(args.Username)
+// register registers the username, reporting whether the registration
+// was accepted. A nil error with accepted false must look like success
+// to the client.
+func (srv *Server) register(args *registerArgs) (accepted bool, err error) {
+	live := srv.live()
+	if live.closed() {
+		return false, errorf(ErrRegistrationClosed, "")
+	}
+	id, err := srv.checkUsername(args.Username)
 	if err != nil {
-		return errorf(ErrInvalidUsername, "%s", err)
+		return false, err
 	}
 	if len(args.LoginKey) != ed25519.PublicKeySize {
-		return errorf(ErrInvalidLoginKey, "got %d bytes, want %d bytes", len(args.LoginKey), ed25519.PublicKeySize)
+		return false, errorf(ErrInvalidLoginKey, "got %d bytes, want %d bytes", len(args.LoginKey), ed25519.PublicKeySize)
+	}
+	if err := srv.checkBlocklist(args.Username); err != nil {
+		return false, err
+	}
+	reserved, err := srv.checkReserved(live, id, args)
+	if err != nil {
+		return false, err
 	}
 
-	err = srv.regTokenHandler(args.Username, args.RegistrationToken)
+	if err := srv.checkRegisterWork(id, args); err != nil {
+		return false, err
+	}
+	if err := srv.checkCaptcha(args); err != nil {
+		return false, err
+	}
+	var tokenSerial []byte
+	if live.mode == RegistrationToken {
+		tokenSerial, err = parseRegistrationToken(live.tokenKey, args.RegistrationToken)
+		if err != nil {
+			return false, err
+		}
+	}
+
+	err = live.verifier.Verify(live.verifierStore, args.Username, args.RegistrationToken)
+	srv.metrics.verifications.Inc(live.verifier.Name(), result(err))
+	srv.audit(&AuditEvent{
+		Type:     AuditVerify,
+		Username: args.Username,
+		Key:      KeyFingerprint(args.LoginKey),
+		Detail:   live.verifier.Name(),
+		Result:   result(err),
+	})
 	if err != nil {
-		return err
+		return false, err
+	}
+	if _, ok := live.verifier.(acceptAll); !ok {
+		srv.notify(&WebhookEvent{
+			Type:     WebhookVerify,
+			Username: args.Username,
+			Detail:   live.verifier.Name(),
+			RemoteIP: args.RemoteIP,
+		})
+	}
+
+	if err := fault.Inject(fault.PKGDB); err != nil {
+		return false, errorf(ErrDatabaseError, "%s", err)
 	}
 
-	tx := srv.db.NewTransaction(true)
+	srv.regLogMu.Lock()
+	defer srv.regLogMu.Unlock()
+	tx, err := srv.db.NewTransaction(true)
+	if err != nil {
+		return false, errorf(ErrDatabaseError, "%s", err)
+	}
 	defer tx.Discard()
 
+	banned := srv.isBanned != nil && srv.isBanned(args.Username)
+	quota, err := srv.checkDomainQuota(tx, args.Username)
+	if err != nil {
+		return false, err
+	}
+
 	key := dbUserKey(id, registrationSuffix)
-	_, err = tx.Get(key)
-	if err != nil && err != badger.ErrKeyNotFound {
-		return errorf(ErrDatabaseError, "%s", err)
+	data, err := tx.Get(key)
+	if err != nil && err != kv.ErrNotFound {
+		return false, errorf(ErrDatabaseError, "%s", err)
 	}
 	if err == nil {
-		return errorf(ErrAlreadyRegistered, "%q", args.Username)
+		var user userState
+		if err := user.Unmarshal(data); err != nil {
+			return false, errorf(ErrDatabaseError, "%s", err)
+		}
+		if user.Revoked && !banned && keysafe.Equal(user.LoginKey, args.LoginKey) {
+			// The user verified their username again after
+			// revoking their login key; see recovery.go.
+			if err := srv.setLoginKey(tx, id, userState{}, args.LoginKey); err != nil {
+				return false, err
+			}
+			if err := tx.Commit(); err != nil {
+				return false, errorf(ErrDatabaseError, "%s", err)
+			}
+			return true, nil
+		}
+		if keysafe.Equal(user.LoginKey, args.LoginKey) {
+			return false, errorf(ErrAlreadyRegistered, "%q", args.Username)
+		}
+		return false, srv.recordRegisterAttempt(tx, id, args.LoginKey)
+	}
+	if banned {
+		return false, srv.recordRegisterAttempt(tx, id, args.LoginKey)
+	}
+	if _, err := tx.Get(dbUserKey(id, renamedSuffix)); err == nil {
+		// The username is held after a rename.
+		return false, srv.recordRegisterAttempt(tx, id, args.LoginKey)
+	} else if err != kv.ErrNotFound {
+		return false, errorf(ErrDatabaseError, "%s", err)
+	}
+
+	if err := quota.use(tx); err != nil {
+		return false, err
+	}
+	if reserved {
+		if err := srv.spendReservedOverride(tx, id, args.OverrideToken); err != nil {
+			return false, err
+		}
+	}
+	if tokenSerial != nil {
+		// The token is spent with the registration, so it is not
+		// lost if the registration fails.
+		tokenKey := regTokenKey(tokenSerial)
+		if _, err := tx.Get(tokenKey); err == nil {
+			return false, errorf(ErrInvalidToken, "token already used")
+		} else if err != kv.ErrNotFound {
+			return false, errorf(ErrDatabaseError, "%s", err)
+		}
+		if err := tx.Set(tokenKey, appendUint64(nil, uint64(srv.clock.Now().Unix()))); err != nil {
+			return false, errorf(ErrDatabaseError, "%s", err)
+		}
 	}
 
 	newUser := userState{
@@ -87,40 +245,131 @@ func (srv *Server) register(args *registerArgs) error {
 
 	err = tx.Set(key, newUser.Marshal())
 	if err != nil {
-		return errorf(ErrDatabaseError, "%s", err)
+		return false, errorf(ErrDatabaseError, "%s", err)
 	}
 
 	err = appendLog(tx, id, UserEvent{
-		Time:     time.Now(),
+		Time:     srv.clock.Now(),
 		Type:     EventRegistered,
 		LoginKey: args.LoginKey,
 	})
 	if err != nil {
-		return err
+		return false, err
+	}
+	if err := srv.logRegistration(tx, id, args.LoginKey); err != nil {
+		return false, err
 	}
 
 	err = tx.Commit()
 	if err != nil {
+		return false, errorf(ErrDatabaseError, "%s", err)
+	}
+
+	return true, nil
+}
+
+// recordRegisterAttempt commits a short-lived record of a registration
+// that was ignored, so that it takes as long as a real one.
+func (srv *Server) recordRegisterAttempt(tx kv.Txn, id *[64]byte, loginKey ed25519.PublicKey) error {
+	h := sha256.New()
+	h.Write(id[:])
+	h.Write(loginKey)
+	key := append(append([]byte(nil), dbRegisterAttemptPrefix...), h.Sum(nil)...)
+
+	val := make([]byte, 8)
+	binary.BigEndian.PutUint64(val, uint64(srv.clock.Now().Unix()))
+	if err := tx.SetWithTTL(key, val, ReplayWindow); err != nil {
+		return errorf(ErrDatabaseError, "%s", err)
+	}
+	if err := tx.Commit(); err != nil {
 		return errorf(ErrDatabaseError, "%s", err)
 	}
+	return nil
+}
+
+// registerChallengeTTL is how long a registration challenge is valid.
+const registerChallengeTTL = 10 * time.Minute
 
+func (srv *Server) registerChallengeHandler(w http.ResponseWriter, req *http.Request) {
+	body := http.MaxBytesReader(w, req.Body, 256)
+	args := new(registerChallengeArgs)
+	err := json.NewDecoder(body).Decode(args)
+	if err != nil {
+		httpError(w, errorf(ErrBadRequestJSON, "%s", err))
+		return
+	}
+	if !srv.limitUsername(w, args.Username) {
+		return
+	}
+	if srv.live().closed() {
+		httpError(w, errorf(ErrRegistrationClosed, ""))
+		return
+	}
+	id, err := srv.checkUsername(args.Username)
+	if err != nil {
+		httpError(w, err)
+		return
+	}
+
+	expires := srv.clock.Now().Add(registerChallengeTTL)
+	reply := &registerChallengeReply{
+		Challenge: srv.registerChallenge(id, expires),
+		WorkBits:  srv.registerWorkBits,
+	}
+	data, err := json.Marshal(reply)
+	if err != nil {
+		panic(err)
+	}
+	w.Write(data)
+}
+
+// registerChallenge returns a challenge for registering id. The
+// challenge is its expiry time and a MAC on it, so the server does not
+// need to remember the challenges it hands out.
+func (srv *Server) registerChallenge(id *[64]byte, expires time.Time) []byte {
+	challenge := make([]byte, 8, 8+registerChallengeMACSize)
+	binary.BigEndian.PutUint64(challenge, uint64(expires.Unix()))
+	mac := hmac.New(sha256.New, srv.challengeKey)
+	mac.Write([]byte("RegisterChallenge"))
+	mac.Write(challenge)
+	mac.Write(id[:])
+	return mac.Sum(challenge)[:8+registerChallengeMACSize]
+}
+
+const registerChallengeMACSize = 16
+
+func (srv *Server) checkRegisterWork(id *[64]byte, args *registerArgs) error {
+	if srv.registerWorkBits <= 0 {
+		return nil
+	}
+	work := args.Work
+	if work == nil || len(work.Challenge) != 8+registerChallengeMACSize {
+		return errorf(ErrWorkRequired, "%d", srv.registerWorkBits)
+	}
+	expires := time.Unix(int64(binary.BigEndian.Uint64(work.Challenge[:8])), 0)
+	if !hmac.Equal(work.Challenge, srv.registerChallenge(id, expires)) {
+		return errorf(ErrWorkRequired, "%d", srv.registerWorkBits)
+	}
+	if !srv.clock.Now().Before(expires) {
+		return errorf(ErrStaleRequest, "registration challenge expired")
+	}
+	if leadingZeros(registerWorkHash(srv.publicKey, args.LoginKey, work)) < srv.registerWorkBits {
+		return errorf(ErrWorkRequired, "%d", srv.registerWorkBits)
+	}
 	return nil
 }
 
-func ExternalVerifier(verifyURL string) RegTokenHandler {
-	return func(username string, token string) error {
-		vals := url.Values{
-			"username": []string{username},
-			"token":    []string{token},
-		}
-		resp, err := http.PostForm(verifyURL, vals)
-		if err != nil {
-			return err
-		}
-		defer resp.Body.Close()
-		if resp.StatusCode == http.StatusOK {
-			return nil
-		}
-		return errorf(ErrInvalidToken, "")
+// checkUsername converts a new username to an identity, checking it
+// against the server's username policy.
+func (srv *Server) checkUsername(username string) (*[64]byte, error) {
+	if err := ValidateUsername(username); err != nil {
+		return nil, errorf(ErrInvalidUsername, "%s", err)
+	}
+	if canon := srv.usernamePolicy.Normalize(username); canon != username {
+		return nil, errorf(ErrInvalidUsername, "%q is not in canonical form; use %q", username, canon)
+	}
+	if err := srv.usernamePolicy.Validate(username); err != nil {
+		return nil, errorf(ErrInvalidUsername, "%s", err)
 	}
+	return ValidUsernameToIdentity(username), nil
 }
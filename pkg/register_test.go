@@ -7,12 +7,18 @@ package pkg
 import (
 	"crypto/ed25519"
 	"crypto/rand"
+	"encoding/json"
 	"fmt"
 	"io/ioutil"
+	"net/http/httptest"
 	"os"
+	"strings"
 	"testing"
+	"time"
 
+	"vuvuzela.io/alpenhorn/clock"
 	"vuvuzela.io/alpenhorn/log"
+	"vuvuzela.io/alpenhorn/pkg/kv"
 )
 
 func BenchmarkRegister(b *testing.B) {
@@ -46,9 +52,174 @@ func BenchmarkRegister(b *testing.B) {
 			Username: fmt.Sprintf("%dbenchmark", i),
 			LoginKey: userPub,
 		}
-		err = srv.register(args)
+		_, err = srv.register(args)
 		if err != nil {
 			b.Fatal(err)
 		}
 	}
 }
+
+func TestRegisterUniform(t *testing.T) {
+	_, serverPriv, _ := ed25519.GenerateKey(rand.Reader)
+	conf := &Config{
+		DBPath: t.TempDir(),
+		Logger: &log.Logger{
+			Level:        log.ErrorLevel,
+			EntryHandler: &log.OutputText{Out: log.Stderr},
+		},
+		SigningKey:      serverPriv,
+		RegTokenHandler: func(string, string) error { return nil },
+		IsBanned: func(username string) bool {
+			return username == "mallory@example.org"
+		},
+	}
+	srv, err := NewServer(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+
+	alice, _, _ := ed25519.GenerateKey(rand.Reader)
+	other, _, _ := ed25519.GenerateKey(rand.Reader)
+
+	tests := []struct {
+		username string
+		key      ed25519.PublicKey
+		accepted bool
+		code     ErrorCode
+	}{
+		{"alice@example.org", alice, true, 0},
+		{"alice@example.org", other, false, 0},
+		{"mallory@example.org", other, false, 0},
+		{"alice@example.org", alice, false, ErrAlreadyRegistered},
+	}
+	for i, tt := range tests {
+		accepted, err := srv.register(&registerArgs{Username: tt.username, LoginKey: tt.key})
+		var code ErrorCode
+		if err != nil {
+			code = errorCode(err)
+		}
+		if accepted != tt.accepted || code != tt.code {
+			t.Fatalf("case %d: got accepted=%v err=%v", i, accepted, err)
+		}
+	}
+
+	user, _, err := srv.getUser(nil, "alice@example.org")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !user.LoginKey.Equal(alice) {
+		t.Fatal("registration under another key replaced the login key")
+	}
+	if _, _, err := srv.getUser(nil, "mallory@example.org"); errorCode(err) != ErrNotRegistered {
+		t.Fatalf("banned username was registered: %v", err)
+	}
+}
+
+func TestRegisterWork(t *testing.T) {
+	mockClock := clock.NewMock(time.Now())
+	_, serverPriv, _ := ed25519.GenerateKey(rand.Reader)
+	srv, err := NewServer(&Config{
+		DB:               kv.NewMemory(),
+		SigningKey:       serverPriv,
+		RegTokenHandler:  func(string, string) error { return nil },
+		RegisterWorkBits: 8,
+		Clock:            mockClock,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+
+	challenge := func(username string) *registerChallengeReply {
+		req := httptest.NewRequest("POST", "/registerchallenge", strings.NewReader(`{"Username":"`+username+`"}`))
+		w := httptest.NewRecorder()
+		srv.ServeHTTP(w, req)
+		reply := new(registerChallengeReply)
+		if err := json.Unmarshal(w.Body.Bytes(), reply); err != nil {
+			t.Fatal(err)
+		}
+		return reply
+	}
+
+	loginKey, _, _ := ed25519.GenerateKey(rand.Reader)
+	args := &registerArgs{Username: "alice@example.org", LoginKey: loginKey}
+	if _, err := srv.register(args); requiredWork(err) != 8 {
+		t.Fatalf("expected ErrWorkRequired for 8 bits, got %v", err)
+	}
+
+	// A challenge is bound to its username.
+	bobChallenge := challenge("bob@example.org")
+	args.Work = solveRegisterWork(srv.publicKey, loginKey, bobChallenge.Challenge, bobChallenge.WorkBits)
+	if _, err := srv.register(args); requiredWork(err) != 8 {
+		t.Fatalf("expected ErrWorkRequired for another username's challenge, got %v", err)
+	}
+
+	reply := challenge("alice@example.org")
+	if reply.WorkBits != 8 {
+		t.Fatalf("unexpected work bits: %d", reply.WorkBits)
+	}
+	args.Work = solveRegisterWork(srv.publicKey, loginKey, reply.Challenge, reply.WorkBits)
+
+	mockClock.Add(registerChallengeTTL)
+	if _, err := srv.register(args); errorCode(err) != ErrStaleRequest {
+		t.Fatalf("expected ErrStaleRequest for an expired challenge, got %v", err)
+	}
+
+	reply = challenge("alice@example.org")
+	args.Work = solveRegisterWork(srv.publicKey, loginKey, reply.Challenge, reply.WorkBits)
+	if accepted, err := srv.register(args); !accepted || err != nil {
+		t.Fatalf("registration with work: accepted=%v err=%v", accepted, err)
+	}
+}
+
+func TestRegistrationMode(t *testing.T) {
+	_, serverPriv, _ := ed25519.GenerateKey(rand.Reader)
+	db := kv.NewMemory()
+	newServer := func(mode RegistrationMode, handler RegTokenHandler) (*Server, error) {
+		return NewServer(&Config{
+			DB:               db,
+			SigningKey:       serverPriv,
+			RegistrationMode: mode,
+			RegTokenHandler:  handler,
+		})
+	}
+
+	accept := func(string, string) error { return nil }
+	if _, err := newServer(RegistrationFCFS, accept); err == nil {
+		t.Fatal("expected error for a verifier in fcfs mode")
+	}
+	if _, err := newServer(RegistrationEmail, nil); err == nil {
+		t.Fatal("expected error for email mode without a verifier")
+	}
+	if _, err := newServer("invite", nil); err == nil {
+		t.Fatal("expected error for an unknown mode")
+	}
+
+	fcfs, err := newServer(RegistrationFCFS, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	loginPub, loginPriv, _ := ed25519.GenerateKey(rand.Reader)
+	if _, err := fcfs.register(&registerArgs{Username: "alice@example.org", LoginKey: loginPub}); err != nil {
+		t.Fatal(err)
+	}
+
+	closed, err := newServer(RegistrationClosed, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer closed.Close()
+
+	bobPub, _, _ := ed25519.GenerateKey(rand.Reader)
+	if _, err := closed.register(&registerArgs{Username: "bob@example.org", LoginKey: bobPub}); errorCode(err) != ErrRegistrationClosed {
+		t.Fatalf("expected ErrRegistrationClosed, got %v", err)
+	}
+
+	// Registered users are still served.
+	args := &statusArgs{Username: "alice@example.org", ServerSigningKey: closed.publicKey}
+	args.Signature = ed25519.Sign(loginPriv, args.msg())
+	if _, err := closed.checkStatus(args); err != nil {
+		t.Fatal(err)
+	}
+}
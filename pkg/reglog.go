@@ -0,0 +1,155 @@
+// Copyright 2018 David Lazar. All rights reserved.
+// Use of this source code is governed by the GNU AGPL
+// license that can be found in the LICENSE file.
+
+//go:build !js
+// +build !js
+
+package pkg
+
+import (
+	"crypto/ed25519"
+	"encoding/json"
+	"net/http"
+
+	"vuvuzela.io/alpenhorn/pkg/kv"
+)
+
+// The registration log is a Merkle tree like the attestation log, with
+// an entry for every change to the login key a username is bound to.
+// Whoever holds the login key can extract the user's keys, so a PKG
+// that quietly binds a user's username to someone else's login key
+// hands them the account. With the log, the PKG must either log the
+// new binding, where the user's client finds it, or show clients
+// inconsistent tree heads.
+//
+// The entry is appended in the same transaction as the change, and
+// those transactions hold srv.regLogMu so they do not conflict.
+
+var (
+	regLog           = newMerkleLog("reglog:")
+	regLogUserPrefix = []byte("reglog:user:")
+)
+
+// regLogUserKey indexes the log entries for a username.
+func regLogUserKey(usernameHash [32]byte, index uint64) []byte {
+	key := append(append([]byte(nil), regLogUserPrefix...), usernameHash[:]...)
+	return appendUint64(key, index)
+}
+
+// logRegistration appends an entry binding the identity to loginKey,
+// or releasing it if loginKey is nil. The caller must hold
+// srv.regLogMu until tx is committed or discarded.
+func (srv *Server) logRegistration(tx kv.Txn, id *[64]byte, loginKey ed25519.PublicKey) error {
+	entry := &RegistrationLogEntry{
+		UsernameHash: LogUsernameHash(id),
+		LoginKey:     loginKey,
+		Time:         srv.clock.Now().Unix(),
+	}
+	index, err := regLog.append(tx, entry.Marshal())
+	if err != nil {
+		return errorf(ErrDatabaseError, "registration log: %s", err)
+	}
+	if err := tx.Set(regLogUserKey(entry.UsernameHash, index), []byte{}); err != nil {
+		return errorf(ErrDatabaseError, "registration log: %s", err)
+	}
+	return nil
+}
+
+// RegistrationLogHead returns a signed head for the current
+// registration log.
+func (srv *Server) RegistrationLogHead() (*RegistrationLogHead, error) {
+	head := new(RegistrationLogHead)
+	err := srv.db.View(func(tx kv.Txn) error {
+		var err error
+		head.Size, head.RootHash, err = regLog.head(tx)
+		return err
+	})
+	if err != nil {
+		return nil, errorf(ErrDatabaseError, "%s", err)
+	}
+	head.Time = srv.clock.Now().Unix()
+	head.Signature, err = srv.sign(head.msg(srv.publicKey))
+	if err != nil {
+		return nil, err
+	}
+	return head, nil
+}
+
+func (srv *Server) regLogInclusion(args *regLogInclusionArgs) (*regLogInclusionReply, error) {
+	id, err := UsernameToIdentity(args.Username)
+	if err != nil {
+		return nil, errorf(ErrInvalidUsername, "%s", err)
+	}
+	usernameHash := LogUsernameHash(id)
+	userPrefix := append(append([]byte(nil), regLogUserPrefix...), usernameHash[:]...)
+
+	reply := new(regLogInclusionReply)
+	err = srv.db.View(func(tx kv.Txn) error {
+		found := false
+		err := tx.Iterate(userPrefix, func(key, _ []byte) error {
+			index, err := decodeIndex(key[len(userPrefix):])
+			if err != nil {
+				return err
+			}
+			if index < args.TreeSize {
+				reply.Index = index
+				found = true
+			}
+			return nil
+		})
+		if err != nil {
+			return errorf(ErrDatabaseError, "%s", err)
+		}
+		if !found {
+			return errorf(ErrNotInLog, "%q in tree size %d", args.Username, args.TreeSize)
+		}
+
+		reply.Proof, err = regLog.inclusion(tx, reply.Index, args.TreeSize)
+		if err != nil {
+			return err
+		}
+		entry, err := tx.Get(regLog.entryKey(reply.Index))
+		if err != nil {
+			return errorf(ErrDatabaseError, "entry %d: %s", reply.Index, err)
+		}
+		reply.Entry = append([]byte(nil), entry...)
+		return nil
+	})
+	return reply, err
+}
+
+func (srv *Server) regLogHandler(w http.ResponseWriter, req *http.Request) {
+	var reply interface{}
+	var err error
+	body := http.MaxBytesReader(w, req.Body, 1024)
+	switch req.URL.Path {
+	case "/reglog/head":
+		reply, err = srv.RegistrationLogHead()
+	case "/reglog/inclusion":
+		args := new(regLogInclusionArgs)
+		if err := json.NewDecoder(body).Decode(args); err != nil {
+			httpError(w, errorf(ErrBadRequestJSON, "%s", err))
+			return
+		}
+		reply, err = srv.regLogInclusion(args)
+	case "/reglog/consistency":
+		args := new(logConsistencyArgs)
+		if err := json.NewDecoder(body).Decode(args); err != nil {
+			httpError(w, errorf(ErrBadRequestJSON, "%s", err))
+			return
+		}
+		reply, err = srv.logConsistency(regLog, args)
+	case "/reglog/entries":
+		args := new(logEntriesArgs)
+		if err := json.NewDecoder(body).Decode(args); err != nil {
+			httpError(w, errorf(ErrBadRequestJSON, "%s", err))
+			return
+		}
+		reply, err = srv.logEntries(regLog, args)
+	default:
+		http.NotFound(w, req)
+		return
+	}
+	srv.writeLogReply(w, req, reply, err)
+}
@@ -0,0 +1,109 @@
+// Copyright 2018 David Lazar. All rights reserved.
+// Use of this source code is governed by the GNU AGPL
+// license that can be found in the LICENSE file.
+
+package pkg_test
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"testing"
+
+	"vuvuzela.io/alpenhorn/edhttp"
+	"vuvuzela.io/alpenhorn/pkg"
+)
+
+func TestRegistrationLog(t *testing.T) {
+	testpkg, _ := launchPKG(t, func(username string, token string) error {
+		return nil
+	})
+	defer testpkg.Close()
+	server := testpkg.PublicServerConfig
+
+	alicePub, oldKey, _ := ed25519.GenerateKey(rand.Reader)
+	_, newKey, _ := ed25519.GenerateKey(rand.Reader)
+	client := &pkg.Client{
+		Username:        "alice@example.org",
+		LoginKey:        oldKey,
+		UserLongTermKey: alicePub,
+		HTTPClient:      new(edhttp.Client),
+	}
+
+	head0, err := client.RegistrationLogHead(server)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := client.VerifyRegistrationLogged(server, head0); err.(pkg.Error).Code != pkg.ErrNotInLog {
+		t.Fatalf("expected ErrNotInLog before registering, got %v", err)
+	}
+
+	if err := client.Register(server, ""); err != nil {
+		t.Fatal(err)
+	}
+	head1, err := client.RegistrationLogHead(server)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if head1.Size != 1 {
+		t.Fatalf("log size is %d after one registration", head1.Size)
+	}
+	if err := client.VerifyRegistrationLogged(server, head1); err != nil {
+		t.Fatal(err)
+	}
+
+	// A client whose login key has been replaced notices.
+	var id [32]byte
+	rand.Read(id[:])
+	if err := client.PrepareLoginKey(server, id, newKey); err != nil {
+		t.Fatal(err)
+	}
+	if err := client.CommitLoginKey(server, id, newKey); err != nil {
+		t.Fatal(err)
+	}
+	head2, err := client.RegistrationLogHead(server)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := client.VerifyRegistrationLogged(server, head2); err == nil {
+		t.Fatal("expected error for a login key that is no longer ours")
+	}
+	// The old head still shows the old key.
+	if err := client.VerifyRegistrationLogged(server, head1); err != nil {
+		t.Fatal(err)
+	}
+	rotated := *client
+	rotated.LoginKey = newKey
+	if err := rotated.VerifyRegistrationLogged(server, head2); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, old := range []*pkg.RegistrationLogHead{head0, head1} {
+		if err := client.VerifyRegistrationLogConsistency(server, old, head2); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := client.VerifyRegistrationLogConsistency(server, head2, head1); err == nil {
+		t.Fatal("expected error for a log that shrank")
+	}
+
+	// A registration log head is not an attestation log head.
+	attestHead := (*pkg.LogHead)(head2)
+	if attestHead.Verify(server.Key) {
+		t.Fatal("registration log head verifies as an attestation log head")
+	}
+
+	if err := rotated.Unregister(server); err != nil {
+		t.Fatal(err)
+	}
+	entries, err := client.RegistrationLogEntries(server, 0, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 3 {
+		t.Fatalf("got %d entries, want 3", len(entries))
+	}
+	newPub := newKey.Public().(ed25519.PublicKey)
+	if !entries[0].LoginKey.Equal(oldKey.Public()) || !entries[1].LoginKey.Equal(newPub) || entries[2].LoginKey != nil {
+		t.Fatalf("unexpected entries: %+v", entries)
+	}
+}
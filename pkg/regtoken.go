@@ -0,0 +1,187 @@
+// Copyright 2018 David Lazar. All rights reserved.
+// Use of this source code is governed by the GNU AGPL
+// license that can be found in the LICENSE file.
+
+package pkg
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/binary"
+	"io"
+	"math/big"
+
+	"github.com/davidlazar/go-crypto/encoding/base32"
+
+	"vuvuzela.io/alpenhorn/errors"
+)
+
+// In RegistrationToken mode, the PKG does not verify usernames.
+// Instead, each registration spends a registration token that the
+// operator issued out of band, such as to members of an organization,
+// so the PKG never learns the users' contact information.
+//
+// Tokens are RSA blind signatures (Chaum's scheme, with a full-domain
+// hash) on random serial numbers. The user picks a serial, blinds it
+// with NewTokenRequest, and sends the blinded serial to the operator,
+// who signs it with SignBlindedToken without seeing the serial. The
+// user unblinds the signature with Finish and registers with the
+// token. Since the operator never saw the serial, the PKG, even with
+// the operator's help, cannot tell which token issuance a username
+// came from. The PKG remembers the serials it has seen so that each
+// token registers one username.
+
+// RegistrationTokenKeyBits is the size of the issuer keys that
+// cmd/alpenhorn-token-issuer generates. Servers accept keys of at
+// least MinRegistrationTokenKeyBits.
+const (
+	RegistrationTokenKeyBits    = 3072
+	MinRegistrationTokenKeyBits = 2048
+)
+
+const tokenSerialSize = 32
+
+// tokenHash is the full-domain hash of serial for the issuer key pub.
+func tokenHash(pub *rsa.PublicKey, serial []byte) *big.Int {
+	// Hash to 128 bits more than the modulus so the reduction is
+	// close to uniform.
+	n := (pub.N.BitLen()+7)/8 + 16
+	out := make([]byte, 0, n+sha256.Size)
+	var ctr [4]byte
+	for i := uint32(0); len(out) < n; i++ {
+		binary.BigEndian.PutUint32(ctr[:], i)
+		h := sha256.New()
+		h.Write([]byte("alpenhorn registration token"))
+		h.Write(ctr[:])
+		h.Write(serial)
+		out = h.Sum(out)
+	}
+	m := new(big.Int).SetBytes(out[:n])
+	return m.Mod(m, pub.N)
+}
+
+func checkTokenKey(pub *rsa.PublicKey) error {
+	if pub == nil || pub.N == nil {
+		return errors.New("nil registration token key")
+	}
+	if pub.N.BitLen() < MinRegistrationTokenKeyBits {
+		return errors.New("registration token key is too small: %d bits", pub.N.BitLen())
+	}
+	if pub.E < 3 || pub.E%2 == 0 {
+		return errors.New("bad registration token key exponent: %d", pub.E)
+	}
+	return nil
+}
+
+// A TokenRequest is a user's request for a registration token.
+type TokenRequest struct {
+	// Blinded is the blinded serial to send to the issuer.
+	Blinded []byte
+
+	issuer *rsa.PublicKey
+	serial []byte
+	rInv   *big.Int
+}
+
+// NewTokenRequest picks a random serial and blinds it for the issuer
+// key. If random is nil, crypto/rand is used.
+func NewTokenRequest(issuer *rsa.PublicKey, random io.Reader) (*TokenRequest, error) {
+	if err := checkTokenKey(issuer); err != nil {
+		return nil, err
+	}
+	if random == nil {
+		random = rand.Reader
+	}
+	serial := make([]byte, tokenSerialSize)
+	if _, err := io.ReadFull(random, serial); err != nil {
+		return nil, err
+	}
+
+	var r, rInv *big.Int
+	for rInv == nil {
+		var err error
+		r, err = rand.Int(random, issuer.N)
+		if err != nil {
+			return nil, err
+		}
+		if r.Sign() > 0 {
+			rInv = new(big.Int).ModInverse(r, issuer.N)
+		}
+	}
+
+	m := tokenHash(issuer, serial)
+	re := new(big.Int).Exp(r, big.NewInt(int64(issuer.E)), issuer.N)
+	blinded := m.Mul(m, re)
+	blinded.Mod(blinded, issuer.N)
+
+	return &TokenRequest{
+		Blinded: blinded.FillBytes(make([]byte, (issuer.N.BitLen()+7)/8)),
+		issuer:  issuer,
+		serial:  serial,
+		rInv:    rInv,
+	}, nil
+}
+
+// SignBlindedToken signs a blinded serial from NewTokenRequest. The
+// issuer should sign only for users entitled to a username, and only
+// once per user.
+func SignBlindedToken(key *rsa.PrivateKey, blinded []byte) ([]byte, error) {
+	if err := checkTokenKey(&key.PublicKey); err != nil {
+		return nil, err
+	}
+	m := new(big.Int).SetBytes(blinded)
+	if m.Sign() <= 0 || m.Cmp(key.N) >= 0 {
+		return nil, errors.New("blinded serial out of range")
+	}
+	s := new(big.Int).Exp(m, key.D, key.N)
+	// Check the signature before releasing it, in case of a fault.
+	if new(big.Int).Exp(s, big.NewInt(int64(key.E)), key.N).Cmp(m) != 0 {
+		return nil, errors.New("signature check failed")
+	}
+	return s.FillBytes(make([]byte, (key.N.BitLen()+7)/8)), nil
+}
+
+// Finish unblinds the issuer's signature on the request and returns
+// the registration token to pass to Client.Register.
+func (req *TokenRequest) Finish(blindSig []byte) (string, error) {
+	s := new(big.Int).SetBytes(blindSig)
+	if s.Cmp(req.issuer.N) >= 0 {
+		return "", errors.New("blind signature out of range")
+	}
+	s.Mul(s, req.rInv)
+	s.Mod(s, req.issuer.N)
+	sig := s.FillBytes(make([]byte, (req.issuer.N.BitLen()+7)/8))
+	token := append(append([]byte(nil), req.serial...), sig...)
+	if _, err := verifyRegistrationToken(req.issuer, token); err != nil {
+		return "", errors.New("issuer returned an invalid signature")
+	}
+	return base32.EncodeToString(token), nil
+}
+
+// parseRegistrationToken checks a token from TokenRequest.Finish and
+// returns its serial.
+func parseRegistrationToken(issuer *rsa.PublicKey, token string) ([]byte, error) {
+	data, err := base32.DecodeString(token)
+	if err != nil {
+		return nil, errorf(ErrInvalidToken, "bad encoding")
+	}
+	return verifyRegistrationToken(issuer, data)
+}
+
+func verifyRegistrationToken(issuer *rsa.PublicKey, data []byte) ([]byte, error) {
+	k := (issuer.N.BitLen() + 7) / 8
+	if len(data) != tokenSerialSize+k {
+		return nil, errorf(ErrInvalidToken, "bad length: %d", len(data))
+	}
+	serial, sig := data[:tokenSerialSize], data[tokenSerialSize:]
+	s := new(big.Int).SetBytes(sig)
+	if s.Cmp(issuer.N) >= 0 {
+		return nil, errorf(ErrInvalidToken, "signature out of range")
+	}
+	s.Exp(s, big.NewInt(int64(issuer.E)), issuer.N)
+	if s.Cmp(tokenHash(issuer, serial)) != 0 {
+		return nil, errorf(ErrInvalidToken, "bad signature")
+	}
+	return serial, nil
+}
@@ -0,0 +1,124 @@
+// Copyright 2018 David Lazar. All rights reserved.
+// Use of this source code is governed by the GNU AGPL
+// license that can be found in the LICENSE file.
+
+package pkg
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"testing"
+
+	"vuvuzela.io/alpenhorn/pkg/kv"
+)
+
+func TestRegistrationTokens(t *testing.T) {
+	issuerKey, err := rsa.GenerateKey(rand.Reader, MinRegistrationTokenKeyBits)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, serverKey, _ := ed25519.GenerateKey(rand.Reader)
+	conf := &Config{
+		DB:               kv.NewMemory(),
+		SigningKey:       serverKey,
+		RegistrationMode: RegistrationToken,
+	}
+	if _, err := NewServer(conf); err == nil {
+		t.Fatal("expected error without a RegistrationTokenKey")
+	}
+	conf.RegistrationTokenKey = &issuerKey.PublicKey
+	srv, err := NewServer(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+
+	newToken := func() string {
+		req, err := NewTokenRequest(&issuerKey.PublicKey, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		blindSig, err := SignBlindedToken(issuerKey, req.Blinded)
+		if err != nil {
+			t.Fatal(err)
+		}
+		token, err := req.Finish(blindSig)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return token
+	}
+	register := func(username string, token string) error {
+		loginKey, _, _ := ed25519.GenerateKey(rand.Reader)
+		_, err := srv.register(&registerArgs{
+			Username:          username,
+			LoginKey:          loginKey,
+			RegistrationToken: token,
+		})
+		return err
+	}
+
+	// The issuer's signature on one request does not finish another.
+	req, err := NewTokenRequest(&issuerKey.PublicKey, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := NewTokenRequest(&issuerKey.PublicKey, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	blindSig, err := SignBlindedToken(issuerKey, other.Blinded)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := req.Finish(blindSig); err == nil {
+		t.Fatal("finished a token with another request's signature")
+	}
+
+	if err := register("alice@example.org", ""); errorCode(err) != ErrInvalidToken {
+		t.Fatalf("expected ErrInvalidToken without a token, got %v", err)
+	}
+	token := newToken()
+	if err := register("alice@example.org", token); err != nil {
+		t.Fatal(err)
+	}
+	if err := register("bob@example.org", token); errorCode(err) != ErrInvalidToken {
+		t.Fatalf("expected ErrInvalidToken for a spent token, got %v", err)
+	}
+	if err := register("bob@example.org", newToken()); err != nil {
+		t.Fatal(err)
+	}
+
+	// Tokens from another issuer are rejected.
+	otherIssuer, err := rsa.GenerateKey(rand.Reader, MinRegistrationTokenKeyBits)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req, err = NewTokenRequest(&otherIssuer.PublicKey, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	blindSig, err = SignBlindedToken(otherIssuer, req.Blinded)
+	if err != nil {
+		t.Fatal(err)
+	}
+	forged, err := req.Finish(blindSig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := register("carol@example.org", forged); errorCode(err) != ErrInvalidToken {
+		t.Fatalf("expected ErrInvalidToken for another issuer's token, got %v", err)
+	}
+
+	stats, err := CollectDBStats(srv.db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.SpentTokens != 2 {
+		t.Fatalf("expected 2 spent tokens, got %d", stats.SpentTokens)
+	}
+	if problems, err := VerifyDB(srv.db); err != nil || len(problems) > 0 {
+		t.Fatalf("VerifyDB: %v %v", problems, err)
+	}
+}
@@ -0,0 +1,210 @@
+// Copyright 2018 David Lazar. All rights reserved.
+// Use of this source code is governed by the GNU AGPL
+// license that can be found in the LICENSE file.
+
+//go:build !js
+// +build !js
+
+package pkg
+
+import (
+	"crypto/ed25519"
+	"crypto/rsa"
+	"net"
+
+	"vuvuzela.io/alpenhorn/errors"
+)
+
+// Settings are the parts of a server's Config that can be changed
+// while it runs with Reload. The fields mean the same as in Config.
+type Settings struct {
+	CoordinatorKey      ed25519.PublicKey
+	CoordinatorKeys     []ed25519.PublicKey
+	CoordinatorNetworks []*net.IPNet
+
+	RegistrationMode     RegistrationMode
+	Verifier             Verifier
+	RegistrationTokenKey *rsa.PublicKey
+	ReservedNames        []string
+
+	// ReadOnly refuses registrations and key changes; see
+	// readonly.go.
+	ReadOnly bool
+
+	IPRateLimit       RateLimit
+	UsernameRateLimit RateLimit
+}
+
+// liveSettings are the server's current Settings. Requests load them
+// once and use them throughout, so a Reload does not change settings
+// under a request in progress.
+type liveSettings struct {
+	coordinatorKeys     []ed25519.PublicKey
+	coordinatorNetworks []*net.IPNet
+
+	mode          RegistrationMode
+	verifier      Verifier
+	verifierStore *VerifierStore
+	tokenKey      *rsa.PublicKey
+	reserved      reservedNames
+	readOnly      bool
+
+	ipLimiter       *rateLimiter
+	usernameLimiter *rateLimiter
+}
+
+func (s *liveSettings) closed() bool {
+	return s.mode == RegistrationClosed
+}
+
+func (srv *Server) live() *liveSettings {
+	return srv.settings.Load().(*liveSettings)
+}
+
+// registrationVerifier returns the verifier for the registration mode.
+func registrationVerifier(mode RegistrationMode, verifier Verifier) (Verifier, error) {
+	switch mode {
+	case "", RegistrationEmail:
+		if verifier == nil {
+			return nil, errors.New("nil Verifier")
+		}
+	case RegistrationFCFS, RegistrationToken, RegistrationClosed:
+		if verifier != nil {
+			return nil, errors.New("Verifier is set in %q registration mode", mode)
+		}
+		verifier = acceptAll{}
+	default:
+		return nil, errors.New("unknown RegistrationMode %q", mode)
+	}
+	if v, ok := verifier.(interface{ Check() error }); ok {
+		if err := v.Check(); err != nil {
+			return nil, errors.Wrap(err, "%s verifier", verifier.Name())
+		}
+	}
+	return verifier, nil
+}
+
+// newLiveSettings checks s and returns the settings to install. Rate
+// limiters whose limits did not change are carried over from old,
+// which may be nil, so clients do not get a fresh burst on reload.
+func (srv *Server) newLiveSettings(s *Settings, old *liveSettings) (*liveSettings, error) {
+	verifier, err := registrationVerifier(s.RegistrationMode, s.Verifier)
+	if err != nil {
+		return nil, err
+	}
+	coordinatorKeys, err := coordinatorKeys(s.CoordinatorKey, s.CoordinatorKeys)
+	if err != nil {
+		return nil, err
+	}
+	mode := s.RegistrationMode
+	if mode == "" {
+		mode = RegistrationEmail
+	}
+	if mode == RegistrationToken {
+		if err := checkTokenKey(s.RegistrationTokenKey); err != nil {
+			return nil, err
+		}
+	}
+	reserved, err := newReservedNames(s.ReservedNames)
+	if err != nil {
+		return nil, err
+	}
+	for _, n := range s.CoordinatorNetworks {
+		if n == nil {
+			return nil, errors.New("nil coordinator network")
+		}
+	}
+	live := &liveSettings{
+		coordinatorKeys:     coordinatorKeys,
+		coordinatorNetworks: s.CoordinatorNetworks,
+		mode:                mode,
+		verifier:            verifier,
+		verifierStore:       newVerifierStore(srv.db, verifier.Name(), srv.clock),
+		tokenKey:            s.RegistrationTokenKey,
+		reserved:            reserved,
+		readOnly:            s.ReadOnly,
+		ipLimiter:           newRateLimiter(s.IPRateLimit),
+		usernameLimiter:     newRateLimiter(s.UsernameRateLimit),
+	}
+	if old != nil {
+		if sameLimit(old.ipLimiter, live.ipLimiter) {
+			live.ipLimiter = old.ipLimiter
+		}
+		if sameLimit(old.usernameLimiter, live.usernameLimiter) {
+			live.usernameLimiter = old.usernameLimiter
+		}
+	}
+	return live, nil
+}
+
+// coordinatorKeys returns the distinct coordinator keys, primary first.
+func coordinatorKeys(primary ed25519.PublicKey, more []ed25519.PublicKey) ([]ed25519.PublicKey, error) {
+	keys := more
+	if primary != nil {
+		keys = append([]ed25519.PublicKey{primary}, more...)
+	}
+
+	var distinct []ed25519.PublicKey
+	for _, key := range keys {
+		if len(key) != ed25519.PublicKeySize {
+			return nil, errors.New("bad coordinator key length: %d", len(key))
+		}
+		seen := false
+		for _, k := range distinct {
+			seen = seen || key.Equal(k)
+		}
+		if !seen {
+			distinct = append(distinct, key)
+		}
+	}
+	return distinct, nil
+}
+
+func sameKeys(a, b []ed25519.PublicKey) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if !a[i].Equal(b[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+func sameLimit(a, b *rateLimiter) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return a.limit == b.limit
+}
+
+// Reload replaces the server's settings. Requests in progress finish
+// with the old settings. Changing the verifier's name orphans codes
+// that the old verifier sent but users have not entered yet.
+func (srv *Server) Reload(s *Settings) error {
+	srv.reloadMu.Lock()
+	defer srv.reloadMu.Unlock()
+
+	old := srv.live()
+	live, err := srv.newLiveSettings(s, old)
+	if err != nil {
+		return err
+	}
+	srv.settings.Store(live)
+
+	if live.mode != old.mode {
+		srv.log.Infof("Registration mode changed from %q to %q", old.mode, live.mode)
+	}
+	if live.readOnly != old.readOnly {
+		if live.readOnly {
+			srv.log.Info("Entered read-only mode")
+		} else {
+			srv.log.Info("Left read-only mode")
+		}
+	}
+	if !sameKeys(live.coordinatorKeys, old.coordinatorKeys) {
+		srv.log.Infof("Coordinator keys changed to %x", live.coordinatorKeys)
+	}
+	return nil
+}
@@ -0,0 +1,97 @@
+// Copyright 2018 David Lazar. All rights reserved.
+// Use of this source code is governed by the GNU AGPL
+// license that can be found in the LICENSE file.
+
+package pkg
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"vuvuzela.io/alpenhorn/pkg/kv"
+)
+
+func TestReload(t *testing.T) {
+	oldCoordinator, _, _ := ed25519.GenerateKey(rand.Reader)
+	newCoordinator, _, _ := ed25519.GenerateKey(rand.Reader)
+	_, serverKey, _ := ed25519.GenerateKey(rand.Reader)
+	ipLimit := RateLimit{Rate: 1, Burst: 5}
+	srv, err := NewServer(&Config{
+		DB:               kv.NewMemory(),
+		SigningKey:       serverKey,
+		CoordinatorKey:   oldCoordinator,
+		RegistrationMode: RegistrationFCFS,
+		IPRateLimit:      ipLimit,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+
+	register := func(username string) error {
+		loginKey, _, _ := ed25519.GenerateKey(rand.Reader)
+		_, err := srv.register(&registerArgs{Username: username, LoginKey: loginKey})
+		return err
+	}
+	commit := func(key ed25519.PublicKey) int {
+		body, _ := json.Marshal(&commitArgs{Round: 1, coordinatorNonce: newCoordinatorNonce(time.Now())})
+		req := httptest.NewRequest("POST", "/commit", bytes.NewReader(body))
+		req.TLS = &tls.ConnectionState{
+			PeerCertificates: []*x509.Certificate{{PublicKey: key}},
+		}
+		w := httptest.NewRecorder()
+		srv.commitHandler(w, req)
+		return w.Code
+	}
+
+	if err := register("alice@example.org"); err != nil {
+		t.Fatal(err)
+	}
+	if code := commit(oldCoordinator); code != http.StatusOK {
+		t.Fatalf("commit: %d", code)
+	}
+	ipLimiter := srv.live().ipLimiter
+
+	if err := srv.Reload(&Settings{RegistrationMode: "bogus"}); err == nil {
+		t.Fatal("expected error for an unknown registration mode")
+	}
+	if err := srv.Reload(&Settings{RegistrationMode: RegistrationEmail}); err == nil {
+		t.Fatal("expected error for email mode without a verifier")
+	}
+	if err := register("bob@example.org"); err != nil {
+		t.Fatalf("failed reload changed the settings: %s", err)
+	}
+
+	err = srv.Reload(&Settings{
+		CoordinatorKey:    newCoordinator,
+		RegistrationMode:  RegistrationClosed,
+		IPRateLimit:       ipLimit,
+		UsernameRateLimit: RateLimit{Rate: 1, Burst: 1},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := register("carol@example.org"); errorCode(err) != ErrRegistrationClosed {
+		t.Fatalf("expected ErrRegistrationClosed, got %v", err)
+	}
+	if code := commit(oldCoordinator); code != http.StatusUnauthorized {
+		t.Fatalf("old coordinator key still accepted: %d", code)
+	}
+	if code := commit(newCoordinator); code != http.StatusOK {
+		t.Fatalf("new coordinator key rejected: %d", code)
+	}
+	if srv.live().ipLimiter != ipLimiter {
+		t.Fatal("unchanged IP rate limit was reset")
+	}
+	if srv.live().usernameLimiter == nil {
+		t.Fatal("username rate limit was not applied")
+	}
+}
@@ -0,0 +1,253 @@
+// Copyright 2018 David Lazar. All rights reserved.
+// Use of this source code is governed by the GNU AGPL
+// license that can be found in the LICENSE file.
+
+//go:build !js
+// +build !js
+
+package pkg
+
+import (
+	"crypto/ed25519"
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"vuvuzela.io/alpenhorn/errors"
+	"vuvuzela.io/alpenhorn/log"
+	"vuvuzela.io/alpenhorn/pkg/kv"
+)
+
+// A user renames their account with a request signed by their login
+// key and a registration token for the new username. The server moves
+// the account's records to the new username and signs a
+// RenameAttestation. The old username is held for RenameHold: it
+// cannot be registered, so that friends who have not yet seen the
+// attestation cannot be tricked into calling someone else, and nobody
+// else can extract the old identity's keys for friend requests that
+// are still in flight.
+
+// RenameHold is how long an old username stays reserved after a rename.
+var RenameHold = 30 * 24 * time.Hour
+
+const renamedBinaryVersion byte = 1
+
+func (srv *Server) renameHandler(w http.ResponseWriter, req *http.Request) {
+	body := http.MaxBytesReader(w, req.Body, 1024)
+	args := new(renameArgs)
+	err := json.NewDecoder(body).Decode(args)
+	if err != nil {
+		httpError(w, errorf(ErrBadRequestJSON, "%s", err))
+		return
+	}
+	if !srv.limitUsername(w, args.OldUsername) {
+		return
+	}
+	args.ServerSigningKey = srv.publicKey
+
+	logger := srv.log.WithFields(log.Fields{"username": args.OldUsername, "newUsername": args.NewUsername})
+	reply, loginKey, err := srv.rename(args)
+	srv.audit(&AuditEvent{
+		Type:     AuditRename,
+		Username: args.OldUsername,
+		Key:      KeyFingerprint(loginKey),
+		Detail:   args.NewUsername,
+		Result:   result(err),
+		RemoteIP: remoteIP(req),
+	})
+	if err != nil {
+		logger = logger.WithFields(log.Fields{"code": errorCode(err).String()})
+		if isInternalError(err) {
+			logger.Errorf("Rename failed: %s", err)
+		} else {
+			logger.Infof("Rename failed: %s", err)
+		}
+		httpError(w, err)
+		return
+	}
+	logger.Info("Renamed user")
+
+	bs, err := json.Marshal(reply)
+	if err != nil {
+		panic(err)
+	}
+	w.Write(bs)
+}
+
+// rename moves the user's account to the new username and returns the
+// attestation along with the user's login key.
+func (srv *Server) rename(args *renameArgs) (*RenameAttestation, ed25519.PublicKey, error) {
+	live := srv.live()
+	if live.closed() {
+		return nil, nil, errorf(ErrRegistrationClosed, "")
+	}
+	newID, err := srv.checkUsername(args.NewUsername)
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := srv.checkBlocklist(args.NewUsername); err != nil {
+		return nil, nil, err
+	}
+	now := srv.clock.Now()
+	if err := checkFresh(args.Time, now); err != nil {
+		return nil, nil, err
+	}
+
+	// Check the signature before asking the verifier, which may send
+	// a code to the new username.
+	user, _, err := srv.getUser(nil, args.OldUsername)
+	if err != nil {
+		return nil, nil, err
+	}
+	if !srv.verifyBound(&args.ServerSigningKey, func() bool {
+		return ed25519.Verify(user.LoginKey, args.msg(), args.Signature)
+	}) {
+		return nil, user.LoginKey, errorf(ErrInvalidSignature, "")
+	}
+
+	err = live.verifier.Verify(live.verifierStore, args.NewUsername, args.RegistrationToken)
+	srv.metrics.verifications.Inc(live.verifier.Name(), result(err))
+	srv.audit(&AuditEvent{
+		Type:     AuditVerify,
+		Username: args.NewUsername,
+		Key:      KeyFingerprint(user.LoginKey),
+		Detail:   live.verifier.Name(),
+		Result:   result(err),
+	})
+	if err != nil {
+		return nil, user.LoginKey, err
+	}
+	if srv.isBanned != nil && srv.isBanned(args.NewUsername) {
+		return nil, user.LoginKey, errorf(ErrAlreadyRegistered, "%q", args.NewUsername)
+	}
+
+	srv.regLogMu.Lock()
+	defer srv.regLogMu.Unlock()
+	tx, err := srv.db.NewTransaction(true)
+	if err != nil {
+		return nil, user.LoginKey, errorf(ErrDatabaseError, "%s", err)
+	}
+	defer tx.Discard()
+
+	// The login key may have changed since the check above.
+	user, oldID, err := srv.getUser(tx, args.OldUsername)
+	if err != nil {
+		return nil, nil, err
+	}
+	if !ed25519.Verify(user.LoginKey, args.msg(), args.Signature) {
+		return nil, user.LoginKey, errorf(ErrInvalidSignature, "")
+	}
+	if err := checkReplay(tx, "rename", args.Signature, now); err != nil {
+		return nil, user.LoginKey, err
+	}
+	if *oldID == *newID {
+		return nil, user.LoginKey, errorf(ErrAlreadyRegistered, "%q", args.NewUsername)
+	}
+	// The user has shown they own the new username, so telling them
+	// it is taken reveals nothing.
+	if taken, err := usernameHeld(tx, newID); err != nil {
+		return nil, user.LoginKey, err
+	} else if taken {
+		return nil, user.LoginKey, errorf(ErrAlreadyRegistered, "%q", args.NewUsername)
+	}
+	if usernameDomain(args.NewUsername) != usernameDomain(args.OldUsername) {
+		quota, err := srv.checkDomainQuota(tx, args.NewUsername)
+		if err != nil {
+			return nil, user.LoginKey, err
+		}
+		if err := quota.use(tx); err != nil {
+			return nil, user.LoginKey, err
+		}
+	}
+
+	type record struct {
+		suffix []byte
+		value  []byte
+	}
+	var records []record
+	err = tx.Iterate(dbUserKey(oldID, nil), func(key, value []byte) error {
+		_, suffix, _ := splitUserKey(key)
+		records = append(records, record{
+			suffix: append([]byte(nil), suffix...),
+			value:  append([]byte(nil), value...),
+		})
+		return nil
+	})
+	if err != nil {
+		return nil, user.LoginKey, errorf(ErrDatabaseError, "%s", err)
+	}
+	for _, r := range records {
+		if err := tx.Delete(dbUserKey(oldID, r.suffix)); err != nil {
+			return nil, user.LoginKey, errorf(ErrDatabaseError, "%s", err)
+		}
+		if err := tx.Set(dbUserKey(newID, r.suffix), r.value); err != nil {
+			return nil, user.LoginKey, errorf(ErrDatabaseError, "%s", err)
+		}
+	}
+	err = appendLog(tx, newID, UserEvent{
+		Time:        now,
+		Type:        EventRenamed,
+		LoginKey:    user.LoginKey,
+		OldUsername: args.OldUsername,
+	})
+	if err != nil {
+		return nil, user.LoginKey, err
+	}
+	if err := srv.logRegistration(tx, oldID, nil); err != nil {
+		return nil, user.LoginKey, err
+	}
+	if err := srv.logRegistration(tx, newID, user.LoginKey); err != nil {
+		return nil, user.LoginKey, err
+	}
+
+	attestation := &RenameAttestation{
+		OldUsername: args.OldUsername,
+		NewUsername: args.NewUsername,
+		Time:        now.Unix(),
+
+		SignatureAlgorithm: wireAlgorithm(srv.signatureScheme),
+	}
+	attestation.Signature, err = srv.signWith(srv.signatureScheme, srv.signer, attestation.msg(srv.publicKey))
+	if err != nil {
+		return nil, user.LoginKey, err
+	}
+	data, err := json.Marshal(attestation)
+	if err != nil {
+		panic(err)
+	}
+	data = append([]byte{renamedBinaryVersion}, data...)
+	if err := tx.SetWithTTL(dbUserKey(oldID, renamedSuffix), data, RenameHold); err != nil {
+		return nil, user.LoginKey, errorf(ErrDatabaseError, "%s", err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, user.LoginKey, errorf(ErrDatabaseError, "%s", err)
+	}
+	return attestation, user.LoginKey, nil
+}
+
+// usernameHeld reports whether the identity is registered or held
+// after a rename.
+func usernameHeld(tx kv.Txn, id *[64]byte) (bool, error) {
+	for _, suffix := range [][]byte{registrationSuffix, renamedSuffix} {
+		_, err := tx.Get(dbUserKey(id, suffix))
+		if err == nil {
+			return true, nil
+		}
+		if err != kv.ErrNotFound {
+			return false, errorf(ErrDatabaseError, "%s", err)
+		}
+	}
+	return false, nil
+}
+
+func unmarshalRenamed(data []byte) (*RenameAttestation, error) {
+	if len(data) < 2 {
+		return nil, errors.New("short data")
+	}
+	if data[0] != renamedBinaryVersion {
+		return nil, errors.New("unexpected binary version: %v", data[0])
+	}
+	a := new(RenameAttestation)
+	return a, json.Unmarshal(data[1:], a)
+}
@@ -0,0 +1,81 @@
+// Copyright 2018 David Lazar. All rights reserved.
+// Use of this source code is governed by the GNU AGPL
+// license that can be found in the LICENSE file.
+
+package pkg_test
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"testing"
+
+	"vuvuzela.io/alpenhorn/edhttp"
+	"vuvuzela.io/alpenhorn/pkg"
+)
+
+func TestRename(t *testing.T) {
+	testpkg, _ := launchPKG(t, func(username string, token string) error {
+		return nil
+	})
+	defer testpkg.Close()
+
+	alicePub, aliceKey, _ := ed25519.GenerateKey(rand.Reader)
+	client := &pkg.Client{
+		Username:        "alice@example.org",
+		LoginKey:        aliceKey,
+		UserLongTermKey: alicePub,
+		HTTPClient:      new(edhttp.Client),
+	}
+	server := testpkg.PublicServerConfig
+	if err := client.Register(server, ""); err != nil {
+		t.Fatal(err)
+	}
+	bob := *client
+	bob.Username = "bob@example.org"
+	_, bob.LoginKey, _ = ed25519.GenerateKey(rand.Reader)
+	if err := bob.Register(server, ""); err != nil {
+		t.Fatal(err)
+	}
+
+	_, err := client.Rename(server, "bob@example.org", "")
+	if err.(pkg.Error).Code != pkg.ErrAlreadyRegistered {
+		t.Fatalf("expected ErrAlreadyRegistered, got %v", err)
+	}
+
+	_, mallory, _ := ed25519.GenerateKey(rand.Reader)
+	impostor := *client
+	impostor.LoginKey = mallory
+	_, err = impostor.Rename(server, "mallory@example.org", "")
+	if err.(pkg.Error).Code != pkg.ErrInvalidSignature {
+		t.Fatalf("expected ErrInvalidSignature, got %v", err)
+	}
+
+	attestation, err := client.Rename(server, "alice2@example.org", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !attestation.Verify(server.Key) {
+		t.Fatal("attestation does not verify")
+	}
+	forged := *attestation
+	forged.NewUsername = "mallory@example.org"
+	if forged.Verify(server.Key) {
+		t.Fatal("forged attestation verifies")
+	}
+
+	if err := client.CheckStatus(server); err.(pkg.Error).Code != pkg.ErrNotRegistered {
+		t.Fatalf("expected ErrNotRegistered for the old username, got %v", err)
+	}
+	client.Username = "alice2@example.org"
+	if err := client.CheckStatus(server); err != nil {
+		t.Fatalf("renamed account: %s", err)
+	}
+
+	// The old username is held, so nobody can register it.
+	squatter := *client
+	squatter.Username = "alice@example.org"
+	_, squatter.LoginKey, _ = ed25519.GenerateKey(rand.Reader)
+	if err := squatter.Register(server, ""); err.(pkg.Error).Code != pkg.ErrNotRegistered {
+		t.Fatalf("expected the held username to be refused, got %v", err)
+	}
+}
@@ -0,0 +1,75 @@
+// Copyright 2018 David Lazar. All rights reserved.
+// Use of this source code is governed by the GNU AGPL
+// license that can be found in the LICENSE file.
+
+//go:build !js
+// +build !js
+
+package pkg
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"time"
+
+	"vuvuzela.io/alpenhorn/pkg/kv"
+)
+
+// Signed requests that change server state are remembered in the
+// database for ReplayWindow, so a captured request cannot be replayed,
+// even across a restart. Proofs of work on lookups are remembered the
+// same way, for as long as their time is accepted. Each request is
+// bound to the window by its round (extractions) or timestamp
+// (everything else), so it is never accepted after its replay entry is
+// gone. Entries are written with a TTL: they disappear once expired,
+// and the leader sweeps them from the database (see sweep.go).
+
+// ReplayWindow is how long the PKG remembers signed requests. Request
+// timestamps must be within half the window of the server's clock.
+var ReplayWindow = 24 * time.Hour
+
+var dbReplayPrefix = []byte("replay:")
+
+func replayKey(kind string, signature []byte) []byte {
+	h := sha256.Sum256(signature)
+	key := make([]byte, 0, len(dbReplayPrefix)+len(kind)+1+len(h))
+	key = append(key, dbReplayPrefix...)
+	key = append(key, kind...)
+	key = append(key, ':')
+	return append(key, h[:]...)
+}
+
+// checkReplay records the signed request in tx, failing if the same
+// request was seen within the replay window.
+func checkReplay(tx kv.Txn, kind string, signature []byte, now time.Time) error {
+	return checkSpent(tx, kind, signature, now, ReplayWindow)
+}
+
+// checkSpent records a single-use token, such as a signature or a
+// proof of work, in tx for ttl, failing if it was already recorded.
+func checkSpent(tx kv.Txn, kind string, token []byte, now time.Time, ttl time.Duration) error {
+	key := replayKey(kind, token)
+	_, err := tx.Get(key)
+	if err == nil {
+		return errorf(ErrReplayedRequest, "%s", kind)
+	}
+	if err != kv.ErrNotFound {
+		return errorf(ErrDatabaseError, "%s", err)
+	}
+
+	expires := make([]byte, 8)
+	binary.BigEndian.PutUint64(expires, uint64(now.Add(ttl).Unix()))
+	if err := tx.SetWithTTL(key, expires, ttl); err != nil {
+		return errorf(ErrDatabaseError, "%s", err)
+	}
+	return nil
+}
+
+// checkFresh rejects request timestamps outside the replay window.
+func checkFresh(unixTime int64, now time.Time) error {
+	t := time.Unix(unixTime, 0)
+	if t.Before(now.Add(-ReplayWindow/2)) || t.After(now.Add(ReplayWindow/2)) {
+		return errorf(ErrStaleRequest, "%s", t.UTC().Format(time.RFC3339))
+	}
+	return nil
+}
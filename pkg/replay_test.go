@@ -0,0 +1,124 @@
+// Copyright 2018 David Lazar. All rights reserved.
+// Use of this source code is governed by the GNU AGPL
+// license that can be found in the LICENSE file.
+
+package pkg
+
+import (
+	"crypto/ed25519"
+	"crypto/mlkem"
+	"crypto/rand"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"vuvuzela.io/alpenhorn/clock"
+	"vuvuzela.io/alpenhorn/pkg/kv"
+)
+
+func TestReplayAcrossRestart(t *testing.T) {
+	dbPath, err := ioutil.TempDir("", "alpenhorn_pkg_replay_")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dbPath)
+
+	_, serverKey, _ := ed25519.GenerateKey(rand.Reader)
+	conf := &Config{
+		DBPath:          dbPath,
+		SigningKey:      serverKey,
+		RegTokenHandler: func(string, string) error { return nil },
+	}
+	srv, err := NewServer(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	loginPub, loginKey, _ := ed25519.GenerateKey(rand.Reader)
+	username := "alice@example.org"
+	_, err = srv.register(&registerArgs{Username: username, LoginKey: loginPub})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dk, _ := mlkem.GenerateKey768()
+	args := &setPQKeyArgs{
+		Username:         username,
+		PQKey:            dk.EncapsulationKey().Bytes(),
+		Time:             time.Now().Unix(),
+		ServerSigningKey: srv.publicKey,
+	}
+	args.Signature = ed25519.Sign(loginKey, args.msg())
+
+	if err := srv.setPQKey(args); err != nil {
+		t.Fatal(err)
+	}
+	if err := srv.setPQKey(args); errorCode(err) != ErrReplayedRequest {
+		t.Fatalf("expected ErrReplayedRequest, got %v", err)
+	}
+
+	srv.Close()
+	srv, err = NewServer(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+
+	if err := srv.setPQKey(args); errorCode(err) != ErrReplayedRequest {
+		t.Fatalf("expected ErrReplayedRequest after restart, got %v", err)
+	}
+
+	args.Time = time.Now().Add(-ReplayWindow).Unix()
+	args.Signature = ed25519.Sign(loginKey, args.msg())
+	if err := srv.setPQKey(args); errorCode(err) != ErrStaleRequest {
+		t.Fatalf("expected ErrStaleRequest, got %v", err)
+	}
+}
+
+func TestRotationExpiresWithClock(t *testing.T) {
+	// The mock's time is years from the real time, so any request
+	// checked against the real clock would be stale.
+	mockClock := clock.NewMock(time.Date(2030, time.January, 1, 0, 0, 0, 0, time.UTC))
+	_, serverKey, _ := ed25519.GenerateKey(rand.Reader)
+	srv, err := NewServer(&Config{
+		DB:              kv.NewMemory(),
+		SigningKey:      serverKey,
+		RegTokenHandler: func(string, string) error { return nil },
+		Clock:           mockClock,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+
+	oldPub, oldKey, _ := ed25519.GenerateKey(rand.Reader)
+	newPub, newKey, _ := ed25519.GenerateKey(rand.Reader)
+	username := "alice@example.org"
+	_, err = srv.register(&registerArgs{Username: username, LoginKey: oldPub})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rotate := func(phase string) error {
+		args := &rotateLoginArgs{
+			Username:         username,
+			Phase:            phase,
+			OldLoginKey:      oldPub,
+			NewLoginKey:      newPub,
+			Time:             mockClock.Now().Unix(),
+			ServerSigningKey: srv.publicKey,
+		}
+		args.Signature = ed25519.Sign(oldKey, args.msg())
+		args.NewKeySignature = ed25519.Sign(newKey, args.msg())
+		return srv.rotateLogin(args)
+	}
+
+	if err := rotate(RotatePrepare); err != nil {
+		t.Fatal(err)
+	}
+	mockClock.Add(RotationWindow + time.Second)
+	if err := rotate(RotateCommit); errorCode(err) != ErrNoRotation {
+		t.Fatalf("expected ErrNoRotation after the rotation window, got %v", err)
+	}
+}
@@ -0,0 +1,162 @@
+// Copyright 2018 David Lazar. All rights reserved.
+// Use of this source code is governed by the GNU AGPL
+// license that can be found in the LICENSE file.
+
+//go:build !js
+// +build !js
+
+package pkg
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	mrand "math/rand/v2"
+	"net/http"
+	"time"
+
+	"vuvuzela.io/alpenhorn/errors"
+	"vuvuzela.io/alpenhorn/log"
+)
+
+// With Config.RequestLog, the server logs a sample of its requests:
+// the route, status, error codes, duration, and the username the
+// request is about, so an operator can see what a load spike is made
+// of. It does not log addresses, request bodies, or headers.
+//
+// Usernames are logged as a keyed hash, unless ClearUsernames is set.
+// The key is a salt the server picks when it starts and keeps only in
+// memory, so the hashes show which requests are about the same user
+// without naming the user, cannot be reversed by hashing guessed
+// usernames, and cannot be linked across restarts.
+
+// RequestLog configures sampled request logging. The zero value logs
+// nothing.
+type RequestLog struct {
+	// SampleRate is the fraction of requests logged, from 0 to 1.
+	SampleRate float64
+
+	// PathRates overrides SampleRate for the routes it lists, such as
+	// "/extract". A rate of 0 turns logging off for the route.
+	PathRates map[string]float64
+
+	// ClearUsernames logs usernames as they are, instead of hashing
+	// them.
+	ClearUsernames bool
+}
+
+func (c RequestLog) check() error {
+	if c.SampleRate < 0 || c.SampleRate > 1 {
+		return errors.New("RequestLog.SampleRate must be between 0 and 1")
+	}
+	for path, rate := range c.PathRates {
+		if !paths[path] {
+			return errors.New("RequestLog.PathRates: unknown route %q", path)
+		}
+		if rate < 0 || rate > 1 {
+			return errors.New("RequestLog.PathRates: rate for %q must be between 0 and 1", path)
+		}
+	}
+	return nil
+}
+
+func (c RequestLog) enabled() bool {
+	if c.SampleRate > 0 {
+		return true
+	}
+	for _, rate := range c.PathRates {
+		if rate > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+type requestLogger struct {
+	conf RequestLog
+	salt []byte
+	log  *log.Logger
+}
+
+// newRequestLogger returns nil if conf logs nothing.
+func newRequestLogger(conf RequestLog, logger *log.Logger) (*requestLogger, error) {
+	if !conf.enabled() {
+		return nil, nil
+	}
+	salt := make([]byte, 32)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+	return &requestLogger{conf: conf, salt: salt, log: logger}, nil
+}
+
+func (l *requestLogger) rate(route string) float64 {
+	if rate, ok := l.conf.PathRates[route]; ok {
+		return rate
+	}
+	return l.conf.SampleRate
+}
+
+// sampled reports whether to log a request to route.
+func (l *requestLogger) sampled(route string) bool {
+	return mrand.Float64() < l.rate(route)
+}
+
+// redact returns how username appears in the log.
+func (l *requestLogger) redact(username string) string {
+	if l.conf.ClearUsernames {
+		return username
+	}
+	mac := hmac.New(sha256.New, l.salt)
+	mac.Write([]byte(username))
+	return hex.EncodeToString(mac.Sum(nil)[:8])
+}
+
+// logRequest logs req if it is sampled. start is when the server
+// began handling it.
+func (l *requestLogger) logRequest(req *http.Request, w *statusRecorder, start time.Time) {
+	if l == nil {
+		return
+	}
+	route := req.URL.Path
+	if !paths[route] {
+		route = "/other"
+	}
+	if !l.sampled(route) {
+		return
+	}
+	status := w.status
+	if status == 0 {
+		status = http.StatusOK
+	}
+	fields := log.Fields{
+		"route":    route,
+		"method":   req.Method,
+		"status":   status,
+		"duration": time.Since(start).String(),
+	}
+	if len(w.errors) > 0 {
+		names := make([]string, len(w.errors))
+		for i, code := range w.errors {
+			names[i] = code.String()
+		}
+		fields["errors"] = names
+	}
+	if w.username != "" {
+		fields["user"] = l.redact(w.username)
+	}
+	l.log.WithFields(fields).Info("Request")
+}
+
+// A usernameRecorder is a ResponseWriter that records the username a
+// request is about, for the request log.
+type usernameRecorder interface {
+	recordUsername(username string)
+}
+
+func recordUsername(w http.ResponseWriter, username string) {
+	if rec, ok := w.(usernameRecorder); ok {
+		rec.recordUsername(username)
+	}
+}
@@ -0,0 +1,117 @@
+// Copyright 2018 David Lazar. All rights reserved.
+// Use of this source code is governed by the GNU AGPL
+// license that can be found in the LICENSE file.
+
+package pkg
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"vuvuzela.io/alpenhorn/internal/version"
+	"vuvuzela.io/alpenhorn/log"
+	"vuvuzela.io/alpenhorn/pkg/kv"
+)
+
+type entryRecorder struct {
+	mu      sync.Mutex
+	entries []*log.Entry
+}
+
+func (r *entryRecorder) Fire(e *log.Entry) {
+	r.mu.Lock()
+	r.entries = append(r.entries, e)
+	r.mu.Unlock()
+}
+
+func (r *entryRecorder) requests() []*log.Entry {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var requests []*log.Entry
+	for _, e := range r.entries {
+		if e.Message == "Request" {
+			requests = append(requests, e)
+		}
+	}
+	return requests
+}
+
+func TestRequestLog(t *testing.T) {
+	if _, err := NewServer(&Config{RequestLog: RequestLog{SampleRate: 2}}); err == nil {
+		t.Fatal("expected error for a sample rate over 1")
+	}
+	if _, err := NewServer(&Config{RequestLog: RequestLog{PathRates: map[string]float64{"/nope": 1}}}); err == nil {
+		t.Fatal("expected error for an unknown route")
+	}
+
+	newServer := func(conf RequestLog) (*Server, *entryRecorder) {
+		rec := new(entryRecorder)
+		_, serverKey, _ := ed25519.GenerateKey(rand.Reader)
+		srv, err := NewServer(&Config{
+			DB:               kv.NewMemory(),
+			SigningKey:       serverKey,
+			RegistrationMode: RegistrationFCFS,
+			Logger:           &log.Logger{Level: log.InfoLevel, EntryHandler: rec},
+			RequestLog:       conf,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return srv, rec
+	}
+	post := func(srv *Server, path, body string) {
+		req := httptest.NewRequest("POST", path, bytes.NewReader([]byte(body)))
+		version.PKG.SetHeader(req.Header)
+		srv.ServeHTTP(httptest.NewRecorder(), req)
+	}
+	const status = `{"Username": "alice@example.org"}`
+
+	srv, rec := newServer(RequestLog{
+		PathRates: map[string]float64{"/status": 1},
+	})
+	defer srv.Close()
+	post(srv, "/status", status)
+	post(srv, "/status", status)
+	post(srv, "/pqkey", `{}`)
+	requests := rec.requests()
+	if len(requests) != 2 {
+		t.Fatalf("got %d request entries, want 2", len(requests))
+	}
+	e := requests[0]
+	if e.Fields["route"] != "/status" || e.Fields["errors"] == nil {
+		t.Fatalf("unexpected entry: %+v", e.Fields)
+	}
+	user, _ := e.Fields["user"].(string)
+	if user == "" || strings.Contains(user, "alice") {
+		t.Fatalf("username not redacted: %q", user)
+	}
+	if requests[1].Fields["user"] != user {
+		t.Fatalf("hashes of the same username differ: %q, %q", user, requests[1].Fields["user"])
+	}
+
+	// Another server picks another salt.
+	srv2, rec2 := newServer(RequestLog{SampleRate: 1})
+	defer srv2.Close()
+	post(srv2, "/status", status)
+	if requests := rec2.requests(); len(requests) != 1 || requests[0].Fields["user"] == user {
+		t.Fatalf("unexpected entries: %+v", requests)
+	}
+
+	srv3, rec3 := newServer(RequestLog{
+		SampleRate:     1,
+		PathRates:      map[string]float64{"/pqkey": 0},
+		ClearUsernames: true,
+	})
+	defer srv3.Close()
+	post(srv3, "/pqkey", `{}`)
+	post(srv3, "/status", status)
+	requests = rec3.requests()
+	if len(requests) != 1 || requests[0].Fields["user"] != "alice@example.org" {
+		t.Fatalf("unexpected entries: %+v", requests)
+	}
+}
@@ -0,0 +1,207 @@
+// Copyright 2018 David Lazar. All rights reserved.
+// Use of this source code is governed by the GNU AGPL
+// license that can be found in the LICENSE file.
+
+//go:build !js
+// +build !js
+
+package pkg
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/davidlazar/go-crypto/encoding/base32"
+
+	"vuvuzela.io/alpenhorn/errors"
+	"vuvuzela.io/alpenhorn/log"
+	"vuvuzela.io/alpenhorn/pkg/kv"
+)
+
+// Operators can reserve names, such as admin and support, or names
+// specific to their project, so that whoever asks first cannot register
+// them. A reserved name without an '@' reserves that local part at
+// every domain, and a reserved name with an '@' reserves that one
+// username. Registering a reserved username takes an override token,
+// which an admin issues for the username through the admin API and the
+// registration spends.
+//
+// Unlike the blocklist, the reserved names are part of the server's
+// Settings, so alpenhorn-pkg rereads them from its reserved names file
+// when it reloads. The override tokens are kept in the database.
+
+// ReservedOverrideTTL is how long an override token stays valid.
+var ReservedOverrideTTL = 7 * 24 * time.Hour
+
+var dbReservedOverridePrefix = []byte("reservedoverride:")
+
+func reservedOverrideKey(id *[64]byte) []byte {
+	return append(append([]byte(nil), dbReservedOverridePrefix...), id[:]...)
+}
+
+type reservedNames map[string]bool
+
+func newReservedNames(names []string) (reservedNames, error) {
+	if len(names) == 0 {
+		return nil, nil
+	}
+	r := make(reservedNames, len(names))
+	for _, name := range names {
+		if name == "" || name != strings.ToLower(name) || strings.ContainsAny(name, " \t\r\n") {
+			return nil, errors.New("invalid reserved name %q", name)
+		}
+		if strings.Contains(name, "@") {
+			if err := ValidateUsername(name); err != nil {
+				return nil, errors.Wrap(err, "reserved name")
+			}
+		}
+		r[name] = true
+	}
+	return r, nil
+}
+
+// reserved reports whether username is reserved.
+func (r reservedNames) reserved(username string) bool {
+	if r[username] {
+		return true
+	}
+	if ix := strings.LastIndex(username, "@"); ix > 0 {
+		return r[username[:ix]]
+	}
+	return false
+}
+
+// A ReservedOverride lets a user register a reserved username.
+type ReservedOverride struct {
+	Username string
+	Token    string
+	Expires  time.Time
+}
+
+type reservedOverrideRecord struct {
+	TokenHash []byte
+	Expires   time.Time
+}
+
+// IssueReservedOverride issues an override token for username,
+// replacing any earlier token for it. The user passes the token to
+// Client.RegisterReserved.
+func (srv *Server) IssueReservedOverride(username string) (*ReservedOverride, error) {
+	id, err := UsernameToIdentity(username)
+	if err != nil {
+		return nil, errorf(ErrInvalidUsername, "%s", err)
+	}
+	token := make([]byte, 16)
+	if _, err := rand.Read(token); err != nil {
+		panic(err)
+	}
+	o := &ReservedOverride{
+		Username: username,
+		Token:    base32.EncodeToString(token),
+		Expires:  srv.clock.Now().Add(ReservedOverrideTTL),
+	}
+	h := sha256.Sum256([]byte(o.Token))
+	data, err := json.Marshal(&reservedOverrideRecord{
+		TokenHash: h[:],
+		Expires:   o.Expires,
+	})
+	if err != nil {
+		panic(err)
+	}
+	err = srv.db.Update(func(tx kv.Txn) error {
+		return tx.Set(reservedOverrideKey(id), data)
+	})
+	if err != nil {
+		return nil, errorf(ErrDatabaseError, "%s", err)
+	}
+	srv.log.WithFields(log.Fields{"username": username}).Info("Issued reserved username override")
+	return o, nil
+}
+
+// checkReserved reports whether the username is reserved, returning an
+// error if it is and the registration does not carry a valid override
+// token. The caller spends the token with spendReservedOverride.
+func (srv *Server) checkReserved(live *liveSettings, id *[64]byte, args *registerArgs) (reserved bool, err error) {
+	if !live.reserved.reserved(args.Username) {
+		return false, nil
+	}
+	if args.OverrideToken == "" {
+		return true, errorf(ErrUsernameReserved, "%q", args.Username)
+	}
+	err = srv.db.View(func(tx kv.Txn) error {
+		_, err := srv.checkReservedOverride(tx, id, args.OverrideToken)
+		return err
+	})
+	return true, err
+}
+
+// spendReservedOverride deletes the username's override token in the
+// registration's transaction, after checking it again.
+func (srv *Server) spendReservedOverride(tx kv.Txn, id *[64]byte, token string) error {
+	key, err := srv.checkReservedOverride(tx, id, token)
+	if err != nil {
+		return err
+	}
+	if err := tx.Delete(key); err != nil {
+		return errorf(ErrDatabaseError, "%s", err)
+	}
+	return nil
+}
+
+func (srv *Server) checkReservedOverride(tx kv.Txn, id *[64]byte, token string) ([]byte, error) {
+	key := reservedOverrideKey(id)
+	data, err := tx.Get(key)
+	if err == kv.ErrNotFound {
+		return nil, errorf(ErrInvalidToken, "no override token for username")
+	} else if err != nil {
+		return nil, errorf(ErrDatabaseError, "%s", err)
+	}
+	var r reservedOverrideRecord
+	if err := json.Unmarshal(data, &r); err != nil {
+		return nil, errorf(ErrDatabaseError, "%s", err)
+	}
+	h := sha256.Sum256([]byte(token))
+	if subtle.ConstantTimeCompare(h[:], r.TokenHash) != 1 {
+		return nil, errorf(ErrInvalidToken, "wrong override token")
+	}
+	if srv.clock.Now().After(r.Expires) {
+		return nil, errorf(ErrExpiredToken, "override token expired at %s", r.Expires.Format(time.RFC3339))
+	}
+	return key, nil
+}
+
+// reservedHandler serves POST /admin/reserved/override, which takes a
+// JSON object with a Username and replies with a ReservedOverride.
+func (srv *Server) reservedHandler(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var args struct {
+		Username string
+	}
+	body := http.MaxBytesReader(w, req.Body, 4096)
+	if err := json.NewDecoder(body).Decode(&args); err != nil {
+		httpError(w, errorf(ErrBadRequestJSON, "%s", err))
+		return
+	}
+	o, err := srv.IssueReservedOverride(args.Username)
+	if err != nil {
+		if isInternalError(err) {
+			srv.log.Errorf("%s: %s", req.URL.Path, err)
+		}
+		httpError(w, err)
+		return
+	}
+	bs, err := json.Marshal(o)
+	if err != nil {
+		panic(err)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(bs)
+}
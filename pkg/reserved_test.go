@@ -0,0 +1,100 @@
+// Copyright 2018 David Lazar. All rights reserved.
+// Use of this source code is governed by the GNU AGPL
+// license that can be found in the LICENSE file.
+
+package pkg
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"vuvuzela.io/alpenhorn/clock"
+	"vuvuzela.io/alpenhorn/pkg/kv"
+)
+
+func TestReservedNames(t *testing.T) {
+	adminPub, _, _ := ed25519.GenerateKey(rand.Reader)
+	_, serverKey, _ := ed25519.GenerateKey(rand.Reader)
+	mock := clock.NewMock(time.Now())
+	srv, err := NewServer(&Config{
+		DB:               kv.NewMemory(),
+		SigningKey:       serverKey,
+		RegistrationMode: RegistrationFCFS,
+		AdminKey:         adminPub,
+		ReservedNames:    []string{"admin", "support@example.org"},
+		Clock:            mock,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+
+	issue := func(username string) *ReservedOverride {
+		body, _ := json.Marshal(map[string]string{"Username": username})
+		req := httptest.NewRequest("POST", "/admin/reserved/override", bytes.NewReader(body))
+		req.TLS = &tls.ConnectionState{
+			PeerCertificates: []*x509.Certificate{{PublicKey: adminPub}},
+		}
+		w := httptest.NewRecorder()
+		srv.AdminHandler().ServeHTTP(w, req)
+		if w.Code != http.StatusOK {
+			t.Fatalf("issuing override for %q: %d %s", username, w.Code, w.Body)
+		}
+		o := new(ReservedOverride)
+		if err := json.Unmarshal(w.Body.Bytes(), o); err != nil {
+			t.Fatal(err)
+		}
+		return o
+	}
+	register := func(username, override string) error {
+		loginKey, _, _ := ed25519.GenerateKey(rand.Reader)
+		_, err := srv.register(&registerArgs{Username: username, LoginKey: loginKey, OverrideToken: override})
+		return err
+	}
+
+	for _, username := range []string{"admin@example.org", "admin@example.com", "support@example.org"} {
+		if err := register(username, ""); errorCode(err) != ErrUsernameReserved {
+			t.Fatalf("%s: expected ErrUsernameReserved, got %v", username, err)
+		}
+	}
+	for _, username := range []string{"support@example.com", "administrator@example.org", "alice@admin"} {
+		if err := register(username, ""); err != nil {
+			t.Fatalf("%s: %s", username, err)
+		}
+	}
+
+	o := issue("admin@example.org")
+	if err := register("admin@example.org", "wrong"); errorCode(err) != ErrInvalidToken {
+		t.Fatalf("expected ErrInvalidToken, got %v", err)
+	}
+	if err := register("admin@example.com", o.Token); errorCode(err) != ErrInvalidToken {
+		t.Fatalf("override for another username: expected ErrInvalidToken, got %v", err)
+	}
+	if err := register("admin@example.org", o.Token); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := srv.getUser(nil, "admin@example.org"); err != nil {
+		t.Fatal(err)
+	}
+	stats, err := CollectDBStats(srv.db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.ReservedOverrides != 0 {
+		t.Fatalf("override was not spent: %d left", stats.ReservedOverrides)
+	}
+
+	o = issue("support@example.org")
+	mock.Add(ReservedOverrideTTL + time.Second)
+	if err := register("support@example.org", o.Token); errorCode(err) != ErrExpiredToken {
+		t.Fatalf("expected ErrExpiredToken, got %v", err)
+	}
+}
@@ -0,0 +1,155 @@
+// Copyright 2018 David Lazar. All rights reserved.
+// Use of this source code is governed by the GNU AGPL
+// license that can be found in the LICENSE file.
+
+//go:build !js
+// +build !js
+
+package pkg
+
+import (
+	"bytes"
+	"strconv"
+	"time"
+
+	"vuvuzela.io/alpenhorn/log"
+	"vuvuzela.io/alpenhorn/pkg/kv"
+)
+
+// A RoundRetention limits how long the server keeps rounds, on top of
+// the RoundCacheSize limit on how many it keeps. Every RoundGCInterval,
+// a garbage collector erases the keys of the rounds that fall outside
+// the retention, and the users' last extraction records from before
+// the rounds it keeps.
+type RoundRetention struct {
+	// Rounds, if nonzero, keeps only the last Rounds rounds, counting
+	// back from the newest committed round.
+	Rounds uint32
+
+	// Age, if nonzero, keeps only the rounds committed within Age.
+	Age time.Duration
+}
+
+func (r RoundRetention) enabled() bool {
+	return r.Rounds > 0 || r.Age > 0
+}
+
+// RoundGCInterval is how often the round garbage collector runs.
+var RoundGCInterval = time.Minute
+
+// roundGCBatch is how many records the garbage collector deletes in
+// each transaction.
+const roundGCBatch = 1000
+
+// startRoundGC starts the round garbage collector. It returns nil,
+// starting nothing, if the retention is not enabled.
+func (srv *Server) startRoundGC(retention RoundRetention) *janitor {
+	if !retention.enabled() {
+		return nil
+	}
+	return srv.newJanitor(RoundGCInterval, func() {
+		rounds, records, err := srv.collectRounds(retention)
+		if err != nil {
+			srv.log.Errorf("Round garbage collection: %s", err)
+		} else if rounds > 0 || records > 0 {
+			srv.log.WithFields(log.Fields{"rounds": rounds, "lastextract": records}).Info("Round garbage collection")
+		}
+	})
+}
+
+// collectRounds erases the rounds that fall outside retention and the
+// last extraction records from before the rounds that are left. It
+// returns how many rounds and records it erased.
+func (srv *Server) collectRounds(retention RoundRetention) (rounds int, records int, err error) {
+	now := srv.clock.Now()
+	var cutoff time.Time
+	if retention.Age > 0 {
+		cutoff = now.Add(-retention.Age)
+	}
+
+	srv.mu.Lock()
+	var newest uint32
+	for r := range srv.rounds {
+		if r > newest {
+			newest = r
+		}
+	}
+	var oldest uint32
+	if retention.Rounds > 0 && newest >= retention.Rounds {
+		oldest = newest - retention.Rounds + 1
+	}
+	for r, st := range srv.rounds {
+		if r < oldest || st.committed.Before(cutoff) {
+			delete(srv.rounds, r)
+			srv.metrics.extractions.Delete(strconv.FormatUint(uint64(r), 10))
+			rounds++
+		}
+	}
+	srv.mu.Unlock()
+	srv.metrics.reclaimed.Add(float64(rounds), "round")
+	if !srv.isLeader() {
+		// Each replica erases its own rounds, but only the
+		// leader deletes records.
+		return rounds, 0, nil
+	}
+
+	stale := func(value []byte) bool {
+		var e lastExtraction
+		if err := e.Unmarshal(value); err != nil {
+			return false
+		}
+		return e.Round < oldest || time.Unix(e.UnixTime, 0).Before(cutoff)
+	}
+	var keys [][]byte
+	err = srv.db.View(func(tx kv.Txn) error {
+		return tx.Iterate(dbUserPrefix, func(key, value []byte) error {
+			_, suffix, ok := splitUserKey(key)
+			if ok && bytes.Equal(suffix, lastExtractionSuffix) && stale(value) {
+				keys = append(keys, append([]byte(nil), key...))
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		return rounds, 0, errorf(ErrDatabaseError, "%s", err)
+	}
+	for len(keys) > 0 {
+		n := len(keys)
+		if n > roundGCBatch {
+			n = roundGCBatch
+		}
+		deleted := 0
+		err := srv.db.Update(func(tx kv.Txn) error {
+			// The user may have extracted since the scan. The
+			// records are all read before any is deleted, so
+			// that backends that batch writes, such as MySQL,
+			// can delete them in one go.
+			var del [][]byte
+			for _, key := range keys[:n] {
+				value, err := tx.Get(key)
+				if err == kv.ErrNotFound {
+					continue
+				} else if err != nil {
+					return err
+				}
+				if stale(value) {
+					del = append(del, key)
+				}
+			}
+			for _, key := range del {
+				if err := tx.Delete(key); err != nil {
+					return err
+				}
+			}
+			deleted = len(del)
+			return nil
+		})
+		if err != nil {
+			return rounds, records, errorf(ErrDatabaseError, "%s", err)
+		}
+		keys = keys[n:]
+		records += deleted
+		srv.metrics.reclaimed.Add(float64(deleted), "lastextract")
+	}
+	return rounds, records, nil
+}
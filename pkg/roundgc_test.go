@@ -0,0 +1,103 @@
+// Copyright 2018 David Lazar. All rights reserved.
+// Use of this source code is governed by the GNU AGPL
+// license that can be found in the LICENSE file.
+
+package pkg
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"vuvuzela.io/alpenhorn/clock"
+	"vuvuzela.io/alpenhorn/pkg/kv"
+)
+
+func TestCollectRounds(t *testing.T) {
+	mockClock := clock.NewMock(time.Now())
+	_, serverKey, _ := ed25519.GenerateKey(rand.Reader)
+	srv, err := NewServer(&Config{
+		DB:               kv.NewMemory(),
+		SigningKey:       serverKey,
+		RegistrationMode: RegistrationFCFS,
+		RoundCacheSize:   100,
+		Clock:            mockClock,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+
+	// Round r was committed r hours before round 10.
+	start := mockClock.Now()
+	srv.mu.Lock()
+	for r := uint32(1); r <= 10; r++ {
+		srv.rounds[r] = &roundState{committed: start.Add(time.Duration(r) * time.Hour)}
+	}
+	srv.mu.Unlock()
+	mockClock.Set(start.Add(10 * time.Hour))
+
+	lastExtract := map[string]lastExtraction{
+		"alice@example.org": {Round: 2, UnixTime: start.Add(2 * time.Hour).Unix()},
+		"bob@example.org":   {Round: 9, UnixTime: start.Add(9 * time.Hour).Unix()},
+		"carol@example.org": {Round: 6, UnixTime: start.Add(6 * time.Hour).Unix()},
+	}
+	err = srv.db.Update(func(tx kv.Txn) error {
+		for username, e := range lastExtract {
+			id := ValidUsernameToIdentity(username)
+			if err := tx.Set(dbUserKey(id, lastExtractionSuffix), e.Marshal()); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Keep the last 5 rounds: 6 through 10.
+	rounds, records, err := srv.collectRounds(RoundRetention{Rounds: 5})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rounds != 5 || records != 1 {
+		t.Fatalf("expected 5 rounds and 1 record erased, got %d and %d", rounds, records)
+	}
+	if _, ok := srv.getRound(5); ok {
+		t.Fatal("round 5 was kept")
+	}
+	if _, ok := srv.getRound(6); !ok {
+		t.Fatal("round 6 was erased")
+	}
+
+	// Keep the rounds committed in the last 2.5 hours: 8 through 10.
+	rounds, records, err = srv.collectRounds(RoundRetention{Age: 150 * time.Minute})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rounds != 2 || records != 1 {
+		t.Fatalf("expected 2 rounds and 1 record erased, got %d and %d", rounds, records)
+	}
+
+	err = srv.db.View(func(tx kv.Txn) error {
+		for username := range lastExtract {
+			_, err := tx.Get(dbUserKey(ValidUsernameToIdentity(username), lastExtractionSuffix))
+			if kept := err == nil; kept != (username == "bob@example.org") {
+				t.Errorf("%s: kept=%v", username, kept)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	w := httptest.NewRecorder()
+	srv.Metrics().ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+	if !strings.Contains(w.Body.String(), `alpenhorn_pkg_gc_reclaimed_total{kind="round"} 7`) {
+		t.Fatalf("reclaimed rounds not counted:\n%s", w.Body)
+	}
+}
@@ -0,0 +1,170 @@
+// Copyright 2018 David Lazar. All rights reserved.
+// Use of this source code is governed by the GNU AGPL
+// license that can be found in the LICENSE file.
+
+//go:build !js
+// +build !js
+
+package pkg
+
+import (
+	"crypto/rand"
+	"strconv"
+	"sync"
+
+	"vuvuzela.io/crypto/bls"
+	"vuvuzela.io/crypto/ibe"
+)
+
+// Generating a round's IBE and BLS keys is the slow part of a commit.
+// A background goroutine generates the bn256 keys for upcoming rounds
+// ahead of time, so a commit only has to take a key pair from the pool.
+// The keys do not depend on the round number, so it does not matter
+// which round ends up with which pair. Keys for other curves are
+// generated when a round asks for them.
+//
+// After a commit, the server keeps the keys of the RoundCacheSize
+// rounds that clients used most recently, so that clients that are
+// catching up can still extract keys for rounds they missed. Erasing a
+// round's master keys is what keeps the round's friend requests secret
+// after the server is compromised, so the cache trades forward secrecy
+// for availability. Config.RoundRetention can also erase rounds by age;
+// see roundgc.go.
+//
+// Each PKG generates its round keys on its own. Clients aggregate the
+// master public keys of every PKG in the round, and the identity keys
+// they extract from every PKG, so a bn256 round needs every PKG to be
+// up. On curves with threshold keys, the coordinator can instead have
+// the PKGs turn their master keys into shares of a joint one, so that
+// clients can extract from any threshold of them; see dkg.go.
+//
+// Round master secrets live only in memory, sealed (see roundseal.go):
+// the server never writes them to its database, so a dump or backup of
+// the database cannot decrypt any round, and a restarted server starts
+// without rounds. Keep it that way; a round that must survive a restart
+// should be committed again by the coordinator. Replicas in a cluster
+// get the leader's rounds from the leader itself; see cluster.go.
+
+const (
+	DefaultPrecomputeRounds = 2
+	DefaultRoundCacheSize   = 2
+)
+
+// roundKeys are a round's keys, with the master secrets sealed; see
+// roundseal.go.
+type roundKeys struct {
+	masterPublicKey *ibe.MasterPublicKey
+	sealedMasterKey []byte
+	blsPublicKey    *bls.PublicKey
+	sealedBLSKey    []byte
+}
+
+func newRoundKeys(kek *roundKEK) *roundKeys {
+	ibePub, ibePriv := ibe.Setup(rand.Reader)
+	blsPub, blsPriv, err := bls.GenerateKey(rand.Reader)
+	if err != nil {
+		panic(err)
+	}
+	k := &roundKeys{
+		masterPublicKey: ibePub,
+		blsPublicKey:    blsPub,
+	}
+	k.sealedMasterKey, k.sealedBLSKey = kek.sealKeys(ibePriv, blsPriv)
+	return k
+}
+
+// A keyPool holds round keys generated ahead of time.
+type keyPool struct {
+	kek       *roundKEK
+	keys      chan *roundKeys
+	done      chan struct{}
+	stopped   chan struct{}
+	closeOnce sync.Once
+}
+
+// newKeyPool starts generating keys for size rounds, sealed with kek.
+// If size is not positive, the pool generates keys on demand.
+func newKeyPool(size int, kek *roundKEK) *keyPool {
+	if size <= 0 {
+		return &keyPool{kek: kek}
+	}
+	p := &keyPool{
+		kek:     kek,
+		keys:    make(chan *roundKeys, size),
+		done:    make(chan struct{}),
+		stopped: make(chan struct{}),
+	}
+	go p.fill()
+	return p
+}
+
+func (p *keyPool) fill() {
+	defer close(p.stopped)
+	for {
+		k := newRoundKeys(p.kek)
+		select {
+		case p.keys <- k:
+		case <-p.done:
+			return
+		}
+	}
+}
+
+// get returns precomputed keys if there are any, and otherwise
+// generates new ones.
+func (p *keyPool) get() *roundKeys {
+	select {
+	case k := <-p.keys:
+		return k
+	default:
+	}
+	return newRoundKeys(p.kek)
+}
+
+// close stops generating keys. It waits for the keys being generated,
+// so the KEK can be destroyed once close returns.
+func (p *keyPool) close() {
+	if p.done != nil {
+		p.closeOnce.Do(func() { close(p.done) })
+		<-p.stopped
+	}
+}
+
+// getRound returns the state of a round and marks it as used. A
+// cluster follower fetches rounds it does not have from the leader.
+func (srv *Server) getRound(round uint32) (*roundState, bool) {
+	srv.mu.Lock()
+	st, ok := srv.rounds[round]
+	if ok {
+		srv.roundUses++
+		st.lastUsed = srv.roundUses
+	}
+	srv.mu.Unlock()
+	if !ok && srv.cluster != nil {
+		return srv.fetchRound(round)
+	}
+	return st, ok
+}
+
+// evictRoundsLocked erases the least recently used rounds other than
+// current until at most RoundCacheSize are left. It must be called
+// with srv.mu held.
+func (srv *Server) evictRoundsLocked(current uint32) {
+	for len(srv.rounds) > srv.roundCacheSize {
+		var lru uint32
+		var lruState *roundState
+		for r, st := range srv.rounds {
+			if r == current {
+				continue
+			}
+			if lruState == nil || st.lastUsed < lruState.lastUsed || st.lastUsed == lruState.lastUsed && r < lru {
+				lru, lruState = r, st
+			}
+		}
+		if lruState == nil {
+			return
+		}
+		delete(srv.rounds, lru)
+		srv.metrics.extractions.Delete(strconv.FormatUint(uint64(lru), 10))
+	}
+}
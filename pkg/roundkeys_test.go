@@ -0,0 +1,129 @@
+// Copyright 2018 David Lazar. All rights reserved.
+// Use of this source code is governed by the GNU AGPL
+// license that can be found in the LICENSE file.
+
+package pkg
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"vuvuzela.io/alpenhorn/pkg/kv"
+)
+
+func TestRoundCache(t *testing.T) {
+	coordinatorPub, _, _ := ed25519.GenerateKey(rand.Reader)
+	_, serverKey, _ := ed25519.GenerateKey(rand.Reader)
+	srv, err := NewServer(&Config{
+		DB:               kv.NewMemory(),
+		SigningKey:       serverKey,
+		CoordinatorKey:   coordinatorPub,
+		RegTokenHandler:  func(string, string) error { return nil },
+		PrecomputeRounds: 1,
+		RoundCacheSize:   2,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+
+	commit := func(round uint32) {
+		body, _ := json.Marshal(&commitArgs{Round: round, coordinatorNonce: newCoordinatorNonce(time.Now())})
+		req := httptest.NewRequest("POST", "/commit", bytes.NewReader(body))
+		req.TLS = &tls.ConnectionState{
+			PeerCertificates: []*x509.Certificate{{PublicKey: coordinatorPub}},
+		}
+		w := httptest.NewRecorder()
+		srv.commitHandler(w, req)
+		if w.Code != 200 {
+			t.Fatalf("commit %d: %d %s", round, w.Code, w.Body)
+		}
+	}
+
+	commit(1)
+	commit(2)
+	// A client catching up uses round 1, so round 2 is evicted first.
+	if _, ok := srv.getRound(1); !ok {
+		t.Fatal("round 1 missing")
+	}
+	commit(3)
+	if _, ok := srv.getRound(2); ok {
+		t.Fatal("least recently used round was not evicted")
+	}
+	if _, ok := srv.getRound(1); !ok {
+		t.Fatal("recently used round was evicted")
+	}
+	commit(4)
+	if len(srv.rounds) != 2 || srv.rounds[1] == nil || srv.rounds[4] == nil {
+		t.Fatalf("expected rounds 1 and 4, got %d rounds", len(srv.rounds))
+	}
+
+	st1, _ := srv.getRound(1)
+	st4, _ := srv.getRound(4)
+	if st1.masterPublicKey == st4.masterPublicKey {
+		t.Fatal("rounds share precomputed keys")
+	}
+}
+
+func TestRoundSecretsNotStored(t *testing.T) {
+	coordinatorPub, _, _ := ed25519.GenerateKey(rand.Reader)
+	_, serverKey, _ := ed25519.GenerateKey(rand.Reader)
+	db := kv.NewMemory()
+	srv, err := NewServer(&Config{
+		DB:               db,
+		SigningKey:       serverKey,
+		CoordinatorKey:   coordinatorPub,
+		RegistrationMode: RegistrationFCFS,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+
+	body, _ := json.Marshal(&commitArgs{Round: 1, coordinatorNonce: newCoordinatorNonce(time.Now())})
+	req := httptest.NewRequest("POST", "/commit", bytes.NewReader(body))
+	req.TLS = &tls.ConnectionState{
+		PeerCertificates: []*x509.Certificate{{PublicKey: coordinatorPub}},
+	}
+	w := httptest.NewRecorder()
+	srv.commitHandler(w, req)
+	if w.Code != 200 {
+		t.Fatalf("commit: %d %s", w.Code, w.Body)
+	}
+	loginKey, _, _ := ed25519.GenerateKey(rand.Reader)
+	if _, err := srv.register(&registerArgs{Username: "alice@example.org", LoginKey: loginKey}); err != nil {
+		t.Fatal(err)
+	}
+
+	st, _ := srv.getRound(1)
+	secret, err := srv.roundKEK.open(st.sealedMasterKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The server holds the secret sealed.
+	if bytes.Contains(st.sealedMasterKey, secret) {
+		t.Fatal("round master secret held in the clear")
+	}
+	otherKEK := newRoundKEK(new([32]byte), nil)
+	if _, err := otherKEK.open(st.sealedMasterKey); err == nil {
+		t.Fatal("round master secret opened with another KEK")
+	}
+	err = db.View(func(tx kv.Txn) error {
+		return tx.Iterate(nil, func(key, value []byte) error {
+			if bytes.Contains(value, secret) {
+				t.Errorf("round master secret stored under %q", key)
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
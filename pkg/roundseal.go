@@ -0,0 +1,141 @@
+// Copyright 2018 David Lazar. All rights reserved.
+// Use of this source code is governed by the GNU AGPL
+// license that can be found in the LICENSE file.
+
+//go:build !js
+// +build !js
+
+package pkg
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+
+	"golang.org/x/crypto/nacl/secretbox"
+
+	"vuvuzela.io/alpenhorn/errors"
+	"vuvuzela.io/alpenhorn/internal/keysafe"
+	"vuvuzela.io/crypto/bls"
+	"vuvuzela.io/crypto/ibe"
+)
+
+// Round master secrets are sealed with a key-encryption key (the KEK)
+// as soon as they are generated. The server holds them sealed, in its
+// key pool and round cache alike, and opens a round's secrets only for
+// the length of an extraction, zeroing them after. A cluster leader
+// sends followers the sealed secrets as they are, inside the box
+// sealed with the cluster key, so every replica must have the same
+// KEK. The KEK is Config.RoundKEK, or is derived from the signing key,
+// which the replicas share, unless the key is behind a Signer such as
+// an HSM. It is kept in locked memory where the platform allows it.
+//
+// The secrets are still never written to the database; see
+// roundkeys.go.
+
+// roundKEKInfo separates the KEK derived from the signing key from the
+// signing key's other uses.
+const roundKEKInfo = "alpenhorn pkg round kek"
+
+type roundKEK struct {
+	secret *keysafe.Secret
+}
+
+// newRoundKEK returns the KEK in key, or derived from the signer's key
+// if key is nil and the signer holds an ed25519 private key. Otherwise,
+// the KEK is random, so only this process can open the secrets it
+// seals.
+func newRoundKEK(key *[32]byte, signer crypto.Signer) *roundKEK {
+	kek := make([]byte, 32)
+	signingKey, _ := signer.(ed25519.PrivateKey)
+	switch {
+	case key != nil:
+		copy(kek, key[:])
+	case len(signingKey) == ed25519.PrivateKeySize:
+		mac := hmac.New(sha256.New, signingKey.Seed())
+		mac.Write([]byte(roundKEKInfo))
+		kek = mac.Sum(kek[:0])
+	default:
+		if _, err := rand.Read(kek); err != nil {
+			panic(err)
+		}
+	}
+	k := &roundKEK{secret: keysafe.New(kek)}
+	// Without locked memory the KEK may be swapped out, which is no
+	// worse than the secrets it seals were before.
+	k.secret.Lock()
+	return k
+}
+
+func (k *roundKEK) key() *[32]byte {
+	return (*[32]byte)(k.secret.Bytes())
+}
+
+// seal seals secret with the KEK and zeros secret.
+func (k *roundKEK) seal(secret []byte) []byte {
+	var nonce [24]byte
+	if _, err := rand.Read(nonce[:]); err != nil {
+		panic(err)
+	}
+	box := secretbox.Seal(nonce[:], secret, &nonce, k.key())
+	keysafe.Zero(secret)
+	return box
+}
+
+// open opens a secret sealed with the KEK. The caller must zero it
+// when it is done with it.
+func (k *roundKEK) open(box []byte) ([]byte, error) {
+	if len(box) < 24+secretbox.Overhead {
+		return nil, errors.New("short sealed round secret")
+	}
+	var nonce [24]byte
+	copy(nonce[:], box)
+	secret, ok := secretbox.Open(nil, box[24:], &nonce, k.key())
+	if !ok {
+		return nil, errors.New("round secret does not open with the round KEK")
+	}
+	return secret, nil
+}
+
+// sealKeys seals a round's bn256 master secrets.
+func (k *roundKEK) sealKeys(ibePriv *ibe.MasterPrivateKey, blsPriv *bls.PrivateKey) (sealedIBE []byte, sealedBLS []byte) {
+	ibeBytes, err := ibePriv.MarshalBinary()
+	if err != nil {
+		panic(err)
+	}
+	blsBytes, err := blsPriv.MarshalBinary()
+	if err != nil {
+		panic(err)
+	}
+	return k.seal(ibeBytes), k.seal(blsBytes)
+}
+
+// openKeys opens a round's bn256 master secrets.
+func (k *roundKEK) openKeys(st *roundState) (*ibe.MasterPrivateKey, *bls.PrivateKey, error) {
+	ibeBytes, err := k.open(st.sealedMasterKey)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer keysafe.Zero(ibeBytes)
+	blsBytes, err := k.open(st.sealedBLSKey)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer keysafe.Zero(blsBytes)
+
+	ibePriv := new(ibe.MasterPrivateKey)
+	if err := ibePriv.UnmarshalBinary(ibeBytes); err != nil {
+		return nil, nil, errors.Wrap(err, "master private key")
+	}
+	blsPriv := new(bls.PrivateKey)
+	if err := blsPriv.UnmarshalBinary(blsBytes); err != nil {
+		return nil, nil, errors.Wrap(err, "bls private key")
+	}
+	return ibePriv, blsPriv, nil
+}
+
+func (k *roundKEK) destroy() {
+	k.secret.Destroy()
+}
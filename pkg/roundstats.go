@@ -0,0 +1,161 @@
+// Copyright 2018 David Lazar. All rights reserved.
+// Use of this source code is governed by the GNU AGPL
+// license that can be found in the LICENSE file.
+
+//go:build !js
+// +build !js
+
+package pkg
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"vuvuzela.io/alpenhorn/internal/metrics"
+)
+
+// The server keeps extraction statistics for each of its most recent
+// rounds, for operators and researchers studying load patterns: how
+// many keys it extracted, how many extractions failed and why, and how
+// long extractions took. Unlike the Prometheus metrics, which drop a
+// round once its keys are erased, the statistics outlive the round's
+// keys, up to RoundStatsHistory rounds. They are read with RoundStats
+// or at /admin/roundstats.
+
+// RoundStatsHistory is how many rounds the server keeps statistics for.
+const RoundStatsHistory = 100
+
+// RoundStats are the extraction statistics of a round.
+type RoundStats struct {
+	Round     uint32
+	Committed time.Time
+
+	// Extractions is how many keys the server extracted in the round,
+	// including each round of batch extractions.
+	Extractions uint64
+
+	// Failures counts the failed extractions by error code.
+	Failures map[string]uint64 `json:",omitempty"`
+
+	// Latency is the latency of successful single-round extractions.
+	Latency LatencyHistogram
+}
+
+// A LatencyHistogram counts latencies in buckets.
+type LatencyHistogram struct {
+	// Buckets are the upper bounds of the buckets, in seconds. Counts
+	// has one more entry than Buckets: Counts[i] is how many latencies
+	// were at most Buckets[i] and above the bucket before, and the
+	// last count is of latencies above every bound.
+	Buckets []float64
+	Counts  []uint64
+
+	// Count and Sum are the number and total, in seconds, of the
+	// latencies.
+	Count uint64
+	Sum   float64
+}
+
+func newLatencyHistogram() LatencyHistogram {
+	return LatencyHistogram{
+		Buckets: metrics.LatencyBuckets,
+		Counts:  make([]uint64, len(metrics.LatencyBuckets)+1),
+	}
+}
+
+func (h *LatencyHistogram) observe(d time.Duration) {
+	v := d.Seconds()
+	i := sort.SearchFloat64s(h.Buckets, v)
+	h.Counts[i]++
+	h.Count++
+	h.Sum += v
+}
+
+type roundStatsTable struct {
+	mu     sync.Mutex
+	rounds map[uint32]*RoundStats
+}
+
+// start begins collecting statistics for a newly committed round,
+// dropping the oldest rounds beyond RoundStatsHistory.
+func (t *roundStatsTable) start(round uint32, committed time.Time) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.rounds == nil {
+		t.rounds = make(map[uint32]*RoundStats)
+	}
+	if _, ok := t.rounds[round]; ok {
+		return
+	}
+	t.rounds[round] = &RoundStats{
+		Round:     round,
+		Committed: committed,
+		Latency:   newLatencyHistogram(),
+	}
+	for len(t.rounds) > RoundStatsHistory {
+		oldest := round
+		for r := range t.rounds {
+			if r < oldest {
+				oldest = r
+			}
+		}
+		delete(t.rounds, oldest)
+	}
+}
+
+// record counts an extraction in the round. Extractions in rounds
+// without statistics, such as rounds the server never held, are not
+// counted, so clients cannot grow the table.
+func (t *roundStatsTable) record(round uint32, latency time.Duration, err error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	st, ok := t.rounds[round]
+	if !ok {
+		return
+	}
+	if err != nil {
+		if st.Failures == nil {
+			st.Failures = make(map[string]uint64)
+		}
+		st.Failures[errorCode(err).String()]++
+		return
+	}
+	st.Extractions++
+	if latency > 0 {
+		st.Latency.observe(latency)
+	}
+}
+
+// RoundStats returns the extraction statistics of the server's recent
+// rounds, oldest first.
+func (srv *Server) RoundStats() []RoundStats {
+	t := &srv.roundStats
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	stats := make([]RoundStats, 0, len(t.rounds))
+	for _, st := range t.rounds {
+		c := *st
+		c.Failures = make(map[string]uint64, len(st.Failures))
+		for code, n := range st.Failures {
+			c.Failures[code] = n
+		}
+		c.Latency.Counts = append([]uint64(nil), st.Latency.Counts...)
+		stats = append(stats, c)
+	}
+	sort.Slice(stats, func(i, j int) bool {
+		return stats[i].Round < stats[j].Round
+	})
+	return stats
+}
+
+func (srv *Server) roundStatsHandler(w http.ResponseWriter, req *http.Request) {
+	bs, err := json.Marshal(srv.RoundStats())
+	if err != nil {
+		panic(err)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(bs)
+}
@@ -0,0 +1,70 @@
+// Copyright 2018 David Lazar. All rights reserved.
+// Use of this source code is governed by the GNU AGPL
+// license that can be found in the LICENSE file.
+
+package pkg_test
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"testing"
+
+	"vuvuzela.io/alpenhorn/edhttp"
+	"vuvuzela.io/alpenhorn/pkg"
+)
+
+func TestRoundStats(t *testing.T) {
+	testpkg, coordinatorClient := launchPKG(t, func(username string, token string) error {
+		return nil
+	})
+	defer testpkg.Close()
+
+	alicePub, aliceKey, _ := ed25519.GenerateKey(rand.Reader)
+	client := &pkg.Client{
+		Username:        "alice@example.org",
+		LoginKey:        aliceKey,
+		UserLongTermKey: alicePub,
+		HTTPClient:      new(edhttp.Client),
+	}
+	server := testpkg.PublicServerConfig
+	if err := client.Register(server, ""); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := coordinatorClient.NewRound([]pkg.PublicServerConfig{server}, 42); err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 2; i++ {
+		if _, err := client.Extract(server, 42); err != nil {
+			t.Fatal(err)
+		}
+	}
+	impostor := *client
+	_, impostor.LoginKey, _ = ed25519.GenerateKey(rand.Reader)
+	if _, err := impostor.Extract(server, 42); err == nil {
+		t.Fatal("expected error extracting with the wrong login key")
+	}
+	// Rounds the server never held are not tracked.
+	if _, err := client.Extract(server, 43); err == nil {
+		t.Fatal("expected error extracting from an unknown round")
+	}
+
+	stats := testpkg.PKGServer.RoundStats()
+	if len(stats) != 1 || stats[0].Round != 42 {
+		t.Fatalf("unexpected round stats: %+v", stats)
+	}
+	st := stats[0]
+	if st.Extractions != 2 || st.Latency.Count != 2 {
+		t.Fatalf("expected 2 extractions, got %d (%d latencies)", st.Extractions, st.Latency.Count)
+	}
+	if st.Failures[pkg.ErrInvalidSignature.String()] != 1 {
+		t.Fatalf("unexpected failures: %v", st.Failures)
+	}
+	var n uint64
+	for _, c := range st.Latency.Counts {
+		n += c
+	}
+	if n != 2 || len(st.Latency.Counts) != len(st.Latency.Buckets)+1 {
+		t.Fatalf("unexpected latency histogram: %+v", st.Latency)
+	}
+}
@@ -2,199 +2,1025 @@
 // Use of this source code is governed by the GNU AGPL
 // license that can be found in the LICENSE file.
 
+//go:build !js
+// +build !js
+
 // Package pkg implements a Private Key Generator (PKG) for
 // Identity-Based Encryption (IBE).
 package pkg
 
 import (
 	"bytes"
+	"context"
+	"crypto"
 	"crypto/ed25519"
 	"crypto/rand"
-	"crypto/sha512"
+	"crypto/rsa"
 	"encoding/binary"
 	"encoding/hex"
 	"encoding/json"
+	"io"
+	"net"
 	"net/http"
+	"runtime"
 	"sort"
-	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 
-	"github.com/dgraph-io/badger"
+	"go.opentelemetry.io/otel/trace"
 
-	"vuvuzela.io/alpenhorn/edhttp"
+	"vuvuzela.io/alpenhorn/clock"
 	"vuvuzela.io/alpenhorn/errors"
+	"vuvuzela.io/alpenhorn/internal/keysafe"
+	"vuvuzela.io/alpenhorn/internal/tracing"
+	"vuvuzela.io/alpenhorn/internal/version"
 	"vuvuzela.io/alpenhorn/log"
+	"vuvuzela.io/alpenhorn/pairing"
+	"vuvuzela.io/alpenhorn/pkg/kv"
 	"vuvuzela.io/crypto/bls"
 	"vuvuzela.io/crypto/ibe"
 )
 
-// Use github.com/davidlazar/easyjson:
-//go:generate easyjson server.go
-
 // A Server is a Private Key Generator (PKG).
 type Server struct {
-	db  *badger.DB
-	log *log.Logger
+	db     kv.DB
+	log    *log.Logger
+	clock  clock.Clock
+	tracer trace.Tracer
+
+	// replica serves scans that authorize nothing, such as the
+	// dashboard's user count. It is db if Config.ReplicaDB is nil.
+	replica kv.DB
 
 	mu     sync.Mutex
 	rounds map[uint32]*roundState
 
-	privateKey     ed25519.PrivateKey
-	publicKey      ed25519.PublicKey
-	coordinatorKey ed25519.PublicKey
-	registrarKey   ed25519.PublicKey
+	// latestRound is the latest round the coordinator revealed, at
+	// lastReveal; see health.go. lastCoordinator is when a coordinator
+	// last committed or revealed a round.
+	latestRound     uint32
+	lastReveal      time.Time
+	lastCoordinator time.Time
+	readyRoundAge   time.Duration
 
-	regTokenHandler RegTokenHandler
-}
+	roundUses      uint64
+	roundCacheSize int
+
+	maxRequestBytes int64
+	handlerSlots    chan struct{}
+	keyPool         *keyPool
+	roundKEK        *roundKEK
+	extractWorkers  *workerPool
+
+	endpointSlots        map[string]chan struct{}
+	endpointQueueTimeout time.Duration
+
+	// closeMu guards closing, which is set by Shutdown. Requests in
+	// progress are counted by inflight.
+	closeMu  sync.Mutex
+	closing  bool
+	inflight sync.WaitGroup
+
+	// logMu serializes appends to the attestation log.
+	logMu sync.Mutex
+
+	// regLogMu serializes transactions that append to the
+	// registration log.
+	regLogMu sync.Mutex
+
+	// settings holds the *liveSettings that Reload can change;
+	// see reload.go. reloadMu serializes reloads.
+	settings atomic.Value
+	reloadMu sync.Mutex
+
+	// maintenance holds the *Maintenance set by SetMaintenance; see
+	// maintenancemode.go.
+	maintenance atomic.Value
+
+	signer       crypto.Signer
+	publicKey    ed25519.PublicKey
+	registrarKey ed25519.PublicKey
+	adminKey     ed25519.PublicKey
+
+	// signatureScheme signs extract replies and rename attestations;
+	// see sigscheme.go. Everything else is signed with Ed25519.
+	signatureScheme SignatureScheme
+
+	// previousSigningKey is the key the server is rotating away
+	// from; see signingkey.go.
+	previousSigningKey ed25519.PrivateKey
+	previousKeyExpires time.Time
+
+	auditLog *auditLog
+
+	abuseReportRetention time.Duration
+
+	webhooks *webhooks
+	janitor  *janitor
+	roundGC  *janitor
+	sweeper  *janitor
+
+	// cluster is nil unless the server is a replica in a cluster;
+	// see cluster.go.
+	cluster *cluster
+
+	isBanned       func(username string) bool
+	usernamePolicy UsernamePolicy
+	blocklist      *blocklist
+	captcha        CaptchaVerifier
+	domainQuotas   map[string]int
 
-type RegTokenHandler func(username string, token string) error
+	registerWorkBits int
+	challengeKey     []byte
+
+	extractQuota  ExtractQuota
+	extractCounts extractCounter
+
+	requestLog *requestLogger
+
+	lookups        lookupTracker
+	lookupLimit    int
+	lookupWindow   time.Duration
+	lookupWorkBits int
+
+	loginKeyGrace time.Duration
+	maxLoginKeys  int
+
+	metrics *serverMetrics
+
+	// extractRate and userCount are shown on the dashboard.
+	extractRate eventRate
+	userCount   userCount
+
+	roundStats roundStatsTable
+}
 
 type roundState struct {
-	masterPublicKey  *ibe.MasterPublicKey
-	masterPrivateKey *ibe.MasterPrivateKey
-	blsPublicKey     *bls.PublicKey
-	blsPrivateKey    *bls.PrivateKey
-	revealSignature  []byte
+	masterPublicKey *ibe.MasterPublicKey
+	blsPublicKey    *bls.PublicKey
+	revealSignature []byte
+
+	// sealedMasterKey and sealedBLSKey are the round's master
+	// secrets, sealed with the round KEK; see roundseal.go.
+	sealedMasterKey []byte
+	sealedBLSKey    []byte
+
+	// lastUsed orders rounds for eviction; see roundkeys.go.
+	lastUsed uint64
+
+	// committed is when the round was committed; see roundgc.go.
+	committed time.Time
+
+	// curves holds the round keys for curves other than bn256.
+	curves map[string]*curveRoundKeys
+}
+
+type curveRoundKeys struct {
+	curve pairing.Curve
+	CurveKeys
+	sealedMasterKey []byte
+	sealedBLSKey    []byte
+
+	// dkg is set if the PKG generates the round's master key on the
+	// curve with the other PKGs; see dkg.go. Until the DKG is
+	// finished, when Threshold is set, sealedMasterKey is the PKG's
+	// part of the master key rather than its share of it.
+	dkg *dkgState
+}
+
+// newCurveRoundKeys generates round keys for the named curves,
+// skipping bn256, which every round has, and seals their master
+// secrets with kek.
+func newCurveRoundKeys(names []string, kek *roundKEK) (map[string]*curveRoundKeys, error) {
+	var keys map[string]*curveRoundKeys
+	for _, name := range names {
+		if name == pairing.BN256 || keys[name] != nil {
+			continue
+		}
+		curve, err := pairing.Lookup(name)
+		if err != nil {
+			return nil, errorf(ErrUnknownCurve, "%s", err)
+		}
+		k := &curveRoundKeys{curve: curve}
+		var masterKey, blsKey []byte
+		k.MasterPublicKey, masterKey, err = curve.IBESetup(rand.Reader)
+		if err != nil {
+			return nil, errorf(ErrUnknown, "%s ibe setup: %s", name, err)
+		}
+		k.sealedMasterKey = kek.seal(masterKey)
+		k.BLSPublicKey, blsKey, err = curve.BLSGenerateKey(rand.Reader)
+		if err != nil {
+			return nil, errorf(ErrUnknown, "%s bls keygen: %s", name, err)
+		}
+		k.sealedBLSKey = kek.seal(blsKey)
+		if keys == nil {
+			keys = make(map[string]*curveRoundKeys)
+		}
+		keys[name] = k
+	}
+	return keys, nil
+}
+
+func (st *roundState) curvePublicKeys() map[string]*CurveKeys {
+	if len(st.curves) == 0 {
+		return nil
+	}
+	keys := make(map[string]*CurveKeys, len(st.curves))
+	for name, k := range st.curves {
+		keys[name] = &k.CurveKeys
+	}
+	return keys
 }
 
 // A Config is used to configure a PKG server.
 type Config struct {
-	// DBPath is the path to the Badger database.
-	DBPath string
+	// DB is the database the server keeps its state in. The server
+	// closes DB when it is closed. If DB is nil, the server opens the
+	// database at DBPath with DBBackend, kv.Badger if it is empty; a
+	// kv.MySQL DBPath is the data source name. Tests can use
+	// kv.NewMemory.
+	DB        kv.DB
+	DBPath    string
+	DBBackend string
+
+	// MaxOpenConns, MaxIdleConns, and ConnMaxLifetime size the
+	// connection pools of the MySQL databases that the server opens,
+	// DB and ReplicaDB; see kv.MySQLPool. Zero means no limit.
+	MaxOpenConns    int
+	MaxIdleConns    int
+	ConnMaxLifetime time.Duration
+
+	// ManualMigrations stops NewServer from migrating the database
+	// to the current schema. Instead, NewServer fails unless the
+	// database is already up to date; see Migrate.
+	ManualMigrations bool
+
+	// ReplicaDB, if not nil, is a read-only copy of DB that the server
+	// runs the reads that authorize nothing on, so that they do not
+	// load the primary of a networked backend: its full scans, such
+	// as counting users for the dashboard, and the last extraction
+	// that a status request reports. Registrations are always looked
+	// up in DB, so extractions, which read nothing else, go to DB: a
+	// replica that lags behind it would accept a login key after the
+	// user revoked or rotated it. The server closes ReplicaDB when it
+	// is closed.
+	ReplicaDB kv.DB
+
+	// ReplicaSource, if ReplicaDB is nil, is the data source name of
+	// a MySQL read replica of DB that the server opens as ReplicaDB.
+	ReplicaSource string
+
+	// DataKeys, if not empty, are the keys the server encrypts users'
+	// login keys and contact details in DB with, and blinds the
+	// usernames in its keys with; see atrest.go.
+	// DataKeys[0] encrypts new records, and the others decrypt records
+	// written before it was rotated in.
+	DataKeys []kv.SealKey
 
 	// SigningKey is the PKG server's long-term signing key.
 	SigningKey ed25519.PrivateKey
 
+	// Signer, if not nil, is used in place of SigningKey, so that the
+	// key can be kept in an HSM or key management service. See
+	// OpenSigner.
+	Signer crypto.Signer
+
+	// PreviousSigningKey, if not nil, is the signing key the server
+	// is rotating away from. Until PreviousKeyExpires, the server
+	// signs extract replies with it as well as SigningKey, and
+	// accepts requests made to either key.
+	PreviousSigningKey ed25519.PrivateKey
+	PreviousKeyExpires time.Time
+
+	// RoundKEK, if not nil, seals round master secrets in memory and
+	// when a cluster leader sends them to its followers; see
+	// roundseal.go. If nil, the KEK is derived from SigningKey, or
+	// from Signer if it is an ed25519.PrivateKey. A cluster server
+	// with another Signer must set it, the same on every replica.
+	RoundKEK *[32]byte
+
+	// PrecomputeRounds is how many rounds' keys the server generates
+	// ahead of time. If zero, DefaultPrecomputeRounds is used. If
+	// negative, keys are generated when a round is committed.
+	PrecomputeRounds int
+
+	// MaxRequestBytes caps the size of request bodies. If zero,
+	// DefaultMaxRequestBytes is used. See limits.go.
+	MaxRequestBytes int64
+
+	// MaxConcurrentRequests, if nonzero, is the most client requests
+	// the server handles at once. Requests beyond it are refused
+	// with ErrServerBusy.
+	MaxConcurrentRequests int
+
+	// EndpointLimits caps the requests the server handles at once on
+	// each path it lists, such as {"/extract": 512, "/register": 32}.
+	// Requests beyond a path's limit wait for EndpointQueueTimeout, or
+	// DefaultEndpointQueueTimeout if it is zero, and are then refused
+	// with ErrServerBusy. See limits.go.
+	EndpointLimits       map[string]int
+	EndpointQueueTimeout time.Duration
+
+	// ReadyRoundAge is how long after the coordinator last revealed
+	// a round the server reports itself ready on /readyz. If zero,
+	// DefaultReadyRoundAge is used.
+	ReadyRoundAge time.Duration
+
+	// RoundCacheSize is how many rounds' keys the server keeps for
+	// extraction, evicting the least recently used. If zero,
+	// DefaultRoundCacheSize is used. See roundkeys.go.
+	RoundCacheSize int
+
+	// RoundRetention limits how long the server keeps rounds' keys
+	// and users' last extraction records; see roundgc.go.
+	RoundRetention RoundRetention
+
+	// ExtractWorkers is how many extractions the server computes at
+	// once. If zero, it is GOMAXPROCS.
+	ExtractWorkers int
+
 	// CoordinatorKey is the key that's authorized to start new PKG rounds.
 	CoordinatorKey ed25519.PublicKey
 
+	// CoordinatorKeys are more coordinators that are authorized to
+	// start rounds, such as a standby coordinator or one run by another
+	// party. The coordinators share the server's rounds: coordinators
+	// that set up the same round get the same round keys.
+	CoordinatorKeys []ed25519.PublicKey
+
+	// CoordinatorNetworks, if not empty, are the only networks that
+	// round setup requests may come from. Requests from other
+	// addresses are rejected with ErrUnauthorized before the server
+	// checks the coordinator's key.
+	CoordinatorNetworks []*net.IPNet
+
 	// RegistrarKey is the key that's authorized to check user availability.
 	RegistrarKey ed25519.PublicKey
 
+	// AdminKey is the key that's authorized to use the admin API
+	// served by AdminHandler. The admin API is disabled if AdminKey
+	// is nil.
+	AdminKey ed25519.PublicKey
+
+	// AuditLog, if not nil, is written a line of JSON for each audit
+	// event. Events are also kept in the database for AuditRetention,
+	// or DefaultAuditRetention if it is zero; a negative retention
+	// keeps them out of the database.
+	AuditLog       io.Writer
+	AuditRetention time.Duration
+
+	// AbuseReportRetention is how long abuse reports are kept, or
+	// DefaultAbuseReportRetention if it is zero. See abusereport.go.
+	AbuseReportRetention time.Duration
+
 	// Logger is the logger used to write log messages. The standard logger
 	// is used if Logger is nil.
 	Logger *log.Logger
 
-	// RegTokenHandler is the function used to verify registration tokens.
+	// RegistrationMode says who may register. The empty string means
+	// RegistrationEmail.
+	RegistrationMode RegistrationMode
+
+	// Verifier checks that users own the usernames they register,
+	// such as by emailing them a token. RegTokenHandler is a simpler
+	// alternative: in RegistrationEmail mode, exactly one of them must
+	// be set, and in the other modes, neither may be.
+	Verifier        Verifier
 	RegTokenHandler RegTokenHandler
+
+	// RegistrationTokenKey is the public key of the operator's
+	// registration token issuer. It is required in RegistrationToken
+	// mode and ignored in the others.
+	RegistrationTokenKey *rsa.PublicKey
+
+	// IsBanned, if not nil, reports whether username may not be
+	// registered. Registrations of banned usernames look successful
+	// to the client but are ignored.
+	IsBanned func(username string) bool
+
+	// ReservedNames are usernames, or local parts at any domain, that
+	// can only be registered with an override token; see reserved.go.
+	ReservedNames []string
+
+	// ReadOnly refuses registrations and changes to users' keys while
+	// extractions continue; see readonly.go.
+	ReadOnly bool
+
+	// UsernamePolicy decides which usernames the server accepts; see
+	// usernamepolicy.go. DefaultUsernamePolicy is used if it is nil.
+	UsernamePolicy UsernamePolicy
+
+	// Captcha, if not nil, requires registrations to carry a solved
+	// CAPTCHA, which it checks.
+	Captcha CaptchaVerifier
+
+	// Webhooks are posted registrations, verifications, account
+	// deletions, and failed round setups; see webhook.go.
+	Webhooks []*Webhook
+
+	// DomainQuotas, if not empty, caps the registrations accepted
+	// per UTC day for each email domain, keyed by lowercase domain.
+	// The DefaultDomainQuota entry applies to domains not listed. A
+	// quota of 0 means no limit.
+	DomainQuotas map[string]int
+
+	// ExtractQuota caps how many keys each user may extract; see
+	// extractquota.go. The zero value sets no cap.
+	ExtractQuota ExtractQuota
+
+	// LookupLimit is the most distinct usernames a client may query
+	// on the status, extract, and PQ key endpoints per LookupWindow,
+	// to make harvesting the user base expensive; see harvest.go for
+	// how clients and lookups are counted. Zero means no limit.
+	// A zero LookupWindow means DefaultLookupWindow.
+	LookupLimit  int
+	LookupWindow time.Duration
+
+	// LookupWorkBits, if nonzero, requires anonymous PQ key lookups to
+	// carry a proof of work with this many leading zero bits. Each
+	// additional bit doubles the work.
+	LookupWorkBits int
+
+	// RegisterWorkBits, if nonzero, requires registrations to carry
+	// a proof of work with this many leading zero bits.
+	RegisterWorkBits int
+
+	// LoginKeyGrace is how long a login key keeps working after the
+	// user rotates it in place. Zero means DefaultLoginKeyGrace.
+	LoginKeyGrace time.Duration
+
+	// MaxLoginKeys is the most login keys a user can have: their login
+	// key and the device keys they enroll. Zero means
+	// DefaultMaxLoginKeys.
+	MaxLoginKeys int
+
+	// UnverifiedTTL, if nonzero, is how long a registration can wait
+	// for its username to be verified before the server deletes it,
+	// along with the verifier's records of usernames that are still
+	// not registered after UnverifiedTTL; see janitor.go.
+	UnverifiedTTL time.Duration
+
+	// RequestLog, if it sets a sample rate, logs a sample of the
+	// server's requests with usernames redacted; see requestlog.go.
+	RequestLog RequestLog
+
+	// IPRateLimit and UsernameRateLimit limit how often each source
+	// IP address may make user requests, and how often each username
+	// may be the subject of one. Zero limits are disabled.
+	IPRateLimit       RateLimit
+	UsernameRateLimit RateLimit
+
+	// TracerProvider records the server's spans: a span for each
+	// request, continuing the trace in the client's traceparent
+	// header, with child spans for the database calls and key
+	// extraction of the extract endpoints. Programs build it with the
+	// exporter that sends the spans to their collector. If it is nil,
+	// spans go to the global tracer provider; see internal/tracing.
+	TracerProvider trace.TracerProvider
+
+	// Cluster, if not nil, makes the server one of several replicas
+	// that share DB, of which only an elected leader sets up rounds;
+	// see cluster.go.
+	Cluster *ClusterConfig
+
+	// Clock decides when login key rotations and lookup windows
+	// expire and timestamps the server's records. The real clock is
+	// used if Clock is nil.
+	Clock clock.Clock
 }
 
 func NewServer(conf *Config) (*Server, error) {
-	if conf.RegTokenHandler == nil {
-		return nil, errors.New("nil RegTokenHandler")
+	verifier := conf.Verifier
+	if conf.RegTokenHandler != nil {
+		if verifier != nil {
+			return nil, errors.New("RegTokenHandler and Verifier are mutually exclusive")
+		}
+		verifier = conf.RegTokenHandler
 	}
-
-	db, err := badger.Open(badger.DefaultOptions(conf.DBPath).WithSyncWrites(true))
+	if v, ok := conf.Captcha.(interface{ Check() error }); ok {
+		if err := v.Check(); err != nil {
+			return nil, errors.Wrap(err, "%s captcha", conf.Captcha.Name())
+		}
+	}
+	usernamePolicy := conf.UsernamePolicy
+	if usernamePolicy == nil {
+		usernamePolicy = DefaultUsernamePolicy
+	}
+	if conf.LookupWorkBits < 0 || conf.LookupWorkBits > maxWorkBits {
+		return nil, errors.New("LookupWorkBits must be between 0 and %d", maxWorkBits)
+	}
+	if err := checkDomainQuotas(conf.DomainQuotas); err != nil {
+		return nil, err
+	}
+	if conf.ExtractQuota.PerRound < 0 || conf.ExtractQuota.PerEpoch < 0 {
+		return nil, errors.New("negative ExtractQuota")
+	}
+	if err := conf.RequestLog.check(); err != nil {
+		return nil, err
+	}
+	for _, h := range conf.Webhooks {
+		if err := h.Check(); err != nil {
+			return nil, err
+		}
+	}
+	if conf.RegisterWorkBits < 0 || conf.RegisterWorkBits > maxWorkBits {
+		return nil, errors.New("RegisterWorkBits must be between 0 and %d", maxWorkBits)
+	}
+	signer := conf.Signer
+	if signer == nil {
+		if len(conf.SigningKey) != ed25519.PrivateKeySize {
+			return nil, errors.New("SigningKey has %d bytes, want %d", len(conf.SigningKey), ed25519.PrivateKeySize)
+		}
+		signer = conf.SigningKey
+	} else if len(conf.SigningKey) != 0 {
+		return nil, errors.New("SigningKey and Signer are mutually exclusive")
+	}
+	publicKey, err := signerPublicKey(signer)
 	if err != nil {
 		return nil, err
 	}
+	if len(conf.PreviousSigningKey) != 0 {
+		if len(conf.PreviousSigningKey) != ed25519.PrivateKeySize {
+			return nil, errors.New("PreviousSigningKey has %d bytes, want %d", len(conf.PreviousSigningKey), ed25519.PrivateKeySize)
+		}
+		if conf.PreviousKeyExpires.IsZero() {
+			return nil, errors.New("PreviousSigningKey is set without PreviousKeyExpires")
+		}
+	}
+	if conf.MaxRequestBytes < 0 {
+		return nil, errors.New("negative MaxRequestBytes")
+	}
+	if conf.MaxConcurrentRequests < 0 {
+		return nil, errors.New("negative MaxConcurrentRequests")
+	}
+	endpointSlots, err := newEndpointSlots(conf.EndpointLimits)
+	if err != nil {
+		return nil, err
+	}
+	if conf.EndpointQueueTimeout < 0 {
+		return nil, errors.New("negative EndpointQueueTimeout")
+	}
+	if conf.ReadyRoundAge < 0 {
+		return nil, errors.New("negative ReadyRoundAge")
+	}
+	if conf.RoundCacheSize < 0 {
+		return nil, errors.New("negative RoundCacheSize")
+	}
+	if conf.RoundRetention.Age < 0 {
+		return nil, errors.New("negative RoundRetention.Age")
+	}
+	if conf.ExtractWorkers < 0 {
+		return nil, errors.New("negative ExtractWorkers")
+	}
+	if conf.UnverifiedTTL < 0 {
+		return nil, errors.New("negative UnverifiedTTL")
+	}
+	if conf.MaxLoginKeys < 0 || conf.MaxLoginKeys > maxLoginKeys {
+		return nil, errors.New("MaxLoginKeys must be between 0 and %d", maxLoginKeys)
+	}
+	var cluster *cluster
+	if conf.Cluster != nil {
+		if _, ok := signer.(ed25519.PrivateKey); !ok && conf.RoundKEK == nil {
+			return nil, errors.New("a cluster server whose Signer is not an ed25519.PrivateKey needs a RoundKEK")
+		}
+		cluster, err = newCluster(conf.Cluster)
+		if err != nil {
+			return nil, err
+		}
+	}
+	challengeKey := make([]byte, 32)
+	if _, err := rand.Read(challengeKey); err != nil {
+		return nil, err
+	}
+
+	pool := kv.MySQLPool{
+		MaxOpenConns:    conf.MaxOpenConns,
+		MaxIdleConns:    conf.MaxIdleConns,
+		ConnMaxLifetime: conf.ConnMaxLifetime,
+	}
+	db := conf.DB
+	if db == nil {
+		if conf.DBBackend == kv.MySQL {
+			db, err = kv.OpenMySQL(conf.DBPath, false, pool)
+		} else {
+			db, err = kv.Open(conf.DBBackend, conf.DBPath, false)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	replicaDB := conf.ReplicaDB
+	if replicaDB == nil && conf.ReplicaSource != "" {
+		replicaDB, err = kv.OpenMySQL(conf.ReplicaSource, true, pool)
+		if err != nil {
+			return nil, errors.Wrap(err, "replica")
+		}
+	}
+	if len(conf.DataKeys) > 0 {
+		sealed, err := SealDB(db, conf.DataKeys)
+		if err != nil {
+			return nil, errors.Wrap(err, "data keys")
+		}
+		db = sealed
+		if replicaDB != nil {
+			replicaDB, _ = SealDB(replicaDB, conf.DataKeys)
+		}
+	}
 
 	logger := conf.Logger
 	if logger == nil {
 		logger = log.StdLogger
 	}
 
+	requestLog, err := newRequestLogger(conf.RequestLog, logger)
+	if err != nil {
+		return nil, err
+	}
+
+	if conf.ManualMigrations {
+		err = checkSchema(db, logger)
+	} else {
+		_, err = Migrate(db, logger)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	metrics := newServerMetrics()
+	db = &timedDB{DB: db, latency: metrics.dbLatency}
+	replica := db
+	if replicaDB != nil {
+		replica = &timedDB{DB: replicaDB, latency: metrics.dbLatency, replica: true}
+	}
+
 	s := &Server{
-		db:  db,
-		log: logger,
+		db:      db,
+		replica: replica,
+		log:     logger,
+		clock:   clock.Or(conf.Clock),
+		tracer:  tracing.Tracer(conf.TracerProvider),
 
 		rounds: make(map[uint32]*roundState),
 
-		privateKey:     conf.SigningKey,
-		publicKey:      conf.SigningKey.Public().(ed25519.PublicKey),
-		coordinatorKey: conf.CoordinatorKey,
-		registrarKey:   conf.RegistrarKey,
+		roundCacheSize: conf.RoundCacheSize,
+		readyRoundAge:  conf.ReadyRoundAge,
+
+		maxRequestBytes: conf.MaxRequestBytes,
+
+		signer:             signer,
+		signatureScheme:    ed25519Scheme{},
+		publicKey:          publicKey,
+		previousSigningKey: conf.PreviousSigningKey,
+		previousKeyExpires: conf.PreviousKeyExpires,
+
+		registrarKey: conf.RegistrarKey,
+		adminKey:     conf.AdminKey,
+
+		auditLog: &auditLog{
+			db:        db,
+			retention: conf.AuditRetention,
+			w:         conf.AuditLog,
+		},
+		abuseReportRetention: conf.AbuseReportRetention,
+
+		isBanned:       conf.IsBanned,
+		usernamePolicy: usernamePolicy,
+		blocklist:      new(blocklist),
+		captcha:        conf.Captcha,
+
+		domainQuotas: conf.DomainQuotas,
+		extractQuota: conf.ExtractQuota,
+		requestLog:   requestLog,
 
-		regTokenHandler: conf.RegTokenHandler,
+		registerWorkBits: conf.RegisterWorkBits,
+		challengeKey:     challengeKey,
+
+		lookupLimit:    conf.LookupLimit,
+		lookupWindow:   conf.LookupWindow,
+		lookupWorkBits: conf.LookupWorkBits,
+
+		loginKeyGrace: conf.LoginKeyGrace,
+		maxLoginKeys:  conf.MaxLoginKeys,
+
+		cluster: cluster,
+		metrics: metrics,
+	}
+	if s.auditLog.retention == 0 {
+		s.auditLog.retention = DefaultAuditRetention
+	}
+	if s.abuseReportRetention == 0 {
+		s.abuseReportRetention = DefaultAbuseReportRetention
+	}
+	if s.lookupWindow == 0 {
+		s.lookupWindow = DefaultLookupWindow
+	}
+	if s.loginKeyGrace == 0 {
+		s.loginKeyGrace = DefaultLoginKeyGrace
+	}
+	if s.maxLoginKeys == 0 {
+		s.maxLoginKeys = DefaultMaxLoginKeys
+	}
+	if s.roundCacheSize == 0 {
+		s.roundCacheSize = DefaultRoundCacheSize
+	}
+	if s.readyRoundAge == 0 {
+		s.readyRoundAge = DefaultReadyRoundAge
+	}
+	if s.maxRequestBytes == 0 {
+		s.maxRequestBytes = DefaultMaxRequestBytes
+	}
+	if conf.MaxConcurrentRequests > 0 {
+		s.handlerSlots = make(chan struct{}, conf.MaxConcurrentRequests)
+	}
+	s.endpointSlots = endpointSlots
+	s.endpointQueueTimeout = conf.EndpointQueueTimeout
+	if s.endpointQueueTimeout == 0 {
+		s.endpointQueueTimeout = DefaultEndpointQueueTimeout
+	}
+	live, err := s.newLiveSettings(&Settings{
+		CoordinatorKey:       conf.CoordinatorKey,
+		CoordinatorKeys:      conf.CoordinatorKeys,
+		CoordinatorNetworks:  conf.CoordinatorNetworks,
+		RegistrationMode:     conf.RegistrationMode,
+		Verifier:             verifier,
+		RegistrationTokenKey: conf.RegistrationTokenKey,
+		ReservedNames:        conf.ReservedNames,
+		ReadOnly:             conf.ReadOnly,
+		IPRateLimit:          conf.IPRateLimit,
+		UsernameRateLimit:    conf.UsernameRateLimit,
+	}, nil)
+	if err != nil {
+		return nil, err
+	}
+	s.settings.Store(live)
+	if err := s.blocklist.load(db); err != nil {
+		return nil, err
+	}
+
+	precompute := conf.PrecomputeRounds
+	if precompute == 0 {
+		precompute = DefaultPrecomputeRounds
+	}
+	s.roundKEK = newRoundKEK(conf.RoundKEK, signer)
+	s.keyPool = newKeyPool(precompute, s.roundKEK)
+	workers := conf.ExtractWorkers
+	if workers == 0 {
+		workers = runtime.GOMAXPROCS(0)
+	}
+	s.extractWorkers = newWorkerPool(workers, metrics.extractQueue, metrics.extractWait)
+	s.webhooks = newWebhooks(conf.Webhooks, s.log)
+	s.janitor = s.startUnverifiedJanitor(conf.UnverifiedTTL)
+	s.roundGC = s.startRoundGC(conf.RoundRetention)
+	s.sweeper = s.startSweeper()
+	if s.cluster != nil {
+		s.startCluster()
 	}
 	return s, nil
 }
 
+// Close closes the server's database without waiting for requests in
+// progress. Use Shutdown to stop the server gracefully.
 func (srv *Server) Close() error {
+	srv.keyPool.close()
+	defer srv.roundKEK.destroy()
+	srv.extractWorkers.close()
+	srv.webhooks.close()
+	srv.janitor.close()
+	srv.roundGC.close()
+	srv.sweeper.close()
+	srv.closeCluster()
+	if srv.replica != srv.db {
+		srv.replica.Close()
+	}
 	return srv.db.Close()
 }
 
+// Shutdown stops the server answering new requests, waits for requests
+// in progress, including round commits and reveals, and then closes
+// the database. If ctx is done first, Shutdown returns ctx's error and
+// leaves the database open for the remaining requests.
+func (srv *Server) Shutdown(ctx context.Context) error {
+	srv.closeMu.Lock()
+	srv.closing = true
+	srv.closeMu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		srv.inflight.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return srv.Close()
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// begin counts a new request as in progress, returning false if the
+// server is shutting down.
+func (srv *Server) begin() bool {
+	srv.closeMu.Lock()
+	defer srv.closeMu.Unlock()
+	if srv.closing {
+		return false
+	}
+	srv.inflight.Add(1)
+	return true
+}
+
 // ServeHTTP implements an http.Handler that answers PKG requests.
-func (srv *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+func (srv *Server) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
+	w := &statusRecorder{ResponseWriter: rw}
+	defer srv.metrics.countRequest(r.URL.Path, w)
+	defer srv.requestLog.logRequest(r, w, time.Now())
+
+	if r.URL.Path == "/healthz" {
+		healthzHandler(w, r)
+		return
+	}
+	if !srv.begin() {
+		w.Header().Set("Connection", "close")
+		httpError(w, errorf(ErrShuttingDown, ""))
+		return
+	}
+	defer srv.inflight.Done()
+
+	r, span := srv.startRequestSpan(r)
+	defer srv.endRequestSpan(span, w)
+
+	if !srv.limitBody(w, r) {
+		return
+	}
+	if !srv.acquireEndpoint(w, r) {
+		return
+	}
+	defer srv.releaseEndpoint(r)
+	if !srv.acquireHandler(w, r) {
+		return
+	}
+	defer srv.releaseHandler(r)
+
+	version.PKG.SetHeader(w.Header())
+	if r.URL.Path == "/readyz" {
+		srv.readyzHandler(w, r)
+		return
+	}
+	if r.URL.Path == "/leaderz" {
+		srv.leaderzHandler(w, r)
+		return
+	}
+	if r.URL.Path != "/version" {
+		if err := version.PKG.CheckHeader("client", r.Header); err != nil {
+			httpError(w, errorf(ErrProtocolVersion, "%s", err))
+			return
+		}
+	}
+	if srv.inMaintenance(w, r) || srv.inReadOnlyMode(w, r) {
+		return
+	}
+
+	switch r.URL.Path {
+	case "/extract", "/extractbatch", "/status", "/register", "/registerchallenge", "/rotatelogin", "/setpqkey", "/pqkey", "/delete", "/rename", "/setrecoverykey", "/revokelogin", "/devicekey", "/devicekeys", "/report":
+		if !srv.limitIP(w, r) {
+			return
+		}
+	}
+
 	switch r.URL.Path {
 	case "/extract":
 		srv.extractHandler(w, r)
+	case "/extractbatch":
+		srv.extractBatchHandler(w, r)
 	case "/status":
 		srv.statusHandler(w, r)
 	case "/register":
 		srv.registerHandler(w, r)
+	case "/registerchallenge":
+		srv.registerChallengeHandler(w, r)
+	case "/rotatelogin":
+		srv.rotateLoginHandler(w, r)
+	case "/setpqkey":
+		srv.setPQKeyHandler(w, r)
+	case "/pqkey":
+		srv.lookupPQKeyHandler(w, r)
+	case "/delete":
+		srv.deleteHandler(w, r)
+	case "/rename":
+		srv.renameHandler(w, r)
+	case "/setrecoverykey":
+		srv.setRecoveryKeyHandler(w, r)
+	case "/revokelogin":
+		srv.revokeLoginHandler(w, r)
+	case "/devicekey":
+		srv.deviceKeyHandler(w, r)
+	case "/devicekeys":
+		srv.deviceKeysHandler(w, r)
+	case "/report":
+		srv.abuseReportHandler(w, r)
+	case "/attestlog/head", "/attestlog/inclusion", "/attestlog/consistency", "/attestlog/entries":
+		srv.attestLogHandler(w, r)
+	case "/reglog/head", "/reglog/inclusion", "/reglog/consistency", "/reglog/entries":
+		srv.regLogHandler(w, r)
 	case "/commit":
 		srv.commitHandler(w, r)
 	case "/reveal":
 		srv.revealHandler(w, r)
+	case "/dkg/deal":
+		srv.dkgDealHandler(w, r)
+	case "/dkg/combine":
+		srv.dkgCombineHandler(w, r)
+	case "/cluster/round":
+		srv.clusterRoundHandler(w, r)
 	case "/registrar/userfilter":
 		srv.userFilterHandler(w, r)
+	case "/version":
+		version.ServeHTTP(w, r)
 	default:
 		http.NotFound(w, r)
 	}
 }
 
 func (srv *Server) authorized(key ed25519.PublicKey, w http.ResponseWriter, req *http.Request) bool {
-	if len(req.TLS.PeerCertificates) == 0 {
-		httpError(w, errorf(ErrUnauthorized, "no peer tls certificate"))
-		return false
-	}
-	peerKey, ok := req.TLS.PeerCertificates[0].PublicKey.(ed25519.PublicKey)
-	if !ok {
-		httpError(w, errorf(ErrUnauthorized, "expecting ed25519 certificate"))
+	peerKey, err := peerKey(req)
+	if err != nil {
+		httpError(w, err)
 		return false
 	}
-	if !bytes.Equal(peerKey, key) {
+	if !keysafe.Equal(peerKey, key) {
 		httpError(w, errorf(ErrUnauthorized, "peer key is not authorized"))
 		return false
 	}
 	return true
 }
 
-type commitArgs struct {
-	Round uint32
-}
-
-type commitReply struct {
-	Commitment []byte
+// peerKey returns the key in the client's TLS certificate.
+func peerKey(req *http.Request) (ed25519.PublicKey, error) {
+	if req.TLS == nil || len(req.TLS.PeerCertificates) == 0 {
+		return nil, errorf(ErrUnauthorized, "no peer tls certificate")
+	}
+	key, ok := req.TLS.PeerCertificates[0].PublicKey.(ed25519.PublicKey)
+	if !ok {
+		return nil, errorf(ErrUnauthorized, "expecting ed25519 certificate")
+	}
+	return key, nil
 }
 
 func (srv *Server) commitHandler(w http.ResponseWriter, req *http.Request) {
-	if !srv.authorized(srv.coordinatorKey, w, req) {
+	if !srv.isLeader() {
+		httpError(w, errorf(ErrNotLeader, ""))
+		return
+	}
+	coordinatorKey, ok := srv.authorizedCoordinator(w, req)
+	if !ok {
 		return
 	}
 
-	body := http.MaxBytesReader(w, req.Body, 512)
+	body := http.MaxBytesReader(w, req.Body, 64*1024)
 	args := new(commitArgs)
 	err := json.NewDecoder(body).Decode(args)
 	if err != nil {
 		httpError(w, errorf(ErrBadRequestJSON, "%s", err))
 		return
 	}
+	if err := srv.checkCoordinator(coordinatorKey, "commit", args.Round, &args.coordinatorNonce); err != nil {
+		srv.roundSetupFailed(w, "commit", args.Round, err)
+		return
+	}
 	round := args.Round
 
 	srv.mu.Lock()
 	st, ok := srv.rounds[round]
 	srv.mu.Unlock()
 	if !ok {
-		ibePub, ibePriv := ibe.Setup(rand.Reader)
-
-		blsPub, blsPriv, err := bls.GenerateKey(rand.Reader)
+		curveKeys, err := newCurveRoundKeys(args.Curves, srv.roundKEK)
 		if err != nil {
-			panic(err)
+			srv.roundSetupFailed(w, "commit", round, err)
+			return
+		}
+		if err := srv.newDKGStates(args, curveKeys); err != nil {
+			srv.roundSetupFailed(w, "commit", round, err)
+			return
 		}
 
+		keys := srv.keyPool.get()
 		st = &roundState{
-			masterPublicKey:  ibePub,
-			masterPrivateKey: ibePriv,
-			blsPublicKey:     blsPub,
-			blsPrivateKey:    blsPriv,
+			masterPublicKey: keys.masterPublicKey,
+			sealedMasterKey: keys.sealedMasterKey,
+			blsPublicKey:    keys.blsPublicKey,
+			sealedBLSKey:    keys.sealedBLSKey,
+			curves:          curveKeys,
+			committed:       srv.clock.Now(),
 		}
 
 		srv.mu.Lock()
 		cst, ok := srv.rounds[round]
 		if !ok {
+			srv.roundUses++
+			st.lastUsed = srv.roundUses
 			srv.rounds[round] = st
+			srv.roundStats.start(round, st.committed)
 		} else {
 			st = cst
 		}
@@ -204,15 +1030,12 @@ func (srv *Server) commitHandler(w http.ResponseWriter, req *http.Request) {
 	srv.log.WithFields(log.Fields{"round": args.Round}).Info("Commit")
 
 	srv.mu.Lock()
-	for r, _ := range srv.rounds {
-		if r < round-1 {
-			delete(srv.rounds, r)
-		}
-	}
+	srv.evictRoundsLocked(round)
 	srv.mu.Unlock()
 
 	reply := &commitReply{
-		Commitment: commitTo(st.masterPublicKey, st.blsPublicKey),
+		Commitment: commitTo(st.masterPublicKey, st.blsPublicKey, st.curvePublicKeys()),
+		BoxKeys:    st.dkgBoxKeys(),
 	}
 	bs, err := json.Marshal(reply)
 	if err != nil {
@@ -222,28 +1045,13 @@ func (srv *Server) commitHandler(w http.ResponseWriter, req *http.Request) {
 	w.Write(bs)
 }
 
-func commitTo(ibeKey *ibe.MasterPublicKey, blsKey *bls.PublicKey) []byte {
-	ibeKeyBytes, _ := ibeKey.MarshalBinary()
-	blsKeyBytes, _ := blsKey.MarshalBinary()
-	h := sha512.Sum512_256(append(ibeKeyBytes, blsKeyBytes...))
-	return h[:]
-}
-
-type revealArgs struct {
-	Round       uint32
-	Commitments map[string][]byte // map from hex(signingPublicKey) -> commitment
-}
-
-type RevealReply struct {
-	MasterPublicKey *ibe.MasterPublicKey
-	BLSPublicKey    *bls.PublicKey
-
-	// Signature signs the commitments in RevealArgs.
-	Signature []byte
-}
-
 func (srv *Server) revealHandler(w http.ResponseWriter, req *http.Request) {
-	if !srv.authorized(srv.coordinatorKey, w, req) {
+	if !srv.isLeader() {
+		httpError(w, errorf(ErrNotLeader, ""))
+		return
+	}
+	coordinatorKey, ok := srv.authorizedCoordinator(w, req)
+	if !ok {
 		return
 	}
 
@@ -254,21 +1062,29 @@ func (srv *Server) revealHandler(w http.ResponseWriter, req *http.Request) {
 		httpError(w, errorf(ErrBadRequestJSON, "%s", err))
 		return
 	}
+	if err := srv.checkCoordinator(coordinatorKey, "reveal", args.Round, &args.coordinatorNonce); err != nil {
+		srv.roundSetupFailed(w, "reveal", args.Round, err)
+		return
+	}
 
 	srv.mu.Lock()
 	defer srv.mu.Unlock()
 
 	st, ok := srv.rounds[args.Round]
 	if !ok {
-		httpError(w, errorf(ErrRoundNotFound, "round %d", args.Round))
+		srv.roundSetupFailed(w, "reveal", args.Round, errorf(ErrRoundNotFound, "round %d", args.Round))
 		return
 	}
 
 	if st.revealSignature == nil {
+		if err := st.checkDKGFinished(args.Round); err != nil {
+			srv.roundSetupFailed(w, "reveal", args.Round, err)
+			return
+		}
 		commitment := args.Commitments[hex.EncodeToString(srv.publicKey)]
-		expected := commitTo(st.masterPublicKey, st.blsPublicKey)
-		if !bytes.Equal(commitment, expected) {
-			httpError(w, errorf(ErrBadCommitment, "unexpected commitment for key %x", srv.publicKey))
+		expected := commitTo(st.masterPublicKey, st.blsPublicKey, st.curvePublicKeys())
+		if !keysafe.Equal(commitment, expected) {
+			srv.roundSetupFailed(w, "reveal", args.Round, errorf(ErrBadCommitment, "unexpected commitment for key %x", srv.publicKey))
 			return
 		}
 
@@ -284,14 +1100,14 @@ func (srv *Server) revealHandler(w http.ResponseWriter, req *http.Request) {
 
 		for _, hexkey := range hexkeys {
 			if len(hexkey) != hex.EncodedLen(ed25519.PublicKeySize) {
-				httpError(w, errorf(ErrBadCommitment, "bad public key length for hex key %s: %d != %d",
+				srv.roundSetupFailed(w, "reveal", args.Round, errorf(ErrBadCommitment, "bad public key length for hex key %s: %d != %d",
 					hexkey, len(hexkey), hex.EncodedLen(ed25519.PublicKeySize)))
 				return
 			}
 
 			commitment := args.Commitments[hexkey]
 			if len(commitment) != len(expected) {
-				httpError(w, errorf(ErrBadCommitment, "bad commitment length for key %s: %d != %d",
+				srv.roundSetupFailed(w, "reveal", args.Round, errorf(ErrBadCommitment, "bad commitment length for key %s: %d != %d",
 					hexkey, len(commitment), len(expected)))
 				return
 			}
@@ -299,7 +1115,16 @@ func (srv *Server) revealHandler(w http.ResponseWriter, req *http.Request) {
 			buf.WriteString(hexkey)
 			buf.Write(commitment)
 		}
-		st.revealSignature = ed25519.Sign(srv.privateKey, buf.Bytes())
+		sig, err := srv.sign(buf.Bytes())
+		if err != nil {
+			srv.roundSetupFailed(w, "reveal", args.Round, err)
+			return
+		}
+		st.revealSignature = sig
+	}
+	if args.Round >= srv.latestRound {
+		srv.latestRound = args.Round
+		srv.lastReveal = srv.clock.Now()
 	}
 
 	srv.log.WithFields(log.Fields{"round": args.Round}).Info("Reveal")
@@ -307,6 +1132,7 @@ func (srv *Server) revealHandler(w http.ResponseWriter, req *http.Request) {
 	reply := &RevealReply{
 		MasterPublicKey: st.masterPublicKey,
 		BLSPublicKey:    st.blsPublicKey,
+		Curves:          st.curvePublicKeys(),
 		Signature:       st.revealSignature,
 	}
 	bs, err := json.Marshal(reply)
@@ -315,170 +1141,3 @@ func (srv *Server) revealHandler(w http.ResponseWriter, req *http.Request) {
 	}
 	w.Write(bs)
 }
-
-type RoundSettings map[string]RevealReply
-
-func (s RoundSettings) Verify(round uint32, keys []ed25519.PublicKey) bool {
-	hexkeys := make([]string, len(keys))
-	for i := range keys {
-		hexkeys[i] = hex.EncodeToString(keys[i])
-	}
-	sort.Strings(hexkeys)
-
-	buf := new(bytes.Buffer)
-	buf.WriteString("Commitments")
-	binary.Write(buf, binary.BigEndian, round)
-
-	for _, hexkey := range hexkeys {
-		reveal, ok := s[hexkey]
-		if !ok {
-			return false
-		}
-
-		commitment := commitTo(reveal.MasterPublicKey, reveal.BLSPublicKey)
-
-		buf.WriteString(hexkey)
-		buf.Write(commitment)
-	}
-	msg := buf.Bytes()
-
-	for _, key := range keys {
-		sig := s[hex.EncodeToString(key)].Signature
-		if !ed25519.Verify(key, msg, sig) {
-			return false
-		}
-	}
-	return true
-}
-
-//easyjson:readable
-type PublicServerConfig struct {
-	Key     ed25519.PublicKey
-	Address string
-}
-
-type CoordinatorClient struct {
-	CoordinatorKey ed25519.PrivateKey
-
-	initOnce sync.Once
-	client   *edhttp.Client
-}
-
-func (c *CoordinatorClient) init() {
-	c.initOnce.Do(func() {
-		c.client = &edhttp.Client{
-			Key: c.CoordinatorKey,
-		}
-	})
-}
-
-func (c *CoordinatorClient) NewRound(pkgs []PublicServerConfig, round uint32) (RoundSettings, error) {
-	c.init()
-
-	commitments := make(map[string][]byte)
-	commitArgs := &commitArgs{
-		Round: round,
-	}
-	for _, pkg := range pkgs {
-		commitReply := new(commitReply)
-		req := &pkgRequest{
-			PublicServerConfig: pkg,
-
-			Path:   "commit",
-			Args:   commitArgs,
-			Reply:  commitReply,
-			Client: c.client,
-		}
-		err := req.Do()
-		if err != nil {
-			return nil, err
-		}
-		commitments[hex.EncodeToString(pkg.Key)] = commitReply.Commitment
-	}
-
-	settings := make(RoundSettings)
-	revealArgs := &revealArgs{
-		Round:       round,
-		Commitments: commitments,
-	}
-	for _, pkg := range pkgs {
-		var reply RevealReply
-		req := &pkgRequest{
-			PublicServerConfig: pkg,
-
-			Path:   "reveal",
-			Args:   revealArgs,
-			Reply:  &reply,
-			Client: c.client,
-		}
-		err := req.Do()
-		if err != nil {
-			return nil, err
-		}
-		settings[hex.EncodeToString(pkg.Key)] = reply
-	}
-
-	keys := make([]ed25519.PublicKey, len(pkgs))
-	for i := range pkgs {
-		keys[i] = pkgs[i].Key
-	}
-	if !settings.Verify(round, keys) {
-		return nil, errors.New("could not verify round settings")
-	}
-
-	return settings, nil
-}
-
-// ValidateUsername returns nil if username is a valid username,
-// otherwise returns an error that explains why the username is invalid.
-func ValidateUsername(username string) error {
-	if len(username) < 3 {
-		return errors.New("username must be at least 3 characters: %s", username)
-	}
-	if len(username) > 64 {
-		return errors.New("username must be 64 characters or less: %s", username)
-	}
-	ix := strings.Index(username, "@")
-	if ix == -1 {
-		return errors.New("username must be a valid email address: %s", username)
-	}
-	if username != strings.ToLower(username) {
-		return errors.New("username must be lowercase: %s", username)
-	}
-	return nil
-}
-
-// UsernameToIdentity converts a username to an identity that can be
-// used with IBE. An error is returned if the username is not valid.
-func UsernameToIdentity(username string) (*[64]byte, error) {
-	if err := ValidateUsername(username); err != nil {
-		return nil, err
-	}
-	return ValidUsernameToIdentity(username), nil
-}
-
-// ValidUsernameToIdentity converts a valid username to an identity.
-// The result is undefined if username is invalid.
-func ValidUsernameToIdentity(username string) *[64]byte {
-	id := new([64]byte)
-	copy(id[:], []byte(username))
-	return id
-}
-
-func validChar(c rune) bool {
-	if c >= 'a' && c <= 'z' {
-		return true
-	}
-	if c >= '0' && c <= '9' {
-		return true
-	}
-	return false
-}
-
-func IdentityToUsername(identity *[64]byte) string {
-	ix := bytes.IndexByte(identity[:], 0)
-	if ix == -1 {
-		return string(identity[:])
-	}
-	return string(identity[0:ix])
-}
@@ -0,0 +1,178 @@
+// Copyright 2018 David Lazar. All rights reserved.
+// Use of this source code is governed by the GNU AGPL
+// license that can be found in the LICENSE file.
+
+package pkg
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"vuvuzela.io/alpenhorn/pkg/kv"
+)
+
+func TestShutdown(t *testing.T) {
+	verifying := make(chan struct{})
+	unblock := make(chan struct{})
+	_, serverKey, _ := ed25519.GenerateKey(rand.Reader)
+	srv, err := NewServer(&Config{
+		DB:         kv.NewMemory(),
+		SigningKey: serverKey,
+		RegTokenHandler: func(string, string) error {
+			close(verifying)
+			<-unblock
+			return nil
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	register := func() *httptest.ResponseRecorder {
+		loginKey, _, _ := ed25519.GenerateKey(rand.Reader)
+		body, _ := json.Marshal(&registerArgs{Username: "alice@example.org", LoginKey: loginKey})
+		w := httptest.NewRecorder()
+		srv.ServeHTTP(w, httptest.NewRequest("POST", "/register", bytes.NewReader(body)))
+		return w
+	}
+
+	registered := make(chan *httptest.ResponseRecorder)
+	go func() {
+		registered <- register()
+	}()
+	<-verifying
+
+	shutdown := make(chan error)
+	go func() {
+		shutdown <- srv.Shutdown(context.Background())
+	}()
+
+	// Give Shutdown time to stop new requests.
+	for i := 0; ; i++ {
+		srv.closeMu.Lock()
+		closing := srv.closing
+		srv.closeMu.Unlock()
+		if closing {
+			break
+		}
+		if i == 100 {
+			t.Fatal("Shutdown did not start")
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	if w := register(); w.Code != http.StatusServiceUnavailable {
+		t.Fatalf("expected 503 while shutting down, got %d", w.Code)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := srv.Shutdown(ctx); err != context.DeadlineExceeded {
+		t.Fatalf("expected the deadline to pass with a request in progress, got %v", err)
+	}
+	select {
+	case err := <-shutdown:
+		t.Fatalf("Shutdown returned %v with a request in progress", err)
+	default:
+	}
+
+	close(unblock)
+	if w := <-registered; w.Code != http.StatusOK {
+		t.Fatalf("request in progress failed: %d %s", w.Code, w.Body)
+	}
+	if err := <-shutdown; err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestReplicaDB(t *testing.T) {
+	_, serverKey, _ := ed25519.GenerateKey(rand.Reader)
+	replica := kv.NewMemory()
+	srv, err := NewServer(&Config{
+		DB:              kv.NewMemory(),
+		ReplicaDB:       replica,
+		SigningKey:      serverKey,
+		RegTokenHandler: func(string, string) error { return nil },
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+
+	oldPub, oldPriv, _ := ed25519.GenerateKey(rand.Reader)
+	newPub, newPriv, _ := ed25519.GenerateKey(rand.Reader)
+	if _, err := srv.register(&registerArgs{Username: "alice@example.org", LoginKey: newPub}); err != nil {
+		t.Fatal(err)
+	}
+
+	// The replica lags behind: it still has alice's old login key.
+	id := ValidUsernameToIdentity("alice@example.org")
+	err = replica.Update(func(tx kv.Txn) error {
+		stale := userState{LoginKey: oldPub}
+		return tx.Set(dbUserKey(id, registrationSuffix), stale.Marshal())
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Registrations are read from the primary, so the rotated key
+	// is not accepted.
+	user, _, err := srv.getUser(nil, "alice@example.org")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !user.LoginKey.Equal(newPub) {
+		t.Fatal("expected the primary's login key")
+	}
+	args := &statusArgs{Username: "alice@example.org", ServerSigningKey: srv.publicKey}
+	args.Signature = ed25519.Sign(oldPriv, args.msg())
+	if _, err := srv.checkStatus(args); errorCode(err) != ErrInvalidSignature {
+		t.Fatalf("expected ErrInvalidSignature for the replica's stale login key, got %v", err)
+	}
+
+	// The last extraction authorizes nothing, so status reads it from
+	// the replica.
+	err = replica.Update(func(tx kv.Txn) error {
+		last := lastExtraction{Round: 7, UnixTime: time.Now().Unix()}
+		return tx.Set(dbUserKey(id, lastExtractionSuffix), last.Marshal())
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	args.Signature = ed25519.Sign(newPriv, args.msg())
+	reply, err := srv.checkStatus(args)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reply.LastExtractRound != 7 {
+		t.Fatalf("status reported round %d, want the replica's 7", reply.LastExtractRound)
+	}
+
+	// A key revoked on the primary is not accepted either.
+	err = srv.db.Update(func(tx kv.Txn) error {
+		user.Revoked = true
+		return tx.Set(dbUserKey(id, registrationSuffix), user.Marshal())
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := srv.getUser(nil, "alice@example.org"); errorCode(err) != ErrLoginKeyRevoked {
+		t.Fatalf("expected ErrLoginKeyRevoked, got %v", err)
+	}
+
+	// Scans that authorize nothing go to the replica.
+	n, err := srv.countUsers(time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 1 {
+		t.Fatalf("counted %d users in the replica, want 1", n)
+	}
+}
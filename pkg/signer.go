@@ -0,0 +1,96 @@
+// Copyright 2018 David Lazar. All rights reserved.
+// Use of this source code is governed by the GNU AGPL
+// license that can be found in the LICENSE file.
+
+package pkg
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"io"
+
+	"vuvuzela.io/alpenhorn/errors"
+	"vuvuzela.io/alpenhorn/internal/keysafe"
+)
+
+// signLogin signs msg with a login key. The signer must produce
+// plain Ed25519 signatures.
+func signLogin(key crypto.Signer, msg []byte) ([]byte, error) {
+	sig, err := key.Sign(rand.Reader, msg, crypto.Hash(0))
+	if err != nil {
+		return nil, errors.Wrap(err, "signing with login key")
+	}
+	if len(sig) != ed25519.SignatureSize {
+		return nil, errors.New("login key signature has %d bytes, want %d", len(sig), ed25519.SignatureSize)
+	}
+	return sig, nil
+}
+
+func loginPublicKey(key crypto.Signer) (ed25519.PublicKey, error) {
+	pub, ok := key.Public().(ed25519.PublicKey)
+	if !ok || len(pub) != ed25519.PublicKeySize {
+		return nil, errors.New("login key is not an Ed25519 key: %T", key.Public())
+	}
+	return pub, nil
+}
+
+// A DerivedLoginKey is a login key whose private half is never stored.
+// Instead, its Ed25519 seed is recomputed for every signature and
+// wiped afterwards. The seed usually comes from hardware, such as the
+// output of a FIDO2 authenticator's hmac-secret extension or a secret
+// unwrapped by the platform keystore, so stealing the client's state
+// from disk does not yield the login key.
+type DerivedLoginKey struct {
+	// PublicKey is the login public key that the seed derives.
+	PublicKey ed25519.PublicKey
+
+	// Seed returns the 32-byte Ed25519 seed. It may block, for
+	// example while the user touches the authenticator.
+	Seed func() ([]byte, error)
+}
+
+// NewDerivedLoginKey calls seed once to learn the public key of the
+// derived login key.
+func NewDerivedLoginKey(seed func() ([]byte, error)) (*DerivedLoginKey, error) {
+	s, err := seed()
+	if err != nil {
+		return nil, err
+	}
+	defer keysafe.Zero(s)
+	if len(s) != ed25519.SeedSize {
+		return nil, errors.New("login key seed has %d bytes, want %d", len(s), ed25519.SeedSize)
+	}
+	priv := ed25519.NewKeyFromSeed(s)
+	defer keysafe.Zero(priv)
+	return &DerivedLoginKey{
+		PublicKey: append(ed25519.PublicKey(nil), priv[ed25519.SeedSize:]...),
+		Seed:      seed,
+	}, nil
+}
+
+func (k *DerivedLoginKey) Public() crypto.PublicKey {
+	return k.PublicKey
+}
+
+// Sign signs msg with the derived key. opts must be crypto.Hash(0).
+func (k *DerivedLoginKey) Sign(_ io.Reader, msg []byte, opts crypto.SignerOpts) ([]byte, error) {
+	if opts.HashFunc() != crypto.Hash(0) {
+		return nil, errors.New("login keys sign unhashed messages")
+	}
+	s, err := k.Seed()
+	if err != nil {
+		return nil, errors.Wrap(err, "deriving login key")
+	}
+	defer keysafe.Zero(s)
+	if len(s) != ed25519.SeedSize {
+		return nil, errors.New("login key seed has %d bytes, want %d", len(s), ed25519.SeedSize)
+	}
+	priv := ed25519.NewKeyFromSeed(s)
+	defer keysafe.Zero(priv)
+	if !bytes.Equal(priv[ed25519.SeedSize:], k.PublicKey) {
+		return nil, errors.New("derived login key does not match its public key")
+	}
+	return ed25519.Sign(priv, msg), nil
+}
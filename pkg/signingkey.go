@@ -0,0 +1,67 @@
+// Copyright 2018 David Lazar. All rights reserved.
+// Use of this source code is governed by the GNU AGPL
+// license that can be found in the LICENSE file.
+
+//go:build !js
+// +build !js
+
+package pkg
+
+import (
+	"crypto/ed25519"
+)
+
+// To rotate its signing key, a PKG starts with the new key as
+// Config.SigningKey and the old one as Config.PreviousSigningKey, and
+// the new key is published in the config with the old one as the
+// server's PublicServerConfig.PreviousKey. Until PreviousKeyExpires,
+// the server signs extract replies with both keys and accepts requests
+// bound to either, so clients that have not yet seen the new config
+// keep working. Commitments, reveals, and log heads are signed with
+// the new key only.
+
+// previousKey returns the previous signing key, or nil if there is
+// none or its overlap period has ended.
+func (srv *Server) previousKey() ed25519.PrivateKey {
+	if len(srv.previousSigningKey) == 0 || !srv.clock.Now().Before(srv.previousKeyExpires) {
+		return nil
+	}
+	return srv.previousSigningKey
+}
+
+// verifyBound checks a request's signature with verify, trying each of
+// the server's keys as the key the request is bound to. On success,
+// serverKey is left set to the key that worked, so that the request's
+// other signatures can be checked with it.
+func (srv *Server) verifyBound(serverKey *ed25519.PublicKey, verify func() bool) bool {
+	*serverKey = srv.publicKey
+	if verify() {
+		return true
+	}
+	if prev := srv.previousKey(); prev != nil {
+		*serverKey = prev.Public().(ed25519.PublicKey)
+		if verify() {
+			return true
+		}
+		*serverKey = srv.publicKey
+	}
+	return false
+}
+
+// signExtractReply signs reply with the signing key and, during a key
+// rotation, the previous one, in the server's signature scheme.
+func (srv *Server) signExtractReply(reply *extractReply) error {
+	reply.SignatureAlgorithm = wireAlgorithm(srv.signatureScheme)
+	sig, err := srv.signWith(srv.signatureScheme, srv.signer, reply.msg())
+	if err != nil {
+		return err
+	}
+	reply.Signature = sig
+	if prev := srv.previousKey(); prev != nil {
+		reply.PreviousSignature, err = srv.signWith(srv.signatureScheme, prev, reply.msg())
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,123 @@
+// Copyright 2018 David Lazar. All rights reserved.
+// Use of this source code is governed by the GNU AGPL
+// license that can be found in the LICENSE file.
+
+package pkg
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"testing"
+	"time"
+
+	"vuvuzela.io/alpenhorn/clock"
+	"vuvuzela.io/alpenhorn/pkg/kv"
+	"vuvuzela.io/crypto/bls"
+	"vuvuzela.io/crypto/ibe"
+)
+
+func TestSigningKeyRotation(t *testing.T) {
+	mockClock := clock.NewMock(time.Now())
+	oldPub, oldPriv, _ := ed25519.GenerateKey(rand.Reader)
+	newPub, newPriv, _ := ed25519.GenerateKey(rand.Reader)
+	srv, err := NewServer(&Config{
+		DB:                 kv.NewMemory(),
+		SigningKey:         newPriv,
+		PreviousSigningKey: oldPriv,
+		PreviousKeyExpires: mockClock.Now().Add(time.Hour),
+		RegTokenHandler:    func(string, string) error { return nil },
+		Clock:              mockClock,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+
+	loginPub, loginPriv, _ := ed25519.GenerateKey(rand.Reader)
+	if _, err := srv.register(&registerArgs{Username: "alice@example.org", LoginKey: loginPub}); err != nil {
+		t.Fatal(err)
+	}
+	ibePub, ibePriv := ibe.Setup(rand.Reader)
+	blsPub, blsPriv, _ := bls.GenerateKey(rand.Reader)
+	sealedMaster, sealedBLS := srv.roundKEK.sealKeys(ibePriv, blsPriv)
+	srv.rounds[1] = &roundState{
+		masterPublicKey: ibePub,
+		sealedMasterKey: sealedMaster,
+		blsPublicKey:    blsPub,
+		sealedBLSKey:    sealedBLS,
+	}
+
+	longTermPub, _, _ := ed25519.GenerateKey(rand.Reader)
+	extract := func(serverKey ed25519.PublicKey) (*extractReply, error) {
+		// A fresh return key keeps the requests from being replays.
+		returnKey := new([32]byte)
+		rand.Read(returnKey[:])
+		args := &extractArgs{
+			Round:            1,
+			Username:         "alice@example.org",
+			ReturnKey:        returnKey,
+			UserLongTermKey:  longTermPub,
+			ServerSigningKey: serverKey,
+		}
+		if err := args.Sign(loginPriv); err != nil {
+			t.Fatal(err)
+		}
+		return srv.extract(context.Background(), args)
+	}
+
+	// Clients with the old config and the new one are both served.
+	for _, key := range []ed25519.PublicKey{oldPub, newPub} {
+		reply, err := extract(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reply.VerifyAny([]ed25519.PublicKey{oldPub}) || !reply.VerifyAny([]ed25519.PublicKey{newPub}) {
+			t.Fatal("reply is not signed with both keys during the overlap")
+		}
+		data, _ := reply.MarshalBinary()
+		breply := new(extractReply)
+		if err := breply.UnmarshalBinary(data); err != nil {
+			t.Fatal(err)
+		}
+		if !breply.VerifyAny([]ed25519.PublicKey{oldPub}) {
+			t.Fatal("previous signature lost in the binary encoding")
+		}
+	}
+
+	mockClock.Add(time.Hour)
+	if _, err := extract(oldPub); errorCode(err) != ErrInvalidSignature {
+		t.Fatalf("expected ErrInvalidSignature for the old key after the overlap, got %v", err)
+	}
+	reply, err := extract(newPub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reply.PreviousSignature != nil || reply.VerifyAny([]ed25519.PublicKey{oldPub}) {
+		t.Fatal("reply signed with the old key after the overlap")
+	}
+	data, _ := reply.MarshalBinary()
+	if data[0] != extractReplyBinaryVersion {
+		t.Fatalf("unexpected binary version %d", data[0])
+	}
+}
+
+func TestPublicServerConfigKeys(t *testing.T) {
+	oldPub, _, _ := ed25519.GenerateKey(rand.Reader)
+	newPub, _, _ := ed25519.GenerateKey(rand.Reader)
+	conf := PublicServerConfig{Key: newPub, Address: "localhost:1234", PreviousKey: oldPub}
+	data, err := conf.MarshalJSON()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got PublicServerConfig
+	if err := got.UnmarshalJSON(data); err != nil {
+		t.Fatal(err)
+	}
+	if keys := got.Keys(); len(keys) != 2 || !keys[1].Equal(oldPub) {
+		t.Fatalf("PreviousKey lost in round trip: %s", data)
+	}
+	if keys := (PublicServerConfig{Key: newPub}).Keys(); len(keys) != 1 {
+		t.Fatalf("expected one key without PreviousKey, got %d", len(keys))
+	}
+}
@@ -0,0 +1,99 @@
+// Copyright 2018 David Lazar. All rights reserved.
+// Use of this source code is governed by the GNU AGPL
+// license that can be found in the LICENSE file.
+
+package pkg
+
+import (
+	"crypto"
+	"crypto/ed25519"
+
+	"vuvuzela.io/alpenhorn/errors"
+)
+
+// Extract replies and rename attestations name the signature scheme
+// they are signed with, so that a PKG can move to another scheme, such
+// as a hybrid of Ed25519 and a post-quantum scheme, while clients that
+// only know Ed25519 keep working. Ed25519 is the default: its
+// signatures leave the algorithm out, and their messages and wire
+// encodings are the same as before schemes were named. A signature in
+// any other scheme covers the scheme's name, so it cannot be passed off
+// as a signature in a weaker one.
+
+// A SignatureAlgorithm identifies a signature scheme on the wire. The
+// empty string means SignatureEd25519.
+type SignatureAlgorithm string
+
+const SignatureEd25519 SignatureAlgorithm = "ed25519"
+
+// A SignatureScheme signs and verifies a PKG's signatures.
+type SignatureScheme interface {
+	Algorithm() SignatureAlgorithm
+
+	// Sign signs msg with the server's signing key.
+	Sign(signer crypto.Signer, msg []byte) ([]byte, error)
+
+	// Verify reports whether sig is a signature on msg by the server
+	// with the given key.
+	Verify(serverKey ed25519.PublicKey, msg, sig []byte) bool
+}
+
+var signatureSchemes = map[SignatureAlgorithm]SignatureScheme{
+	SignatureEd25519: ed25519Scheme{},
+}
+
+// LookupSignatureScheme returns the scheme with the given algorithm,
+// where the empty string means Ed25519.
+func LookupSignatureScheme(alg SignatureAlgorithm) (SignatureScheme, error) {
+	if alg == "" {
+		alg = SignatureEd25519
+	}
+	s, ok := signatureSchemes[alg]
+	if !ok {
+		return nil, errors.New("unknown signature algorithm %q", alg)
+	}
+	return s, nil
+}
+
+// wireAlgorithm returns the algorithm to send for s: empty for
+// Ed25519, which older clients expect to see unnamed.
+func wireAlgorithm(s SignatureScheme) SignatureAlgorithm {
+	if s.Algorithm() == SignatureEd25519 {
+		return ""
+	}
+	return s.Algorithm()
+}
+
+// verifySignature verifies sig with the scheme named by alg, and
+// returns false if the scheme is unknown.
+func verifySignature(alg SignatureAlgorithm, serverKey ed25519.PublicKey, msg, sig []byte) bool {
+	s, err := LookupSignatureScheme(alg)
+	if err != nil {
+		return false
+	}
+	return s.Verify(serverKey, msg, sig)
+}
+
+type ed25519Scheme struct{}
+
+func (ed25519Scheme) Algorithm() SignatureAlgorithm {
+	return SignatureEd25519
+}
+
+func (ed25519Scheme) Sign(signer crypto.Signer, msg []byte) ([]byte, error) {
+	if key, ok := signer.(ed25519.PrivateKey); ok {
+		return ed25519.Sign(key, msg), nil
+	}
+	sig, err := signer.Sign(nil, msg, crypto.Hash(0))
+	if err != nil {
+		return nil, err
+	}
+	if len(sig) != ed25519.SignatureSize {
+		return nil, errors.New("signer returned %d-byte signature", len(sig))
+	}
+	return sig, nil
+}
+
+func (ed25519Scheme) Verify(serverKey ed25519.PublicKey, msg, sig []byte) bool {
+	return len(serverKey) == ed25519.PublicKeySize && ed25519.Verify(serverKey, msg, sig)
+}
@@ -0,0 +1,107 @@
+// Copyright 2018 David Lazar. All rights reserved.
+// Use of this source code is governed by the GNU AGPL
+// license that can be found in the LICENSE file.
+
+package pkg
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"reflect"
+	"testing"
+)
+
+// prefixScheme stands in for a future scheme: Ed25519 over a
+// domain-separated message.
+type prefixScheme struct{}
+
+func (prefixScheme) Algorithm() SignatureAlgorithm { return "test-prefix" }
+
+func (prefixScheme) Sign(signer crypto.Signer, msg []byte) ([]byte, error) {
+	return ed25519Scheme{}.Sign(signer, append([]byte("prefix"), msg...))
+}
+
+func (prefixScheme) Verify(serverKey ed25519.PublicKey, msg, sig []byte) bool {
+	return ed25519Scheme{}.Verify(serverKey, append([]byte("prefix"), msg...), sig)
+}
+
+func TestSignatureSchemes(t *testing.T) {
+	signatureSchemes["test-prefix"] = prefixScheme{}
+	defer delete(signatureSchemes, "test-prefix")
+
+	serverPub, serverPriv, _ := ed25519.GenerateKey(rand.Reader)
+	srv := &Server{signer: serverPriv, publicKey: serverPub, signatureScheme: ed25519Scheme{}}
+	newReply := func() *extractReply {
+		return &extractReply{
+			Round:               7,
+			Username:            "alice@example.org",
+			EncryptedPrivateKey: []byte("ciphertext"),
+		}
+	}
+
+	// Ed25519 replies look as they did before schemes were named.
+	reply := newReply()
+	if err := srv.signExtractReply(reply); err != nil {
+		t.Fatal(err)
+	}
+	if reply.SignatureAlgorithm != "" || !ed25519.Verify(serverPub, reply.msg(), reply.Signature) {
+		t.Fatalf("unexpected Ed25519 reply: %+v", reply)
+	}
+	data, _ := reply.MarshalBinary()
+	if data[0] != extractReplyBinaryVersion {
+		t.Fatalf("Ed25519 reply has binary version %d", data[0])
+	}
+
+	srv.signatureScheme = prefixScheme{}
+	reply = newReply()
+	if err := srv.signExtractReply(reply); err != nil {
+		t.Fatal(err)
+	}
+	if reply.SignatureAlgorithm != "test-prefix" || !reply.Verify(serverPub) {
+		t.Fatalf("unexpected reply: %+v", reply)
+	}
+	data, err := reply.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ureply := new(extractReply)
+	if err := ureply.UnmarshalBinary(data); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(reply, ureply) {
+		t.Fatalf("after unmarshal: got %#v, want %#v", ureply, reply)
+	}
+	if !ureply.VerifyAny([]ed25519.PublicKey{serverPub}) {
+		t.Fatal("reply does not verify after unmarshal")
+	}
+
+	// The algorithm is covered by the signature.
+	ureply.SignatureAlgorithm = ""
+	if ureply.Verify(serverPub) {
+		t.Fatal("reply verified under another scheme")
+	}
+	ureply.SignatureAlgorithm = "unknown"
+	if ureply.Verify(serverPub) {
+		t.Fatal("reply verified under an unknown scheme")
+	}
+
+	a := &RenameAttestation{
+		OldUsername: "alice@example.org",
+		NewUsername: "alice@example.net",
+		Time:        1,
+
+		SignatureAlgorithm: wireAlgorithm(srv.signatureScheme),
+	}
+	a.Signature, err = srv.signWith(srv.signatureScheme, srv.signer, a.msg(serverPub))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !a.Verify(serverPub) {
+		t.Fatal("rename attestation does not verify")
+	}
+	a.SignatureAlgorithm = ""
+	if a.Verify(serverPub) {
+		t.Fatal("rename attestation verified under another scheme")
+	}
+}
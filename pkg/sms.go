@@ -0,0 +1,128 @@
+// Copyright 2018 David Lazar. All rights reserved.
+// Use of this source code is governed by the GNU AGPL
+// license that can be found in the LICENSE file.
+
+//go:build !js
+// +build !js
+
+package pkg
+
+import (
+	"crypto/rand"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"vuvuzela.io/alpenhorn/errors"
+)
+
+// DefaultSMSCodeTTL is how long an SMS code is valid by default.
+const DefaultSMSCodeTTL = 15 * time.Minute
+
+// An SMSVerifier checks that users own their usernames by texting a
+// six-digit code to the phone number on file for the username.
+type SMSVerifier struct {
+	// PhoneNumber returns the phone number of the user who owns
+	// username.
+	PhoneNumber func(username string) (string, error)
+
+	// GatewayURL is the SMS gateway that sends the texts. The
+	// verifier posts the form values "to" and "body" to it, and
+	// expects a 2xx reply.
+	GatewayURL string
+
+	// Client is the HTTP client used to reach GatewayURL. The
+	// default client is used if Client is nil.
+	Client *http.Client
+
+	// CodeTTL is how long a code is valid. ResendCooldown is the
+	// least time between texts to the same username. Zero values
+	// mean DefaultSMSCodeTTL and DefaultResendCooldown.
+	CodeTTL        time.Duration
+	ResendCooldown time.Duration
+
+	// Send, if not nil, is called to deliver each text instead of
+	// posting it to GatewayURL.
+	Send func(to string, body string) error
+}
+
+func (v *SMSVerifier) Name() string {
+	return "sms"
+}
+
+func (v *SMSVerifier) Check() error {
+	if v.PhoneNumber == nil {
+		return errors.New("no phone number lookup for SMS verification")
+	}
+	if v.Send == nil {
+		u, err := url.Parse(v.GatewayURL)
+		if err != nil {
+			return errors.Wrap(err, "invalid SMS gateway URL")
+		}
+		if u.Scheme != "https" && u.Scheme != "http" {
+			return errors.New("SMS gateway URL must be http or https: %q", v.GatewayURL)
+		}
+	}
+	return nil
+}
+
+func (v *SMSVerifier) Verify(store *VerifierStore, username string, token string) error {
+	ch := &codeChallenge{
+		ttl:      v.CodeTTL,
+		cooldown: v.ResendCooldown,
+		newCode:  newSMSCode,
+		send: func(username string, code string, expires time.Time) error {
+			number, err := v.PhoneNumber(username)
+			if err != nil {
+				return errors.Wrap(err, "looking up phone number")
+			}
+			body := fmt.Sprintf("Your Alpenhorn verification code is %s", code)
+			return v.send(number, body)
+		},
+		normalize: func(code string) string {
+			return strings.NewReplacer(" ", "", "-", "").Replace(code)
+		},
+	}
+	if ch.ttl == 0 {
+		ch.ttl = DefaultSMSCodeTTL
+	}
+	if ch.cooldown == 0 {
+		ch.cooldown = DefaultResendCooldown
+	}
+	return ch.verify(store, username, token)
+}
+
+// newSMSCode returns a random six-digit code. Short codes are safe
+// because each one allows only MaxCodeAttempts guesses.
+func newSMSCode() (string, error) {
+	n, err := rand.Int(rand.Reader, big.NewInt(1000000))
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%06d", n.Int64()), nil
+}
+
+func (v *SMSVerifier) send(to string, body string) error {
+	if v.Send != nil {
+		return v.Send(to, body)
+	}
+	client := v.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.PostForm(v.GatewayURL, url.Values{
+		"to":   []string{to},
+		"body": []string{body},
+	})
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return errors.New("SMS gateway replied %s", resp.Status)
+	}
+	return nil
+}
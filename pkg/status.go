@@ -2,41 +2,21 @@
 // Use of this source code is governed by the GNU AGPL
 // license that can be found in the LICENSE file.
 
+//go:build !js
+// +build !js
+
 package pkg
 
 import (
 	"bytes"
-	"crypto/ed25519"
 	"encoding/json"
 	"net/http"
 
-	"github.com/dgraph-io/badger"
-
 	"vuvuzela.io/alpenhorn/bloom"
 	"vuvuzela.io/alpenhorn/log"
+	"vuvuzela.io/alpenhorn/pkg/kv"
 )
 
-type statusArgs struct {
-	Username         string
-	Message          [32]byte
-	ServerSigningKey ed25519.PublicKey `json:"-"`
-
-	Signature []byte
-}
-
-func (a *statusArgs) msg() []byte {
-	buf := new(bytes.Buffer)
-	buf.WriteString("StatusArgs")
-	buf.Write(a.ServerSigningKey)
-	id := ValidUsernameToIdentity(a.Username)
-	buf.Write(id[:])
-	buf.Write(a.Message[:])
-	return buf.Bytes()
-}
-
-type statusReply struct {
-}
-
 func (srv *Server) statusHandler(w http.ResponseWriter, req *http.Request) {
 	body := http.MaxBytesReader(w, req.Body, 512)
 	args := new(statusArgs)
@@ -45,6 +25,9 @@ func (srv *Server) statusHandler(w http.ResponseWriter, req *http.Request) {
 		httpError(w, errorf(ErrBadRequestJSON, "%s", err))
 		return
 	}
+	if !srv.limitUsername(w, args.Username) {
+		return
+	}
 	args.ServerSigningKey = srv.publicKey
 
 	reply, err := srv.checkStatus(args)
@@ -55,7 +38,7 @@ func (srv *Server) statusHandler(w http.ResponseWriter, req *http.Request) {
 				"code":     errorCode(err).String(),
 			}).Errorf("Status failed: %s", err)
 		}
-		httpError(w, err)
+		httpError(w, srv.lookupFailed(req, args.Username, err))
 		return
 	}
 
@@ -72,31 +55,49 @@ func (srv *Server) checkStatus(args *statusArgs) (*statusReply, error) {
 		return nil, err
 	}
 
-	if !ed25519.Verify(user.LoginKey, args.msg(), args.Signature) {
+	if !srv.verifyBound(&args.ServerSigningKey, func() bool {
+		return user.verifyLogin(srv.clock.Now(), args.msg(), args.Signature)
+	}) {
 		return nil, errorf(ErrInvalidSignature, "")
 	}
 
-	return &statusReply{}, nil
+	// The last extraction authorizes nothing, so it is read from the
+	// replica. A lagging replica may report an extraction late, but
+	// never one that did not happen.
+	var last lastExtraction
+	id := ValidUsernameToIdentity(args.Username)
+	err = srv.replica.View(func(tx kv.Txn) error {
+		data, err := tx.Get(dbUserKey(id, lastExtractionSuffix))
+		if err == kv.ErrNotFound {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		return last.Unmarshal(data)
+	})
+	if err != nil {
+		return nil, errorf(ErrDatabaseError, "%s", err)
+	}
+
+	return &statusReply{
+		LastExtractRound: last.Round,
+		LastExtractTime:  last.UnixTime,
+	}, nil
 }
 
 func (srv *Server) RegisteredUsernames() ([]*[64]byte, error) {
 	users := make([]*[64]byte, 0, 32)
-	err := srv.db.View(func(tx *badger.Txn) error {
-		opt := badger.DefaultIteratorOptions
-		it := tx.NewIterator(opt)
-		defer it.Close()
-
-		for it.Seek(dbUserPrefix); it.ValidForPrefix(dbUserPrefix); it.Next() {
-			key := it.Item().Key()
+	err := srv.db.View(func(tx kv.Txn) error {
+		return tx.Iterate(dbUserPrefix, func(key, _ []byte) error {
 			if !bytes.HasSuffix(key, registrationSuffix) {
-				continue
+				return nil
 			}
 			userID := bytes.TrimSuffix(bytes.TrimPrefix(key, dbUserPrefix), registrationSuffix)
 			clone := new([64]byte)
 			copy(clone[:], userID)
 			users = append(users, clone)
-		}
-		return nil
+			return nil
+		})
 	})
 	if err != nil {
 		return nil, err
@@ -0,0 +1,72 @@
+// Copyright 2018 David Lazar. All rights reserved.
+// Use of this source code is governed by the GNU AGPL
+// license that can be found in the LICENSE file.
+
+//go:build !js
+// +build !js
+
+package pkg
+
+import (
+	"time"
+
+	"vuvuzela.io/alpenhorn/log"
+	"vuvuzela.io/alpenhorn/pkg/kv"
+)
+
+// The server writes short-lived records with a TTL, such as spent
+// replay tokens and proofs of work. Badger drops them once they
+// expire, but the other backends only hide them (see kv.Sweeper), so
+// every SweepInterval the leader deletes them in batches of sweepBatch,
+// each in its own short transaction.
+
+// SweepInterval is how often the leader deletes expired records.
+var SweepInterval = 10 * time.Minute
+
+// sweepBatch is how many expired records are deleted at a time.
+const sweepBatch = 1000
+
+// startSweeper starts deleting expired records. It returns nil,
+// starting nothing, if the database drops them itself.
+func (srv *Server) startSweeper() *janitor {
+	sweeper, ok := backendDB(srv.db).(kv.Sweeper)
+	if !ok {
+		return nil
+	}
+	return srv.newJanitor(SweepInterval, func() {
+		if !srv.isLeader() {
+			return
+		}
+		n, err := sweepExpired(sweeper)
+		if err != nil {
+			srv.log.Errorf("Sweeping expired records: %s", err)
+		} else if n > 0 {
+			srv.log.WithFields(log.Fields{"deleted": n}).Info("Swept expired records")
+		}
+	})
+}
+
+// sweepExpired deletes sweeper's expired records and returns how many
+// it deleted.
+func sweepExpired(sweeper kv.Sweeper) (int, error) {
+	deleted := 0
+	for {
+		n, err := sweeper.SweepExpired(sweepBatch)
+		deleted += n
+		if err != nil || n < sweepBatch {
+			return deleted, err
+		}
+	}
+}
+
+// backendDB returns the database under the server's instrumentation
+// and encryption wrappers.
+func backendDB(db kv.DB) kv.DB {
+	if t, ok := db.(*timedDB); ok {
+		db = t.DB
+	}
+	if s, ok := db.(*kv.SealedDB); ok {
+		db = s.Unwrap()
+	}
+	return db
+}
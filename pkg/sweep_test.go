@@ -0,0 +1,57 @@
+// Copyright 2018 David Lazar. All rights reserved.
+// Use of this source code is governed by the GNU AGPL
+// license that can be found in the LICENSE file.
+
+package pkg
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"testing"
+	"time"
+
+	"vuvuzela.io/alpenhorn/clock"
+	"vuvuzela.io/alpenhorn/pkg/kv"
+)
+
+func TestSweeper(t *testing.T) {
+	mockClock := clock.NewMock(time.Now())
+	db := kv.NewMemory()
+	_, serverKey, _ := ed25519.GenerateKey(rand.Reader)
+	srv, err := NewServer(&Config{
+		DB:               db,
+		SigningKey:       serverKey,
+		RegistrationMode: RegistrationFCFS,
+		Clock:            mockClock,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+
+	err = db.Update(func(tx kv.Txn) error {
+		if err := tx.SetWithTTL([]byte("replay:a"), []byte("a"), time.Nanosecond); err != nil {
+			return err
+		}
+		return tx.SetWithTTL([]byte("replay:b"), []byte("b"), time.Hour)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(10 * time.Millisecond)
+
+	mockClock.BlockUntil(1)
+	mockClock.Add(SweepInterval)
+	mockClock.BlockUntil(1)
+	// Had the sweeper not run, this would delete replay:a.
+	if n, err := db.SweepExpired(10); err != nil || n != 0 {
+		t.Fatalf("expired record left after the sweep: %d %v", n, err)
+	}
+	err = db.View(func(tx kv.Txn) error {
+		_, err := tx.Get([]byte("replay:b"))
+		return err
+	})
+	if err != nil {
+		t.Fatalf("live record swept: %s", err)
+	}
+}
@@ -0,0 +1,202 @@
+// Copyright 2018 David Lazar. All rights reserved.
+// Use of this source code is governed by the GNU AGPL
+// license that can be found in the LICENSE file.
+
+//go:build !js
+// +build !js
+
+package pkg
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/binary"
+	"fmt"
+	"net/url"
+	"time"
+
+	"vuvuzela.io/alpenhorn/clock"
+	"vuvuzela.io/alpenhorn/errors"
+	"vuvuzela.io/alpenhorn/pkg/kv"
+)
+
+// TOTP parameters. These are the defaults of authenticator apps.
+const (
+	totpPeriod     = 30 * time.Second
+	totpDigits     = 6
+	totpSecretSize = 20
+)
+
+// TOTPLockout is how long TOTP verification is locked for a username
+// after MaxCodeAttempts wrong codes in a row.
+const TOTPLockout = 15 * time.Minute
+
+// A TOTPVerifier checks that registration tokens are time-based
+// one-time passwords (RFC 6238) from an authenticator app that the
+// user enrolled out of band, such as by scanning the QR code of a
+// TOTPURI. Each code is accepted at most once.
+type TOTPVerifier struct {
+	// Secret, if not nil, returns the TOTP secret that username
+	// enrolled with. Otherwise the verifier uses the secrets stored
+	// in the PKG database by EnrollTOTP.
+	Secret func(username string) ([]byte, error)
+}
+
+func (v *TOTPVerifier) Name() string {
+	return "totp"
+}
+
+// totpState is a TOTPVerifier's record of a username.
+type totpState struct {
+	LastStep    uint64
+	Failures    uint8
+	LockedUntil time.Time
+	Secret      []byte
+}
+
+const totpStateBinaryVersion byte = 1
+
+func (s *totpState) Marshal() []byte {
+	data := make([]byte, 1+8+1+8, 1+8+1+8+len(s.Secret))
+	data[0] = totpStateBinaryVersion
+	binary.BigEndian.PutUint64(data[1:9], s.LastStep)
+	data[9] = s.Failures
+	binary.BigEndian.PutUint64(data[10:18], uint64(s.LockedUntil.Unix()))
+	return append(data, s.Secret...)
+}
+
+func (s *totpState) Unmarshal(data []byte) error {
+	if len(data) < 1+8+1+8 {
+		return errors.New("short data: got %d bytes, want at least %d bytes", len(data), 1+8+1+8)
+	}
+	if data[0] != totpStateBinaryVersion {
+		return errors.New("unexpected version: got %d, want %d", data[0], totpStateBinaryVersion)
+	}
+	s.LastStep = binary.BigEndian.Uint64(data[1:9])
+	s.Failures = data[9]
+	s.LockedUntil = time.Unix(int64(binary.BigEndian.Uint64(data[10:18])), 0)
+	s.Secret = append([]byte(nil), data[18:]...)
+	return nil
+}
+
+func (v *TOTPVerifier) Verify(store *VerifierStore, username string, token string) error {
+	if token == "" {
+		return errorf(ErrInvalidToken, "TOTP code required")
+	}
+	now := store.Now()
+
+	var result error
+	err := store.Update(username, 0, func(data []byte) ([]byte, error) {
+		var st totpState
+		if data != nil {
+			if err := st.Unmarshal(data); err != nil {
+				return nil, errorf(ErrDatabaseError, "%s", err)
+			}
+		}
+		secret := st.Secret
+		if v.Secret != nil {
+			var err error
+			secret, err = v.Secret(username)
+			if err != nil {
+				return nil, errorf(ErrUnknown, "looking up TOTP secret: %s", err)
+			}
+		}
+		if len(secret) == 0 {
+			return nil, errorf(ErrInvalidToken, "%q is not enrolled for TOTP", username)
+		}
+
+		if now.Before(st.LockedUntil) {
+			return nil, errorf(ErrTooManyAttempts, "try again after %s", st.LockedUntil.UTC().Format(time.RFC3339))
+		}
+
+		step, ok := checkTOTP(secret, token, now, st.LastStep)
+		if !ok {
+			st.Failures++
+			if st.Failures >= MaxCodeAttempts {
+				st.Failures = 0
+				st.LockedUntil = now.Add(TOTPLockout)
+			}
+			result = errorf(ErrInvalidToken, "")
+			return st.Marshal(), nil
+		}
+		st.LastStep = step
+		st.Failures = 0
+		result = nil
+		return st.Marshal(), nil
+	})
+	if err != nil {
+		return err
+	}
+	return result
+}
+
+// checkTOTP reports whether code is the TOTP code for secret within
+// one period of now, and returns its time step. Steps up to lastStep
+// were already used and are rejected.
+func checkTOTP(secret []byte, code string, now time.Time, lastStep uint64) (uint64, bool) {
+	current := uint64(now.Unix() / int64(totpPeriod/time.Second))
+	for _, step := range []uint64{current - 1, current, current + 1} {
+		if step <= lastStep {
+			continue
+		}
+		want := totpCode(secret, step)
+		if subtle.ConstantTimeCompare([]byte(want), []byte(code)) == 1 {
+			return step, true
+		}
+	}
+	return 0, false
+}
+
+// totpCode computes the HOTP (RFC 4226) value of secret at step.
+func totpCode(secret []byte, step uint64) string {
+	var msg [8]byte
+	binary.BigEndian.PutUint64(msg[:], step)
+	mac := hmac.New(sha1.New, secret)
+	mac.Write(msg[:])
+	sum := mac.Sum(nil)
+
+	offset := sum[len(sum)-1] & 0x0f
+	n := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+	return fmt.Sprintf("%0*d", totpDigits, n%1000000)
+}
+
+// EnrollTOTP generates a TOTP secret for username and stores it in
+// the PKG database for a TOTPVerifier, replacing any previous secret.
+// The server must not be running.
+func EnrollTOTP(db kv.DB, username string) ([]byte, error) {
+	secret := make([]byte, totpSecretSize)
+	if _, err := rand.Read(secret); err != nil {
+		return nil, err
+	}
+	store := newVerifierStore(db, new(TOTPVerifier).Name(), clock.Real)
+	err := store.Update(username, 0, func([]byte) ([]byte, error) {
+		st := &totpState{Secret: secret}
+		return st.Marshal(), nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return secret, nil
+}
+
+// TOTPURI returns the otpauth URI that authenticator apps enroll
+// with, usually by scanning it as a QR code.
+func TOTPURI(issuer string, username string, secret []byte) string {
+	vals := url.Values{
+		"secret":    []string{base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(secret)},
+		"issuer":    []string{issuer},
+		"algorithm": []string{"SHA1"},
+		"digits":    []string{fmt.Sprint(totpDigits)},
+		"period":    []string{fmt.Sprint(int(totpPeriod / time.Second))},
+	}
+	u := &url.URL{
+		Scheme:   "otpauth",
+		Host:     "totp",
+		Path:     "/" + issuer + ":" + username,
+		RawQuery: vals.Encode(),
+	}
+	return u.String()
+}
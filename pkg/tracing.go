@@ -0,0 +1,63 @@
+// Copyright 2018 David Lazar. All rights reserved.
+// Use of this source code is governed by the GNU AGPL
+// license that can be found in the LICENSE file.
+
+//go:build !js
+// +build !js
+
+package pkg
+
+import (
+	"context"
+	"net/http"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+
+	"vuvuzela.io/alpenhorn/internal/tracing"
+)
+
+// Every request gets a server span, named "pkg" followed by the path
+// and continuing the trace the client's pkgRequest.Do started. The
+// extract endpoints add child spans for their database calls and key
+// extraction, so a slow extraction shows where its time went.
+
+func (srv *Server) startSpan(ctx context.Context, name string, opts ...trace.SpanStartOption) (context.Context, trace.Span) {
+	return srv.tracer.Start(ctx, name, opts...)
+}
+
+// startRequestSpan starts the server span of req, and returns req with
+// the span in its context.
+func (srv *Server) startRequestSpan(req *http.Request) (*http.Request, trace.Span) {
+	route := req.URL.Path
+	if !paths[route] {
+		// Keep clients from naming spans.
+		route = "/other"
+	}
+	ctx, span := srv.startSpan(tracing.Extract(req.Context(), req.Header), "pkg"+route,
+		trace.WithSpanKind(trace.SpanKindServer),
+		trace.WithAttributes(attribute.String("http.route", route)))
+	return req.WithContext(ctx), span
+}
+
+// endRequestSpan ends a span from startRequestSpan, labeling it with
+// the response's status code and error codes.
+func (srv *Server) endRequestSpan(span trace.Span, w *statusRecorder) {
+	status := w.status
+	if status == 0 {
+		status = http.StatusOK
+	}
+	span.SetAttributes(attribute.Int("http.status_code", status))
+	if len(w.errors) > 0 {
+		names := make([]string, len(w.errors))
+		for i, code := range w.errors {
+			names[i] = code.String()
+		}
+		span.SetAttributes(attribute.StringSlice("pkg.errors", names))
+	}
+	if status >= 500 {
+		span.SetStatus(codes.Error, http.StatusText(status))
+	}
+	span.End()
+}
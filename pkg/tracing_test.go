@@ -0,0 +1,160 @@
+// Copyright 2018 David Lazar. All rights reserved.
+// Use of this source code is governed by the GNU AGPL
+// license that can be found in the LICENSE file.
+
+package pkg
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"go.opentelemetry.io/otel/trace"
+	"go.opentelemetry.io/otel/trace/embedded"
+	"go.opentelemetry.io/otel/trace/noop"
+
+	"vuvuzela.io/alpenhorn/internal/tracing"
+	"vuvuzela.io/alpenhorn/pkg/kv"
+	"vuvuzela.io/crypto/bls"
+	"vuvuzela.io/crypto/ibe"
+)
+
+// spanRecorder is a TracerProvider that records the spans it starts.
+type spanRecorder struct {
+	embedded.TracerProvider
+
+	mu    sync.Mutex
+	spans map[string]*recordedSpan
+}
+
+type recordedSpan struct {
+	noop.Span
+	parent trace.SpanContext
+	sc     trace.SpanContext
+	ended  bool
+}
+
+func (s *recordedSpan) SpanContext() trace.SpanContext { return s.sc }
+func (s *recordedSpan) End(...trace.SpanEndOption)     { s.ended = true }
+
+func (r *spanRecorder) Tracer(string, ...trace.TracerOption) trace.Tracer {
+	return recordingTracer{r: r}
+}
+
+type recordingTracer struct {
+	embedded.Tracer
+	r *spanRecorder
+}
+
+func (t recordingTracer) Start(ctx context.Context, name string, _ ...trace.SpanStartOption) (context.Context, trace.Span) {
+	parent := trace.SpanContextFromContext(ctx)
+	traceID := parent.TraceID()
+	if !traceID.IsValid() {
+		rand.Read(traceID[:])
+	}
+	var spanID trace.SpanID
+	rand.Read(spanID[:])
+	span := &recordedSpan{
+		parent: parent,
+		sc: trace.NewSpanContext(trace.SpanContextConfig{
+			TraceID:    traceID,
+			SpanID:     spanID,
+			TraceFlags: trace.FlagsSampled,
+		}),
+	}
+	t.r.mu.Lock()
+	t.r.spans[name] = span
+	t.r.mu.Unlock()
+	return trace.ContextWithSpan(ctx, span), span
+}
+
+func TestExtractSpans(t *testing.T) {
+	recorder := &spanRecorder{spans: make(map[string]*recordedSpan)}
+	_, serverKey, _ := ed25519.GenerateKey(rand.Reader)
+	srv, err := NewServer(&Config{
+		DB:               kv.NewMemory(),
+		SigningKey:       serverKey,
+		RegistrationMode: RegistrationFCFS,
+		TracerProvider:   recorder,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+
+	loginPub, loginPriv, _ := ed25519.GenerateKey(rand.Reader)
+	if _, err := srv.register(&registerArgs{Username: "alice@example.org", LoginKey: loginPub}); err != nil {
+		t.Fatal(err)
+	}
+	ibePub, ibePriv := ibe.Setup(rand.Reader)
+	blsPub, blsPriv, _ := bls.GenerateKey(rand.Reader)
+	sealedMaster, sealedBLS := srv.roundKEK.sealKeys(ibePriv, blsPriv)
+	srv.rounds[1] = &roundState{
+		masterPublicKey: ibePub,
+		sealedMasterKey: sealedMaster,
+		blsPublicKey:    blsPub,
+		sealedBLSKey:    sealedBLS,
+	}
+
+	longTermPub, _, _ := ed25519.GenerateKey(rand.Reader)
+	args := &extractArgs{
+		Round:            1,
+		Username:         "alice@example.org",
+		ReturnKey:        new([32]byte),
+		UserLongTermKey:  longTermPub,
+		ServerSigningKey: srv.publicKey,
+	}
+	if err := args.Sign(loginPriv); err != nil {
+		t.Fatal(err)
+	}
+	body, _ := json.Marshal(args)
+	req := httptest.NewRequest("POST", "/extract", bytes.NewReader(body))
+
+	// The client's span, as pkgRequest.Do sends it.
+	client := trace.NewSpanContext(trace.SpanContextConfig{
+		TraceID:    trace.TraceID{1, 2, 3},
+		SpanID:     trace.SpanID{4, 5, 6},
+		TraceFlags: trace.FlagsSampled,
+	})
+	tracing.Inject(trace.ContextWithSpanContext(context.Background(), client), req.Header)
+
+	w := httptest.NewRecorder()
+	srv.ServeHTTP(w, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("extract failed: %d %s", w.Code, w.Body)
+	}
+
+	parents := map[string]string{
+		"pkg/extract":           "",
+		"pkg.extract":           "pkg/extract",
+		"pkg.db.getUser":        "pkg.extract",
+		"pkg.db.lastExtraction": "pkg.extract",
+		"pkg.db.logAttestation": "pkg.extract",
+		"pkg.extractKey":        "pkg.extract",
+	}
+	for name, parentName := range parents {
+		span := recorder.spans[name]
+		if span == nil {
+			t.Fatalf("no %s span", name)
+		}
+		if !span.ended {
+			t.Fatalf("%s span not ended", name)
+		}
+		if span.sc.TraceID() != client.TraceID() {
+			t.Fatalf("%s span is not in the client's trace", name)
+		}
+		want := client
+		if parentName != "" {
+			want = recorder.spans[parentName].sc
+		}
+		if span.parent.SpanID() != want.SpanID() {
+			t.Fatalf("%s span has parent %s, want %s", name, span.parent.SpanID(), want.SpanID())
+		}
+	}
+}
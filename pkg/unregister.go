@@ -0,0 +1,126 @@
+// Copyright 2018 David Lazar. All rights reserved.
+// Use of this source code is governed by the GNU AGPL
+// license that can be found in the LICENSE file.
+
+//go:build !js
+// +build !js
+
+package pkg
+
+import (
+	"crypto/ed25519"
+	"encoding/json"
+	"net/http"
+
+	"vuvuzela.io/alpenhorn/log"
+	"vuvuzela.io/alpenhorn/pkg/kv"
+)
+
+// A user can delete their account with a request signed by their login
+// key. The server erases everything it stores under the username: the
+// registration and login key, the user's event log, last extraction,
+// pending login key rotation, PQ key, and the verifier's records, and
+// the username can be registered again. The attestation and
+// registration logs are append-only and keep their entries, but they
+// name users only by LogUsernameHash. Audit events expire after Config.AuditRetention.
+
+func (srv *Server) deleteHandler(w http.ResponseWriter, req *http.Request) {
+	body := http.MaxBytesReader(w, req.Body, 1024)
+	args := new(deleteArgs)
+	err := json.NewDecoder(body).Decode(args)
+	if err != nil {
+		httpError(w, errorf(ErrBadRequestJSON, "%s", err))
+		return
+	}
+	if !srv.limitUsername(w, args.Username) {
+		return
+	}
+	args.ServerSigningKey = srv.publicKey
+
+	logger := srv.log.WithFields(log.Fields{"username": args.Username})
+	loginKey, err := srv.deleteUser(args)
+	srv.audit(&AuditEvent{
+		Type:     AuditDelete,
+		Username: args.Username,
+		Key:      KeyFingerprint(loginKey),
+		Result:   result(err),
+		RemoteIP: remoteIP(req),
+	})
+	if err != nil {
+		logger = logger.WithFields(log.Fields{"code": errorCode(err).String()})
+		if isInternalError(err) {
+			logger.Errorf("Delete failed: %s", err)
+		} else {
+			logger.Infof("Delete failed: %s", err)
+		}
+		httpError(w, err)
+		return
+	}
+	logger.Info("Deleted user")
+	srv.notify(&WebhookEvent{
+		Type:     WebhookDelete,
+		Username: args.Username,
+		RemoteIP: remoteIP(req),
+	})
+
+	w.Write([]byte("\"OK\""))
+}
+
+// deleteUser erases the user's records and returns their login key.
+func (srv *Server) deleteUser(args *deleteArgs) (ed25519.PublicKey, error) {
+	now := srv.clock.Now()
+	if err := checkFresh(args.Time, now); err != nil {
+		return nil, err
+	}
+
+	srv.regLogMu.Lock()
+	defer srv.regLogMu.Unlock()
+	tx, err := srv.db.NewTransaction(true)
+	if err != nil {
+		return nil, errorf(ErrDatabaseError, "%s", err)
+	}
+	defer tx.Discard()
+
+	user, id, err := srv.getUser(tx, args.Username)
+	if err != nil {
+		return nil, err
+	}
+	if !srv.verifyBound(&args.ServerSigningKey, func() bool {
+		return ed25519.Verify(user.LoginKey, args.msg(), args.Signature)
+	}) {
+		return user.LoginKey, errorf(ErrInvalidSignature, "")
+	}
+	if err := checkReplay(tx, "delete", args.Signature, now); err != nil {
+		return user.LoginKey, err
+	}
+
+	if err := srv.eraseUser(tx, id); err != nil {
+		return user.LoginKey, err
+	}
+	if err := srv.logRegistration(tx, id, nil); err != nil {
+		return user.LoginKey, err
+	}
+	if err := tx.Commit(); err != nil {
+		return user.LoginKey, errorf(ErrDatabaseError, "%s", err)
+	}
+	return user.LoginKey, nil
+}
+
+// eraseUser deletes every record of the user, including the verifier's.
+func (srv *Server) eraseUser(tx kv.Txn, id *[64]byte) error {
+	verifierKey := srv.live().verifierStore.idKey(id)
+	keys := [][]byte{verifierKey, append(verifierKey, sinceSuffix...)}
+	err := tx.Iterate(dbUserKey(id, nil), func(key, _ []byte) error {
+		keys = append(keys, append([]byte(nil), key...))
+		return nil
+	})
+	if err != nil {
+		return errorf(ErrDatabaseError, "%s", err)
+	}
+	for _, key := range keys {
+		if err := tx.Delete(key); err != nil {
+			return errorf(ErrDatabaseError, "%s", err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,69 @@
+// Copyright 2018 David Lazar. All rights reserved.
+// Use of this source code is governed by the GNU AGPL
+// license that can be found in the LICENSE file.
+
+package pkg_test
+
+import (
+	"crypto/ed25519"
+	"crypto/mlkem"
+	"crypto/rand"
+	"testing"
+
+	"vuvuzela.io/alpenhorn/edhttp"
+	"vuvuzela.io/alpenhorn/pkg"
+)
+
+func TestUnregister(t *testing.T) {
+	testpkg, _ := launchPKG(t, func(username string, token string) error {
+		return nil
+	})
+	defer testpkg.Close()
+
+	alicePub, aliceKey, _ := ed25519.GenerateKey(rand.Reader)
+	client := &pkg.Client{
+		Username:        "alice@example.org",
+		LoginKey:        aliceKey,
+		UserLongTermKey: alicePub,
+		HTTPClient:      new(edhttp.Client),
+	}
+	server := testpkg.PublicServerConfig
+	if err := client.Register(server, ""); err != nil {
+		t.Fatal(err)
+	}
+	dk, _ := mlkem.GenerateKey768()
+	if err := client.SetPQKey(server, dk.EncapsulationKey().Bytes()); err != nil {
+		t.Fatal(err)
+	}
+
+	_, mallory, _ := ed25519.GenerateKey(rand.Reader)
+	impostor := *client
+	impostor.LoginKey = mallory
+	err := impostor.Unregister(server)
+	if err.(pkg.Error).Code != pkg.ErrInvalidSignature {
+		t.Fatalf("expected ErrInvalidSignature, got %v", err)
+	}
+
+	if err := client.Unregister(server); err != nil {
+		t.Fatal(err)
+	}
+	err = client.CheckStatus(server)
+	if err.(pkg.Error).Code != pkg.ErrNotRegistered {
+		t.Fatalf("expected ErrNotRegistered after unregistering, got %v", err)
+	}
+	_, err = client.LookupPQKey(server, "alice@example.org")
+	if err.(pkg.Error).Code != pkg.ErrNotRegistered {
+		t.Fatalf("expected ErrNotRegistered for the PQ key, got %v", err)
+	}
+	err = client.Unregister(server)
+	if err.(pkg.Error).Code != pkg.ErrNotRegistered {
+		t.Fatalf("expected ErrNotRegistered for a second delete, got %v", err)
+	}
+
+	// The username is free again.
+	bob := *client
+	_, bob.LoginKey, _ = ed25519.GenerateKey(rand.Reader)
+	if err := bob.Register(server, ""); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,66 @@
+// Copyright 2016 David Lazar. All rights reserved.
+// Use of this source code is governed by the GNU AGPL
+// license that can be found in the LICENSE file.
+
+package pkg
+
+import (
+	"bytes"
+	"strings"
+
+	"vuvuzela.io/alpenhorn/errors"
+)
+
+// ValidateUsername returns nil if username is a valid username,
+// otherwise returns an error that explains why the username is invalid.
+func ValidateUsername(username string) error {
+	if len(username) < 3 {
+		return errors.New("username must be at least 3 characters: %s", username)
+	}
+	if len(username) > 64 {
+		return errors.New("username must be 64 characters or less: %s", username)
+	}
+	ix := strings.Index(username, "@")
+	if ix == -1 {
+		return errors.New("username must be a valid email address: %s", username)
+	}
+	if username != strings.ToLower(username) {
+		return errors.New("username must be lowercase: %s", username)
+	}
+	return nil
+}
+
+// UsernameToIdentity converts a username to an identity that can be
+// used with IBE. An error is returned if the username is not valid.
+func UsernameToIdentity(username string) (*[64]byte, error) {
+	if err := ValidateUsername(username); err != nil {
+		return nil, err
+	}
+	return ValidUsernameToIdentity(username), nil
+}
+
+// ValidUsernameToIdentity converts a valid username to an identity.
+// The result is undefined if username is invalid.
+func ValidUsernameToIdentity(username string) *[64]byte {
+	id := new([64]byte)
+	copy(id[:], []byte(username))
+	return id
+}
+
+func validChar(c rune) bool {
+	if c >= 'a' && c <= 'z' {
+		return true
+	}
+	if c >= '0' && c <= '9' {
+		return true
+	}
+	return false
+}
+
+func IdentityToUsername(identity *[64]byte) string {
+	ix := bytes.IndexByte(identity[:], 0)
+	if ix == -1 {
+		return string(identity[:])
+	}
+	return string(identity[0:ix])
+}
@@ -0,0 +1,178 @@
+// Copyright 2018 David Lazar. All rights reserved.
+// Use of this source code is governed by the GNU AGPL
+// license that can be found in the LICENSE file.
+
+package pkg
+
+import (
+	"strings"
+	"unicode"
+
+	"vuvuzela.io/alpenhorn/errors"
+)
+
+// A UsernamePolicy decides which usernames a PKG server accepts, on
+// top of the checks in ValidateUsername. Since users sign requests
+// with their username, the server does not rewrite usernames: it only
+// accepts usernames that are already in the policy's canonical form,
+// and tells the client the canonical form otherwise. Clients should
+// call Normalize before registering.
+//
+// The server applies the policy to new usernames, in registrations
+// and renames, and to the usernames in other requests that are not
+// registered. Users registered before a policy change keep their
+// usernames.
+type UsernamePolicy interface {
+	// Normalize returns the canonical form of username.
+	Normalize(username string) string
+
+	// Validate returns an error that explains why username is not
+	// allowed, or nil if it is.
+	Validate(username string) error
+}
+
+// DefaultUsernamePolicy is the policy used when Config.UsernamePolicy
+// is nil.
+var DefaultUsernamePolicy UsernamePolicy = EmailPolicy{}
+
+// EmailPolicy accepts lowercase email addresses.
+type EmailPolicy struct {
+	// MaxLength is the longest username in bytes. Zero, like anything
+	// above 64, means 64, the size of an identity.
+	MaxLength int
+
+	// AllowUnicode allows letters and digits outside of ASCII in the
+	// local part and the domain. To guard against confusable
+	// usernames, such as a Cyrillic "а" in place of a Latin "a", the
+	// local part and each domain label must be written in a single
+	// script.
+	AllowUnicode bool
+}
+
+// Normalize trims surrounding whitespace and lowercases username.
+func (p EmailPolicy) Normalize(username string) string {
+	return strings.ToLower(strings.TrimSpace(username))
+}
+
+func (p EmailPolicy) Validate(username string) error {
+	if err := ValidateUsername(username); err != nil {
+		return err
+	}
+	max := p.MaxLength
+	if max <= 0 || max > 64 {
+		max = 64
+	}
+	if len(username) > max {
+		return errors.New("username must be %d characters or less: %s", max, username)
+	}
+
+	ix := strings.LastIndex(username, "@")
+	local, domain := username[:ix], username[ix+1:]
+	if err := p.validateLocal(local); err != nil {
+		return errors.Wrap(err, "%s", username)
+	}
+	if err := p.validateDomain(domain); err != nil {
+		return errors.Wrap(err, "%s", username)
+	}
+	return nil
+}
+
+func (p EmailPolicy) validateLocal(local string) error {
+	if local == "" {
+		return errors.New("empty local part")
+	}
+	if local[0] == '.' || local[len(local)-1] == '.' || strings.Contains(local, "..") {
+		return errors.New("misplaced '.' in local part")
+	}
+	for _, c := range local {
+		if c == '.' || isAtext(c) {
+			continue
+		}
+		if p.AllowUnicode && c > unicode.MaxASCII && (unicode.IsLetter(c) || unicode.IsDigit(c)) {
+			continue
+		}
+		return errors.New("invalid character %q in local part", c)
+	}
+	if p.AllowUnicode && !singleScript(local) {
+		return errors.New("local part mixes scripts")
+	}
+	return nil
+}
+
+func (p EmailPolicy) validateDomain(domain string) error {
+	if domain == "" {
+		return errors.New("empty domain")
+	}
+	for _, label := range strings.Split(domain, ".") {
+		if label == "" || len(label) > 63 {
+			return errors.New("invalid domain label %q", label)
+		}
+		if label[0] == '-' || label[len(label)-1] == '-' {
+			return errors.New("domain label %q starts or ends with '-'", label)
+		}
+		for _, c := range label {
+			if c == '-' || c >= 'a' && c <= 'z' || c >= '0' && c <= '9' {
+				continue
+			}
+			if p.AllowUnicode && c > unicode.MaxASCII && (unicode.IsLetter(c) || unicode.IsDigit(c)) {
+				continue
+			}
+			return errors.New("invalid character %q in domain", c)
+		}
+		if p.AllowUnicode && !singleScript(label) {
+			return errors.New("domain label %q mixes scripts", label)
+		}
+	}
+	return nil
+}
+
+// isAtext reports whether c may appear in the local part of an email
+// address without quoting (RFC 5322, section 3.2.3), apart from '.'.
+func isAtext(c rune) bool {
+	switch {
+	case c >= 'a' && c <= 'z', c >= '0' && c <= '9':
+		return true
+	case c >= 'A' && c <= 'Z':
+		// ValidateUsername rejects uppercase.
+		return false
+	}
+	return strings.ContainsRune("!#$%&'*+-/=?^_`{|}~", c)
+}
+
+// scripts are the scripts singleScript tells apart. Han, Hiragana,
+// and Katakana mix in Japanese, so they count as one script. Letters
+// in other scripts all count as one more script, and characters
+// outside of any script, such as digits and punctuation, count toward
+// none.
+var scripts = [][]*unicode.RangeTable{
+	{unicode.Latin}, {unicode.Greek}, {unicode.Cyrillic}, {unicode.Armenian},
+	{unicode.Hebrew}, {unicode.Arabic}, {unicode.Devanagari}, {unicode.Bengali},
+	{unicode.Thai}, {unicode.Georgian}, {unicode.Hangul}, {unicode.Cherokee},
+	{unicode.Han, unicode.Hiragana, unicode.Katakana},
+}
+
+// singleScript reports whether the letters in s come from at most one
+// script.
+func singleScript(s string) bool {
+	seen := -1
+	for _, c := range s {
+		script := -1
+		for i, tables := range scripts {
+			if unicode.In(c, tables...) {
+				script = i
+				break
+			}
+		}
+		if script < 0 {
+			if !unicode.IsLetter(c) {
+				continue
+			}
+			script = len(scripts)
+		}
+		if seen >= 0 && seen != script {
+			return false
+		}
+		seen = script
+	}
+	return true
+}
@@ -0,0 +1,118 @@
+// Copyright 2018 David Lazar. All rights reserved.
+// Use of this source code is governed by the GNU AGPL
+// license that can be found in the LICENSE file.
+
+package pkg
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"strings"
+	"testing"
+
+	"vuvuzela.io/alpenhorn/pkg/kv"
+)
+
+func TestEmailPolicy(t *testing.T) {
+	ascii := EmailPolicy{}
+	unicode := EmailPolicy{AllowUnicode: true}
+	short := EmailPolicy{MaxLength: 20}
+	tests := []struct {
+		policy   EmailPolicy
+		username string
+		ok       bool
+	}{
+		{ascii, "alice@example.org", true},
+		{ascii, "alice.smith+tag@mail.example.org", true},
+		{ascii, "o'brien@example.org", true},
+		{ascii, "alice@localhost", true},
+		{ascii, "Alice@example.org", false},
+		{ascii, "alice@@example.org", false},
+		{ascii, "@example.org", false},
+		{ascii, ".alice@example.org", false},
+		{ascii, "alice.@example.org", false},
+		{ascii, "al..ice@example.org", false},
+		{ascii, "al ice@example.org", false},
+		{ascii, "alice@example..org", false},
+		{ascii, "alice@-example.org", false},
+		{ascii, "alice@exa_mple.org", false},
+		{ascii, "alice@", false},
+		{ascii, "алиса@example.org", false},
+		{short, "alice@example.org", true},
+		{short, "alice.smith@example.org", false},
+		{unicode, "алиса@пример.рф", true},
+		{unicode, "ali2@example.org", true},
+		{unicode, "jürgen@münchen.de", true},
+		{unicode, "たなか@example.jp", true},
+		{unicode, "田中たなか@example.jp", true},
+		{unicode, "pаypal@example.org", false}, // Cyrillic а
+		{unicode, "alice@pаypal.com", false},
+		{unicode, "alice@пример.com", true},
+	}
+	for _, tt := range tests {
+		err := tt.policy.Validate(tt.username)
+		if (err == nil) != tt.ok {
+			t.Errorf("%+v.Validate(%q) = %v, want ok=%v", tt.policy, tt.username, err, tt.ok)
+		}
+	}
+
+	if u := ascii.Normalize("  Alice@Example.ORG\n"); u != "alice@example.org" {
+		t.Errorf("Normalize: got %q", u)
+	}
+}
+
+type testPolicy struct {
+	EmailPolicy
+	deny string
+}
+
+func (p testPolicy) Validate(username string) error {
+	if strings.HasPrefix(username, p.deny) {
+		return errorf(ErrInvalidUsername, "denied")
+	}
+	return p.EmailPolicy.Validate(username)
+}
+
+func TestUsernamePolicy(t *testing.T) {
+	_, serverKey, _ := ed25519.GenerateKey(rand.Reader)
+	db := kv.NewMemory()
+	srv, err := NewServer(&Config{
+		DB:              db,
+		SigningKey:      serverKey,
+		RegTokenHandler: func(string, string) error { return nil },
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+
+	loginKey, _, _ := ed25519.GenerateKey(rand.Reader)
+	register := func(username string) error {
+		_, err := srv.register(&registerArgs{Username: username, LoginKey: loginKey})
+		return err
+	}
+	if err := register("alice@example.org"); err != nil {
+		t.Fatal(err)
+	}
+	if err := register("al..ice@example.org"); errorCode(err) != ErrInvalidUsername {
+		t.Fatalf("expected ErrInvalidUsername, got %v", err)
+	}
+	if err := register(" bob@example.org"); err == nil || !strings.Contains(err.Error(), `use "bob@example.org"`) {
+		t.Fatalf("expected the canonical form in the error, got %v", err)
+	}
+	if _, _, err := srv.getUser(nil, "al..ice@example.org"); errorCode(err) != ErrInvalidUsername {
+		t.Fatalf("expected ErrInvalidUsername, got %v", err)
+	}
+	if _, _, err := srv.getUser(nil, "carol@example.org"); errorCode(err) != ErrNotRegistered {
+		t.Fatalf("expected ErrNotRegistered, got %v", err)
+	}
+
+	// A stricter policy keeps existing users.
+	srv.usernamePolicy = testPolicy{deny: "alice"}
+	if _, _, err := srv.getUser(nil, "alice@example.org"); err != nil {
+		t.Fatalf("existing user: %s", err)
+	}
+	if err := register("alice2@example.org"); errorCode(err) != ErrInvalidUsername {
+		t.Fatalf("expected ErrInvalidUsername, got %v", err)
+	}
+}
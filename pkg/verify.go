@@ -0,0 +1,425 @@
+// Copyright 2018 David Lazar. All rights reserved.
+// Use of this source code is governed by the GNU AGPL
+// license that can be found in the LICENSE file.
+
+//go:build !js
+// +build !js
+
+package pkg
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/binary"
+	"net/http"
+	"net/url"
+	"time"
+
+	"vuvuzela.io/alpenhorn/clock"
+	"vuvuzela.io/alpenhorn/errors"
+	"vuvuzela.io/alpenhorn/pkg/kv"
+)
+
+// A Verifier checks that users own the usernames they register. The
+// server calls Verify with the token that came with each registration.
+//
+// Verifiers that send the user a code, such as by email or SMS, send
+// one when the token is empty and return ErrVerificationSent; the user
+// then registers again with the code as the token.
+//
+// If a Verifier has a method Check() error, NewServer calls it to
+// validate the verifier's configuration.
+type Verifier interface {
+	// Name identifies the verifier in logs and in the database.
+	Name() string
+
+	// Verify returns nil if token proves that the user owns username.
+	// The store keeps the verifier's state in the PKG database.
+	Verify(store *VerifierStore, username string, token string) error
+}
+
+// A RegTokenHandler is a Verifier that keeps no state.
+type RegTokenHandler func(username string, token string) error
+
+func (h RegTokenHandler) Name() string {
+	return "token"
+}
+
+func (h RegTokenHandler) Verify(store *VerifierStore, username string, token string) error {
+	return h(username, token)
+}
+
+// A RegistrationMode says who may register usernames on a server.
+type RegistrationMode string
+
+const (
+	// RegistrationEmail requires users to show that they own their
+	// usernames, usually email addresses, to Config.Verifier.
+	RegistrationEmail RegistrationMode = "email"
+
+	// RegistrationFCFS gives each username to whoever registers it
+	// first, without verification.
+	RegistrationFCFS RegistrationMode = "fcfs"
+
+	// RegistrationToken gives each username to whoever registers it
+	// first with a registration token from the operator, without
+	// verification; see regtoken.go.
+	RegistrationToken RegistrationMode = "token"
+
+	// RegistrationClosed refuses new registrations and renames.
+	// Registered users can still extract their keys.
+	RegistrationClosed RegistrationMode = "closed"
+)
+
+// acceptAll is the verifier of servers that do not verify usernames.
+type acceptAll struct{}
+
+func (acceptAll) Name() string {
+	return "none"
+}
+
+func (acceptAll) Verify(store *VerifierStore, username string, token string) error {
+	return nil
+}
+
+var dbVerifierPrefix = []byte("verify:")
+
+// A VerifierStore keeps a verifier's per-username records in the PKG
+// database.
+type VerifierStore struct {
+	db     kv.DB
+	prefix []byte
+	clock  clock.Clock
+}
+
+func newVerifierStore(db kv.DB, name string, c clock.Clock) *VerifierStore {
+	prefix := append(append([]byte(nil), dbVerifierPrefix...), name...)
+	prefix = append(prefix, ':')
+	return &VerifierStore{db: db, prefix: prefix, clock: c}
+}
+
+func (s *VerifierStore) key(username string) ([]byte, error) {
+	id, err := UsernameToIdentity(username)
+	if err != nil {
+		return nil, errorf(ErrInvalidUsername, "%s", err)
+	}
+	return s.idKey(id), nil
+}
+
+func (s *VerifierStore) idKey(id *[64]byte) []byte {
+	return append(append([]byte(nil), s.prefix...), id[:]...)
+}
+
+// Each record has a companion that holds when the record was created,
+// so the janitor can delete the records of usernames that were never
+// registered (see janitor.go). It is stored under the record's key
+// with sinceSuffix appended.
+var sinceSuffix = []byte(":since")
+
+// splitVerifierKey splits a key under dbVerifierPrefix into the key of
+// the record it is about and the record's identity, and reports
+// whether the key is a companion written at the record's creation.
+func splitVerifierKey(key []byte) (record []byte, id *[64]byte, since bool, ok bool) {
+	rest := key[len(dbVerifierPrefix):]
+	i := bytes.IndexByte(rest, ':')
+	if i < 0 {
+		return nil, nil, false, false
+	}
+	rest = rest[i+1:]
+	switch {
+	case len(rest) == 64:
+		record = key
+	case len(rest) == 64+len(sinceSuffix) && bytes.HasSuffix(rest, sinceSuffix):
+		record = key[:len(key)-len(sinceSuffix)]
+		since = true
+	default:
+		return nil, nil, false, false
+	}
+	id = new([64]byte)
+	copy(id[:], rest)
+	return record, id, since, true
+}
+
+// Now returns the server's current time.
+func (s *VerifierStore) Now() time.Time {
+	return s.clock.Now()
+}
+
+// Get returns the record for username, or nil if there is none.
+func (s *VerifierStore) Get(username string) ([]byte, error) {
+	key, err := s.key(username)
+	if err != nil {
+		return nil, err
+	}
+	var value []byte
+	err = s.db.View(func(tx kv.Txn) error {
+		v, err := tx.Get(key)
+		if err == kv.ErrNotFound {
+			return nil
+		}
+		value = append([]byte(nil), v...)
+		return err
+	})
+	if err != nil {
+		return nil, errorf(ErrDatabaseError, "%s", err)
+	}
+	return value, nil
+}
+
+// Update atomically replaces the record for username with the result
+// of fn, which is called with the current record or nil. The record
+// is deleted if fn returns nil, and expires after ttl unless ttl is
+// zero. If fn returns an error, the record is left unchanged.
+func (s *VerifierStore) Update(username string, ttl time.Duration, fn func(value []byte) ([]byte, error)) error {
+	key, err := s.key(username)
+	if err != nil {
+		return err
+	}
+	err = s.db.Update(func(tx kv.Txn) error {
+		old, err := tx.Get(key)
+		if err == kv.ErrNotFound {
+			old = nil
+		} else if err != nil {
+			return errorf(ErrDatabaseError, "%s", err)
+		}
+		value, err := fn(old)
+		if err != nil {
+			return err
+		}
+		sinceKey := append(append([]byte(nil), key...), sinceSuffix...)
+		since, err := tx.Get(sinceKey)
+		if err == kv.ErrNotFound {
+			since = appendUint64(nil, uint64(s.clock.Now().Unix()))
+		} else if err != nil {
+			return errorf(ErrDatabaseError, "%s", err)
+		}
+		switch {
+		case value == nil:
+			err = tx.Delete(key)
+			if err == nil {
+				err = tx.Delete(sinceKey)
+			}
+		case ttl == 0:
+			err = tx.Set(key, value)
+			if err == nil {
+				err = tx.Set(sinceKey, since)
+			}
+		default:
+			err = tx.SetWithTTL(key, value, ttl)
+			if err == nil {
+				err = tx.SetWithTTL(sinceKey, since, ttl)
+			}
+		}
+		if err != nil {
+			return errorf(ErrDatabaseError, "%s", err)
+		}
+		return nil
+	})
+	if _, ok := err.(Error); !ok && err != nil {
+		return errorf(ErrDatabaseError, "%s", err)
+	}
+	return err
+}
+
+// MaxCodeAttempts is how many wrong codes a user may try before the
+// code sent to them stops working.
+const MaxCodeAttempts = 5
+
+// A codeChallenge sends codes to users and checks them. It
+// implements the verifiers that send codes by email or SMS.
+type codeChallenge struct {
+	ttl      time.Duration
+	cooldown time.Duration
+
+	// newCode generates a code. send delivers it to the user.
+	newCode func() (string, error)
+	send    func(username string, code string, expires time.Time) error
+
+	// normalize maps a code as the user typed it to the code sent.
+	normalize func(code string) string
+}
+
+// pendingCode is the record of the last code sent to a username.
+type pendingCode struct {
+	Sent     time.Time
+	Expires  time.Time
+	Attempts uint8
+	CodeHash [32]byte
+}
+
+const pendingCodeBinaryVersion byte = 1
+
+const pendingCodeSize = 1 + 8 + 8 + 1 + 32
+
+func (c *pendingCode) Marshal() []byte {
+	data := make([]byte, pendingCodeSize)
+	data[0] = pendingCodeBinaryVersion
+	binary.BigEndian.PutUint64(data[1:9], uint64(c.Sent.Unix()))
+	binary.BigEndian.PutUint64(data[9:17], uint64(c.Expires.Unix()))
+	data[17] = c.Attempts
+	copy(data[18:], c.CodeHash[:])
+	return data
+}
+
+func (c *pendingCode) Unmarshal(data []byte) error {
+	if len(data) != pendingCodeSize {
+		return errors.New("short data: got %d bytes, want %d bytes", len(data), pendingCodeSize)
+	}
+	if data[0] != pendingCodeBinaryVersion {
+		return errors.New("unexpected version: got %d, want %d", data[0], pendingCodeBinaryVersion)
+	}
+	c.Sent = time.Unix(int64(binary.BigEndian.Uint64(data[1:9])), 0)
+	c.Expires = time.Unix(int64(binary.BigEndian.Uint64(data[9:17])), 0)
+	c.Attempts = data[17]
+	copy(c.CodeHash[:], data[18:])
+	return nil
+}
+
+func (ch *codeChallenge) hash(code string) [32]byte {
+	if ch.normalize != nil {
+		code = ch.normalize(code)
+	}
+	return sha256.Sum256([]byte(code))
+}
+
+func (ch *codeChallenge) verify(store *VerifierStore, username string, token string) error {
+	if token == "" {
+		return ch.sendCode(store, username)
+	}
+	return ch.checkCode(store, username, token)
+}
+
+func (ch *codeChallenge) sendCode(store *VerifierStore, username string) error {
+	now := store.Now()
+	code, err := ch.newCode()
+	if err != nil {
+		return errorf(ErrUnknown, "%s", err)
+	}
+	rec := &pendingCode{
+		Sent:     now,
+		Expires:  now.Add(ch.ttl),
+		CodeHash: ch.hash(code),
+	}
+
+	// Record the code before sending it, so that concurrent
+	// requests cannot get around the cooldown.
+	err = store.Update(username, ch.ttl, func(data []byte) ([]byte, error) {
+		var prev pendingCode
+		if data != nil && prev.Unmarshal(data) == nil {
+			wait := prev.Sent.Add(ch.cooldown).Sub(now)
+			if wait > 0 {
+				return nil, errorf(ErrResendTooSoon, "try again in %s", wait.Round(time.Second))
+			}
+		}
+		return rec.Marshal(), nil
+	})
+	if err != nil {
+		return err
+	}
+
+	if err := ch.send(username, code, rec.Expires); err != nil {
+		// Let the user try again right away.
+		store.Update(username, 0, func([]byte) ([]byte, error) { return nil, nil })
+		return errorf(ErrUnknown, "sending verification code: %s", err)
+	}
+	return errorf(ErrVerificationSent, "%q", username)
+}
+
+func (ch *codeChallenge) checkCode(store *VerifierStore, username string, token string) error {
+	now := store.Now()
+	h := ch.hash(token)
+	var result error
+	err := store.Update(username, ch.ttl, func(data []byte) ([]byte, error) {
+		if data == nil {
+			result = errorf(ErrInvalidToken, "no code sent to %q", username)
+			return nil, nil
+		}
+		var rec pendingCode
+		if err := rec.Unmarshal(data); err != nil {
+			return nil, errorf(ErrDatabaseError, "%s", err)
+		}
+		if !now.Before(rec.Expires) {
+			result = errorf(ErrExpiredToken, "")
+			return nil, nil
+		}
+		if rec.Attempts >= MaxCodeAttempts {
+			result = errorf(ErrTooManyAttempts, "request a new code")
+			return data, nil
+		}
+		if subtle.ConstantTimeCompare(h[:], rec.CodeHash[:]) != 1 {
+			rec.Attempts++
+			result = errorf(ErrInvalidToken, "")
+			return rec.Marshal(), nil
+		}
+		// A code is good for one registration.
+		result = nil
+		return nil, nil
+	})
+	if err != nil {
+		return err
+	}
+	return result
+}
+
+// A WebhookVerifier asks an external service to verify registrations.
+// It posts the form values "username" and "token" to URL. The service
+// replies 200 OK if the token is valid, 202 Accepted if it sent the
+// user a token, and 429 Too Many Requests if it sent one too recently.
+type WebhookVerifier struct {
+	URL string
+
+	// Client is the HTTP client used to reach URL. The default
+	// client is used if Client is nil.
+	Client *http.Client
+}
+
+func (v *WebhookVerifier) Name() string {
+	return "webhook"
+}
+
+func (v *WebhookVerifier) Check() error {
+	u, err := url.Parse(v.URL)
+	if err != nil {
+		return errors.Wrap(err, "invalid webhook URL")
+	}
+	if u.Scheme != "https" && u.Scheme != "http" {
+		return errors.New("webhook URL must be http or https: %q", v.URL)
+	}
+	return nil
+}
+
+func (v *WebhookVerifier) Verify(store *VerifierStore, username string, token string) error {
+	client := v.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	vals := url.Values{
+		"username": []string{username},
+		"token":    []string{token},
+	}
+	resp, err := client.PostForm(v.URL, vals)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return nil
+	case http.StatusAccepted:
+		return errorf(ErrVerificationSent, "%q", username)
+	case http.StatusTooManyRequests:
+		return errorf(ErrResendTooSoon, "")
+	default:
+		return errorf(ErrInvalidToken, "")
+	}
+}
+
+// ExternalVerifier returns a RegTokenHandler that verifies tokens
+// with the registrar's verify endpoint. See WebhookVerifier.
+func ExternalVerifier(verifyURL string) RegTokenHandler {
+	v := &WebhookVerifier{URL: verifyURL}
+	return func(username string, token string) error {
+		return v.Verify(nil, username, token)
+	}
+}
@@ -0,0 +1,196 @@
+// Copyright 2018 David Lazar. All rights reserved.
+// Use of this source code is governed by the GNU AGPL
+// license that can be found in the LICENSE file.
+
+package pkg
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"vuvuzela.io/alpenhorn/clock"
+	"vuvuzela.io/alpenhorn/pkg/kv"
+)
+
+func newVerifierServer(t *testing.T, v Verifier, c clock.Clock) *Server {
+	_, serverKey, _ := ed25519.GenerateKey(rand.Reader)
+	srv, err := NewServer(&Config{
+		DB:         kv.NewMemory(),
+		SigningKey: serverKey,
+		Clock:      c,
+		Verifier:   v,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return srv
+}
+
+func TestVerifierConfig(t *testing.T) {
+	_, serverKey, _ := ed25519.GenerateKey(rand.Reader)
+	_, err := NewServer(&Config{
+		DB:         kv.NewMemory(),
+		SigningKey: serverKey,
+	})
+	if err == nil {
+		t.Fatal("expected error without a verifier")
+	}
+	_, err = NewServer(&Config{
+		DB:              kv.NewMemory(),
+		SigningKey:      serverKey,
+		Verifier:        new(TOTPVerifier),
+		RegTokenHandler: func(string, string) error { return nil },
+	})
+	if err == nil {
+		t.Fatal("expected error with both a verifier and a RegTokenHandler")
+	}
+	_, err = NewServer(&Config{
+		DB:         kv.NewMemory(),
+		SigningKey: serverKey,
+		Verifier:   &EmailVerifier{SMTPAddr: "localhost:25"},
+	})
+	if err == nil {
+		t.Fatal("expected error from the verifier's Check")
+	}
+}
+
+func TestSMSVerifier(t *testing.T) {
+	var code string
+	srv := newVerifierServer(t, &SMSVerifier{
+		PhoneNumber: func(username string) (string, error) {
+			return "+15555550100", nil
+		},
+		Send: func(to string, body string) error {
+			if to != "+15555550100" {
+				t.Errorf("text sent to %q", to)
+			}
+			code = body[strings.LastIndex(body, " ")+1:]
+			return nil
+		},
+	}, nil)
+	defer srv.Close()
+
+	verify := func(token string) error {
+		return srv.live().verifier.Verify(srv.live().verifierStore, "alice@example.org", token)
+	}
+
+	if err := verify(""); errorCode(err) != ErrVerificationSent {
+		t.Fatalf("expected ErrVerificationSent, got %v", err)
+	}
+	if len(code) != 6 {
+		t.Fatalf("unexpected code %q", code)
+	}
+	wrong := "000000"
+	if code == wrong {
+		wrong = "111111"
+	}
+	for i := 0; i < MaxCodeAttempts; i++ {
+		if err := verify(wrong); errorCode(err) != ErrInvalidToken {
+			t.Fatalf("attempt %d: expected ErrInvalidToken, got %v", i, err)
+		}
+	}
+	// The right code no longer works after too many wrong ones.
+	if err := verify(code); errorCode(err) != ErrTooManyAttempts {
+		t.Fatalf("expected ErrTooManyAttempts, got %v", err)
+	}
+}
+
+func TestTOTPCode(t *testing.T) {
+	// From RFC 6238, Appendix B, truncated to six digits.
+	secret := []byte("12345678901234567890")
+	for _, tc := range []struct {
+		unix int64
+		code string
+	}{
+		{59, "287082"},
+		{1111111109, "081804"},
+		{1234567890, "005924"},
+		{2000000000, "279037"},
+	} {
+		step := uint64(tc.unix / 30)
+		if got := totpCode(secret, step); got != tc.code {
+			t.Errorf("time %d: got %s, want %s", tc.unix, got, tc.code)
+		}
+	}
+}
+
+func TestTOTPVerifier(t *testing.T) {
+	mockClock := clock.NewMock(time.Unix(1234567890, 0))
+	srv := newVerifierServer(t, new(TOTPVerifier), mockClock)
+	defer srv.Close()
+
+	verify := func(token string) error {
+		return srv.live().verifier.Verify(srv.live().verifierStore, "alice@example.org", token)
+	}
+	if err := verify("123456"); errorCode(err) != ErrInvalidToken {
+		t.Fatalf("expected ErrInvalidToken before enrolling, got %v", err)
+	}
+
+	secret, err := EnrollTOTP(srv.db, "alice@example.org")
+	if err != nil {
+		t.Fatal(err)
+	}
+	uri := TOTPURI("Alpenhorn", "alice@example.org", secret)
+	if !strings.HasPrefix(uri, "otpauth://totp/Alpenhorn:alice@example.org?") {
+		t.Fatalf("unexpected URI: %s", uri)
+	}
+
+	code := totpCode(secret, uint64(mockClock.Now().Unix()/30))
+	if err := verify(code); err != nil {
+		t.Fatal(err)
+	}
+	if err := verify(code); errorCode(err) != ErrInvalidToken {
+		t.Fatalf("expected ErrInvalidToken for a reused code, got %v", err)
+	}
+
+	mockClock.Add(30 * time.Second)
+	for i := 0; i < MaxCodeAttempts; i++ {
+		verify("not a code")
+	}
+	code = totpCode(secret, uint64(mockClock.Now().Unix()/30))
+	if err := verify(code); errorCode(err) != ErrTooManyAttempts {
+		t.Fatalf("expected ErrTooManyAttempts, got %v", err)
+	}
+	mockClock.Add(TOTPLockout)
+	code = totpCode(secret, uint64(mockClock.Now().Unix()/30))
+	if err := verify(code); err != nil {
+		t.Fatalf("after the lockout: %s", err)
+	}
+}
+
+func TestWebhookVerifier(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.FormValue("token") {
+		case "":
+			w.WriteHeader(http.StatusAccepted)
+		case "good":
+			if r.FormValue("username") != "alice@example.org" {
+				w.WriteHeader(http.StatusForbidden)
+			}
+		default:
+			w.WriteHeader(http.StatusForbidden)
+		}
+	}))
+	defer ts.Close()
+
+	srv := newVerifierServer(t, &WebhookVerifier{URL: ts.URL}, nil)
+	defer srv.Close()
+
+	verify := func(token string) error {
+		return srv.live().verifier.Verify(srv.live().verifierStore, "alice@example.org", token)
+	}
+	if err := verify(""); errorCode(err) != ErrVerificationSent {
+		t.Fatalf("expected ErrVerificationSent, got %v", err)
+	}
+	if err := verify("bad"); errorCode(err) != ErrInvalidToken {
+		t.Fatalf("expected ErrInvalidToken, got %v", err)
+	}
+	if err := verify("good"); err != nil {
+		t.Fatal(err)
+	}
+}
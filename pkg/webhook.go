@@ -0,0 +1,242 @@
+// Copyright 2018 David Lazar. All rights reserved.
+// Use of this source code is governed by the GNU AGPL
+// license that can be found in the LICENSE file.
+
+//go:build !js
+// +build !js
+
+package pkg
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"vuvuzela.io/alpenhorn/errors"
+	"vuvuzela.io/alpenhorn/log"
+)
+
+// Webhooks tell external services, such as fraud analysis or alerting
+// pipelines, about events on the server as they happen. Each event is
+// posted as JSON to every webhook that wants it, signed with the
+// webhook's secret. Events are queued and posted in the background, so
+// a slow or failing webhook does not hold up requests; when the queue
+// is full, new events are dropped and logged.
+
+type WebhookEventType string
+
+const (
+	// WebhookRegister is sent when a user completes registration.
+	WebhookRegister WebhookEventType = "register"
+	// WebhookVerify is sent when a verifier accepts a user's token.
+	WebhookVerify WebhookEventType = "verify"
+	// WebhookDelete is sent when a user deletes their account.
+	WebhookDelete WebhookEventType = "delete"
+	// WebhookRoundFailure is sent when the server rejects or fails a
+	// round setup request from a coordinator.
+	WebhookRoundFailure WebhookEventType = "roundfailure"
+)
+
+// A WebhookEvent is the JSON payload posted to webhooks.
+type WebhookEvent struct {
+	Time time.Time
+	Type WebhookEventType
+
+	// Server is the hex encoding of the server's signing key, so a
+	// webhook can tell the PKGs that post to it apart.
+	Server string
+
+	Username string `json:",omitempty"`
+	Round    uint32 `json:",omitempty"`
+
+	// Detail is the verifier's name for verifications and the error
+	// for round failures.
+	Detail   string `json:",omitempty"`
+	RemoteIP string `json:",omitempty"`
+}
+
+// WebhookSignatureHeader is the header that carries a payload's
+// signature: "sha256=" followed by the hex HMAC-SHA256 of the body,
+// keyed with the webhook's secret.
+const WebhookSignatureHeader = "X-Alpenhorn-Signature"
+
+// A Webhook is a URL that the server posts events to.
+type Webhook struct {
+	URL string
+
+	// Secret is the key that payloads are signed with.
+	Secret []byte
+
+	// Events are the event types posted to the webhook. All events
+	// are posted if Events is empty.
+	Events []WebhookEventType
+
+	// Client is the HTTP client used to reach URL. A client with a
+	// 10 second timeout is used if Client is nil.
+	Client *http.Client
+}
+
+func (h *Webhook) Check() error {
+	u, err := url.Parse(h.URL)
+	if err != nil {
+		return errors.Wrap(err, "invalid webhook URL")
+	}
+	if u.Scheme != "https" && u.Scheme != "http" {
+		return errors.New("webhook URL must be http or https: %q", h.URL)
+	}
+	if len(h.Secret) == 0 {
+		return errors.New("webhook %q has no secret", h.URL)
+	}
+	for _, t := range h.Events {
+		switch t {
+		case WebhookRegister, WebhookVerify, WebhookDelete, WebhookRoundFailure:
+		default:
+			return errors.New("webhook %q: unknown event type %q", h.URL, t)
+		}
+	}
+	return nil
+}
+
+func (h *Webhook) wants(t WebhookEventType) bool {
+	if len(h.Events) == 0 {
+		return true
+	}
+	for _, e := range h.Events {
+		if e == t {
+			return true
+		}
+	}
+	return false
+}
+
+// SignWebhook returns the signature of a webhook payload.
+func SignWebhook(secret []byte, body []byte) string {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// VerifyWebhook reports whether signature, the value of a request's
+// WebhookSignatureHeader, is the signature of body.
+func VerifyWebhook(secret []byte, body []byte, signature string) bool {
+	if !strings.HasPrefix(signature, "sha256=") {
+		return false
+	}
+	return hmac.Equal([]byte(signature), []byte(SignWebhook(secret, body)))
+}
+
+var defaultWebhookClient = &http.Client{Timeout: 10 * time.Second}
+
+// webhookQueueSize is how many events can wait to be posted.
+const webhookQueueSize = 1024
+
+// webhookAttempts is how many times an event is posted to a webhook
+// before it is given up on.
+const webhookAttempts = 3
+
+type webhooks struct {
+	hooks []*Webhook
+	log   *log.Logger
+
+	queue chan *WebhookEvent
+	done  chan struct{}
+	once  sync.Once
+}
+
+func newWebhooks(hooks []*Webhook, logger *log.Logger) *webhooks {
+	if len(hooks) == 0 {
+		return nil
+	}
+	w := &webhooks{
+		hooks: hooks,
+		log:   logger,
+		queue: make(chan *WebhookEvent, webhookQueueSize),
+		done:  make(chan struct{}),
+	}
+	go w.run()
+	return w
+}
+
+func (w *webhooks) run() {
+	for {
+		select {
+		case e := <-w.queue:
+			w.deliver(e)
+		case <-w.done:
+			return
+		}
+	}
+}
+
+func (w *webhooks) deliver(e *WebhookEvent) {
+	body, err := json.Marshal(e)
+	if err != nil {
+		panic(err)
+	}
+	for _, h := range w.hooks {
+		if !h.wants(e.Type) {
+			continue
+		}
+		var err error
+		for i := 0; i < webhookAttempts; i++ {
+			if i > 0 {
+				time.Sleep(time.Duration(i) * time.Second)
+			}
+			if err = h.post(body); err == nil {
+				break
+			}
+		}
+		if err != nil {
+			w.log.WithFields(log.Fields{"webhook": h.URL, "event": e.Type}).Errorf("Posting webhook: %s", err)
+		}
+	}
+}
+
+func (h *Webhook) post(body []byte) error {
+	client := h.Client
+	if client == nil {
+		client = defaultWebhookClient
+	}
+	req, err := http.NewRequest("POST", h.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(WebhookSignatureHeader, SignWebhook(h.Secret, body))
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return errors.New("webhook returned %s", resp.Status)
+	}
+	return nil
+}
+
+func (w *webhooks) close() {
+	if w != nil {
+		w.once.Do(func() { close(w.done) })
+	}
+}
+
+// notify queues an event for the server's webhooks.
+func (srv *Server) notify(e *WebhookEvent) {
+	if srv.webhooks == nil {
+		return
+	}
+	e.Time = srv.clock.Now()
+	e.Server = hex.EncodeToString(srv.publicKey)
+	select {
+	case srv.webhooks.queue <- e:
+	default:
+		srv.log.WithFields(log.Fields{"event": e.Type}).Warnf("Webhook queue is full; dropping event")
+	}
+}
@@ -0,0 +1,121 @@
+// Copyright 2018 David Lazar. All rights reserved.
+// Use of this source code is governed by the GNU AGPL
+// license that can be found in the LICENSE file.
+
+package pkg
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"vuvuzela.io/alpenhorn/pkg/kv"
+)
+
+func TestWebhooks(t *testing.T) {
+	secret := []byte("webhook secret")
+	type post struct {
+		hook  string
+		event WebhookEvent
+	}
+	posts := make(chan post, 10)
+	hookServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		body, _ := ioutil.ReadAll(req.Body)
+		if !VerifyWebhook(secret, body, req.Header.Get(WebhookSignatureHeader)) {
+			t.Errorf("bad webhook signature: %q", req.Header.Get(WebhookSignatureHeader))
+			http.Error(w, "bad signature", http.StatusForbidden)
+			return
+		}
+		var e WebhookEvent
+		if err := json.Unmarshal(body, &e); err != nil {
+			t.Error(err)
+		}
+		posts <- post{hook: req.URL.Path, event: e}
+	}))
+	defer hookServer.Close()
+
+	coordinatorPub, _, _ := ed25519.GenerateKey(rand.Reader)
+	serverPub, serverKey, _ := ed25519.GenerateKey(rand.Reader)
+	srv, err := NewServer(&Config{
+		DB:               kv.NewMemory(),
+		SigningKey:       serverKey,
+		CoordinatorKey:   coordinatorPub,
+		RegistrationMode: RegistrationFCFS,
+		Webhooks: []*Webhook{
+			{URL: hookServer.URL + "/all", Secret: secret},
+			{URL: hookServer.URL + "/rounds", Secret: secret, Events: []WebhookEventType{WebhookRoundFailure}},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer srv.Close()
+
+	next := func() post {
+		select {
+		case p := <-posts:
+			return p
+		case <-time.After(5 * time.Second):
+			t.Fatal("timed out waiting for webhook")
+		}
+		panic("unreachable")
+	}
+
+	loginKey, _, _ := ed25519.GenerateKey(rand.Reader)
+	body, _ := json.Marshal(&registerArgs{Username: "alice@example.org", LoginKey: loginKey})
+	w := httptest.NewRecorder()
+	srv.ServeHTTP(w, httptest.NewRequest("POST", "/register", bytes.NewReader(body)))
+	if w.Code != http.StatusOK {
+		t.Fatalf("register: %d %s", w.Code, w.Body)
+	}
+	p := next()
+	if p.hook != "/all" || p.event.Type != WebhookRegister || p.event.Username != "alice@example.org" {
+		t.Fatalf("unexpected webhook post: %+v", p)
+	}
+	if p.event.Server != hex.EncodeToString(serverPub) {
+		t.Fatalf("unexpected server in webhook event: %s", p.event.Server)
+	}
+
+	body, _ = json.Marshal(&revealArgs{Round: 7, coordinatorNonce: newCoordinatorNonce(time.Now())})
+	req := httptest.NewRequest("POST", "/reveal", bytes.NewReader(body))
+	req.TLS = &tls.ConnectionState{
+		PeerCertificates: []*x509.Certificate{{PublicKey: coordinatorPub}},
+	}
+	w = httptest.NewRecorder()
+	srv.ServeHTTP(w, req)
+	if w.Code == http.StatusOK {
+		t.Fatal("reveal of an unknown round succeeded")
+	}
+	seen := map[string]bool{}
+	for i := 0; i < 2; i++ {
+		p := next()
+		if p.event.Type != WebhookRoundFailure || p.event.Round != 7 {
+			t.Fatalf("unexpected webhook post: %+v", p)
+		}
+		seen[p.hook] = true
+	}
+	if !seen["/all"] || !seen["/rounds"] {
+		t.Fatalf("round failure not posted to both webhooks: %v", seen)
+	}
+
+	if VerifyWebhook(secret, []byte("{}"), SignWebhook([]byte("other secret"), []byte("{}"))) {
+		t.Fatal("signature with the wrong secret verified")
+	}
+	if _, err := NewServer(&Config{
+		DB:               kv.NewMemory(),
+		SigningKey:       serverKey,
+		RegistrationMode: RegistrationFCFS,
+		Webhooks:         []*Webhook{{URL: hookServer.URL}},
+	}); err == nil {
+		t.Fatal("expected error for a webhook without a secret")
+	}
+}
@@ -0,0 +1,126 @@
+// Copyright 2018 David Lazar. All rights reserved.
+// Use of this source code is governed by the GNU AGPL
+// license that can be found in the LICENSE file.
+
+package pkg
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"math/bits"
+	"strconv"
+	"time"
+)
+
+// PQ key lookups are anonymous, so a PKG can require each one to carry
+// a hashcash-style proof of work (Config.LookupWorkBits). The work is
+// bound to the PKG, the username, and the time, so every username a
+// harvester looks up costs a fresh proof, and the server accepts each
+// proof only once. Servers that require work reject lookups without it
+// with ErrWorkRequired, whose message is the number of bits;
+// pkg.Client then solves the puzzle and retries.
+
+// workWindow bounds how far a proof's time may be from the server's
+// clock.
+const workWindow = 5 * time.Minute
+
+// maxWorkBits bounds the difficulty clients will attempt.
+const maxWorkBits = 32
+
+// A WorkStamp is a proof of work on a lookup.
+type WorkStamp struct {
+	// Time is when the work was done, in Unix seconds.
+	Time  int64
+	Nonce uint64
+}
+
+func workHash(serverKey ed25519.PublicKey, username string, stamp *WorkStamp) [32]byte {
+	h := sha256.New()
+	h.Write([]byte("LookupWork"))
+	h.Write(serverKey)
+	id := ValidUsernameToIdentity(username)
+	h.Write(id[:])
+	var buf [16]byte
+	binary.BigEndian.PutUint64(buf[0:8], uint64(stamp.Time))
+	binary.BigEndian.PutUint64(buf[8:16], stamp.Nonce)
+	h.Write(buf[:])
+	var sum [32]byte
+	h.Sum(sum[:0])
+	return sum
+}
+
+func leadingZeros(h [32]byte) int {
+	n := 0
+	for i := 0; i < len(h); i += 8 {
+		z := bits.LeadingZeros64(binary.BigEndian.Uint64(h[i : i+8]))
+		n += z
+		if z < 64 {
+			break
+		}
+	}
+	return n
+}
+
+// solveWork finds a stamp with at least workBits leading zero bits.
+// It starts from a random nonce, so lookups of the same username in
+// the same second get different stamps.
+func solveWork(serverKey ed25519.PublicKey, username string, workBits int, now time.Time) *WorkStamp {
+	var r [8]byte
+	rand.Read(r[:])
+	stamp := &WorkStamp{Time: now.Unix(), Nonce: binary.BigEndian.Uint64(r[:])}
+	for leadingZeros(workHash(serverKey, username, stamp)) < workBits {
+		stamp.Nonce++
+	}
+	return stamp
+}
+
+// Registrations can require a proof of work too
+// (Config.RegisterWorkBits), to make registering many accounts
+// expensive. The server answers a registration without work with
+// ErrWorkRequired; pkg.Client then asks the server for a challenge,
+// which is bound to the username and expires, and solves it for its
+// login key. Work is checked before the server verifies the username,
+// so it also throttles verification emails.
+
+// A RegisterWork is a proof of work on a registration challenge.
+type RegisterWork struct {
+	Challenge []byte
+	Nonce     uint64
+}
+
+func registerWorkHash(serverKey ed25519.PublicKey, loginKey ed25519.PublicKey, work *RegisterWork) [32]byte {
+	h := sha256.New()
+	h.Write([]byte("RegisterWork"))
+	h.Write(serverKey)
+	h.Write(loginKey)
+	h.Write(work.Challenge)
+	var buf [8]byte
+	binary.BigEndian.PutUint64(buf[:], work.Nonce)
+	h.Write(buf[:])
+	var sum [32]byte
+	h.Sum(sum[:0])
+	return sum
+}
+
+// solveRegisterWork finds a nonce for challenge with at least
+// workBits leading zero bits.
+func solveRegisterWork(serverKey ed25519.PublicKey, loginKey ed25519.PublicKey, challenge []byte, workBits int) *RegisterWork {
+	work := &RegisterWork{Challenge: challenge}
+	for leadingZeros(registerWorkHash(serverKey, loginKey, work)) < workBits {
+		work.Nonce++
+	}
+	return work
+}
+
+// requiredWork returns the number of bits a server asked for in an
+// ErrWorkRequired error, or 0 if err is not one.
+func requiredWork(err error) int {
+	e, ok := err.(Error)
+	if !ok || e.Code != ErrWorkRequired {
+		return 0
+	}
+	n, _ := strconv.Atoi(e.Message)
+	return n
+}
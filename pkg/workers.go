@@ -0,0 +1,81 @@
+// Copyright 2018 David Lazar. All rights reserved.
+// Use of this source code is governed by the GNU AGPL
+// license that can be found in the LICENSE file.
+
+//go:build !js
+// +build !js
+
+package pkg
+
+import (
+	"sync"
+	"time"
+
+	"vuvuzela.io/alpenhorn/internal/metrics"
+)
+
+// Extractions are CPU-bound on pairing operations. Instead of every
+// request's goroutine computing at once, the pairing operations run on
+// a fixed pool of workers, one per CPU by default, and requests wait
+// in a queue for a free worker. A burst of extractions then keeps all
+// cores busy without the scheduler juggling thousands of goroutines
+// that each hold a partly computed key.
+
+type workerPool struct {
+	jobs chan func()
+	done chan struct{}
+	once sync.Once
+
+	depth *metrics.Gauge
+	wait  *metrics.Histogram
+}
+
+func newWorkerPool(workers int, depth *metrics.Gauge, wait *metrics.Histogram) *workerPool {
+	p := &workerPool{
+		jobs:  make(chan func()),
+		done:  make(chan struct{}),
+		depth: depth,
+		wait:  wait,
+	}
+	for i := 0; i < workers; i++ {
+		go p.work()
+	}
+	return p
+}
+
+func (p *workerPool) work() {
+	for {
+		select {
+		case fn := <-p.jobs:
+			fn()
+		case <-p.done:
+			return
+		}
+	}
+}
+
+// do runs fn on a worker and waits for it to finish. Once the pool is
+// closed, do runs fn in the calling goroutine.
+func (p *workerPool) do(fn func()) {
+	finished := make(chan struct{})
+	job := func() {
+		defer close(finished)
+		fn()
+	}
+
+	p.depth.Add(1)
+	start := time.Now()
+	select {
+	case p.jobs <- job:
+		p.depth.Add(-1)
+		p.wait.Since(start)
+		<-finished
+	case <-p.done:
+		p.depth.Add(-1)
+		fn()
+	}
+}
+
+func (p *workerPool) close() {
+	p.once.Do(func() { close(p.done) })
+}
@@ -0,0 +1,57 @@
+// Copyright 2018 David Lazar. All rights reserved.
+// Use of this source code is governed by the GNU AGPL
+// license that can be found in the LICENSE file.
+
+package pkg
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"vuvuzela.io/alpenhorn/internal/metrics"
+)
+
+func TestWorkerPool(t *testing.T) {
+	r := metrics.NewRegistry()
+	depth := r.Gauge("depth", "")
+	wait := r.Histogram("wait", "", metrics.LatencyBuckets)
+	pool := newWorkerPool(2, depth, wait)
+
+	var mu sync.Mutex
+	var running, maxRunning, done int
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			pool.do(func() {
+				mu.Lock()
+				running++
+				if running > maxRunning {
+					maxRunning = running
+				}
+				mu.Unlock()
+				time.Sleep(time.Millisecond)
+				mu.Lock()
+				running--
+				done++
+				mu.Unlock()
+			})
+		}()
+	}
+	wg.Wait()
+	if done != 10 {
+		t.Fatalf("ran %d jobs, want 10", done)
+	}
+	if maxRunning > 2 {
+		t.Fatalf("%d jobs ran at once on 2 workers", maxRunning)
+	}
+
+	pool.close()
+	ran := false
+	pool.do(func() { ran = true })
+	if !ran {
+		t.Fatal("job did not run after close")
+	}
+}
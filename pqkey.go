@@ -0,0 +1,69 @@
+// Copyright 2018 David Lazar. All rights reserved.
+// Use of this source code is governed by the GNU AGPL
+// license that can be found in the LICENSE file.
+
+package alpenhorn
+
+import (
+	"bytes"
+	"crypto/mlkem"
+
+	"vuvuzela.io/alpenhorn/errors"
+	"vuvuzela.io/alpenhorn/pkg"
+)
+
+// Hybrid add-friend intros need the recipient's PQ key, which the
+// sender fetches from the PKGs in the round the request is sent. The
+// PKGs therefore learn who the sender is befriending (but not who the
+// sender is, beyond its network address). To hide whether a request
+// was sent at all, the client looks up its own key in cover rounds.
+
+// pqDecapsulationKeyLocked returns the client's ML-KEM key, generating
+// it if needed. It assumes c.mu is locked.
+func (c *Client) pqDecapsulationKeyLocked() *mlkem.DecapsulationKey768 {
+	if c.pqSeed == nil {
+		dk, err := mlkem.GenerateKey768()
+		if err != nil {
+			panic("mlkem.GenerateKey768: " + err.Error())
+		}
+		c.pqSeed = dk.Bytes()
+		return dk
+	}
+	dk, err := mlkem.NewDecapsulationKey768(c.pqSeed)
+	if err != nil {
+		panic("invalid persisted PQ seed: " + err.Error())
+	}
+	return dk
+}
+
+// lookupPQKey fetches username's PQ key from every PKG and requires
+// that they all agree.
+func (c *Client) lookupPQKey(servers []pkg.PublicServerConfig, username string) ([]byte, error) {
+	pkgClient := &pkg.Client{
+		HTTPClient: c.edhttpClient,
+	}
+	var key []byte
+	for _, server := range servers {
+		k, err := pkgClient.LookupPQKey(server, username)
+		if err != nil {
+			return nil, errors.Wrap(err, "looking up PQ key for %q at PKG %s", username, server.Address)
+		}
+		if key == nil {
+			key = k
+		} else if !bytes.Equal(key, k) {
+			return nil, errors.New("PKGs disagree on the PQ key for %q", username)
+		}
+	}
+	if key == nil {
+		return nil, errors.New("no PKGs to look up PQ key for %q", username)
+	}
+	return key, nil
+}
+
+// requeueFriendRequest puts a request that could not be sent back at
+// the front of the outgoing queue.
+func (c *Client) requeueFriendRequest(req *OutgoingFriendRequest) {
+	c.mu.Lock()
+	c.outgoingFriendRequests = append([]*OutgoingFriendRequest{req}, c.outgoingFriendRequests...)
+	c.mu.Unlock()
+}
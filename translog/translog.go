@@ -0,0 +1,265 @@
+// Copyright 2018 David Lazar. All rights reserved.
+// Use of this source code is governed by the GNU AGPL
+// license that can be found in the LICENSE file.
+
+// Package translog implements append-only Merkle tree logs in the
+// style of Certificate Transparency (RFC 6962). A log server appends
+// leaves and serves signed tree heads along with inclusion proofs
+// (a leaf is in the tree) and consistency proofs (an older tree is a
+// prefix of a newer one). Clients verify the proofs without trusting
+// the server, so a server that shows different histories to different
+// clients can be caught.
+//
+// The server stores the hash of every complete (perfect) subtree.
+// Appending a leaf writes O(log n) nodes, and root hashes and proofs
+// read O(log n) nodes.
+package translog
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"math/bits"
+
+	"vuvuzela.io/alpenhorn/errors"
+)
+
+// HashSize is the size of leaf, node, and root hashes.
+const HashSize = sha256.Size
+
+// LeafHash returns the hash of a leaf with the given data.
+func LeafHash(data []byte) []byte {
+	h := sha256.New()
+	h.Write([]byte{0})
+	h.Write(data)
+	return h.Sum(nil)
+}
+
+// NodeHash returns the hash of an interior node.
+func NodeHash(left, right []byte) []byte {
+	h := sha256.New()
+	h.Write([]byte{1})
+	h.Write(left)
+	h.Write(right)
+	return h.Sum(nil)
+}
+
+// EmptyRootHash is the root hash of the empty tree.
+func EmptyRootHash() []byte {
+	h := sha256.Sum256(nil)
+	return h[:]
+}
+
+// A Node is the hash of the perfect subtree of 2^Level leaves starting
+// at leaf Index<<Level.
+type Node struct {
+	Level uint8
+	Index uint64
+	Hash  []byte
+}
+
+// A NodeReader returns the hash of a stored node.
+type NodeReader func(level uint8, index uint64) ([]byte, error)
+
+// AppendNodes returns the nodes to store when appending leafHash to a
+// tree of the given size: the leaf itself and every subtree the leaf
+// completes.
+func AppendNodes(read NodeReader, size uint64, leafHash []byte) ([]Node, error) {
+	nodes := []Node{{Level: 0, Index: size, Hash: leafHash}}
+	h := leafHash
+	index := size
+	for level := uint8(0); index&1 == 1; level++ {
+		left, err := read(level, index-1)
+		if err != nil {
+			return nil, err
+		}
+		h = NodeHash(left, h)
+		index >>= 1
+		nodes = append(nodes, Node{Level: level + 1, Index: index, Hash: h})
+	}
+	return nodes, nil
+}
+
+// RootHash returns the root hash of the tree with the given size.
+func RootHash(read NodeReader, size uint64) ([]byte, error) {
+	if size == 0 {
+		return EmptyRootHash(), nil
+	}
+	return subtreeHash(read, 0, size)
+}
+
+// subtreeHash returns the hash of leaves [start, end). As in RFC 6962,
+// the tree splits at the largest power of two smaller than its size,
+// so start is always aligned to the size of the subtree.
+func subtreeHash(read NodeReader, start, end uint64) ([]byte, error) {
+	n := end - start
+	if n&(n-1) == 0 {
+		level := uint8(bits.TrailingZeros64(n))
+		return read(level, start>>level)
+	}
+	k := splitPoint(n)
+	left, err := subtreeHash(read, start, start+k)
+	if err != nil {
+		return nil, err
+	}
+	right, err := subtreeHash(read, start+k, end)
+	if err != nil {
+		return nil, err
+	}
+	return NodeHash(left, right), nil
+}
+
+// splitPoint returns the largest power of two smaller than n > 1.
+func splitPoint(n uint64) uint64 {
+	return 1 << uint(bits.Len64(n-1)-1)
+}
+
+// InclusionProof returns the audit path for the leaf at index in the
+// tree with the given size.
+func InclusionProof(read NodeReader, index, size uint64) ([][]byte, error) {
+	if index >= size {
+		return nil, errors.New("leaf %d is not in a tree of size %d", index, size)
+	}
+	return inclusionPath(read, index, 0, size)
+}
+
+func inclusionPath(read NodeReader, index, start, end uint64) ([][]byte, error) {
+	n := end - start
+	if n == 1 {
+		return nil, nil
+	}
+	k := splitPoint(n)
+	var path [][]byte
+	var sibling []byte
+	var err error
+	if index < start+k {
+		path, err = inclusionPath(read, index, start, start+k)
+		if err == nil {
+			sibling, err = subtreeHash(read, start+k, end)
+		}
+	} else {
+		path, err = inclusionPath(read, index, start+k, end)
+		if err == nil {
+			sibling, err = subtreeHash(read, start, start+k)
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	return append(path, sibling), nil
+}
+
+// ConsistencyProof returns a proof that the tree of size first is a
+// prefix of the tree of size second.
+func ConsistencyProof(read NodeReader, first, second uint64) ([][]byte, error) {
+	if first > second {
+		return nil, errors.New("tree size %d is larger than %d", first, second)
+	}
+	if first == 0 || first == second {
+		return nil, nil
+	}
+	return subproof(read, first, 0, second, true)
+}
+
+func subproof(read NodeReader, m, start, end uint64, complete bool) ([][]byte, error) {
+	n := end - start
+	if m == n {
+		if complete {
+			return nil, nil
+		}
+		h, err := subtreeHash(read, start, end)
+		if err != nil {
+			return nil, err
+		}
+		return [][]byte{h}, nil
+	}
+	k := splitPoint(n)
+	var proof [][]byte
+	var sibling []byte
+	var err error
+	if m <= k {
+		proof, err = subproof(read, m, start, start+k, complete)
+		if err == nil {
+			sibling, err = subtreeHash(read, start+k, end)
+		}
+	} else {
+		proof, err = subproof(read, m-k, start+k, end, false)
+		if err == nil {
+			sibling, err = subtreeHash(read, start, start+k)
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	return append(proof, sibling), nil
+}
+
+// VerifyInclusion reports whether proof shows that leafHash is the
+// leaf at index in the tree with the given size and root hash.
+func VerifyInclusion(leafHash []byte, index, size uint64, proof [][]byte, root []byte) bool {
+	if index >= size {
+		return false
+	}
+	fn, sn := index, size-1
+	r := leafHash
+	for _, p := range proof {
+		if sn == 0 {
+			return false
+		}
+		if fn&1 == 1 || fn == sn {
+			r = NodeHash(p, r)
+			for fn&1 == 0 && fn != 0 {
+				fn >>= 1
+				sn >>= 1
+			}
+		} else {
+			r = NodeHash(r, p)
+		}
+		fn >>= 1
+		sn >>= 1
+	}
+	return sn == 0 && bytes.Equal(r, root)
+}
+
+// VerifyConsistency reports whether proof shows that the tree of size
+// first with root firstRoot is a prefix of the tree of size second
+// with root secondRoot.
+func VerifyConsistency(first, second uint64, firstRoot, secondRoot []byte, proof [][]byte) bool {
+	switch {
+	case first > second:
+		return false
+	case first == second:
+		return len(proof) == 0 && bytes.Equal(firstRoot, secondRoot)
+	case first == 0:
+		return len(proof) == 0
+	case len(proof) == 0:
+		return false
+	}
+
+	if first&(first-1) == 0 {
+		proof = append([][]byte{firstRoot}, proof...)
+	}
+	fn, sn := first-1, second-1
+	for fn&1 == 1 {
+		fn >>= 1
+		sn >>= 1
+	}
+	fr, sr := proof[0], proof[0]
+	for _, c := range proof[1:] {
+		if sn == 0 {
+			return false
+		}
+		if fn&1 == 1 || fn == sn {
+			fr = NodeHash(c, fr)
+			sr = NodeHash(c, sr)
+			for fn&1 == 0 && fn != 0 {
+				fn >>= 1
+				sn >>= 1
+			}
+		} else {
+			sr = NodeHash(sr, c)
+		}
+		fn >>= 1
+		sn >>= 1
+	}
+	return sn == 0 && bytes.Equal(fr, firstRoot) && bytes.Equal(sr, secondRoot)
+}
@@ -0,0 +1,107 @@
+// Copyright 2018 David Lazar. All rights reserved.
+// Use of this source code is governed by the GNU AGPL
+// license that can be found in the LICENSE file.
+
+package translog
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+)
+
+type memTree struct {
+	nodes  map[[2]uint64][]byte
+	leaves [][]byte
+}
+
+func (t *memTree) read(level uint8, index uint64) ([]byte, error) {
+	h, ok := t.nodes[[2]uint64{uint64(level), index}]
+	if !ok {
+		return nil, fmt.Errorf("missing node %d/%d", level, index)
+	}
+	return h, nil
+}
+
+func (t *memTree) append(data []byte) error {
+	leaf := LeafHash(data)
+	nodes, err := AppendNodes(t.read, uint64(len(t.leaves)), leaf)
+	if err != nil {
+		return err
+	}
+	for _, n := range nodes {
+		t.nodes[[2]uint64{uint64(n.Level), n.Index}] = n.Hash
+	}
+	t.leaves = append(t.leaves, leaf)
+	return nil
+}
+
+// naiveRoot is the RFC 6962 definition of the tree hash.
+func naiveRoot(leaves [][]byte) []byte {
+	switch len(leaves) {
+	case 0:
+		return EmptyRootHash()
+	case 1:
+		return leaves[0]
+	}
+	k := splitPoint(uint64(len(leaves)))
+	return NodeHash(naiveRoot(leaves[:k]), naiveRoot(leaves[k:]))
+}
+
+func TestTree(t *testing.T) {
+	tree := &memTree{nodes: make(map[[2]uint64][]byte)}
+	roots := [][]byte{EmptyRootHash()}
+	for i := 0; i < 40; i++ {
+		if err := tree.append([]byte{byte(i)}); err != nil {
+			t.Fatal(err)
+		}
+		root, err := RootHash(tree.read, uint64(len(tree.leaves)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := naiveRoot(tree.leaves); !bytes.Equal(root, want) {
+			t.Fatalf("size %d: root %x, want %x", len(tree.leaves), root, want)
+		}
+		roots = append(roots, root)
+	}
+
+	for size := uint64(1); size < uint64(len(roots)); size++ {
+		for index := uint64(0); index < size; index++ {
+			proof, err := InclusionProof(tree.read, index, size)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !VerifyInclusion(tree.leaves[index], index, size, proof, roots[size]) {
+				t.Fatalf("inclusion proof failed: index=%d size=%d", index, size)
+			}
+			if VerifyInclusion(tree.leaves[index], index, size, proof, roots[size-1]) {
+				t.Fatalf("inclusion proof verified against wrong root: index=%d size=%d", index, size)
+			}
+			other := tree.leaves[(index+1)%uint64(len(tree.leaves))]
+			if VerifyInclusion(other, index, size, proof, roots[size]) {
+				t.Fatalf("inclusion proof verified wrong leaf: index=%d size=%d", index, size)
+			}
+		}
+	}
+
+	for second := uint64(0); second < uint64(len(roots)); second++ {
+		for first := uint64(0); first <= second; first++ {
+			proof, err := ConsistencyProof(tree.read, first, second)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !VerifyConsistency(first, second, roots[first], roots[second], proof) {
+				t.Fatalf("consistency proof failed: %d -> %d", first, second)
+			}
+			if first > 0 && first < second {
+				bad := LeafHash([]byte("bad"))
+				if VerifyConsistency(first, second, bad, roots[second], proof) {
+					t.Fatalf("consistency proof verified wrong old root: %d -> %d", first, second)
+				}
+				if VerifyConsistency(first, second, roots[first], bad, proof) {
+					t.Fatalf("consistency proof verified wrong new root: %d -> %d", first, second)
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,203 @@
+//go:build js
+// +build js
+
+package typesocket
+
+import (
+	"crypto/ed25519"
+	"encoding/json"
+	"errors"
+	"strconv"
+	"sync"
+	"syscall/js"
+	"time"
+
+	"vuvuzela.io/alpenhorn/internal/wire"
+	"vuvuzela.io/alpenhorn/log"
+)
+
+// In the browser, ClientConn uses the browser's WebSocket API. The
+// browser does its own TLS, so the connection is authenticated by the
+// server's web PKI certificate rather than by peerKey, and the server
+// must be reachable at addr with a certificate the browser trusts.
+// CountTraffic only counts websocket message payloads.
+
+type ClientConn struct {
+	// Logger is used for the connection's log messages. The standard
+	// logger is used if Logger is nil.
+	Logger *log.Logger
+
+	ws    js.Value
+	count func(sent, received int)
+	funcs []js.Func
+
+	mu       sync.Mutex
+	queue    []jsMessage
+	closeErr error
+	notify   chan struct{}
+}
+
+type jsMessage struct {
+	data   []byte
+	binary bool
+}
+
+var errClosed = errors.New("websocket closed")
+
+func (d *Dialer) Dial(addr string, peerKey ed25519.PublicKey) (*ClientConn, error) {
+	ws := js.Global().Get("WebSocket").New(addr, []interface{}{wire.Subprotocol})
+	ws.Set("binaryType", "arraybuffer")
+
+	c := &ClientConn{
+		ws:     ws,
+		count:  d.CountTraffic,
+		notify: make(chan struct{}, 1),
+	}
+	opened := make(chan error, 1)
+	c.on("open", func(js.Value) {
+		select {
+		case opened <- nil:
+		default:
+		}
+	})
+	c.on("close", func(event js.Value) {
+		err := errors.New("websocket closed: code " + strconv.Itoa(event.Get("code").Int()))
+		select {
+		case opened <- err:
+		default:
+		}
+		c.push(nil, err)
+	})
+	c.on("message", func(event js.Value) {
+		data := event.Get("data")
+		var msg jsMessage
+		if data.Type() == js.TypeString {
+			msg.data = []byte(data.String())
+		} else {
+			buf := js.Global().Get("Uint8Array").New(data)
+			msg.data = make([]byte, buf.Length())
+			js.CopyBytesToGo(msg.data, buf)
+			msg.binary = true
+		}
+		if c.count != nil {
+			c.count(0, len(msg.data))
+		}
+		c.push(&msg, nil)
+	})
+
+	select {
+	case err := <-opened:
+		if err != nil {
+			c.release()
+			return nil, err
+		}
+	case <-time.After(10 * time.Second):
+		c.Close()
+		return nil, errors.New("websocket handshake timed out")
+	}
+	return c, nil
+}
+
+// on registers a handler for a WebSocket event. Handlers run on the
+// browser's event loop, so they must not block.
+func (c *ClientConn) on(event string, fn func(js.Value)) {
+	f := js.FuncOf(func(this js.Value, args []js.Value) interface{} {
+		fn(args[0])
+		return nil
+	})
+	c.funcs = append(c.funcs, f)
+	c.ws.Call("addEventListener", event, f)
+}
+
+func (c *ClientConn) release() {
+	for _, f := range c.funcs {
+		f.Release()
+	}
+	c.funcs = nil
+}
+
+// push queues a message, or records that the connection closed,
+// without blocking.
+func (c *ClientConn) push(msg *jsMessage, err error) {
+	c.mu.Lock()
+	if msg != nil {
+		c.queue = append(c.queue, *msg)
+	}
+	if err != nil && c.closeErr == nil {
+		c.closeErr = err
+	}
+	c.mu.Unlock()
+	select {
+	case c.notify <- struct{}{}:
+	default:
+	}
+}
+
+// next returns the next message, waiting until one arrives or the
+// connection closes.
+func (c *ClientConn) next() (jsMessage, error) {
+	for {
+		c.mu.Lock()
+		if len(c.queue) > 0 {
+			msg := c.queue[0]
+			c.queue = c.queue[1:]
+			c.mu.Unlock()
+			return msg, nil
+		}
+		err := c.closeErr
+		c.mu.Unlock()
+		if err != nil {
+			return jsMessage{}, err
+		}
+		<-c.notify
+	}
+}
+
+func (c *ClientConn) Close() error {
+	// 1001 is the "going away" close code.
+	c.ws.Call("close", 1001)
+	c.push(nil, errClosed)
+	return nil
+}
+
+func (c *ClientConn) Send(msgID string, v interface{}) error {
+	e, err := newEnvelope(msgID, v)
+	if err != nil {
+		return err
+	}
+	data, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+
+	c.mu.Lock()
+	closed := c.closeErr
+	c.mu.Unlock()
+	if closed != nil {
+		return closed
+	}
+
+	c.ws.Call("send", string(data))
+	if c.count != nil {
+		c.count(len(data), 0)
+	}
+	return nil
+}
+
+func (c *ClientConn) Serve(mux Mux) error {
+	defer c.release()
+	defer c.Close()
+
+	for {
+		msg, err := c.next()
+		if err != nil {
+			return err
+		}
+		e, err := decodeEnvelope(msg.data, msg.binary)
+		if err != nil {
+			logger(c.Logger).WithFields(log.Fields{"call": "decodeEnvelope"}).Error(err)
+			return err
+		}
+		go mux.openEnvelope(c, e)
+	}
+}
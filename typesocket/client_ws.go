@@ -0,0 +1,118 @@
+//go:build !js
+// +build !js
+
+package typesocket
+
+import (
+	"context"
+	"crypto/ed25519"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+
+	"vuvuzela.io/alpenhorn/edtls"
+	"vuvuzela.io/alpenhorn/internal/happyeyeballs"
+	"vuvuzela.io/alpenhorn/internal/meter"
+	"vuvuzela.io/alpenhorn/internal/wire"
+	"vuvuzela.io/alpenhorn/log"
+)
+
+type ClientConn struct {
+	// Logger is used for the connection's log messages. The standard
+	// logger is used if Logger is nil.
+	Logger *log.Logger
+
+	mu sync.Mutex
+	ws *websocket.Conn
+}
+
+func (d *Dialer) Dial(addr string, peerKey ed25519.PublicKey) (*ClientConn, error) {
+	tlsConfig := edtls.NewTLSClientConfig(nil, peerKey)
+
+	dialer := &websocket.Dialer{
+		NetDialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			conn, err := happyeyeballs.DialContext(ctx, network, addr)
+			if err != nil {
+				return nil, err
+			}
+			return meter.Conn(conn, d.CountTraffic), nil
+		},
+		TLSClientConfig:  tlsConfig,
+		HandshakeTimeout: 10 * time.Second,
+
+		// Servers that do not know the binary subprotocol
+		// ignore it and send JSON.
+		Subprotocols: []string{wire.Subprotocol},
+	}
+	ws, _, err := dialer.Dial(addr, nil)
+	if err != nil {
+		return nil, err
+	}
+	conn := &ClientConn{
+		ws: ws,
+	}
+
+	ws.SetReadDeadline(time.Now().Add(pongWait))
+	ws.SetPingHandler(conn.pingHandler)
+
+	return conn, nil
+}
+
+func (c *ClientConn) pingHandler(message string) error {
+	c.ws.SetReadDeadline(time.Now().Add(pongWait))
+	// The code below is copied from the default ping handler.
+	err := c.ws.WriteControl(websocket.PongMessage, []byte(message), time.Now().Add(writeWait))
+	if err == websocket.ErrCloseSent {
+		return nil
+	} else if e, ok := err.(net.Error); ok && e.Temporary() {
+		return nil
+	}
+	return err
+}
+
+func (c *ClientConn) Close() error {
+	c.mu.Lock()
+	c.ws.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseGoingAway, ""))
+	c.mu.Unlock()
+
+	return c.ws.Close()
+}
+
+func (c *ClientConn) Send(msgID string, v interface{}) error {
+	e, err := newEnvelope(msgID, v)
+	if err != nil {
+		return err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.ws.SetWriteDeadline(time.Now().Add(writeWait))
+	if err := c.ws.WriteJSON(e); err != nil {
+		logger(c.Logger).WithFields(log.Fields{"call": "WriteJSON"}).Error(err)
+		return err
+	}
+
+	return nil
+}
+
+func (c *ClientConn) Serve(mux Mux) error {
+	defer c.Close()
+
+	for {
+		mt, data, err := c.ws.ReadMessage()
+		if err != nil {
+			if websocket.IsCloseError(err, websocket.CloseGoingAway) {
+				return err
+			}
+			return err
+		}
+		e, err := decodeEnvelope(data, mt == websocket.BinaryMessage)
+		if err != nil {
+			return err
+		}
+		go mux.openEnvelope(c, e)
+	}
+}
@@ -9,6 +9,7 @@ import (
 
 	"github.com/gorilla/websocket"
 
+	"vuvuzela.io/alpenhorn/internal/wire"
 	"vuvuzela.io/alpenhorn/log"
 )
 
@@ -35,15 +36,29 @@ type Hub struct {
 	// OnConnect is called when a client connects to the server.
 	OnConnect func(Conn) error
 
+	// Logger is used for the hub's log messages. The standard logger
+	// is used if Logger is nil.
+	Logger *log.Logger
+
 	mu    sync.Mutex
 	conns map[*serverConn]bool
 }
 
+func logger(l *log.Logger) *log.Logger {
+	if l == nil {
+		return log.StdLogger
+	}
+	return l
+}
+
 type serverConn struct {
 	hub  *Hub
 	conn *websocket.Conn
 	send chan []byte
 
+	// binary is set if the client negotiated the binary subprotocol.
+	binary bool
+
 	mu     sync.Mutex
 	closed bool
 }
@@ -74,9 +89,9 @@ func (c *serverConn) readPump() {
 			case websocket.IsCloseError(err, websocket.CloseGoingAway):
 				// all good
 			case websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway):
-				log.Errorf("hub: unexpected close error: %v", err)
+				logger(c.hub.Logger).Errorf("hub: unexpected close error: %v", err)
 			default:
-				log.Errorf("hub: ReadJSON error: %s", err)
+				logger(c.hub.Logger).Errorf("hub: ReadJSON error: %s", err)
 			}
 			break
 		}
@@ -107,20 +122,24 @@ func (c *serverConn) writePump() {
 			}
 
 			c.conn.SetWriteDeadline(time.Now().Add(writeWait))
-			w, err := c.conn.NextWriter(websocket.TextMessage)
+			mt := websocket.TextMessage
+			if c.binary {
+				mt = websocket.BinaryMessage
+			}
+			w, err := c.conn.NextWriter(mt)
 			if err != nil {
-				log.Errorf("hub: write error: %s", err)
+				logger(c.hub.Logger).Errorf("hub: write error: %s", err)
 				return
 			}
 			w.Write(message)
 
 			if err := w.Close(); err != nil {
-				log.Errorf("hub: write (close) error: %s", err)
+				logger(c.hub.Logger).Errorf("hub: write (close) error: %s", err)
 				return
 			}
 		case <-ticker.C:
 			if err := c.write(websocket.PingMessage, []byte{}); err != nil {
-				log.Errorf("hub: write (ping) error: %s", err)
+				logger(c.hub.Logger).Errorf("hub: write (ping) error: %s", err)
 				return
 			}
 		}
@@ -128,7 +147,13 @@ func (c *serverConn) writePump() {
 }
 
 func (c *serverConn) Send(msgID string, v interface{}) error {
-	msg, err := encodeMessage(msgID, v)
+	var msg []byte
+	var err error
+	if c.binary {
+		msg, err = encodeBinaryMessage(msgID, v)
+	} else {
+		msg, err = encodeMessage(msgID, v)
+	}
 	if err != nil {
 		return err
 	}
@@ -159,6 +184,7 @@ func (c *serverConn) Close() error {
 var upgrader = websocket.Upgrader{
 	ReadBufferSize:  4096,
 	WriteBufferSize: 4096,
+	Subprotocols:    []string{wire.Subprotocol},
 }
 
 func (h *Hub) ServeHTTP(w http.ResponseWriter, r *http.Request) {
@@ -169,14 +195,15 @@ func (h *Hub) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 
 	ws, err := upgrader.Upgrade(w, r, nil)
 	if err != nil {
-		log.Errorf("hub: Upgrade error: %s", err)
+		logger(h.Logger).Errorf("hub: Upgrade error: %s", err)
 		return
 	}
 
 	c := &serverConn{
-		hub:  h,
-		conn: ws,
-		send: make(chan []byte, 64),
+		hub:    h,
+		conn:   ws,
+		send:   make(chan []byte, 64),
+		binary: ws.Subprotocol() == wire.Subprotocol,
 	}
 	h.register(c)
 
@@ -215,6 +242,7 @@ func (h *Hub) Broadcast(msgID string, v interface{}) error {
 	if err != nil {
 		return err
 	}
+	var binaryMsg []byte
 
 	h.mu.Lock()
 	defer h.mu.Unlock()
@@ -226,6 +254,18 @@ func (h *Hub) Broadcast(msgID string, v interface{}) error {
 			continue
 		}
 
+		msg := msg
+		if conn.binary {
+			if binaryMsg == nil {
+				binaryMsg, err = encodeBinaryMessage(msgID, v)
+				if err != nil {
+					conn.mu.Unlock()
+					return err
+				}
+			}
+			msg = binaryMsg
+		}
+
 		select {
 		case conn.send <- msg:
 		default:
@@ -1,8 +1,11 @@
 package typesocket
 
 import (
+	"encoding"
 	"encoding/json"
 	"reflect"
+
+	"vuvuzela.io/alpenhorn/internal/wire"
 )
 
 type Mux map[string]*muxEntry
@@ -31,8 +34,14 @@ func NewMux(handlers map[string]interface{}) Mux {
 type envelope struct {
 	ID      string
 	Message json.RawMessage
+
+	// Binary is set if Message is in the wire encoding
+	// instead of JSON.
+	Binary bool `json:"-"`
 }
 
+const binaryEnvelopeVersion byte = 1
+
 func encodeMessage(msgID string, v interface{}) ([]byte, error) {
 	rawMsg, err := json.Marshal(v)
 	if err != nil {
@@ -50,6 +59,44 @@ func encodeMessage(msgID string, v interface{}) ([]byte, error) {
 	return msgBytes, nil
 }
 
+// encodeBinaryMessage encodes a message for connections that
+// negotiated the binary subprotocol. Messages whose type does not
+// implement encoding.BinaryMarshaler are sent as JSON inside the
+// binary envelope.
+func encodeBinaryMessage(msgID string, v interface{}) ([]byte, error) {
+	var rawMsg []byte
+	var err error
+	m, isBinary := v.(encoding.BinaryMarshaler)
+	if isBinary {
+		rawMsg, err = m.MarshalBinary()
+	} else {
+		rawMsg, err = json.Marshal(v)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	w := wire.NewWriter(binaryEnvelopeVersion)
+	w.PutString(msgID)
+	if isBinary {
+		w.PutByte(1)
+	} else {
+		w.PutByte(0)
+	}
+	w.PutBytes(rawMsg)
+	return w.Data(), nil
+}
+
+func decodeBinaryEnvelope(data []byte) (*envelope, error) {
+	r := wire.NewReader(binaryEnvelopeVersion, data)
+	e := &envelope{
+		ID:     r.Text(),
+		Binary: r.Byte() == 1,
+	}
+	e.Message = r.Bytes()
+	return e, r.Err()
+}
+
 func (m Mux) openEnvelope(conn Conn, e *envelope) {
 	h := m[e.ID]
 	if h == nil {
@@ -57,7 +104,11 @@ func (m Mux) openEnvelope(conn Conn, e *envelope) {
 	}
 
 	arg := reflect.New(h.argType)
-	if err := json.Unmarshal(e.Message, arg.Interface()); err != nil {
+	if u, ok := arg.Interface().(encoding.BinaryUnmarshaler); ok && e.Binary {
+		if err := u.UnmarshalBinary(e.Message); err != nil {
+			return
+		}
+	} else if err := json.Unmarshal(e.Message, arg.Interface()); err != nil {
 		return
 	}
 
@@ -72,3 +72,84 @@ func TestTypeSocket(t *testing.T) {
 		t.Fatal("timeout")
 	}
 }
+
+type binaryPing struct {
+	Count byte
+}
+
+func (p binaryPing) MarshalBinary() ([]byte, error) {
+	return []byte{'b', p.Count}, nil
+}
+
+func (p *binaryPing) UnmarshalBinary(data []byte) error {
+	if len(data) != 2 || data[0] != 'b' {
+		return fmt.Errorf("not a binary ping: %q", data)
+	}
+	p.Count = data[1]
+	return nil
+}
+
+func TestBinaryMessages(t *testing.T) {
+	serverPublic, serverPrivate, _ := ed25519.GenerateKey(rand.Reader)
+
+	hub := &Hub{
+		Mux: NewMux(map[string]interface{}{}),
+	}
+	connected := make(chan Conn, 1)
+	hub.OnConnect = func(c Conn) error {
+		connected <- c
+		return nil
+	}
+	l, err := edtls.Listen("tcp", "127.0.0.1:0", serverPrivate)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go http.Serve(l, hub)
+
+	received := make(chan binaryPing, 2)
+	clientMux := NewMux(map[string]interface{}{
+		"Ping": func(c Conn, p binaryPing) {
+			received <- p
+		},
+		"JSONPing": func(c Conn, p Ping) {
+			received <- binaryPing{Count: byte(p.Count)}
+		},
+	})
+	conn, err := Dial(fmt.Sprintf("wss://%s/ws", l.Addr().String()), serverPublic)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go conn.Serve(clientMux)
+	defer conn.Close()
+
+	var c Conn
+	select {
+	case c = <-connected:
+	case <-time.After(1 * time.Second):
+		t.Fatal("timeout waiting for connection")
+	}
+	if !c.(*serverConn).binary {
+		t.Fatal("client did not negotiate the binary subprotocol")
+	}
+	if err := c.Send("Ping", binaryPing{Count: 7}); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Send("JSONPing", Ping{Count: 8}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Messages are handled concurrently, so they may arrive in any order.
+	got := make(map[byte]bool)
+	for i := 0; i < 2; i++ {
+		select {
+		case p := <-received:
+			got[p.Count] = true
+		case <-time.After(1 * time.Second):
+			t.Fatal("timeout")
+		}
+	}
+	if !got[7] || !got[8] {
+		t.Fatalf("got counts %v, want 7 and 8", got)
+	}
+}
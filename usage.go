@@ -0,0 +1,92 @@
+// Copyright 2018 David Lazar. All rights reserved.
+// Use of this source code is governed by the GNU AGPL
+// license that can be found in the LICENSE file.
+
+package alpenhorn
+
+import (
+	"sync"
+	"time"
+
+	"vuvuzela.io/alpenhorn/internal/meter"
+)
+
+// Traffic is a count of bytes sent and received.
+type Traffic struct {
+	Sent     uint64
+	Received uint64
+}
+
+// DataUsage is the client's network traffic by category. Byte counts
+// are measured on the wire and include TLS, HTTP, and websocket
+// overhead. Applications can use them to show how much data Alpenhorn
+// uses, or to disconnect when a limit is reached.
+type DataUsage struct {
+	// PKG is traffic to the PKG servers: registration, key
+	// extraction, and key lookups.
+	PKG Traffic
+
+	// Coordinator is traffic on the add-friend and dialing
+	// connections to the coordinators, including onions.
+	Coordinator Traffic
+
+	// CDN is traffic to the CDN: mailbox downloads and PIR queries.
+	CDN Traffic
+
+	// Cover is the number of bytes of cover onions sent in rounds
+	// where the client had no friend request or call to send. It is
+	// part of Coordinator.Sent.
+	Cover uint64
+
+	// Since is when counting started: when the client first
+	// connected, or when the usage was last reset.
+	Since time.Time
+}
+
+// Total returns the client's total traffic.
+func (u DataUsage) Total() Traffic {
+	return Traffic{
+		Sent:     u.PKG.Sent + u.Coordinator.Sent + u.CDN.Sent,
+		Received: u.PKG.Received + u.Coordinator.Received + u.CDN.Received,
+	}
+}
+
+type usageCounters struct {
+	mu          sync.Mutex
+	since       time.Time
+	pkg         meter.Counter
+	coordinator meter.Counter
+	cdn         meter.Counter
+	cover       meter.Counter
+}
+
+func (u *usageCounters) snapshot(load func(*meter.Counter) (uint64, uint64)) DataUsage {
+	usage := DataUsage{Since: u.since}
+	usage.PKG.Sent, usage.PKG.Received = load(&u.pkg)
+	usage.Coordinator.Sent, usage.Coordinator.Received = load(&u.coordinator)
+	usage.CDN.Sent, usage.CDN.Received = load(&u.cdn)
+	usage.Cover, _ = load(&u.cover)
+	return usage
+}
+
+// DataUsage returns the client's network traffic since it started
+// counting.
+func (c *Client) DataUsage() DataUsage {
+	c.init()
+	c.usage.mu.Lock()
+	defer c.usage.mu.Unlock()
+	return c.usage.snapshot((*meter.Counter).Load)
+}
+
+// ResetDataUsage returns the client's network traffic and resets the
+// counts to zero. No traffic is lost between the returned usage and
+// the next one, so applications can keep their own running totals,
+// for example per billing period or across restarts.
+func (c *Client) ResetDataUsage() DataUsage {
+	c.init()
+	c.usage.mu.Lock()
+	defer c.usage.mu.Unlock()
+	usage := c.usage.snapshot((*meter.Counter).Reset)
+	c.usage.since = c.clock().Now()
+	return usage
+}